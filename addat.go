@@ -0,0 +1,76 @@
+//go:build !appengine && (linux || freebsd || openbsd || netbsd || dragonfly || darwin)
+
+package fsnotify
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+func addAt(b fdAdder, dirfd int, relpath string, opts ...addOpt) error {
+	fd, err := openAt(dirfd, relpath)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	return b.addFd(fd, relpath, opts...)
+}
+
+// openAt opens relpath relative to dirfd one component at a time, without
+// following symlinks, for AddAt().
+func openAt(dirfd int, relpath string) (int, error) {
+	if strings.HasPrefix(relpath, "/") {
+		return -1, fmt.Errorf("fsnotify: path must be relative: %q", relpath)
+	}
+
+	parts := strings.Split(relpath, "/")
+	fd := dirfd
+	for i, p := range parts {
+		if p == ".." {
+			return -1, fmt.Errorf("fsnotify: path can't contain \"..\": %q", relpath)
+		}
+		if (p == "" || p == ".") && i < len(parts)-1 {
+			continue
+		}
+		if p == "" {
+			p = "."
+		}
+
+		flags := unix.O_RDONLY | unix.O_DIRECTORY | unix.O_NOFOLLOW | unix.O_CLOEXEC
+		if i == len(parts)-1 {
+			flags = openMode | unix.O_NOFOLLOW
+		}
+		next, err := openatRetry(fd, p, flags)
+		if fd != dirfd {
+			unix.Close(fd)
+		}
+		if err != nil {
+			return -1, &os.PathError{Op: "openat", Path: relpath, Err: err}
+		}
+		fd = next
+	}
+
+	// O_PATH opens the symlink itself with O_NOFOLLOW, rather than failing.
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		unix.Close(fd)
+		return -1, &os.PathError{Op: "fstat", Path: relpath, Err: err}
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		unix.Close(fd)
+		return -1, &os.PathError{Op: "openat", Path: relpath, Err: unix.ELOOP}
+	}
+	return fd, nil
+}
+
+func openatRetry(dirfd int, name string, flags int) (int, error) {
+	for {
+		fd, err := unix.Openat(dirfd, name, flags, 0)
+		if err != unix.EINTR {
+			return fd, err
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build appengine || (!linux && !freebsd && !openbsd && !netbsd && !dragonfly && !darwin)
+
+package fsnotify
+
+import "fmt"
+
+func addAt(b fdAdder, dirfd int, relpath string, opts ...addOpt) error {
+	return fmt.Errorf("%w: AddAt", xErrUnsupported)
+}
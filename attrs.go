@@ -0,0 +1,104 @@
+//go:build !appengine && (linux || freebsd || openbsd || netbsd || dragonfly || darwin)
+
+package fsnotify
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// Operations for the attributes that changed in a Chmod event.
+const attrOps = UnportableMode | UnportableOwner | UnportableTimes | UnportableXattr | UnportableACL |
+	UnportableLink | UnportableUnlink
+
+// fileAttrs are the attributes that are compared to get the attrOps.
+type fileAttrs struct {
+	mode     os.FileMode
+	uid, gid uint32
+	nlink    uint64
+	mtime    time.Time
+	xattr    uint64 // Checksum of the extended attributes; only with UnportableXattr.
+	acl      uint64 // Checksum of the ACL; only with UnportableACL.
+}
+
+// attrsOf gets the attributes for path, with fi from stat() or lstat(). The
+// extended attributes and ACL are only read if op has UnportableXattr or
+// UnportableACL.
+func attrsOf(path string, fi os.FileInfo, op Op) fileAttrs {
+	a := fileAttrs{mode: fi.Mode(), mtime: fi.ModTime()}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		a.uid, a.gid, a.nlink = st.Uid, st.Gid, uint64(st.Nlink)
+	}
+	if op.Has(UnportableXattr) {
+		a.xattr = xattrSum(path)
+	}
+	if op.Has(UnportableACL) {
+		a.acl = xattrSum(path, aclXattrs...)
+	}
+	return a
+}
+
+// changed gets the attrOps for the attributes that are different in prev.
+func (a fileAttrs) changed(prev fileAttrs) Op {
+	var op Op
+	if a.mode != prev.mode {
+		op |= UnportableMode
+	}
+	if a.uid != prev.uid || a.gid != prev.gid {
+		op |= UnportableOwner
+	}
+	if !a.mtime.Equal(prev.mtime) {
+		op |= UnportableTimes
+	}
+	if a.xattr != prev.xattr {
+		op |= UnportableXattr
+	}
+	if a.acl != prev.acl {
+		op |= UnportableACL
+	}
+	if !a.mode.IsDir() && a.nlink > prev.nlink {
+		op |= UnportableLink
+	} else if !a.mode.IsDir() && a.nlink < prev.nlink {
+		op |= UnportableUnlink
+	}
+	return op
+}
+
+// setLinks sets the link count in the Info for events with UnportableLink or
+// UnportableUnlink.
+func setLinks(e *Event, n uint64) {
+	if !e.Has(UnportableLink) && !e.Has(UnportableUnlink) {
+		return
+	}
+	if e.Info == nil {
+		e.Info = &EventInfo{}
+	}
+	e.Info.Links = n
+}
+
+// pollMeta is the metadata that's compared with PollMetadata, besides what's in
+// os.FileInfo.
+type pollMeta struct {
+	ino, nlink uint64
+	uid, gid   uint32
+}
+
+func pollMetaOf(fi os.FileInfo) pollMeta {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return pollMeta{ino: uint64(st.Ino), nlink: uint64(st.Nlink), uid: st.Uid, gid: st.Gid}
+	}
+	return pollMeta{}
+}
+
+// changed gets the operations for the change from m to cur.
+func (m pollMeta) changed(cur pollMeta, dir bool) Op {
+	var op Op
+	if m.ino != cur.ino && !dir {
+		op |= Write
+	}
+	if m.uid != cur.uid || m.gid != cur.gid || m.nlink != cur.nlink {
+		op |= Chmod
+	}
+	return op
+}
@@ -0,0 +1,13 @@
+//go:build appengine || (!linux && !freebsd && !openbsd && !netbsd && !dragonfly && !darwin && !plan9)
+
+package fsnotify
+
+import "os"
+
+// pollMeta is the metadata that's compared with PollMetadata, besides what's in
+// os.FileInfo. There isn't any on these platforms.
+type pollMeta struct{}
+
+func pollMetaOf(os.FileInfo) pollMeta { return pollMeta{} }
+
+func (m pollMeta) changed(cur pollMeta, dir bool) Op { return 0 }
@@ -0,0 +1,35 @@
+//go:build !appengine && plan9
+
+package fsnotify
+
+import (
+	"os"
+	"syscall"
+)
+
+// pollMeta is the metadata that's compared with PollMetadata, besides what's in
+// os.FileInfo. The qid version is incremented on every change, so this also
+// catches writes within the same second.
+type pollMeta struct {
+	path, vers uint64
+	uid, gid   string
+}
+
+func pollMetaOf(fi os.FileInfo) pollMeta {
+	if d, ok := fi.Sys().(*syscall.Dir); ok {
+		return pollMeta{path: d.Qid.Path, vers: uint64(d.Qid.Vers), uid: d.Uid, gid: d.Gid}
+	}
+	return pollMeta{}
+}
+
+// changed gets the operations for the change from m to cur.
+func (m pollMeta) changed(cur pollMeta, dir bool) Op {
+	var op Op
+	if (m.path != cur.path || m.vers != cur.vers) && !dir {
+		op |= Write
+	}
+	if m.uid != cur.uid || m.gid != cur.gid {
+		op |= Chmod
+	}
+	return op
+}
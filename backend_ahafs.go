@@ -0,0 +1,648 @@
+//go:build aix && !appengine
+
+// AHAFS backend for AIX.
+//
+// The Autonomic Health Advisor FileSystem is mounted on /aha (with "mount -v
+// ahafs /aha /aha"). A path is monitored by creating a .mon file for it below
+// the directory of an event producer, and writing the "wait specification" to
+// it:
+//
+//	/aha/fs/modFile.monFactory/path/to/file.mon       Writes, remove, rename.
+//	/aha/fs/modDir.monFactory/path/to/dir.mon         Entries created, removed.
+//	/aha/fs/modFileAttr.monFactory/path/to/file.mon   Mode, owner, ACL.
+//
+// The file becomes readable when an event happens, with something like:
+//
+//	BEGIN_EVENT_INFO
+//	TIME_tvsec=1291994300
+//	[..]
+//	RC_FROM_EVPROD=1000
+//	END_EVENT_INFO
+//
+// Only jfs and jfs2 are supported; other filesystems are polled, as is
+// everything if AHAFS isn't mounted.
+//
+// See "Autonomic Health Advisor FileSystem" in the AIX docs:
+// https://www.ibm.com/docs/en/aix/7.3?topic=management-autonomic-health-advisor-filesystem
+
+package fsnotify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/esvos/fsnotify/internal"
+	"golang.org/x/sys/unix"
+)
+
+const ahafsRoot = "/aha/fs"
+
+// The wait specification written to the .mon files; WAIT_IN_SELECT makes
+// poll() report the file as readable when there's an event.
+const ahafsWait = "CHANGED=YES;WAIT_TYPE=WAIT_IN_SELECT;INFO_LVL=1"
+
+// RC_FROM_EVPROD values, from <sys/ahafs_evProds.h>.
+const (
+	ahafsFileWrite     = 1000
+	ahafsFileMap       = 1001
+	ahafsFileRemove    = 1002
+	ahafsFileRename    = 1003
+	ahafsFileClear     = 1004
+	ahafsFileTrunc     = 1005
+	ahafsFileOverwrite = 1006
+	ahafsFileUnmount   = 1007
+
+	ahafsDirCreate     = 1000
+	ahafsDirRemove     = 1001
+	ahafsDirUnmount    = 1002
+	ahafsDirRemoveSelf = 1003
+)
+
+// Filesystems AHAFS can monitor; everything else is polled.
+var ahafsFilesystems = map[string]bool{"jfs": true, "jfs2": true}
+
+// Network filesystems, which are polled; AHAFS doesn't see changes made on
+// other systems for these (or anything at all for cifs).
+var pollFilesystems = map[string]bool{
+	"nfs": true, "nfs3": true, "nfs4": true, "stnfs": true, "cifs": true,
+	"autofs": true,
+}
+
+type ahafs struct {
+	Events chan Event
+	Errors chan error
+
+	aha       bool           // /aha is mounted.
+	noPolling bool           // WithNoPolling()
+	raw       func(RawEvent) // WithRawEvents()
+	poll      *poller
+
+	wakeR, wakeW int // Pipe to wake up the reader after Add() and Remove().
+
+	mu      sync.Mutex
+	watches map[string]*ahaWatch
+
+	done     chan struct{}
+	doneMu   sync.Mutex
+	doneResp chan struct{}
+}
+
+type ahaWatch struct {
+	path  string
+	op    Op
+	files map[string]struct{} // Directory entries; nil for files.
+	mons  []*ahaMon
+}
+
+// ahaMon is an open .mon file.
+type ahaMon struct {
+	w      *ahaWatch
+	evprod string // modFile, modDir, or modFileAttr.
+	fd     int    // -1 once closed.
+}
+
+func newBackend(ev chan Event, errs chan error) (backend, error) {
+	return newBufferedBackend(0, ev, errs, defaultWatcherOpts)
+}
+
+func newBufferedBackend(sz uint, ev chan Event, errs chan error, with watcherOpts) (backend, error) {
+	if with.external {
+		return nil, fmt.Errorf("%w: WithExternalLoop", xErrUnsupported)
+	}
+	if with.audit {
+		return nil, fmt.Errorf("%w: WithAudit", xErrUnsupported)
+	}
+	if with.ebpf {
+		return nil, fmt.Errorf("%w: WithEBPF", xErrUnsupported)
+	}
+
+	_, err := os.Stat(filepath.Join(ahafsRoot, "modFile.monFactory"))
+	aha := err == nil
+	if !aha && with.noPolling {
+		return nil, errors.New("fsnotify: AHAFS isn't mounted on /aha; mount it with \"mount -v ahafs /aha /aha\"")
+	}
+
+	var p [2]int
+	if err := unix.Pipe(p[:]); err != nil {
+		return nil, fmt.Errorf("fsnotify.NewWatcher: %w", err)
+	}
+	unix.CloseOnExec(p[0])
+	unix.CloseOnExec(p[1])
+	unix.SetNonblock(p[1], true)
+
+	w := &ahafs{
+		Events:    ev,
+		Errors:    errs,
+		aha:       aha,
+		noPolling: with.noPolling,
+		raw:       with.raw,
+		wakeR:     p[0],
+		wakeW:     p[1],
+		watches:   make(map[string]*ahaWatch),
+		done:      make(chan struct{}),
+		doneResp:  make(chan struct{}),
+	}
+	w.poll = newPoller(w.sendEvent, w.sendError, with.clock, with.pollWorkers)
+	go w.readEvents()
+	return w, nil
+}
+
+// Returns true if the event was sent, or false if watcher is closed.
+func (w *ahafs) sendEvent(e Event) bool {
+	select {
+	case <-w.done:
+		return false
+	case w.Events <- e:
+		return true
+	}
+}
+
+// Returns true if the error was sent, or false if watcher is closed.
+func (w *ahafs) sendError(err error) bool {
+	if err == nil {
+		return true
+	}
+	err = wrapError(w, "watch", "", err)
+	select {
+	case <-w.done:
+		return false
+	case w.Errors <- err:
+		return true
+	}
+}
+
+func (w *ahafs) isClosed() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// wake makes the reader pick up the changed list of watches.
+func (w *ahafs) wake() {
+	unix.Write(w.wakeW, []byte{0})
+}
+
+func (w *ahafs) Close() error {
+	w.doneMu.Lock()
+	if w.isClosed() {
+		w.doneMu.Unlock()
+		return nil
+	}
+	close(w.done)
+	w.doneMu.Unlock()
+
+	w.poll.stop()
+	w.wake()
+	<-w.doneResp
+	unix.Close(w.wakeW)
+
+	close(w.Events)
+	close(w.Errors)
+	return nil
+}
+
+func (w *ahafs) Add(name string) error { return w.AddWith(name) }
+
+func (w *ahafs) AddWith(name string, opts ...addOpt) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  AddWith(%q)\n",
+			time.Now().Format("15:04:05.000000000"), name)
+	}
+
+	with := getOptions(opts...)
+	if !w.xSupports(with.op) {
+		return fmt.Errorf("%w: %s", xErrUnsupported, with.op)
+	}
+	if _, recurse := recursivePath(name); recurse {
+		return fmt.Errorf("%w: recursive watches on AIX", xErrUnsupported)
+	}
+
+	name = filepath.Clean(name)
+	if with.poll {
+		return w.poll.addWith(name, with.op, "", virtualFilesystems[fsTypeName(name)], getPollConfig(with))
+	}
+	fstype := fsTypeName(name)
+	if !ahafsFilesystems[fstype] || !w.aha {
+		if w.noPolling {
+			return fmt.Errorf("%w: AHAFS can't watch %s filesystems", xErrUnsupported, fstype)
+		}
+		return w.poll.addWith(name, with.op, fstype, virtualFilesystems[fstype], getPollConfig(with))
+	}
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if isSpecial(fi.Mode()) {
+		return &FileTypeError{Path: name, Mode: fi.Mode().Type()}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if ww, ok := w.watches[name]; ok {
+		ww.op |= with.op
+		return nil
+	}
+	ww, err := w.newWatch(name, fi.IsDir(), with.op)
+	if err != nil {
+		return err
+	}
+	w.watches[name] = ww
+	w.wake()
+	return nil
+}
+
+// newWatch creates the .mon files for path.
+func (w *ahafs) newWatch(path string, dir bool, op Op) (*ahaWatch, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	ww := &ahaWatch{path: path, op: op}
+	evprods := []string{"modFile", "modFileAttr"}
+	if dir {
+		evprods[0] = "modDir"
+		ww.files, err = ahaList(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range evprods {
+		mon := filepath.Join(ahafsRoot, e+".monFactory", abs) + ".mon"
+		// AHAFS doesn't create the directories for the path.
+		if err := os.MkdirAll(filepath.Dir(mon), 0o755); err != nil {
+			ww.close()
+			return nil, err
+		}
+		fd, err := unix.Open(mon, unix.O_CREAT|unix.O_RDWR|unix.O_CLOEXEC, 0o644)
+		if err != nil {
+			ww.close()
+			if errors.Is(err, unix.EMFILE) {
+				return nil, &WatchLimitError{Sysctl: "RLIMIT_NOFILE", Limit: nofile(), Err: err}
+			}
+			return nil, &os.PathError{Op: "open", Path: mon, Err: err}
+		}
+		ww.mons = append(ww.mons, &ahaMon{w: ww, evprod: e, fd: fd})
+		if _, err := unix.Write(fd, []byte(ahafsWait)); err != nil {
+			ww.close()
+			return nil, &os.PathError{Op: "write", Path: mon, Err: err}
+		}
+	}
+	return ww, nil
+}
+
+// close closes the .mon files; the reader must be woken up after this.
+func (ww *ahaWatch) close() {
+	for _, m := range ww.mons {
+		if m.fd >= 0 {
+			unix.Close(m.fd)
+			m.fd = -1
+		}
+	}
+}
+
+func (w *ahafs) removeOps(name string, op Op) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  RemoveOps(%q, %s)\n",
+			time.Now().Format("15:04:05.000000000"), name, op)
+	}
+
+	name = filepath.Clean(name)
+	if ok, err := w.poll.removeOps(name, op); ok {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ww, ok := w.watches[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	if ww.op&^op == 0 {
+		return errAllOps(name)
+	}
+	ww.op &^= op
+	return nil
+}
+
+func (w *ahafs) Remove(name string) error {
+	if w.isClosed() {
+		return nil
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  Remove(%q)\n",
+			time.Now().Format("15:04:05.000000000"), name)
+	}
+
+	name = filepath.Clean(name)
+	if w.poll.remove(name) {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ww, ok := w.watches[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	ww.close()
+	delete(w.watches, name)
+	w.wake()
+	return nil
+}
+
+func (w *ahafs) WatchList() []string {
+	if w.isClosed() {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	entries := make([]string, 0, len(w.watches))
+	for p := range w.watches {
+		entries = append(entries, p)
+	}
+	return append(entries, w.poll.list()...)
+}
+
+func (w *ahafs) watchInfo() []WatchInfo {
+	if w.isClosed() {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	l := make([]WatchInfo, 0, len(w.watches))
+	for p, ww := range w.watches {
+		l = append(l, WatchInfo{Path: p, Op: ww.op})
+	}
+	return append(l, w.poll.info()...)
+}
+
+func (w *ahafs) Stats() Stats {
+	if w.isClosed() {
+		return Stats{}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return Stats{Watches: len(w.watches), Polled: len(w.poll.list())}
+}
+
+func (w *ahafs) readEvents() {
+	defer func() {
+		w.mu.Lock()
+		for _, ww := range w.watches {
+			ww.close()
+		}
+		w.mu.Unlock()
+		unix.Close(w.wakeR)
+		close(w.doneResp)
+	}()
+
+	var (
+		buf  = make([]byte, 4096)
+		fds  []unix.PollFd
+		mons []*ahaMon
+	)
+	for {
+		fds, mons = fds[:0], mons[:0]
+		fds = append(fds, unix.PollFd{Fd: int32(w.wakeR), Events: unix.POLLIN})
+		w.mu.Lock()
+		for _, ww := range w.watches {
+			for _, m := range ww.mons {
+				fds = append(fds, unix.PollFd{Fd: int32(m.fd), Events: unix.POLLIN})
+				mons = append(mons, m)
+			}
+		}
+		w.mu.Unlock()
+
+		_, err := unix.Poll(fds, -1)
+		if w.isClosed() {
+			return
+		}
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			if !w.sendError(err) {
+				return
+			}
+			continue
+		}
+		if fds[0].Revents != 0 {
+			unix.Read(w.wakeR, buf)
+		}
+
+		for i, m := range mons {
+			if fds[i+1].Revents&unix.POLLIN == 0 {
+				continue
+			}
+			// The watch may have been removed since poll() returned, and the
+			// fd re-used for something else.
+			w.mu.Lock()
+			fd := m.fd
+			w.mu.Unlock()
+			if fd < 0 {
+				continue
+			}
+			n, err := unix.Pread(fd, buf, 0)
+			if err != nil {
+				if !w.sendError(fmt.Errorf("reading %s monitor for %q: %w", m.evprod, m.w.path, err)) {
+					return
+				}
+				continue
+			}
+			if !w.handleEvent(m, buf[:n]) {
+				return
+			}
+		}
+	}
+}
+
+// handleEvent handles the data read from a .mon file; there may be more than
+// one event in it. Returns false if the watcher was closed.
+func (w *ahafs) handleEvent(m *ahaMon, data []byte) bool {
+	ww := m.w
+	w.mu.Lock()
+	op := ww.op
+	w.mu.Unlock()
+
+	// BUF_WRAP means events were lost; assume everything changed.
+	if bytes.HasPrefix(data, []byte("BUF_WRAP")) {
+		switch {
+		case m.evprod == "modDir":
+			return w.updateDirectory(ww)
+		case m.evprod == "modFileAttr" && op.Has(Chmod):
+			return w.sendEvent(Event{Name: ww.path, Op: Chmod})
+		case m.evprod == "modFile" && op.Has(Write):
+			return w.sendEvent(Event{Name: ww.path, Op: Write})
+		}
+		return true
+	}
+
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		v := bytes.TrimPrefix(line, []byte("RC_FROM_EVPROD="))
+		if len(v) == len(line) {
+			continue
+		}
+		rc, err := strconv.Atoi(string(v))
+		if err != nil {
+			continue
+		}
+		if debug {
+			internal.Debug(ww.path, m.evprod, rc)
+		}
+		if w.raw != nil {
+			w.raw(RawEvent{Name: ww.path, Mask: uint64(rc)})
+		}
+
+		var (
+			send Op
+			gone bool
+		)
+		switch m.evprod {
+		case "modFileAttr":
+			send = Chmod
+		case "modFile":
+			switch rc {
+			case ahafsFileWrite, ahafsFileMap, ahafsFileClear, ahafsFileTrunc, ahafsFileOverwrite:
+				send = Write
+			case ahafsFileRemove:
+				send, gone = Remove, true
+			case ahafsFileRename:
+				send, gone = Rename, true
+			case ahafsFileUnmount:
+				send, gone = Remove, true
+				if op.Has(UnportableUnmount) {
+					send = UnportableUnmount
+				}
+			}
+		case "modDir":
+			switch rc {
+			case ahafsDirCreate, ahafsDirRemove:
+				if !w.updateDirectory(ww) {
+					return false
+				}
+			case ahafsDirRemoveSelf:
+				send, gone = Remove, true
+			case ahafsDirUnmount:
+				send, gone = Remove, true
+				if op.Has(UnportableUnmount) {
+					send = UnportableUnmount
+				}
+			}
+		}
+
+		if gone {
+			w.mu.Lock()
+			if w.watches[ww.path] == ww {
+				ww.close()
+				delete(w.watches, ww.path)
+			}
+			w.mu.Unlock()
+		}
+		if send != 0 && op.Has(send) {
+			if !w.sendEvent(Event{Name: ww.path, Op: send}) {
+				return false
+			}
+		}
+		if gone {
+			return true
+		}
+	}
+	return true
+}
+
+// updateDirectory sends Create and Remove events for the changes in the
+// directory since the last time it was read. Returns false if the watcher was
+// closed.
+func (w *ahafs) updateDirectory(ww *ahaWatch) bool {
+	files, err := ahaList(ww.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return true // modDir sends REMOVE_SELF for this.
+		}
+		return w.sendError(err)
+	}
+
+	w.mu.Lock()
+	prev, op := ww.files, ww.op
+	ww.files = files
+	w.mu.Unlock()
+
+	for name := range prev {
+		if _, ok := files[name]; !ok && op.Has(Remove) {
+			if !w.sendEvent(Event{Name: filepath.Join(ww.path, name), Op: Remove}) {
+				return false
+			}
+		}
+	}
+	for name := range files {
+		if _, ok := prev[name]; !ok && op.Has(Create) {
+			if !w.sendEvent(Event{Name: filepath.Join(ww.path, name), Op: Create}) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ahaList gets the names of the entries in the directory path.
+func ahaList(path string) (map[string]struct{}, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		files[e.Name()] = struct{}{}
+	}
+	return files, nil
+}
+
+// backendName is the name of the backend newBufferedBackend() creates, for
+// the pprof labels with WithProfiling().
+func backendName(with watcherOpts) string { return "ahafs" }
+
+func probe(path string, with watcherOpts) Capabilities {
+	c := Capabilities{FSType: fsTypeName(path)}
+	c.Network = pollFilesystems[c.FSType]
+	_, err := os.Stat(filepath.Join(ahafsRoot, "modFile.monFactory"))
+	switch {
+	case err == nil && ahafsFilesystems[c.FSType]:
+		c.Ops = supportedOps((&ahafs{}).xSupports)
+	case !with.noPolling:
+		c.Ops, c.Polled, c.Latency, c.FileWrites = pollOps&^Rename, true, pollInterval, true
+	}
+	return c
+}
+
+// nofile gets the soft RLIMIT_NOFILE limit, or -1 if it can't be read.
+func nofile() int {
+	var l unix.Rlimit
+	if unix.Getrlimit(unix.RLIMIT_NOFILE, &l) != nil {
+		return -1
+	}
+	return int(l.Cur)
+}
+
+// Virtual filesystems where the kernel changes files without sending any
+// events.
+var virtualFilesystems = map[string]bool{"procfs": true, "ahafs": true, "namefs": true}
+
+func (w *ahafs) name() string { return "ahafs" }
+
+func (w *ahafs) xSupports(op Op) bool {
+	return op&^(Create|Write|Remove|Rename|Chmod|UnportableUnmount) == 0
+}
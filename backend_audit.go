@@ -0,0 +1,659 @@
+//go:build linux && !appengine
+
+// Linux audit backend, used with WithAudit().
+//
+// Rather than watching a path, an audit rule is added for the inode and device
+// of every added file, so that changes are reported no matter through which
+// hard link or bind mount the file is accessed. Events are read from the
+// AUDIT_NLGRP_READLOG multicast group, so this works alongside auditd.
+//
+// There are two rules for every watch: one for the "write" syscall class and
+// one for the "attr" class. The filter key is used to find the watch an event
+// belongs to.
+//
+// Adding rules needs CAP_AUDIT_CONTROL, and reading events needs
+// CAP_AUDIT_READ. Audit rules are global and outlive the process; they are
+// removed on Remove() and Close(), but will stick around if the process exits
+// without calling Close().
+
+package fsnotify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+type audit struct {
+	Events chan Event
+	Errors chan error
+
+	ctl      int      // Netlink socket for adding rules.
+	events   *os.File // Netlink socket for the multicast group.
+	done     chan struct{}
+	doneMu   sync.Mutex
+	doneResp chan struct{}
+	enabled  bool // Audit was enabled by us, and should be disabled on close.
+
+	mu      sync.Mutex
+	seq     uint32
+	nextID  int
+	watches map[string]*auditWatch // Key is the absolute path.
+	keys    map[string]*auditWatch // Key is the rule's filter key, without suffix.
+
+	records map[string]*auditRecord // Key is the event serial; only used from readEvents().
+}
+
+type (
+	auditWatch struct {
+		path  string // Path as passed to Add().
+		abs   string
+		key   string
+		ino   uint64
+		dev   uint64
+		perms uint32 // AUDIT_PERM_* flags we have a rule for.
+		op    Op     // Ops to send events for.
+	}
+	// Records for a single syscall, which end with AUDIT_EOE.
+	auditRecord struct {
+		key     string
+		pid     int
+		failed  bool
+		created []uint64 // Inodes with nametype=CREATE.
+		deleted []uint64 // Inodes with nametype=DELETE.
+	}
+)
+
+// struct audit_rule_data, without the variable-length buf.
+type auditRuleData struct {
+	Flags      uint32
+	Action     uint32
+	FieldCount uint32
+	Mask       [unix.AUDIT_BITMASK_SIZE]uint32
+	Fields     [64]uint32
+	Values     [64]uint32
+	Fieldflags [64]uint32
+	Buflen     uint32
+}
+
+// AUDIT_NLGRP_READLOG isn't in x/sys/unix.
+const auditNlgrpReadlog = 1
+
+// Maximum number of incomplete events to keep in audit.records.
+const maxAuditRecords = 1024
+
+func newAudit(ev chan Event, errs chan error) (backend, error) {
+	ctl, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_AUDIT)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	evfd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_AUDIT)
+	if err != nil {
+		unix.Close(ctl)
+		return nil, os.NewSyscallError("socket", err)
+	}
+	err = unix.Bind(evfd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: auditNlgrpReadlog})
+	if err != nil {
+		unix.Close(ctl)
+		unix.Close(evfd)
+		if err == unix.EPERM {
+			return nil, fmt.Errorf("fsnotify: WithAudit() needs CAP_AUDIT_READ: %w", err)
+		}
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	w := &audit{
+		Events:   ev,
+		Errors:   errs,
+		ctl:      ctl,
+		events:   os.NewFile(uintptr(evfd), ""),
+		done:     make(chan struct{}),
+		doneResp: make(chan struct{}),
+		watches:  make(map[string]*auditWatch),
+		keys:     make(map[string]*auditWatch),
+		records:  make(map[string]*auditRecord),
+	}
+
+	enabled, err := w.status()
+	if err == nil && !enabled {
+		err = w.setEnabled(true)
+		w.enabled = err == nil
+	}
+	if err != nil {
+		unix.Close(ctl)
+		w.events.Close()
+		if errors.Is(err, unix.EPERM) {
+			return nil, fmt.Errorf("fsnotify: WithAudit() needs CAP_AUDIT_CONTROL: %w", err)
+		}
+		return nil, err
+	}
+
+	go w.readEvents()
+	return w, nil
+}
+
+// Returns true if the event was sent, or false if watcher is closed.
+func (w *audit) sendEvent(e Event) bool {
+	select {
+	case <-w.done:
+		return false
+	case w.Events <- e:
+		return true
+	}
+}
+
+// Returns true if the error was sent, or false if watcher is closed.
+func (w *audit) sendError(err error) bool {
+	if err == nil {
+		return true
+	}
+	err = wrapError(w, "watch", "", err)
+	select {
+	case <-w.done:
+		return false
+	case w.Errors <- err:
+		return true
+	}
+}
+
+func (w *audit) isClosed() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *audit) Close() error {
+	w.doneMu.Lock()
+	if w.isClosed() {
+		w.doneMu.Unlock()
+		return nil
+	}
+	close(w.done)
+	w.doneMu.Unlock()
+
+	err := w.events.Close()
+	<-w.doneResp
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, watch := range w.watches {
+		w.delRules(watch)
+	}
+	if w.enabled {
+		w.setEnabled(false)
+	}
+	unix.Close(w.ctl)
+	w.watches, w.keys = nil, nil
+	return err
+}
+
+func (w *audit) Add(name string) error { return w.AddWith(name) }
+
+func (w *audit) AddWith(path string, opts ...addOpt) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  AddWith(%q)\n",
+			time.Now().Format("15:04:05.000000000"), path)
+	}
+
+	with := getOptions(opts...)
+	if !w.xSupports(with.op) {
+		return fmt.Errorf("%w: %s", xErrUnsupported, with.op)
+	}
+	if _, recurse := recursivePath(path); recurse {
+		return fmt.Errorf("%w: recursive watches with WithAudit()", xErrUnsupported)
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(abs, &st); err != nil {
+		return &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+
+	var perms uint32
+	if with.op.Has(Write) || with.op.Has(Remove) || with.op.Has(Rename) || with.op.Has(Create) {
+		perms |= unix.AUDIT_PERM_WRITE
+	}
+	if with.op.Has(Chmod) {
+		perms |= unix.AUDIT_PERM_ATTR
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	watch, ok := w.watches[abs]
+	if ok && (watch.ino != st.Ino || watch.dev != uint64(st.Dev)) {
+		// Path now refers to a different file.
+		w.delRules(watch)
+		delete(w.keys, watch.key)
+		ok = false
+	}
+	if !ok {
+		w.nextID++
+		watch = &auditWatch{
+			path: path,
+			abs:  abs,
+			key:  fmt.Sprintf("fsnotify-%d-%d", os.Getpid(), w.nextID),
+			ino:  st.Ino,
+			dev:  uint64(st.Dev),
+		}
+	}
+
+	for _, p := range []uint32{unix.AUDIT_PERM_WRITE, unix.AUDIT_PERM_ATTR} {
+		if perms&p == 0 || watch.perms&p != 0 {
+			continue
+		}
+		if err := w.rule(unix.AUDIT_ADD_RULE, watch, p); err != nil {
+			if !ok {
+				w.delRules(watch)
+			}
+			if errors.Is(err, unix.EPERM) {
+				return fmt.Errorf("fsnotify: WithAudit() needs CAP_AUDIT_CONTROL: %w", err)
+			}
+			return fmt.Errorf("adding audit rule for %q: %w", path, err)
+		}
+		watch.perms |= p
+	}
+	watch.op |= with.op
+	w.watches[abs] = watch
+	w.keys[watch.key] = watch
+	return nil
+}
+
+func (w *audit) Remove(name string) error {
+	if w.isClosed() {
+		return nil
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  Remove(%q)\n",
+			time.Now().Format("15:04:05.000000000"), name)
+	}
+
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	watch, ok := w.watches[abs]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	delete(w.watches, abs)
+	delete(w.keys, watch.key)
+	return w.delRules(watch)
+}
+
+func (w *audit) WatchList() []string {
+	if w.isClosed() {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	entries := make([]string, 0, len(w.watches))
+	for _, watch := range w.watches {
+		entries = append(entries, watch.path)
+	}
+	return entries
+}
+
+func (w *audit) Stats() Stats {
+	if w.isClosed() {
+		return Stats{}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var n int
+	for _, watch := range w.watches {
+		for _, p := range []uint32{unix.AUDIT_PERM_WRITE, unix.AUDIT_PERM_ATTR} {
+			if watch.perms&p != 0 {
+				n++
+			}
+		}
+	}
+	return Stats{Watches: n}
+}
+
+func (w *audit) name() string { return "audit" }
+
+func (w *audit) xSupports(op Op) bool {
+	return !(op.Has(xUnportableOpen) || op.Has(xUnportableRead) ||
+		op.Has(UnportableCloseWrite) || op.Has(xUnportableCloseRead) || op.Has(UnportableSecurity) ||
+		op.Has(UnportableExtend) || op.Has(UnportableTruncate) || op.Has(UnportableMount) ||
+		op.Has(UnportableUnmount) || op.Has(UnportableMode) || op.Has(UnportableOwner) ||
+		op.Has(UnportableTimes) || op.Has(UnportableXattr) || op.Has(UnportableACL) ||
+		op.Has(UnportableLink) || op.Has(UnportableUnlink) || op.Has(UnportableClone))
+}
+
+// delRules removes all audit rules for the watch.
+//
+// Must be called with w.mu held.
+func (w *audit) delRules(watch *auditWatch) error {
+	var err error
+	for _, p := range []uint32{unix.AUDIT_PERM_WRITE, unix.AUDIT_PERM_ATTR} {
+		if watch.perms&p == 0 {
+			continue
+		}
+		if e := w.rule(unix.AUDIT_DEL_RULE, watch, p); e != nil && err == nil {
+			err = fmt.Errorf("removing audit rule for %q: %w", watch.path, e)
+		}
+		watch.perms &^= p
+	}
+	return err
+}
+
+// ruleKey gets the filter key for a rule; the suffix is used to find out which
+// rule matched.
+func ruleKey(watch *auditWatch, perm uint32) string {
+	if perm == unix.AUDIT_PERM_ATTR {
+		return watch.key + "-a"
+	}
+	return watch.key + "-w"
+}
+
+// rule adds or deletes (depending on typ) the audit rule for the watch:
+//
+//	-a always,exit -S all -F inode=.. -F devmajor=.. -F devminor=.. -F perm=.. -k ..
+//
+// Must be called with w.mu held.
+func (w *audit) rule(typ uint16, watch *auditWatch, perm uint32) error {
+	type field struct{ typ, val uint32 }
+	var (
+		key    = ruleKey(watch, perm)
+		fields = []field{
+			{unix.AUDIT_INODE, uint32(watch.ino)},
+			{unix.AUDIT_DEVMAJOR, unix.Major(watch.dev)},
+			{unix.AUDIT_DEVMINOR, unix.Minor(watch.dev)},
+			{unix.AUDIT_PERM, perm},
+			{unix.AUDIT_FILTERKEY, uint32(len(key))},
+		}
+		r = auditRuleData{
+			Flags:      unix.AUDIT_FILTER_EXIT,
+			Action:     unix.AUDIT_ALWAYS,
+			FieldCount: uint32(len(fields)),
+			Buflen:     uint32(len(key)),
+		}
+	)
+	for i := range r.Mask { // All syscalls.
+		r.Mask[i] = 0xffffffff
+	}
+	for i, f := range fields {
+		r.Fields[i], r.Values[i], r.Fieldflags[i] = f.typ, f.val, unix.AUDIT_EQUAL
+	}
+	data := append((*[unsafe.Sizeof(auditRuleData{})]byte)(unsafe.Pointer(&r))[:], key...)
+
+	_, err := w.request(typ, data, true)
+	return err
+}
+
+// status gets the current audit status, and returns if auditing is enabled.
+//
+// Must be called with w.mu held, or before the watcher is used.
+func (w *audit) status() (bool, error) {
+	reply, err := w.request(unix.AUDIT_GET, nil, false)
+	if err != nil {
+		return false, err
+	}
+	if len(reply) < 8 {
+		return false, errors.New("fsnotify: short AUDIT_GET reply")
+	}
+	return *(*uint32)(unsafe.Pointer(&reply[4])) != 0, nil
+}
+
+// setEnabled enables or disables auditing.
+//
+// Must be called with w.mu held, or before the watcher is used.
+func (w *audit) setEnabled(enable bool) error {
+	// struct audit_status; only mask and enabled are used.
+	data := make([]byte, 8)
+	*(*uint32)(unsafe.Pointer(&data[0])) = unix.AUDIT_STATUS_ENABLED
+	if enable {
+		*(*uint32)(unsafe.Pointer(&data[4])) = 1
+	}
+	_, err := w.request(unix.AUDIT_SET, data, true)
+	return err
+}
+
+// request sends a netlink message on the control socket and returns the reply.
+// If ack is true only the error status of the ACK is returned.
+//
+// Must be called with w.mu held, or before the watcher is used.
+func (w *audit) request(typ uint16, data []byte, ack bool) ([]byte, error) {
+	w.seq++
+	flags := uint16(unix.NLM_F_REQUEST)
+	if ack {
+		flags |= unix.NLM_F_ACK
+	}
+	msg := make([]byte, unix.NLMSG_HDRLEN+len(data))
+	*(*unix.NlMsghdr)(unsafe.Pointer(&msg[0])) = unix.NlMsghdr{
+		Len:   uint32(len(msg)),
+		Type:  typ,
+		Flags: flags,
+		Seq:   w.seq,
+	}
+	copy(msg[unix.NLMSG_HDRLEN:], data)
+	if err := unix.Sendto(w.ctl, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("sendto", err)
+	}
+
+	buf := make([]byte, 8192)
+	for {
+		n, _, err := unix.Recvfrom(w.ctl, buf, 0)
+		if err != nil {
+			return nil, os.NewSyscallError("recvfrom", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != w.seq {
+				continue
+			}
+			if m.Header.Type == unix.NLMSG_ERROR {
+				if len(m.Data) < 4 {
+					return nil, errors.New("fsnotify: short netlink error")
+				}
+				if errno := -*(*int32)(unsafe.Pointer(&m.Data[0])); errno != 0 {
+					return nil, unix.Errno(errno)
+				}
+				if ack {
+					return nil, nil
+				}
+				continue
+			}
+			if m.Header.Type == typ {
+				return m.Data, nil
+			}
+		}
+	}
+}
+
+func (w *audit) readEvents() {
+	defer func() {
+		close(w.doneResp)
+		close(w.Errors)
+		close(w.Events)
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		if w.isClosed() {
+			return
+		}
+
+		n, err := w.events.Read(buf)
+		if errors.Unwrap(err) == os.ErrClosed {
+			return
+		}
+		if err != nil {
+			if !w.sendError(err) {
+				return
+			}
+			continue
+		}
+
+		// Every read is a single record. Don't use ParseNetlinkMessage(): the
+		// kernel doesn't pad audit records to NLMSG_ALIGNTO, which it rejects.
+		if n < unix.NLMSG_HDRLEN {
+			continue
+		}
+		hdr := (*unix.NlMsghdr)(unsafe.Pointer(&buf[0]))
+		end := int(hdr.Len)
+		if end > n || end < unix.NLMSG_HDRLEN {
+			end = n
+		}
+		if !w.handleRecord(hdr.Type, buf[unix.NLMSG_HDRLEN:end]) {
+			return
+		}
+	}
+}
+
+// handleRecord processes a single audit record; records are collected until
+// AUDIT_EOE, after which the event is sent.
+//
+// Returns false if the watcher was closed.
+func (w *audit) handleRecord(typ uint16, data []byte) bool {
+	data = bytes.TrimRight(data, "\x00\n")
+	serial, fields := parseAuditRecord(string(data))
+	if serial == "" {
+		return true
+	}
+
+	switch typ {
+	case unix.AUDIT_SYSCALL:
+		key := fields["key"]
+		if !strings.HasPrefix(key, "fsnotify-") {
+			return true
+		}
+		if len(w.records) >= maxAuditRecords {
+			w.records = make(map[string]*auditRecord)
+		}
+		pid, _ := strconv.Atoi(fields["pid"])
+		w.records[serial] = &auditRecord{key: key, pid: pid, failed: fields["success"] == "no"}
+	case unix.AUDIT_PATH:
+		rec, ok := w.records[serial]
+		if !ok {
+			return true
+		}
+		ino, _ := strconv.ParseUint(fields["inode"], 10, 64)
+		switch fields["nametype"] {
+		case "CREATE":
+			rec.created = append(rec.created, ino)
+		case "DELETE":
+			rec.deleted = append(rec.deleted, ino)
+		}
+	case unix.AUDIT_EOE:
+		rec, ok := w.records[serial]
+		if !ok {
+			return true
+		}
+		delete(w.records, serial)
+		if rec.failed {
+			return true
+		}
+		return w.send(rec)
+	}
+	return true
+}
+
+func (w *audit) send(rec *auditRecord) bool {
+	key, kind := rec.key[:len(rec.key)-2], rec.key[len(rec.key)-1:]
+	w.mu.Lock()
+	watch, ok := w.keys[key]
+	var op Op
+	if ok {
+		op = watch.op
+	}
+	w.mu.Unlock()
+	if !ok {
+		return true
+	}
+
+	has := func(l []uint64) bool {
+		for _, ino := range l {
+			if ino == watch.ino {
+				return true
+			}
+		}
+		return false
+	}
+
+	e := Event{Name: watch.path, Pid: rec.pid}
+	switch {
+	case kind == "a":
+		e.Op = Chmod
+	case has(rec.deleted) && has(rec.created):
+		e.Op = Rename
+	case has(rec.deleted):
+		e.Op = Remove
+	case has(rec.created):
+		e.Op = Create // New hard link.
+	default:
+		e.Op = Write
+	}
+	if e.Op&op == 0 {
+		return true
+	}
+	return w.sendEvent(e)
+}
+
+// parseAuditRecord parses the text of an audit record, e.g.:
+//
+//	audit(1700000000.123:456): arch=c000003e syscall=2 key="x"
+//
+// Returns the serial (456) and the fields. Quotes are removed from values, and
+// "(null)" is returned as an empty string.
+func parseAuditRecord(s string) (string, map[string]string) {
+	if !strings.HasPrefix(s, "audit(") {
+		return "", nil
+	}
+	end := strings.Index(s, "):")
+	if end == -1 {
+		return "", nil
+	}
+	stamp := s[len("audit("):end]
+	i := strings.IndexByte(stamp, ':')
+	if i == -1 {
+		return "", nil
+	}
+
+	fields := make(map[string]string)
+	for _, f := range strings.Fields(s[end+2:]) {
+		k, v, ok := cut(f, "=")
+		if !ok {
+			continue
+		}
+		if v == "(null)" {
+			v = ""
+		}
+		fields[k] = strings.Trim(v, `"`)
+	}
+	return stamp[i+1:], fields
+}
+
+// strings.Cut() is only available in Go 1.18.
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,1033 @@
+//go:build linux && !appengine
+
+// Experimental eBPF backend, used with WithEBPF().
+//
+// BPF programs are attached to the syscall tracepoints for the syscalls that
+// modify files (openat, unlinkat, renameat2, write, etc.). The arguments are
+// stored in a hash map on syscall entry, and sent to a ring buffer on exit if
+// the syscall succeeded. Writes are only reported for file descriptors that
+// were opened for writing with one of the traced open syscalls, which are
+// tracked in a second map, so that writes to pipes, sockets, etc. are not sent
+// to userspace.
+//
+// This doesn't use BTF or kprobes, so the programs work on every kernel with
+// ring buffers (5.8 and newer), and are small enough to assemble by hand rather
+// than pulling in a BPF compiler or loader library. The downside is that the
+// paths are as passed to the syscall: relative paths are resolved with the
+// process's working directory or dirfd from /proc when the event is read,
+// which can fail if the process already exited or closed the dirfd.
+//
+// Loading the programs needs CAP_BPF and CAP_PERFMON (or CAP_SYS_ADMIN), and
+// tracefs needs to be mounted on /sys/kernel/tracing or
+// /sys/kernel/debug/tracing.
+
+package fsnotify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+type ebpf struct {
+	Events chan Event
+	Errors chan error
+
+	done     chan struct{}
+	doneMu   sync.Mutex
+	doneResp chan struct{}
+	wake     int // eventfd to wake up readEvents() on close.
+
+	maps   []int // pending, files, events.
+	progs  []int
+	perf   []int // Perf events the programs are attached to.
+	ring   int
+	cons   []byte // Consumer page of the ring buffer.
+	prod   []byte // Producer page and data (mapped twice).
+	ringSz int
+
+	mu      sync.Mutex
+	watches map[string]*ebpfWatch // Key is the absolute path.
+	real    map[string]*ebpfWatch // Key is the path with symlinks resolved.
+}
+
+type ebpfWatch struct {
+	path  string // Path as passed to Add().
+	abs   string
+	real  string
+	dir   bool
+	op    Op                  // Ops to send events for.
+	names map[string]struct{} // Directory entries, to tell if open(O_CREAT) created a file.
+}
+
+// Record sent from the BPF programs; the layout must match the offsets used in
+// the programs.
+type ebpfRecord struct {
+	Op    uint32 // ebpfOpen, etc.
+	Pid   uint32
+	Ret   int64  // Syscall return value; the fd for ebpfOpen and ebpfWrite.
+	Dfd   uint64 // Directory fd for Path, or AT_FDCWD.
+	Dfd2  uint64 // Directory fd for Path2.
+	Flags uint64 // open() flags.
+	Path  [ebpfPathMax]byte
+	Path2 [ebpfPathMax]byte // New path for renames.
+}
+
+// Longer paths are truncated.
+const ebpfPathMax = 224
+
+const (
+	ebpfOpen uint32 = iota + 1
+	ebpfMkdir
+	ebpfUnlink
+	ebpfRename
+	ebpfChmod
+	ebpfTruncate
+	ebpfWrite
+)
+
+// Syscalls to trace; args lists the name of every syscall argument we need,
+// in order. Syscalls that don't exist on the architecture (e.g. open and
+// rename on arm64) are skipped.
+var ebpfSyscalls = []struct {
+	name string
+	op   uint32
+	args string
+}{
+	{"openat", ebpfOpen, "dfd path flags"},
+	{"open", ebpfOpen, "path flags"},
+	{"mkdirat", ebpfMkdir, "dfd path"},
+	{"mkdir", ebpfMkdir, "path"},
+	{"unlinkat", ebpfUnlink, "dfd path"},
+	{"unlink", ebpfUnlink, "path"},
+	{"rmdir", ebpfUnlink, "path"},
+	{"renameat2", ebpfRename, "dfd path dfd2 path2"},
+	{"renameat", ebpfRename, "dfd path dfd2 path2"},
+	{"rename", ebpfRename, "path path2"},
+	{"fchmodat", ebpfChmod, "dfd path"},
+	{"fchmodat2", ebpfChmod, "dfd path"},
+	{"chmod", ebpfChmod, "path"},
+	{"fchownat", ebpfChmod, "dfd path"},
+	{"chown", ebpfChmod, "path"},
+	{"lchown", ebpfChmod, "path"},
+	{"truncate", ebpfTruncate, "path"},
+}
+
+// Syscalls that write to the fd in the first argument.
+var ebpfWriteSyscalls = []string{"write", "pwrite64", "writev", "pwritev", "pwritev2", "ftruncate", "fallocate"}
+
+// Size of the ring buffer; must be a power of 2 and a multiple of the page
+// size.
+const ebpfRingSize = 1 << 20
+
+func newEBPF(ev chan Event, errs chan error) (backend, error) {
+	tracefs := ""
+	for _, d := range []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"} {
+		if _, err := os.Stat(filepath.Join(d, "events/syscalls")); err == nil {
+			tracefs = d
+			break
+		}
+	}
+	if tracefs == "" {
+		return nil, errors.New("fsnotify: WithEBPF() needs tracefs mounted on /sys/kernel/tracing")
+	}
+
+	wake, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("eventfd", err)
+	}
+	w := &ebpf{
+		Events:   ev,
+		Errors:   errs,
+		done:     make(chan struct{}),
+		doneResp: make(chan struct{}),
+		wake:     wake,
+		ring:     -1,
+		watches:  make(map[string]*ebpfWatch),
+		real:     make(map[string]*ebpfWatch),
+	}
+	if err := w.load(tracefs); err != nil {
+		w.release()
+		if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+			return nil, fmt.Errorf("fsnotify: WithEBPF() needs CAP_BPF and CAP_PERFMON: %w", err)
+		}
+		return nil, err
+	}
+
+	go w.readEvents()
+	return w, nil
+}
+
+// load creates the maps, loads the programs, and attaches them.
+func (w *ebpf) load(tracefs string) error {
+	recSize := uint32(unsafe.Sizeof(ebpfRecord{}))
+	for _, m := range []bpfMapCreateAttr{
+		{MapType: unix.BPF_MAP_TYPE_HASH, KeySize: 8, ValueSize: recSize, MaxEntries: 10240},
+		{MapType: unix.BPF_MAP_TYPE_LRU_HASH, KeySize: 8, ValueSize: recSize, MaxEntries: 16384},
+		{MapType: unix.BPF_MAP_TYPE_RINGBUF, MaxEntries: ebpfRingSize},
+	} {
+		fd, err := bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&m), unsafe.Sizeof(m))
+		if err != nil {
+			return fmt.Errorf("creating BPF map: %w", err)
+		}
+		w.maps = append(w.maps, fd)
+	}
+	pending, files, events := w.maps[0], w.maps[1], w.maps[2]
+
+	var err error
+	w.ring, w.ringSz = events, ebpfRingSize
+	page := os.Getpagesize()
+	w.cons, err = unix.Mmap(events, 0, page, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+	w.prod, err = unix.Mmap(events, int64(page), page+2*ebpfRingSize, unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return os.NewSyscallError("mmap", err)
+	}
+
+	exit, err := w.loadProg("fsnotify_exit", ebpfExitProg(pending, files, events))
+	if err != nil {
+		return err
+	}
+	var n int
+	for _, s := range ebpfSyscalls {
+		id, ok, err := tracepointID(tracefs, "sys_enter_"+s.name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		exitID, ok, err := tracepointID(tracefs, "sys_exit_"+s.name)
+		if err != nil || !ok {
+			return fmt.Errorf("fsnotify: no sys_exit_%s tracepoint: %v", s.name, err)
+		}
+		enter, err := w.loadProg("fsnotify_"+s.name, ebpfEnterProg(s.op, strings.Fields(s.args), pending))
+		if err != nil {
+			return err
+		}
+		if err := w.attach(id, enter); err != nil {
+			return err
+		}
+		if err := w.attach(exitID, exit); err != nil {
+			return err
+		}
+		n++
+	}
+	if n == 0 {
+		return errors.New("fsnotify: no syscall tracepoints in " + tracefs)
+	}
+
+	write, err := w.loadProg("fsnotify_write", ebpfFdProg(false, files, events))
+	if err != nil {
+		return err
+	}
+	cl, err := w.loadProg("fsnotify_close", ebpfFdProg(true, files, events))
+	if err != nil {
+		return err
+	}
+	for _, s := range append(ebpfWriteSyscalls, "close") {
+		id, ok, err := tracepointID(tracefs, "sys_enter_"+s)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		prog := write
+		if s == "close" {
+			prog = cl
+		}
+		if err := w.attach(id, prog); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *ebpf) loadProg(name string, insns []bpfInsn) (int, error) {
+	license := []byte("Dual BSD/GPL\x00")
+	attr := bpfProgLoadAttr{
+		ProgType: unix.BPF_PROG_TYPE_TRACEPOINT,
+		InsnCnt:  uint32(len(insns)),
+		Insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		License:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	copy(attr.ProgName[:unix.BPF_OBJ_NAME_LEN-1], name)
+	fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil && !errors.Is(err, unix.EPERM) {
+		// Load it again with the verifier log, for the error.
+		log := make([]byte, 64*1024)
+		attr.LogLevel, attr.LogSize = 1, uint32(len(log))
+		attr.LogBuf = uint64(uintptr(unsafe.Pointer(&log[0])))
+		if fd2, err2 := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err2 == nil {
+			unix.Close(fd2)
+		}
+		if i := bytes.IndexByte(log, 0); i > 0 {
+			err = fmt.Errorf("%w:\n%s", err, bytes.TrimSpace(log[:i]))
+		}
+	}
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	if err != nil {
+		return -1, fmt.Errorf("loading BPF program %s: %w", name, err)
+	}
+	w.progs = append(w.progs, fd)
+	return fd, nil
+}
+
+// attach attaches the program to the tracepoint; the program runs on all CPUs,
+// even though the perf event is only opened on CPU 0.
+func (w *ebpf) attach(id uint64, prog int) error {
+	attr := unix.PerfEventAttr{
+		Type:        unix.PERF_TYPE_TRACEPOINT,
+		Config:      id,
+		Sample_type: unix.PERF_SAMPLE_RAW,
+		Sample:      1,
+		Wakeup:      1,
+	}
+	attr.Size = uint32(unsafe.Sizeof(attr))
+	fd, err := unix.PerfEventOpen(&attr, -1, 0, -1, unix.PERF_FLAG_FD_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("perf_event_open", err)
+	}
+	w.perf = append(w.perf, fd)
+	if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_SET_BPF, prog); err != nil {
+		return os.NewSyscallError("ioctl(PERF_EVENT_IOC_SET_BPF)", err)
+	}
+	if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0); err != nil {
+		return os.NewSyscallError("ioctl(PERF_EVENT_IOC_ENABLE)", err)
+	}
+	return nil
+}
+
+// tracepointID reads the ID of the tracepoint; returns false if it doesn't
+// exist.
+func tracepointID(tracefs, name string) (uint64, bool, error) {
+	b, err := os.ReadFile(filepath.Join(tracefs, "events/syscalls", name, "id"))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	id, err := strconv.ParseUint(string(bytes.TrimSpace(b)), 10, 64)
+	return id, err == nil, err
+}
+
+// release detaches the programs and closes everything.
+func (w *ebpf) release() {
+	for _, fd := range w.perf {
+		unix.Close(fd)
+	}
+	for _, fd := range w.progs {
+		unix.Close(fd)
+	}
+	if w.cons != nil {
+		unix.Munmap(w.cons)
+	}
+	if w.prod != nil {
+		unix.Munmap(w.prod)
+	}
+	for _, fd := range w.maps {
+		unix.Close(fd)
+	}
+	unix.Close(w.wake)
+	w.perf, w.progs, w.maps, w.cons, w.prod = nil, nil, nil, nil, nil
+}
+
+// Returns true if the event was sent, or false if watcher is closed.
+func (w *ebpf) sendEvent(e Event) bool {
+	select {
+	case <-w.done:
+		return false
+	case w.Events <- e:
+		return true
+	}
+}
+
+// Returns true if the error was sent, or false if watcher is closed.
+func (w *ebpf) sendError(err error) bool {
+	if err == nil {
+		return true
+	}
+	err = wrapError(w, "watch", "", err)
+	select {
+	case <-w.done:
+		return false
+	case w.Errors <- err:
+		return true
+	}
+}
+
+func (w *ebpf) isClosed() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *ebpf) Close() error {
+	w.doneMu.Lock()
+	if w.isClosed() {
+		w.doneMu.Unlock()
+		return nil
+	}
+	close(w.done)
+	w.doneMu.Unlock()
+
+	one := [8]byte{1}
+	unix.Write(w.wake, one[:])
+	<-w.doneResp
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.release()
+	w.watches, w.real = nil, nil
+	return nil
+}
+
+func (w *ebpf) Add(name string) error { return w.AddWith(name) }
+
+func (w *ebpf) AddWith(path string, opts ...addOpt) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  AddWith(%q)\n",
+			time.Now().Format("15:04:05.000000000"), path)
+	}
+
+	with := getOptions(opts...)
+	if !w.xSupports(with.op) {
+		return fmt.Errorf("%w: %s", xErrUnsupported, with.op)
+	}
+	if _, recurse := recursivePath(path); recurse {
+		return fmt.Errorf("%w: recursive watches with WithEBPF()", xErrUnsupported)
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	st, err := os.Stat(abs)
+	if err != nil {
+		return err
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return err
+	}
+	var names map[string]struct{}
+	if st.IsDir() {
+		ls, err := os.ReadDir(abs)
+		if err != nil {
+			return err
+		}
+		names = make(map[string]struct{}, len(ls))
+		for _, l := range ls {
+			names[l.Name()] = struct{}{}
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	watch, ok := w.watches[abs]
+	if ok && watch.real != real {
+		delete(w.real, watch.real)
+		ok = false
+	}
+	if !ok {
+		watch = &ebpfWatch{path: path, abs: abs, real: real}
+	}
+	watch.dir, watch.names = st.IsDir(), names
+	watch.op |= with.op
+	w.watches[abs] = watch
+	w.real[real] = watch
+	return nil
+}
+
+func (w *ebpf) Remove(name string) error {
+	if w.isClosed() {
+		return nil
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  Remove(%q)\n",
+			time.Now().Format("15:04:05.000000000"), name)
+	}
+
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	watch, ok := w.watches[abs]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	delete(w.watches, abs)
+	delete(w.real, watch.real)
+	return nil
+}
+
+func (w *ebpf) WatchList() []string {
+	if w.isClosed() {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	entries := make([]string, 0, len(w.watches))
+	for _, watch := range w.watches {
+		entries = append(entries, watch.path)
+	}
+	return entries
+}
+
+func (w *ebpf) Stats() Stats {
+	if w.isClosed() {
+		return Stats{}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return Stats{Watches: len(w.watches)}
+}
+
+func (w *ebpf) name() string { return "ebpf" }
+
+func (w *ebpf) xSupports(op Op) bool {
+	return !(op.Has(xUnportableOpen) || op.Has(xUnportableRead) ||
+		op.Has(UnportableCloseWrite) || op.Has(xUnportableCloseRead) || op.Has(UnportableSecurity) ||
+		op.Has(UnportableExtend) || op.Has(UnportableTruncate) || op.Has(UnportableMount) ||
+		op.Has(UnportableUnmount) || op.Has(UnportableMode) || op.Has(UnportableOwner) ||
+		op.Has(UnportableTimes) || op.Has(UnportableXattr) || op.Has(UnportableACL) ||
+		op.Has(UnportableLink) || op.Has(UnportableUnlink) || op.Has(UnportableClone))
+}
+
+// Flags in the length of ring buffer records.
+const (
+	ringbufBusy    = 1 << 31
+	ringbufDiscard = 1 << 30
+	ringbufHdrSize = 8
+)
+
+func (w *ebpf) readEvents() {
+	defer func() {
+		close(w.doneResp)
+		close(w.Errors)
+		close(w.Events)
+	}()
+
+	var (
+		cons = (*uint64)(unsafe.Pointer(&w.cons[0]))
+		prod = (*uint64)(unsafe.Pointer(&w.prod[0]))
+		data = w.prod[os.Getpagesize():]
+		fds  = []unix.PollFd{{Fd: int32(w.ring), Events: unix.POLLIN}, {Fd: int32(w.wake), Events: unix.POLLIN}}
+		rec  ebpfRecord
+	)
+	for {
+		if w.isClosed() {
+			return
+		}
+
+		pos, end := atomic.LoadUint64(cons), atomic.LoadUint64(prod)
+		for pos < end {
+			hdr := data[pos&uint64(w.ringSz-1):]
+			l := atomic.LoadUint32((*uint32)(unsafe.Pointer(&hdr[0])))
+			if l&ringbufBusy != 0 {
+				break
+			}
+			n := l &^ (ringbufBusy | ringbufDiscard)
+			if l&ringbufDiscard == 0 && n == uint32(unsafe.Sizeof(rec)) {
+				rec = *(*ebpfRecord)(unsafe.Pointer(&hdr[ringbufHdrSize]))
+				if !w.handleRecord(&rec) {
+					return
+				}
+			}
+			pos += uint64((n + ringbufHdrSize + 7) &^ 7)
+			atomic.StoreUint64(cons, pos)
+		}
+		if pos < end {
+			continue // Record is still being written.
+		}
+
+		_, err := unix.Poll(fds, -1)
+		if err != nil && err != unix.EINTR {
+			if !w.sendError(os.NewSyscallError("poll", err)) {
+				return
+			}
+		}
+	}
+}
+
+// handleRecord converts a single record to events.
+//
+// Returns false if the watcher was closed.
+func (w *ebpf) handleRecord(r *ebpfRecord) bool {
+	var path string
+	if r.Op == ebpfWrite {
+		// The fd is still open most of the time; the path in the record is
+		// as it was when it was opened.
+		p, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", r.Pid, r.Ret))
+		if strings.HasSuffix(p, " (deleted)") {
+			return true
+		}
+		if err == nil && filepath.IsAbs(p) {
+			path = p
+		}
+	}
+	if path == "" {
+		path = ebpfResolve(r.Pid, r.Dfd, cstring(r.Path[:]))
+	}
+	if path == "" {
+		return true
+	}
+
+	w.mu.Lock()
+	var events []Event
+	add := func(watch *ebpfWatch, name string, op Op) bool {
+		if op&watch.op == 0 {
+			return false
+		}
+		events = append(events, Event{Name: name, Op: op, Pid: int(r.Pid)})
+		return true
+	}
+	switch r.Op {
+	case ebpfOpen:
+		w.match(path, func(watch *ebpfWatch, name string, child bool) {
+			if child && r.Flags&unix.O_CREAT != 0 {
+				if _, ok := watch.names[filepath.Base(path)]; !ok {
+					watch.names[filepath.Base(path)] = struct{}{}
+					add(watch, name, Create)
+					return
+				}
+			}
+			if r.Flags&unix.O_TRUNC != 0 {
+				add(watch, name, Write)
+			}
+		})
+	case ebpfMkdir:
+		w.match(path, func(watch *ebpfWatch, name string, child bool) {
+			if child {
+				watch.names[filepath.Base(path)] = struct{}{}
+				add(watch, name, Create)
+			}
+		})
+	case ebpfUnlink:
+		var self *ebpfWatch
+		w.match(path, func(watch *ebpfWatch, name string, child bool) {
+			if child {
+				delete(watch.names, filepath.Base(path))
+			} else {
+				self = watch
+			}
+			add(watch, name, Remove)
+		})
+		if self != nil {
+			delete(w.watches, self.abs)
+			delete(w.real, self.real)
+		}
+	case ebpfRename:
+		to := ebpfResolve(r.Pid, r.Dfd2, cstring(r.Path2[:]))
+		from := path
+		w.match(path, func(watch *ebpfWatch, name string, child bool) {
+			if child {
+				delete(watch.names, filepath.Base(path))
+			}
+			add(watch, name, Rename)
+			from = name
+		})
+		if to != "" {
+			w.match(to, func(watch *ebpfWatch, name string, child bool) {
+				if child {
+					watch.names[filepath.Base(to)] = struct{}{}
+					if add(watch, name, Create) {
+						events[len(events)-1].RenamedFrom = from
+					}
+				}
+			})
+		}
+	case ebpfChmod:
+		w.match(path, func(watch *ebpfWatch, name string, child bool) { add(watch, name, Chmod) })
+	case ebpfTruncate, ebpfWrite:
+		w.match(path, func(watch *ebpfWatch, name string, child bool) { add(watch, name, Write) })
+	}
+	w.mu.Unlock()
+
+	for _, e := range events {
+		if !w.sendEvent(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// match calls fn for the watch on path, and the watch on the directory path is
+// in. name is the path relative to the path passed to Add().
+//
+// Must be called with w.mu held.
+func (w *ebpf) match(path string, fn func(watch *ebpfWatch, name string, child bool)) {
+	if watch, ok := w.real[path]; ok {
+		fn(watch, watch.path, false)
+	}
+	dir := filepath.Dir(path)
+	if dir == path {
+		return
+	}
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = real
+	}
+	if watch, ok := w.real[dir]; ok && watch.dir {
+		fn(watch, filepath.Join(watch.path, filepath.Base(path)), true)
+	}
+}
+
+// ebpfResolve makes path absolute, using the working directory of pid or dfd
+// if it's relative. Returns an empty string if that fails.
+func ebpfResolve(pid uint32, dfd uint64, path string) string {
+	if path == "" {
+		return ""
+	}
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	// The upper 32 bits aren't set if the caller passed AT_FDCWD as an int.
+	base := fmt.Sprintf("/proc/%d/cwd", pid)
+	if int32(dfd) != unix.AT_FDCWD {
+		base = fmt.Sprintf("/proc/%d/fd/%d", pid, int32(dfd))
+	}
+	dir, err := os.Readlink(base)
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, path)
+}
+
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// BPF programs
+//
+// Registers r1 to r5 are arguments for calls and are clobbered by them, r0 is
+// the return value, r6 to r9 are preserved, and r10 is the frame pointer. The
+// stack is 512 bytes.
+
+// Offsets in the stack of the programs: the map key at the top, and the record
+// below it.
+const (
+	bpfStackKey  = -8
+	bpfStackKey2 = -16
+	bpfStackRec  = bpfStackKey - int16(unsafe.Sizeof(ebpfRecord{}))
+)
+
+// Tracepoint context: the syscall arguments (or the return value for
+// sys_exit_*) start at offset 16, and are all 8 bytes.
+const bpfCtxArgs = 16
+
+// BPF helper functions.
+const (
+	bpfMapLookupElem     = 1
+	bpfMapUpdateElem     = 2
+	bpfMapDeleteElem     = 3
+	bpfGetCurrentPidTgid = 14
+	bpfProbeReadUserStr  = 114
+	bpfRingbufOutput     = 130
+)
+
+// ebpfEnterProg stores the syscall arguments in the pending map, keyed by the
+// thread ID.
+func ebpfEnterProg(op uint32, args []string, pending int) []bpfInsn {
+	arg := func(name string) int16 {
+		for i, a := range args {
+			if a == name {
+				return bpfCtxArgs + int16(i)*8
+			}
+		}
+		return -1
+	}
+	var (
+		a   bpfAsm
+		off = func(f uintptr) int16 { return bpfStackRec + int16(f) }
+		rec ebpfRecord
+	)
+	a.movReg(6, 1)
+	a.call(bpfGetCurrentPidTgid)
+	a.stx(unix.BPF_DW, 10, 0, bpfStackKey)
+	a.alu(unix.BPF_RSH, 0, 32)
+	a.stx(unix.BPF_W, 10, 0, off(unsafe.Offsetof(rec.Pid)))
+	a.st(unix.BPF_W, 10, off(unsafe.Offsetof(rec.Op)), int32(op))
+	a.st(unix.BPF_DW, 10, off(unsafe.Offsetof(rec.Ret)), 0)
+	for _, f := range []struct {
+		name string
+		off  uintptr
+		def  int32
+	}{
+		{"dfd", unsafe.Offsetof(rec.Dfd), unix.AT_FDCWD},
+		{"dfd2", unsafe.Offsetof(rec.Dfd2), unix.AT_FDCWD},
+		{"flags", unsafe.Offsetof(rec.Flags), 0},
+	} {
+		if o := arg(f.name); o != -1 {
+			a.ldx(unix.BPF_DW, 1, 6, o)
+			a.stx(unix.BPF_DW, 10, 1, off(f.off))
+		} else {
+			a.st(unix.BPF_DW, 10, off(f.off), f.def)
+		}
+	}
+	for _, f := range []struct {
+		name string
+		off  uintptr
+	}{
+		{"path", unsafe.Offsetof(rec.Path)},
+		{"path2", unsafe.Offsetof(rec.Path2)},
+	} {
+		if o := arg(f.name); o != -1 {
+			a.movReg(1, 10)
+			a.alu(unix.BPF_ADD, 1, int32(off(f.off)))
+			a.mov(2, ebpfPathMax)
+			a.ldx(unix.BPF_DW, 3, 6, o)
+			a.call(bpfProbeReadUserStr)
+		} else {
+			for i := int16(0); i < ebpfPathMax; i += 8 {
+				a.st(unix.BPF_DW, 10, off(f.off)+i, 0)
+			}
+		}
+	}
+	a.ldMap(1, pending)
+	a.movReg(2, 10)
+	a.alu(unix.BPF_ADD, 2, bpfStackKey)
+	a.movReg(3, 10)
+	a.alu(unix.BPF_ADD, 3, int32(bpfStackRec))
+	a.mov(4, unix.BPF_ANY)
+	a.call(bpfMapUpdateElem)
+	a.mov(0, 0)
+	a.exit()
+	return a.assemble()
+}
+
+// ebpfExitProg sends the record in the pending map to the ring buffer if the
+// syscall succeeded. Files opened for writing are added to the files map, and
+// opens are only sent if they could create or truncate a file.
+func ebpfExitProg(pending, files, events int) []bpfInsn {
+	var (
+		a   bpfAsm
+		rec ebpfRecord
+	)
+	a.movReg(6, 1)
+	a.call(bpfGetCurrentPidTgid)
+	a.stx(unix.BPF_DW, 10, 0, bpfStackKey)
+	a.movReg(7, 0)
+	a.alu(unix.BPF_RSH, 7, 32)
+	a.ldMap(1, pending)
+	a.movReg(2, 10)
+	a.alu(unix.BPF_ADD, 2, bpfStackKey)
+	a.call(bpfMapLookupElem)
+	a.jmp(unix.BPF_JEQ, 0, 0, "out")
+	a.movReg(8, 0)
+
+	a.ldx(unix.BPF_DW, 1, 6, bpfCtxArgs)
+	a.jmp(unix.BPF_JSLT, 1, 0, "delete")
+	a.stx(unix.BPF_DW, 8, 1, int16(unsafe.Offsetof(rec.Ret)))
+	a.ldx(unix.BPF_W, 2, 8, int16(unsafe.Offsetof(rec.Op)))
+	a.jmp(unix.BPF_JNE, 2, int32(ebpfOpen), "output")
+
+	// Key for the files map is tgid<<32 | fd.
+	a.ldx(unix.BPF_DW, 3, 8, int16(unsafe.Offsetof(rec.Flags)))
+	a.alu(unix.BPF_AND, 3, unix.O_ACCMODE)
+	a.jmp(unix.BPF_JEQ, 3, unix.O_RDONLY, "created")
+	a.movReg(2, 7)
+	a.alu(unix.BPF_LSH, 2, 32)
+	a.aluReg(unix.BPF_OR, 2, 1)
+	a.stx(unix.BPF_DW, 10, 2, bpfStackKey2)
+	a.ldMap(1, files)
+	a.movReg(2, 10)
+	a.alu(unix.BPF_ADD, 2, bpfStackKey2)
+	a.movReg(3, 8)
+	a.mov(4, unix.BPF_ANY)
+	a.call(bpfMapUpdateElem)
+	a.label("created")
+	a.ldx(unix.BPF_DW, 3, 8, int16(unsafe.Offsetof(rec.Flags)))
+	a.alu(unix.BPF_AND, 3, unix.O_CREAT|unix.O_TRUNC)
+	a.jmp(unix.BPF_JEQ, 3, 0, "delete")
+
+	a.label("output")
+	a.ldMap(1, events)
+	a.movReg(2, 8)
+	a.mov(3, int32(unsafe.Sizeof(rec)))
+	a.mov(4, 0)
+	a.call(bpfRingbufOutput)
+
+	a.label("delete")
+	a.ldMap(1, pending)
+	a.movReg(2, 10)
+	a.alu(unix.BPF_ADD, 2, bpfStackKey)
+	a.call(bpfMapDeleteElem)
+	a.label("out")
+	a.mov(0, 0)
+	a.exit()
+	return a.assemble()
+}
+
+// ebpfFdProg handles writes to the fd in the first argument by sending the
+// record from the files map as ebpfWrite, or removes the fd from the files map
+// on close.
+func ebpfFdProg(del bool, files, events int) []bpfInsn {
+	var (
+		a   bpfAsm
+		rec ebpfRecord
+	)
+	a.movReg(6, 1)
+	a.call(bpfGetCurrentPidTgid)
+	a.alu(unix.BPF_RSH, 0, 32)
+	a.alu(unix.BPF_LSH, 0, 32)
+	a.ldx(unix.BPF_DW, 1, 6, bpfCtxArgs)
+	a.alu(unix.BPF_LSH, 1, 32)
+	a.alu(unix.BPF_RSH, 1, 32)
+	a.aluReg(unix.BPF_OR, 0, 1)
+	a.stx(unix.BPF_DW, 10, 0, bpfStackKey)
+	a.ldMap(1, files)
+	a.movReg(2, 10)
+	a.alu(unix.BPF_ADD, 2, bpfStackKey)
+	if del {
+		a.call(bpfMapDeleteElem)
+	} else {
+		a.call(bpfMapLookupElem)
+		a.jmp(unix.BPF_JEQ, 0, 0, "out")
+		a.st(unix.BPF_W, 0, int16(unsafe.Offsetof(rec.Op)), int32(ebpfWrite))
+		a.movReg(2, 0)
+		a.ldMap(1, events)
+		a.mov(3, int32(unsafe.Sizeof(rec)))
+		a.mov(4, 0)
+		a.call(bpfRingbufOutput)
+	}
+	a.label("out")
+	a.mov(0, 0)
+	a.exit()
+	return a.assemble()
+}
+
+// struct bpf_insn
+type bpfInsn struct {
+	Code uint8
+	Regs uint8 // dst in the lower 4 bits, src in the upper 4.
+	Off  int16
+	Imm  int32
+}
+
+// bpfAsm assembles BPF programs; jumps are to labels, which are resolved in
+// assemble().
+type bpfAsm struct {
+	insns  []bpfInsn
+	labels map[string]int
+	jumps  map[int]string
+}
+
+func (a *bpfAsm) emit(code, dst, src uint8, off int16, imm int32) {
+	a.insns = append(a.insns, bpfInsn{Code: code, Regs: dst | src<<4, Off: off, Imm: imm})
+}
+
+func (a *bpfAsm) label(l string) {
+	if a.labels == nil {
+		a.labels = make(map[string]int)
+	}
+	a.labels[l] = len(a.insns)
+}
+
+func (a *bpfAsm) mov(dst uint8, imm int32) {
+	a.emit(unix.BPF_ALU64|unix.BPF_MOV|unix.BPF_K, dst, 0, 0, imm)
+}
+func (a *bpfAsm) movReg(dst, src uint8) {
+	a.emit(unix.BPF_ALU64|unix.BPF_MOV|unix.BPF_X, dst, src, 0, 0)
+}
+func (a *bpfAsm) alu(op, dst uint8, imm int32) {
+	a.emit(unix.BPF_ALU64|op|unix.BPF_K, dst, 0, 0, imm)
+}
+func (a *bpfAsm) aluReg(op, dst, src uint8) {
+	a.emit(unix.BPF_ALU64|op|unix.BPF_X, dst, src, 0, 0)
+}
+func (a *bpfAsm) ldx(size, dst, src uint8, off int16) {
+	a.emit(unix.BPF_LDX|unix.BPF_MEM|size, dst, src, off, 0)
+}
+func (a *bpfAsm) stx(size, dst, src uint8, off int16) {
+	a.emit(unix.BPF_STX|unix.BPF_MEM|size, dst, src, off, 0)
+}
+func (a *bpfAsm) st(size, dst uint8, off int16, imm int32) {
+	a.emit(unix.BPF_ST|unix.BPF_MEM|size, dst, 0, off, imm)
+}
+func (a *bpfAsm) call(fn int32) { a.emit(unix.BPF_JMP|unix.BPF_CALL, 0, 0, 0, fn) }
+func (a *bpfAsm) exit()         { a.emit(unix.BPF_JMP|unix.BPF_EXIT, 0, 0, 0, 0) }
+
+// jmp jumps to label l if dst <op> imm.
+func (a *bpfAsm) jmp(op, dst uint8, imm int32, l string) {
+	if a.jumps == nil {
+		a.jumps = make(map[int]string)
+	}
+	a.jumps[len(a.insns)] = l
+	a.emit(unix.BPF_JMP|op|unix.BPF_K, dst, 0, 0, imm)
+}
+
+// ldMap loads the map fd in dst; this takes two instructions.
+func (a *bpfAsm) ldMap(dst uint8, fd int) {
+	a.emit(unix.BPF_LD|unix.BPF_DW|unix.BPF_IMM, dst, unix.BPF_PSEUDO_MAP_FD, 0, int32(fd))
+	a.emit(0, 0, 0, 0, 0)
+}
+
+func (a *bpfAsm) assemble() []bpfInsn {
+	for i, l := range a.jumps {
+		t, ok := a.labels[l]
+		if !ok {
+			panic("fsnotify: undefined BPF label " + l)
+		}
+		a.insns[i].Off = int16(t - i - 1)
+	}
+	return a.insns
+}
+
+// Start of union bpf_attr for BPF_MAP_CREATE.
+type bpfMapCreateAttr struct {
+	MapType    uint32
+	KeySize    uint32
+	ValueSize  uint32
+	MaxEntries uint32
+	MapFlags   uint32
+}
+
+// Start of union bpf_attr for BPF_PROG_LOAD.
+type bpfProgLoadAttr struct {
+	ProgType    uint32
+	InsnCnt     uint32
+	Insns       uint64
+	License     uint64
+	LogLevel    uint32
+	LogSize     uint32
+	LogBuf      uint64
+	KernVersion uint32
+	ProgFlags   uint32
+	ProgName    [unix.BPF_OBJ_NAME_LEN]byte
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, os.NewSyscallError("bpf", errno)
+	}
+	return int(fd), nil
+}
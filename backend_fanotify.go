@@ -0,0 +1,785 @@
+//go:build linux && !appengine
+
+// fanotify backend, used with WithWholeVolume().
+//
+// A single FAN_MARK_FILESYSTEM mark is set for every filesystem that has a
+// watched path, and events are filtered to the added paths here. This avoids
+// having to set up an inotify watch for every directory, and the race between
+// creating a directory and adding a watch for it.
+//
+// AddMount() sets a FAN_MARK_MOUNT mark instead, which is filtered the same
+// way, but the kernel only supports a limited set of events for it.
+//
+// Events are reported with FAN_REPORT_DFID_NAME: the file handle of the
+// directory and the filename. The file handle is converted to a path with
+// open_by_handle_at() and readlink(/proc/self/fd/n). With FAN_REPORT_FID and
+// FAN_REPORT_TARGET_FID the handle of the file itself is reported too, which
+// is set as EventInfo.Handle.
+//
+// This needs CAP_SYS_ADMIN (for the filesystem mark) and CAP_DAC_READ_SEARCH
+// (for open_by_handle_at).
+
+package fsnotify
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/esvos/fsnotify/internal"
+	"golang.org/x/sys/unix"
+)
+
+type fanotify struct {
+	Events chan Event
+	Errors chan error
+
+	fd       int
+	file     *os.File
+	done     chan struct{}
+	doneMu   sync.Mutex
+	doneResp chan struct{}
+	noRename bool // FAN_RENAME isn't supported (Linux <5.17).
+	raw      func(RawEvent)
+
+	// Recently seen directory handles → path; only used from readEvents().
+	dirs map[string]string
+
+	mu    sync.Mutex
+	marks map[unix.Fsid]*fanMark // Filesystem marks.
+	roots map[string]*fanRoot    // Added paths; key is the absolute path.
+}
+
+type (
+	fanMark struct {
+		path    string // Path the mark was added with.
+		mountFd int    // Directory on the filesystem, for open_by_handle_at.
+		mask    uint64
+	}
+	fanRoot struct {
+		path    string // Path as passed to Add(); events are sent relative to this.
+		abs     string // Absolute path with symlinks resolved.
+		fsid    unix.Fsid
+		mask    uint64
+		dir     bool
+		recurse bool
+		mount   bool // FAN_MARK_MOUNT mark, rather than on the filesystem.
+	}
+)
+
+const sizeofFanMetadata = int(unsafe.Sizeof(unix.FanotifyEventMetadata{}))
+
+// fanotify_event_info_header, fanotify_event_info_fid, and struct file_handle.
+type (
+	fanInfoHeader struct {
+		InfoType uint8
+		Pad      uint8
+		Len      uint16
+	}
+	fanInfoFid struct {
+		Hdr  fanInfoHeader
+		Fsid unix.Fsid
+	}
+	fanFileHandle struct {
+		Bytes uint32
+		Type  int32
+	}
+)
+
+func newFanotify(ev chan Event, errs chan error, raw func(RawEvent)) (backend, error) {
+	// FAN_REPORT_TARGET_FID (Linux 5.17) is needed to get the file handle for
+	// create, delete, and rename events; fall back to just FAN_REPORT_FID for
+	// older versions.
+	var (
+		flags      = uint(unix.FAN_CLASS_NOTIF | unix.FAN_CLOEXEC | unix.FAN_NONBLOCK)
+		eventFlags = uint(unix.O_RDONLY | unix.O_CLOEXEC | unix.O_LARGEFILE)
+	)
+	fd, err := unix.FanotifyInit(flags|unix.FAN_REPORT_DFID_NAME_TARGET, eventFlags)
+	if err == unix.EINVAL {
+		fd, err = unix.FanotifyInit(flags|unix.FAN_REPORT_DFID_NAME|unix.FAN_REPORT_FID, eventFlags)
+	}
+	if err != nil {
+		if err == unix.EPERM {
+			return nil, fmt.Errorf("fsnotify: WithWholeVolume() needs CAP_SYS_ADMIN on Linux: %w", err)
+		}
+		return nil, os.NewSyscallError("fanotify_init", err)
+	}
+
+	w := &fanotify{
+		Events:   ev,
+		Errors:   errs,
+		fd:       fd,
+		file:     os.NewFile(uintptr(fd), ""),
+		done:     make(chan struct{}),
+		doneResp: make(chan struct{}),
+		marks:    make(map[unix.Fsid]*fanMark),
+		roots:    make(map[string]*fanRoot),
+		dirs:     make(map[string]string),
+		raw:      raw,
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+// Returns true if the event was sent, or false if watcher is closed.
+func (w *fanotify) sendEvent(e Event) bool {
+	select {
+	case <-w.done:
+		return false
+	case w.Events <- e:
+		return true
+	}
+}
+
+// Returns true if the error was sent, or false if watcher is closed.
+func (w *fanotify) sendError(err error) bool {
+	if err == nil {
+		return true
+	}
+	err = wrapError(w, "watch", "", err)
+	select {
+	case <-w.done:
+		return false
+	case w.Errors <- err:
+		return true
+	}
+}
+
+func (w *fanotify) isClosed() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *fanotify) Close() error {
+	w.doneMu.Lock()
+	if w.isClosed() {
+		w.doneMu.Unlock()
+		return nil
+	}
+	close(w.done)
+	w.doneMu.Unlock()
+
+	err := w.file.Close()
+	<-w.doneResp
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, m := range w.marks {
+		unix.Close(m.mountFd)
+	}
+	w.marks, w.roots = nil, nil
+	return err
+}
+
+func (w *fanotify) Add(name string) error { return w.AddWith(name) }
+
+func (w *fanotify) AddWith(path string, opts ...addOpt) error {
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  AddWith(%q)\n",
+			time.Now().Format("15:04:05.000000000"), path)
+	}
+	return w.add(path, false, opts...)
+}
+
+func (w *fanotify) addMount(path string, opts ...addOpt) error {
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  AddMount(%q)\n",
+			time.Now().Format("15:04:05.000000000"), path)
+	}
+	return w.add(path, true, opts...)
+}
+
+// Events that can be used with FAN_MARK_MOUNT; everything else needs
+// FAN_REPORT_FID, which the kernel doesn't support for mount marks.
+const fanMountMask = unix.FAN_MODIFY | unix.FAN_OPEN | unix.FAN_ACCESS |
+	unix.FAN_CLOSE_WRITE | unix.FAN_CLOSE_NOWRITE
+
+func (w *fanotify) add(path string, mount bool, opts ...addOpt) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+
+	with := getOptions(opts...)
+	if !w.xSupports(with.op) {
+		return fmt.Errorf("%w: %s", xErrUnsupported, with.op)
+	}
+
+	path, recurse := recursivePath(path)
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	abs, err = filepath.EvalSymlinks(abs)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return err
+	}
+	if mount && !fi.IsDir() {
+		return fmt.Errorf("fsnotify: AddMount: not a directory: %s", path)
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(abs, &st); err != nil {
+		return &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	r, ok := w.roots[abs]
+	if ok && r.mount != mount {
+		return fmt.Errorf("fsnotify: %s is already watched with a different mark type", path)
+	}
+	if !ok {
+		r = &fanRoot{path: path, abs: abs, fsid: st.Fsid, dir: fi.IsDir(), mount: mount}
+	}
+
+	markPath := abs
+	if !r.dir {
+		markPath = filepath.Dir(abs)
+	}
+	if err := w.mark(markPath, st.Fsid); err != nil {
+		return err
+	}
+
+	if mount {
+		mask := r.mask | w.toMask(with.op)&fanMountMask
+		err := unix.FanotifyMark(w.fd, unix.FAN_MARK_ADD|unix.FAN_MARK_MOUNT,
+			mask|unix.FAN_ONDIR, unix.AT_FDCWD, abs)
+		if err != nil {
+			if !ok {
+				w.updateMark(st.Fsid, 0)
+			}
+			return os.NewSyscallError("fanotify_mark", err)
+		}
+		r.mask, r.recurse = mask, true
+		w.roots[abs] = r
+		return nil
+	}
+
+	r.mask |= w.toMask(with.op)
+	r.recurse = r.recurse || recurse
+	w.roots[abs] = r
+	err = w.updateMark(st.Fsid, r.mask)
+	if err != nil && !ok {
+		delete(w.roots, abs)
+	}
+	return err
+}
+
+// mark makes sure there's a filesystem mark for fsid; path must be a directory
+// on that filesystem.
+//
+// Must be called with w.mu held.
+func (w *fanotify) mark(path string, fsid unix.Fsid) error {
+	if _, ok := w.marks[fsid]; ok {
+		return nil
+	}
+	// Can't use O_PATH: open_by_handle_at() doesn't accept it.
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	w.marks[fsid] = &fanMark{path: path, mountFd: fd}
+	return nil
+}
+
+// updateMark adds the flags in mask to the filesystem mark, and removes any
+// flags no longer needed by any root. The mark is removed if there are no more
+// roots on the filesystem.
+//
+// Must be called with w.mu held.
+func (w *fanotify) updateMark(fsid unix.Fsid, add uint64) error {
+	m := w.marks[fsid]
+	var (
+		mask   uint64
+		mounts bool
+	)
+	for _, r := range w.roots {
+		if r.fsid == fsid {
+			if r.mount {
+				mounts = true
+			} else {
+				mask |= r.mask
+			}
+		}
+	}
+	mask |= add
+
+	if mask == 0 && m.mask != 0 {
+		err := unix.FanotifyMark(w.fd, unix.FAN_MARK_REMOVE|unix.FAN_MARK_FILESYSTEM,
+			m.mask|unix.FAN_ONDIR, unix.AT_FDCWD, m.path)
+		m.mask = 0
+		if err != nil && err != unix.ENOENT {
+			return os.NewSyscallError("fanotify_mark", err)
+		}
+	}
+	if mask == 0 && !mounts {
+		unix.Close(m.mountFd)
+		delete(w.marks, fsid)
+		return nil
+	}
+	if mask == 0 {
+		return nil
+	}
+	if rm := m.mask &^ mask; rm != 0 {
+		err := unix.FanotifyMark(w.fd, unix.FAN_MARK_REMOVE|unix.FAN_MARK_FILESYSTEM,
+			rm, unix.AT_FDCWD, m.path)
+		if err != nil {
+			return os.NewSyscallError("fanotify_mark", err)
+		}
+	}
+	if mask&^m.mask != 0 {
+		err := unix.FanotifyMark(w.fd, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM,
+			mask|unix.FAN_ONDIR, unix.AT_FDCWD, m.path)
+		if err == unix.EINVAL && mask&unix.FAN_RENAME != 0 {
+			// FAN_RENAME needs Linux 5.17; fall back to MOVED_FROM and
+			// MOVED_TO, which can't be paired.
+			w.noRename = true
+			mask = mask&^unix.FAN_RENAME | unix.FAN_MOVED_FROM | unix.FAN_MOVED_TO
+			err = unix.FanotifyMark(w.fd, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM,
+				mask|unix.FAN_ONDIR, unix.AT_FDCWD, m.path)
+		}
+		if err != nil {
+			if m.mask == 0 && !mounts {
+				unix.Close(m.mountFd)
+				delete(w.marks, fsid)
+			}
+			if err == unix.EPERM {
+				return fmt.Errorf("fsnotify: WithWholeVolume() needs CAP_SYS_ADMIN on Linux: %w", err)
+			}
+			return os.NewSyscallError("fanotify_mark", err)
+		}
+	}
+	m.mask = mask
+	return nil
+}
+
+func (w *fanotify) toMask(op Op) uint64 {
+	var mask uint64
+	if op.Has(Create) {
+		mask |= unix.FAN_CREATE | unix.FAN_RENAME
+	}
+	if op.Has(Remove) {
+		mask |= unix.FAN_DELETE
+	}
+	if op.Has(Write) {
+		mask |= unix.FAN_MODIFY
+	}
+	if op.Has(Rename) {
+		mask |= unix.FAN_RENAME
+	}
+	if op.Has(Chmod) {
+		mask |= unix.FAN_ATTRIB
+	}
+	if op.Has(xUnportableOpen) {
+		mask |= unix.FAN_OPEN
+	}
+	if op.Has(xUnportableRead) {
+		mask |= unix.FAN_ACCESS
+	}
+	if op.Has(UnportableCloseWrite) {
+		mask |= unix.FAN_CLOSE_WRITE
+	}
+	if op.Has(xUnportableCloseRead) {
+		mask |= unix.FAN_CLOSE_NOWRITE
+	}
+	if w.noRename && mask&unix.FAN_RENAME != 0 {
+		mask = mask&^unix.FAN_RENAME | unix.FAN_MOVED_FROM | unix.FAN_MOVED_TO
+	}
+	return mask
+}
+
+func (w *fanotify) Remove(name string) error {
+	if w.isClosed() {
+		return nil
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  Remove(%q)\n",
+			time.Now().Format("15:04:05.000000000"), name)
+	}
+
+	name, _ = recursivePath(name)
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r, ok := w.roots[abs]
+	if !ok {
+		// Try again with symlinks resolved; but only if we can't find it
+		// without, as the path may no longer exist.
+		if res, err := filepath.EvalSymlinks(abs); err == nil {
+			r, ok = w.roots[res]
+		}
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	return w.removeRoot(r)
+}
+
+// Must be called with w.mu held.
+func (w *fanotify) removeRoot(r *fanRoot) error {
+	delete(w.roots, r.abs)
+	if r.mount {
+		err := unix.FanotifyMark(w.fd, unix.FAN_MARK_REMOVE|unix.FAN_MARK_MOUNT,
+			r.mask|unix.FAN_ONDIR, unix.AT_FDCWD, r.abs)
+		if err != nil && err != unix.ENOENT {
+			return os.NewSyscallError("fanotify_mark", err)
+		}
+		// Other roots may be on the same mount; there's no easy way to tell,
+		// so just set their flags again.
+		for _, o := range w.roots {
+			if o.mount && o.fsid == r.fsid {
+				unix.FanotifyMark(w.fd, unix.FAN_MARK_ADD|unix.FAN_MARK_MOUNT,
+					o.mask|unix.FAN_ONDIR, unix.AT_FDCWD, o.abs)
+			}
+		}
+	}
+	return w.updateMark(r.fsid, 0)
+}
+
+func (w *fanotify) WatchList() []string {
+	if w.isClosed() {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	entries := make([]string, 0, len(w.roots))
+	for _, r := range w.roots {
+		entries = append(entries, r.path)
+	}
+	return entries
+}
+
+func (w *fanotify) Stats() Stats {
+	if w.isClosed() {
+		return Stats{}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var n int
+	for _, m := range w.marks {
+		if m.mask != 0 {
+			n++
+		}
+	}
+	for _, r := range w.roots {
+		if r.mount {
+			n++
+		}
+	}
+	return Stats{Watches: n}
+}
+
+func (w *fanotify) name() string { return "fanotify" }
+
+func (w *fanotify) xSupports(op Op) bool {
+	return !(op.Has(UnportableSecurity) || op.Has(UnportableExtend) || op.Has(UnportableTruncate) ||
+		op.Has(UnportableMount) || op.Has(UnportableUnmount) || op.Has(UnportableMode) ||
+		op.Has(UnportableOwner) || op.Has(UnportableTimes) || op.Has(UnportableXattr) ||
+		op.Has(UnportableACL) || op.Has(UnportableLink) || op.Has(UnportableUnlink) ||
+		op.Has(UnportableClone))
+}
+
+func (w *fanotify) readEvents() {
+	defer func() {
+		close(w.doneResp)
+		close(w.Errors)
+		close(w.Events)
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		if w.isClosed() {
+			return
+		}
+
+		n, err := w.file.Read(buf)
+		if errors.Unwrap(err) == os.ErrClosed {
+			return
+		}
+		if err != nil {
+			if !w.sendError(err) {
+				return
+			}
+			continue
+		}
+
+		for off := 0; off+sizeofFanMetadata <= n; {
+			meta := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[off]))
+			if int(meta.Event_len) < sizeofFanMetadata || off+int(meta.Event_len) > n {
+				break
+			}
+			if !w.handleEvent(meta, buf[off+int(meta.Metadata_len):off+int(meta.Event_len)]) {
+				return
+			}
+			off += int(meta.Event_len)
+		}
+	}
+}
+
+// handleEvent converts the event to Events and sends them. info are the info
+// records after the metadata.
+//
+// Returns false if the watcher was closed.
+func (w *fanotify) handleEvent(meta *unix.FanotifyEventMetadata, info []byte) bool {
+	if meta.Fd >= 0 { // Shouldn't happen with FAN_REPORT_FID.
+		unix.Close(int(meta.Fd))
+	}
+	if meta.Mask&unix.FAN_Q_OVERFLOW != 0 {
+		return w.sendError(ErrEventOverflow)
+	}
+
+	var (
+		path, oldPath string
+		fileInfo      *EventInfo
+	)
+	for len(info) >= int(unsafe.Sizeof(fanInfoHeader{})) {
+		hdr := (*fanInfoHeader)(unsafe.Pointer(&info[0]))
+		if hdr.Len == 0 || int(hdr.Len) > len(info) {
+			break
+		}
+		rec := info[:hdr.Len]
+		info = info[hdr.Len:]
+
+		switch hdr.InfoType {
+		case unix.FAN_EVENT_INFO_TYPE_DFID_NAME, unix.FAN_EVENT_INFO_TYPE_NEW_DFID_NAME:
+			path = w.resolve(rec)
+		case unix.FAN_EVENT_INFO_TYPE_OLD_DFID_NAME:
+			oldPath = w.resolve(rec)
+		case unix.FAN_EVENT_INFO_TYPE_FID:
+			if _, _, key, _, ok := parseFid(rec); ok {
+				fileInfo = &EventInfo{Handle: key}
+			}
+			if path == "" {
+				path = w.resolve(rec)
+			}
+		case unix.FAN_EVENT_INFO_TYPE_DFID:
+			if path == "" {
+				path = w.resolve(rec)
+			}
+		}
+	}
+
+	if debug {
+		internal.DebugFanotify(path, meta.Mask)
+	}
+	if w.raw != nil {
+		w.raw(RawEvent{Name: path, Mask: meta.Mask})
+	}
+
+	mask, pid := meta.Mask, int(meta.Pid)
+	if mask&unix.FAN_RENAME != 0 {
+		mask &^= unix.FAN_RENAME
+		if oldPath != "" && !w.send(oldPath, "", pid, fileInfo, unix.FAN_MOVED_FROM, unix.FAN_RENAME) {
+			return false
+		}
+		if path != "" && !w.send(path, oldPath, pid, fileInfo, unix.FAN_MOVED_TO, unix.FAN_RENAME) {
+			return false
+		}
+	}
+	if mask&^unix.FAN_ONDIR != 0 && path != "" {
+		return w.send(path, "", pid, fileInfo, mask, mask)
+	}
+	return true
+}
+
+// send an event for path if it's in one of the watched roots; need is the flag
+// that must be set on the root.
+func (w *fanotify) send(path, renamedFrom string, pid int, info *EventInfo, mask, need uint64) bool {
+	w.mu.Lock()
+	r := w.matchRoot(path)
+	if r == nil || r.mask&need == 0 {
+		w.mu.Unlock()
+		return true
+	}
+	name := r.path + path[len(r.abs):]
+	if renamedFrom != "" {
+		if from := w.matchRoot(renamedFrom); from != nil {
+			renamedFrom = from.path + renamedFrom[len(from.abs):]
+		}
+	}
+
+	// The watched path itself was removed or renamed: remove the watch, like
+	// inotify does.
+	if path == r.abs && mask&(unix.FAN_DELETE|unix.FAN_MOVED_FROM) != 0 {
+		if err := w.removeRoot(r); err != nil {
+			w.mu.Unlock()
+			if !w.sendError(err) {
+				return false
+			}
+			w.mu.Lock()
+		}
+	}
+	w.mu.Unlock()
+
+	e := w.newEvent(name, mask&r.toMaskFilter())
+	e.RenamedFrom, e.Pid, e.Info = renamedFrom, pid, info
+	if e.Op == 0 {
+		return true
+	}
+	return w.sendEvent(e)
+}
+
+// toMaskFilter gets the fanotify flags to send events for; FAN_RENAME is
+// split in MOVED_FROM and MOVED_TO.
+func (r *fanRoot) toMaskFilter() uint64 {
+	m := r.mask
+	if m&unix.FAN_RENAME != 0 {
+		m |= unix.FAN_MOVED_FROM | unix.FAN_MOVED_TO
+	}
+	return m
+}
+
+// matchRoot finds the root for the path: either the path itself, the
+// directory it's in, or any parent directory for recursive watches.
+//
+// Must be called with w.mu held.
+func (w *fanotify) matchRoot(path string) *fanRoot {
+	dir := path
+	for depth := 0; ; depth++ {
+		if r, ok := w.roots[dir]; ok && (depth == 0 || (r.dir && (depth == 1 || r.recurse))) {
+			return r
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+}
+
+func (w *fanotify) newEvent(name string, mask uint64) Event {
+	e := Event{Name: name}
+	if mask&unix.FAN_CREATE != 0 || mask&unix.FAN_MOVED_TO != 0 {
+		e.Op |= Create
+	}
+	if mask&unix.FAN_DELETE != 0 {
+		e.Op |= Remove
+	}
+	if mask&unix.FAN_MODIFY != 0 {
+		e.Op |= Write
+	}
+	if mask&unix.FAN_MOVED_FROM != 0 {
+		e.Op |= Rename
+	}
+	if mask&unix.FAN_ATTRIB != 0 {
+		e.Op |= Chmod
+	}
+	if mask&unix.FAN_OPEN != 0 {
+		e.Op |= xUnportableOpen
+	}
+	if mask&unix.FAN_ACCESS != 0 {
+		e.Op |= xUnportableRead
+	}
+	if mask&unix.FAN_CLOSE_WRITE != 0 {
+		e.Op |= UnportableCloseWrite
+	}
+	if mask&unix.FAN_CLOSE_NOWRITE != 0 {
+		e.Op |= xUnportableCloseRead
+	}
+	return e
+}
+
+// parseFid parses a fanotify_event_info_fid record. key is the filesystem ID
+// and file handle, which uniquely identifies the file. name is only set for
+// DFID_NAME records.
+func parseFid(rec []byte) (fid *fanInfoFid, fh *fanFileHandle, key, name string, ok bool) {
+	const (
+		fidSize = int(unsafe.Sizeof(fanInfoFid{}))
+		fhSize  = int(unsafe.Sizeof(fanFileHandle{}))
+	)
+	if len(rec) < fidSize+fhSize {
+		return nil, nil, "", "", false
+	}
+	fid = (*fanInfoFid)(unsafe.Pointer(&rec[0]))
+	fh = (*fanFileHandle)(unsafe.Pointer(&rec[fidSize]))
+	end := fidSize + fhSize + int(fh.Bytes)
+	if end > len(rec) {
+		return nil, nil, "", "", false
+	}
+	key = string(rec[unsafe.Sizeof(fanInfoHeader{}):end])
+
+	if fid.Hdr.InfoType != unix.FAN_EVENT_INFO_TYPE_DFID && fid.Hdr.InfoType != unix.FAN_EVENT_INFO_TYPE_FID {
+		name = string(rec[end:])
+		if i := strings.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+	}
+	return fid, fh, key, name, true
+}
+
+// openHandle gets the current path for the file handle.
+func (w *fanotify) openHandle(fid *fanInfoFid, fh *fanFileHandle, rec []byte) (string, error) {
+	w.mu.Lock()
+	m, ok := w.marks[fid.Fsid]
+	w.mu.Unlock()
+	if !ok {
+		return "", unix.ESTALE
+	}
+
+	start := int(unsafe.Sizeof(fanInfoFid{}) + unsafe.Sizeof(fanFileHandle{}))
+	handle := unix.NewFileHandle(fh.Type, rec[start:start+int(fh.Bytes)])
+	fd, err := unix.OpenByHandleAt(m.mountFd, handle, unix.O_PATH|unix.O_CLOEXEC)
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(fd)
+	path, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(fd))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(path, " (deleted)"), nil
+}
+
+// Maximum number of entries in fanotify.dirs.
+const maxDirCache = 4096
+
+// resolve gets the path from a fanotify_event_info_fid record, including the
+// filename for DFID_NAME records. Returns "" if the path can't be found.
+//
+// Directories that can no longer be opened (e.g. because they were removed)
+// are looked up in w.dirs, so that events for a file in a directory that was
+// removed right after can still be reported.
+//
+// Must only be called from readEvents().
+func (w *fanotify) resolve(rec []byte) string {
+	fid, fh, key, name, ok := parseFid(rec)
+	if !ok {
+		return ""
+	}
+
+	dir, err := w.openHandle(fid, fh, rec)
+	if err != nil {
+		var ok bool
+		if dir, ok = w.dirs[key]; !ok {
+			return ""
+		}
+	} else if fid.Hdr.InfoType != unix.FAN_EVENT_INFO_TYPE_FID {
+		if len(w.dirs) >= maxDirCache {
+			w.dirs = make(map[string]string)
+		}
+		w.dirs[key] = dir
+	}
+
+	if name == "" || name == "." {
+		return dir
+	}
+	return filepath.Join(dir, name)
+}
@@ -24,22 +24,33 @@ type fen struct {
 
 	mu      sync.Mutex
 	port    *unix.EventPort
-	done    chan struct{} // Channel for sending a "quit message" to the reader goroutine
-	dirs    map[string]Op // Explicitly watched directories
-	watches map[string]Op // Explicitly watched non-directories
+	done    chan struct{}  // Channel for sending a "quit message" to the reader goroutine
+	dirs    map[string]Op  // Explicitly watched directories
+	watches map[string]Op  // Explicitly watched non-directories
+	raw     func(RawEvent) // WithRawEvents()
 }
 
 func newBackend(ev chan Event, errs chan error) (backend, error) {
-	return newBufferedBackend(0, ev, errs)
+	return newBufferedBackend(0, ev, errs, defaultWatcherOpts)
 }
 
-func newBufferedBackend(sz uint, ev chan Event, errs chan error) (backend, error) {
+func newBufferedBackend(sz uint, ev chan Event, errs chan error, with watcherOpts) (backend, error) {
+	if with.external {
+		return nil, fmt.Errorf("%w: WithExternalLoop", xErrUnsupported)
+	}
+	if with.audit {
+		return nil, fmt.Errorf("%w: WithAudit", xErrUnsupported)
+	}
+	if with.ebpf {
+		return nil, fmt.Errorf("%w: WithEBPF", xErrUnsupported)
+	}
 	w := &fen{
 		Events:  ev,
 		Errors:  errs,
 		dirs:    make(map[string]Op),
 		watches: make(map[string]Op),
 		done:    make(chan struct{}),
+		raw:     with.raw,
 	}
 
 	var err error
@@ -69,6 +80,7 @@ func (w *fen) sendError(err error) (sent bool) {
 	if err == nil {
 		return true
 	}
+	err = wrapError(w, "watch", "", err)
 	select {
 	case <-w.done:
 		return false
@@ -120,6 +132,10 @@ func (w *fen) AddWith(name string, opts ...addOpt) error {
 	if err != nil {
 		return err
 	}
+	// FILE_OBJ only works for regular files and directories.
+	if isSpecial(stat.Mode()) {
+		return &FileTypeError{Path: name, Mode: stat.Mode().Type()}
+	}
 
 	// Associate all files in the directory.
 	if stat.IsDir() {
@@ -129,7 +145,7 @@ func (w *fen) AddWith(name string, opts ...addOpt) error {
 		}
 
 		w.mu.Lock()
-		w.dirs[name] = with.op
+		w.dirs[name] |= with.op
 		w.mu.Unlock()
 		return nil
 	}
@@ -140,11 +156,37 @@ func (w *fen) AddWith(name string, opts ...addOpt) error {
 	}
 
 	w.mu.Lock()
-	w.watches[name] = with.op
+	w.watches[name] |= with.op
 	w.mu.Unlock()
 	return nil
 }
 
+func (w *fen) removeOps(name string, op Op) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  RemoveOps(%q, %s)\n",
+			time.Now().Format("15:04:05.000000000"), name, op)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	m := w.watches
+	if _, ok := w.dirs[name]; ok {
+		m = w.dirs
+	}
+	prev, ok := m[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	if prev&^op == 0 {
+		return errAllOps(name)
+	}
+	m[name] = prev &^ op
+	return nil
+}
+
 func (w *fen) Remove(name string) error {
 	if w.isClosed() {
 		return nil
@@ -227,6 +269,9 @@ func (w *fen) readEvents() {
 			if debug {
 				internal.Debug(pevent.Path, pevent.Events)
 			}
+			if w.raw != nil {
+				w.raw(RawEvent{Name: pevent.Path, Mask: uint64(pevent.Events)})
+			}
 
 			err = w.handleEvent(&pevent)
 			if !w.sendError(err) {
@@ -273,9 +318,24 @@ func (w *fen) handleEvent(event *unix.PortEvent) error {
 	w.mu.Lock()
 	_, watchedDir := w.dirs[path]
 	_, watchedPath := w.watches[path]
+	ops := w.dirs[path] | w.watches[path] | w.dirs[filepath.Dir(path)]
 	w.mu.Unlock()
 	isWatched := watchedDir || watchedPath
 
+	// Something was mounted over the path, or the filesystem it's on was
+	// unmounted. The association is removed, and is set up again below for
+	// whatever is at the path now.
+	if events&unix.MOUNTEDOVER != 0 && ops.Has(UnportableMount) {
+		if !w.sendEvent(path, UnportableMount) {
+			return nil
+		}
+	}
+	if events&unix.UNMOUNTED != 0 && ops.Has(UnportableUnmount) {
+		if !w.sendEvent(path, UnportableUnmount) {
+			return nil
+		}
+	}
+
 	if events&unix.FILE_DELETE != 0 {
 		if !w.sendEvent(path, Remove) {
 			return nil
@@ -475,9 +535,62 @@ func (w *fen) WatchList() []string {
 	return entries
 }
 
+func (w *fen) watchInfo() []WatchInfo {
+	if w.isClosed() {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	l := make([]WatchInfo, 0, len(w.watches)+len(w.dirs))
+	for pathname, op := range w.dirs {
+		l = append(l, WatchInfo{Path: pathname, Op: op})
+	}
+	for pathname, op := range w.watches {
+		l = append(l, WatchInfo{Path: pathname, Op: op})
+	}
+	return l
+}
+
+func (w *fen) Stats() Stats {
+	if w.isClosed() {
+		return Stats{}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return Stats{Watches: len(w.watches) + len(w.dirs)}
+}
+
+// backendName is the name of the backend newBufferedBackend() creates, for
+// the pprof labels with WithProfiling().
+func backendName(with watcherOpts) string { return "fen" }
+
+func probe(path string, with watcherOpts) Capabilities {
+	c := Capabilities{Ops: supportedOps((&fen{}).xSupports), FileWrites: true}
+	var st unix.Statvfs_t
+	if unix.Statvfs(path, &st) == nil {
+		b := make([]byte, 0, len(st.Basetype))
+		for _, ch := range st.Basetype {
+			if ch == 0 {
+				break
+			}
+			b = append(b, byte(ch))
+		}
+		c.FSType = string(b)
+	}
+	c.Network = c.FSType == "nfs" || c.FSType == "smbfs"
+	return c
+}
+
+func (w *fen) name() string { return "fen" }
+
 func (w *fen) xSupports(op Op) bool {
 	if op.Has(xUnportableOpen) || op.Has(xUnportableRead) ||
-		op.Has(UnportableCloseWrite) || op.Has(xUnportableCloseRead) {
+		op.Has(UnportableCloseWrite) || op.Has(xUnportableCloseRead) ||
+		op.Has(UnportableSecurity) || op.Has(UnportableExtend) || op.Has(UnportableTruncate) ||
+		op.Has(UnportableMode) || op.Has(UnportableOwner) || op.Has(UnportableTimes) ||
+		op.Has(UnportableXattr) || op.Has(UnportableACL) || op.Has(UnportableLink) ||
+		op.Has(UnportableUnlink) || op.Has(UnportableClone) {
 		return false
 	}
 	return true
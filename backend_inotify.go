@@ -7,8 +7,11 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -31,6 +34,34 @@ type inotify struct {
 	doneMu      sync.Mutex
 	doneResp    chan struct{} // Channel to respond to Close
 
+	// For WithExternalLoop(): there's no reader goroutine and events are
+	// collected in pending until ReadEvents() is called.
+	external bool
+	pending  pending
+	readMu   sync.Mutex // Only one ReadEvents() at a time, and not during Close().
+
+	raw      func(RawEvent)     // WithRawEvents()
+	addFault func(string) error // Faults.AddError from WithFaults()
+
+	// For UnportableMount and UnportableUnmount; started on the first
+	// AddWith() that uses them.
+	mounts   *mountWatch
+	mountsMu sync.Mutex
+
+	// Paths on filesystems where inotify doesn't work are polled; pollFS is
+	// nil with WithNoPolling(). On Android paths are also polled after
+	// running in to fs.inotify.max_user_watches, if pollLimit is set.
+	poll      *poller
+	pollFS    func(path string) string
+	pollLimit bool
+
+	// Directories on SMB mounts use CIFS_IOC_NOTIFY_INFO; see
+	// backend_inotify_smb.go. smbSend is held while sending events.
+	smb        map[string]*smbWatch
+	smbMu      sync.Mutex
+	smbSend    sync.RWMutex
+	smbStopped bool
+
 	// Store rename cookies in an array, with the index wrapping to 0. Almost
 	// all of the time what we get is a MOVED_FROM to set the cookie and the
 	// next event inotify sends will be MOVED_TO to read it. However, this is
@@ -45,9 +76,15 @@ type inotify struct {
 	// Ten items should be more than enough for our purpose, and a loop over
 	// such a short array is faster than a map access anyway (not that it hugely
 	// matters since we're talking about hundreds of ns at the most, but still).
-	cookies     [10]koekje
-	cookieIndex uint8
-	cookiesMu   sync.Mutex
+	//
+	// With WithRenameWindow() the cookies are stored in renames instead, and
+	// removed after renameWindow.
+	cookies      [10]koekje
+	cookieIndex  uint8
+	cookiesMu    sync.Mutex
+	renameWindow time.Duration
+	clock        Clock
+	renames      map[uint32]koekje
 }
 
 type (
@@ -61,10 +98,22 @@ type (
 		flags   uint32 // inotify flags of this watch (see inotify(7) for the list of valid flags)
 		path    string // Watch path.
 		recurse bool   // Recursion with ./...?
+		ns      bool   // Added with AddInNamespace(), so path isn't a path on the host.
+
+		// Unportable ops that inotify doesn't handle: UnportableExtend and
+		// UnportableTruncate (inotify doesn't report the size, so we keep
+		// track of it in sizes), UnportableMount and UnportableUnmount, and
+		// the attrOps (tracked in attrs), and UnportableClone (files that
+		// weren't written to since they were created are in created).
+		ops     Op
+		sizes   map[string]int64
+		attrs   map[string]fileAttrs
+		created map[string]struct{}
 	}
 	koekje struct {
 		cookie uint32
 		path   string
+		at     time.Time // Only with WithRenameWindow().
 	}
 )
 
@@ -140,6 +189,24 @@ func (w *watches) byWd(wd uint32) *watch {
 	return w.wd[wd]
 }
 
+// move changes the path of the watch for from and all watches in it to to, for
+// a directory that was renamed in a recursive watch.
+func (w *watches) move(from, to string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for p, wd := range w.path {
+		if p != from && !strings.HasPrefix(p, from+string(filepath.Separator)) {
+			continue
+		}
+		newPath := to + p[len(from):]
+		delete(w.path, p)
+		w.path[newPath] = wd
+		if ww := w.wd[wd]; ww != nil && ww.path == p {
+			ww.path = newPath
+		}
+	}
+}
+
 func (w *watches) updatePath(path string, f func(*watch) (*watch, error)) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -167,14 +234,36 @@ func (w *watches) updatePath(path string, f func(*watch) (*watch, error)) error
 }
 
 func newBackend(ev chan Event, errs chan error) (backend, error) {
-	return newBufferedBackend(0, ev, errs)
+	return newBufferedBackend(0, ev, errs, defaultWatcherOpts)
 }
 
-func newBufferedBackend(sz uint, ev chan Event, errs chan error) (backend, error) {
+func newBufferedBackend(sz uint, ev chan Event, errs chan error, with watcherOpts) (backend, error) {
+	if with.audit {
+		if with.volume || with.external || with.queueWarnFn != nil {
+			return nil, fmt.Errorf("%w: WithAudit with WithWholeVolume, WithExternalLoop, or WithQueueWarning", xErrUnsupported)
+		}
+		return newAudit(ev, errs)
+	}
+	if with.ebpf {
+		if with.volume || with.external || with.queueWarnFn != nil {
+			return nil, fmt.Errorf("%w: WithEBPF with WithWholeVolume, WithExternalLoop, or WithQueueWarning", xErrUnsupported)
+		}
+		return newEBPF(ev, errs)
+	}
+	if with.volume {
+		if with.external || with.queueWarnFn != nil {
+			return nil, fmt.Errorf("%w: WithWholeVolume with WithExternalLoop or WithQueueWarning", xErrUnsupported)
+		}
+		return newFanotify(ev, errs, with.raw)
+	}
+
 	// Need to set nonblocking mode for SetDeadline to work, otherwise blocking
 	// I/O operations won't terminate on close.
 	fd, errno := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
 	if fd == -1 {
+		if errno == unix.EMFILE {
+			return nil, newInitLimitError(errno)
+		}
 		return nil, errno
 	}
 
@@ -186,14 +275,98 @@ func newBufferedBackend(sz uint, ev chan Event, errs chan error) (backend, error
 		watches:     newWatches(),
 		done:        make(chan struct{}),
 		doneResp:    make(chan struct{}),
+		external:    with.external,
+		raw:         with.raw,
+
+		renameWindow: with.renameWindow,
+		clock:        with.clock,
+	}
+	if with.faults != nil {
+		w.addFault = with.faults.AddError
+	}
+	if w.renameWindow > 0 {
+		w.renames = make(map[uint32]koekje)
+	}
+	w.pending.limit, w.pending.policy = with.memLimit, with.memPolicy
+	w.poll = newPoller(w.sendEvent, w.sendError, with.clock, with.pollWorkers)
+	if !with.noPolling {
+		w.pollFS = pollFSType
+		// The default limit is only 8192 on Android, shared by all watchers of
+		// the app.
+		w.pollLimit = runtime.GOOS == "android"
 	}
 
-	go w.readEvents()
+	if w.external {
+		close(w.doneResp)
+	} else {
+		go w.readEvents()
+	}
+	if with.queueWarnFn != nil {
+		go w.watchQueue(with.queueWarn, with.queueWarnFn)
+	}
 	return w, nil
 }
 
+// How often watchQueue() checks the queue.
+var queueInterval = 100 * time.Millisecond
+
+// watchQueue periodically checks the number of bytes in the queue, and calls fn
+// when it goes over the threshold.
+func (w *inotify) watchQueue(threshold int, fn func(int)) {
+	t := time.NewTicker(queueInterval)
+	defer t.Stop()
+
+	var over bool
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-t.C:
+		}
+
+		n, err := w.queued()
+		if err != nil {
+			return
+		}
+		if n > threshold && !over {
+			fn(n)
+		}
+		over = n > threshold
+	}
+}
+
+// queued gets the number of unread bytes on the inotify fd.
+func (w *inotify) queued() (int, error) {
+	// Use RawConn so the fd won't get closed (and possibly re-used) while we're
+	// using it.
+	rc, err := w.inotifyFile.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		n     int
+		ioErr error
+	)
+	err = rc.Control(func(fd uintptr) {
+		// TIOCINQ is the same as FIONREAD on Linux; x/sys doesn't have the
+		// latter.
+		n, ioErr = unix.IoctlGetInt(int(fd), unix.TIOCINQ)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, ioErr
+}
+
 // Returns true if the event was sent, or false if watcher is closed.
 func (w *inotify) sendEvent(e Event) bool {
+	if w.external {
+		if w.isClosed() {
+			return false
+		}
+		w.pending.event(e)
+		return true
+	}
 	select {
 	case <-w.done:
 		return false
@@ -207,6 +380,14 @@ func (w *inotify) sendError(err error) bool {
 	if err == nil {
 		return true
 	}
+	err = wrapError(w, "watch", "", err)
+	if w.external {
+		if w.isClosed() {
+			return false
+		}
+		w.pending.err(err)
+		return true
+	}
 	select {
 	case <-w.done:
 		return false
@@ -233,6 +414,16 @@ func (w *inotify) Close() error {
 	close(w.done)
 	w.doneMu.Unlock()
 
+	if w.external {
+		w.stopSMB()
+		w.stopMounts()
+		w.poll.stop()
+		w.readMu.Lock()
+		defer w.readMu.Unlock()
+		close(w.Events)
+		close(w.Errors)
+	}
+
 	// Causes any blocking reads to return with an error, provided the file
 	// still supports deadline operations.
 	err := w.inotifyFile.Close()
@@ -263,11 +454,125 @@ func (w *inotify) AddWith(path string, opts ...addOpt) error {
 	}
 
 	path, recurse := recursivePath(path)
+	if recurse && with.poll {
+		return fmt.Errorf("%w: WithPolling for recursive watches", xErrUnsupported)
+	}
 	if recurse {
-		return filepath.WalkDir(path, func(root string, d fs.DirEntry, err error) error {
+		return w.addRecursive(path, with)
+	}
+	if with.poll {
+		return w.poll.addWith(path, with.op, "", virtualFilesystems[fsTypeName(path)], getPollConfig(with))
+	}
+
+	if w.pollFS != nil {
+		if fstype := w.pollFS(path); fstype != "" {
+			if smbFilesystems[fstype] {
+				return w.addSMB(path, with.op, fstype, getPollConfig(with))
+			}
+			return w.poll.add(path, with.op, fstype, getPollConfig(with))
+		}
+	}
+	return w.pollAtLimit(path, with, w.add(path, with, false))
+}
+
+// pollAtLimit polls path instead if adding it failed with err because
+// fs.inotify.max_user_watches was reached, with pollLimit. Returns err
+// otherwise.
+func (w *inotify) pollAtLimit(path string, with withOpts, err error) error {
+	var lerr *WatchLimitError
+	if !w.pollLimit || !errors.As(err, &lerr) || lerr.Sysctl != "fs.inotify.max_user_watches" {
+		return err
+	}
+	if with.op&^pollOps != 0 {
+		return err
+	}
+	return w.poll.addAtLimit(path, with.op, fsTypeName(path), lerr.Sysctl, getPollConfig(with))
+}
+
+func (w *inotify) addInNamespace(nsPath, path string, opts ...addOpt) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  AddInNamespace(%q, %q)\n",
+			time.Now().Format("15:04:05.000000000"), nsPath, path)
+	}
+
+	with := getOptions(opts...)
+	// These need to access the path after adding it.
+	unsup := with.op & (UnportableExtend | UnportableTruncate | UnportableMount | UnportableUnmount | UnportableClone | attrOps)
+	if !w.xSupports(with.op) || unsup != 0 {
+		return fmt.Errorf("%w: %s", xErrUnsupported, with.op)
+	}
+	if _, recurse := recursivePath(path); recurse {
+		return fmt.Errorf("%w: recursive watches with AddInNamespace", xErrUnsupported)
+	}
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("fsnotify: path must be absolute: %q", path)
+	}
+	path = filepath.Clean(path)
+	if w.watches.byPath(path) != nil {
+		return fmt.Errorf("fsnotify: %q is already watched", path)
+	}
+
+	fd, err := openInNamespace(nsPath, path, with.noFollow)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	// The fd was opened with O_NOFOLLOW already, and IN_DONT_FOLLOW would
+	// watch the /proc symlink.
+	flags := inotifyFlags(with) &^ unix.IN_DONT_FOLLOW
+	return w.register(path, "/proc/self/fd/"+strconv.Itoa(fd), flags, false, true)
+}
+
+func (w *inotify) addFd(fd int, name string, opts ...addOpt) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	path := filepath.Clean(name)
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  AddFd(%d, %q)\n",
+			time.Now().Format("15:04:05.000000000"), fd, path)
+	}
+
+	with := getOptions(opts...)
+	// These need to access the path after adding it.
+	unsup := with.op & (UnportableExtend | UnportableTruncate | UnportableMount | UnportableUnmount | UnportableClone | attrOps)
+	if !w.xSupports(with.op) || unsup != 0 {
+		return fmt.Errorf("%w: %s", xErrUnsupported, with.op)
+	}
+	if w.watches.byPath(path) != nil {
+		return fmt.Errorf("fsnotify: %q is already watched", path)
+	}
+
+	// The fd already refers to the file, and IN_DONT_FOLLOW would watch the
+	// /proc symlink.
+	flags := inotifyFlags(with) &^ unix.IN_DONT_FOLLOW
+	return w.register(path, "/proc/self/fd/"+strconv.Itoa(fd), flags, false, true)
+}
+
+// addRecursive adds path and all directories in it. Symlinks to directories are
+// followed after all other directories are added with WithFollowSymlinks(),
+// so that the directories are watched with their own path if the symlink
+// points inside path.
+func (w *inotify) addRecursive(path string, with withOpts) error {
+	type devIno struct{ dev, ino uint64 }
+	var (
+		visited = make(map[devIno]struct{})
+		links   []string
+	)
+	walk := func(start string) error {
+		return filepath.WalkDir(start, func(root string, d fs.DirEntry, err error) error {
 			if err != nil {
 				return err
 			}
+			root = filepath.Clean(root)
+			if with.followLinks && d.Type()&fs.ModeSymlink != 0 {
+				links = append(links, root)
+				return nil
+			}
 			if !d.IsDir() {
 				if root == path {
 					return fmt.Errorf("fsnotify: not a directory: %q", path)
@@ -285,18 +590,133 @@ func (w *inotify) AddWith(path string, opts ...addOpt) error {
 				w.sendEvent(Event{Name: root, Op: Create})
 			}
 
+			if with.followLinks {
+				var st unix.Stat_t
+				if err := unix.Stat(root, &st); err == nil {
+					visited[devIno{uint64(st.Dev), uint64(st.Ino)}] = struct{}{}
+				}
+			}
 			return w.add(root, with, true)
 		})
 	}
+	if err := walk(path); err != nil || !with.followLinks {
+		return err
+	}
+
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	for len(links) > 0 {
+		link := links[0]
+		links = links[1:]
+
+		var st unix.Stat_t
+		if err := unix.Stat(link, &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFDIR {
+			continue // Broken symlink, or not a directory.
+		}
+		var skip error
+		if _, ok := visited[devIno{uint64(st.Dev), uint64(st.Ino)}]; ok {
+			skip = ErrSymlinkLoop
+		} else if !with.followOutside {
+			target, err := filepath.EvalSymlinks(link)
+			if err != nil {
+				continue
+			}
+			if target != real && !strings.HasPrefix(target, real+string(filepath.Separator)) {
+				skip = ErrSymlinkEscape
+			}
+		}
+		if skip != nil {
+			if debug {
+				fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  skipping symlink %q: %s\n",
+					time.Now().Format("15:04:05.000000000"), link, skip)
+			}
+			if !w.sendError(&os.PathError{Op: "follow", Path: link, Err: skip}) {
+				return ErrClosed
+			}
+			continue
+		}
 
-	return w.add(path, with, false)
+		// The trailing / makes WalkDir() follow the symlink.
+		if err := walk(link + string(filepath.Separator)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openInNamespace opens path in the mount namespace nsPath, and returns an
+// O_PATH file descriptor for it.
+//
+// setns() changes the namespace for the current thread only, so this is done
+// in a new goroutine locked to its thread. It's never unlocked, so the runtime
+// terminates the thread when the goroutine exits, rather than reusing it for
+// other goroutines.
+func openInNamespace(nsPath, path string, noFollow bool) (int, error) {
+	ns, err := unix.Open(nsPath, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("fsnotify: opening namespace: %w", err)
+	}
+	defer unix.Close(ns)
+
+	type result struct {
+		fd  int
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		// Threads share the root and working directory with the rest of the
+		// process, and setns() refuses to change the mount namespace of such
+		// a thread.
+		if err := unix.Unshare(unix.CLONE_FS); err != nil {
+			ch <- result{-1, fmt.Errorf("fsnotify: unshare: %w", err)}
+			return
+		}
+		if err := unix.Setns(ns, unix.CLONE_NEWNS); err != nil {
+			ch <- result{-1, fmt.Errorf("fsnotify: setns %q: %w", nsPath, err)}
+			return
+		}
+
+		flags := unix.O_PATH | unix.O_CLOEXEC
+		if noFollow {
+			flags |= unix.O_NOFOLLOW
+		}
+		for {
+			fd, err := unix.Open(path, flags, 0)
+			if err == unix.EINTR {
+				continue
+			}
+			if err != nil {
+				err = &os.PathError{Op: "open", Path: path, Err: err}
+			}
+			ch <- result{fd, err}
+			return
+		}
+	}()
+	r := <-ch
+	return r.fd, r.err
 }
 
 func (w *inotify) add(path string, with withOpts, recurse bool) error {
+	ops := with.op & (UnportableExtend | UnportableTruncate | UnportableMount | UnportableUnmount | UnportableClone | attrOps)
+	if err := w.register(path, path, inotifyFlags(with), recurse, true); err != nil {
+		return err
+	}
+	return w.setOps(path, ops)
+}
+
+// inotifyFlags gets the inotify flags for the options.
+func inotifyFlags(with withOpts) uint32 {
 	var flags uint32
 	if with.noFollow {
 		flags |= unix.IN_DONT_FOLLOW
 	}
+	if with.excludeUnlinked {
+		flags |= unix.IN_EXCL_UNLINK
+	}
 	if with.op.Has(Create) {
 		flags |= unix.IN_CREATE
 	}
@@ -324,17 +744,207 @@ func (w *inotify) add(path string, with withOpts, recurse bool) error {
 	if with.op.Has(xUnportableCloseRead) {
 		flags |= unix.IN_CLOSE_NOWRITE
 	}
-	return w.register(path, flags, recurse)
+	if with.op.Has(UnportableExtend) || with.op.Has(UnportableTruncate) {
+		flags |= unix.IN_MODIFY
+	}
+	if with.op&attrOps != 0 {
+		flags |= unix.IN_ATTRIB
+	}
+	if with.op.Has(UnportableLink) {
+		flags |= unix.IN_CREATE
+	}
+	if with.op.Has(UnportableUnlink) {
+		flags |= unix.IN_DELETE
+	}
+	if with.op.Has(UnportableClone) {
+		flags |= unix.IN_CREATE | unix.IN_MODIFY
+	}
+	return flags
+}
+
+// setOps adds the ops inotify doesn't handle to the watch for path, and
+// records the file sizes and attributes or starts watching the mountpoints if
+// needed.
+func (w *inotify) setOps(path string, op Op) error {
+	if op == 0 {
+		return nil
+	}
+	var (
+		sizes map[string]int64
+		attrs map[string]fileAttrs
+	)
+	if op.Has(UnportableExtend) || op.Has(UnportableTruncate) {
+		sizes = readSizes(path)
+	}
+	if op&attrOps != 0 {
+		attrs = readAttrs(path, op)
+	}
+	if op.Has(UnportableMount) || op.Has(UnportableUnmount) {
+		if err := w.watchMounts(); err != nil {
+			return err
+		}
+	}
+
+	watch := w.watches.byPath(path)
+	if watch == nil {
+		return nil
+	}
+	w.watches.mu.Lock()
+	defer w.watches.mu.Unlock()
+	watch.ops |= op
+	if sizes != nil {
+		watch.sizes = sizes
+	}
+	if attrs != nil {
+		watch.attrs = attrs
+	}
+	return nil
+}
+
+// readSizes gets the size of path, or of all files in path if it's a
+// directory.
+func readSizes(path string) map[string]int64 {
+	sizes := make(map[string]int64)
+	if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+		sizes[path] = fi.Size()
+	} else if ls, err := os.ReadDir(path); err == nil {
+		for _, f := range ls {
+			if fi, err := f.Info(); err == nil && fi.Mode().IsRegular() {
+				sizes[path+"/"+f.Name()] = fi.Size()
+			}
+		}
+	}
+	return sizes
+}
+
+// readAttrs gets the attributes of path, and of all entries in path if it's a
+// directory.
+func readAttrs(path string, op Op) map[string]fileAttrs {
+	attrs := make(map[string]fileAttrs)
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return attrs
+	}
+	attrs[path] = attrsOf(path, fi, op)
+	if fi.IsDir() {
+		if ls, err := os.ReadDir(path); err == nil {
+			for _, f := range ls {
+				if fi, err := f.Info(); err == nil {
+					p := path + "/" + f.Name()
+					attrs[p] = attrsOf(p, fi, op)
+				}
+			}
+		}
+	}
+	return attrs
 }
 
-func (w *inotify) register(path string, flags uint32, recurse bool) error {
+func (w *watches) ops(ww *watch) Op {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return ww.ops
+}
+
+// resize adds UnportableExtend or UnportableTruncate to a Write event if the
+// file size changed since the previous event.
+func (w *inotify) resize(watch *watch, ev *Event, mask uint32) {
+	op := w.watches.ops(watch) & (UnportableExtend | UnportableTruncate)
+	if op == 0 || mask&unix.IN_ISDIR != 0 {
+		return
+	}
+	var size int64 = -1
+	if (ev.Has(Write) || ev.Has(Create)) && !ev.Has(Remove) && mask&unix.IN_CREATE == 0 {
+		if fi, err := os.Lstat(ev.Name); err == nil {
+			size = fi.Size()
+		}
+	}
+
+	w.watches.mu.Lock()
+	defer w.watches.mu.Unlock()
+	switch {
+	case ev.Has(Remove) || ev.Has(Rename):
+		delete(watch.sizes, ev.Name)
+	case mask&unix.IN_CREATE != 0:
+		watch.sizes[ev.Name] = 0
+	case size >= 0:
+		prev, ok := watch.sizes[ev.Name]
+		watch.sizes[ev.Name] = size
+		if ok && ev.Has(Write) {
+			if size > prev {
+				ev.Op |= op & UnportableExtend
+			} else if size < prev {
+				ev.Op |= op & UnportableTruncate
+			}
+		}
+	}
+}
+
+// reattr adds the attrOps to a Chmod event for the attributes that changed
+// since the previous event, UnportableLink to a Create event for a new hard
+// link, and UnportableUnlink to a Remove event if the file had other links.
+func (w *inotify) reattr(watch *watch, ev *Event) {
+	op := w.watches.ops(watch) & attrOps
+	if op == 0 {
+		return
+	}
+	var fi os.FileInfo
+	if !ev.Has(Remove) && !ev.Has(Rename) {
+		fi, _ = os.Lstat(ev.Name)
+	}
+
+	w.watches.mu.Lock()
+	defer w.watches.mu.Unlock()
+	prev, ok := watch.attrs[ev.Name]
+	if fi == nil {
+		if ok && ev.Has(Remove) && !prev.mode.IsDir() && prev.nlink > 1 {
+			ev.Op |= op & UnportableUnlink
+			setLinks(ev, prev.nlink-1)
+		}
+		delete(watch.attrs, ev.Name)
+		return
+	}
+	if watch.attrs == nil {
+		watch.attrs = make(map[string]fileAttrs)
+	}
+	a := attrsOf(ev.Name, fi, op)
+	watch.attrs[ev.Name] = a
+	switch {
+	case ev.Has(Create) && !a.mode.IsDir() && a.nlink > 1:
+		ev.Op |= op & UnportableLink
+	case ok && ev.Has(Chmod):
+		ev.Op |= a.changed(prev) & op
+	}
+	setLinks(ev, a.nlink)
+}
+
+// register a watch for path.
+//
+// sysPath is the path passed to inotify_add_watch(), which is usually the same
+// as path; it's different for AddInNamespace().
+//
+// With exclusive it's an error if the inode is already watched under another
+// path; without it the existing watch is taken over, which is what we want for
+// renames in recursive watches.
+func (w *inotify) register(path, sysPath string, flags uint32, recurse, exclusive bool) error {
+	flags &^= unix.IN_MASK_ADD | unix.IN_MASK_CREATE
 	return w.watches.updatePath(path, func(existing *watch) (*watch, error) {
+		var (
+			wd  int
+			err error
+		)
 		if existing != nil {
-			flags |= existing.flags | unix.IN_MASK_ADD
+			// Merge with the existing flags, rather than replacing them.
+			flags |= existing.flags
+			wd, err = unix.InotifyAddWatch(w.fd, sysPath, flags|unix.IN_MASK_ADD)
+		} else if exclusive {
+			wd, err = w.addNew(path, sysPath, flags)
+		} else {
+			wd, err = unix.InotifyAddWatch(w.fd, sysPath, flags)
 		}
-
-		wd, err := unix.InotifyAddWatch(w.fd, path, flags)
 		if wd == -1 {
+			if err == unix.ENOSPC {
+				err = newWatchLimitError(path, "fs.inotify.max_user_watches", len(w.watches.wd), err)
+			}
 			return nil, err
 		}
 
@@ -344,6 +954,7 @@ func (w *inotify) register(path string, flags uint32, recurse bool) error {
 				path:    path,
 				flags:   flags,
 				recurse: recurse,
+				ns:      sysPath != path,
 			}, nil
 		}
 
@@ -353,6 +964,97 @@ func (w *inotify) register(path string, flags uint32, recurse bool) error {
 	})
 }
 
+func newWatchLimitError(path, sysctl string, watches int, err error) error {
+	limit := -1
+	b, rErr := os.ReadFile("/proc/sys/" + strings.ReplaceAll(sysctl, ".", "/"))
+	if rErr == nil {
+		if n, rErr := strconv.Atoi(strings.TrimSpace(string(b))); rErr == nil {
+			limit = n
+		}
+	}
+	return &WatchLimitError{Path: path, Sysctl: sysctl, Limit: limit, Watches: watches, Err: err}
+}
+
+// Both limits inotify_init1() returns EMFILE for.
+const initLimits = "fs.inotify.max_user_instances or RLIMIT_NOFILE"
+
+// newInitLimitError gets the error for EMFILE from inotify_init1(), which is
+// returned if either fs.inotify.max_user_instances or RLIMIT_NOFILE was
+// reached.
+func newInitLimitError(err error) error {
+	var (
+		fds, fdErr = os.ReadDir("/proc/self/fd")
+		l          unix.Rlimit
+		nofile     = -1
+	)
+	if unix.Getrlimit(unix.RLIMIT_NOFILE, &l) == nil && l.Cur <= math.MaxInt32 {
+		nofile = int(l.Cur)
+	}
+	open := -1
+	switch {
+	case errors.Is(fdErr, unix.EMFILE): // Can't even open a directory.
+		open = nofile
+	case fdErr == nil:
+		open = len(fds) - 1 // Without the one for reading /proc/self/fd.
+	}
+
+	switch limit := initLimit(open, nofile); limit {
+	case "RLIMIT_NOFILE":
+		return &WatchLimitError{Sysctl: limit, Limit: nofile, Err: err}
+	case initLimits:
+		return &WatchLimitError{Sysctl: limit, Limit: -1, Err: err}
+	default:
+		return newWatchLimitError("", limit, 0, err)
+	}
+}
+
+// initLimit gets the limit that was reached when inotify_init1() returns
+// EMFILE, from the number of open file descriptors and RLIMIT_NOFILE (-1 if
+// unknown).
+func initLimit(open, nofile int) string {
+	switch {
+	case open < 0 || nofile < 0:
+		return initLimits
+	case open >= nofile-1: // Other goroutines may have opened or closed some.
+		return "RLIMIT_NOFILE"
+	default:
+		return "fs.inotify.max_user_instances"
+	}
+}
+
+// addNew adds a new inotify watch for a path we don't have a watch for yet.
+//
+// inotify has one watch per inode, so adding a symlink or bind mount to an
+// already watched directory would replace the flags of the existing watch, and
+// we'd get confused about which path the events are for. IN_MASK_CREATE makes
+// that an error instead.
+//
+// Must be called with w.watches.mu held.
+func (w *inotify) addNew(path, sysPath string, flags uint32) (int, error) {
+	wd, err := unix.InotifyAddWatch(w.fd, sysPath, flags|unix.IN_MASK_CREATE)
+	if wd != -1 {
+		return wd, nil
+	}
+	if err == unix.EEXIST {
+		return -1, fmt.Errorf("%w: %s", ErrAlreadyWatched, path)
+	}
+	if err != unix.EINVAL {
+		return -1, err
+	}
+
+	// IN_MASK_CREATE is only supported since Linux 4.18; check afterwards and
+	// restore the original flags.
+	wd, err = unix.InotifyAddWatch(w.fd, sysPath, flags|unix.IN_MASK_ADD)
+	if wd == -1 {
+		return -1, err
+	}
+	if other := w.watches.wd[uint32(wd)]; other != nil {
+		unix.InotifyAddWatch(w.fd, sysPath, other.flags)
+		return -1, fmt.Errorf("%w: %s is watched as %s", ErrAlreadyWatched, path, other.path)
+	}
+	return wd, nil
+}
+
 func (w *inotify) Remove(name string) error {
 	if w.isClosed() {
 		return nil
@@ -361,9 +1063,68 @@ func (w *inotify) Remove(name string) error {
 		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  Remove(%q)\n",
 			time.Now().Format("15:04:05.000000000"), name)
 	}
+	if w.poll.remove(filepath.Clean(name)) || w.removeSMB(filepath.Clean(name)) {
+		return nil
+	}
 	return w.remove(filepath.Clean(name))
 }
 
+func (w *inotify) removeOps(name string, op Op) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  RemoveOps(%q, %s)\n",
+			time.Now().Format("15:04:05.000000000"), name, op)
+	}
+	if _, recurse := recursivePath(name); recurse {
+		return fmt.Errorf("%w: RemoveOps for recursive watches", xErrUnsupported)
+	}
+
+	name = filepath.Clean(name)
+	if ok, err := w.poll.removeOps(name, op); ok {
+		return err
+	}
+	w.smbMu.Lock()
+	if sw, ok := w.smb[name]; ok {
+		defer w.smbMu.Unlock()
+		if sw.op&^op == 0 {
+			return errAllOps(name)
+		}
+		sw.op &^= op
+		return nil
+	}
+	w.smbMu.Unlock()
+
+	return w.watches.updatePath(name, func(existing *watch) (*watch, error) {
+		if existing == nil {
+			return nil, fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+		}
+		if existing.ns {
+			return nil, fmt.Errorf("%w: RemoveOps for watches added with AddInNamespace", xErrUnsupported)
+		}
+		keep := (inotifyOps(existing.flags) | existing.ops) &^ op
+		flags := inotifyFlags(withOpts{
+			op:              keep,
+			noFollow:        existing.flags&unix.IN_DONT_FOLLOW != 0,
+			excludeUnlinked: existing.flags&unix.IN_EXCL_UNLINK != 0,
+		})
+		if flags&^(unix.IN_DONT_FOLLOW|unix.IN_EXCL_UNLINK) == 0 {
+			return nil, errAllOps(name)
+		}
+
+		// Without IN_MASK_ADD this replaces the flags.
+		wd, err := unix.InotifyAddWatch(w.fd, name, flags)
+		if wd == -1 {
+			return nil, err
+		}
+		existing.wd = uint32(wd)
+		existing.flags = flags
+		existing.ops &^= op
+		return existing, nil
+	})
+}
+
 func (w *inotify) remove(name string) error {
 	wds, err := w.watches.removePath(name)
 	if err != nil {
@@ -402,13 +1163,229 @@ func (w *inotify) WatchList() []string {
 	}
 	w.watches.mu.RUnlock()
 
-	return entries
+	entries = append(entries, w.listSMB()...)
+	return append(entries, w.poll.list()...)
+}
+
+func (w *inotify) watchInfo() []WatchInfo {
+	if w.isClosed() {
+		return nil
+	}
+
+	w.watches.mu.RLock()
+	l := make([]WatchInfo, 0, len(w.watches.wd))
+	for _, ww := range w.watches.wd {
+		// Directories in a recursive watch are internal if the parent is
+		// in the same recursive watch.
+		root := ww.path
+		if ww.recurse {
+			for p := filepath.Dir(root); p != root; p = filepath.Dir(root) {
+				wd, ok := w.watches.path[p]
+				if !ok || !w.watches.wd[wd].recurse {
+					break
+				}
+				root = p
+			}
+		}
+		l = append(l, WatchInfo{
+			Path:      ww.path,
+			Op:        inotifyOps(ww.flags) | ww.ops,
+			Recursive: ww.recurse,
+			NoFollow:  ww.flags&unix.IN_DONT_FOLLOW != 0,
+			Internal:  root != ww.path,
+			Root:      root,
+			ID:        uint64(ww.wd),
+		})
+	}
+	w.watches.mu.RUnlock()
+
+	w.smbMu.Lock()
+	for path, sw := range w.smb {
+		l = append(l, WatchInfo{Path: path, Op: sw.op})
+	}
+	w.smbMu.Unlock()
+	return append(l, w.poll.info()...)
+}
+
+// inotifyOps gets the operations for the inotify flags; the reverse of
+// inotifyFlags().
+func inotifyOps(flags uint32) Op {
+	var op Op
+	if flags&unix.IN_CREATE != 0 {
+		op |= Create
+	}
+	if flags&unix.IN_MODIFY != 0 {
+		op |= Write
+	}
+	if flags&(unix.IN_DELETE|unix.IN_DELETE_SELF) != 0 {
+		op |= Remove
+	}
+	if flags&(unix.IN_MOVED_TO|unix.IN_MOVED_FROM|unix.IN_MOVE_SELF) != 0 {
+		op |= Rename
+	}
+	if flags&unix.IN_ATTRIB != 0 {
+		op |= Chmod
+	}
+	if flags&unix.IN_OPEN != 0 {
+		op |= xUnportableOpen
+	}
+	if flags&unix.IN_ACCESS != 0 {
+		op |= xUnportableRead
+	}
+	if flags&unix.IN_CLOSE_WRITE != 0 {
+		op |= UnportableCloseWrite
+	}
+	if flags&unix.IN_CLOSE_NOWRITE != 0 {
+		op |= xUnportableCloseRead
+	}
+	return op
+}
+
+// verify checks the watches against the list of watches the kernel has, and
+// the inode the path refers to now.
+func (w *inotify) verify() map[string]error {
+	if w.isClosed() {
+		return nil
+	}
+	kernel, kErr := inotifyFdinfo(w.fd)
+
+	w.watches.mu.RLock()
+	watches := make([]watch, 0, len(w.watches.wd))
+	for _, ww := range w.watches.wd {
+		watches = append(watches, *ww)
+	}
+	w.watches.mu.RUnlock()
+
+	failed := make(map[string]error)
+	for _, ww := range watches {
+		k, ok := kernel[ww.wd]
+		if kErr == nil && !ok {
+			failed[ww.path] = fmt.Errorf("%w: removed by the kernel", ErrWatchDead)
+			continue
+		}
+		if ww.ns {
+			continue
+		}
+
+		var (
+			st   unix.Stat_t
+			stat = unix.Stat
+		)
+		if ww.flags&unix.IN_DONT_FOLLOW != 0 {
+			stat = unix.Lstat
+		}
+		if err := stat(ww.path, &st); err != nil {
+			failed[ww.path] = fmt.Errorf("%w: %s", ErrWatchDead, err)
+			continue
+		}
+		if kErr == nil && (st.Ino != k.ino || uint64(st.Dev) != k.dev) {
+			failed[ww.path] = ErrWatchDiverged
+		}
+	}
+	return failed
+}
+
+type fdinfoWatch struct{ ino, dev uint64 }
+
+// inotifyFdinfo reads the watches from /proc/self/fdinfo/[fd], which has a line
+// for every watch:
+//
+//	inotify wd:1 ino:a2 sdev:800010 mask:fce ignored_mask:0 [..]
+//
+// sdev is the kernel's internal dev_t, which is converted to the format used in
+// stat.
+func inotifyFdinfo(fd int) (map[uint32]fdinfoWatch, error) {
+	b, err := os.ReadFile("/proc/self/fdinfo/" + strconv.Itoa(fd))
+	if err != nil {
+		return nil, err
+	}
+	watches := make(map[uint32]fdinfoWatch)
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "inotify ") {
+			continue
+		}
+		var (
+			wd  uint64
+			fw  fdinfoWatch
+			err error
+		)
+		for _, f := range strings.Fields(line)[1:] {
+			i := strings.IndexByte(f, ':')
+			if i == -1 {
+				continue
+			}
+			switch k, v := f[:i], f[i+1:]; k {
+			case "wd":
+				wd, err = strconv.ParseUint(v, 10, 32)
+			case "ino":
+				fw.ino, err = strconv.ParseUint(v, 16, 64)
+			case "sdev":
+				var dev uint64
+				dev, err = strconv.ParseUint(v, 16, 32)
+				fw.dev = unix.Mkdev(uint32(dev>>20), uint32(dev&(1<<20-1)))
+			}
+			if err != nil {
+				return nil, fmt.Errorf("parsing fdinfo: %q: %w", line, err)
+			}
+		}
+		watches[uint32(wd)] = fw
+	}
+	return watches, nil
+}
+
+func (w *inotify) Stats() Stats {
+	if w.isClosed() {
+		return Stats{}
+	}
+	queued, _ := w.queued()
+	return Stats{Watches: w.watches.len(), QueuedBytes: queued, Polled: len(w.poll.list())}
+}
+
+func (w *inotify) sysFd() (int, error) {
+	if !w.external {
+		return -1, errors.New("fsnotify: SysFd() requires WithExternalLoop()")
+	}
+	return w.fd, nil
+}
+
+func (w *inotify) readAvailable() ([]Event, []error) {
+	if !w.external {
+		return nil, []error{errors.New("fsnotify: ReadEvents() requires WithExternalLoop()")}
+	}
+
+	w.readMu.Lock()
+	defer w.readMu.Unlock()
+	if w.isClosed() {
+		return nil, []error{ErrClosed}
+	}
+
+	buf := make([]byte, unix.SizeofInotifyEvent*4096)
+	for !w.pending.blocked() {
+		n, err := unix.Read(w.fd, buf)
+		if err == unix.EAGAIN {
+			break
+		}
+		if err != nil {
+			w.pending.err(err)
+			break
+		}
+		if n < unix.SizeofInotifyEvent {
+			w.pending.err(errors.New("notify: short read in readEvents()"))
+			break
+		}
+		w.handleEvents(buf[:n])
+	}
+	return w.pending.take()
 }
 
 // readEvents reads from the inotify file descriptor, converts the
 // received events into Event objects and sends them via the Events channel
 func (w *inotify) readEvents() {
 	defer func() {
+		// Must be stopped before closing the channels.
+		w.stopSMB()
+		w.stopMounts()
+		w.poll.stop()
 		close(w.doneResp)
 		close(w.Errors)
 		close(w.Events)
@@ -450,126 +1427,172 @@ func (w *inotify) readEvents() {
 			continue
 		}
 
-		// We don't know how many events we just read into the buffer
-		// While the offset points to at least one whole event...
-		var offset uint32
-		for offset <= uint32(n-unix.SizeofInotifyEvent) {
-			var (
-				// Point "raw" to the event in the buffer
-				raw     = (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
-				mask    = uint32(raw.Mask)
-				nameLen = uint32(raw.Len)
-				// Move to the next event in the buffer
-				next = func() { offset += unix.SizeofInotifyEvent + nameLen }
-			)
-
-			if mask&unix.IN_Q_OVERFLOW != 0 {
-				if !w.sendError(ErrEventOverflow) {
-					return
-				}
+		if !w.handleEvents(buf[:n]) {
+			return
+		}
+	}
+}
+
+// handleEvents converts the raw events in buf to Events and sends them.
+//
+// Returns false if the watcher was closed.
+func (w *inotify) handleEvents(buf []byte) bool {
+	// We don't know how many events we just read into the buffer
+	// While the offset points to at least one whole event...
+	var offset uint32
+	for offset <= uint32(len(buf)-unix.SizeofInotifyEvent) {
+		var (
+			// Point "raw" to the event in the buffer
+			raw     = (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			mask    = uint32(raw.Mask)
+			nameLen = uint32(raw.Len)
+			// Move to the next event in the buffer
+			next = func() { offset += unix.SizeofInotifyEvent + nameLen }
+		)
+
+		if mask&unix.IN_Q_OVERFLOW != 0 {
+			if !w.sendError(ErrEventOverflow) {
+				return false
 			}
+		}
+
+		// If the event happened to the watched directory or the watched file, the kernel
+		// doesn't append the filename to the event, but we would like to always fill the
+		// the "Name" field with a valid filename. We retrieve the path of the watch from
+		// the "paths" map.
+		watch := w.watches.byWd(uint32(raw.Wd))
 
-			// If the event happened to the watched directory or the watched file, the kernel
-			// doesn't append the filename to the event, but we would like to always fill the
-			// the "Name" field with a valid filename. We retrieve the path of the watch from
-			// the "paths" map.
-			watch := w.watches.byWd(uint32(raw.Wd))
+		var name string
+		if watch != nil {
+			name = watch.path
+		}
+		if nameLen > 0 {
+			// Point "bytes" at the first byte of the filename
+			bytes := (*[unix.PathMax]byte)(unsafe.Pointer(&buf[offset+unix.SizeofInotifyEvent]))[:nameLen:nameLen]
+			// The filename is padded with NULL bytes. TrimRight() gets rid of those.
+			name += "/" + strings.TrimRight(string(bytes[0:nameLen]), "\000")
+		}
+
+		if debug {
+			internal.Debug(name, raw.Mask, raw.Cookie)
+		}
+		if w.raw != nil {
+			w.raw(RawEvent{Name: name, Mask: uint64(raw.Mask), Cookie: raw.Cookie})
+		}
 
-			var name string
+		// The filesystem was unmounted; the watch is removed and IN_IGNORED
+		// follows. Skip the event if the parent directory is watched, as that
+		// will already send it (either from its own IN_UNMOUNT, or from
+		// watchMounts() if this was the mountpoint).
+		if mask&unix.IN_UNMOUNT != 0 {
 			if watch != nil {
-				name = watch.path
-			}
-			if nameLen > 0 {
-				// Point "bytes" at the first byte of the filename
-				bytes := (*[unix.PathMax]byte)(unsafe.Pointer(&buf[offset+unix.SizeofInotifyEvent]))[:nameLen:nameLen]
-				// The filename is padded with NULL bytes. TrimRight() gets rid of those.
-				name += "/" + strings.TrimRight(string(bytes[0:nameLen]), "\000")
+				w.watches.remove(watch.wd)
+				if w.watches.ops(watch).Has(UnportableUnmount) && !w.unmountReported(watch.path) {
+					if !w.sendEvent(Event{Name: watch.path, Op: UnportableUnmount}) {
+						return false
+					}
+				}
 			}
+			next()
+			continue
+		}
 
-			if debug {
-				internal.Debug(name, raw.Mask, raw.Cookie)
-			}
+		if mask&unix.IN_IGNORED != 0 { //&& event.Op != 0
+			next()
+			continue
+		}
+
+		// inotify will automatically remove the watch on deletes; just need
+		// to clean our state here.
+		if watch != nil && mask&unix.IN_DELETE_SELF == unix.IN_DELETE_SELF {
+			w.watches.remove(watch.wd)
+		}
 
-			if mask&unix.IN_IGNORED != 0 { //&& event.Op != 0
+		// We can't really update the state when a watched path is moved;
+		// only IN_MOVE_SELF is sent and not IN_MOVED_{FROM,TO}. So remove
+		// the watch.
+		//
+		// Directories in a recursive watch that were moved inside the tree
+		// already have the new path from the IN_MOVED_TO in the parent, which
+		// is sent first. If it was moved outside the tree, stop watching it
+		// and everything in it, rather than keep watching them with the old
+		// path.
+		if watch != nil && mask&unix.IN_MOVE_SELF == unix.IN_MOVE_SELF {
+			if watch.recurse {
+				if _, err := os.Lstat(watch.path); err != nil && w.recursiveParent(watch.path) {
+					err := w.remove(filepath.Join(watch.path, "..."))
+					if err != nil && !errors.Is(err, ErrNonExistentWatch) {
+						if !w.sendError(err) {
+							return false
+						}
+					}
+				}
 				next()
 				continue
 			}
 
-			// inotify will automatically remove the watch on deletes; just need
-			// to clean our state here.
-			if watch != nil && mask&unix.IN_DELETE_SELF == unix.IN_DELETE_SELF {
-				w.watches.remove(watch.wd)
-			}
-
-			// We can't really update the state when a watched path is moved;
-			// only IN_MOVE_SELF is sent and not IN_MOVED_{FROM,TO}. So remove
-			// the watch.
-			if watch != nil && mask&unix.IN_MOVE_SELF == unix.IN_MOVE_SELF {
-				if watch.recurse {
-					next() // Do nothing
-					continue
+			err := w.remove(watch.path)
+			if err != nil && !errors.Is(err, ErrNonExistentWatch) {
+				if !w.sendError(err) {
+					return false
 				}
+			}
+		}
 
-				err := w.remove(watch.path)
-				if err != nil && !errors.Is(err, ErrNonExistentWatch) {
-					if !w.sendError(err) {
-						return
-					}
-				}
+		/// Skip if we're watching both this path and the parent; the parent
+		/// will already send a delete so no need to do it twice.
+		if mask&unix.IN_DELETE_SELF != 0 {
+			if _, ok := w.watches.path[filepath.Dir(watch.path)]; ok {
+				next()
+				continue
 			}
+		}
 
-			/// Skip if we're watching both this path and the parent; the parent
-			/// will already send a delete so no need to do it twice.
-			if mask&unix.IN_DELETE_SELF != 0 {
-				if _, ok := w.watches.path[filepath.Dir(watch.path)]; ok {
-					next()
-					continue
+		ev := w.newEvent(name, mask, raw.Cookie)
+		if watch != nil {
+			w.resize(watch, &ev, mask)
+			w.reattr(watch, &ev)
+			w.clone(watch, &ev, mask)
+		}
+		// Need to update watch path for recurse.
+		if watch != nil && watch.recurse {
+			isDir := mask&unix.IN_ISDIR == unix.IN_ISDIR
+			/// New directory created: set up watch on it.
+			if isDir && ev.Has(Create) {
+				// This was a directory rename, so we need to update all the
+				// children.
+				if ev.RenamedFrom != "" && w.watches.byPath(ev.RenamedFrom) != nil {
+					w.watches.move(ev.RenamedFrom, ev.Name)
+					ev.Op |= Move
 				}
-			}
 
-			ev := w.newEvent(name, mask, raw.Cookie)
-			// Need to update watch path for recurse.
-			if watch != nil && watch.recurse {
-				isDir := mask&unix.IN_ISDIR == unix.IN_ISDIR
-				/// New directory created: set up watch on it.
-				if isDir && ev.Has(Create) {
-					err := w.register(ev.Name, watch.flags, true)
+				var err error
+				if w.addFault != nil {
+					err = w.addFault(ev.Name)
+				}
+				if err == nil {
+					err = w.register(ev.Name, ev.Name, watch.flags, true, false)
+				}
+				if !w.sendError(err) {
+					return false
+				}
+				if err == nil {
+					err = w.setOps(ev.Name, w.watches.ops(watch))
 					if !w.sendError(err) {
-						return
-					}
-
-					// This was a directory rename, so we need to update all
-					// the children.
-					//
-					// TODO: this is of course pretty slow; we should use a
-					// better data structure for storing all of this, e.g. store
-					// children in the watch. I have some code for this in my
-					// kqueue refactor we can use in the future. For now I'm
-					// okay with this as it's not publicly available.
-					// Correctness first, performance second.
-					if ev.renamedFrom != "" {
-						w.watches.mu.Lock()
-						for k, ww := range w.watches.wd {
-							if k == watch.wd || ww.path == ev.Name {
-								continue
-							}
-							if strings.HasPrefix(ww.path, ev.renamedFrom) {
-								ww.path = strings.Replace(ww.path, ev.renamedFrom, ev.Name, 1)
-								w.watches.wd[k] = ww
-							}
-						}
-						w.watches.mu.Unlock()
+						return false
 					}
 				}
-			}
 
-			/// Send the events that are not ignored on the events channel
-			if !w.sendEvent(ev) {
-				return
 			}
-			next()
 		}
+
+		/// Send the events that are not ignored on the events channel
+		if !w.sendEvent(ev) {
+			return false
+		}
+		next()
 	}
+	return true
 }
 
 func (w *inotify) isRecursive(path string) bool {
@@ -580,6 +1603,13 @@ func (w *inotify) isRecursive(path string) bool {
 	return ww != nil && ww.recurse
 }
 
+// recursiveParent reports if the parent directory of path is watched
+// recursively, so path isn't a path added by the user.
+func (w *inotify) recursiveParent(path string) bool {
+	ww := w.watches.byPath(filepath.Dir(path))
+	return ww != nil && ww.recurse
+}
+
 func (w *inotify) newEvent(name string, mask, cookie uint32) Event {
 	e := Event{Name: name}
 	if mask&unix.IN_CREATE == unix.IN_CREATE || mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO {
@@ -610,7 +1640,9 @@ func (w *inotify) newEvent(name string, mask, cookie uint32) Event {
 		e.Op |= Chmod
 	}
 
-	if cookie != 0 {
+	if cookie != 0 && w.renames != nil {
+		e.RenamedFrom = w.pairRename(e.Name, mask, cookie)
+	} else if cookie != 0 {
 		if mask&unix.IN_MOVED_FROM == unix.IN_MOVED_FROM {
 			w.cookiesMu.Lock()
 			w.cookies[w.cookieIndex] = koekje{cookie: cookie, path: e.Name}
@@ -629,14 +1661,82 @@ func (w *inotify) newEvent(name string, mask, cookie uint32) Event {
 				}
 			}
 			w.cookiesMu.Unlock()
-			e.renamedFrom = prev
+			e.RenamedFrom = prev
 		}
 	}
 	return e
 }
 
+// pairRename remembers the cookie for IN_MOVED_FROM, and gets the old name for
+// IN_MOVED_TO, for WithRenameWindow().
+func (w *inotify) pairRename(name string, mask, cookie uint32) string {
+	w.cookiesMu.Lock()
+	defer w.cookiesMu.Unlock()
+
+	now := w.clock.Now()
+	if mask&unix.IN_MOVED_FROM == unix.IN_MOVED_FROM {
+		for k, c := range w.renames {
+			if now.Sub(c.at) > w.renameWindow {
+				delete(w.renames, k)
+			}
+		}
+		w.renames[cookie] = koekje{cookie: cookie, path: name, at: now}
+		return ""
+	}
+	if mask&unix.IN_MOVED_TO == unix.IN_MOVED_TO {
+		c, ok := w.renames[cookie]
+		delete(w.renames, cookie)
+		if ok && now.Sub(c.at) <= w.renameWindow {
+			return c.path
+		}
+	}
+	return ""
+}
+
+// backendName is the name of the backend newBufferedBackend() creates, for
+// the pprof labels with WithProfiling().
+func backendName(with watcherOpts) string {
+	switch {
+	case with.audit:
+		return "audit"
+	case with.ebpf:
+		return "ebpf"
+	case with.volume:
+		return "fanotify"
+	}
+	return "inotify"
+}
+
+func probe(path string, with watcherOpts) Capabilities {
+	c := Capabilities{FSType: fsTypeName(path), FileWrites: true}
+	if b, err := os.ReadFile("/proc/sys/fs/inotify/max_user_watches"); err == nil {
+		c.WatchLimit, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+	}
+	c.Network = pollFilesystems[c.FSType]
+	switch {
+	case virtualFilesystems[c.FSType]:
+	case with.audit:
+		c.Ops = supportedOps((&audit{}).xSupports)
+	case with.ebpf:
+		c.Ops = supportedOps((&ebpf{}).xSupports)
+	case with.volume:
+		c.Ops = supportedOps((&fanotify{}).xSupports)
+	case smbFilesystems[c.FSType] && !with.noPolling:
+		// Assumes the kernel and server support change notifications; it's
+		// polled otherwise.
+		c.Ops = Create | Write | Remove | Rename
+	case c.Network && !with.noPolling:
+		c.Ops, c.Polled, c.Latency = pollOps&^Rename, true, pollInterval
+	default:
+		c.Ops = supportedOps((&inotify{}).xSupports)
+	}
+	return c
+}
+
+func (w *inotify) name() string { return "inotify" }
+
 func (w *inotify) xSupports(op Op) bool {
-	return true // Supports everything.
+	return !op.Has(UnportableSecurity)
 }
 
 func (w *inotify) state() {
@@ -0,0 +1,93 @@
+//go:build linux
+
+package fsnotify
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Clones (reflinks) made with FICLONE, FICLONERANGE, or copy_file_range() on
+// Btrfs and XFS are sent by inotify as a normal IN_CREATE and IN_MODIFY. The
+// data of a clone is shared with the original until one of them is written
+// to, which FIEMAP reports with FIEMAP_EXTENT_SHARED.
+//
+// Files are only checked on the first Write after they were created; files
+// that were modified later may still share data with the original (or with a
+// snapshot) but aren't a clone in the sense that anyone cares about.
+
+// FS_IOC_FIEMAP from linux/fs.h, and FIEMAP_EXTENT_SHARED from
+// linux/fiemap.h.
+const (
+	fsIocFiemap        = 0xc020660b
+	fiemapExtentShared = 0x2000
+)
+
+// struct fiemap, with room for fiemapExtents extents.
+type fiemap struct {
+	start, length uint64
+	flags, mapped uint32
+	count, _      uint32
+	extents       [fiemapExtents]fiemapExtent
+}
+
+// struct fiemap_extent
+type fiemapExtent struct {
+	logical, physical, length uint64
+	_                         [2]uint64
+	flags                     uint32
+	_                         [3]uint32
+}
+
+// Number of extents to check; a clone shares all extents, so we don't need to
+// check the whole file.
+const fiemapExtents = 8
+
+// clone adds UnportableClone to the first Write event after a file was created
+// if its data is shared with another file.
+func (w *inotify) clone(watch *watch, ev *Event, mask uint32) {
+	if !w.watches.ops(watch).Has(UnportableClone) || mask&unix.IN_ISDIR != 0 {
+		return
+	}
+
+	w.watches.mu.Lock()
+	_, created := watch.created[ev.Name]
+	switch {
+	case mask&unix.IN_CREATE != 0:
+		if watch.created == nil {
+			watch.created = make(map[string]struct{})
+		}
+		watch.created[ev.Name] = struct{}{}
+		created = false
+	case ev.Has(Remove) || ev.Has(Rename) || ev.Has(Write):
+		delete(watch.created, ev.Name)
+	}
+	w.watches.mu.Unlock()
+
+	if created && ev.Has(Write) && sharedExtents(ev.Name) {
+		ev.Op |= UnportableClone
+	}
+}
+
+// sharedExtents reports if the data of the file at path is shared with
+// another file.
+func sharedExtents(path string) bool {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return false
+	}
+	defer unix.Close(fd)
+
+	fm := fiemap{length: ^uint64(0), count: fiemapExtents}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), fsIocFiemap, uintptr(unsafe.Pointer(&fm)))
+	if errno != 0 || fm.mapped == 0 {
+		return false
+	}
+	for _, e := range fm.extents[:fm.mapped] {
+		if e.flags&fiemapExtentShared == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,206 @@
+//go:build linux
+
+package fsnotify
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountWatch watches /proc/self/mountinfo for UnportableMount and
+// UnportableUnmount: inotify only sends IN_UNMOUNT for watches on the unmounted
+// filesystem, and nothing at all for mounts.
+type mountWatch struct {
+	fd     int    // /proc/self/mountinfo
+	pipe   [2]int // Closing pipe[1] stops the goroutine.
+	done   chan struct{}
+	points map[string]struct{}
+}
+
+// watchMounts starts watching the mountpoints, if not done already.
+func (w *inotify) watchMounts() error {
+	w.mountsMu.Lock()
+	defer w.mountsMu.Unlock()
+	if w.mounts != nil {
+		return nil
+	}
+
+	// Use the mount namespace of the current thread rather than that of the
+	// main thread, which may be in a different one if a goroutine locked to
+	// it changed its namespace (e.g. with AddInNamespace()). The namespace is
+	// fixed once the file is opened.
+	fd, err := unix.Open("/proc/thread-self/mountinfo", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err == unix.ENOENT { // Linux <3.17
+		fd, err = unix.Open("/proc/self/mountinfo", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	}
+	if err != nil {
+		return fmt.Errorf("fsnotify: watching mounts: %w", err)
+	}
+	m := &mountWatch{fd: fd, done: make(chan struct{})}
+	m.points, err = readMountinfo(fd)
+	if err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("fsnotify: watching mounts: %w", err)
+	}
+	if err := unix.Pipe2(m.pipe[:], unix.O_CLOEXEC); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("fsnotify: watching mounts: %w", err)
+	}
+
+	w.mounts = m
+	go w.readMounts(m)
+	return nil
+}
+
+// stopMounts stops the goroutine started by watchMounts, and waits for it to
+// exit.
+func (w *inotify) stopMounts() {
+	w.mountsMu.Lock()
+	m := w.mounts
+	w.mounts = nil
+	w.mountsMu.Unlock()
+	if m == nil {
+		return
+	}
+
+	unix.Close(m.pipe[1])
+	<-m.done
+	unix.Close(m.pipe[0])
+	unix.Close(m.fd)
+}
+
+func (w *inotify) readMounts(m *mountWatch) {
+	defer close(m.done)
+
+	fds := []unix.PollFd{
+		{Fd: int32(m.fd), Events: unix.POLLPRI},
+		{Fd: int32(m.pipe[0]), Events: unix.POLLIN},
+	}
+	for {
+		_, err := unix.Poll(fds, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			w.sendError(fmt.Errorf("fsnotify: watching mounts: %w", err))
+			return
+		}
+		if fds[1].Revents != 0 {
+			return
+		}
+		// The kernel signals changes with POLLERR|POLLPRI.
+		if fds[0].Revents&(unix.POLLPRI|unix.POLLERR) == 0 {
+			continue
+		}
+
+		points, err := readMountinfo(m.fd)
+		if err != nil {
+			if !w.sendError(fmt.Errorf("fsnotify: watching mounts: %w", err)) {
+				return
+			}
+			continue
+		}
+		prev := m.points
+		m.points = points
+
+		if !w.sendMounts(points, prev, UnportableMount) ||
+			!w.sendMounts(prev, points, UnportableUnmount) {
+			return
+		}
+	}
+}
+
+// sendMounts sends op for all mountpoints in points that aren't in other.
+//
+// Returns false if the watcher was closed.
+func (w *inotify) sendMounts(points, other map[string]struct{}, op Op) bool {
+	changed := make([]string, 0, 1)
+	for p := range points {
+		if _, ok := other[p]; !ok {
+			changed = append(changed, p)
+		}
+	}
+	sort.Strings(changed)
+
+	for _, p := range changed {
+		// Watches on an unmounted filesystem already get IN_UNMOUNT, so only
+		// send unmounts for mountpoints in watched directories.
+		if (op == UnportableMount && w.watchedWith(p, op)) || w.watchedWith(filepath.Dir(p), op) {
+			if !w.sendEvent(Event{Name: p, Op: op}) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// unmountReported reports if an unmount of path is already sent for the parent
+// directory.
+func (w *inotify) unmountReported(path string) bool {
+	return w.watchedWith(filepath.Dir(path), UnportableUnmount)
+}
+
+func (w *inotify) watchedWith(path string, op Op) bool {
+	ww := w.watches.byPath(path)
+	return ww != nil && w.watches.ops(ww).Has(op)
+}
+
+// readMountinfo reads all mountpoints from the /proc/self/mountinfo file
+// descriptor fd.
+func readMountinfo(fd int) (map[string]struct{}, error) {
+	var (
+		data []byte
+		buf  = make([]byte, 16384)
+	)
+	for {
+		n, err := unix.Pread(fd, buf, int64(len(data)))
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		data = append(data, buf[:n]...)
+	}
+
+	// Fields are:
+	//   36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+	// with the mountpoint as the fifth field. Spaces and some other characters
+	// are escaped as octal (\040).
+	points := make(map[string]struct{})
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		f := bytes.Fields(line)
+		if len(f) < 5 {
+			continue
+		}
+		points[unescapeMountinfo(string(f[4]))] = struct{}{}
+	}
+	return points, nil
+}
+
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b = append(b, byte(n))
+				i += 3
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
@@ -0,0 +1,294 @@
+//go:build linux
+
+package fsnotify
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotify only sees changes made on the local system for SMB mounts. The
+// kernel's CIFS client can send SMB2 CHANGE_NOTIFY requests to the server with
+// the CIFS_IOC_NOTIFY_INFO ioctl (Linux 6.3 and newer), which blocks until
+// something in the directory changed and returns the changes in the same
+// FILE_NOTIFY_INFORMATION format as ReadDirectoryChangesW() on Windows.
+//
+// Every watched directory has a goroutine blocking in the ioctl. This can't be
+// interrupted, so on Remove() or Close() the goroutine keeps running until the
+// next change (or until the share is unmounted).
+//
+// Paths are polled if the kernel or server doesn't support this, for files (as
+// CHANGE_NOTIFY only works on directories), and for UnportableExtend and
+// UnportableTruncate. Chmod is never sent.
+
+// Filesystems to use CIFS_IOC_NOTIFY_INFO for.
+var smbFilesystems = map[string]bool{"cifs": true, "smb2": true, "smb": true}
+
+// CIFS_IOC_NOTIFY_INFO from fs/smb/client/cifs_ioctl.h; this is
+// _IOWR(0xcf, 11, struct smb3_notify_info), which is encoded the same on all
+// architectures.
+const cifsIocNotifyInfo = 0xc009cf0b
+
+// Size of the packed struct smb3_notify_info header:
+//
+//	struct smb3_notify_info {
+//		__u32 completion_filter;
+//		bool  watch_tree;
+//		__u32 data_len;
+//		__u8  notify_data[];
+//	} __packed;
+const smb3NotifyInfoSize = 9
+
+// CompletionFilter and Action values from MS-FSCC.
+const (
+	smbNotifyFileName  = 0x001
+	smbNotifyDirName   = 0x002
+	smbNotifySize      = 0x008
+	smbNotifyLastWrite = 0x010
+
+	smbActionAdded      = 1
+	smbActionRemoved    = 2
+	smbActionModified   = 3
+	smbActionRenamedOld = 4
+	smbActionRenamedNew = 5
+)
+
+type smbWatch struct {
+	op      Op
+	poll    pollConfig // For when it falls back to polling.
+	removed bool
+}
+
+// addSMB starts watching path on the fstype SMB filesystem.
+func (w *inotify) addSMB(path string, op Op, fstype string, cfg pollConfig) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() || op&^(Create|Write|Remove|Rename|Chmod) != 0 {
+		return w.poll.add(path, op, fstype, cfg)
+	}
+
+	w.smbMu.Lock()
+	defer w.smbMu.Unlock()
+	if ww, ok := w.smb[path]; ok {
+		ww.op |= op
+		if cfg != (pollConfig{}) {
+			ww.poll = cfg
+		}
+		return nil
+	}
+
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	if w.smb == nil {
+		w.smb = make(map[string]*smbWatch)
+	}
+	ww := &smbWatch{op: op, poll: cfg}
+	w.smb[path] = ww
+	go w.readSMB(path, fstype, fd, ww)
+	return nil
+}
+
+// removeSMB stops watching path. Returns false if path isn't watched.
+func (w *inotify) removeSMB(path string) bool {
+	w.smbMu.Lock()
+	defer w.smbMu.Unlock()
+	ww, ok := w.smb[path]
+	if ok {
+		ww.removed = true
+		delete(w.smb, path)
+	}
+	return ok
+}
+
+func (w *inotify) listSMB() []string {
+	w.smbMu.Lock()
+	defer w.smbMu.Unlock()
+	l := make([]string, 0, len(w.smb))
+	for path := range w.smb {
+		l = append(l, path)
+	}
+	return l
+}
+
+// stopSMB stops the goroutines from sending anything; it must be called before
+// the channels are closed.
+func (w *inotify) stopSMB() {
+	w.smbSend.Lock()
+	defer w.smbSend.Unlock()
+	w.smbStopped = true
+}
+
+// smbOp gets the operations, or 0 if the watch was removed.
+func (w *inotify) smbOp(ww *smbWatch) Op {
+	w.smbMu.Lock()
+	defer w.smbMu.Unlock()
+	if ww.removed {
+		return 0
+	}
+	return ww.op
+}
+
+func (w *inotify) readSMB(path, fstype string, fd int, ww *smbWatch) {
+	defer unix.Close(fd)
+
+	buf := make([]byte, smb3NotifyInfoSize+65536)
+	for {
+		op := w.smbOp(ww)
+		if op == 0 {
+			return
+		}
+
+		// Clear the first entry to detect the server returning nothing, which
+		// it does if too much changed (STATUS_NOTIFY_ENUM_DIR); the kernel
+		// doesn't update data_len in that case, so it's still the buffer size.
+		filter, dataLen := smbFilter(op), uint32(len(buf)-smb3NotifyInfoSize)
+		copy(buf[0:4], (*[4]byte)(unsafe.Pointer(&filter))[:])
+		buf[4] = 0 // watch_tree
+		copy(buf[5:9], (*[4]byte)(unsafe.Pointer(&dataLen))[:])
+		for i := smb3NotifyInfoSize; i < smb3NotifyInfoSize+12; i++ {
+			buf[i] = 0
+		}
+
+		var err error
+		for {
+			_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), cifsIocNotifyInfo, uintptr(unsafe.Pointer(&buf[0])))
+			if errno != unix.EINTR {
+				if errno != 0 {
+					err = errno
+				}
+				break
+			}
+		}
+
+		w.smbSend.RLock()
+		ok := w.sendSMB(path, fstype, ww, buf, err)
+		w.smbSend.RUnlock()
+		if !ok {
+			return
+		}
+	}
+}
+
+// sendSMB sends the events (or error) from a CIFS_IOC_NOTIFY_INFO call. Returns
+// false if the goroutine should stop.
+func (w *inotify) sendSMB(path, fstype string, ww *smbWatch, buf []byte, err error) bool {
+	op := w.smbOp(ww)
+	if w.smbStopped || op == 0 {
+		return false
+	}
+
+	if err != nil {
+		if _, statErr := os.Stat(path); errors.Is(statErr, os.ErrNotExist) {
+			w.removeSMB(path)
+			if op.Has(Remove) {
+				w.sendEvent(Event{Name: path, Op: Remove})
+			}
+			return false
+		}
+
+		// Not supported by the kernel (ENOTTY) or server (EOPNOTSUPP), or the
+		// share is having problems: poll instead.
+		if err != unix.ENOTTY && err != unix.EOPNOTSUPP && err != unix.EINVAL {
+			if !w.sendError(fmt.Errorf("fsnotify: SMB change notifications for %q: %w", path, err)) {
+				return false
+			}
+		}
+		w.removeSMB(path)
+		if err := w.poll.add(path, op, fstype, ww.poll); err != nil {
+			w.sendError(err)
+		}
+		return false
+	}
+
+	var n uint32
+	copy((*[4]byte)(unsafe.Pointer(&n))[:], buf[5:9])
+	if int(n) > len(buf)-smb3NotifyInfoSize {
+		n = uint32(len(buf) - smb3NotifyInfoSize)
+	}
+	changes, overflow := parseSMBNotify(buf[smb3NotifyInfoSize : smb3NotifyInfoSize+int(n)])
+	if overflow {
+		return w.sendError(ErrEventOverflow)
+	}
+	var renamedFrom string
+	for _, c := range changes {
+		e := Event{Name: filepath.Join(path, c.name)}
+		switch c.action {
+		case smbActionAdded:
+			e.Op = Create
+		case smbActionRemoved:
+			e.Op = Remove
+		case smbActionModified:
+			e.Op = Write
+		case smbActionRenamedOld:
+			e.Op = Rename
+			renamedFrom = e.Name
+		case smbActionRenamedNew:
+			e.Op, e.RenamedFrom = Create, renamedFrom
+			renamedFrom = ""
+		}
+		if e.Op&op == 0 {
+			continue
+		}
+		if !w.sendEvent(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// smbFilter gets the CompletionFilter for the operations. Chmod isn't
+// supported: attribute changes are sent as FILE_ACTION_MODIFIED, just like
+// writes, so it's not possible to tell them apart (the Windows backend doesn't
+// send Chmod either).
+func smbFilter(op Op) uint32 {
+	var f uint32
+	if op.Has(Create) || op.Has(Remove) || op.Has(Rename) {
+		f |= smbNotifyFileName | smbNotifyDirName
+	}
+	if op.Has(Write) {
+		f |= smbNotifySize | smbNotifyLastWrite
+	}
+	return f
+}
+
+type smbChange struct {
+	action uint32
+	name   string
+}
+
+// parseSMBNotify parses the FILE_NOTIFY_INFORMATION records in buf, which are
+// always little-endian. overflow is true if there are no records.
+func parseSMBNotify(buf []byte) (changes []smbChange, overflow bool) {
+	for off := 0; off+12 <= len(buf); {
+		var (
+			next   = int(binary.LittleEndian.Uint32(buf[off:]))
+			action = binary.LittleEndian.Uint32(buf[off+4:])
+			size   = int(binary.LittleEndian.Uint32(buf[off+8:]))
+		)
+		if action == 0 || off+12+size > len(buf) {
+			break
+		}
+		name := make([]uint16, size/2)
+		for i := range name {
+			name[i] = binary.LittleEndian.Uint16(buf[off+12+i*2:])
+		}
+		changes = append(changes, smbChange{action: action, name: string(utf16.Decode(name))})
+
+		if next == 0 {
+			break
+		}
+		off += next
+	}
+	return changes, len(changes) == 0
+}
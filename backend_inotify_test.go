@@ -3,13 +3,24 @@
 package fsnotify
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
+	"unicode/utf16"
+
+	"golang.org/x/sys/unix"
 )
 
 func TestRemoveState(t *testing.T) {
@@ -139,3 +150,1331 @@ func TestInotifyDeleteOpenFile(t *testing.T) {
 	e = w.stop(t)
 	cmpEvents(t, tmp, e, newEvents(t, `remove /file`))
 }
+
+func TestInotifyExcludeUnlinked(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := join(tmp, "file")
+	touch(t, file)
+
+	w := newCollector(t)
+	if err := w.w.AddWith(tmp, WithExcludeUnlinked()); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	fp, err := os.OpenFile(file, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	rm(t, file)
+	if _, err := fp.WriteString("data"); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `remove /file`))
+}
+
+func TestInotifyAddTwice(t *testing.T) {
+	t.Parallel()
+
+	t.Run("merge ops", func(t *testing.T) {
+		t.Parallel()
+		tmp := t.TempDir()
+		touch(t, tmp, "file")
+
+		w := newCollector(t)
+		if err := w.w.AddWith(tmp, WithOps(Create)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.w.AddWith(tmp, WithOps(Remove)); err != nil {
+			t.Fatal(err)
+		}
+		w.collect(t)
+
+		touch(t, tmp, "new")
+		rm(t, tmp, "file")
+		cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+			create /new
+			remove /file
+		`))
+	})
+
+	t.Run("symlink", func(t *testing.T) {
+		t.Parallel()
+		tmp := t.TempDir()
+		mkdir(t, tmp, "dir")
+		symlink(t, join(tmp, "dir"), tmp, "link")
+
+		w := newWatcher(t)
+		addWatch(t, w, tmp, "dir")
+		err := w.Add(join(tmp, "link"))
+		if !errors.Is(err, ErrAlreadyWatched) {
+			t.Fatalf("wrong error: %v", err)
+		}
+		if have := w.WatchList(); len(have) != 1 || have[0] != join(tmp, "dir") {
+			t.Errorf("wrong WatchList: %s", have)
+		}
+	})
+}
+
+func TestInotifyWatchLimitError(t *testing.T) {
+	err := newWatchLimitError("/path", "fs.inotify.max_user_watches", 3, syscall.ENOSPC)
+
+	if !errors.Is(err, ErrWatchLimit) {
+		t.Error("not ErrWatchLimit")
+	}
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Error("not ENOSPC")
+	}
+	var limitErr *WatchLimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatal("not a WatchLimitError")
+	}
+	if limitErr.Limit <= 0 {
+		t.Errorf("Limit: %d", limitErr.Limit)
+	}
+	want := fmt.Sprintf(`fsnotify: watching "/path": no space left on device (this watcher has 3 watches; `+
+		`fs.inotify.max_user_watches is %d); the limit can be increased with "sysctl fs.inotify.max_user_watches=<n>"`,
+		limitErr.Limit)
+	if have := err.Error(); have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
+
+func TestInotifyInitLimit(t *testing.T) {
+	tests := []struct {
+		open, nofile int
+		want         string
+	}{
+		{10, 1024, "fs.inotify.max_user_instances"},
+		{1022, 1024, "fs.inotify.max_user_instances"},
+		{1023, 1024, "RLIMIT_NOFILE"},
+		{1024, 1024, "RLIMIT_NOFILE"},
+		{-1, 1024, "fs.inotify.max_user_instances or RLIMIT_NOFILE"},
+		{10, -1, "fs.inotify.max_user_instances or RLIMIT_NOFILE"},
+	}
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			if have := initLimit(tt.open, tt.nofile); have != tt.want {
+				t.Errorf("initLimit(%d, %d)\nhave: %s\nwant: %s", tt.open, tt.nofile, have, tt.want)
+			}
+		})
+	}
+
+	err := newInitLimitError(syscall.EMFILE)
+	if !errors.Is(err, ErrWatchLimit) || !errors.Is(err, syscall.EMFILE) {
+		t.Errorf("wrong error: %#v", err)
+	}
+	var limitErr *WatchLimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatal("not a WatchLimitError")
+	}
+	// Plenty of file descriptors left in the test process.
+	if limitErr.Sysctl != "fs.inotify.max_user_instances" {
+		t.Errorf("Sysctl: %q", limitErr.Sysctl)
+	}
+}
+
+func TestInotifyQueueWarning(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	warn := make(chan int, 1)
+	w, err := NewWatcherWith(WithQueueWarning(100, func(n int) {
+		select {
+		case warn <- n:
+		default:
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addWatch(t, w, tmp)
+
+	// Don't read from Events, so the queue fills up; we need to create more
+	// events than fit in the read buffer.
+	for i := 0; i < 4000; i++ {
+		touch(t, tmp, strconv.Itoa(i), noWait)
+	}
+
+	select {
+	case n := <-warn:
+		if n <= 100 {
+			t.Errorf("queued is %d", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no warning")
+	}
+	if have := w.Stats().QueuedBytes; have <= 100 {
+		t.Errorf("QueuedBytes is %d", have)
+	}
+}
+
+func TestFanotifyWholeVolume(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	mkdir(t, tmp, "other")
+	touch(t, tmp, "file")
+
+	w, err := NewWatcherWith(WithWholeVolume())
+	if err != nil {
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSYS) {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	err = w.Add(join(tmp, "dir"))
+	if errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.EOPNOTSUPP) {
+		t.Skipf("filesystem doesn't support fanotify FIDs: %s", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	addWatch(t, w, tmp, "file")
+
+	if have := w.WatchList(); len(have) != 2 {
+		t.Errorf("WatchList: %s", have)
+	}
+	if have := w.Stats(); have.Watches != 1 {
+		t.Errorf("Stats: %#v", have)
+	}
+
+	touch(t, tmp, "dir", "new")
+	touch(t, tmp, "other", "new")
+	echoAppend(t, "data", tmp, "file")
+	mv(t, join(tmp, "dir", "new"), tmp, "dir", "renamed")
+	rm(t, tmp, "dir", "renamed")
+
+	cmpEvents(t, tmp, c.stop(t), newEvents(t, `
+		create  /dir/new
+		write   /file
+		rename  /dir/new
+		create  /dir/renamed ← /dir/new
+		remove  /dir/renamed
+	`))
+}
+
+func TestFanotifyAddMount(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	touch(t, tmp, "dir", "file")
+	touch(t, tmp, "other")
+
+	w, err := NewWatcherWith(WithWholeVolume())
+	if err != nil {
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSYS) {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	err = w.AddMount(join(tmp, "dir"))
+	if errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.EOPNOTSUPP) {
+		t.Skipf("filesystem doesn't support fanotify FIDs: %s", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := w.Stats(); have.Watches != 1 {
+		t.Errorf("Stats: %#v", have)
+	}
+
+	echoAppend(t, "data", tmp, "dir", "file")
+	echoAppend(t, "data", tmp, "other")
+
+	have := c.stop(t)
+	cmpEvents(t, tmp, have, newEvents(t, `
+		write   /dir/file
+	`))
+	for _, e := range have {
+		if e.Pid != os.Getpid() {
+			t.Errorf("wrong pid for %s: %d; want %d", e, e.Pid, os.Getpid())
+		}
+	}
+}
+
+func TestFanotifyHandle(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file")
+
+	w, err := NewWatcherWith(WithWholeVolume())
+	if err != nil {
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSYS) {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	err = w.Add(tmp)
+	if errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.EOPNOTSUPP) {
+		t.Skipf("filesystem doesn't support fanotify FIDs: %s", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	echoAppend(t, "data", tmp, "file")
+	mv(t, join(tmp, "file"), tmp, "rename")
+	rm(t, tmp, "rename")
+
+	have := c.stop(t)
+	cmpEvents(t, tmp, have, newEvents(t, `
+		write   /file
+		rename  /file
+		create  /rename ← /file
+		remove  /rename
+	`))
+	for _, e := range have {
+		if e.Info == nil || e.Info.Handle == "" {
+			t.Fatalf("no handle for %s", e)
+		}
+		if e.Info.Handle != have[0].Info.Handle {
+			t.Errorf("handle for %s differs from %s", e, have[0])
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	tmp := t.TempDir()
+	file := join(tmp, "file")
+	touch(t, file)
+	if err := os.Link(file, join(tmp, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewWatcherWith(WithAudit())
+	if err != nil {
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EPROTONOSUPPORT) || errors.Is(err, syscall.ECONNREFUSED) {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	addWatch(t, w, file)
+
+	echoAppend(t, "data", tmp, "link")
+	chmod(t, 0o600, tmp, "link")
+	rm(t, tmp, "link")
+
+	have := c.stop(t)
+	if len(have) == 0 {
+		t.Skip("no audit events; auditing was probably disabled when the test started")
+	}
+	cmpEvents(t, tmp, have, newEvents(t, `
+		write   /file
+		chmod   /file
+		remove  /file
+	`))
+}
+
+func TestAuditWithOps(t *testing.T) {
+	tmp := t.TempDir()
+	file := join(tmp, "file")
+	touch(t, file)
+	for _, l := range []string{"link1", "link2"} {
+		if err := os.Link(file, join(tmp, l)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w, err := NewWatcherWith(WithAudit())
+	if err != nil {
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EPROTONOSUPPORT) || errors.Is(err, syscall.ECONNREFUSED) {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	if err := w.AddWith(file, WithOps(Write)); err != nil {
+		t.Fatal(err)
+	}
+
+	echoAppend(t, "data", tmp, "link1")
+	chmod(t, 0o600, tmp, "link1")
+	rm(t, tmp, "link1")
+
+	// Adding it again merges the ops.
+	if err := w.AddWith(file, WithOps(Remove)); err != nil {
+		t.Fatal(err)
+	}
+	chmod(t, 0o644, tmp, "link2")
+	rm(t, tmp, "link2")
+	echoAppend(t, "data", tmp, "file")
+
+	have := c.stop(t)
+	if len(have) == 0 {
+		t.Skip("no audit events; auditing was probably disabled when the test started")
+	}
+	cmpEvents(t, tmp, have, newEvents(t, `
+		write   /file
+		remove  /file
+		write   /file
+	`))
+}
+
+func newEBPFWatcher(t *testing.T) *Watcher {
+	t.Helper()
+	w, err := NewWatcherWith(WithEBPF())
+	if err != nil {
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) || strings.Contains(err.Error(), "tracefs") {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestEBPF(t *testing.T) {
+	tmp := t.TempDir()
+	touch(t, tmp, "file")
+
+	w := newEBPFWatcher(t)
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	addWatch(t, w, tmp)
+
+	touch(t, tmp, "new")
+	echoAppend(t, "data", tmp, "file")
+	chmod(t, 0o600, tmp, "file")
+	mv(t, join(tmp, "new"), tmp, "renamed")
+	rm(t, tmp, "renamed")
+	mkdir(t, tmp, "dir")
+
+	have := c.stop(t)
+	for _, e := range have {
+		if e.Pid != os.Getpid() {
+			t.Errorf("wrong Pid for %s: %d; want %d", e, e.Pid, os.Getpid())
+		}
+	}
+	cmpEvents(t, tmp, have, newEvents(t, `
+		create  /new
+		write   /file
+		chmod   /file
+		rename  /new
+		create  /renamed ← /new
+		remove  /renamed
+		create  /dir
+	`))
+}
+
+func TestEBPFWithOps(t *testing.T) {
+	tmp := t.TempDir()
+	file := join(tmp, "file")
+	touch(t, file)
+
+	w := newEBPFWatcher(t)
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	if err := w.AddWith(file, WithOps(Write)); err != nil {
+		t.Fatal(err)
+	}
+
+	echoAppend(t, "data", file)
+	chmod(t, 0o600, file)
+
+	// Adding it again merges the ops.
+	if err := w.AddWith(file, WithOps(Chmod)); err != nil {
+		t.Fatal(err)
+	}
+	chmod(t, 0o644, file)
+	echoAppend(t, "data", file)
+	rm(t, file)
+
+	cmpEvents(t, tmp, c.stop(t), newEvents(t, `
+		write   /file
+		chmod   /file
+		write   /file
+	`))
+}
+
+func TestInotifyMount(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "mnt")
+	mkdirAll(t, tmp, "a", "mnt2")
+
+	mount := func(path ...string) {
+		t.Helper()
+		err := syscall.Mount("tmpfs", join(path...), "tmpfs", 0, "")
+		if errors.Is(err, syscall.EPERM) {
+			t.Skipf("mount: %s", err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { syscall.Unmount(join(path...), syscall.MNT_DETACH) })
+		eventSeparator()
+	}
+	unmount := func(path ...string) {
+		t.Helper()
+		if err := syscall.Unmount(join(path...), 0); err != nil {
+			t.Fatal(err)
+		}
+		eventSeparator()
+	}
+
+	mount(tmp, "a", "mnt2")
+	w := newCollector(t)
+	ops := WithOps(Create | Write | Remove | Rename | Chmod | UnportableMount | UnportableUnmount)
+	if err := w.w.AddWith(tmp, ops); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.w.AddWith(join(tmp, "a", "mnt2"), ops); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	mount(tmp, "mnt")
+	if err := w.w.AddWith(join(tmp, "mnt"), ops); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, tmp, "mnt", "file")
+	unmount(tmp, "mnt")
+	unmount(tmp, "a", "mnt2")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		mount    /mnt
+		create   /mnt/file
+		unmount  /mnt
+		unmount  /a/mnt2
+	`))
+}
+
+func TestInotifyAddInNamespace(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "mnt")
+
+	// Run functions in a new mount namespace with a tmpfs mounted on /mnt, which
+	// isn't visible outside of it.
+	var (
+		run  = make(chan func())
+		done = make(chan error)
+	)
+	go func() {
+		runtime.LockOSThread()
+		err := syscall.Unshare(syscall.CLONE_FS | syscall.CLONE_NEWNS)
+		if err == nil {
+			err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+		}
+		if err == nil {
+			err = syscall.Mount("tmpfs", join(tmp, "mnt"), "tmpfs", 0, "")
+		}
+		done <- err
+		if err != nil {
+			return
+		}
+		for f := range run {
+			f()
+			done <- nil
+		}
+	}()
+	if err := <-done; err != nil {
+		if errors.Is(err, syscall.EPERM) {
+			t.Skipf("unshare: %s", err)
+		}
+		t.Fatal(err)
+	}
+	defer close(run)
+	inNS := func(f func()) {
+		run <- f
+		<-done
+	}
+
+	var nsPath string
+	inNS(func() {
+		touch(t, tmp, "mnt", "file")
+		nsPath = "/proc/self/task/" + strconv.Itoa(syscall.Gettid()) + "/ns/mnt"
+	})
+
+	w := newCollector(t)
+	if err := w.w.AddInNamespace(nsPath, join(tmp, "mnt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.w.AddInNamespace(nsPath, join(tmp, "mnt")); err == nil {
+		t.Fatal("no error when adding twice")
+	}
+	w.collect(t)
+
+	touch(t, tmp, "mnt", "outside") // Not in the namespace.
+	inNS(func() {
+		echoAppend(t, "data", tmp, "mnt", "file")
+		touch(t, tmp, "mnt", "new")
+		rm(t, tmp, "mnt", "file")
+	})
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		write   /mnt/file
+		create  /mnt/new
+		remove  /mnt/file
+	`))
+}
+
+func TestInotifyAddFile(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	f, err := os.Open(join(tmp, "dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the path after opening it; the original directory should be
+	// watched.
+	mv(t, join(tmp, "dir"), tmp, "moved")
+	mkdir(t, tmp, "dir")
+
+	w := newCollector(t)
+	if err := w.w.AddFile(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.w.AddFile(f); err == nil {
+		t.Fatal("no error when adding twice")
+	}
+	f.Close()
+	w.collect(t)
+
+	touch(t, tmp, "dir", "new") // Not watched.
+	touch(t, tmp, "moved", "file")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /dir/file
+	`))
+}
+
+func TestInotifyFollowSymlinks(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdirAll(t, tmp, "root", "dir")
+	mkdirAll(t, tmp, "outside")
+	symlink(t, join(tmp, "root"), tmp, "root", "dir", "loop")
+	symlink(t, join(tmp, "outside"), tmp, "root", "out")
+
+	// Returns the symlinks that were skipped, and the error they were skipped
+	// with.
+	add := func(w *Watcher, outside bool) map[string]error {
+		t.Helper()
+		errc := make(chan error, 1)
+		go func() { errc <- w.AddWith(join(tmp, "root", "..."), WithFollowSymlinks(outside)) }()
+		skipped := make(map[string]error)
+		for {
+			select {
+			case err := <-errc:
+				if err != nil {
+					t.Fatal(err)
+				}
+				return skipped
+			case err := <-w.Errors:
+				var e *Error
+				if !errors.As(err, &e) {
+					t.Fatalf("not an *Error: %#v", err)
+				}
+				skipped[strings.TrimPrefix(e.Path, tmp)] = e.Err
+			}
+		}
+	}
+
+	w := newWatcher(t)
+	skipped := add(w, false)
+	if len(skipped) != 2 || !errors.Is(skipped["/root/dir/loop"], ErrSymlinkLoop) ||
+		!errors.Is(skipped["/root/out"], ErrSymlinkEscape) {
+		t.Errorf("wrong skipped symlinks: %v", skipped)
+	}
+	w.Close()
+
+	w = newWatcher(t)
+	skipped = add(w, true)
+	if len(skipped) != 1 || !errors.Is(skipped["/root/dir/loop"], ErrSymlinkLoop) {
+		t.Errorf("wrong skipped symlinks: %v", skipped)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+
+	touch(t, tmp, "root", "dir", "file")
+	touch(t, tmp, "outside", "file")
+
+	cmpEvents(t, tmp, c.stop(t), newEvents(t, `
+		create  /root/dir/file
+		create  /root/out/file
+	`))
+}
+
+func TestInotifyAttrOps(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file")
+
+	w := newCollector(t)
+	ops := WithOps(Create | Write | Chmod | UnportableMode | UnportableOwner | UnportableTimes)
+	if err := w.w.AddWith(tmp, ops); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	chmod(t, 0o600, tmp, "file")
+	if err := os.Chtimes(join(tmp, "file"), time.Now(), time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	eventSeparator()
+	touch(t, tmp, "new")
+	chmod(t, 0o600, tmp, "new")
+	want := `
+		chmod|mode   /file
+		chmod|times  /file
+		create       /new
+		chmod|mode   /new
+	`
+	if os.Getuid() == 0 {
+		if err := os.Chown(join(tmp, "file"), 1, 1); err != nil {
+			t.Fatal(err)
+		}
+		eventSeparator()
+		want += "chmod|owner  /file\n"
+	}
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, want))
+}
+
+func TestInotifyXattr(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file")
+	file := join(tmp, "file")
+	if err := unix.Setxattr(file, "user.test", []byte("1"), 0); err != nil {
+		t.Skipf("setxattr: %s", err)
+	}
+
+	w := newCollector(t)
+	if err := w.w.AddWith(tmp, WithOps(Chmod|UnportableXattr)); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	if err := unix.Setxattr(file, "user.test", []byte("2"), 0); err != nil {
+		t.Fatal(err)
+	}
+	eventSeparator()
+	chmod(t, 0o600, file)
+	if err := unix.Removexattr(file, "user.test"); err != nil {
+		t.Fatal(err)
+	}
+	eventSeparator()
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		chmod|xattr  /file
+		chmod        /file
+		chmod|xattr  /file
+	`))
+}
+
+func TestInotifyACL(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file")
+	file := join(tmp, "file")
+
+	// struct posix_acl_xattr_header and posix_acl_xattr_entry; user:1:rwx.
+	acl := func(perm uint16) []byte {
+		b := make([]byte, 4, 44)
+		binary.LittleEndian.PutUint32(b, 2)
+		for _, e := range [][3]uint32{{0x01, 6, 0}, {0x02, uint32(perm), 1}, {0x04, 4, 0}, {0x10, 7, 0}, {0x20, 4, 0}} {
+			var ent [8]byte
+			binary.LittleEndian.PutUint16(ent[0:], uint16(e[0]))
+			binary.LittleEndian.PutUint16(ent[2:], uint16(e[1]))
+			binary.LittleEndian.PutUint32(ent[4:], e[2])
+			b = append(b, ent[:]...)
+		}
+		return b
+	}
+	if err := unix.Setxattr(file, "system.posix_acl_access", acl(7), 0); err != nil {
+		t.Skipf("setxattr: %s", err)
+	}
+
+	w := newCollector(t)
+	if err := w.w.AddWith(tmp, WithOps(Chmod|UnportableACL)); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	if err := unix.Setxattr(file, "system.posix_acl_access", acl(4), 0); err != nil {
+		t.Fatal(err)
+	}
+	eventSeparator()
+	if err := os.Chtimes(file, time.Now(), time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	eventSeparator()
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		chmod|acl  /file
+		chmod      /file
+	`))
+}
+
+func TestInotifyLink(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	touch(t, tmp, "file")
+
+	w := newCollector(t)
+	ops := WithOps(Create | Remove | UnportableLink | UnportableUnlink)
+	if err := w.w.AddWith(join(tmp, "dir"), ops); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	if err := os.Link(join(tmp, "file"), join(tmp, "dir", "link")); err != nil {
+		t.Fatal(err)
+	}
+	eventSeparator()
+	touch(t, tmp, "dir", "new")
+	rm(t, tmp, "dir", "new")
+	rm(t, tmp, "dir", "link")
+
+	have := w.stop(t)
+	cmpEvents(t, tmp, have, newEvents(t, `
+		create|link    /dir/link
+		create         /dir/new
+		remove         /dir/new
+		remove|unlink  /dir/link
+	`))
+	if have[0].Info == nil || have[0].Info.Links != 2 {
+		t.Errorf("wrong Info for Link: %+v", have[0].Info)
+	}
+	if have[3].Info == nil || have[3].Info.Links != 1 {
+		t.Errorf("wrong Info for Unlink: %+v", have[3].Info)
+	}
+}
+
+func TestInotifyClone(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newCollector(t)
+	if err := w.w.AddWith(tmp, WithOps(Create|Write|UnportableClone)); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	echoAppend(t, "data", tmp, "file")
+	src, err := os.Open(join(tmp, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := os.Create(join(tmp, "clone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	want := `
+		create       /file
+		write        /file
+		create       /clone
+	`
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err == nil {
+		want += "write|clone  /clone\n"
+	} else {
+		t.Logf("no clone support: %s", err)
+	}
+	eventSeparator()
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, want))
+}
+
+func TestInotifyRenameWindow(t *testing.T) {
+	t.Parallel()
+
+	w := &inotify{renameWindow: 50 * time.Millisecond, clock: realClock{}, renames: make(map[uint32]koekje)}
+
+	// More than fit in the cookies ring.
+	for i := uint32(1); i <= 20; i++ {
+		w.pairRename("/from/"+strconv.Itoa(int(i)), unix.IN_MOVED_FROM, i)
+	}
+	if have := w.pairRename("/to/1", unix.IN_MOVED_TO, 1); have != "/from/1" {
+		t.Errorf("cookie 1: %q", have)
+	}
+	if have := w.pairRename("/to/1", unix.IN_MOVED_TO, 1); have != "" {
+		t.Errorf("cookie 1 again: %q", have)
+	}
+	if have := w.pairRename("/to/99", unix.IN_MOVED_TO, 99); have != "" {
+		t.Errorf("cookie 99: %q", have)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if have := w.pairRename("/to/2", unix.IN_MOVED_TO, 2); have != "" {
+		t.Errorf("cookie 2 after window: %q", have)
+	}
+	w.pairRename("/from/new", unix.IN_MOVED_FROM, 100)
+	if len(w.renames) != 1 {
+		t.Errorf("expired renames not removed: %d left", len(w.renames))
+	}
+}
+
+func TestInotifyRecursiveMove(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "tree")
+	mkdir(t, tmp, "tree", "a")
+	mkdir(t, tmp, "tree", "a", "b")
+	mkdir(t, tmp, "tree", "x")
+	mkdir(t, tmp, "out")
+
+	w := newCollector(t)
+	if err := w.w.Add(join(tmp, "tree", "...")); err != nil {
+		t.Fatal(err)
+	}
+	w.collect(t)
+
+	list := func() string {
+		l := w.w.WatchList()
+		for i := range l {
+			l[i] = strings.TrimPrefix(filepath.ToSlash(l[i]), filepath.ToSlash(tmp))
+		}
+		sort.Strings(l)
+		return strings.Join(l, " ")
+	}
+
+	mv(t, join(tmp, "tree", "a"), tmp, "tree", "x", "c")
+	waitForEvents()
+	if have, want := list(), "/tree /tree/x /tree/x/c /tree/x/c/b"; have != want {
+		t.Errorf("after move inside tree:\nhave: %s\nwant: %s", have, want)
+	}
+
+	mv(t, join(tmp, "tree", "x"), tmp, "out", "x")
+	waitForEvents()
+	if have, want := list(), "/tree"; have != want {
+		t.Errorf("after move outside tree:\nhave: %s\nwant: %s", have, want)
+	}
+
+	have := w.stop(t)
+	for _, e := range have {
+		if e.Has(Move) && e.RenamedFrom != join(tmp, "tree", "a") {
+			t.Errorf("wrong RenamedFrom for %s: %q", e, e.RenamedFrom)
+		}
+	}
+	cmpEvents(t, tmp, have, newEvents(t, `
+		rename       /tree/a
+		create|move  /tree/x/c ← /tree/a
+		rename       /tree/x
+	`))
+}
+
+func TestInotifySpecialFiles(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkfifo(t, tmp, "fifo")
+	l, err := net.Listen("unix", join(tmp, "sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	w := newCollector(t)
+	addWatch(t, w.w, tmp, "fifo")
+	addWatch(t, w.w, tmp, "sock")
+	w.collect(t)
+
+	// O_RDWR doesn't block on Linux, even without a reader.
+	fp, err := os.OpenFile(join(tmp, "fifo"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+	eventSeparator()
+	chmod(t, 0o600, tmp, "sock")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		write  /fifo
+		chmod  /sock
+	`))
+}
+
+func TestInotifyPoll(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file")
+	touch(t, tmp, "rm")
+	echoAppend(t, "data", tmp, "truncate")
+
+	w := newCollector(t)
+	in := w.w.b.(*inotify)
+	in.pollFS = func(string) string { return "nfs" }
+	in.poll.interval = 20 * time.Millisecond
+
+	ops := WithOps(Create | Write | Remove | Rename | Chmod | UnportableExtend | UnportableTruncate)
+	if err := w.w.AddWith(tmp, ops); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.w.AddWith(tmp, WithOps(UnportableMount)); !errors.Is(err, xErrUnsupported) {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if have := w.w.WatchList(); len(have) != 1 || have[0] != tmp {
+		t.Fatalf("WatchList: %v", have)
+	}
+
+	var perr *PollingError
+	select {
+	case err := <-w.w.Errors:
+		if !errors.As(err, &perr) || perr.Path != tmp || perr.FSType != "nfs" {
+			t.Fatalf("wrong error: %#v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no PollingError")
+	}
+	w.collect(t)
+
+	touch(t, tmp, "new")
+	echoAppend(t, "data", tmp, "file")
+	truncate(t, 0, tmp, "truncate")
+	chmod(t, 0o700, tmp, "file")
+	rm(t, tmp, "rm")
+	time.Sleep(100 * time.Millisecond)
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create          /new
+		write|extend    /file
+		write|truncate  /truncate
+		chmod           /file
+		remove          /rm
+	`))
+}
+
+func TestInotifyPollInterval(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "fast")
+	mkdir(t, tmp, "slow")
+
+	w := newCollector(t)
+	w.w.b.(*inotify).pollFS = func(string) string { return "nfs" }
+	if err := w.w.AddWith(join(tmp, "fast"), WithPollInterval(20*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.w.AddWith(join(tmp, "slow"), WithPollInterval(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	intervals := make(map[string]time.Duration)
+	for i := 0; i < 2; i++ {
+		var perr *PollingError
+		select {
+		case err := <-w.w.Errors:
+			if !errors.As(err, &perr) {
+				t.Fatalf("wrong error: %#v", err)
+			}
+			intervals[filepath.Base(perr.Path)] = perr.Interval
+		case <-time.After(time.Second):
+			t.Fatal("no PollingError")
+		}
+	}
+	if intervals["fast"] != 20*time.Millisecond || intervals["slow"] != time.Hour {
+		t.Errorf("wrong intervals: %v", intervals)
+	}
+	w.collect(t)
+
+	touch(t, tmp, "fast", "file")
+	touch(t, tmp, "slow", "file")
+	time.Sleep(100 * time.Millisecond)
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /fast/file
+	`))
+}
+
+func TestInotifyPollAtLimit(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newCollector(t)
+	in := w.w.b.(*inotify)
+	limit := &WatchLimitError{Path: tmp, Sysctl: "fs.inotify.max_user_watches", Err: unix.ENOSPC}
+
+	in.pollLimit = false
+	if err := in.pollAtLimit(tmp, getOptions(), limit); err != limit {
+		t.Fatalf("wrong error without pollLimit: %v", err)
+	}
+	in.pollLimit = true
+	if err := in.pollAtLimit(tmp, getOptions(), unix.EACCES); err != unix.EACCES {
+		t.Fatalf("wrong error for EACCES: %v", err)
+	}
+	if err := in.pollAtLimit(tmp, getOptions(WithPollInterval(20*time.Millisecond)), limit); err != nil {
+		t.Fatal(err)
+	}
+
+	var perr *PollingError
+	select {
+	case err := <-w.w.Errors:
+		if !errors.As(err, &perr) {
+			t.Fatalf("wrong error: %#v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no PollingError")
+	}
+	if perr.Limit != "fs.inotify.max_user_watches" || perr.Path != tmp {
+		t.Errorf("wrong PollingError: %#v", perr)
+	}
+	if have := w.w.Stats(); have.Watches != 0 || have.Polled != 1 {
+		t.Errorf("wrong Stats: %+v", have)
+	}
+	w.collect(t)
+
+	touch(t, tmp, "file")
+	time.Sleep(100 * time.Millisecond)
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /file
+	`))
+}
+
+func TestInotifyAdaptivePolling(t *testing.T) {
+	t.Parallel()
+
+	ww := &pollWatch{cfg: pollConfig{interval: 10 * time.Millisecond, min: 20 * time.Millisecond, max: 100 * time.Millisecond}}
+	ww.interval = ww.cfg.start(pollInterval)
+	var have []time.Duration
+	for _, changed := range []bool{false, false, false, true, true, true, true} {
+		ww.adapt(changed)
+		have = append(have, ww.interval)
+	}
+	if fmt.Sprint(have) != "[40ms 80ms 100ms 50ms 25ms 20ms 20ms]" {
+		t.Errorf("wrong intervals: %v", have)
+	}
+
+	tmp := t.TempDir()
+	w := newCollector(t)
+	w.w.b.(*inotify).pollFS = func(string) string { return "nfs" }
+	if err := w.w.AddWith(tmp, WithAdaptivePolling(time.Second, time.Millisecond)); err == nil {
+		t.Fatal("no error for min > max")
+	}
+	if err := w.w.AddWith(tmp, WithAdaptivePolling(time.Second, 0)); err == nil {
+		t.Fatal("no error for min without max")
+	}
+	if err := w.w.AddWith(tmp, WithPollInterval(time.Millisecond), WithAdaptivePolling(10*time.Millisecond, 50*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	var perr *PollingError
+	if err := <-w.w.Errors; !errors.As(err, &perr) || perr.Interval != 10*time.Millisecond {
+		t.Fatalf("wrong error: %v", err)
+	}
+	w.collect(t)
+
+	time.Sleep(200 * time.Millisecond) // Backs off to 50ms.
+	touch(t, tmp, "file")
+	time.Sleep(100 * time.Millisecond)
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /file
+	`))
+}
+
+func TestInotifyPollStrategy(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, dir := range []string{"modtime", "meta", "content"} {
+		mkdir(t, tmp, dir)
+		echoAppend(t, "aaaa", tmp, dir, "a")
+		echoAppend(t, "aaaa", tmp, dir, "b")
+		for _, f := range []string{"a", "b"} {
+			if err := os.Chtimes(join(tmp, dir, f), mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Poll manually, so it doesn't see the changes halfway.
+	w := newCollector(t)
+	in := w.w.b.(*inotify)
+	in.pollFS = func(string) string { return "nfs" }
+	for dir, s := range map[string]PollStrategy{"modtime": PollModTime, "meta": PollMetadata, "content": PollContent} {
+		if err := w.w.AddWith(join(tmp, dir), WithPollStrategy(s), WithPollInterval(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		<-w.w.Errors // PollingError
+	}
+	w.collect(t)
+
+	for _, dir := range []string{"modtime", "meta", "content"} {
+		// Same size and modification time, different contents.
+		echoTrunc(t, "bbbb", tmp, dir, "a")
+		// Replaced by a different file with the same size and modification
+		// time.
+		echoAppend(t, "aaaa", tmp, dir+"-new")
+		mv(t, join(tmp, dir+"-new"), tmp, dir, "b")
+		for _, f := range []string{"a", "b"} {
+			if err := os.Chtimes(join(tmp, dir, f), mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	in.poll.mu.Lock()
+	for _, ww := range in.poll.watches {
+		ww.next = time.Time{}
+	}
+	in.poll.mu.Unlock()
+	in.poll.poll()
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		write  /meta/b
+		write  /content/a
+	`))
+}
+
+func TestInotifyPollWorkers(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	for _, dir := range []string{"a", "b", "big", "c"} {
+		mkdir(t, tmp, dir)
+	}
+	for i := 0; i < pollParallelMin+10; i++ {
+		if err := os.WriteFile(join(tmp, "big", fmt.Sprintf("file%04d", i)), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w, err := NewWatcherWith(WithPollWorkers(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := w.b.(*inotify)
+	in.pollFS = func(string) string { return "nfs" }
+	for _, dir := range []string{"c", "big", "b", "a"} {
+		if err := w.AddWith(join(tmp, dir), WithPollInterval(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		<-w.Errors // PollingError
+	}
+	if have := len(in.poll.watches[join(tmp, "big")].files); have != pollParallelMin+10 {
+		t.Fatalf("read %d files in big", have)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+
+	for _, dir := range []string{"c", "big", "b", "a"} {
+		touch(t, tmp, dir, "new")
+	}
+	rm(t, tmp, "big", "file0500")
+	in.poll.mu.Lock()
+	for _, ww := range in.poll.watches {
+		ww.next = time.Time{}
+	}
+	in.poll.mu.Unlock()
+	in.poll.poll()
+
+	cmpEvents(t, tmp, c.stop(t), newEvents(t, `
+		create  /a/new
+		create  /b/new
+		remove  /big/file0500
+		create  /big/new
+		create  /c/new
+	`))
+}
+
+func TestInotifyWithPolling(t *testing.T) {
+	t.Parallel()
+
+	// /proc/uptime changes every 10ms, but always has a size of 0.
+	const path = "/proc/uptime"
+	if _, err := os.Stat(path); err != nil {
+		t.Skip(err)
+	}
+
+	w := newWatcher(t)
+	defer w.Close()
+	w.b.(*inotify).poll.interval = 20 * time.Millisecond
+	if err := w.AddWith(path, WithPolling()); err != nil {
+		t.Fatal(err)
+	}
+	if have := w.WatchList(); len(have) != 1 || have[0] != path {
+		t.Fatalf("WatchList: %v", have)
+	}
+	if err := w.AddWith(t.TempDir()+"/...", WithPolling()); !errors.Is(err, xErrUnsupported) {
+		t.Errorf("wrong error for recursive watch: %v", err)
+	}
+
+	select {
+	case e := <-w.Events:
+		if e.Name != path || e.Op != Write {
+			t.Errorf("wrong event: %s", e)
+		}
+	case err := <-w.Errors:
+		t.Fatal(err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event")
+	}
+}
+
+func TestParseSMBNotify(t *testing.T) {
+	// FILE_NOTIFY_INFORMATION record; the last one has NextEntryOffset 0.
+	record := func(last bool, action uint32, name string) []byte {
+		var b []byte
+		for _, c := range utf16.Encode([]rune(name)) {
+			b = append(b, byte(c), byte(c>>8))
+		}
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+		next := uint32(12 + len(b))
+		if last {
+			next = 0
+		}
+		hdr := make([]byte, 12)
+		binary.LittleEndian.PutUint32(hdr[0:], next)
+		binary.LittleEndian.PutUint32(hdr[4:], action)
+		binary.LittleEndian.PutUint32(hdr[8:], uint32(len([]rune(name))*2))
+		return append(hdr, b...)
+	}
+
+	var buf []byte
+	buf = append(buf, record(false, smbActionAdded, "file")...)
+	buf = append(buf, record(false, smbActionRenamedOld, "old")...)
+	buf = append(buf, record(true, smbActionRenamedNew, "néw")...)
+	buf = append(buf, make([]byte, 32)...)
+
+	have, overflow := parseSMBNotify(buf)
+	want := []smbChange{{smbActionAdded, "file"}, {smbActionRenamedOld, "old"}, {smbActionRenamedNew, "néw"}}
+	if overflow || !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %v %t\nwant: %v", have, overflow, want)
+	}
+
+	if _, overflow := parseSMBNotify(make([]byte, 64)); !overflow {
+		t.Error("no overflow for empty buffer")
+	}
+}
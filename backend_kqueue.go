@@ -8,7 +8,9 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/esvos/fsnotify/internal"
@@ -24,6 +26,35 @@ type kqueue struct {
 	watches   *watches
 	done      chan struct{}
 	doneMu    sync.Mutex
+
+	// Open a file descriptor for every file in watched directories, rather
+	// than diffing the directory listing (WithFileWatches()).
+	fileWatches bool
+
+	// WithSandbox(): don't raise RLIMIT_NOFILE, and use at most maxFDs file
+	// descriptors. Paths are polled after that if pollLimit is set.
+	sandbox   bool
+	maxFDs    int
+	pollLimit bool
+
+	raw func(RawEvent) // WithRawEvents()
+	nfc bool           // WithNFC()
+
+	// For WithExternalLoop(): there's no reader goroutine and events are
+	// collected in pending until ReadEvents() is called.
+	external bool
+	pending  pending
+	readMu   sync.Mutex // Only one ReadEvents() at a time, and not during Close().
+
+	// Mountpoints for UnportableMount and UnportableUnmount; nil until the
+	// first AddWith() that uses them.
+	mounts   map[string]struct{}
+	mountsMu sync.Mutex
+
+	// Paths on filesystems where kqueue doesn't work are polled; pollFS is nil
+	// with WithNoPolling().
+	poll   *poller
+	pollFS func(path string) string
 }
 
 type (
@@ -34,6 +65,18 @@ type (
 		byDir  map[string]map[int]struct{} // dirname(path) → wd
 		seen   map[string]struct{}         // Keep track of if we know this file exists.
 		byUser map[string]struct{}         // Watches added with Watcher.Add()
+		ops    map[string]Op               // Unportable ops watches were added with.
+
+		// Directory listing for every watched directory; only used without
+		// WithFileWatches().
+		listing map[string]map[string]dirEntry
+	}
+	dirEntry struct {
+		ino   uint64
+		size  int64
+		mtime time.Time
+		mode  os.FileMode
+		nlink uint64
 	}
 	watch struct {
 		wd       int
@@ -41,6 +84,8 @@ type (
 		linkName string // In case of links; name is the target, and this is the link.
 		isDir    bool
 		dirFlags uint32
+		size     int64      // File size at the previous event.
+		attrs    *fileAttrs // Attributes at the previous event; nil if not known.
 	}
 )
 
@@ -51,6 +96,9 @@ func newWatches() *watches {
 		byDir:  make(map[string]map[int]struct{}),
 		seen:   make(map[string]struct{}),
 		byUser: make(map[string]struct{}),
+		ops:    make(map[string]Op),
+
+		listing: make(map[string]map[string]dirEntry),
 	}
 }
 
@@ -94,6 +142,63 @@ func (w *watches) addUserWatch(path string) {
 	w.byUser[path] = struct{}{}
 }
 
+// setOps sets the unportable ops path was added with.
+func (w *watches) setOps(path string, op Op) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if op == 0 {
+		delete(w.ops, path)
+	} else {
+		w.ops[path] = op
+	}
+}
+
+// opsFor gets the unportable ops for path, which are set if either path or its
+// directory was added with them.
+func (w *watches) opsFor(path string) Op {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.ops[path] | w.ops[filepath.Dir(path)]
+}
+
+// ownOps gets the unportable ops path was added with.
+func (w *watches) ownOps(path string) Op {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.ops[path]
+}
+
+// resize sets the file size for the watch, and returns the previous size.
+func (w *watches) resize(fd int, size int64) int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	info, ok := w.wd[fd]
+	if !ok {
+		return size
+	}
+	prev := info.size
+	info.size = size
+	w.wd[fd] = info
+	return prev
+}
+
+// reattr sets the attributes for the watch, and returns the previous ones.
+func (w *watches) reattr(fd int, a fileAttrs) (fileAttrs, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	info, ok := w.wd[fd]
+	if !ok {
+		return a, false
+	}
+	prev := info.attrs
+	info.attrs = &a
+	w.wd[fd] = info
+	if prev == nil {
+		return a, false
+	}
+	return *prev, true
+}
+
 func (w *watches) addLink(path string, fd int) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -102,12 +207,12 @@ func (w *watches) addLink(path string, fd int) {
 	w.seen[path] = struct{}{}
 }
 
-func (w *watches) add(path, linkPath string, fd int, isDir bool) {
+func (w *watches) add(path, linkPath string, fd int, isDir bool, size int64) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
 	w.path[path] = fd
-	w.wd[fd] = watch{wd: fd, name: path, linkName: linkPath, isDir: isDir}
+	w.wd[fd] = watch{wd: fd, name: path, linkName: linkPath, isDir: isDir, size: size}
 
 	parent := filepath.Dir(path)
 	byDir, ok := w.byDir[parent]
@@ -149,6 +254,7 @@ func (w *watches) remove(fd int, path string) bool {
 	isDir := w.wd[fd].isDir
 	delete(w.path, path)
 	delete(w.byUser, path)
+	delete(w.ops, path)
 
 	parent := filepath.Dir(path)
 	delete(w.byDir[parent], fd)
@@ -159,9 +265,36 @@ func (w *watches) remove(fd int, path string) bool {
 
 	delete(w.wd, fd)
 	delete(w.seen, path)
+	delete(w.listing, path)
 	return isDir
 }
 
+// swapListing sets the listing for dir and returns the previous one; returns
+// nil if the directory isn't watched (anymore), in which case the listing isn't
+// set.
+func (w *watches) swapListing(dir string, l map[string]dirEntry) map[string]dirEntry {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	prev, ok := w.listing[dir]
+	if !ok {
+		if _, watched := w.path[dir]; !watched {
+			return nil
+		}
+		prev = make(map[string]dirEntry)
+	}
+	w.listing[dir] = l
+	return prev
+}
+
+// unlist removes path from the listing of its directory, so that diffDir()
+// doesn't send a second Remove or Rename for a path that had its own watch if
+// the event for the directory is read after the one for the path.
+func (w *watches) unlist(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.listing[filepath.Dir(path)], filepath.Base(path))
+}
+
 func (w *watches) markSeen(path string, exists bool) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -180,12 +313,27 @@ func (w *watches) seenBefore(path string) bool {
 }
 
 func newBackend(ev chan Event, errs chan error) (backend, error) {
-	return newBufferedBackend(0, ev, errs)
+	return newBufferedBackend(0, ev, errs, defaultWatcherOpts)
 }
 
-func newBufferedBackend(sz uint, ev chan Event, errs chan error) (backend, error) {
+func newBufferedBackend(sz uint, ev chan Event, errs chan error, with watcherOpts) (backend, error) {
+	if with.audit {
+		return nil, fmt.Errorf("%w: WithAudit", xErrUnsupported)
+	}
+	if with.ebpf {
+		return nil, fmt.Errorf("%w: WithEBPF", xErrUnsupported)
+	}
+	if runtime.GOOS == "ios" {
+		with.sandbox = true
+	}
+	if with.sandbox && with.fileWatches {
+		return nil, fmt.Errorf("%w: WithFileWatches with WithSandbox", xErrUnsupported)
+	}
 	kq, closepipe, err := newKqueue()
 	if err != nil {
+		if err == unix.EMFILE {
+			return nil, &WatchLimitError{Sysctl: "RLIMIT_NOFILE", Limit: nofile(), Err: err}
+		}
 		return nil, err
 	}
 
@@ -196,9 +344,24 @@ func newBufferedBackend(sz uint, ev chan Event, errs chan error) (backend, error
 		closepipe: closepipe,
 		done:      make(chan struct{}),
 		watches:   newWatches(),
+		external:  with.external,
+
+		fileWatches: with.fileWatches,
+		raw:         with.raw,
+		nfc:         with.nfc && runtime.GOOS == "darwin",
+	}
+	w.pending.limit, w.pending.policy = with.memLimit, with.memPolicy
+	w.poll = newPoller(w.sendEvent, w.sendError, with.clock, with.pollWorkers)
+	if !with.noPolling {
+		w.pollFS = pollFSType
+	}
+	if with.sandbox {
+		w.sandbox, w.maxFDs, w.pollLimit = true, sandboxFDs(with), !with.noPolling
 	}
 
-	go w.readEvents()
+	if !w.external {
+		go w.readEvents()
+	}
 	return w, nil
 }
 
@@ -241,6 +404,16 @@ func newKqueue() (kq int, closepipe [2]int, err error) {
 
 // Returns true if the event was sent, or false if watcher is closed.
 func (w *kqueue) sendEvent(e Event) bool {
+	if w.nfc {
+		e.Name, e.RenamedFrom = internal.NFC(e.Name), internal.NFC(e.RenamedFrom)
+	}
+	if w.external {
+		if w.isClosed() {
+			return false
+		}
+		w.pending.event(e)
+		return true
+	}
 	select {
 	case <-w.done:
 		return false
@@ -254,6 +427,14 @@ func (w *kqueue) sendError(err error) bool {
 	if err == nil {
 		return true
 	}
+	err = wrapError(w, "watch", "", err)
+	if w.external {
+		if w.isClosed() {
+			return false
+		}
+		w.pending.err(err)
+		return true
+	}
 	select {
 	case <-w.done:
 		return false
@@ -287,9 +468,63 @@ func (w *kqueue) Close() error {
 
 	// Send "quit" message to the reader goroutine.
 	unix.Close(w.closepipe[1])
+
+	if w.external { // No reader goroutine to clean up.
+		w.poll.stop()
+		w.readMu.Lock()
+		defer w.readMu.Unlock()
+		close(w.Events)
+		close(w.Errors)
+		unix.Close(w.kq)
+		unix.Close(w.closepipe[0])
+	}
 	return nil
 }
 
+func (w *kqueue) sysFd() (int, error) {
+	if !w.external {
+		return -1, errors.New("fsnotify: SysFd() requires WithExternalLoop()")
+	}
+	return w.kq, nil
+}
+
+func (w *kqueue) readAvailable() ([]Event, []error) {
+	if !w.external {
+		return nil, []error{errors.New("fsnotify: ReadEvents() requires WithExternalLoop()")}
+	}
+
+	w.readMu.Lock()
+	defer w.readMu.Unlock()
+	if w.isClosed() {
+		return nil, []error{ErrClosed}
+	}
+
+	var (
+		buf     = make([]unix.Kevent_t, 10)
+		timeout unix.Timespec // Zero: don't block.
+	)
+	for !w.pending.blocked() {
+		n, err := unix.Kevent(w.kq, nil, buf, &timeout)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			w.pending.err(fmt.Errorf("fsnotify.ReadEvents: %w", err))
+			break
+		}
+		for i := range buf[:n] {
+			wd := int(buf[i].Ident)
+			if wd != w.closepipe[0] {
+				w.handleEvent(wd, uint32(buf[i].Fflags), &buf[i])
+			}
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+	return w.pending.take()
+}
+
 func (w *kqueue) Add(name string) error { return w.AddWith(name) }
 
 func (w *kqueue) AddWith(name string, opts ...addOpt) error {
@@ -303,11 +538,109 @@ func (w *kqueue) AddWith(name string, opts ...addOpt) error {
 		return fmt.Errorf("%w: %s", xErrUnsupported, with.op)
 	}
 
-	_, err := w.addWatch(name, noteAllEvents)
+	if with.poll {
+		return w.poll.addWith(filepath.Clean(name), with.op, "", virtualFilesystems[fsTypeName(name)], getPollConfig(with))
+	}
+	if w.pollFS != nil {
+		if fstype := w.pollFS(name); fstype != "" {
+			return w.poll.add(filepath.Clean(name), with.op, fstype, getPollConfig(with))
+		}
+	}
+
+	// Opening a FIFO or socket doesn't work, and opening a device may do
+	// anything the driver wants with O_RDONLY; only O_EVTONLY on macOS is
+	// safe.
+	if fi, err := os.Stat(name); err == nil && isSpecial(fi.Mode()) &&
+		(runtime.GOOS != "darwin" || fi.Mode()&os.ModeDevice == 0) {
+		return &FileTypeError{Path: name, Mode: fi.Mode().Type()}
+	}
+
+	// Set before adding, so that watchDirectoryFiles() will use them. Merged
+	// with the ops if the path is already watched.
+	var (
+		clean = filepath.Clean(name)
+		prev  = w.watches.ownOps(clean)
+		ops   = prev | with.op&^(Create|Write|Remove|Rename|Chmod)
+	)
+	w.watches.setOps(clean, ops)
+
+	_, err := w.addWatch(name, noteAllEvents|notesFor(ops))
 	if err != nil {
-		return err
+		w.watches.setOps(clean, prev)
+		return w.pollAtLimit(clean, with, err)
 	}
 	w.watches.addUserWatch(name)
+
+	if ops.Has(UnportableMount) || ops.Has(UnportableUnmount) {
+		return w.watchMounts()
+	}
+	return nil
+}
+
+func (w *kqueue) addFd(fd int, name string, opts ...addOpt) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  AddFd(%d, %q)\n",
+			time.Now().Format("15:04:05.000000000"), fd, name)
+	}
+
+	with := getOptions(opts...)
+	if !w.xSupports(with.op) {
+		return fmt.Errorf("%w: %s", xErrUnsupported, with.op)
+	}
+	clean := filepath.Clean(name)
+	if _, ok := w.watches.byPath(clean); ok {
+		return fmt.Errorf("fsnotify: %q is already watched", name)
+	}
+
+	ops := with.op &^ (Create | Write | Remove | Rename | Chmod)
+	w.watches.setOps(clean, ops)
+	_, err := w.addWatchFd(clean, fd, noteAllEvents|notesFor(ops))
+	if err != nil {
+		w.watches.setOps(clean, 0)
+		return err
+	}
+	w.watches.addUserWatch(clean)
+
+	if ops.Has(UnportableMount) || ops.Has(UnportableUnmount) {
+		return w.watchMounts()
+	}
+	return nil
+}
+
+func (w *kqueue) removeOps(name string, op Op) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  RemoveOps(%q, %s)\n",
+			time.Now().Format("15:04:05.000000000"), name, op)
+	}
+
+	clean := filepath.Clean(name)
+	if ok, err := w.poll.removeOps(clean, op); ok {
+		return err
+	}
+	if _, ok := w.watches.byPath(clean); !ok {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+
+	// Create, Write, Remove, Rename, and Chmod are always sent.
+	prev := w.watches.ownOps(clean)
+	if (Create|Write|Remove|Rename|Chmod|prev)&^op == 0 {
+		return errAllOps(name)
+	}
+	ops := prev &^ op
+	if ops == prev {
+		return nil
+	}
+	w.watches.setOps(clean, ops)
+	if _, err := w.addWatch(clean, noteAllEvents|notesFor(ops)); err != nil {
+		w.watches.setOps(clean, prev)
+		return err
+	}
 	return nil
 }
 
@@ -316,6 +649,9 @@ func (w *kqueue) Remove(name string) error {
 		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  Remove(%q)\n",
 			time.Now().Format("15:04:05.000000000"), name)
 	}
+	if w.poll.remove(filepath.Clean(name)) {
+		return nil
+	}
 	return w.remove(name, true)
 }
 
@@ -356,17 +692,154 @@ func (w *kqueue) WatchList() []string {
 	if w.isClosed() {
 		return nil
 	}
-	return w.watches.listPaths(true)
+	return append(w.watches.listPaths(true), w.poll.list()...)
 }
 
-// Watch all events (except NOTE_EXTEND, NOTE_LINK, NOTE_REVOKE)
-const noteAllEvents = unix.NOTE_DELETE | unix.NOTE_WRITE | unix.NOTE_ATTRIB | unix.NOTE_RENAME
+func (w *kqueue) watchInfo() []WatchInfo {
+	if w.isClosed() {
+		return nil
+	}
+
+	w.watches.mu.RLock()
+	l := make([]WatchInfo, 0, len(w.watches.wd))
+	for fd, ww := range w.watches.wd {
+		path := ww.name
+		if ww.linkName != "" {
+			path = ww.linkName
+		}
+		root := path
+		_, user := w.watches.byUser[path]
+		if !user {
+			root = filepath.Dir(path) // File in a watched directory.
+		}
+		l = append(l, WatchInfo{
+			Path:     path,
+			Op:       Create | Write | Remove | Rename | Chmod | w.watches.ops[path] | w.watches.ops[filepath.Dir(path)],
+			Internal: !user,
+			Root:     root,
+			ID:       uint64(fd),
+		})
+	}
+	w.watches.mu.RUnlock()
+	return append(l, w.poll.info()...)
+}
+
+// verify checks if the file descriptors for the watches are still valid, and
+// still refer to the same file as the path.
+func (w *kqueue) verify() map[string]error {
+	if w.isClosed() {
+		return nil
+	}
+
+	failed := make(map[string]error)
+	for _, p := range w.watches.listPaths(true) {
+		ww, ok := w.watches.byPath(p)
+		if !ok { // Polled, or being removed.
+			continue
+		}
+
+		var fst, st unix.Stat_t
+		if err := unix.Fstat(ww.wd, &fst); err != nil {
+			failed[p] = fmt.Errorf("%w: %s", ErrWatchDead, err)
+			continue
+		}
+		stat := unix.Stat
+		if fst.Mode&unix.S_IFMT == unix.S_IFLNK {
+			stat = unix.Lstat
+		}
+		if err := stat(ww.name, &st); err != nil {
+			failed[p] = fmt.Errorf("%w: %s", ErrWatchDead, err)
+			continue
+		}
+		if st.Ino != fst.Ino || st.Dev != fst.Dev {
+			failed[p] = ErrWatchDiverged
+		}
+	}
+	return failed
+}
+
+func (w *kqueue) Stats() Stats {
+	if w.isClosed() {
+		return Stats{}
+	}
+	w.watches.mu.RLock()
+	defer w.watches.mu.RUnlock()
+	return Stats{Watches: len(w.watches.wd), Polled: len(w.poll.list())}
+}
+
+// Filesystem types (f_fstypename) that need to be polled; kqueue only sees
+// changes made on the local system for these, if any.
+var pollFilesystems = map[string]bool{
+	"nfs":     true,
+	"smbfs":   true,
+	"afpfs":   true,
+	"webdav":  true,
+	"afs":     true,
+	"fusefs":  true,
+	"macfuse": true,
+	"osxfuse": true,
+	"puffs":   true,
+}
+
+// Virtual filesystems where the kernel changes files without sending any
+// events.
+var virtualFilesystems = map[string]bool{
+	"procfs": true, "linprocfs": true, "linsysfs": true, "kernfs": true,
+	"fdescfs": true,
+}
+
+// pollFSType gets the filesystem type of path if it needs to be polled, or ""
+// if it doesn't.
+func pollFSType(path string) string {
+	if t := fsTypeName(path); pollFilesystems[t] {
+		return t
+	}
+	return ""
+}
+
+// Watch all events (except NOTE_LINK, which is only used for UnportableLink and
+// UnportableUnlink). NOTE_EXTEND is only used for UnportableExtend, and
+// NOTE_REVOKE for UnportableUnmount.
+const noteAllEvents = unix.NOTE_DELETE | unix.NOTE_WRITE | unix.NOTE_EXTEND | unix.NOTE_ATTRIB |
+	unix.NOTE_RENAME | unix.NOTE_REVOKE
+
+// Notes for xUnportableOpen, xUnportableRead, UnportableCloseWrite, and
+// xUnportableCloseRead. These are 0 if the platform doesn't support them; they
+// are set in system_freebsd.go and system_netbsd.go.
+var noteOpen, noteRead, noteCloseWrite, noteCloseRead uint32
+
+// notesFor gets the extra notes to watch for the unportable ops.
+func notesFor(op Op) uint32 {
+	var n uint32
+	if op.Has(xUnportableOpen) {
+		n |= noteOpen
+	}
+	if op.Has(xUnportableRead) {
+		n |= noteRead
+	}
+	if op.Has(UnportableCloseWrite) {
+		n |= noteCloseWrite
+	}
+	if op.Has(xUnportableCloseRead) {
+		n |= noteCloseRead
+	}
+	if op.Has(UnportableLink) || op.Has(UnportableUnlink) {
+		n |= unix.NOTE_LINK
+	}
+	return n
+}
 
 // addWatch adds name to the watched file set; the flags are interpreted as
 // described in kevent(2).
 //
 // Returns the real path to the file which was added, with symlinks resolved.
 func (w *kqueue) addWatch(name string, flags uint32) (string, error) {
+	return w.addWatchFd(name, -1, flags)
+}
+
+// addWatchFd is like addWatch, but uses a copy of fd for the watch if it's not
+// -1, rather than opening name.
+func (w *kqueue) addWatchFd(name string, fd int, flags uint32) (string, error) {
 	if w.isClosed() {
 		return "", ErrClosed
 	}
@@ -374,14 +847,26 @@ func (w *kqueue) addWatch(name string, flags uint32) (string, error) {
 	name = filepath.Clean(name)
 
 	info, alreadyWatching := w.watches.byPath(name)
-	if !alreadyWatching {
+	if !alreadyWatching && fd != -1 {
+		var st unix.Stat_t
+		if err := unix.Fstat(fd, &st); err != nil {
+			return "", os.NewSyscallError("fstat", err)
+		}
+		var err error
+		info.wd, err = unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+		if err != nil {
+			return "", os.NewSyscallError("fcntl", err)
+		}
+		info.isDir, info.size = st.Mode&unix.S_IFMT == unix.S_IFDIR, st.Size
+	} else if !alreadyWatching {
 		fi, err := os.Lstat(name)
 		if err != nil {
 			return "", err
 		}
 
-		// Don't watch sockets or named pipes.
-		if (fi.Mode()&os.ModeSocket == os.ModeSocket) || (fi.Mode()&os.ModeNamedPipe == os.ModeNamedPipe) {
+		// Don't watch sockets, named pipes, or devices (except on macOS)
+		// in directories.
+		if isSpecial(fi.Mode()) && (runtime.GOOS != "darwin" || fi.Mode()&os.ModeDevice == 0) {
 			return "", nil
 		}
 
@@ -412,23 +897,19 @@ func (w *kqueue) addWatch(name string, flags uint32) (string, error) {
 			}
 		}
 
-		// Retry on EINTR; open() can return EINTR in practice on macOS.
-		// See #354, and Go issues 11180 and 39237.
-		for {
-			info.wd, err = unix.Open(name, openMode, 0)
-			if err == nil {
-				break
-			}
-			if errors.Is(err, unix.EINTR) {
-				continue
-			}
-
+		info.wd, err = w.open(name)
+		if err != nil {
 			return "", err
 		}
 
-		info.isDir = fi.IsDir()
+		info.isDir, info.size = fi.IsDir(), fi.Size()
 	}
 
+	// Don't watch opens and reads for directories, as we read directories
+	// ourselves on changes.
+	if info.isDir {
+		flags &^= noteOpen | noteRead | noteCloseWrite | noteCloseRead | unix.NOTE_LINK
+	}
 	err := w.register([]int{info.wd}, unix.EV_ADD|unix.EV_CLEAR|unix.EV_ENABLE, flags)
 	if err != nil {
 		unix.Close(info.wd)
@@ -436,7 +917,12 @@ func (w *kqueue) addWatch(name string, flags uint32) (string, error) {
 	}
 
 	if !alreadyWatching {
-		w.watches.add(name, info.linkName, info.wd, info.isDir)
+		w.watches.add(name, info.linkName, info.wd, info.isDir, info.size)
+		eventName := name
+		if info.linkName != "" {
+			eventName = info.linkName
+		}
+		w.reattr(info.wd, name, &Event{Name: eventName})
 	}
 
 	// Watch the directory if it has not been watched before, or if it was
@@ -455,10 +941,85 @@ func (w *kqueue) addWatch(name string, flags uint32) (string, error) {
 	return name, nil
 }
 
+// pollAtLimit polls path instead if adding it failed with err because the
+// limit for WithSandbox() was reached, with pollLimit. Returns err otherwise.
+func (w *kqueue) pollAtLimit(path string, with withOpts, err error) error {
+	var lerr *WatchLimitError
+	if !w.pollLimit || !errors.As(err, &lerr) || with.op&^pollOps != 0 {
+		return err
+	}
+	return w.poll.addAtLimit(path, with.op, fsTypeName(path), lerr.Sysctl, getPollConfig(with))
+}
+
+// sandboxFDs gets the maximum number of file descriptors for WithSandbox().
+func sandboxFDs(with watcherOpts) int {
+	if with.sandboxFDs > 0 {
+		return with.sandboxFDs
+	}
+	n := nofile() / 4
+	if n < 16 {
+		n = 16
+	}
+	return n
+}
+
+// open a file for a watch.
+//
+// If the open file limit is reached this tries to raise the soft limit, and
+// returns a WatchLimitError if that didn't help. With WithSandbox() the limit
+// isn't raised, and it's a WatchLimitError once maxFDs are open.
+func (w *kqueue) open(name string) (int, error) {
+	if w.sandbox {
+		w.watches.mu.RLock()
+		n := len(w.watches.wd)
+		w.watches.mu.RUnlock()
+		if n >= w.maxFDs {
+			return -1, &WatchLimitError{Path: name, Sysctl: "WithSandbox", Limit: w.maxFDs, Watches: n, Needed: 1, Err: unix.EMFILE}
+		}
+	}
+	raised := w.sandbox
+	for {
+		fd, err := unix.Open(name, openMode, 0)
+		if err == nil {
+			return fd, nil
+		}
+		// Retry on EINTR; open() can return EINTR in practice on macOS.
+		// See #354, and Go issues 11180 and 39237.
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err == unix.EMFILE {
+			if !raised && raiseNofile() {
+				raised = true
+				continue
+			}
+			return -1, w.limitError(name, 1, err)
+		}
+		return -1, err
+	}
+}
+
+func (w *kqueue) limitError(path string, needed int, err error) *WatchLimitError {
+	w.watches.mu.RLock()
+	n := len(w.watches.wd)
+	w.watches.mu.RUnlock()
+	return &WatchLimitError{Path: path, Sysctl: "RLIMIT_NOFILE", Limit: nofile(), Watches: n, Needed: needed, Err: err}
+}
+
+// nofile gets the current soft RLIMIT_NOFILE, or -1 if it can't be read.
+func nofile() int {
+	var l unix.Rlimit
+	if unix.Getrlimit(unix.RLIMIT_NOFILE, &l) != nil {
+		return -1
+	}
+	return int(l.Cur)
+}
+
 // readEvents reads from kqueue and converts the received kevents into
 // Event values that it sends down the Events channel.
 func (w *kqueue) readEvents() {
 	defer func() {
+		w.poll.stop() // Must be stopped before closing the channels.
 		close(w.Events)
 		close(w.Errors)
 		_ = unix.Close(w.kq)
@@ -487,85 +1048,124 @@ func (w *kqueue) readEvents() {
 				return
 			}
 
-			path, ok := w.watches.byWd(wd)
-			if debug {
-				internal.Debug(path.name, &kevent)
+			if !w.handleEvent(wd, mask, &kevent) {
+				return
 			}
+		}
+	}
+}
 
-			// On macOS it seems that sometimes an event with Ident=0 is
-			// delivered, and no other flags/information beyond that, even
-			// though we never saw such a file descriptor. For example in
-			// TestWatchSymlink/277 (usually at the end, but sometimes sooner):
-			//
-			// fmt.Printf("READ: %2d  %#v\n", kevent.Ident, kevent)
-			// unix.Kevent_t{Ident:0x2a, Filter:-4, Flags:0x25, Fflags:0x2, Data:0, Udata:(*uint8)(nil)}
-			// unix.Kevent_t{Ident:0x0,  Filter:-4, Flags:0x25, Fflags:0x2, Data:0, Udata:(*uint8)(nil)}
-			//
-			// The first is a normal event, the second with Ident 0. No error
-			// flag, no data, no ... nothing.
-			//
-			// I read a bit through bsd/kern_event.c from the xnu source, but I
-			// don't really see an obvious location where this is triggered –
-			// this doesn't seem intentional, but idk...
-			//
-			// Technically fd 0 is a valid descriptor, so only skip it if
-			// there's no path, and if we're on macOS.
-			if !ok && kevent.Ident == 0 && runtime.GOOS == "darwin" {
-				continue
-			}
+// handleEvent converts a kevent to Events and sends them.
+//
+// Returns false if the watcher was closed.
+func (w *kqueue) handleEvent(wd int, mask uint32, kevent *unix.Kevent_t) bool {
+	if evfiltFS != 0 && int(kevent.Filter) == evfiltFS {
+		return w.mountChange()
+	}
 
-			event := w.newEvent(path.name, path.linkName, mask)
+	path, ok := w.watches.byWd(wd)
+	if debug {
+		internal.Debug(path.name, kevent)
+	}
+	if w.raw != nil {
+		w.raw(RawEvent{Name: path.name, Mask: uint64(kevent.Fflags)})
+	}
 
-			if event.Has(Rename) || event.Has(Remove) {
-				w.remove(event.Name, false)
-				w.watches.markSeen(event.Name, false)
-			}
+	// On macOS it seems that sometimes an event with Ident=0 is
+	// delivered, and no other flags/information beyond that, even
+	// though we never saw such a file descriptor. For example in
+	// TestWatchSymlink/277 (usually at the end, but sometimes sooner):
+	//
+	// fmt.Printf("READ: %2d  %#v\n", kevent.Ident, kevent)
+	// unix.Kevent_t{Ident:0x2a, Filter:-4, Flags:0x25, Fflags:0x2, Data:0, Udata:(*uint8)(nil)}
+	// unix.Kevent_t{Ident:0x0,  Filter:-4, Flags:0x25, Fflags:0x2, Data:0, Udata:(*uint8)(nil)}
+	//
+	// The first is a normal event, the second with Ident 0. No error
+	// flag, no data, no ... nothing.
+	//
+	// I read a bit through bsd/kern_event.c from the xnu source, but I
+	// don't really see an obvious location where this is triggered –
+	// this doesn't seem intentional, but idk...
+	//
+	// Technically fd 0 is a valid descriptor, so only skip it if
+	// there's no path, and if we're on macOS.
+	if !ok && kevent.Ident == 0 && runtime.GOOS == "darwin" {
+		return true
+	}
 
-			if path.isDir && event.Has(Write) && !event.Has(Remove) {
-				w.dirChange(event.Name)
-			} else if !w.sendEvent(event) {
-				return
-			}
+	event := w.newEvent(path.name, path.linkName, mask)
 
-			if event.Has(Remove) {
-				// Look for a file that may have overwritten this; for example,
-				// mv f1 f2 will delete f2, then create f2.
-				if path.isDir {
-					fileDir := filepath.Clean(event.Name)
-					_, found := w.watches.byPath(fileDir)
-					if found {
-						// TODO: this branch is never triggered in any test.
-						// Added in d6220df (2012).
-						// isDir check added in 8611c35 (2016): https://github.com/esvos/fsnotify/pull/111
-						//
-						// I don't really get how this can be triggered either.
-						// And it wasn't triggered in the patch that added it,
-						// either.
-						//
-						// Original also had a comment:
-						//   make sure the directory exists before we watch for
-						//   changes. When we do a recursive watch and perform
-						//   rm -rf, the parent directory might have gone
-						//   missing, ignore the missing directory and let the
-						//   upcoming delete event remove the watch from the
-						//   parent directory.
-						err := w.dirChange(fileDir)
-						if !w.sendError(err) {
-							return
-						}
-					}
-				} else {
-					path := filepath.Clean(event.Name)
-					if fi, err := os.Lstat(path); err == nil {
-						err := w.sendCreateIfNew(path, fi)
-						if !w.sendError(err) {
-							return
-						}
-					}
+	// The file descriptor was revoked; this happens when the filesystem is
+	// unmounted with force. Like with inotify, only send it if the parent
+	// directory doesn't already send it.
+	if mask&unix.NOTE_REVOKE != 0 {
+		w.remove(event.Name, true)
+		if w.watches.ownOps(event.Name).Has(UnportableUnmount) &&
+			!w.watches.ownOps(filepath.Dir(event.Name)).Has(UnportableUnmount) {
+			return w.sendEvent(Event{Name: event.Name, Op: UnportableUnmount})
+		}
+		return true
+	}
+	if !path.isDir && !event.Has(Remove) && !event.Has(Rename) {
+		event.Op |= w.resize(wd, path.name, event.Name, mask)
+	}
+	if event.Has(Chmod) {
+		w.reattr(wd, path.name, &event)
+	}
+	if event.Op == 0 { // NOTE_EXTEND without UnportableExtend.
+		return true
+	}
+
+	if event.Has(Rename) || event.Has(Remove) {
+		w.remove(event.Name, false)
+		w.watches.markSeen(event.Name, false)
+		w.watches.unlist(event.Name)
+	}
+
+	if path.isDir && event.Has(Write) && !event.Has(Remove) {
+		w.dirChange(event.Name)
+	} else if !w.sendEvent(event) {
+		return false
+	}
+
+	if event.Has(Remove) {
+		// Look for a file that may have overwritten this; for example,
+		// mv f1 f2 will delete f2, then create f2.
+		if path.isDir {
+			fileDir := filepath.Clean(event.Name)
+			_, found := w.watches.byPath(fileDir)
+			if found {
+				// TODO: this branch is never triggered in any test.
+				// Added in d6220df (2012).
+				// isDir check added in 8611c35 (2016): https://github.com/esvos/fsnotify/pull/111
+				//
+				// I don't really get how this can be triggered either.
+				// And it wasn't triggered in the patch that added it,
+				// either.
+				//
+				// Original also had a comment:
+				//   make sure the directory exists before we watch for
+				//   changes. When we do a recursive watch and perform
+				//   rm -rf, the parent directory might have gone
+				//   missing, ignore the missing directory and let the
+				//   upcoming delete event remove the watch from the
+				//   parent directory.
+				err := w.dirChange(fileDir)
+				if !w.sendError(err) {
+					return false
+				}
+			}
+		} else {
+			path := filepath.Clean(event.Name)
+			if fi, err := os.Lstat(path); err == nil {
+				err := w.sendCreateIfNew(path, fi)
+				if !w.sendError(err) {
+					return false
 				}
 			}
 		}
 	}
+	return true
 }
 
 // newEvent returns an platform-independent Event based on kqueue Fflags.
@@ -586,9 +1186,21 @@ func (w *kqueue) newEvent(name, linkName string, mask uint32) Event {
 	if mask&unix.NOTE_RENAME == unix.NOTE_RENAME {
 		e.Op |= Rename
 	}
-	if mask&unix.NOTE_ATTRIB == unix.NOTE_ATTRIB {
+	if mask&(unix.NOTE_ATTRIB|unix.NOTE_LINK) != 0 {
 		e.Op |= Chmod
 	}
+	if mask&noteOpen != 0 {
+		e.Op |= xUnportableOpen
+	}
+	if mask&noteRead != 0 {
+		e.Op |= xUnportableRead
+	}
+	if mask&noteCloseWrite != 0 {
+		e.Op |= UnportableCloseWrite
+	}
+	if mask&noteCloseRead != 0 {
+		e.Op |= xUnportableCloseRead
+	}
 	// No point sending a write and delete event at the same time: if it's gone,
 	// then it's gone.
 	if e.Op.Has(Write) && e.Op.Has(Remove) {
@@ -597,14 +1209,156 @@ func (w *kqueue) newEvent(name, linkName string, mask uint32) Event {
 	return e
 }
 
+// For UnportableMount: evfiltFS is EVFILT_FS, which is triggered on any mount
+// or unmount, and mountpoints lists the current mountpoints. These are only set
+// on platforms that support it (see backend_kqueue_mount.go).
+var (
+	evfiltFS    int
+	mountpoints func() (map[string]struct{}, error)
+)
+
+// watchMounts starts watching the mountpoints, if not done already.
+func (w *kqueue) watchMounts() error {
+	if mountpoints == nil {
+		return nil
+	}
+	w.mountsMu.Lock()
+	defer w.mountsMu.Unlock()
+	if w.mounts != nil {
+		return nil
+	}
+
+	points, err := mountpoints()
+	if err != nil {
+		return fmt.Errorf("fsnotify: watching mounts: %w", err)
+	}
+	changes := make([]unix.Kevent_t, 1)
+	unix.SetKevent(&changes[0], 0, evfiltFS, unix.EV_ADD|unix.EV_CLEAR|unix.EV_ENABLE)
+	if _, err := unix.Kevent(w.kq, changes, nil, nil); err != nil {
+		return fmt.Errorf("fsnotify: watching mounts: %w", err)
+	}
+	w.mounts = points
+	return nil
+}
+
+// mountChange sends UnportableMount and UnportableUnmount events after
+// EVFILT_FS reported a change.
+//
+// Returns false if the watcher was closed.
+func (w *kqueue) mountChange() bool {
+	points, err := mountpoints()
+	if err != nil {
+		return w.sendError(fmt.Errorf("fsnotify: watching mounts: %w", err))
+	}
+	w.mountsMu.Lock()
+	prev := w.mounts
+	w.mounts = points
+	w.mountsMu.Unlock()
+
+	return w.sendMounts(points, prev, UnportableMount) &&
+		w.sendMounts(prev, points, UnportableUnmount)
+}
+
+// sendMounts sends op for all mountpoints in points that aren't in other.
+//
+// Returns false if the watcher was closed.
+func (w *kqueue) sendMounts(points, other map[string]struct{}, op Op) bool {
+	changed := make([]string, 0, 1)
+	for p := range points {
+		if _, ok := other[p]; !ok {
+			changed = append(changed, p)
+		}
+	}
+	sort.Strings(changed)
+
+	for _, p := range changed {
+		// Watches on an unmounted filesystem already get NOTE_REVOKE, so only
+		// send unmounts for mountpoints in watched directories.
+		if (op == UnportableMount && w.watches.ownOps(p).Has(op)) || w.watches.ownOps(filepath.Dir(p)).Has(op) {
+			if !w.sendEvent(Event{Name: p, Op: op}) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// resize returns Write and UnportableExtend or UnportableTruncate if the file
+// size changed since the previous event and the file or its directory was
+// added with those ops.
+//
+// name is the file that's watched, and eventName the path in the event (which
+// is different for symlinks).
+func (w *kqueue) resize(wd int, name, eventName string, mask uint32) Op {
+	if mask&(unix.NOTE_WRITE|unix.NOTE_EXTEND|unix.NOTE_ATTRIB) == 0 {
+		return 0
+	}
+	op := w.watches.opsFor(eventName)
+	if !op.Has(UnportableExtend) && !op.Has(UnportableTruncate) {
+		return 0
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return 0
+	}
+	switch prev := w.watches.resize(wd, fi.Size()); {
+	case fi.Size() > prev && op.Has(UnportableExtend):
+		return Write | UnportableExtend
+	case fi.Size() < prev && op.Has(UnportableTruncate):
+		return Write | UnportableTruncate
+	}
+	return 0
+}
+
+// reattr adds the attrOps for the attributes that changed since the previous
+// event to e, if the file or its directory was added with them.
+//
+// name is the file that's watched, which is different from the path in the
+// event for symlinks.
+func (w *kqueue) reattr(wd int, name string, e *Event) {
+	op := w.watches.opsFor(e.Name) & attrOps
+	if op == 0 {
+		return
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return
+	}
+	a := attrsOf(name, fi, op)
+	if prev, ok := w.watches.reattr(wd, a); ok {
+		e.Op |= a.changed(prev) & op
+		setLinks(e, a.nlink)
+	}
+}
+
 // watchDirectoryFiles to mimic inotify when adding a watch on a directory
 func (w *kqueue) watchDirectoryFiles(dirPath string) error {
+	if !w.fileWatches {
+		l, err := readListing(dirPath)
+		if err != nil {
+			return err
+		}
+		w.watches.swapListing(dirPath, l)
+		return nil
+	}
+
 	files, err := os.ReadDir(dirPath)
 	if err != nil {
 		return err
 	}
 
-	for _, f := range files {
+	// Try to raise the limit now if we're getting close, rather than halfway
+	// through the directory.
+	if l := nofile(); l > 0 {
+		w.watches.mu.RLock()
+		n := len(w.watches.wd)
+		w.watches.mu.RUnlock()
+		if n+len(files) > l*9/10 {
+			raiseNofile()
+		}
+	}
+
+	for i, f := range files {
 		path := filepath.Join(dirPath, f.Name())
 
 		fi, err := f.Info()
@@ -618,9 +1372,13 @@ func (w *kqueue) watchDirectoryFiles(dirPath string) error {
 			// But do add it to w.fileExists to prevent it from being picked up
 			// as a "new" file later (it still shows up in the directory
 			// listing).
+			var limitErr *WatchLimitError
 			switch {
 			case errors.Is(err, unix.EACCES) || errors.Is(err, unix.EPERM):
 				cleanPath = filepath.Clean(path)
+			case errors.As(err, &limitErr):
+				limitErr.Path, limitErr.Needed = dirPath, len(files)-i
+				return limitErr
 			default:
 				return fmt.Errorf("%q: %w", path, err)
 			}
@@ -637,6 +1395,10 @@ func (w *kqueue) watchDirectoryFiles(dirPath string) error {
 // This functionality is to have the BSD watcher match the inotify, which sends
 // a create event for files created in a watched directory.
 func (w *kqueue) dirChange(dir string) error {
+	if !w.fileWatches {
+		return w.diffDir(dir)
+	}
+
 	files, err := os.ReadDir(dir)
 	if err != nil {
 		// Directory no longer exists: we can ignore this safely. kqueue will
@@ -683,6 +1445,156 @@ func (w *kqueue) sendCreateIfNew(path string, fi os.FileInfo) error {
 	return nil
 }
 
+// readListing reads the directory entries for dir.
+func readListing(dir string) (map[string]dirEntry, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := make(map[string]dirEntry, len(files))
+	for _, f := range files {
+		fi, err := f.Info()
+		if err != nil { // Removed since the ReadDir().
+			continue
+		}
+		e := dirEntry{size: fi.Size(), mtime: fi.ModTime(), mode: fi.Mode()}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			e.ino, e.nlink = uint64(st.Ino), uint64(st.Nlink)
+		}
+		l[f.Name()] = e
+	}
+	return l, nil
+}
+
+// diffDir compares the directory with the previous listing, and sends events
+// for the differences. This is used instead of a watch for every file if
+// WithFileWatches() isn't used.
+//
+// A new inode under a different name than one that disappeared is sent as a
+// rename. Writes and chmods are sent only if the size, mtime, or mode changed
+// (and only when the directory itself changes, as kqueue doesn't report changes
+// to files in a directory).
+func (w *kqueue) diffDir(dir string) error {
+	cur, err := readListing(dir)
+	if err != nil {
+		// Directory no longer exists: we can ignore this safely. kqueue will
+		// still give us the correct events.
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("fsnotify.dirChange: %w", err)
+	}
+	prev := w.watches.swapListing(dir, cur)
+	if prev == nil {
+		return nil
+	}
+
+	// Files with their own watch send their own write, chmod, remove, and
+	// rename events.
+	ownWatch := func(path string) bool {
+		_, ok := w.watches.byPath(path)
+		return ok
+	}
+
+	var (
+		gone  = make(map[string]struct{}) // Removed (or renamed) names.
+		byIno = make(map[uint64]string)   // Inode of removed names, to detect renames.
+	)
+	for name, p := range prev {
+		if _, ok := cur[name]; !ok {
+			gone[name] = struct{}{}
+			if p.ino != 0 {
+				byIno[p.ino] = name
+			}
+		}
+	}
+
+	names := make([]string, 0, len(cur))
+	for name := range cur {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var (
+			c     = cur[name]
+			p, ok = prev[name]
+			path  = filepath.Join(dir, name)
+			send  []Event
+		)
+		switch {
+		case !ok || p.ino != c.ino:
+			old, renamed := byIno[c.ino]
+			if !renamed || c.ino == 0 {
+				e := Event{Name: path, Op: Create}
+				if !c.mode.IsDir() && c.nlink > 1 {
+					e.Op |= w.watches.opsFor(path) & UnportableLink
+					setLinks(&e, c.nlink)
+				}
+				send = append(send, e)
+				break
+			}
+			delete(gone, old)
+			delete(byIno, c.ino)
+			oldPath := filepath.Join(dir, old)
+			if !ownWatch(oldPath) {
+				send = append(send, Event{Name: oldPath, Op: Rename})
+			}
+			send = append(send, Event{Name: path, Op: Create, RenamedFrom: oldPath})
+		case ownWatch(path):
+		default:
+			if c.size != p.size || !c.mtime.Equal(p.mtime) {
+				e := Event{Name: path, Op: Write}
+				if c.size > p.size {
+					e.Op |= w.watches.opsFor(path) & UnportableExtend
+				} else if c.size < p.size {
+					e.Op |= w.watches.opsFor(path) & UnportableTruncate
+				}
+				send = append(send, e)
+			}
+			if c.mode != p.mode {
+				send = append(send, Event{Name: path, Op: Chmod | w.watches.opsFor(path)&UnportableMode})
+			}
+			if ops := w.watches.opsFor(path); !c.mode.IsDir() && c.nlink != p.nlink &&
+				(ops.Has(UnportableLink) || ops.Has(UnportableUnlink)) {
+				e := Event{Name: path, Op: Chmod}
+				if c.nlink > p.nlink {
+					e.Op |= ops & UnportableLink
+				} else {
+					e.Op |= ops & UnportableUnlink
+				}
+				setLinks(&e, c.nlink)
+				send = append(send, e)
+			}
+		}
+		for _, e := range send {
+			if !w.sendEvent(e) {
+				return nil
+			}
+		}
+	}
+
+	names = names[:0]
+	for name := range gone {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if ownWatch(path) {
+			continue
+		}
+		e := Event{Name: path, Op: Remove}
+		if p := prev[name]; !p.mode.IsDir() && p.nlink > 1 {
+			e.Op |= w.watches.opsFor(path) & UnportableUnlink
+			setLinks(&e, p.nlink-1)
+		}
+		if !w.sendEvent(e) {
+			return nil
+		}
+	}
+	return nil
+}
+
 func (w *kqueue) internalWatch(name string, fi os.FileInfo) (string, error) {
 	if fi.IsDir() {
 		// mimic Linux providing delete events for subdirectories, but preserve
@@ -692,7 +1604,7 @@ func (w *kqueue) internalWatch(name string, fi os.FileInfo) (string, error) {
 	}
 
 	// watch file to mimic Linux inotify
-	return w.addWatch(name, noteAllEvents)
+	return w.addWatch(name, noteAllEvents|notesFor(w.watches.opsFor(name)))
 }
 
 // Register events with the queue.
@@ -721,12 +1633,34 @@ func (w *kqueue) read(events []unix.Kevent_t) ([]unix.Kevent_t, error) {
 	return events[0:n], nil
 }
 
-func (w *kqueue) xSupports(op Op) bool {
-	if runtime.GOOS == "freebsd" {
-		//return true // Supports everything.
+// backendName is the name of the backend newBufferedBackend() creates, for
+// the pprof labels with WithProfiling().
+func backendName(with watcherOpts) string { return "kqueue" }
+
+func probe(path string, with watcherOpts) Capabilities {
+	c := Capabilities{FSType: fsTypeName(path), FileWrites: with.fileWatches}
+	if with.sandbox || runtime.GOOS == "ios" {
+		c.WatchLimit, c.FileWrites = sandboxFDs(with), false
 	}
-	if op.Has(xUnportableOpen) || op.Has(xUnportableRead) ||
-		op.Has(UnportableCloseWrite) || op.Has(xUnportableCloseRead) {
+	c.Network = pollFilesystems[c.FSType]
+	if c.Network && !with.noPolling {
+		c.Ops, c.Polled, c.Latency, c.FileWrites = pollOps&^Rename, true, pollInterval, true
+	} else {
+		c.Ops = supportedOps((&kqueue{}).xSupports)
+	}
+	return c
+}
+
+func (w *kqueue) name() string { return "kqueue" }
+
+func (w *kqueue) xSupports(op Op) bool {
+	if (op.Has(xUnportableOpen) && noteOpen == 0) || (op.Has(xUnportableRead) && noteRead == 0) ||
+		(op.Has(UnportableCloseWrite) && noteCloseWrite == 0) ||
+		(op.Has(xUnportableCloseRead) && noteCloseRead == 0) ||
+		(op.Has(UnportableMount) && mountpoints == nil) ||
+		(op.Has(UnportableXattr) && !hasXattr) ||
+		(op.Has(UnportableACL) && aclXattrs == nil) ||
+		op.Has(UnportableSecurity) || op.Has(UnportableClone) {
 		return false
 	}
 	return true
@@ -0,0 +1,30 @@
+//go:build darwin || freebsd
+
+package fsnotify
+
+import "golang.org/x/sys/unix"
+
+func init() {
+	evfiltFS = unix.EVFILT_FS
+	mountpoints = getfsstat
+}
+
+// getfsstat gets all mountpoints.
+func getfsstat() (map[string]struct{}, error) {
+	n, err := unix.Getfsstat(nil, unix.MNT_NOWAIT)
+	if err != nil {
+		return nil, err
+	}
+	// Leave some room for filesystems mounted in the meanwhile.
+	buf := make([]unix.Statfs_t, n+8)
+	n, err = unix.Getfsstat(buf, unix.MNT_NOWAIT)
+	if err != nil {
+		return nil, err
+	}
+
+	points := make(map[string]struct{}, n)
+	for _, s := range buf[:n] {
+		points[unix.ByteSliceToString(s.Mntonname[:])] = struct{}{}
+	}
+	return points, nil
+}
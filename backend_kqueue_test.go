@@ -3,9 +3,13 @@
 package fsnotify
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func TestRemoveState(t *testing.T) {
@@ -93,3 +97,129 @@ func TestRemoveState(t *testing.T) {
 		}
 	}
 }
+
+func TestKqueueDirOnly(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file")
+	touch(t, tmp, "other")
+	mkdir(t, tmp, "dir")
+
+	// The tests use WithFileWatches() by default.
+	w, err := NewWatcherWith(func(o *watcherOpts) { o.fileWatches = false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	addWatch(t, w, tmp)
+
+	if have := w.Stats(); have.Watches != 1 {
+		t.Errorf("Stats: %#v", have)
+	}
+
+	echoAppend(t, "data", tmp, "file") // Not seen until the directory changes.
+	touch(t, tmp, "new")
+	mv(t, join(tmp, "other"), tmp, "renamed")
+	rm(t, tmp, "new")
+	rm(t, tmp, "dir")
+
+	cmpEvents(t, tmp, c.stop(t), newEventsDirOnly(t, `
+		write   /file
+		create  /new
+		rename  /other
+		create  /renamed ← /other
+		remove  /new
+		remove  /dir
+	`))
+}
+
+func TestKqueueSandbox(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "a")
+	mkdir(t, tmp, "b")
+	mkdir(t, tmp, "c")
+
+	// The tests use WithFileWatches() by default.
+	if _, err := NewWatcherWith(WithSandbox(2)); !errors.Is(err, xErrUnsupported) {
+		t.Fatalf("wrong error with WithFileWatches: %v", err)
+	}
+	w, err := NewWatcherWith(WithSandbox(2), func(o *watcherOpts) { o.fileWatches = false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addWatch(t, w, tmp, "a")
+	addWatch(t, w, tmp, "b")
+	addWatch(t, w, tmp, "c")
+
+	var perr *PollingError
+	select {
+	case err := <-w.Errors:
+		if !errors.As(err, &perr) {
+			t.Fatalf("wrong error: %#v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no PollingError")
+	}
+	if perr.Limit != "WithSandbox" || perr.Path != join(tmp, "c") {
+		t.Errorf("wrong PollingError: %#v", perr)
+	}
+	if have := w.Stats(); have.Watches != 2 || have.Polled != 1 {
+		t.Errorf("wrong Stats: %+v", have)
+	}
+
+	w2, err := NewWatcherWith(WithSandbox(1), WithNoPolling(), func(o *watcherOpts) { o.fileWatches = false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Close()
+	addWatch(t, w2, tmp, "a")
+	var lerr *WatchLimitError
+	if err := w2.Add(join(tmp, "b")); !errors.As(err, &lerr) || lerr.Limit != 1 {
+		t.Fatalf("wrong error with WithNoPolling: %v", err)
+	}
+}
+
+func TestKqueueWatchLimitError(t *testing.T) {
+	err := (&kqueue{watches: newWatches()}).limitError("/path", 2, unix.EMFILE)
+
+	if !errors.Is(err, ErrWatchLimit) {
+		t.Error("not ErrWatchLimit")
+	}
+	if !errors.Is(err, unix.EMFILE) {
+		t.Error("not EMFILE")
+	}
+	if err.Limit <= 0 {
+		t.Errorf("Limit: %d", err.Limit)
+	}
+	want := fmt.Sprintf(`fsnotify: watching "/path": too many open files (this watcher has 0 watches and needs 2 more; `+
+		`RLIMIT_NOFILE is %d); the limit can be increased with "ulimit -n <n>"`, err.Limit)
+	if have := err.Error(); have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+}
+
+func TestKqueueFileTypeError(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkfifo(t, tmp, "fifo")
+
+	w := newWatcher(t)
+	defer w.Close()
+	err := w.Add(join(tmp, "fifo"))
+	var ftErr *FileTypeError
+	if !errors.As(err, &ftErr) {
+		t.Fatalf("wrong error: %#v", err)
+	}
+	if ftErr.Path != join(tmp, "fifo") {
+		t.Errorf("wrong Path: %q", ftErr.Path)
+	}
+	if want := `fsnotify: can't watch "` + join(tmp, "fifo") + `": watching a FIFO is not supported with this backend`; ftErr.Error() != want {
+		t.Errorf("\nhave: %s\nwant: %s", ftErr.Error(), want)
+	}
+}
@@ -0,0 +1,316 @@
+// Object storage backend, used with WithObjectStore().
+//
+// This turns the notifications from an ObjectStore adapter into events. Object
+// stores don't have directories, so a watched path is a key prefix: adding
+// "dir" sends events for "dir" itself and for all keys directly below it
+// ("dir/file", but not "dir/sub/file").
+
+package fsnotify
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ObjectStore is an adapter for object storage notifications (e.g. S3 or
+// MinIO bucket notifications, or GCS Pub/Sub notifications), for use with
+// [WithObjectStore].
+//
+// fsnotify doesn't include any adapters, as that would mean depending on the
+// SDKs for all of them; they're usually a few dozen lines on top of the SDK's
+// notification API.
+type ObjectStore interface {
+	// List returns the keys of all objects directly below prefix (i.e. with
+	// no "/" after the prefix), and the object with the prefix as key if it
+	// exists. prefix doesn't have a trailing "/", and is empty for the root of
+	// the bucket.
+	//
+	// This is called when a path is added, to tell if an ObjectCreated
+	// notification is for a new object (Create) or an overwrite (Write).
+	List(prefix string) ([]string, error)
+
+	// Notifications returns the channel the notifications are read from. This
+	// is called once, and the channel should stay open until Close is called.
+	Notifications() <-chan ObjectEvent
+
+	// Close stops sending notifications and releases all resources.
+	Close() error
+}
+
+// ObjectEvent is a notification from an [ObjectStore].
+type ObjectEvent struct {
+	// Object key, e.g. "dir/file.txt".
+	Key string
+
+	// The object was removed; if false it was created or overwritten (e.g.
+	// s3:ObjectCreated:* or OBJECT_FINALIZE).
+	Removed bool
+
+	// Send this error on the Errors channel, rather than an event. Key and
+	// Removed are ignored.
+	Err error
+}
+
+type objectWatcher struct {
+	Events chan Event
+	Errors chan error
+
+	store    ObjectStore
+	done     chan struct{}
+	doneMu   sync.Mutex
+	doneResp chan struct{}
+
+	mu      sync.Mutex
+	watches map[string]Op       // Watched prefixes.
+	keys    map[string]struct{} // Keys that exist, for watched prefixes.
+}
+
+func newObjectWatcher(store ObjectStore, ev chan Event, errs chan error) (backend, error) {
+	w := &objectWatcher{
+		Events:   ev,
+		Errors:   errs,
+		store:    store,
+		done:     make(chan struct{}),
+		doneResp: make(chan struct{}),
+		watches:  make(map[string]Op),
+		keys:     make(map[string]struct{}),
+	}
+	go w.readEvents(store.Notifications())
+	return w, nil
+}
+
+// Returns true if the event was sent, or false if watcher is closed.
+func (w *objectWatcher) sendEvent(e Event) bool {
+	select {
+	case <-w.done:
+		return false
+	case w.Events <- e:
+		return true
+	}
+}
+
+// Returns true if the error was sent, or false if watcher is closed.
+func (w *objectWatcher) sendError(err error) bool {
+	if err == nil {
+		return true
+	}
+	err = wrapError(w, "watch", "", err)
+	select {
+	case <-w.done:
+		return false
+	case w.Errors <- err:
+		return true
+	}
+}
+
+func (w *objectWatcher) isClosed() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *objectWatcher) Close() error {
+	w.doneMu.Lock()
+	if w.isClosed() {
+		w.doneMu.Unlock()
+		return nil
+	}
+	close(w.done)
+	w.doneMu.Unlock()
+
+	err := w.store.Close()
+	<-w.doneResp
+	return err
+}
+
+// objectPrefix converts a path to a key prefix: without leading or trailing
+// slashes, and "" for the root.
+func objectPrefix(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+func (w *objectWatcher) Add(name string) error { return w.AddWith(name) }
+
+func (w *objectWatcher) AddWith(name string, opts ...addOpt) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  AddWith(%q)\n",
+			time.Now().Format("15:04:05.000000000"), name)
+	}
+
+	with := getOptions(opts...)
+	if !w.xSupports(with.op) {
+		return fmt.Errorf("%w: %s", xErrUnsupported, with.op)
+	}
+
+	prefix := objectPrefix(name)
+	w.mu.Lock()
+	if op, ok := w.watches[prefix]; ok {
+		w.watches[prefix] = op | with.op
+		w.mu.Unlock()
+		return nil
+	}
+	w.mu.Unlock()
+
+	keys, err := w.store.List(prefix)
+	if err != nil {
+		return fmt.Errorf("fsnotify: listing %q: %w", prefix, err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.watches[prefix] = with.op
+	for _, k := range keys {
+		w.keys[k] = struct{}{}
+	}
+	return nil
+}
+
+func (w *objectWatcher) removeOps(name string, op Op) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  RemoveOps(%q, %s)\n",
+			time.Now().Format("15:04:05.000000000"), name, op)
+	}
+
+	prefix := objectPrefix(name)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	prev, ok := w.watches[prefix]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	if prev&^op == 0 {
+		return errAllOps(name)
+	}
+	w.watches[prefix] = prev &^ op
+	return nil
+}
+
+func (w *objectWatcher) Remove(name string) error {
+	if w.isClosed() {
+		return nil
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  Remove(%q)\n",
+			time.Now().Format("15:04:05.000000000"), name)
+	}
+
+	prefix := objectPrefix(name)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.watches[prefix]; !ok {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	delete(w.watches, prefix)
+	for k := range w.keys {
+		if w.opsLocked(k) == 0 {
+			delete(w.keys, k)
+		}
+	}
+	return nil
+}
+
+func (w *objectWatcher) WatchList() []string {
+	if w.isClosed() {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	entries := make([]string, 0, len(w.watches))
+	for p := range w.watches {
+		entries = append(entries, p)
+	}
+	return entries
+}
+
+func (w *objectWatcher) Stats() Stats {
+	if w.isClosed() {
+		return Stats{}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return Stats{Watches: len(w.watches)}
+}
+
+func (w *objectWatcher) name() string { return "object" }
+
+func (w *objectWatcher) xSupports(op Op) bool { return op&^(Create|Write|Remove|Rename|Chmod) == 0 }
+
+// opsLocked gets the operations key is watched for, as a watched prefix or
+// directly below one. Must be called with w.mu held.
+func (w *objectWatcher) opsLocked(key string) Op {
+	dir := path.Dir(key)
+	if dir == "." {
+		dir = ""
+	}
+	return w.watches[key] | w.watches[dir]
+}
+
+func (w *objectWatcher) readEvents(ch <-chan ObjectEvent) {
+	defer func() {
+		close(w.doneResp)
+		close(w.Errors)
+		close(w.Events)
+	}()
+
+	for {
+		var (
+			ev ObjectEvent
+			ok bool
+		)
+		select {
+		case <-w.done:
+			return
+		case ev, ok = <-ch:
+			if !ok {
+				return
+			}
+		}
+
+		if ev.Err != nil {
+			if !w.sendError(ev.Err) {
+				return
+			}
+			continue
+		}
+
+		key := strings.TrimPrefix(ev.Key, "/")
+		w.mu.Lock()
+		ops := w.opsLocked(key)
+		if ops == 0 {
+			w.mu.Unlock()
+			continue
+		}
+		_, exists := w.keys[key]
+		op := Create
+		switch {
+		case ev.Removed:
+			op = Remove
+			delete(w.keys, key)
+		case exists:
+			op = Write
+		default:
+			w.keys[key] = struct{}{}
+		}
+		w.mu.Unlock()
+
+		if !ops.Has(op) {
+			continue
+		}
+		if !w.sendEvent(Event{Name: key, Op: op}) {
+			return
+		}
+	}
+}
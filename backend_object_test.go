@@ -0,0 +1,59 @@
+package fsnotify
+
+import (
+	"errors"
+	"testing"
+)
+
+type fakeObjectStore struct {
+	keys []string
+	ch   chan ObjectEvent
+}
+
+func (s *fakeObjectStore) List(prefix string) ([]string, error) {
+	if prefix == "error" {
+		return nil, errors.New("oops")
+	}
+	return s.keys, nil
+}
+func (s *fakeObjectStore) Notifications() <-chan ObjectEvent { return s.ch }
+func (s *fakeObjectStore) Close() error                      { close(s.ch); return nil }
+
+func TestObjectStore(t *testing.T) {
+	t.Parallel()
+
+	store := &fakeObjectStore{keys: []string{"dir/file"}, ch: make(chan ObjectEvent)}
+	w, err := NewWatcherWith(WithObjectStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	addWatch(t, w, "/dir/")
+	if err := w.Add("error"); err == nil {
+		t.Error("no error from List")
+	}
+	if have := w.WatchList(); len(have) != 1 || have[0] != "dir" {
+		t.Errorf("WatchList: %s", have)
+	}
+
+	for _, e := range []ObjectEvent{
+		{Key: "dir/new"},
+		{Key: "dir/file"},
+		{Key: "dir/new"},
+		{Key: "dir/sub/file"}, // Not directly below dir.
+		{Key: "other"},
+		{Key: "dir/file", Removed: true},
+		{Key: "dir/file"},
+	} {
+		store.ch <- e
+	}
+
+	cmpEvents(t, "dir", c.stop(t), newEvents(t, `
+		create  /new
+		write   /file
+		write   /new
+		remove  /file
+		create  /file
+	`))
+}
@@ -1,4 +1,4 @@
-//go:build appengine || (!darwin && !dragonfly && !freebsd && !openbsd && !linux && !netbsd && !solaris && !windows)
+//go:build appengine || (!darwin && !dragonfly && !freebsd && !openbsd && !linux && !netbsd && !solaris && !windows && !js && !wasip1 && !plan9 && !aix && !zos)
 
 package fsnotify
 
@@ -12,12 +12,17 @@ type other struct {
 func newBackend(ev chan Event, errs chan error) (backend, error) {
 	return nil, errors.New("fsnotify not supported on the current platform")
 }
-func newBufferedBackend(sz uint, ev chan Event, errs chan error) (backend, error) {
+func newBufferedBackend(sz uint, ev chan Event, errs chan error, with watcherOpts) (backend, error) {
 	return newBackend(ev, errs)
 }
+func backendName(with watcherOpts) string              { return "other" }
+func probe(path string, with watcherOpts) Capabilities { return Capabilities{} }
+
 func (w *other) Close() error                              { return nil }
 func (w *other) WatchList() []string                       { return nil }
+func (w *other) Stats() Stats                              { return Stats{} }
 func (w *other) Add(name string) error                     { return nil }
 func (w *other) AddWith(name string, opts ...addOpt) error { return nil }
 func (w *other) Remove(name string) error                  { return nil }
 func (w *other) xSupports(op Op) bool                      { return false }
+func (w *other) name() string                              { return "other" }
@@ -0,0 +1,689 @@
+package fsnotify
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PollStrategy is how polled paths are compared to detect changes, for use with
+// [WithPollStrategy].
+type PollStrategy int
+
+const (
+	// PollDefault uses PollContent for files on virtual filesystems such as
+	// proc and sysfs, and PollModTime for everything else.
+	PollDefault PollStrategy = iota
+
+	// PollModTime compares the size and modification time. This is cheap, but
+	// misses changes that don't change the size within the resolution of the
+	// timestamps; for example 2 seconds on FAT.
+	PollModTime
+
+	// PollMetadata compares the size, modification time, mode, inode, owner,
+	// and link count. Files that are replaced (e.g. by a rename) are detected
+	// even if they have the same size and modification time. This is the same
+	// as PollModTime on Windows and with WithSSH. On Plan 9 this compares the
+	// qid version instead of the inode and link count, which sees every write.
+	PollMetadata
+
+	// PollContent compares a hash of the contents of files. This detects all
+	// changes regardless of the timestamps, but reads every file on every
+	// poll.
+	PollContent
+)
+
+func (s PollStrategy) String() string {
+	switch s {
+	case PollDefault:
+		return "PollDefault"
+	case PollModTime:
+		return "PollModTime"
+	case PollMetadata:
+		return "PollMetadata"
+	case PollContent:
+		return "PollContent"
+	}
+	return fmt.Sprintf("PollStrategy(%d)", int(s))
+}
+
+// Operations the poller can detect.
+const pollOps = Create | Write | Remove | Rename | Chmod | UnportableExtend | UnportableTruncate
+
+// poller watches paths by periodically comparing the state of the path (and
+// the entries in it, for directories) with the previous state. This is used for
+// filesystems where the kernel doesn't report changes, or only reports changes
+// made on the local system (NFS, SMB, FUSE, etc.)
+//
+// Events are sent with the backend's sendEvent and sendError, and stop() must
+// be called before the backend closes the channels.
+type poller struct {
+	sendEvent func(Event) bool
+	sendError func(error) bool
+	stat      func(path string) (os.FileInfo, map[string]os.FileInfo, error)
+	interval  time.Duration
+	clock     Clock
+	workers   int
+
+	mu      sync.Mutex
+	watches map[string]*pollWatch
+	warn    []error       // Warnings to send from the goroutine.
+	wake    chan struct{} // Send warnings.
+	stopped chan struct{} // nil if the goroutine isn't running.
+	done    chan struct{}
+}
+
+type pollWatch struct {
+	op       Op
+	cfg      pollConfig
+	interval time.Duration // Current interval.
+	next     time.Time     // When to poll next.
+	info     os.FileInfo
+	files    map[string]os.FileInfo // Directory entries; nil for files.
+
+	strategy PollStrategy
+	sumLimit int64             // Bytes to read for PollContent; 0 for everything.
+	sums     map[string]uint64 // PollContent; by name in the directory, "" for the path itself.
+}
+
+// How often paths are polled by default.
+const pollInterval = 2 * time.Second
+
+const (
+	pollWorkers     = 4    // Default for WithPollWorkers().
+	pollParallelMin = 1000 // Directories with fewer entries are read by one goroutine.
+)
+
+// pollConfig is how a path is polled, from the addOpts.
+type pollConfig struct {
+	interval time.Duration // WithPollInterval(); 0 for the default.
+	min, max time.Duration // WithAdaptivePolling(); both 0 if not used.
+	strategy PollStrategy  // WithPollStrategy()
+}
+
+func getPollConfig(with withOpts) pollConfig {
+	return pollConfig{interval: with.pollInterval, min: with.pollMin, max: with.pollMax, strategy: with.pollStrategy}
+}
+
+func (c pollConfig) adaptive() bool { return c.max > 0 }
+
+// checkAdaptive returns an error if the WithAdaptivePolling() bounds are
+// invalid; a min without a max is an error too, rather than being ignored.
+func (c pollConfig) checkAdaptive() error {
+	if (c.min != 0 || c.max != 0) && (c.min <= 0 || c.max < c.min) {
+		return fmt.Errorf("fsnotify: WithAdaptivePolling: invalid bounds %s and %s", c.min, c.max)
+	}
+	return nil
+}
+
+// start gets the interval to start with.
+func (c pollConfig) start(def time.Duration) time.Duration {
+	d := c.interval
+	if d <= 0 {
+		d = def
+	}
+	if c.adaptive() {
+		if d < c.min {
+			d = c.min
+		}
+		if d > c.max {
+			d = c.max
+		}
+	}
+	return d
+}
+
+// adapt adjusts the interval after polling for WithAdaptivePolling(): it's
+// halved if the path changed, and doubled if it didn't.
+func (ww *pollWatch) adapt(changed bool) {
+	if !ww.cfg.adaptive() {
+		return
+	}
+	if changed {
+		ww.interval /= 2
+		if ww.interval < ww.cfg.min {
+			ww.interval = ww.cfg.min
+		}
+	} else {
+		ww.interval *= 2
+		if ww.interval > ww.cfg.max {
+			ww.interval = ww.cfg.max
+		}
+	}
+}
+
+// newPoller creates a poller that reads paths with up to workers goroutines.
+func newPoller(sendEvent func(Event) bool, sendError func(error) bool, clock Clock, workers int) *poller {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &poller{
+		sendEvent: sendEvent,
+		sendError: sendError,
+		interval:  pollInterval,
+		clock:     clock,
+		workers:   workers,
+		watches:   make(map[string]*pollWatch),
+		wake:      make(chan struct{}, 1),
+	}
+	p.stat = func(path string) (os.FileInfo, map[string]os.FileInfo, error) { return pollStat(path, p.workers) }
+	return p
+}
+
+// add starts polling path, which is on the fstype filesystem, as set in cfg. A
+// *PollingError is sent when a path is polled for the first time, unless fstype
+// is empty.
+func (p *poller) add(path string, op Op, fstype string, cfg pollConfig) error {
+	return p.addWith(path, op, fstype, false, cfg)
+}
+
+// addWith is like add, but for a path on a virtual filesystem (proc, sysfs)
+// if virtual is set: files on those don't have a meaningful size or
+// modification time, so the contents are compared by default.
+func (p *poller) addWith(path string, op Op, fstype string, virtual bool, cfg pollConfig) error {
+	if op&^pollOps != 0 {
+		return fmt.Errorf("%w: %s on %s (polled)", xErrUnsupported, op&^pollOps, fstype)
+	}
+	if err := cfg.checkAdaptive(); err != nil {
+		return err
+	}
+	if cfg.strategy < PollDefault || cfg.strategy > PollContent {
+		return fmt.Errorf("fsnotify: WithPollStrategy: invalid strategy %s", cfg.strategy)
+	}
+
+	strategy, limit := cfg.strategy, int64(0)
+	if strategy == PollDefault {
+		strategy = PollModTime
+		if virtual {
+			strategy = PollContent
+		}
+	}
+	if virtual {
+		// Files on /proc and /sys report a size of 0 (or 4096) and need to
+		// be read until EOF, which may never come.
+		limit = 1 << 20
+	}
+
+	info, files, err := p.stat(path)
+	if err != nil {
+		return err
+	}
+	var sums map[string]uint64
+	if strategy == PollContent {
+		sums = pollSums(path, files, limit, p.workers)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ww, ok := p.watches[path]; ok {
+		ww.op |= op
+		if cfg != (pollConfig{}) && cfg != ww.cfg {
+			ww.cfg, ww.interval = cfg, cfg.start(p.interval)
+			ww.next = p.clock.Now().Add(ww.interval)
+			if strategy != ww.strategy {
+				ww.strategy, ww.info, ww.files, ww.sums = strategy, info, files, sums
+			}
+			p.wakeLocked()
+		}
+		return nil
+	}
+	interval := cfg.start(p.interval)
+	p.watches[path] = &pollWatch{op: op, cfg: cfg, interval: interval, next: p.clock.Now().Add(interval),
+		info: info, files: files, strategy: strategy, sumLimit: limit, sums: sums}
+	if fstype != "" {
+		p.warn = append(p.warn, &PollingError{Path: path, FSType: fstype, Interval: interval})
+	}
+
+	if p.stopped == nil {
+		p.stopped, p.done = make(chan struct{}), make(chan struct{})
+		go p.run(p.stopped, p.done)
+	}
+	p.wakeLocked()
+	return nil
+}
+
+// addAtLimit is like add, for a path that's polled because the sysctl limit
+// was reached.
+func (p *poller) addAtLimit(path string, op Op, fstype, sysctl string, cfg pollConfig) error {
+	if err := p.add(path, op, "", cfg); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ww, ok := p.watches[path]; ok {
+		p.warn = append(p.warn, &PollingError{Path: path, FSType: fstype, Interval: ww.interval, Limit: sysctl})
+		p.wakeLocked()
+	}
+	return nil
+}
+
+// wakeLocked makes the goroutine send the warnings and check when to poll
+// next. Must be called with p.mu held.
+func (p *poller) wakeLocked() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// remove stops polling path. Returns false if path isn't polled.
+func (p *poller) remove(path string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.watches[path]
+	delete(p.watches, path)
+	return ok
+}
+
+// removeOps stops sending events for op for path. Returns false if path isn't
+// polled.
+func (p *poller) removeOps(path string, op Op) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ww, ok := p.watches[path]
+	if !ok {
+		return false, nil
+	}
+	if ww.op&^op == 0 {
+		return true, errAllOps(path)
+	}
+	ww.op &^= op
+	return true, nil
+}
+
+func (p *poller) list() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l := make([]string, 0, len(p.watches))
+	for path := range p.watches {
+		l = append(l, path)
+	}
+	return l
+}
+
+func (p *poller) info() []WatchInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l := make([]WatchInfo, 0, len(p.watches))
+	for path, pw := range p.watches {
+		l = append(l, WatchInfo{Path: path, Op: pw.op, Polled: true})
+	}
+	return l
+}
+
+// stop stops the goroutine and waits for it to exit.
+func (p *poller) stop() {
+	p.mu.Lock()
+	stopped, done := p.stopped, p.done
+	p.stopped, p.done = nil, nil
+	p.watches = make(map[string]*pollWatch)
+	p.mu.Unlock()
+	if stopped == nil {
+		return
+	}
+	close(stopped)
+	<-done
+}
+
+func (p *poller) run(stopped, done chan struct{}) {
+	defer close(done)
+
+	t := p.clock.NewTimer(p.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stopped:
+			return
+		case <-p.wake:
+			p.mu.Lock()
+			warn := p.warn
+			p.warn = nil
+			p.mu.Unlock()
+			for _, err := range warn {
+				if !p.sendError(err) {
+					return
+				}
+			}
+		case <-t.C():
+			if !p.poll() {
+				return
+			}
+		}
+
+		stopTimer(t)
+		t.Reset(p.nextPoll())
+	}
+}
+
+// nextPoll gets the time until a path needs to be polled.
+func (p *poller) nextPoll() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var (
+		now = p.clock.Now()
+		d   = p.interval
+	)
+	for _, ww := range p.watches {
+		if dd := ww.next.Sub(now); dd < d {
+			d = dd
+		}
+	}
+	return d
+}
+
+// pollScan is the state of a path read by a worker in poll().
+type pollScan struct {
+	ok    bool // false if the path was removed in the meantime.
+	info  os.FileInfo
+	files map[string]os.FileInfo
+	sums  map[string]uint64
+	err   error
+}
+
+// scan reads the current state of path.
+func (p *poller) scan(path string) pollScan {
+	p.mu.Lock()
+	ww, ok := p.watches[path]
+	var (
+		content = ok && ww.strategy == PollContent
+		limit   int64
+	)
+	if ok {
+		limit = ww.sumLimit
+	}
+	p.mu.Unlock()
+	if !ok {
+		return pollScan{}
+	}
+
+	s := pollScan{ok: true}
+	s.info, s.files, s.err = p.stat(path)
+	if s.err == nil && content {
+		s.sums = pollSums(path, s.files, limit, p.workers)
+	}
+	return s
+}
+
+// poll checks all paths that are due once. Returns false if the watcher was
+// closed.
+//
+// The paths are read by up to p.workers goroutines, and the results are
+// compared and sent in order as they come in. Workers don't get more than a few
+// paths ahead of the events that are sent, to bound the memory used.
+func (p *poller) poll() bool {
+	p.mu.Lock()
+	now := p.clock.Now()
+	paths := make([]string, 0, len(p.watches))
+	for path, ww := range p.watches {
+		if !ww.next.After(now) {
+			paths = append(paths, path)
+			ww.next = now.Add(ww.interval)
+		}
+	}
+	p.mu.Unlock()
+	sort.Strings(paths)
+
+	var (
+		results = make([]chan pollScan, len(paths))
+		ahead   = make(chan struct{}, 2*p.workers) // Paths scanned but not sent.
+		quit    = make(chan struct{})
+	)
+	defer close(quit)
+	for i := range results {
+		results[i] = make(chan pollScan, 1)
+	}
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range paths {
+			select {
+			case <-quit:
+				return
+			case ahead <- struct{}{}:
+			}
+			select {
+			case <-quit:
+				return
+			case jobs <- i:
+			}
+		}
+	}()
+	for k := 0; k < p.workers && k < len(paths); k++ {
+		go func() {
+			for i := range jobs {
+				results[i] <- p.scan(paths[i])
+			}
+		}()
+	}
+
+	for i, path := range paths {
+		s := <-results[i]
+		<-ahead
+		if !s.ok { // Removed in the meantime.
+			continue
+		}
+		info, files, sums, err := s.info, s.files, s.sums, s.err
+
+		p.mu.Lock()
+		ww, ok := p.watches[path]
+		if !ok { // Removed in the meantime.
+			p.mu.Unlock()
+			continue
+		}
+		var events []Event
+		if err != nil {
+			// Removed, or no longer accessible: stop watching it, like the
+			// kernel does.
+			delete(p.watches, path)
+			if os.IsNotExist(err) {
+				events = append(events, Event{Name: path, Op: Remove})
+			} else {
+				p.mu.Unlock()
+				if !p.sendError(err) {
+					return false
+				}
+				continue
+			}
+		} else {
+			events = ww.diff(path, info, files, sums)
+			ww.info, ww.files, ww.sums = info, files, sums
+			ww.adapt(len(events) > 0)
+			ww.next = now.Add(ww.interval)
+		}
+		op := ww.op
+		p.mu.Unlock()
+
+		for _, e := range events {
+			e.Op &= op
+			if e.Op == 0 {
+				continue
+			}
+			if !p.sendEvent(e) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// diff gets the events for the changes from ww to the new state.
+func (ww *pollWatch) diff(path string, info os.FileInfo, files map[string]os.FileInfo, sums map[string]uint64) []Event {
+	changed := func(name string, prev, cur os.FileInfo) Op {
+		switch ww.strategy {
+		default:
+			return pollChanged(prev, cur)
+		case PollMetadata:
+			return pollChanged(prev, cur) | pollMetaOf(prev).changed(pollMetaOf(cur), cur.IsDir())
+		case PollContent:
+			op := pollChanged(prev, cur)
+			if cur.IsDir() || ww.sums[name] == sums[name] {
+				return op & Chmod
+			}
+			return op | Write
+		}
+	}
+
+	var events []Event
+	if op := changed("", ww.info, info); op != 0 && ww.files == nil {
+		events = append(events, Event{Name: path, Op: op})
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	for name := range ww.files {
+		if _, ok := files[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var (
+			prev, ok1 = ww.files[name]
+			cur, ok2  = files[name]
+			op        Op
+		)
+		switch {
+		case !ok1:
+			op = Create
+		case !ok2:
+			op = Remove
+		case prev.IsDir() != cur.IsDir():
+			events = append(events, Event{Name: filepath.Join(path, name), Op: Remove})
+			op = Create
+		default:
+			op = changed(name, prev, cur)
+		}
+		if op != 0 {
+			events = append(events, Event{Name: filepath.Join(path, name), Op: op})
+		}
+	}
+	return events
+}
+
+// pollChanged gets the Write and Chmod operations for a changed file.
+func pollChanged(prev, cur os.FileInfo) Op {
+	var op Op
+	if !cur.IsDir() && (prev.Size() != cur.Size() || !prev.ModTime().Equal(cur.ModTime())) {
+		op |= Write
+		switch {
+		case cur.Size() > prev.Size():
+			op |= UnportableExtend
+		case cur.Size() < prev.Size():
+			op |= UnportableTruncate
+		}
+	}
+	if prev.Mode() != cur.Mode() {
+		op |= Chmod
+	}
+	return op
+}
+
+// pollStat gets the current state of path, and the entries in it if it's a
+// directory. Large directories are read with up to workers goroutines.
+func pollStat(path string, workers int) (os.FileInfo, map[string]os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return info, nil, err
+	}
+
+	ls, err := os.ReadDir(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ls) < pollParallelMin {
+		workers = 1
+	}
+	fis := make([]os.FileInfo, len(ls))
+	pollParallel(len(ls), workers, func(i int) {
+		fis[i], _ = ls[i].Info() // nil if removed since ReadDir.
+	})
+	files := make(map[string]os.FileInfo, len(ls))
+	for i, f := range ls {
+		if fis[i] != nil {
+			files[f.Name()] = fis[i]
+		}
+	}
+	return info, files, nil
+}
+
+// pollSums gets a hash of the contents of path if it's a file, or the files in
+// it if it's a directory, with up to workers goroutines. Files that can't be
+// read have a sum of 0. Only the first limit bytes are read, unless limit is 0.
+func pollSums(path string, files map[string]os.FileInfo, limit int64, workers int) map[string]uint64 {
+	if files == nil {
+		return map[string]uint64{"": pollSum(path, limit)}
+	}
+	names := make([]string, 0, len(files))
+	for name, fi := range files {
+		if fi.Mode().IsRegular() {
+			names = append(names, name)
+		}
+	}
+	s := make([]uint64, len(names))
+	pollParallel(len(names), workers, func(i int) {
+		s[i] = pollSum(filepath.Join(path, names[i]), limit)
+	})
+	sums := make(map[string]uint64, len(names))
+	for i, name := range names {
+		sums[name] = s[i]
+	}
+	return sums
+}
+
+// pollParallel calls f for 0 to n-1 from up to workers goroutines, and waits
+// for all of them to finish.
+func pollParallel(n, workers int, f func(i int)) {
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+
+	var (
+		wg   sync.WaitGroup
+		next = int64(-1)
+	)
+	wg.Add(workers)
+	for k := 0; k < workers; k++ {
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				f(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func pollSum(path string, limit int64) uint64 {
+	fp, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer fp.Close()
+	var r io.Reader = fp
+	if limit > 0 {
+		r = io.LimitReader(fp, limit)
+	}
+	h := fnv.New64a()
+	if _, err := io.Copy(h, r); err != nil {
+		return 0
+	}
+	return h.Sum64()
+}
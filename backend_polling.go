@@ -0,0 +1,176 @@
+//go:build !appengine && (js || wasip1 || plan9 || zos)
+
+// Polling backend, for platforms without filesystem notifications: WASM
+// runtimes, and Plan 9 (where the 9P protocol has no way to report changes).
+// Everything is polled.
+//
+// This is also used on z/OS: z/OS UNIX has an inotify-compatible API, but
+// golang.org/x/sys/unix doesn't have the wrappers for it on zos in the version
+// this module uses.
+
+package fsnotify
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+type polling struct {
+	Events chan Event
+	Errors chan error
+
+	poll   *poller
+	done   chan struct{}
+	doneMu sync.Mutex
+}
+
+func newBackend(ev chan Event, errs chan error) (backend, error) {
+	return newBufferedBackend(0, ev, errs, defaultWatcherOpts)
+}
+
+func newBufferedBackend(sz uint, ev chan Event, errs chan error, with watcherOpts) (backend, error) {
+	if with.noPolling {
+		return nil, errors.New("fsnotify: WithNoPolling: polling is the only way to watch paths on " + runtime.GOOS)
+	}
+	w := &polling{
+		Events: ev,
+		Errors: errs,
+		done:   make(chan struct{}),
+	}
+	w.poll = newPoller(w.sendEvent, w.sendError, with.clock, with.pollWorkers)
+	return w, nil
+}
+
+func backendName(with watcherOpts) string { return "poll" }
+
+func probe(path string, with watcherOpts) Capabilities {
+	return Capabilities{Ops: pollOps &^ Rename, Polled: true, Latency: pollInterval, FileWrites: true}
+}
+
+// Returns true if the event was sent, or false if watcher is closed.
+func (w *polling) sendEvent(e Event) bool {
+	select {
+	case <-w.done:
+		return false
+	case w.Events <- e:
+		return true
+	}
+}
+
+// Returns true if the error was sent, or false if watcher is closed.
+func (w *polling) sendError(err error) bool {
+	if err == nil {
+		return true
+	}
+	err = wrapError(w, "watch", "", err)
+	select {
+	case <-w.done:
+		return false
+	case w.Errors <- err:
+		return true
+	}
+}
+
+func (w *polling) isClosed() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *polling) Close() error {
+	w.doneMu.Lock()
+	if w.isClosed() {
+		w.doneMu.Unlock()
+		return nil
+	}
+	close(w.done)
+	w.doneMu.Unlock()
+
+	w.poll.stop()
+	close(w.Events)
+	close(w.Errors)
+	return nil
+}
+
+func (w *polling) Add(name string) error { return w.AddWith(name) }
+
+func (w *polling) AddWith(path string, opts ...addOpt) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  AddWith(%q)\n",
+			time.Now().Format("15:04:05.000000000"), path)
+	}
+
+	with := getOptions(opts...)
+	if !w.xSupports(with.op) {
+		return fmt.Errorf("%w: %s", xErrUnsupported, with.op)
+	}
+	if _, recurse := recursivePath(path); recurse {
+		return fmt.Errorf("%w: recursive watches on %s", xErrUnsupported, runtime.GOOS)
+	}
+	return w.poll.add(path, with.op, "", getPollConfig(with))
+}
+
+func (w *polling) removeOps(name string, op Op) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  RemoveOps(%q, %s)\n",
+			time.Now().Format("15:04:05.000000000"), name, op)
+	}
+	ok, err := w.poll.removeOps(name, op)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	return err
+}
+
+func (w *polling) Remove(name string) error {
+	if w.isClosed() {
+		return nil
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  Remove(%q)\n",
+			time.Now().Format("15:04:05.000000000"), name)
+	}
+	if !w.poll.remove(name) {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	return nil
+}
+
+func (w *polling) WatchList() []string {
+	if w.isClosed() {
+		return nil
+	}
+	return w.poll.list()
+}
+
+func (w *polling) watchInfo() []WatchInfo {
+	if w.isClosed() {
+		return nil
+	}
+	return w.poll.info()
+}
+
+func (w *polling) Stats() Stats {
+	if w.isClosed() {
+		return Stats{}
+	}
+	n := len(w.poll.list())
+	return Stats{Watches: n, Polled: n}
+}
+
+func (w *polling) name() string { return "poll" }
+
+func (w *polling) xSupports(op Op) bool { return op&^pollOps == 0 }
@@ -0,0 +1,363 @@
+// SSH backend, used with WithSSH().
+//
+// This watches paths on a remote system by polling: a small Perl script is run
+// over ssh, which reads paths (hex-encoded, one per line) from stdin and
+// replies with the stat() information for the path and the entries in it:
+//
+//	F <st_mode> <st_size> <st_mtime> -            The path itself.
+//	F <st_mode> <st_size> <st_mtime> <hex name>   Directory entry (lstat).
+//	E <error>                                      Instead of the above.
+//	.                                              End of reply.
+//
+// The ssh binary is used rather than an SSH library, so that the user's
+// ~/.ssh/config, keys, and ssh-agent all work as expected. Perl is available on
+// pretty much every Unix system, and unlike stat(1) or find(1) it works the
+// same on all of them.
+
+package fsnotify
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Script to run on the remote system; this must not contain single quotes.
+const sshAgent = `use strict; use Errno; use Time::HiRes qw(stat lstat); $| = 1;
+sub st { return sprintf("%d %d %.6f", $_[2], $_[7], $_[9]) }
+while (my $l = <STDIN>) {
+	chomp($l);
+	my $p = pack("H*", $l);
+	my @s = stat($p);
+	if (!@s) { print(($!{ENOENT} ? "E ENOENT" : "E $!"), "\n.\n"); next }
+	print("F ", st(@s), " -\n");
+	if (($s[2] & 0170000) == 0040000 && opendir(my $d, $p)) {
+		for my $n (readdir($d)) {
+			next if $n eq "." || $n eq "..";
+			my @e = lstat("$p/$n");
+			print("F ", st(@e), " ", unpack("H*", $n), "\n") if @e;
+		}
+		closedir($d);
+	}
+	print(".\n");
+}`
+
+// sshCommand creates the command to run script on dest.
+var sshCommand = func(dest, script string) *exec.Cmd {
+	return exec.Command("ssh", "-T", "-o", "BatchMode=yes", dest, "perl -e '"+script+"'")
+}
+
+type sshWatcher struct {
+	Events chan Event
+	Errors chan error
+
+	dest   string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	statMu sync.Mutex // Only one stat request at a time.
+
+	poll   *poller
+	done   chan struct{}
+	doneMu sync.Mutex
+}
+
+func newSSH(dest string, ev chan Event, errs chan error) (backend, error) {
+	cmd := sshCommand(dest, sshAgent)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("fsnotify: starting ssh: %w", err)
+	}
+
+	w := &sshWatcher{
+		Events: ev,
+		Errors: errs,
+		dest:   dest,
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+		done:   make(chan struct{}),
+	}
+	w.poll = newPoller(w.sendEvent, w.sendError, realClock{}, 1) // stat() is serialized anyway.
+	w.poll.stat = w.stat
+
+	// Make sure the connection works, so that NewWatcherWith() fails rather
+	// than every AddWith().
+	if _, _, err := w.stat("/"); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Returns true if the event was sent, or false if watcher is closed.
+func (w *sshWatcher) sendEvent(e Event) bool {
+	select {
+	case <-w.done:
+		return false
+	case w.Events <- e:
+		return true
+	}
+}
+
+// Returns true if the error was sent, or false if watcher is closed.
+func (w *sshWatcher) sendError(err error) bool {
+	if err == nil {
+		return true
+	}
+	err = wrapError(w, "watch", "", err)
+	select {
+	case <-w.done:
+		return false
+	case w.Errors <- err:
+		return true
+	}
+}
+
+func (w *sshWatcher) isClosed() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *sshWatcher) Close() error {
+	w.doneMu.Lock()
+	if w.isClosed() {
+		w.doneMu.Unlock()
+		return nil
+	}
+	close(w.done)
+	w.doneMu.Unlock()
+
+	// Kill ssh first, as the poller may be waiting for a reply.
+	w.stdin.Close()
+	w.cmd.Process.Kill()
+	w.poll.stop()
+	w.cmd.Wait()
+
+	close(w.Events)
+	close(w.Errors)
+	return nil
+}
+
+func (w *sshWatcher) Add(name string) error { return w.AddWith(name) }
+
+func (w *sshWatcher) AddWith(path string, opts ...addOpt) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  AddWith(%q)\n",
+			time.Now().Format("15:04:05.000000000"), path)
+	}
+
+	with := getOptions(opts...)
+	if !w.xSupports(with.op) {
+		return fmt.Errorf("%w: %s", xErrUnsupported, with.op)
+	}
+	if _, recurse := recursivePath(path); recurse {
+		return fmt.Errorf("%w: recursive watches with WithSSH", xErrUnsupported)
+	}
+	// Everything is polled already, so WithPolling() doesn't change anything;
+	// the contents aren't compared, as that would need to read the remote
+	// files.
+	if with.pollStrategy == PollContent {
+		return fmt.Errorf("%w: PollContent with WithSSH", xErrUnsupported)
+	}
+	return w.poll.add(path, with.op, "", getPollConfig(with))
+}
+
+func (w *sshWatcher) removeOps(name string, op Op) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  RemoveOps(%q, %s)\n",
+			time.Now().Format("15:04:05.000000000"), name, op)
+	}
+	ok, err := w.poll.removeOps(name, op)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	return err
+}
+
+func (w *sshWatcher) Remove(name string) error {
+	if w.isClosed() {
+		return nil
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  Remove(%q)\n",
+			time.Now().Format("15:04:05.000000000"), name)
+	}
+	if !w.poll.remove(name) {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	return nil
+}
+
+func (w *sshWatcher) WatchList() []string {
+	if w.isClosed() {
+		return nil
+	}
+	return w.poll.list()
+}
+
+func (w *sshWatcher) Stats() Stats {
+	if w.isClosed() {
+		return Stats{}
+	}
+	n := len(w.poll.list())
+	return Stats{Watches: n, Polled: n}
+}
+
+func (w *sshWatcher) name() string { return "ssh" }
+
+func (w *sshWatcher) xSupports(op Op) bool { return op&^pollOps == 0 }
+
+// stat gets the state of path and the entries in it from the remote system.
+func (w *sshWatcher) stat(path string) (os.FileInfo, map[string]os.FileInfo, error) {
+	w.statMu.Lock()
+	defer w.statMu.Unlock()
+
+	if _, err := fmt.Fprintf(w.stdin, "%x\n", path); err != nil {
+		return nil, nil, fmt.Errorf("fsnotify: ssh %s: %w", w.dest, err)
+	}
+
+	var (
+		info  os.FileInfo
+		files map[string]os.FileInfo
+		rerr  error
+	)
+	for {
+		line, err := w.stdout.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("connection closed")
+			}
+			return nil, nil, fmt.Errorf("fsnotify: ssh %s: %w", w.dest, err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == ".":
+			if rerr != nil {
+				return nil, nil, rerr
+			}
+			if info == nil {
+				return nil, nil, fmt.Errorf("fsnotify: ssh %s: no reply for %q", w.dest, path)
+			}
+			return info, files, nil
+		case line == "E ENOENT":
+			rerr = &os.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+		case strings.HasPrefix(line, "E "):
+			rerr = &os.PathError{Op: "stat", Path: path, Err: errors.New(line[2:])}
+		case strings.HasPrefix(line, "F "):
+			fi, err := parseSSHStat(line[2:])
+			if err != nil {
+				return nil, nil, fmt.Errorf("fsnotify: ssh %s: %w", w.dest, err)
+			}
+			if fi.name == "" {
+				info = fi
+				if fi.IsDir() {
+					files = make(map[string]os.FileInfo)
+				}
+			} else if files != nil {
+				files[fi.name] = fi
+			}
+		}
+	}
+}
+
+// sshFileInfo is an os.FileInfo for a remote file.
+type sshFileInfo struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+}
+
+func (f *sshFileInfo) Name() string       { return f.name }
+func (f *sshFileInfo) Size() int64        { return f.size }
+func (f *sshFileInfo) Mode() os.FileMode  { return f.mode }
+func (f *sshFileInfo) ModTime() time.Time { return f.mtime }
+func (f *sshFileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f *sshFileInfo) Sys() interface{}   { return nil }
+
+// parseSSHStat parses "<st_mode> <st_size> <st_mtime> <hex name>"; the name is
+// "-" for the path itself, which is returned with an empty name.
+func parseSSHStat(s string) (*sshFileInfo, error) {
+	f := strings.Fields(s)
+	if len(f) != 4 {
+		return nil, fmt.Errorf("invalid reply: %q", s)
+	}
+	mode, err1 := strconv.ParseUint(f[0], 10, 32)
+	size, err2 := strconv.ParseInt(f[1], 10, 64)
+	mtime, err3 := strconv.ParseFloat(f[2], 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, fmt.Errorf("invalid reply: %q", s)
+	}
+
+	fi := &sshFileInfo{
+		size:  size,
+		mode:  unixMode(uint32(mode)),
+		mtime: time.Unix(0, int64(mtime*1e9)),
+	}
+	if f[3] != "-" {
+		name, err := hex.DecodeString(f[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid reply: %q", s)
+		}
+		fi.name = string(name)
+	}
+	return fi, nil
+}
+
+// unixMode converts a Unix st_mode to an os.FileMode.
+func unixMode(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0o777)
+	switch m & 0o170000 {
+	case 0o040000:
+		mode |= os.ModeDir
+	case 0o120000:
+		mode |= os.ModeSymlink
+	case 0o010000:
+		mode |= os.ModeNamedPipe
+	case 0o140000:
+		mode |= os.ModeSocket
+	case 0o020000:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case 0o060000:
+		mode |= os.ModeDevice
+	}
+	if m&0o4000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&0o2000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&0o1000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
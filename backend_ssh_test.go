@@ -0,0 +1,71 @@
+package fsnotify
+
+import (
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Runs the agent locally rather than over ssh; the tests using this can't be
+// parallel.
+func localSSH(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("no Windows support")
+	}
+	if _, err := exec.LookPath("perl"); err != nil {
+		t.Skip("needs perl")
+	}
+	orig := sshCommand
+	t.Cleanup(func() { sshCommand = orig })
+	sshCommand = func(dest, script string) *exec.Cmd { return exec.Command("perl", "-e", script) }
+}
+
+func TestSSH(t *testing.T) {
+	localSSH(t)
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file")
+	touch(t, tmp, "rm")
+	mkdir(t, tmp, "dir")
+
+	w, err := NewWatcherWith(WithSSH("localhost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.b.(*sshWatcher).poll.interval = 20 * time.Millisecond
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	addWatch(t, w, tmp)
+
+	if err := w.Add(join(tmp, "nonexistent")); err == nil {
+		t.Error("no error for nonexistent path")
+	}
+	if have := w.WatchList(); len(have) != 1 {
+		t.Errorf("WatchList: %s", have)
+	}
+
+	touch(t, tmp, "new")
+	echoAppend(t, "data", tmp, "file")
+	chmod(t, 0o700, tmp, "file")
+	rm(t, tmp, "rm")
+	touch(t, tmp, "dir", "not-watched")
+	time.Sleep(100 * time.Millisecond)
+
+	cmpEvents(t, tmp, c.stop(t), newEvents(t, `
+		create  /new
+		write   /file
+		chmod   /file
+		remove  /rm
+	`))
+}
+
+func TestSSHError(t *testing.T) {
+	localSSH(t)
+	sshCommand = func(dest, script string) *exec.Cmd { return exec.Command("false") }
+
+	if _, err := NewWatcherWith(WithSSH("localhost")); err == nil {
+		t.Fatal("no error")
+	}
+}
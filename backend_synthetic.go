@@ -0,0 +1,415 @@
+// Synthetic backend, used with WithSyntheticLoad().
+//
+// This doesn't look at the filesystem at all: it generates events for the
+// added paths at the configured rate, to benchmark the code that reads them.
+
+package fsnotify
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SyntheticLoad describes the events generated with [WithSyntheticLoad]. All
+// fields are optional.
+type SyntheticLoad struct {
+	// Number of events per second. If 0, events are sent as fast as they're
+	// read.
+	Rate float64
+
+	// Send events in bursts of this many events at once, at the same average
+	// Rate. The default is 1.
+	Burst int
+
+	// Number of distinct files below every added path. The default is 1000.
+	Files int
+
+	// Number of directory levels between the added path and the files, with
+	// up to 10 directories per level. The default is 0: all files are directly
+	// below the added path.
+	Depth int
+
+	// Distribution of the events over the files. 0 picks every file with the
+	// same probability; values above 1 use a Zipf distribution with this
+	// exponent, so a few files get most of the events (e.g. 1.1 for mild skew,
+	// 2 for a handful of hot files).
+	Skew float64
+
+	// The relative weight of every operation, for example {Write: 8, Create:
+	// 1, Remove: 1} (which is the default). Only Create, Write, Remove, Rename,
+	// and Chmod are used. Operations a path wasn't added for aren't sent for
+	// that path.
+	Ops map[Op]int
+
+	// Stop after this many events. The Events channel stays open until the
+	// Watcher is closed. 0 means no limit.
+	Count int
+
+	// Seed for the random generator: the same Seed generates the same events
+	// for the same paths. Every event is derived from the Seed, its position,
+	// and the paths that are watched when it's sent, so this doesn't depend on
+	// how fast the paths are added, as long as that's done before reading
+	// events. 0 uses a random seed.
+	Seed int64
+}
+
+var syntheticOps = []Op{Create, Write, Remove, Rename, Chmod}
+
+type synthetic struct {
+	Events chan Event
+	Errors chan error
+
+	load  SyntheticLoad
+	clock Clock
+	src   splitMix // Reset for every event by next().
+	rnd   *rand.Rand
+	zipf  *rand.Zipf
+
+	done     chan struct{}
+	doneMu   sync.Mutex
+	doneResp chan struct{}
+
+	mu      sync.Mutex
+	watches map[string]Op
+	paths   []string // Keys of watches, sorted so Seed is reproducible.
+
+	// Changes to watches are sent to run(), which closes the channel once
+	// the event it's about to send is generated again for the new watches.
+	wake chan chan struct{}
+}
+
+func newSynthetic(load SyntheticLoad, clock Clock, ev chan Event, errs chan error) (backend, error) {
+	if load.Rate < 0 || load.Burst < 0 || load.Files < 0 || load.Depth < 0 || load.Count < 0 {
+		return nil, fmt.Errorf("fsnotify: invalid SyntheticLoad: negative value")
+	}
+	for _, n := range load.Ops {
+		if n < 0 {
+			return nil, fmt.Errorf("fsnotify: invalid SyntheticLoad: negative value")
+		}
+	}
+	if load.Skew != 0 && load.Skew <= 1 {
+		return nil, fmt.Errorf("fsnotify: invalid SyntheticLoad: Skew must be 0 or above 1, not %g", load.Skew)
+	}
+	if load.Burst == 0 {
+		load.Burst = 1
+	}
+	if load.Files == 0 {
+		load.Files = 1000
+	}
+	if len(load.Ops) == 0 {
+		load.Ops = map[Op]int{Write: 8, Create: 1, Remove: 1}
+	}
+	if load.Seed == 0 {
+		load.Seed = time.Now().UnixNano()
+	}
+
+	w := &synthetic{
+		Events:   ev,
+		Errors:   errs,
+		load:     load,
+		clock:    clock,
+		done:     make(chan struct{}),
+		doneResp: make(chan struct{}),
+		watches:  make(map[string]Op),
+		wake:     make(chan chan struct{}),
+	}
+	w.rnd = rand.New(&w.src)
+	if load.Skew > 1 {
+		w.zipf = rand.NewZipf(w.rnd, load.Skew, 1, uint64(load.Files-1))
+	}
+	go w.run()
+	return w, nil
+}
+
+// sendEvent sends the event at index, generating it again if the watches
+// change while it's waiting to be read.
+//
+// sent is false if there are no paths to send the event for anymore, and open
+// is false if the watcher is closed.
+func (w *synthetic) sendEvent(e Event, index int) (sent, open bool) {
+	for {
+		select {
+		case <-w.done:
+			return false, false
+		case w.Events <- e:
+			return true, true
+		case ack := <-w.wake:
+			var ok bool
+			e, ok = w.next(index)
+			close(ack)
+			if !ok {
+				return false, true
+			}
+		}
+	}
+}
+
+// wait for c, or for the watches to change if c is nil. Returns false if the
+// watcher is closed.
+func (w *synthetic) wait(c <-chan time.Time) bool {
+	for {
+		select {
+		case <-w.done:
+			return false
+		case <-c:
+			return true
+		case ack := <-w.wake:
+			close(ack)
+			if c == nil {
+				return true
+			}
+		}
+	}
+}
+
+// changed tells run() the watches changed, and waits until it has seen it.
+func (w *synthetic) changed() {
+	ack := make(chan struct{})
+	select {
+	case <-w.done:
+	case w.wake <- ack:
+		<-ack
+	}
+}
+
+func (w *synthetic) isClosed() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *synthetic) Close() error {
+	w.doneMu.Lock()
+	if w.isClosed() {
+		w.doneMu.Unlock()
+		return nil
+	}
+	close(w.done)
+	w.doneMu.Unlock()
+
+	<-w.doneResp
+	return nil
+}
+
+func (w *synthetic) Add(name string) error { return w.AddWith(name) }
+
+func (w *synthetic) AddWith(name string, opts ...addOpt) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  AddWith(%q)\n",
+			time.Now().Format("15:04:05.000000000"), name)
+	}
+
+	with := getOptions(opts...)
+	if !w.xSupports(with.op) {
+		return fmt.Errorf("%w: %s", xErrUnsupported, with.op)
+	}
+
+	name = filepath.Clean(name)
+	w.mu.Lock()
+	if _, ok := w.watches[name]; !ok {
+		w.paths = append(w.paths, name)
+		sort.Strings(w.paths)
+	}
+	w.watches[name] |= with.op
+	w.mu.Unlock()
+	w.changed()
+	return nil
+}
+
+func (w *synthetic) removeOps(name string, op Op) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+
+	name = filepath.Clean(name)
+	w.mu.Lock()
+	prev, ok := w.watches[name]
+	if !ok {
+		w.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	if prev&^op == 0 {
+		w.mu.Unlock()
+		return errAllOps(name)
+	}
+	w.watches[name] = prev &^ op
+	w.mu.Unlock()
+	w.changed()
+	return nil
+}
+
+func (w *synthetic) Remove(name string) error {
+	if w.isClosed() {
+		return nil
+	}
+
+	name = filepath.Clean(name)
+	w.mu.Lock()
+	if _, ok := w.watches[name]; !ok {
+		w.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	delete(w.watches, name)
+	i := sort.SearchStrings(w.paths, name)
+	w.paths = append(w.paths[:i], w.paths[i+1:]...)
+	w.mu.Unlock()
+	w.changed()
+	return nil
+}
+
+func (w *synthetic) WatchList() []string {
+	if w.isClosed() {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	entries := make([]string, 0, len(w.watches))
+	for p := range w.watches {
+		entries = append(entries, p)
+	}
+	return entries
+}
+
+func (w *synthetic) Stats() Stats {
+	if w.isClosed() {
+		return Stats{}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return Stats{Watches: len(w.watches)}
+}
+
+func (w *synthetic) name() string { return "synthetic" }
+
+func (w *synthetic) xSupports(op Op) bool { return op&^(Create|Write|Remove|Rename|Chmod) == 0 }
+
+func (w *synthetic) run() {
+	defer func() {
+		close(w.doneResp)
+		close(w.Errors)
+		close(w.Events)
+	}()
+
+	var (
+		start = w.clock.Now()
+		sent  int // Since start.
+		total int
+	)
+	for w.load.Count == 0 || total < w.load.Count {
+		if w.load.Rate > 0 {
+			at := start.Add(time.Duration(float64(sent) / w.load.Rate * float64(time.Second)))
+			if d := at.Sub(w.clock.Now()); d > 0 {
+				t := w.clock.NewTimer(d)
+				if !w.wait(t.C()) {
+					t.Stop()
+					return
+				}
+			}
+		}
+
+		for i := 0; i < w.load.Burst && (w.load.Count == 0 || total < w.load.Count); i++ {
+			e, ok := w.next(total)
+			if ok {
+				var open bool
+				ok, open = w.sendEvent(e, total)
+				if !open {
+					return
+				}
+			}
+			if !ok {
+				// Nothing to send events for; wait for Add() and start over,
+				// rather than sending a burst to catch up.
+				if !w.wait(nil) {
+					return
+				}
+				start, sent = w.clock.Now(), 0
+				break
+			}
+			sent++
+			total++
+		}
+	}
+	for w.wait(nil) {
+	}
+}
+
+// next generates the event at index. Returns false if there are no paths to
+// send events for.
+func (w *synthetic) next(index int) (Event, bool) {
+	w.src.Seed(w.load.Seed ^ int64(uint64(index+1)*0xd1b54a32d192ed03))
+
+	w.mu.Lock()
+	paths := make([]string, 0, len(w.paths))
+	for _, p := range w.paths {
+		for _, o := range syntheticOps {
+			if w.watches[p].Has(o) && w.load.Ops[o] > 0 {
+				paths = append(paths, p)
+				break
+			}
+		}
+	}
+	if len(paths) == 0 {
+		w.mu.Unlock()
+		return Event{}, false
+	}
+	path := paths[w.rnd.Intn(len(paths))]
+	watchOp := w.watches[path]
+	w.mu.Unlock()
+
+	var sum int
+	for _, o := range syntheticOps {
+		if watchOp.Has(o) && w.load.Ops[o] > 0 {
+			sum += w.load.Ops[o]
+		}
+	}
+	var op Op
+	n := w.rnd.Intn(sum)
+	for _, o := range syntheticOps {
+		if watchOp.Has(o) && w.load.Ops[o] > 0 {
+			if n < w.load.Ops[o] {
+				op = o
+				break
+			}
+			n -= w.load.Ops[o]
+		}
+	}
+
+	var file int
+	if w.zipf != nil {
+		file = int(w.zipf.Uint64())
+	} else {
+		file = w.rnd.Intn(w.load.Files)
+	}
+	name := path
+	for l, n := 0, file; l < w.load.Depth; l, n = l+1, n/10 {
+		name = filepath.Join(name, "dir"+strconv.Itoa(n%10))
+	}
+	return Event{Name: filepath.Join(name, "file"+strconv.Itoa(file)), Op: op}, true
+}
+
+// splitMix is a splitmix64 rand.Source64; unlike the default source, it's
+// cheap to seed again for every event.
+type splitMix struct{ s uint64 }
+
+func (r *splitMix) Seed(seed int64) { r.s = uint64(seed) }
+func (r *splitMix) Int63() int64    { return int64(r.Uint64() >> 1) }
+
+func (r *splitMix) Uint64() uint64 {
+	r.s += 0x9e3779b97f4a7c15
+	z := r.s
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31
+}
@@ -0,0 +1,104 @@
+package fsnotify
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyntheticLoad(t *testing.T) {
+	t.Parallel()
+
+	load := SyntheticLoad{Files: 50, Depth: 2, Count: 100, Seed: 42,
+		Ops: map[Op]int{Create: 1, Write: 3, Chmod: 1}}
+	read := func(t *testing.T) []string {
+		w, err := NewWatcherWith(WithSyntheticLoad(load))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		if err := w.AddWith("/a", WithOps(Write)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Add("/b"); err != nil {
+			t.Fatal(err)
+		}
+
+		var have []string
+		for len(have) < load.Count {
+			select {
+			case e := <-w.Events:
+				have = append(have, e.String())
+				dir, file := filepath.Split(e.Name)
+				if !strings.HasPrefix(file, "file") || strings.Count(filepath.ToSlash(dir), "/") != 4 {
+					t.Errorf("wrong name: %s", e.Name)
+				}
+				switch {
+				case strings.HasPrefix(e.Name, filepath.FromSlash("/a/")):
+					if e.Op != Write {
+						t.Errorf("wrong op for /a: %s", e)
+					}
+				case strings.HasPrefix(e.Name, filepath.FromSlash("/b/")):
+					if e.Op != Create && e.Op != Write && e.Op != Chmod {
+						t.Errorf("wrong op for /b: %s", e)
+					}
+				default:
+					t.Errorf("event for path that wasn't added: %s", e)
+				}
+			case err := <-w.Errors:
+				t.Fatal(err)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout after %d events", len(have))
+			}
+		}
+		select {
+		case e := <-w.Events:
+			t.Errorf("event after Count: %s", e)
+		case <-time.After(50 * time.Millisecond):
+		}
+		return have
+	}
+
+	first, second := read(t), read(t)
+	if strings.Join(first, "\n") != strings.Join(second, "\n") {
+		t.Error("different events with the same Seed")
+	}
+}
+
+func TestSyntheticLoadRate(t *testing.T) {
+	t.Parallel()
+
+	w, err := NewWatcherWith(WithSyntheticLoad(SyntheticLoad{Rate: 500, Burst: 5, Count: 50}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	start := time.Now()
+	addWatch(t, w, "/dir")
+	for i := 0; i < 50; i++ {
+		<-w.Events
+	}
+	// 50 events at 500/s in bursts of 5: the last burst is sent after 90ms.
+	if took := time.Since(start); took < 80*time.Millisecond {
+		t.Errorf("too fast: %s", took)
+	}
+}
+
+func TestSyntheticLoadInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, load := range []SyntheticLoad{
+		{Rate: -1},
+		{Skew: 0.5},
+		{Ops: map[Op]int{Write: -1}},
+	} {
+		if w, err := NewWatcherWith(WithSyntheticLoad(load)); err == nil {
+			w.Close()
+			t.Errorf("no error for %+v", load)
+		}
+	}
+	if _, err := NewWatcherWith(WithSyntheticLoad(SyntheticLoad{}), WithPersist()); err == nil {
+		t.Error("no error for WithPersist")
+	}
+}
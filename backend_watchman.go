@@ -0,0 +1,425 @@
+// Watchman backend, used with WithWatchman().
+//
+// This talks to an existing Watchman daemon over its local socket with the JSON
+// protocol: every added path is a subscription on the project root Watchman
+// picks for it, and the files in the subscription results are converted to
+// events.
+//
+// See https://facebook.github.io/watchman/docs/socket-interface
+
+package fsnotify
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type watchman struct {
+	Events chan Event
+	Errors chan error
+
+	conn     net.Conn
+	done     chan struct{}
+	doneMu   sync.Mutex
+	doneResp chan struct{}
+	replies  chan watchmanPDU // Replies to commands (not unilateral).
+
+	cmdMu sync.Mutex // Only one command can be in flight.
+
+	mu      sync.Mutex
+	nextID  int
+	watches map[string]*watchmanWatch // Key is the absolute path.
+	subs    map[string]*watchmanWatch // Key is the subscription name.
+}
+
+type (
+	watchmanWatch struct {
+		path    string // Path as passed to Add().
+		root    string // Watchman project root.
+		rel     string // Relative path of the watched directory in root.
+		name    string // Only send events for this filename; for watching files.
+		sub     string // Subscription name.
+		recurse bool
+	}
+	watchmanPDU struct {
+		Error            string          `json:"error"`
+		Unilateral       bool            `json:"unilateral"`
+		Subscription     string          `json:"subscription"`
+		Watch            string          `json:"watch"`
+		RelativePath     string          `json:"relative_path"`
+		IsFreshInstance  bool            `json:"is_fresh_instance"`
+		Canceled         bool            `json:"canceled"`
+		Files            []watchmanFile  `json:"files"`
+		Sockname         string          `json:"sockname"`
+		Log              json.RawMessage `json:"log"`
+		StateEnter       json.RawMessage `json:"state-enter"`
+		StateLeave       json.RawMessage `json:"state-leave"`
+		SubscriptionName json.RawMessage `json:"subscribe"`
+	}
+	watchmanFile struct {
+		Name   string `json:"name"`
+		Exists bool   `json:"exists"`
+		New    bool   `json:"new"`
+	}
+)
+
+// watchmanSockname finds the socket for the Watchman daemon: $WATCHMAN_SOCK if
+// set, or else from "watchman get-sockname" (which also starts the daemon if
+// needed).
+func watchmanSockname() (string, error) {
+	if s := os.Getenv("WATCHMAN_SOCK"); s != "" {
+		return s, nil
+	}
+	out, err := exec.Command("watchman", "--output-encoding=json", "--no-pretty", "get-sockname").Output()
+	if err != nil {
+		return "", fmt.Errorf("fsnotify: finding Watchman socket: %w", err)
+	}
+	var pdu watchmanPDU
+	if err := json.Unmarshal(out, &pdu); err != nil {
+		return "", fmt.Errorf("fsnotify: finding Watchman socket: %w", err)
+	}
+	if pdu.Error != "" {
+		return "", fmt.Errorf("fsnotify: finding Watchman socket: %s", pdu.Error)
+	}
+	return pdu.Sockname, nil
+}
+
+func newWatchman(sockname string, ev chan Event, errs chan error) (backend, error) {
+	if sockname == "" {
+		var err error
+		sockname, err = watchmanSockname()
+		if err != nil {
+			return nil, err
+		}
+	}
+	conn, err := net.Dial("unix", sockname)
+	if err != nil {
+		return nil, fmt.Errorf("fsnotify: connecting to Watchman: %w", err)
+	}
+
+	w := &watchman{
+		Events:   ev,
+		Errors:   errs,
+		conn:     conn,
+		done:     make(chan struct{}),
+		doneResp: make(chan struct{}),
+		replies:  make(chan watchmanPDU),
+		watches:  make(map[string]*watchmanWatch),
+		subs:     make(map[string]*watchmanWatch),
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+// Returns true if the event was sent, or false if watcher is closed.
+func (w *watchman) sendEvent(e Event) bool {
+	select {
+	case <-w.done:
+		return false
+	case w.Events <- e:
+		return true
+	}
+}
+
+// Returns true if the error was sent, or false if watcher is closed.
+func (w *watchman) sendError(err error) bool {
+	if err == nil {
+		return true
+	}
+	err = wrapError(w, "watch", "", err)
+	select {
+	case <-w.done:
+		return false
+	case w.Errors <- err:
+		return true
+	}
+}
+
+func (w *watchman) isClosed() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *watchman) Close() error {
+	w.doneMu.Lock()
+	if w.isClosed() {
+		w.doneMu.Unlock()
+		return nil
+	}
+	close(w.done)
+	w.doneMu.Unlock()
+
+	// Subscriptions are tied to the connection, so there's no need to
+	// unsubscribe.
+	err := w.conn.Close()
+	<-w.doneResp
+
+	w.mu.Lock()
+	w.watches, w.subs = nil, nil
+	w.mu.Unlock()
+	return err
+}
+
+// command sends a command and waits for the reply.
+func (w *watchman) command(args ...interface{}) (watchmanPDU, error) {
+	w.cmdMu.Lock()
+	defer w.cmdMu.Unlock()
+
+	b, err := json.Marshal(args)
+	if err != nil {
+		return watchmanPDU{}, err
+	}
+	if _, err := w.conn.Write(append(b, '\n')); err != nil {
+		return watchmanPDU{}, fmt.Errorf("fsnotify: writing to Watchman: %w", err)
+	}
+	select {
+	case <-w.done:
+		return watchmanPDU{}, ErrClosed
+	case pdu, ok := <-w.replies:
+		if !ok {
+			return watchmanPDU{}, ErrClosed
+		}
+		if pdu.Error != "" {
+			return pdu, fmt.Errorf("fsnotify: Watchman: %s", pdu.Error)
+		}
+		return pdu, nil
+	}
+}
+
+func (w *watchman) Add(name string) error { return w.AddWith(name) }
+
+func (w *watchman) AddWith(path string, opts ...addOpt) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  AddWith(%q)\n",
+			time.Now().Format("15:04:05.000000000"), path)
+	}
+
+	with := getOptions(opts...)
+	if !w.xSupports(with.op) {
+		return fmt.Errorf("%w: %s", xErrUnsupported, with.op)
+	}
+
+	path, recurse := recursivePath(path)
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	_, ok := w.watches[abs]
+	w.mu.Unlock()
+	if ok {
+		return nil
+	}
+
+	watch := &watchmanWatch{path: path, recurse: recurse}
+	dir := abs
+	if !fi.IsDir() {
+		dir, watch.name = filepath.Dir(abs), filepath.Base(abs)
+	}
+	pdu, err := w.command("watch-project", dir)
+	if err != nil {
+		return err
+	}
+	watch.root, watch.rel = pdu.Watch, filepath.ToSlash(pdu.RelativePath)
+
+	w.mu.Lock()
+	w.nextID++
+	watch.sub = fmt.Sprintf("fsnotify-%d-%d", os.Getpid(), w.nextID)
+	w.subs[watch.sub] = watch
+	w.mu.Unlock()
+
+	query := map[string]interface{}{
+		"fields":                  []string{"name", "exists", "new"},
+		"empty_on_fresh_instance": true,
+	}
+	if watch.rel != "" {
+		query["relative_root"] = watch.rel
+	}
+	if watch.name != "" {
+		query["expression"] = []interface{}{"name", watch.name}
+	}
+	if _, err := w.command("subscribe", watch.root, watch.sub, query); err != nil {
+		w.mu.Lock()
+		delete(w.subs, watch.sub)
+		w.mu.Unlock()
+		return err
+	}
+
+	w.mu.Lock()
+	w.watches[abs] = watch
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *watchman) Remove(name string) error {
+	if w.isClosed() {
+		return nil
+	}
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  Remove(%q)\n",
+			time.Now().Format("15:04:05.000000000"), name)
+	}
+
+	name, _ = recursivePath(name)
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	watch, ok := w.watches[abs]
+	if ok {
+		delete(w.watches, abs)
+		delete(w.subs, watch.sub)
+	}
+	w.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	_, err = w.command("unsubscribe", watch.root, watch.sub)
+	return err
+}
+
+func (w *watchman) WatchList() []string {
+	if w.isClosed() {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	entries := make([]string, 0, len(w.watches))
+	for _, watch := range w.watches {
+		entries = append(entries, watch.path)
+	}
+	return entries
+}
+
+func (w *watchman) Stats() Stats {
+	if w.isClosed() {
+		return Stats{}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return Stats{Watches: len(w.subs)}
+}
+
+func (w *watchman) name() string { return "watchman" }
+
+func (w *watchman) xSupports(op Op) bool {
+	return !(op.Has(xUnportableOpen) || op.Has(xUnportableRead) ||
+		op.Has(UnportableCloseWrite) || op.Has(xUnportableCloseRead) || op.Has(UnportableSecurity) ||
+		op.Has(UnportableExtend) || op.Has(UnportableTruncate) || op.Has(UnportableMount) ||
+		op.Has(UnportableUnmount) || op.Has(UnportableMode) || op.Has(UnportableOwner) ||
+		op.Has(UnportableTimes) || op.Has(UnportableXattr) || op.Has(UnportableACL) ||
+		op.Has(UnportableLink) || op.Has(UnportableUnlink) || op.Has(UnportableClone))
+}
+
+func (w *watchman) readEvents() {
+	defer func() {
+		close(w.doneResp)
+		close(w.replies)
+		close(w.Errors)
+		close(w.Events)
+	}()
+
+	dec := json.NewDecoder(bufio.NewReader(w.conn))
+	for {
+		var pdu watchmanPDU
+		err := dec.Decode(&pdu)
+		if w.isClosed() {
+			return
+		}
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			w.sendError(fmt.Errorf("fsnotify: reading from Watchman: %w", err))
+			return
+		}
+
+		switch {
+		case pdu.Subscription != "" && pdu.SubscriptionName == nil:
+			if !w.handleSubscription(pdu) {
+				return
+			}
+		case pdu.Unilateral || pdu.Log != nil || pdu.StateEnter != nil || pdu.StateLeave != nil:
+			// Ignore.
+		default:
+			select {
+			case <-w.done:
+				return
+			case w.replies <- pdu:
+			}
+		}
+	}
+}
+
+// handleSubscription sends the events for a subscription result.
+//
+// Returns false if the watcher was closed.
+func (w *watchman) handleSubscription(pdu watchmanPDU) bool {
+	w.mu.Lock()
+	watch, ok := w.subs[pdu.Subscription]
+	w.mu.Unlock()
+	if !ok || pdu.IsFreshInstance {
+		// Watchman restarted or the results were recrawled, so we can't know
+		// what changed.
+		if ok && len(pdu.Files) > 0 {
+			return w.sendError(fmt.Errorf("%w: Watchman recrawled %s", ErrEventOverflow, watch.path))
+		}
+		return true
+	}
+	if pdu.Canceled {
+		w.mu.Lock()
+		for k, ww := range w.watches {
+			if ww == watch {
+				delete(w.watches, k)
+			}
+		}
+		delete(w.subs, watch.sub)
+		w.mu.Unlock()
+		return w.sendError(fmt.Errorf("fsnotify: Watchman canceled the subscription for %s", watch.path))
+	}
+
+	for _, f := range pdu.Files {
+		if !watch.recurse && watch.name == "" && strings.Contains(f.Name, "/") {
+			continue
+		}
+		e := Event{Op: Write}
+		switch {
+		case !f.Exists:
+			e.Op = Remove
+		case f.New:
+			e.Op = Create
+		}
+		if watch.name != "" {
+			e.Name = watch.path
+		} else {
+			e.Name = filepath.Join(watch.path, filepath.FromSlash(f.Name))
+		}
+		if !w.sendEvent(e) {
+			return false
+		}
+	}
+	return true
+}
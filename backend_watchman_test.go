@@ -0,0 +1,89 @@
+package fsnotify
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+// fakeWatchman is a minimal Watchman server, which replies to watch-project
+// and subscribe, and sends the results written to files for every
+// subscription.
+func fakeWatchman(t *testing.T, root string, files [][]watchmanFile) string {
+	t.Helper()
+
+	sock := join(t.TempDir(), "sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("no unix sockets: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		enc := json.NewEncoder(conn)
+		scan := bufio.NewScanner(conn)
+		for scan.Scan() {
+			var cmd []json.RawMessage
+			if err := json.Unmarshal(scan.Bytes(), &cmd); err != nil {
+				t.Error(err)
+				return
+			}
+			var name string
+			json.Unmarshal(cmd[0], &name)
+			switch name {
+			case "watch-project":
+				enc.Encode(map[string]interface{}{"watch": root, "relative_path": "dir"})
+			case "subscribe":
+				var sub string
+				json.Unmarshal(cmd[2], &sub)
+				enc.Encode(map[string]interface{}{"subscribe": sub})
+				enc.Encode(map[string]interface{}{"subscription": sub, "is_fresh_instance": true, "unilateral": true})
+				for _, f := range files {
+					enc.Encode(map[string]interface{}{"subscription": sub, "files": f, "unilateral": true})
+				}
+			case "unsubscribe":
+				enc.Encode(map[string]interface{}{"unsubscribe": "x"})
+			default:
+				enc.Encode(map[string]interface{}{"error": "unknown command " + name})
+			}
+		}
+	}()
+	return sock
+}
+
+func TestWatchman(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	sock := fakeWatchman(t, tmp, [][]watchmanFile{
+		{{Name: "new", Exists: true, New: true}},
+		{{Name: "file", Exists: true}, {Name: "sub/file", Exists: true}},
+		{{Name: "new", Exists: false}},
+	})
+
+	w, err := NewWatcherWith(WithWatchman(sock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	addWatch(t, w, tmp, "dir")
+
+	if have := w.WatchList(); len(have) != 1 {
+		t.Errorf("WatchList: %s", have)
+	}
+
+	cmpEvents(t, tmp, c.stop(t), newEvents(t, `
+		create  /dir/new
+		write   /dir/file
+		remove  /dir/new
+	`))
+}
@@ -9,12 +9,14 @@ package fsnotify
 import (
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 	"unsafe"
 
@@ -26,33 +28,68 @@ type readDirChangesW struct {
 	Events chan Event
 	Errors chan error
 
-	port  windows.Handle // Handle to completion port
-	input chan *input    // Inputs to the reader are sent on this channel
-	quit  chan chan<- error
-
-	mu      sync.Mutex // Protects access to watches, closed
+	port      windows.Handle // Handle to completion port
+	input     chan *input    // Inputs to the reader are sent on this channel
+	inputMu   sync.Mutex     // Only process one input at a time
+	quit      chan chan<- error
+	done      chan struct{}  // Closed when Close() is first called
+	workers   sync.WaitGroup // I/O threads reading from the completion port
+	volume    bool           // WithWholeVolume()
+	longNames bool           // WithLongNames()
+	raw       func(RawEvent) // WithRawEvents()
+
+	// Files removed from a watched directory, which are sent as Rename
+	// rather than Remove if the same file ID is added to another watched
+	// directory: Windows sends moves between directories as REMOVED and
+	// ADDED in the watch for each directory, rather than as RENAMED_OLD_NAME
+	// and RENAMED_NEW_NAME.
+	//
+	// The Remove is sent after movedDelay if the file ID isn't added.
+	moved   []movedFile
+	movedMu sync.Mutex
+
+	mu      sync.Mutex // Protects access to watches, closed, and watch.path
 	watches watchMap   // Map of watches (key: i-number)
 	closed  bool       // Set to true when Close() is first called
+
+	devMu   sync.Mutex // Protects devHwnd
+	devHwnd uintptr    // Window for device notifications; created on first use
 }
 
 func newBackend(ev chan Event, errs chan error) (backend, error) {
-	return newBufferedBackend(50, ev, errs)
+	return newBufferedBackend(50, ev, errs, defaultWatcherOpts)
 }
 
-func newBufferedBackend(sz uint, ev chan Event, errs chan error) (backend, error) {
+func newBufferedBackend(sz uint, ev chan Event, errs chan error, with watcherOpts) (backend, error) {
+	if with.external {
+		return nil, fmt.Errorf("%w: WithExternalLoop", xErrUnsupported)
+	}
+	if with.audit {
+		return nil, fmt.Errorf("%w: WithAudit", xErrUnsupported)
+	}
+	if with.ebpf {
+		return nil, fmt.Errorf("%w: WithEBPF", xErrUnsupported)
+	}
 	port, err := windows.CreateIoCompletionPort(windows.InvalidHandle, 0, 0, 0)
 	if err != nil {
 		return nil, os.NewSyscallError("CreateIoCompletionPort", err)
 	}
 	w := &readDirChangesW{
-		Events:  ev,
-		Errors:  errs,
-		port:    port,
-		watches: make(watchMap),
-		input:   make(chan *input, 1),
-		quit:    make(chan chan<- error, 1),
-	}
-	go w.readEvents()
+		Events:    ev,
+		Errors:    errs,
+		port:      port,
+		watches:   make(watchMap),
+		input:     make(chan *input, 1),
+		quit:      make(chan chan<- error, 1),
+		done:      make(chan struct{}),
+		volume:    with.volume,
+		longNames: with.longNames,
+		raw:       with.raw,
+	}
+	for i := 0; i < with.workers; i++ {
+		w.workers.Add(1)
+		go w.readEvents()
+	}
 	return w, nil
 }
 
@@ -62,16 +99,16 @@ func (w *readDirChangesW) isClosed() bool {
 	return w.closed
 }
 
-func (w *readDirChangesW) sendEvent(name, renamedFrom string, mask uint64) bool {
+func (w *readDirChangesW) sendEvent(name, renamedFrom string, mask uint64, info *EventInfo) bool {
 	if mask == 0 {
 		return false
 	}
 
 	event := w.newEvent(name, uint32(mask))
-	event.renamedFrom = renamedFrom
+	event.RenamedFrom = renamedFrom
+	event.Info = info
 	select {
-	case ch := <-w.quit:
-		w.quit <- ch
+	case <-w.done:
 	case w.Events <- event:
 	}
 	return true
@@ -82,21 +119,23 @@ func (w *readDirChangesW) sendError(err error) bool {
 	if err == nil {
 		return true
 	}
+	err = wrapError(w, "watch", "", err)
 	select {
 	case w.Errors <- err:
 		return true
-	case <-w.quit:
+	case <-w.done:
 		return false
 	}
 }
 
 func (w *readDirChangesW) Close() error {
-	if w.isClosed() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
 		return nil
 	}
-
-	w.mu.Lock()
 	w.closed = true
+	close(w.done)
 	w.mu.Unlock()
 
 	// Send "quit" message to the reader goroutine
@@ -127,13 +166,29 @@ func (w *readDirChangesW) AddWith(name string, opts ...addOpt) error {
 		return fmt.Errorf("fsnotify.WithBufferSize: buffer size cannot be smaller than 4096 bytes")
 	}
 
+	flags := uint32(sysFSALLEVENTS)
+	if with.op.Has(UnportableSecurity) {
+		flags |= sysFSSECURITY
+	}
+	if with.op.Has(UnportableACL) {
+		flags |= sysFSACL
+	}
+	if with.op.Has(xUnportableRead) {
+		flags |= sysFSACCESS
+	}
+
 	in := &input{
 		op:      opAddWatch,
 		path:    filepath.Clean(name),
-		flags:   sysFSALLEVENTS,
+		flags:   flags,
 		reply:   make(chan error),
 		bufsize: with.bufsize,
 	}
+	return w.sendInput(in)
+}
+
+// sendInput sends the input to the reader goroutine and waits for the reply.
+func (w *readDirChangesW) sendInput(in *input) error {
 	w.input <- in
 	if err := w.wakeupReader(); err != nil {
 		return err
@@ -155,11 +210,61 @@ func (w *readDirChangesW) Remove(name string) error {
 		path:  filepath.Clean(name),
 		reply: make(chan error),
 	}
-	w.input <- in
-	if err := w.wakeupReader(); err != nil {
-		return err
+	return w.sendInput(in)
+}
+
+// removeOps stops sending the unportable ops in op. The portable ops are always
+// sent for this backend.
+func (w *readDirChangesW) removeOps(name string, op Op) error {
+	if w.isClosed() {
+		return ErrClosed
 	}
-	return <-in.reply
+	if debug {
+		fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  RemoveOps(%q, %s)\n",
+			time.Now().Format("15:04:05.000000000"), filepath.ToSlash(name), op)
+	}
+	if w.volume {
+		return fmt.Errorf("%w: RemoveOps with WithWholeVolume()", xErrUnsupported)
+	}
+	if op.Has(Create) && op.Has(Write) && op.Has(Remove) && op.Has(Rename) && op.Has(Chmod) {
+		return errAllOps(name)
+	}
+
+	var flags uint32
+	if op.Has(UnportableSecurity) {
+		flags |= sysFSSECURITY
+	}
+	if op.Has(UnportableACL) {
+		flags |= sysFSACL
+	}
+	if op.Has(xUnportableRead) {
+		flags |= sysFSACCESS
+	}
+	in := &input{
+		op:    opRemoveOps,
+		path:  filepath.Clean(name),
+		flags: flags,
+		reply: make(chan error),
+	}
+	return w.sendInput(in)
+}
+
+// setBufferSize changes the buffer size set with WithBufferSize(). The buffer
+// is resized after the next read, as it's in use by the pending read.
+func (w *readDirChangesW) setBufferSize(name string, bufsize int) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if bufsize < 4096 {
+		bufsize = 4096
+	}
+	in := &input{
+		op:      opSetBufferSize,
+		path:    filepath.Clean(name),
+		bufsize: bufsize,
+		reply:   make(chan error),
+	}
+	return w.sendInput(in)
 }
 
 func (w *readDirChangesW) WatchList() []string {
@@ -173,6 +278,12 @@ func (w *readDirChangesW) WatchList() []string {
 	entries := make([]string, 0, len(w.watches))
 	for _, entry := range w.watches {
 		for _, watchEntry := range entry {
+			if watchEntry.prefixes != nil {
+				for _, p := range watchEntry.prefixes {
+					entries = append(entries, p.path)
+				}
+				continue
+			}
 			for name := range watchEntry.names {
 				entries = append(entries, filepath.Join(watchEntry.path, name))
 			}
@@ -186,6 +297,91 @@ func (w *readDirChangesW) WatchList() []string {
 	return entries
 }
 
+func (w *readDirChangesW) watchInfo() []WatchInfo {
+	if w.isClosed() {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	l := make([]WatchInfo, 0, len(w.watches))
+	for _, entry := range w.watches {
+		for _, watch := range entry {
+			id := uint64(watch.ino.handle)
+			if watch.prefixes != nil {
+				for _, p := range watch.prefixes {
+					l = append(l, WatchInfo{Path: p.path, Op: w.newEvent("", uint32(p.flags)).Op, Recursive: p.recurse, ID: id})
+				}
+				continue
+			}
+			for name, flags := range watch.names {
+				l = append(l, WatchInfo{Path: filepath.Join(watch.path, name), Op: w.newEvent("", uint32(flags)).Op, ID: id})
+			}
+			if watch.mask != 0 {
+				l = append(l, WatchInfo{Path: watch.path, Op: w.newEvent("", uint32(watch.mask)).Op, Recursive: watch.recurse, ID: id})
+			}
+		}
+	}
+	return l
+}
+
+// verify checks if the directory handles for the watches are still valid, and
+// still refer to the same directory as the path.
+func (w *readDirChangesW) verify() map[string]error {
+	if w.isClosed() {
+		return nil
+	}
+
+	type check struct {
+		path string
+		ino  inode
+	}
+	w.mu.Lock()
+	checks := make([]check, 0, len(w.watches))
+	for _, entry := range w.watches {
+		for _, watch := range entry {
+			checks = append(checks, check{path: watch.path, ino: *watch.ino})
+		}
+	}
+	w.mu.Unlock()
+
+	failed := make(map[string]error)
+	for _, c := range checks {
+		var fi windows.ByHandleFileInformation
+		if err := windows.GetFileInformationByHandle(c.ino.handle, &fi); err != nil {
+			failed[c.path] = fmt.Errorf("%w: %s", ErrWatchDead, os.NewSyscallError("GetFileInformationByHandle", err))
+			continue
+		}
+		ino, err := w.getIno(c.path)
+		if err != nil {
+			failed[c.path] = fmt.Errorf("%w: %s", ErrWatchDead, err)
+			continue
+		}
+		windows.CloseHandle(ino.handle)
+		if ino.volume != c.ino.volume || ino.index != c.ino.index {
+			failed[c.path] = ErrWatchDiverged
+		}
+	}
+	return failed
+}
+
+func (w *readDirChangesW) Stats() Stats {
+	if w.isClosed() {
+		return Stats{}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := Stats{BufferSizes: make(map[string]int)}
+	for _, index := range w.watches {
+		for _, watch := range index {
+			s.Watches++
+			s.BufferSizes[watch.path] = watch.bufsize
+		}
+	}
+	return s
+}
+
 // These options are from the old golang.org/x/exp/winfsnotify, where you could
 // add various options to the watch. This has long since been removed.
 //
@@ -203,6 +399,10 @@ const (
 	sysFSMOVEDTO    = 0x80
 	sysFSMOVESELF   = 0x800
 	sysFSIGNORED    = 0x8000
+	sysFSSECURITY   = 0x1000
+	sysFSACCESS     = 0x2000
+	sysFSACL        = 0x4000
+	sysFSMOVETREE   = 0x10000
 )
 
 func (w *readDirChangesW) newEvent(name string, mask uint32) Event {
@@ -219,12 +419,41 @@ func (w *readDirChangesW) newEvent(name string, mask uint32) Event {
 	if mask&sysFSMOVE == sysFSMOVE || mask&sysFSMOVESELF == sysFSMOVESELF || mask&sysFSMOVEDFROM == sysFSMOVEDFROM {
 		e.Op |= Rename
 	}
+	if mask&sysFSSECURITY == sysFSSECURITY {
+		e.Op |= UnportableSecurity
+	}
+	if mask&sysFSACL == sysFSACL {
+		e.Op |= UnportableACL
+	}
+	if mask&sysFSACCESS == sysFSACCESS {
+		e.Op |= xUnportableRead
+	}
+	if mask&sysFSMOVETREE == sysFSMOVETREE {
+		e.Op |= Move
+	}
 	return e
 }
 
+// moveTree gets sysFSMOVETREE if path is a directory that was renamed in a
+// recursive watch; Windows already reports the new paths for everything in it,
+// so there's nothing to update.
+func moveTree(watch *watch, path string) uint64 {
+	if !watch.recurse {
+		return 0
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.IsDir() {
+		return sysFSMOVETREE
+	}
+	return 0
+}
+
 const (
 	opAddWatch = iota
 	opRemoveWatch
+	opDeviceRemove
+	opRemoveOps
+	opSetBufferSize
+	opResizeBuffer
 )
 
 const (
@@ -236,9 +465,118 @@ type input struct {
 	path    string
 	flags   uint32
 	bufsize int
+	handle  windows.Handle // For opDeviceRemove
 	reply   chan error
 }
 
+// How long to wait for the ADDED in another watch before sending a REMOVED as
+// Remove. Both are queued at the same time, so this doesn't need to be long.
+const movedDelay = 20 * time.Millisecond
+
+type movedFile struct {
+	watch  *watch
+	id     uint64
+	path   string
+	remove uint64 // Flags to send if it's not moved.
+	rename uint64 // Flags to send if it's moved.
+	info   *EventInfo
+	at     time.Time
+}
+
+// removed holds back the Remove for a removed file, to send it as Rename if
+// movedFrom() finds the same file ID in another watch. Returns false if the
+// event should be sent now: if there's no file ID, or only one watch.
+func (w *readDirChangesW) removed(watch *watch, info *EventInfo, path string) bool {
+	if info == nil || info.FileID == 0 {
+		return false
+	}
+	w.mu.Lock()
+	n := 0
+	for _, index := range w.watches {
+		n += len(index)
+	}
+	w.mu.Unlock()
+	if n < 2 {
+		return false
+	}
+
+	w.movedMu.Lock()
+	defer w.movedMu.Unlock()
+	w.moved = append(w.moved, movedFile{
+		watch:  watch,
+		id:     info.FileID,
+		path:   path,
+		remove: watch.mask & sysFSDELETE,
+		rename: watch.mask & sysFSMOVEDFROM,
+		info:   info,
+		at:     time.Now(),
+	})
+	return true
+}
+
+// movedFrom gets the path the file was removed from if the added file was
+// moved from another watched directory, and sends the Rename for the old path.
+func (w *readDirChangesW) movedFrom(volume uint32, info *EventInfo) string {
+	if info == nil || info.FileID == 0 {
+		return ""
+	}
+	w.movedMu.Lock()
+	var (
+		m  movedFile
+		ok bool
+	)
+	for i := range w.moved {
+		if w.moved[i].id == info.FileID && w.moved[i].watch.ino.volume == volume {
+			m, ok = w.moved[i], true
+			w.moved = append(w.moved[:i], w.moved[i+1:]...)
+			break
+		}
+	}
+	w.movedMu.Unlock()
+	if !ok {
+		return ""
+	}
+	w.sendEvent(m.path, "", m.rename, m.info)
+	return m.path
+}
+
+// flushMoved sends the Remove for files that weren't added to another watch
+// within movedDelay, and returns the timeout for GetQueuedCompletionStatus()
+// until the next one expires.
+//
+// If from is set the Remove for all files removed from that watch is sent, so
+// they're not sent after later events for the watch.
+func (w *readDirChangesW) flushMoved(from *watch) uint32 {
+	w.movedMu.Lock()
+	if len(w.moved) == 0 {
+		w.movedMu.Unlock()
+		return windows.INFINITE
+	}
+	var (
+		now     = time.Now()
+		expired []movedFile
+		timeout = uint32(windows.INFINITE)
+	)
+	keep := w.moved[:0]
+	for _, m := range w.moved {
+		if d := m.at.Add(movedDelay).Sub(now); d > 0 && m.watch != from {
+			keep = append(keep, m)
+			if ms := uint32(d/time.Millisecond) + 1; ms < timeout {
+				timeout = ms
+			}
+			continue
+		}
+		expired = append(expired, m)
+	}
+	w.moved = keep
+	w.movedMu.Unlock()
+
+	for _, m := range expired {
+		w.sendEvent(m.path, "", m.remove, m.info)
+	}
+	return timeout
+}
+
 type inode struct {
 	handle windows.Handle
 	volume uint32
@@ -246,14 +584,64 @@ type inode struct {
 }
 
 type watch struct {
-	ov      windows.Overlapped
-	ino     *inode            // i-number
-	recurse bool              // Recursive watch?
-	path    string            // Directory path
-	mask    uint64            // Directory itself is being watched with these notify flags
-	names   map[string]uint64 // Map of names being watched and their notify flags
-	rename  string            // Remembers the old name while renaming a file
-	buf     []byte            // buffer, allocated later
+	ov        windows.Overlapped
+	ino       *inode            // i-number
+	recurse   bool              // Recursive watch?
+	path      string            // Directory path
+	mask      uint64            // Directory itself is being watched with these notify flags
+	names     map[string]uint64 // Map of names being watched and their notify flags
+	rename    string            // Remembers the old name while renaming a file
+	renameID  uint64            // File ID of the old name while renaming, if known
+	buf       []byte            // buffer, allocated later
+	bufsize   int               // Current buffer size; only for Stats(), protected by readDirChangesW.mu
+	minBuf    int               // Buffer size set with WithBufferSize(); we never shrink below this
+	maxBuf    int               // Never grow the buffer larger than this
+	resize    int               // Switch to this buffer size once the cancelled read completes; for SetBufferSize()
+	overflow  time.Time         // Last time the buffer overflowed
+	ext       bool              // buf was filled by ReadDirectoryChangesExW
+	devNotify uintptr           // Device notification handle, if registered
+
+	// Paths added with Add() if this is the volume root watch for
+	// WithWholeVolume(); the key is the lower-cased absolute path.
+	prefixes map[string]volumePrefix
+
+	// Held while processing a read or changing the watch, as there may be
+	// more than one I/O thread.
+	ioMu sync.Mutex
+}
+
+// name gets the key in names for the file path: the existing key if it's
+// already watched with a different case, or the name as it's stored on disk,
+// so that it matches the names in events.
+func (w *watch) name(path string) string {
+	name := filepath.Base(path)
+	if _, ok := w.names[name]; ok {
+		return name
+	}
+	for n := range w.names {
+		if strings.EqualFold(n, name) {
+			return n
+		}
+	}
+	var d windows.Win32finddata
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return name
+	}
+	h, err := windows.FindFirstFile(p, &d)
+	if err != nil {
+		return name
+	}
+	windows.FindClose(h)
+	return windows.UTF16ToString(d.FileName[:])
+}
+
+// watchPath gets the path of the watch; this can be changed by renames
+// processed in another I/O thread.
+func (w *readDirChangesW) watchPath(watch *watch) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return watch.path
 }
 
 type (
@@ -270,7 +658,7 @@ func (w *readDirChangesW) wakeupReader() error {
 }
 
 func (w *readDirChangesW) getDir(pathname string) (dir string, err error) {
-	attr, err := windows.GetFileAttributes(windows.StringToUTF16Ptr(pathname))
+	attr, err := windows.GetFileAttributes(windows.StringToUTF16Ptr(longPath(pathname)))
 	if err != nil {
 		return "", os.NewSyscallError("GetFileAttributes", err)
 	}
@@ -284,7 +672,7 @@ func (w *readDirChangesW) getDir(pathname string) (dir string, err error) {
 }
 
 func (w *readDirChangesW) getIno(path string) (ino *inode, err error) {
-	h, err := windows.CreateFile(windows.StringToUTF16Ptr(path),
+	h, err := windows.CreateFile(windows.StringToUTF16Ptr(longPath(path)),
 		windows.FILE_LIST_DIRECTORY,
 		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
 		nil, windows.OPEN_EXISTING,
@@ -307,6 +695,106 @@ func (w *readDirChangesW) getIno(path string) (ino *inode, err error) {
 	return ino, nil
 }
 
+// longPath converts path to an extended-length path (prefixed with \\?\) so
+// that paths longer than MAX_PATH (260 characters) work. Paths that already
+// have the prefix are returned as-is.
+//
+// This is only used for the syscalls: the watch keeps the path as it was passed
+// to Add(), so events are sent with the same style of path.
+func longPath(path string) string {
+	if strings.HasPrefix(path, `\\?\`) || strings.HasPrefix(path, `\\.\`) {
+		return path
+	}
+	if !filepath.IsAbs(path) {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return path
+		}
+		path = abs
+	}
+	if strings.HasPrefix(path, `\\`) { // UNC path: \\server\share → \\?\UNC\server\share
+		return `\\?\UNC\` + path[2:]
+	}
+	return `\\?\` + path
+}
+
+// longName converts any 8.3 short names in name (which is relative to dir) to
+// the long name. The file may no longer exist (e.g. for removes), in which case
+// the parent directories are still converted if possible.
+//
+// Components of dir are never converted, so that events have the path as it
+// was passed to Add().
+func longName(dir, name string) string {
+	if !strings.Contains(name, "~") { // Short names always have a ~
+		return name
+	}
+
+	parts := strings.Split(name, `\`)
+	for i := len(parts); i > 0; i-- {
+		long, err := getLongPathName(longPath(filepath.Join(dir, strings.Join(parts[:i], `\`))))
+		if err != nil {
+			continue
+		}
+		lp := strings.Split(long, `\`)
+		if len(lp) < i {
+			break
+		}
+		return strings.Join(append(lp[len(lp)-i:], parts[i:]...), `\`)
+	}
+	return name
+}
+
+func getLongPathName(path string) (string, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]uint16, windows.MAX_PATH)
+	for {
+		n, err := windows.GetLongPathName(p, &buf[0], uint32(len(buf)))
+		if err != nil {
+			return "", err
+		}
+		if n <= uint32(len(buf)) {
+			return windows.UTF16ToString(buf[:n]), nil
+		}
+		buf = make([]uint16, n)
+	}
+}
+
+// backendName is the name of the backend newBufferedBackend() creates, for
+// the pprof labels with WithProfiling().
+func backendName(with watcherOpts) string { return "windows" }
+
+func probe(path string, with watcherOpts) Capabilities {
+	c := Capabilities{
+		Ops:        supportedOps((&readDirChangesW{}).xSupports),
+		Network:    isRemote(path),
+		FileWrites: true,
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	var (
+		root = filepath.VolumeName(path) + `\`
+		name [windows.MAX_PATH + 1]uint16
+	)
+	err := windows.GetVolumeInformation(windows.StringToUTF16Ptr(root), nil, 0, nil, nil, nil, &name[0], uint32(len(name)))
+	if err == nil {
+		c.FSType = windows.UTF16ToString(name[:])
+	}
+	return c
+}
+
+// isRemote reports if the path is on a network drive.
+func isRemote(path string) bool {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	root := filepath.VolumeName(path) + `\`
+	return windows.GetDriveType(windows.StringToUTF16Ptr(root)) == windows.DRIVE_REMOTE
+}
+
 // Must run within the I/O thread.
 func (m watchMap) get(ino *inode) *watch {
 	if i := m[ino.volume]; i != nil {
@@ -325,8 +813,41 @@ func (m watchMap) set(ino *inode, watch *watch) {
 	i[ino.index] = watch
 }
 
+// newWatch creates a new watch for the directory handle and associates it with
+// the completion port. The handle is closed on errors.
+func (w *readDirChangesW) newWatch(ino *inode, dir string, recurse bool, bufsize int) (*watch, error) {
+	_, err := windows.CreateIoCompletionPort(ino.handle, w.port, 0, 0)
+	if err != nil {
+		windows.CloseHandle(ino.handle)
+		return nil, os.NewSyscallError("CreateIoCompletionPort", err)
+	}
+	watch := &watch{
+		ino:     ino,
+		path:    dir,
+		names:   make(map[string]uint64),
+		recurse: recurse,
+		buf:     make([]byte, bufsize),
+		bufsize: bufsize,
+		minBuf:  bufsize,
+		maxBuf:  maxBufsize,
+	}
+	if isRemote(dir) {
+		// Larger buffers don't work over SMB.
+		watch.maxBuf = maxBufsizeRemote
+	} else {
+		watch.devNotify = w.registerDevice(ino.handle)
+	}
+	if watch.maxBuf < bufsize {
+		watch.maxBuf = bufsize
+	}
+	return watch, nil
+}
+
 // Must run within the I/O thread.
 func (w *readDirChangesW) addWatch(pathname string, flags uint64, bufsize int) error {
+	if w.volume {
+		return w.addVolume(pathname, flags, bufsize)
+	}
 	pathname, recurse := recursivePath(pathname)
 
 	dir, err := w.getDir(pathname)
@@ -342,29 +863,27 @@ func (w *readDirChangesW) addWatch(pathname string, flags uint64, bufsize int) e
 	watchEntry := w.watches.get(ino)
 	w.mu.Unlock()
 	if watchEntry == nil {
-		_, err := windows.CreateIoCompletionPort(ino.handle, w.port, 0, 0)
+		watchEntry, err = w.newWatch(ino, dir, recurse, bufsize)
 		if err != nil {
-			windows.CloseHandle(ino.handle)
-			return os.NewSyscallError("CreateIoCompletionPort", err)
-		}
-		watchEntry = &watch{
-			ino:     ino,
-			path:    dir,
-			names:   make(map[string]uint64),
-			recurse: recurse,
-			buf:     make([]byte, bufsize),
+			return err
 		}
+		watchEntry.ioMu.Lock()
+		defer watchEntry.ioMu.Unlock()
 		w.mu.Lock()
 		w.watches.set(ino, watchEntry)
 		w.mu.Unlock()
 		flags |= provisional
 	} else {
 		windows.CloseHandle(ino.handle)
+		watchEntry.ioMu.Lock()
+		defer watchEntry.ioMu.Unlock()
 	}
+	var name string
 	if pathname == dir {
 		watchEntry.mask |= flags
 	} else {
-		watchEntry.names[filepath.Base(pathname)] |= flags
+		name = watchEntry.name(pathname)
+		watchEntry.names[name] |= flags
 	}
 
 	err = w.startRead(watchEntry)
@@ -375,13 +894,16 @@ func (w *readDirChangesW) addWatch(pathname string, flags uint64, bufsize int) e
 	if pathname == dir {
 		watchEntry.mask &= ^provisional
 	} else {
-		watchEntry.names[filepath.Base(pathname)] &= ^provisional
+		watchEntry.names[name] &= ^provisional
 	}
 	return nil
 }
 
 // Must run within the I/O thread.
 func (w *readDirChangesW) remWatch(pathname string) error {
+	if w.volume {
+		return w.remVolume(pathname)
+	}
 	pathname, recurse := recursivePath(pathname)
 
 	dir, err := w.getDir(pathname)
@@ -408,29 +930,179 @@ func (w *readDirChangesW) remWatch(pathname string) error {
 	if watch == nil {
 		return fmt.Errorf("%w: %s", ErrNonExistentWatch, pathname)
 	}
+	watch.ioMu.Lock()
+	defer watch.ioMu.Unlock()
 	if pathname == dir {
-		w.sendEvent(watch.path, "", watch.mask&sysFSIGNORED)
+		w.sendEvent(w.watchPath(watch), "", watch.mask&sysFSIGNORED, nil)
 		watch.mask = 0
 	} else {
-		name := filepath.Base(pathname)
-		w.sendEvent(filepath.Join(watch.path, name), "", watch.names[name]&sysFSIGNORED)
+		name := watch.name(pathname)
+		w.sendEvent(filepath.Join(w.watchPath(watch), name), "", watch.names[name]&sysFSIGNORED, nil)
 		delete(watch.names, name)
 	}
 
 	return w.startRead(watch)
 }
 
+// Must run within the I/O thread.
+func (w *readDirChangesW) remOps(pathname string, flags uint64) error {
+	pathname, _ = recursivePath(pathname)
+	dir, err := w.getDir(pathname)
+	if err != nil {
+		return err
+	}
+	ino, err := w.getIno(dir)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	watch := w.watches.get(ino)
+	w.mu.Unlock()
+
+	err = windows.CloseHandle(ino.handle)
+	if err != nil {
+		w.sendError(os.NewSyscallError("CloseHandle", err))
+	}
+	if watch == nil {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, pathname)
+	}
+	watch.ioMu.Lock()
+	defer watch.ioMu.Unlock()
+	if pathname == dir {
+		if watch.mask == 0 {
+			return fmt.Errorf("%w: %s", ErrNonExistentWatch, pathname)
+		}
+		watch.mask &^= flags
+	} else {
+		name := watch.name(pathname)
+		if _, ok := watch.names[name]; !ok {
+			return fmt.Errorf("%w: %s", ErrNonExistentWatch, pathname)
+		}
+		watch.names[name] &^= flags
+	}
+	return w.startRead(watch)
+}
+
+// resizeBufferNow changes the buffer size like setBufferSize(), but cancels the
+// pending read so that the new size is used right away.
+func (w *readDirChangesW) resizeBufferNow(name string, bufsize int) error {
+	if w.isClosed() {
+		return ErrClosed
+	}
+	if bufsize < 4096 {
+		bufsize = 4096
+	}
+	in := &input{
+		op:      opResizeBuffer,
+		path:    filepath.Clean(name),
+		bufsize: bufsize,
+		reply:   make(chan error),
+	}
+	return w.sendInput(in)
+}
+
+// The kernel may still write to the buffer until the cancelled read completes,
+// so the buffer is replaced only once the completion is read in readWatch().
+// Changes made in the meanwhile aren't lost, as the kernel keeps them for the
+// next read on the same handle.
+//
+// Must run within the I/O thread.
+func (w *readDirChangesW) resizeNow(pathname string, bufsize int) error {
+	if err := w.setBufsize(pathname, bufsize); err != nil || w.volume {
+		return err
+	}
+	pathname, _ = recursivePath(pathname)
+	watch := w.findWatch(pathname)
+	if watch == nil {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, pathname)
+	}
+
+	watch.ioMu.Lock()
+	defer watch.ioMu.Unlock()
+	if bufsize == len(watch.buf) {
+		return nil
+	}
+	watch.resize = bufsize
+	err := windows.CancelIoEx(watch.ino.handle, &watch.ov)
+	if err != nil && err != windows.ERROR_NOT_FOUND { // Not found: already completed.
+		return os.NewSyscallError("CancelIoEx", err)
+	}
+	return nil
+}
+
+// findWatch gets the watch for the directory pathname, or nil if it's not
+// watched.
+//
+// Must run within the I/O thread.
+func (w *readDirChangesW) findWatch(pathname string) *watch {
+	dir, err := w.getDir(pathname)
+	if err != nil {
+		return nil
+	}
+	ino, err := w.getIno(dir)
+	if err != nil {
+		return nil
+	}
+	w.mu.Lock()
+	watch := w.watches.get(ino)
+	w.mu.Unlock()
+	if err := windows.CloseHandle(ino.handle); err != nil {
+		w.sendError(os.NewSyscallError("CloseHandle", err))
+	}
+	return watch
+}
+
+// Must run within the I/O thread.
+func (w *readDirChangesW) setBufsize(pathname string, bufsize int) error {
+	if w.volume {
+		return nil
+	}
+	pathname, _ = recursivePath(pathname)
+	dir, err := w.getDir(pathname)
+	if err != nil {
+		return err
+	}
+	ino, err := w.getIno(dir)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	watch := w.watches.get(ino)
+	w.mu.Unlock()
+
+	err = windows.CloseHandle(ino.handle)
+	if err != nil {
+		w.sendError(os.NewSyscallError("CloseHandle", err))
+	}
+	if watch == nil {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, pathname)
+	}
+	watch.ioMu.Lock()
+	defer watch.ioMu.Unlock()
+	watch.minBuf = bufsize
+	if watch.maxBuf < bufsize {
+		watch.maxBuf = bufsize
+	}
+	return nil
+}
+
 // Must run within the I/O thread.
 func (w *readDirChangesW) deleteWatch(watch *watch) {
+	path := w.watchPath(watch)
 	for name, mask := range watch.names {
 		if mask&provisional == 0 {
-			w.sendEvent(filepath.Join(watch.path, name), "", mask&sysFSIGNORED)
+			w.sendEvent(filepath.Join(path, name), "", mask&sysFSIGNORED, nil)
 		}
 		delete(watch.names, name)
 	}
+	for k := range watch.prefixes {
+		delete(watch.prefixes, k)
+	}
 	if watch.mask != 0 {
 		if watch.mask&provisional == 0 {
-			w.sendEvent(watch.path, "", watch.mask&sysFSIGNORED)
+			w.sendEvent(path, "", watch.mask&sysFSIGNORED, nil)
 		}
 		watch.mask = 0
 	}
@@ -438,9 +1110,11 @@ func (w *readDirChangesW) deleteWatch(watch *watch) {
 
 // Must run within the I/O thread.
 func (w *readDirChangesW) startRead(watch *watch) error {
-	err := windows.CancelIo(watch.ino.handle)
-	if err != nil {
-		w.sendError(os.NewSyscallError("CancelIo", err))
+	// CancelIoEx rather than CancelIo, as the read may have been started by
+	// another I/O thread.
+	err := windows.CancelIoEx(watch.ino.handle, nil)
+	if err != nil && err != windows.ERROR_NOT_FOUND {
+		w.sendError(os.NewSyscallError("CancelIoEx", err))
 		w.deleteWatch(watch)
 	}
 	mask := w.toWindowsFlags(watch.mask)
@@ -448,6 +1122,8 @@ func (w *readDirChangesW) startRead(watch *watch) error {
 		mask |= w.toWindowsFlags(m)
 	}
 	if mask == 0 {
+		unregisterDevice(watch.devNotify)
+		watch.devNotify = 0
 		err := windows.CloseHandle(watch.ino.handle)
 		if err != nil {
 			w.sendError(os.NewSyscallError("CloseHandle", err))
@@ -460,14 +1136,25 @@ func (w *readDirChangesW) startRead(watch *watch) error {
 
 	// We need to pass the array, rather than the slice.
 	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&watch.buf))
-	rdErr := windows.ReadDirectoryChanges(watch.ino.handle,
+
+	// Try ReadDirectoryChangesExW first, as that gives us the file ID, size,
+	// and timestamps for free. This fails on older Windows versions and some
+	// filesystems (e.g. some network shares), in which case just use the
+	// regular ReadDirectoryChangesW.
+	rdErr := readDirectoryChangesEx(watch.ino.handle,
 		(*byte)(unsafe.Pointer(hdr.Data)), uint32(hdr.Len),
-		watch.recurse, mask, nil, &watch.ov, 0)
+		watch.recurse, mask, &watch.ov)
+	watch.ext = rdErr == nil
+	if rdErr != nil {
+		rdErr = windows.ReadDirectoryChanges(watch.ino.handle,
+			(*byte)(unsafe.Pointer(hdr.Data)), uint32(hdr.Len),
+			watch.recurse, mask, nil, &watch.ov, 0)
+	}
 	if rdErr != nil {
 		err := os.NewSyscallError("ReadDirectoryChanges", rdErr)
 		if rdErr == windows.ERROR_ACCESS_DENIED && watch.mask&provisional == 0 {
 			// Watched directory was probably removed
-			w.sendEvent(watch.path, "", watch.mask&sysFSDELETESELF)
+			w.sendEvent(w.watchPath(watch), "", watch.mask&sysFSDELETESELF, nil)
 			err = nil
 		}
 		w.deleteWatch(watch)
@@ -479,7 +1166,8 @@ func (w *readDirChangesW) startRead(watch *watch) error {
 
 // readEvents reads from the I/O completion port, converts the
 // received events into Event objects and sends them via the Events channel.
-// Entry point to the I/O thread.
+// Entry point to the I/O threads; there is one goroutine for every worker set
+// with WithWorkers().
 func (w *readDirChangesW) readEvents() {
 	var (
 		n   uint32
@@ -487,13 +1175,20 @@ func (w *readDirChangesW) readEvents() {
 		ov  *windows.Overlapped
 	)
 	runtime.LockOSThread()
+	defer w.workers.Done()
 
 	for {
 		// This error is handled after the watch == nil check below.
-		qErr := windows.GetQueuedCompletionStatus(w.port, &n, &key, &ov, windows.INFINITE)
+		qErr := windows.GetQueuedCompletionStatus(w.port, &n, &key, &ov, w.flushMoved(nil))
+		if ov == nil && qErr == windows.WAIT_TIMEOUT {
+			continue // Only to send the Remove for files in w.moved.
+		}
 
 		watch := (*watch)(unsafe.Pointer(ov))
 		if watch == nil {
+			if qErr != nil { // Port was closed by the thread that got the quit message.
+				return
+			}
 			select {
 			case ch := <-w.quit:
 				w.mu.Lock()
@@ -504,146 +1199,511 @@ func (w *readDirChangesW) readEvents() {
 				w.mu.Unlock()
 				for _, index := range indexes {
 					for _, watch := range index {
+						watch.ioMu.Lock()
 						w.deleteWatch(watch)
 						w.startRead(watch)
+						watch.ioMu.Unlock()
 					}
 				}
 
+				w.closeDeviceWindow()
 				err := windows.CloseHandle(w.port)
 				if err != nil {
 					err = os.NewSyscallError("CloseHandle", err)
 				}
-				close(w.Events)
-				close(w.Errors)
-				ch <- err
+				// Other I/O threads may still be sending; close the channels
+				// only once they all stopped.
+				go func() {
+					w.workers.Wait()
+					close(w.Events)
+					close(w.Errors)
+					ch <- err
+				}()
 				return
 			case in := <-w.input:
+				w.inputMu.Lock()
 				switch in.op {
 				case opAddWatch:
 					in.reply <- w.addWatch(in.path, uint64(in.flags), in.bufsize)
 				case opRemoveWatch:
 					in.reply <- w.remWatch(in.path)
+				case opDeviceRemove:
+					in.reply <- w.deviceRemoved(in.handle)
+				case opRemoveOps:
+					in.reply <- w.remOps(in.path, uint64(in.flags))
+				case opSetBufferSize:
+					in.reply <- w.setBufsize(in.path, in.bufsize)
+				case opResizeBuffer:
+					in.reply <- w.resizeNow(in.path, in.bufsize)
 				}
+				w.inputMu.Unlock()
 			default:
 			}
 			continue
 		}
 
-		switch qErr {
-		case nil:
-			// No error
-		case windows.ERROR_MORE_DATA:
-			if watch == nil {
-				w.sendError(errors.New("ERROR_MORE_DATA has unexpectedly null lpOverlapped buffer"))
-			} else {
-				// The i/o succeeded but the buffer is full.
-				// In theory we should be building up a full packet.
-				// In practice we can get away with just carrying on.
-				n = uint32(unsafe.Sizeof(watch.buf))
+		watch.ioMu.Lock()
+		w.readWatch(watch, n, qErr)
+		watch.ioMu.Unlock()
+	}
+}
+
+// readWatch processes the completion of a read for the watch.
+//
+// Must run within an I/O thread, with watch.ioMu held.
+func (w *readDirChangesW) readWatch(watch *watch, n uint32, qErr error) {
+	if w.isClosed() {
+		return
+	}
+	dir := w.watchPath(watch)
+
+	switch qErr {
+	case nil:
+		// No error
+	case windows.ERROR_MORE_DATA:
+		if watch == nil {
+			w.sendError(errors.New("ERROR_MORE_DATA has unexpectedly null lpOverlapped buffer"))
+		} else {
+			// The i/o succeeded but the buffer is full.
+			// In theory we should be building up a full packet.
+			// In practice we can get away with just carrying on.
+			n = uint32(unsafe.Sizeof(watch.buf))
+		}
+	case windows.ERROR_ACCESS_DENIED:
+		// Watched directory was probably removed
+		w.sendEvent(dir, "", watch.mask&sysFSDELETESELF, nil)
+		w.deleteWatch(watch)
+		w.startRead(watch)
+		return
+	case windows.ERROR_OPERATION_ABORTED:
+		// CancelIo was called on this handle; the read was restarted already,
+		// unless it was cancelled by resizeNow().
+		if watch.resize > 0 {
+			w.resizeBuffer(watch, watch.resize)
+			watch.resize = 0
+			if err := w.startRead(watch); err != nil {
+				w.sendError(err)
 			}
-		case windows.ERROR_ACCESS_DENIED:
-			// Watched directory was probably removed
-			w.sendEvent(watch.path, "", watch.mask&sysFSDELETESELF)
-			w.deleteWatch(watch)
-			w.startRead(watch)
-			continue
-		case windows.ERROR_OPERATION_ABORTED:
-			// CancelIo was called on this handle
-			continue
-		default:
-			w.sendError(os.NewSyscallError("GetQueuedCompletionPort", qErr))
-			continue
 		}
+		return
+	case windows.ERROR_NETNAME_DELETED, windows.ERROR_UNEXP_NET_ERR,
+		windows.ERROR_BAD_NETPATH, windows.ERROR_BAD_NET_NAME,
+		windows.ERROR_NETWORK_UNREACHABLE, windows.ERROR_VC_DISCONNECTED,
+		windows.ERROR_CONNECTION_ABORTED, windows.ERROR_DEV_NOT_EXIST:
+		// Network share went away.
+		w.lostWatch(watch, os.NewSyscallError("ReadDirectoryChanges", qErr))
+		return
+	default:
+		w.sendError(os.NewSyscallError("GetQueuedCompletionPort", qErr))
+		return
+	}
 
-		var offset uint32
-		for {
-			if n == 0 {
-				w.sendError(ErrEventOverflow)
-				break
-			}
+	if watch.prefixes != nil {
+		w.readVolume(watch, dir, n)
+		return
+	}
 
-			// Point "raw" to the event in the buffer
-			raw := (*windows.FileNotifyInformation)(unsafe.Pointer(&watch.buf[offset]))
-
-			// Create a buf that is the size of the path name
-			size := int(raw.FileNameLength / 2)
-			var buf []uint16
-			// TODO: Use unsafe.Slice in Go 1.17; https://stackoverflow.com/questions/51187973
-			sh := (*reflect.SliceHeader)(unsafe.Pointer(&buf))
-			sh.Data = uintptr(unsafe.Pointer(&raw.FileName))
-			sh.Len = size
-			sh.Cap = size
-			name := windows.UTF16ToString(buf)
-			fullname := filepath.Join(watch.path, name)
-
-			if debug {
-				internal.Debug(fullname, raw.Action)
-			}
+	var offset uint32
+	for {
+		if n == 0 {
+			w.sendError(ErrEventOverflow)
+			w.growBuffer(watch)
+			break
+		}
 
-			var mask uint64
-			switch raw.Action {
-			case windows.FILE_ACTION_REMOVED:
-				mask = sysFSDELETESELF
-			case windows.FILE_ACTION_MODIFIED:
-				mask = sysFSMODIFY
-			case windows.FILE_ACTION_RENAMED_OLD_NAME:
-				watch.rename = name
-			case windows.FILE_ACTION_RENAMED_NEW_NAME:
-				// Update saved path of all sub-watches.
-				old := filepath.Join(watch.path, watch.rename)
-				w.mu.Lock()
-				for _, watchMap := range w.watches {
-					for _, ww := range watchMap {
-						if strings.HasPrefix(ww.path, old) {
-							ww.path = filepath.Join(fullname, strings.TrimPrefix(ww.path, old))
-						}
+		raw, name, info := parseNotify(watch.buf[offset:], watch.ext)
+		w.flushMoved(watch)
+		if w.longNames {
+			name = longName(dir, name)
+		}
+		fullname := filepath.Join(dir, name)
+
+		if debug {
+			internal.Debug(fullname, raw.Action)
+		}
+		if w.raw != nil {
+			w.raw(RawEvent{Name: fullname, Mask: uint64(raw.Action)})
+		}
+
+		var mask uint64
+		switch raw.Action {
+		case windows.FILE_ACTION_REMOVED:
+			mask = sysFSDELETESELF
+		case windows.FILE_ACTION_MODIFIED:
+			mask = modifyMask(watch.mask|watch.names[name], info)
+		case windows.FILE_ACTION_RENAMED_OLD_NAME:
+			watch.rename = name
+			watch.renameID = 0
+			if info != nil {
+				watch.renameID = info.FileID
+			}
+		case windows.FILE_ACTION_RENAMED_NEW_NAME:
+			// With the file ID we can make sure the old and new names
+			// actually belong together, rather than assuming the previous
+			// RENAMED_OLD_NAME is the right one.
+			if info != nil && watch.renameID != 0 && watch.renameID != info.FileID {
+				watch.rename = ""
+			}
+			// Update saved path of all sub-watches.
+			old := filepath.Join(dir, watch.rename)
+			w.mu.Lock()
+			for _, watchMap := range w.watches {
+				for _, ww := range watchMap {
+					if strings.HasPrefix(ww.path, old) {
+						ww.path = filepath.Join(fullname, strings.TrimPrefix(ww.path, old))
 					}
 				}
-				w.mu.Unlock()
+			}
+			w.mu.Unlock()
 
-				if watch.names[watch.rename] != 0 {
-					watch.names[name] |= watch.names[watch.rename]
-					delete(watch.names, watch.rename)
-					mask = sysFSMOVESELF
-				}
+			if watch.names[watch.rename] != 0 {
+				watch.names[name] |= watch.names[watch.rename]
+				delete(watch.names, watch.rename)
+				mask = sysFSMOVESELF
 			}
+		}
+
+		if raw.Action != windows.FILE_ACTION_RENAMED_NEW_NAME {
+			w.sendEvent(fullname, "", watch.names[name]&mask, info)
+		}
+		if raw.Action == windows.FILE_ACTION_REMOVED {
+			w.sendEvent(fullname, "", watch.names[name]&sysFSIGNORED, info)
+			delete(watch.names, name)
+		}
 
-			if raw.Action != windows.FILE_ACTION_RENAMED_NEW_NAME {
-				w.sendEvent(fullname, "", watch.names[name]&mask)
+		if watch.rename != "" && raw.Action == windows.FILE_ACTION_RENAMED_NEW_NAME {
+			m := watch.mask & w.toFSnotifyFlags(raw.Action)
+			if m != 0 {
+				m |= moveTree(watch, fullname)
 			}
-			if raw.Action == windows.FILE_ACTION_REMOVED {
-				w.sendEvent(fullname, "", watch.names[name]&sysFSIGNORED)
-				delete(watch.names, name)
+			w.sendEvent(fullname, filepath.Join(dir, watch.rename), m, info)
+		} else if raw.Action == windows.FILE_ACTION_MODIFIED {
+			w.sendEvent(fullname, "", watch.mask&modifyMask(watch.mask, info), info)
+		} else if raw.Action == windows.FILE_ACTION_ADDED {
+			w.sendEvent(fullname, w.movedFrom(watch.ino.volume, info), watch.mask&w.toFSnotifyFlags(raw.Action), info)
+		} else if raw.Action == windows.FILE_ACTION_REMOVED {
+			if !w.removed(watch, info, fullname) {
+				w.sendEvent(fullname, "", watch.mask&sysFSDELETE, info)
 			}
+		} else {
+			w.sendEvent(fullname, "", watch.mask&w.toFSnotifyFlags(raw.Action), info)
+		}
+
+		if raw.Action == windows.FILE_ACTION_RENAMED_NEW_NAME {
+			w.sendEvent(filepath.Join(dir, watch.rename), "", watch.names[name]&mask, info)
+		}
+
+		// Move to the next event in the buffer
+		if raw.NextEntryOffset == 0 {
+			break
+		}
+		offset += raw.NextEntryOffset
+
+		// Error!
+		if offset >= n {
+			//lint:ignore ST1005 Windows should be capitalized
+			w.sendError(errors.New("Windows system assumed buffer larger than it is, events have likely been missed"))
+			break
+		}
+	}
+
+	if watch.resize > 0 {
+		w.resizeBuffer(watch, watch.resize)
+		watch.resize = 0
+	} else {
+		w.shrinkBuffer(watch, n)
+	}
+	if err := w.startRead(watch); err != nil {
+		w.sendError(err)
+	}
+}
+
+var procReadDirectoryChangesExW = windows.NewLazySystemDLL("kernel32.dll").NewProc("ReadDirectoryChangesExW")
+
+// ReadDirectoryNotifyExtendedInformation from READ_DIRECTORY_NOTIFY_INFORMATION_CLASS.
+const readDirectoryNotifyExtendedInformation = 2
+
+// readDirectoryChangesEx calls ReadDirectoryChangesExW to fill buf with
+// FILE_NOTIFY_EXTENDED_INFORMATION records.
+//
+// https://learn.microsoft.com/en-us/windows/win32/api/winbase/nf-winbase-readdirectorychangesexw
+func readDirectoryChangesEx(h windows.Handle, buf *byte, buflen uint32, watchSubTree bool, mask uint32, ov *windows.Overlapped) error {
+	if err := procReadDirectoryChangesExW.Find(); err != nil {
+		return err
+	}
+	var subtree uintptr
+	if watchSubTree {
+		subtree = 1
+	}
+	r, _, err := procReadDirectoryChangesExW.Call(uintptr(h),
+		uintptr(unsafe.Pointer(buf)), uintptr(buflen), subtree, uintptr(mask),
+		0, uintptr(unsafe.Pointer(ov)), 0, readDirectoryNotifyExtendedInformation)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// fileNotifyExtendedInformation is FILE_NOTIFY_EXTENDED_INFORMATION; this
+// isn't in x/sys/windows.
+type fileNotifyExtendedInformation struct {
+	NextEntryOffset      uint32
+	Action               uint32
+	CreationTime         int64
+	LastModificationTime int64
+	LastChangeTime       int64
+	LastAccessTime       int64
+	AllocatedLength      int64
+	FileSize             int64
+	FileAttributes       uint32
+	ReparsePointTag      uint32
+	FileID               uint64
+	ParentFileID         uint64
+	FileNameLength       uint32
+	FileName             uint16
+}
+
+// parseNotify reads one notification record from buf; if ext is set this is a
+// FILE_NOTIFY_EXTENDED_INFORMATION and the EventInfo is returned as well.
+//
+// The returned FileNotifyInformation only has NextEntryOffset and Action set.
+func parseNotify(buf []byte, ext bool) (windows.FileNotifyInformation, string, *EventInfo) {
+	var (
+		raw     windows.FileNotifyInformation
+		info    *EventInfo
+		namePtr *uint16
+		nameLen uint32
+	)
+	if ext {
+		r := (*fileNotifyExtendedInformation)(unsafe.Pointer(&buf[0]))
+		raw.NextEntryOffset, raw.Action = r.NextEntryOffset, r.Action
+		namePtr, nameLen = &r.FileName, r.FileNameLength
+		info = &EventInfo{
+			FileID:     r.FileID,
+			Size:       r.FileSize,
+			ModTime:    filetime(r.LastModificationTime),
+			ChangeTime: filetime(r.LastChangeTime),
+			AccessTime: filetime(r.LastAccessTime),
+			BirthTime:  filetime(r.CreationTime),
+		}
+	} else {
+		r := (*windows.FileNotifyInformation)(unsafe.Pointer(&buf[0]))
+		raw.NextEntryOffset, raw.Action = r.NextEntryOffset, r.Action
+		namePtr, nameLen = &r.FileName, r.FileNameLength
+	}
+
+	// Create a buf that is the size of the path name
+	size := int(nameLen / 2)
+	var name []uint16
+	// TODO: Use unsafe.Slice in Go 1.17; https://stackoverflow.com/questions/51187973
+	sh := (*reflect.SliceHeader)(unsafe.Pointer(&name))
+	sh.Data = uintptr(unsafe.Pointer(namePtr))
+	sh.Len = size
+	sh.Cap = size
+	return raw, windows.UTF16ToString(name), info
+}
+
+// filetime converts a FILETIME stored as a LARGE_INTEGER to a time.Time.
+func filetime(ft int64) time.Time {
+	if ft == 0 {
+		return time.Time{}
+	}
+	f := windows.Filetime{LowDateTime: uint32(ft), HighDateTime: uint32(ft >> 32)}
+	return time.Unix(0, f.Nanoseconds())
+}
+
+// FILE_ACTION_MODIFIED is sent for writes, security descriptor changes, and
+// access time updates. If the watch is listening for security or access changes
+// then use the timestamps from the extended information to tell them apart:
+// changing the security descriptor updates only the change time, and reading
+// updates only the access time. Without the extended information there's no
+// way to know, so report everything that's being watched.
+func modifyMask(watched uint64, info *EventInfo) uint64 {
+	extra := watched & (sysFSSECURITY | sysFSACL | sysFSACCESS)
+	if extra == 0 {
+		return sysFSMODIFY
+	}
+	if info == nil {
+		return sysFSMODIFY | extra
+	}
+	switch {
+	case extra&sysFSACCESS != 0 && info.AccessTime.After(info.ChangeTime) && info.AccessTime.After(info.ModTime):
+		return sysFSACCESS
+	case extra&(sysFSSECURITY|sysFSACL) != 0 && info.ChangeTime.After(info.ModTime):
+		return extra & (sysFSSECURITY | sysFSACL)
+	}
+	return sysFSMODIFY
+}
 
-			if watch.rename != "" && raw.Action == windows.FILE_ACTION_RENAMED_NEW_NAME {
-				w.sendEvent(fullname, filepath.Join(watch.path, watch.rename), watch.mask&w.toFSnotifyFlags(raw.Action))
+// Limits for growing the buffer after an overflow; ReadDirectoryChangesW fails
+// with buffers larger than 64K on network shares.
+//
+// After shrinkAfter without overflows the buffer is shrunk (by half, down to
+// the size set with WithBufferSize) if the last read used less than a quarter
+// of it.
+var (
+	maxBufsize       = 1 << 20
+	maxBufsizeRemote = 64 << 10
+	shrinkAfter      = time.Minute
+)
+
+// growBuffer doubles the buffer size after an overflow.
+//
+// Must run within the I/O thread, and only when there's no read pending.
+func (w *readDirChangesW) growBuffer(watch *watch) {
+	watch.overflow = time.Now()
+	size := len(watch.buf) * 2
+	if size > watch.maxBuf {
+		size = watch.maxBuf
+	}
+	w.resizeBuffer(watch, size)
+}
+
+// shrinkBuffer halves the buffer size if there haven't been overflows in a
+// while, and the last read of n bytes used only a small part of the buffer.
+//
+// It's also grown to the size set with WithBufferSize() if that was changed
+// with UpdateWith().
+//
+// Must run within the I/O thread, and only when there's no read pending.
+func (w *readDirChangesW) shrinkBuffer(watch *watch, n uint32) {
+	if len(watch.buf) < watch.minBuf {
+		w.resizeBuffer(watch, watch.minBuf)
+		return
+	}
+	if len(watch.buf) <= watch.minBuf || time.Since(watch.overflow) < shrinkAfter ||
+		int(n) > len(watch.buf)/4 {
+		return
+	}
+	size := len(watch.buf) / 2
+	if size < watch.minBuf {
+		size = watch.minBuf
+	}
+	w.resizeBuffer(watch, size)
+}
+
+func (w *readDirChangesW) resizeBuffer(watch *watch, size int) {
+	if size == len(watch.buf) {
+		return
+	}
+	watch.buf = make([]byte, size)
+	w.mu.Lock()
+	watch.bufsize = size
+	w.mu.Unlock()
+}
+
+// How often to check if the path of a lost watch is available again.
+var retryLost = 5 * time.Second
+
+// lostWatch removes a watch that stopped working because the filesystem went
+// away (e.g. a network share disconnected), and starts trying to re-establish
+// it in the background.
+//
+// Must run within the I/O thread.
+func (w *readDirChangesW) lostWatch(watch *watch, err error) {
+	path := w.watchPath(watch)
+	w.sendError(&WatchLostError{Path: path, Err: err})
+
+	unregisterDevice(watch.devNotify)
+	watch.devNotify = 0
+	windows.CloseHandle(watch.ino.handle)
+	w.mu.Lock()
+	delete(w.watches[watch.ino.volume], watch.ino.index)
+	w.mu.Unlock()
+
+	// Copy everything we need here, as the watch is no longer owned by the I/O
+	// thread once we return.
+	var (
+		lostAt  = time.Now()
+		add     = make(map[string]uint64, len(watch.names)+1)
+		recurse = watch.recurse
+	)
+	if watch.prefixes != nil {
+		recurse = false
+		for _, p := range watch.prefixes {
+			if p.recurse {
+				add[filepath.Join(p.path, "...")] = p.flags
 			} else {
-				w.sendEvent(fullname, "", watch.mask&w.toFSnotifyFlags(raw.Action))
+				add[p.path] = p.flags
 			}
+		}
+	}
+	if watch.mask&^provisional != 0 {
+		add[path] = watch.mask &^ provisional
+	}
+	for name, mask := range watch.names {
+		if mask&^provisional != 0 {
+			add[filepath.Join(path, name)] = mask &^ provisional
+		}
+	}
+	go w.restoreWatch(path, add, recurse, len(watch.buf), lostAt)
+}
 
-			if raw.Action == windows.FILE_ACTION_RENAMED_NEW_NAME {
-				w.sendEvent(filepath.Join(watch.path, watch.rename), "", watch.names[name]&mask)
-			}
+// restoreWatch waits for path to become available again and then re-adds the
+// watches.
+func (w *readDirChangesW) restoreWatch(path string, add map[string]uint64, recurse bool, bufsize int, lostAt time.Time) {
+	for {
+		time.Sleep(retryLost)
+		if w.isClosed() {
+			return
+		}
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
 
-			// Move to the next event in the buffer
-			if raw.NextEntryOffset == 0 {
-				break
+		for p, flags := range add {
+			if recurse && p == path {
+				p = filepath.Join(p, "...")
 			}
-			offset += raw.NextEntryOffset
-
-			// Error!
-			if offset >= n {
-				//lint:ignore ST1005 Windows should be capitalized
-				w.sendError(errors.New("Windows system assumed buffer larger than it is, events have likely been missed"))
-				break
+			err := w.sendInput(&input{
+				op:      opAddWatch,
+				path:    p,
+				flags:   uint32(flags),
+				reply:   make(chan error),
+				bufsize: bufsize,
+			})
+			if err != nil {
+				if w.isClosed() {
+					return
+				}
+				w.sendError(fmt.Errorf("fsnotify: re-adding %q: %w", p, err))
 			}
 		}
+		w.rescan(path, add[path], recurse, lostAt)
+		return
+	}
+}
 
-		if err := w.startRead(watch); err != nil {
-			w.sendError(err)
-		}
+// rescan sends events for everything that changed in path since the given
+// time. We don't know what was in the directory when the watch was lost, so
+// only creates and writes can be detected.
+func (w *readDirChangesW) rescan(path string, flags uint64, recurse bool, since time.Time) {
+	if flags == 0 {
+		return
 	}
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == path {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		attr, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+		if !ok {
+			return nil
+		}
+		switch {
+		case time.Unix(0, attr.CreationTime.Nanoseconds()).After(since):
+			w.sendEvent(p, "", flags&sysFSCREATE, nil)
+		case time.Unix(0, attr.LastWriteTime.Nanoseconds()).After(since):
+			w.sendEvent(p, "", flags&sysFSMODIFY, nil)
+		}
+		if d.IsDir() && !recurse {
+			return filepath.SkipDir
+		}
+		return nil
+	})
 }
 
 func (w *readDirChangesW) toWindowsFlags(mask uint64) uint32 {
@@ -651,6 +1711,12 @@ func (w *readDirChangesW) toWindowsFlags(mask uint64) uint32 {
 	if mask&sysFSMODIFY != 0 {
 		m |= windows.FILE_NOTIFY_CHANGE_LAST_WRITE
 	}
+	if mask&(sysFSSECURITY|sysFSACL) != 0 {
+		m |= windows.FILE_NOTIFY_CHANGE_SECURITY
+	}
+	if mask&sysFSACCESS != 0 {
+		m |= windows.FILE_NOTIFY_CHANGE_LAST_ACCESS
+	}
 	if mask&(sysFSMOVE|sysFSCREATE|sysFSDELETE) != 0 {
 		m |= windows.FILE_NOTIFY_CHANGE_FILE_NAME | windows.FILE_NOTIFY_CHANGE_DIR_NAME
 	}
@@ -673,9 +1739,14 @@ func (w *readDirChangesW) toFSnotifyFlags(action uint32) uint64 {
 	return 0
 }
 
+func (w *readDirChangesW) name() string { return "windows" }
+
 func (w *readDirChangesW) xSupports(op Op) bool {
-	if op.Has(xUnportableOpen) || op.Has(xUnportableRead) ||
-		op.Has(UnportableCloseWrite) || op.Has(xUnportableCloseRead) {
+	if op.Has(xUnportableOpen) || op.Has(UnportableCloseWrite) || op.Has(xUnportableCloseRead) ||
+		op.Has(UnportableExtend) || op.Has(UnportableTruncate) || op.Has(UnportableMount) ||
+		op.Has(UnportableUnmount) || op.Has(UnportableMode) || op.Has(UnportableOwner) ||
+		op.Has(UnportableTimes) || op.Has(UnportableXattr) || op.Has(UnportableLink) ||
+		op.Has(UnportableUnlink) || op.Has(UnportableClone) {
 		return false
 	}
 	return true
@@ -0,0 +1,254 @@
+//go:build windows
+
+// Device removal notifications for the Windows backend.
+//
+// An open directory handle prevents a removable drive from being ejected, so we
+// register for notifications on every watched directory handle, and close the
+// handle when Windows asks if the device can be removed. This requires a
+// window to receive the WM_DEVICECHANGE messages; we create a message-only
+// window in its own thread for this the first time it's needed.
+//
+// https://learn.microsoft.com/en-us/windows/win32/devio/processing-a-request-to-remove-a-device
+
+package fsnotify
+
+import (
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	user32                          = windows.NewLazySystemDLL("user32.dll")
+	procRegisterClassExW            = user32.NewProc("RegisterClassExW")
+	procCreateWindowExW             = user32.NewProc("CreateWindowExW")
+	procDefWindowProcW              = user32.NewProc("DefWindowProcW")
+	procDestroyWindow               = user32.NewProc("DestroyWindow")
+	procGetMessageW                 = user32.NewProc("GetMessageW")
+	procDispatchMessageW            = user32.NewProc("DispatchMessageW")
+	procPostMessageW                = user32.NewProc("PostMessageW")
+	procPostQuitMessage             = user32.NewProc("PostQuitMessage")
+	procRegisterDeviceNotificationW = user32.NewProc("RegisterDeviceNotificationW")
+	procUnregisterDeviceNotify      = user32.NewProc("UnregisterDeviceNotification")
+)
+
+const (
+	wmDestroy      = 0x0002
+	wmClose        = 0x0010
+	wmDeviceChange = 0x0219
+
+	dbtDeviceQueryRemove    = 0x8001
+	dbtDeviceRemovePending  = 0x8003
+	dbtDeviceRemoveComplete = 0x8004
+	dbtDevtypHandle         = 6
+
+	hwndMessage = ^uintptr(2) // HWND_MESSAGE: (HWND)-3
+)
+
+type (
+	wndClassEx struct {
+		size       uint32
+		style      uint32
+		wndProc    uintptr
+		clsExtra   int32
+		wndExtra   int32
+		instance   windows.Handle
+		icon       windows.Handle
+		cursor     windows.Handle
+		background windows.Handle
+		menuName   *uint16
+		className  *uint16
+		iconSm     windows.Handle
+	}
+	msg struct {
+		hwnd     uintptr
+		message  uint32
+		wParam   uintptr
+		lParam   uintptr
+		time     uint32
+		pt       struct{ x, y int32 }
+		lPrivate uint32
+	}
+	devBroadcastHandle struct {
+		size       uint32
+		devType    uint32
+		reserved   uint32
+		handle     windows.Handle
+		devNotify  uintptr
+		eventGUID  windows.GUID
+		nameOffset int32
+		data       [1]byte
+	}
+)
+
+var (
+	deviceWndOnce  sync.Once
+	deviceWndClass *uint16
+	deviceWndErr   error
+
+	// hwnd → backend; the window procedure is shared by all watchers.
+	deviceWndMu       sync.Mutex
+	deviceWndBackends = make(map[uintptr]*readDirChangesW)
+)
+
+// deviceWindow returns the window to receive device notifications on, creating
+// it if needed.
+func (w *readDirChangesW) deviceWindow() (uintptr, error) {
+	w.devMu.Lock()
+	defer w.devMu.Unlock()
+	if w.devHwnd != 0 {
+		return w.devHwnd, nil
+	}
+
+	deviceWndOnce.Do(func() {
+		deviceWndClass = windows.StringToUTF16Ptr("fsnotify-device")
+		wc := wndClassEx{
+			wndProc:   windows.NewCallback(deviceWndProc),
+			className: deviceWndClass,
+		}
+		wc.size = uint32(unsafe.Sizeof(wc))
+		r, _, err := procRegisterClassExW.Call(uintptr(unsafe.Pointer(&wc)))
+		if r == 0 {
+			deviceWndErr = err
+		}
+	})
+	if deviceWndErr != nil {
+		return 0, deviceWndErr
+	}
+
+	// Window messages are delivered to the thread that created the window, so
+	// create it in a new locked thread that runs the message loop.
+	created := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		hwnd, _, err := procCreateWindowExW.Call(0,
+			uintptr(unsafe.Pointer(deviceWndClass)), 0, 0, 0, 0, 0, 0,
+			hwndMessage, 0, 0, 0)
+		if hwnd == 0 {
+			created <- err
+			return
+		}
+		deviceWndMu.Lock()
+		deviceWndBackends[hwnd] = w
+		deviceWndMu.Unlock()
+		w.devHwnd = hwnd
+		created <- nil
+
+		var m msg
+		for {
+			r, _, _ := procGetMessageW.Call(uintptr(unsafe.Pointer(&m)), 0, 0, 0)
+			if r == 0 || int32(r) == -1 {
+				break
+			}
+			procDispatchMessageW.Call(uintptr(unsafe.Pointer(&m)))
+		}
+
+		deviceWndMu.Lock()
+		delete(deviceWndBackends, hwnd)
+		deviceWndMu.Unlock()
+	}()
+	return w.devHwnd, <-created
+}
+
+// closeDeviceWindow stops the message loop, if it was started.
+func (w *readDirChangesW) closeDeviceWindow() {
+	w.devMu.Lock()
+	defer w.devMu.Unlock()
+	if w.devHwnd != 0 {
+		procPostMessageW.Call(w.devHwnd, wmClose, 0, 0)
+		w.devHwnd = 0
+	}
+}
+
+// registerDevice registers for device notifications on the handle. Errors are
+// ignored: we just won't be able to release the handle on eject, which is
+// no worse than not trying at all.
+func (w *readDirChangesW) registerDevice(h windows.Handle) uintptr {
+	hwnd, err := w.deviceWindow()
+	if err != nil {
+		return 0
+	}
+	filter := devBroadcastHandle{devType: dbtDevtypHandle, handle: h}
+	filter.size = uint32(unsafe.Sizeof(filter))
+	r, _, _ := procRegisterDeviceNotificationW.Call(hwnd, uintptr(unsafe.Pointer(&filter)), 0)
+	return r
+}
+
+func unregisterDevice(devNotify uintptr) {
+	if devNotify != 0 {
+		procUnregisterDeviceNotify.Call(devNotify)
+	}
+}
+
+func deviceWndProc(hwnd, message, wParam, lParam uintptr) uintptr {
+	switch message {
+	case wmDeviceChange:
+		switch wParam {
+		case dbtDeviceQueryRemove, dbtDeviceRemovePending, dbtDeviceRemoveComplete:
+			// lParam is a pointer to the DEV_BROADCAST_HANDLE; convert it like
+			// this rather than unsafe.Pointer(lParam) to keep go vet happy.
+			hdr := *(**devBroadcastHandle)(unsafe.Pointer(&lParam))
+			if hdr == nil || hdr.devType != dbtDevtypHandle {
+				break
+			}
+			deviceWndMu.Lock()
+			w := deviceWndBackends[hwnd]
+			deviceWndMu.Unlock()
+			if w == nil || w.isClosed() {
+				break
+			}
+
+			// Close the handle before returning, so that the device can be
+			// ejected.
+			w.sendInput(&input{op: opDeviceRemove, handle: hdr.handle, reply: make(chan error)})
+		}
+		return 1 // TRUE: grant the request.
+	case wmClose:
+		procDestroyWindow.Call(hwnd)
+		return 0
+	case wmDestroy:
+		procPostQuitMessage.Call(0)
+		return 0
+	}
+	r, _, _ := procDefWindowProcW.Call(hwnd, message, wParam, lParam)
+	return r
+}
+
+// deviceRemoved releases the watch for the handle because the device it's on
+// is being removed.
+//
+// Must run within the I/O thread.
+func (w *readDirChangesW) deviceRemoved(h windows.Handle) error {
+	var found *watch
+	w.mu.Lock()
+	for _, index := range w.watches {
+		for _, ww := range index {
+			if ww.ino.handle == h {
+				found = ww
+			}
+		}
+	}
+	w.mu.Unlock()
+	if found == nil { // Already removed.
+		return nil
+	}
+
+	found.ioMu.Lock()
+	defer found.ioMu.Unlock()
+	w.mu.Lock()
+	removed := w.watches.get(found.ino) != found
+	w.mu.Unlock()
+	if removed { // Lost in another I/O thread while we were waiting.
+		return nil
+	}
+
+	windows.CancelIoEx(h, nil)
+	unregisterDevice(found.devNotify)
+	found.devNotify = 0
+	w.lostWatch(found, ErrDeviceRemoved)
+	return nil
+}
@@ -3,9 +3,14 @@
 package fsnotify
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/windows"
 )
 
 func TestRemoveState(t *testing.T) {
@@ -71,3 +76,220 @@ func TestWindowsRemWatch(t *testing.T) {
 		t.Fatal("Should be fail with closed handle\n")
 	}
 }
+
+func TestWindowsLongPath(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	dir := join(tmp, strings.Repeat("a", 100), strings.Repeat("b", 100), strings.Repeat("c", 100))
+	mkdirAll(t, dir)
+
+	for _, p := range []string{dir, `\\?\` + dir} {
+		t.Run("", func(t *testing.T) {
+			w := newCollector(t)
+			w.collect(t)
+			addWatch(t, w.w, p)
+			touch(t, dir, "file")
+			rm(t, dir, "file")
+
+			cmpEvents(t, p, w.stop(t), newEvents(t, `
+				create  /file
+				remove  /file
+			`))
+		})
+	}
+}
+
+func TestWindowsWorkers(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	dirs := []string{join(tmp, "a"), join(tmp, "b"), join(tmp, "c")}
+
+	w, err := NewWatcherWith(WithWorkers(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	for _, d := range dirs {
+		mkdir(t, d)
+		addWatch(t, w, d)
+	}
+	for _, d := range dirs {
+		touch(t, d, "file")
+	}
+
+	have := c.stop(t)
+	sort.Slice(have, func(i, j int) bool { return have[i].Name < have[j].Name })
+	cmpEvents(t, tmp, have, newEvents(t, `
+		create  /a/file
+		create  /b/file
+		create  /c/file
+	`))
+}
+
+func TestWindowsSetBufferSize(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newCollector(t, tmp)
+	w.collect(t)
+
+	if err := w.w.SetBufferSize(join(tmp, "nonexistent"), 8192); !errors.Is(err, ErrNonExistentWatch) {
+		t.Errorf("wrong error: %v", err)
+	}
+	if err := w.w.SetBufferSize(tmp, 8192); err != nil {
+		t.Fatal(err)
+	}
+	// The buffer is replaced once the cancelled read completes.
+	for i := 0; w.w.Stats().BufferSizes[tmp] != 8192; i++ {
+		if i > 100 {
+			t.Fatalf("wrong BufferSizes: %v", w.w.Stats().BufferSizes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	touch(t, tmp, "file")
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /file
+	`))
+}
+
+func TestWindowsWholeVolume(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	mkdir(t, tmp, "other")
+	touch(t, tmp, "file")
+
+	w, err := NewWatcherWith(WithWholeVolume(), WithWorkers(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	addWatch(t, w, tmp, "dir")
+	addWatch(t, w, tmp, "file")
+
+	if have := w.WatchList(); len(have) != 2 {
+		t.Errorf("WatchList: %s", have)
+	}
+	if have := w.Stats(); have.Watches != 1 {
+		t.Errorf("Stats: %#v", have)
+	}
+
+	touch(t, tmp, "dir", "new")
+	touch(t, tmp, "other", "new")
+	echoAppend(t, "data", tmp, "file")
+	mv(t, join(tmp, "dir", "new"), tmp, "dir", "renamed")
+	rm(t, tmp, "dir", "renamed")
+
+	cmpEvents(t, tmp, c.stop(t), newEvents(t, `
+		create  /dir/new
+		write   /file
+		rename  /dir/new
+		create  /dir/renamed
+		remove  /dir/renamed
+	`))
+}
+
+func TestWindowsLongNames(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	file := join(tmp, "long file name.txt")
+	touch(t, file)
+
+	buf := make([]uint16, windows.MAX_PATH)
+	n, err := windows.GetShortPathName(windows.StringToUTF16Ptr(file), &buf[0], uint32(len(buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	short := windows.UTF16ToString(buf[:n])
+	if strings.EqualFold(short, file) {
+		t.Skip("8.3 names disabled on this volume")
+	}
+
+	w, err := NewWatcherWith(WithLongNames())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	addWatch(t, w, tmp)
+
+	echoAppend(t, "data", short)
+
+	have := c.stop(t)
+	if len(have) == 0 {
+		t.Fatal("no events")
+	}
+	for _, e := range have {
+		if e.Name != file {
+			t.Errorf("wrong name: %s", e)
+		}
+	}
+}
+
+func TestWindowsMovedFrom(t *testing.T) {
+	var (
+		ino  = &inode{volume: 1}
+		dir1 = &watch{ino: ino, path: `C:\dir1`, mask: sysFSALLEVENTS}
+		dir2 = &watch{ino: ino, path: `C:\dir2`, mask: sysFSALLEVENTS}
+		w    = &readDirChangesW{
+			Events:  make(chan Event, 8),
+			done:    make(chan struct{}),
+			watches: watchMap{1: indexMap{1: dir1, 2: dir2}},
+		}
+	)
+	events := func() []string {
+		var l []string
+		for {
+			select {
+			case e := <-w.Events:
+				l = append(l, e.String())
+			default:
+				return l
+			}
+		}
+	}
+
+	// Moved to the other watch: Rename, and Create with the old name.
+	if !w.removed(dir1, &EventInfo{FileID: 42}, `C:\dir1\file`) {
+		t.Fatal("removed() returned false")
+	}
+	if have := events(); len(have) != 0 {
+		t.Fatalf("Remove not held back: %s", have)
+	}
+	if have := w.movedFrom(1, &EventInfo{FileID: 42}); have != `C:\dir1\file` {
+		t.Errorf("wrong movedFrom: %q", have)
+	}
+	if have := events(); len(have) != 1 || !strings.HasPrefix(have[0], "RENAME ") {
+		t.Errorf("no Rename for the old name: %s", have)
+	}
+
+	// Not added anywhere: Remove after movedDelay.
+	w.removed(dir1, &EventInfo{FileID: 43}, `C:\dir1\file2`)
+	if timeout := w.flushMoved(nil); timeout == windows.INFINITE || timeout > uint32(movedDelay/time.Millisecond)+1 {
+		t.Errorf("wrong timeout: %d", timeout)
+	}
+	time.Sleep(movedDelay * 2)
+	if timeout := w.flushMoved(nil); timeout != windows.INFINITE {
+		t.Errorf("wrong timeout: %d", timeout)
+	}
+	if have := events(); len(have) != 1 || !strings.HasPrefix(have[0], "REMOVE ") {
+		t.Errorf("no Remove: %s", have)
+	}
+	if have := w.movedFrom(1, &EventInfo{FileID: 43}); have != "" {
+		t.Errorf("movedFrom after Remove was sent: %q", have)
+	}
+
+	// Another event for the same watch sends the Remove first.
+	w.removed(dir1, &EventInfo{FileID: 44}, `C:\dir1\file3`)
+	w.flushMoved(dir1)
+	if have := events(); len(have) != 1 || !strings.HasPrefix(have[0], "REMOVE ") {
+		t.Errorf("no Remove: %s", have)
+	}
+}
@@ -0,0 +1,236 @@
+//go:build windows
+
+// Whole-volume mode for the Windows backend (WithWholeVolume).
+//
+// Rather than opening a directory handle for every added path, there is a
+// single recursive watch on the volume root, and events are filtered to the
+// added paths here. The root watch is a regular watch, except that it has
+// prefixes set and events are processed by readVolume() rather than the usual
+// code.
+
+package fsnotify
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/esvos/fsnotify/internal"
+	"golang.org/x/sys/windows"
+)
+
+type volumePrefix struct {
+	path    string // Path as passed to Add(); events are sent relative to this
+	abs     string // Absolute path
+	flags   uint64
+	dir     bool
+	recurse bool
+}
+
+// volumeRoot gets the absolute path and volume root for the path.
+func volumeRoot(pathname string) (abs, root string, err error) {
+	abs, err = filepath.Abs(pathname)
+	if err != nil {
+		return "", "", err
+	}
+	return abs, filepath.VolumeName(abs) + `\`, nil
+}
+
+// Must run within the I/O thread.
+func (w *readDirChangesW) addVolume(pathname string, flags uint64, bufsize int) error {
+	pathname, recurse := recursivePath(pathname)
+
+	attr, err := windows.GetFileAttributes(windows.StringToUTF16Ptr(longPath(pathname)))
+	if err != nil {
+		return os.NewSyscallError("GetFileAttributes", err)
+	}
+	abs, root, err := volumeRoot(pathname)
+	if err != nil {
+		return err
+	}
+
+	ino, err := w.getIno(root)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	watch := w.watches.get(ino)
+	w.mu.Unlock()
+	if watch == nil {
+		watch, err = w.newWatch(ino, root, true, bufsize)
+		if err != nil {
+			return err
+		}
+		watch.prefixes = make(map[string]volumePrefix)
+		watch.ioMu.Lock()
+		defer watch.ioMu.Unlock()
+		w.mu.Lock()
+		w.watches.set(ino, watch)
+		w.mu.Unlock()
+	} else {
+		windows.CloseHandle(ino.handle)
+		watch.ioMu.Lock()
+		defer watch.ioMu.Unlock()
+	}
+
+	key := strings.ToLower(abs)
+	p, ok := watch.prefixes[key]
+	if !ok {
+		p = volumePrefix{
+			path: pathname,
+			abs:  abs,
+			dir:  attr&windows.FILE_ATTRIBUTE_DIRECTORY != 0,
+		}
+	}
+	p.flags |= flags
+	p.recurse = p.recurse || recurse
+	watch.prefixes[key] = p
+
+	prev := watch.mask
+	watch.mask = volumeMask(watch)
+	if prev == 0 {
+		watch.mask |= provisional
+	}
+	err = w.startRead(watch)
+	watch.mask &^= provisional
+	return err
+}
+
+// Must run within the I/O thread.
+func (w *readDirChangesW) remVolume(pathname string) error {
+	pathname, _ = recursivePath(pathname)
+
+	abs, root, err := volumeRoot(pathname)
+	if err != nil {
+		return err
+	}
+	ino, err := w.getIno(root)
+	if err != nil {
+		return err
+	}
+	windows.CloseHandle(ino.handle)
+
+	w.mu.Lock()
+	watch := w.watches.get(ino)
+	w.mu.Unlock()
+	if watch == nil {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, pathname)
+	}
+
+	watch.ioMu.Lock()
+	defer watch.ioMu.Unlock()
+	key := strings.ToLower(abs)
+	if _, ok := watch.prefixes[key]; !ok {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, pathname)
+	}
+	delete(watch.prefixes, key)
+	watch.mask = volumeMask(watch)
+	return w.startRead(watch)
+}
+
+// volumeMask gets the combined flags of all prefixes.
+func volumeMask(watch *watch) uint64 {
+	var mask uint64
+	for _, p := range watch.prefixes {
+		mask |= p.flags
+	}
+	return mask
+}
+
+// matchPrefix finds the prefix for the path: either the path itself, the
+// directory it's in, or any parent directory for recursive watches.
+func (watch *watch) matchPrefix(path string) (volumePrefix, bool) {
+	dir := strings.ToLower(path)
+	for depth := 0; ; depth++ {
+		if p, ok := watch.prefixes[dir]; ok && (depth == 0 || (p.dir && (depth == 1 || p.recurse))) {
+			return p, true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return volumePrefix{}, false
+		}
+		dir = parent
+	}
+}
+
+// sendVolume sends an event for path if it matches one of the added paths.
+func (w *readDirChangesW) sendVolume(watch *watch, path, renamedFrom string, mask uint64, info *EventInfo) {
+	p, ok := watch.matchPrefix(path)
+	if !ok {
+		return
+	}
+	// Changes to a directory's timestamps etc. aren't reported for regular
+	// watches (only for the files in it), so don't report them here either.
+	rel := path[len(p.abs):]
+	if rel == "" && p.dir && mask&(sysFSDELETE|sysFSMOVEDFROM) == 0 {
+		return
+	}
+	if renamedFrom != "" {
+		if from, ok := watch.matchPrefix(renamedFrom); ok {
+			renamedFrom = from.path + renamedFrom[len(from.abs):]
+		}
+	}
+	w.sendEvent(p.path+rel, renamedFrom, p.flags&mask, info)
+}
+
+// readVolume processes the completion of a read for a volume root watch.
+//
+// Must run within an I/O thread, with watch.ioMu held.
+func (w *readDirChangesW) readVolume(watch *watch, dir string, n uint32) {
+	var offset uint32
+	for {
+		if n == 0 {
+			w.sendError(ErrEventOverflow)
+			w.growBuffer(watch)
+			break
+		}
+
+		raw, name, info := parseNotify(watch.buf[offset:], watch.ext)
+		if w.longNames {
+			name = longName(dir, name)
+		}
+		fullname := filepath.Join(dir, name)
+
+		if debug {
+			internal.Debug(fullname, raw.Action)
+		}
+		if w.raw != nil {
+			w.raw(RawEvent{Name: fullname, Mask: uint64(raw.Action)})
+		}
+
+		switch raw.Action {
+		case windows.FILE_ACTION_RENAMED_OLD_NAME:
+			watch.rename = fullname
+			w.sendVolume(watch, fullname, "", sysFSMOVEDFROM, info)
+		case windows.FILE_ACTION_RENAMED_NEW_NAME:
+			w.sendVolume(watch, fullname, watch.rename, sysFSMOVEDTO, info)
+			watch.rename = ""
+		case windows.FILE_ACTION_MODIFIED:
+			w.sendVolume(watch, fullname, "", modifyMask(watch.mask, info), info)
+		case windows.FILE_ACTION_REMOVED:
+			w.sendVolume(watch, fullname, "", sysFSDELETE, info)
+			// Added path was removed; remove the watch like for regular watches.
+			delete(watch.prefixes, strings.ToLower(fullname))
+		default:
+			w.sendVolume(watch, fullname, "", w.toFSnotifyFlags(raw.Action), info)
+		}
+
+		if raw.NextEntryOffset == 0 {
+			break
+		}
+		offset += raw.NextEntryOffset
+		if offset >= n {
+			//lint:ignore ST1005 Windows should be capitalized
+			w.sendError(errors.New("Windows system assumed buffer larger than it is, events have likely been missed"))
+			break
+		}
+	}
+
+	watch.mask = volumeMask(watch)
+	w.shrinkBuffer(watch, n)
+	if err := w.startRead(watch); err != nil {
+		w.sendError(err)
+	}
+}
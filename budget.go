@@ -0,0 +1,268 @@
+package fsnotify
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WatchUsage is information about a path added with [Watcher.Add], for
+// choosing which watch to evict with [WithWatchBudget].
+type WatchUsage struct {
+	Path      string    // Path as added, without "/..." for recursive watches.
+	Watches   int       // Number of watches for Path, including internal ones.
+	Priority  int       // Priority set with WithPriority; 0 if not set.
+	Added     time.Time // When Path was added.
+	LastEvent time.Time // When the last event for Path was sent; zero if none.
+}
+
+// EvictFunc selects which watch to remove when the budget set with
+// [WithWatchBudget] is exceeded. It's called with all paths except the one
+// being added, and returns one of the paths.
+type EvictFunc func(candidates []WatchUsage) string
+
+// EvictLRU evicts the watch that had no events for the longest time; watches
+// that never had an event use the time they were added.
+func EvictLRU(candidates []WatchUsage) string {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return lastUsed(candidates[i]).Before(lastUsed(candidates[j]))
+	})
+	return candidates[0].Path
+}
+
+// EvictPriority evicts the watch with the lowest priority set with
+// [WithPriority], using [EvictLRU] for watches with the same priority.
+func EvictPriority(candidates []WatchUsage) string {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Priority != candidates[j].Priority {
+			return candidates[i].Priority < candidates[j].Priority
+		}
+		return lastUsed(candidates[i]).Before(lastUsed(candidates[j]))
+	})
+	return candidates[0].Path
+}
+
+func lastUsed(u WatchUsage) time.Time {
+	if u.LastEvent.IsZero() {
+		return u.Added
+	}
+	return u.LastEvent
+}
+
+// EvictedError is sent on the Errors channel when a watch was removed to stay
+// within the budget set with [WithWatchBudget].
+type EvictedError struct {
+	Path    string // Path that was removed, as added with Watcher.Add.
+	Watches int    // Number of watches that were removed.
+	For     string // Path that was being added.
+}
+
+func (e *EvictedError) Error() string {
+	return fmt.Sprintf("fsnotify: stopped watching %q (%d watches) to stay within the watch budget for %q",
+		e.Path, e.Watches, e.For)
+}
+
+// Unwrap returns ErrWatchLimit.
+func (e *EvictedError) Unwrap() error { return ErrWatchLimit }
+
+// budget sits between the backend (or the other layers) and the Events channel
+// for WithWatchBudget(): it records when the last event for every path was
+// sent, and sends the errors for evicted paths.
+type budget struct {
+	max     int
+	evict   EvictFunc
+	clock   Clock
+	counts  func() map[string]int // Watcher.WatchCounts()
+	remove  func(string) error    // Watcher.Remove()
+	backend backend               // For wrapError().
+
+	inEv   chan Event // From the backend.
+	inErr  chan error
+	outEv  chan Event // To the user.
+	outErr chan error
+
+	mu      sync.Mutex
+	roots   map[string]*WatchUsage
+	paths   map[string]string // Root → path as added (with "/..." for recursive watches).
+	evicted []error           // Errors to send from run().
+	notify  chan struct{}     // Something was added to evicted.
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newBudget(with watcherOpts, ev chan Event, errs chan error) *budget {
+	evict := with.budgetEvict
+	if evict == nil {
+		evict = EvictLRU
+	}
+	return &budget{
+		max:     with.budget,
+		evict:   evict,
+		clock:   with.clock,
+		inEv:    make(chan Event),
+		inErr:   make(chan error),
+		outEv:   ev,
+		outErr:  errs,
+		roots:   make(map[string]*WatchUsage),
+		paths:   make(map[string]string),
+		notify:  make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// close stops sending events.
+func (b *budget) close() {
+	b.closeOnce.Do(func() { close(b.closing) })
+}
+
+// forget stops tracking path after it was removed.
+func (b *budget) forget(path string) {
+	path, _ = recursivePath(path)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.roots, path)
+	delete(b.paths, path)
+}
+
+// add records that path was added, and removes other paths until the number
+// of watches is within the budget again.
+//
+// The path itself is removed again and an error is returned if it needs more
+// watches than the budget allows on its own.
+func (b *budget) add(path string, priority int) error {
+	root, _ := recursivePath(path)
+	b.mu.Lock()
+	if u, ok := b.roots[root]; ok {
+		u.Priority = priority
+	} else {
+		b.roots[root] = &WatchUsage{Path: root, Priority: priority, Added: b.clock.Now()}
+	}
+	b.paths[root] = path
+	b.mu.Unlock()
+
+	for {
+		counts := b.counts()
+		b.mu.Lock()
+		var (
+			total      int
+			candidates = make([]WatchUsage, 0, len(b.roots))
+		)
+		for p, u := range b.roots {
+			u.Watches = counts[p]
+			if u.Watches == 0 { // Backends that only have the path in WatchInfo.
+				u.Watches = 1
+			}
+			total += u.Watches
+			if p != root {
+				candidates = append(candidates, *u)
+			}
+		}
+		if total <= b.max {
+			b.mu.Unlock()
+			return nil
+		}
+		if len(candidates) == 0 {
+			n := b.roots[root].Watches
+			delete(b.roots, root)
+			delete(b.paths, root)
+			b.mu.Unlock()
+			_ = b.remove(path)
+			return fmt.Errorf("%w: %q needs %d watches, and the budget is %d", ErrWatchLimit, root, n, b.max)
+		}
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].Path < candidates[j].Path })
+		victim := b.evict(candidates)
+		u, ok := b.roots[victim]
+		if !ok {
+			b.mu.Unlock()
+			return fmt.Errorf("fsnotify: EvictFunc returned %q, which isn't a watched path", victim)
+		}
+		rm := b.paths[victim]
+		delete(b.roots, victim)
+		delete(b.paths, victim)
+		b.evicted = append(b.evicted, wrapError(b.backend, "watch", rm,
+			&EvictedError{Path: rm, Watches: u.Watches, For: path}))
+		b.mu.Unlock()
+
+		select {
+		case b.notify <- struct{}{}:
+		default:
+		}
+		if err := b.remove(rm); err != nil {
+			return err
+		}
+	}
+}
+
+// used records an event for the path added with Watcher.Add that name is in.
+func (b *budget) used(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var (
+		best *WatchUsage
+		now  = b.clock.Now()
+	)
+	for p, u := range b.roots {
+		if (name == p || strings.HasPrefix(name, p+string(filepath.Separator))) &&
+			(best == nil || len(p) > len(best.Path)) {
+			best = u
+		}
+	}
+	if best != nil {
+		best.LastEvent = now
+	}
+}
+
+func (b *budget) run() {
+	defer func() {
+		close(b.done)
+		close(b.outErr)
+		close(b.outEv)
+	}()
+
+	inEv, inErr := b.inEv, b.inErr
+	for inEv != nil || inErr != nil {
+		select {
+		case <-b.closing:
+			return
+		case err, ok := <-inErr:
+			if !ok {
+				inErr = nil
+				continue
+			}
+			select {
+			case <-b.closing:
+				return
+			case b.outErr <- err:
+			}
+		case e, ok := <-inEv:
+			if !ok {
+				inEv = nil
+				continue
+			}
+			b.used(e.Name)
+			select {
+			case <-b.closing:
+				return
+			case b.outEv <- e:
+			}
+		case <-b.notify:
+			b.mu.Lock()
+			errs := b.evicted
+			b.evicted = nil
+			b.mu.Unlock()
+			for _, err := range errs {
+				select {
+				case <-b.closing:
+					return
+				case b.outErr <- err:
+				}
+			}
+		}
+	}
+}
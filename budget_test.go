@@ -0,0 +1,135 @@
+package fsnotify
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestWithWatchBudget(t *testing.T) {
+	if isKqueue() {
+		t.Skip("kqueue adds a watch for every file in a watched directory")
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	for _, d := range []string{"a", "b", "c", "d"} {
+		mkdir(t, tmp, d)
+	}
+
+	w, err := NewWatcherWith(WithWatchBudget(3, EvictPriority))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var (
+		evicted = make(chan string, 8)
+		done    = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case _, ok := <-w.Events:
+				if !ok {
+					return
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				var e *EvictedError
+				if !errors.As(err, &e) {
+					t.Error(err)
+					continue
+				}
+				evicted <- e.Path
+			}
+		}
+	}()
+
+	if err := w.AddWith(join(tmp, "a"), WithPriority(1)); err != nil {
+		t.Fatal(err)
+	}
+	addWatch(t, w, tmp, "b")
+	eventSeparator()
+	addWatch(t, w, tmp, "c")
+	eventSeparator()
+	touch(t, tmp, "b", "file") // b had an event more recently than c.
+	eventSeparator()
+	addWatch(t, w, tmp, "d") // a has a higher priority, so c is evicted.
+
+	have := w.WatchList()
+	sort.Strings(have)
+	if want := []string{join(tmp, "a"), join(tmp, "b"), join(tmp, "d")}; !reflect.DeepEqual(have, want) {
+		t.Errorf("wrong WatchList:\nhave: %q\nwant: %q", have, want)
+	}
+
+	var got []string
+	timeout := time.After(2 * time.Second)
+	for len(got) < 1 {
+		select {
+		case p := <-evicted:
+			got = append(got, p)
+		case <-timeout:
+			t.Fatalf("timeout; evicted: %q", got)
+		}
+	}
+	if want := []string{join(tmp, "c")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong evicted:\nhave: %q\nwant: %q", got, want)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
+
+func TestWithWatchBudgetTooLarge(t *testing.T) {
+	if !enableRecurse {
+		t.Skip("recursion not enabled")
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "a")
+	mkdir(t, tmp, "dir")
+	mkdir(t, tmp, "dir", "1")
+	mkdir(t, tmp, "dir", "2")
+
+	w, err := NewWatcherWith(WithWatchBudget(2, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	go func() {
+		for range w.Errors {
+		}
+	}()
+	addWatch(t, w, tmp, "a")
+
+	err = w.Add(join(tmp, "dir", "..."))
+	if errors.Is(err, xErrUnsupported) {
+		t.Skip(err)
+	}
+	if !errors.Is(err, ErrWatchLimit) {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if have := w.WatchList(); len(have) != 0 {
+		t.Errorf("wrong WatchList: %q", have)
+	}
+}
+
+func TestEvictLRU(t *testing.T) {
+	now := time.Now()
+	have := EvictLRU([]WatchUsage{
+		{Path: "a", Added: now.Add(-time.Hour), LastEvent: now},
+		{Path: "b", Added: now.Add(-time.Minute)},
+		{Path: "c", Added: now.Add(-time.Hour), LastEvent: now.Add(-time.Second)},
+	})
+	if have != "b" {
+		t.Errorf("have %q; want %q", have, "b")
+	}
+}
@@ -0,0 +1,68 @@
+package fsnotify
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// watchedCase gets the path path is watched as, if it's only different in case
+// and on a case-insensitive filesystem (the default on Windows and macOS).
+// This way Remove("C:\Dir") works for a watch added as "c:\dir", and adding
+// the same directory twice with a different case doesn't add two watches.
+//
+// The path is returned as-is if it's not watched yet; events use the case of
+// the path as it was first added.
+func (w *Watcher) watchedCase(path string) string {
+	clean, recurse := recursivePath(path)
+	if !caseInsensitive(clean) {
+		return path
+	}
+	var match string
+	for _, p := range w.WatchList() {
+		p, _ = recursivePath(p)
+		if p == clean {
+			return path
+		}
+		if match == "" && strings.EqualFold(p, clean) {
+			match = p
+		}
+	}
+	if match == "" {
+		return path
+	}
+	if recurse {
+		match = filepath.Join(match, "...")
+	}
+	return match
+}
+
+// caseInsensitive reports if path is on a case-insensitive filesystem, by
+// checking if the last element with letters in it refers to the same file with
+// the case swapped. Elements that don't exist are skipped.
+func caseInsensitive(path string) bool {
+	for p := path; ; {
+		base := filepath.Base(p)
+		if swapped := swapCase(base); swapped != base {
+			if a, err := os.Lstat(p); err == nil {
+				b, err := os.Lstat(filepath.Join(filepath.Dir(p), swapped))
+				return err == nil && os.SameFile(a, b)
+			}
+		}
+		dir := filepath.Dir(p)
+		if dir == p {
+			return false
+		}
+		p = dir
+	}
+}
+
+func swapCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, s)
+}
@@ -0,0 +1,54 @@
+package fsnotify
+
+import "time"
+
+// Clock is the source of time for the time-based options, for use with
+// [WithClock].
+//
+// This is meant for tests: a fake clock that's advanced by the test makes
+// debouncing and polling run instantly and deterministically, instead of
+// sleeping. The fsnotifytest package has one.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTimer creates a Timer that sends the current time on its channel
+	// after at least d.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer created by [Clock.NewTimer]. It works like time.Timer.
+type Timer interface {
+	// C returns the channel the time is sent on.
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing. Returns false if it already
+	// expired or was stopped.
+	Stop() bool
+
+	// Reset changes the timer to expire after d. Returns true if the timer
+	// had been active.
+	Reset(d time.Duration) bool
+}
+
+// realClock is the default Clock, using the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                 { return time.Now() }
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{t: time.NewTimer(d)} }
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time        { return t.t.C }
+func (t realTimer) Stop() bool                 { return t.t.Stop() }
+func (t realTimer) Reset(d time.Duration) bool { return t.t.Reset(d) }
+
+// stopTimer stops t and drains its channel, so it can be Reset.
+func stopTimer(t Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C():
+		default:
+		}
+	}
+}
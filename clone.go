@@ -0,0 +1,120 @@
+package fsnotify
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// cloneState records how a Watcher was created and which paths were added to
+// it, for Watcher.Clone().
+type cloneState struct {
+	new func() (*Watcher, error)
+
+	mu    sync.Mutex
+	paths map[string]cloneWatch // Paths added by the user.
+}
+
+// cloneWatch is a path added by the user: the options of every call, and the
+// union of their operations, as AddWith adds operations to an existing watch.
+type cloneWatch struct {
+	opts []addOpt
+	op   Op
+}
+
+func newCloneState(new func() (*Watcher, error)) *cloneState {
+	return &cloneState{new: new, paths: make(map[string]cloneWatch)}
+}
+
+// track records that path was added by the user.
+func (c *cloneState) track(path string, opts ...addOpt) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cw := c.paths[path]
+	cw.opts = append(cw.opts, opts...)
+	cw.op |= getOptions(opts...).op
+	c.paths[path] = cw
+}
+
+// setOpts records opts for path, without changing the operations.
+func (c *cloneState) setOpts(path string, opts ...addOpt) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cw, ok := c.paths[path]; ok {
+		cw.opts = append(cw.opts, opts...)
+		c.paths[path] = cw
+	}
+}
+
+// forget removes path after the user removed it.
+func (c *cloneState) forget(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.paths, path)
+}
+
+// removeOps removes op from the options path is added with.
+func (c *cloneState) removeOps(path string, op Op) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cw, ok := c.paths[path]; ok {
+		cw.op &^= op
+		c.paths[path] = cw
+	}
+}
+
+// Clone creates a new Watcher with the same options as w, and adds all paths
+// that were added to w with [Watcher.Add], [Watcher.AddWith], or
+// [Watcher.UpdateWith] (and not removed since) with the same options. This
+// can be used to start over after the backend got in a bad state, for example
+// after a lot of [ErrEventOverflow] errors, without having to keep track of
+// the paths and options.
+//
+// w isn't changed, and the new Watcher is only returned if all paths could be
+// added; otherwise it's closed and the error from the first path that failed
+// is returned. The new Watcher is independent from w: start reading its
+// Events and Errors before closing w to swap them. Events for changes made
+// while both are open may be sent by both.
+//
+// Paths added with AddAt, AddFd, AddFile, AddInNamespace, or AddMount aren't
+// added to the new Watcher. Watchers from [SharedWatcher.Scope] can't be
+// cloned.
+func (w *Watcher) Clone() (*Watcher, error) {
+	if w.clone == nil {
+		return nil, w.wrap("clone", "", fmt.Errorf("%w: Clone", xErrUnsupported))
+	}
+
+	w.clone.mu.Lock()
+	paths := make([]string, 0, len(w.clone.paths))
+	opts := make(map[string][]addOpt, len(w.clone.paths))
+	for p, cw := range w.clone.paths {
+		paths = append(paths, p)
+		opts[p] = append(append([]addOpt(nil), cw.opts...), WithOps(cw.op))
+	}
+	w.clone.mu.Unlock()
+	sort.Strings(paths)
+
+	nw, err := w.clone.new()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		if err := nw.AddWith(p, opts[p]...); err != nil {
+			nw.Close()
+			return nil, err
+		}
+	}
+	return nw, nil
+}
@@ -19,6 +19,10 @@ Commands:
     watch [paths]  Watch the paths for changes and print the events.
     file  [file]   Watch a single file for changes.
     dedup [paths]  Watch the paths for changes, suppressing duplicate events.
+    run [flags] [paths] [-- command]
+                   Watch the paths, with options to watch recursively, filter
+                   events, print JSON, and run a command on changes. Use
+                   "run -h" to list the flags.
 `[1:]
 
 func exit(format string, a ...interface{}) {
@@ -61,5 +65,7 @@ func main() {
 		file(args...)
 	case "dedup":
 		dedup(args...)
+	case "run":
+		run(args...)
 	}
 }
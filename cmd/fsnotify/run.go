@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/esvos/fsnotify"
+)
+
+// run is a more complete tool than the other examples: events can be filtered,
+// printed as JSON, and a command can be run when something changes (like
+// watchexec or entr).
+func run(args ...string) {
+	f := flag.NewFlagSet("run", flag.ExitOnError)
+	var (
+		recurse = f.Bool("r", false, "watch directories recursively")
+		ops     = f.String("op", "", "only these operations, comma-separated (e.g. create,write)")
+		match   = f.String("match", "", "only filenames matching these patterns, comma-separated (e.g. *.go,*.mod)")
+		exclude = f.String("exclude", "", "skip filenames matching these patterns, comma-separated")
+		jsonOut = f.Bool("json", false, "print events as JSON, one per line")
+		quiet   = f.Bool("q", false, "don't print events")
+		delay   = f.Duration("delay", 100*time.Millisecond, "wait this long for more events before running the command")
+		restart = f.Bool("restart", false, "kill the command if it's still running, instead of waiting for it to finish")
+	)
+	f.Usage = func() {
+		fmt.Fprintf(f.Output(), "usage: %s run [flags] path.. [-- command..]\n\n", filepath.Base(os.Args[0]))
+		f.PrintDefaults()
+	}
+	f.Parse(args)
+
+	paths, command := f.Args(), []string(nil)
+	for i, a := range paths {
+		if a == "--" {
+			paths, command = paths[:i], paths[i+1:]
+			break
+		}
+	}
+	if len(paths) < 1 {
+		exit("must specify at least one path to watch")
+	}
+
+	filter, err := newRunFilter(*ops, *match, *exclude)
+	if err != nil {
+		exit("%s", err)
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		exit("creating a new watcher: %s", err)
+	}
+	defer w.Close()
+
+	// Recursive watches aren't supported yet, so add all subdirectories, and
+	// add new directories as they're created (for which Create is needed).
+	addOp := filter.op
+	if *recurse {
+		addOp |= fsnotify.Create
+	}
+	add := func(p string) error {
+		if !*recurse {
+			return w.AddWith(p, fsnotify.WithOps(addOp))
+		}
+		return filepath.WalkDir(p, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && path != p {
+				return nil
+			}
+			return w.AddWith(path, fsnotify.WithOps(addOp))
+		})
+	}
+	for _, p := range paths {
+		if err := add(p); err != nil {
+			exit("%q: %s", p, err)
+		}
+	}
+
+	// Run the command after there were no events for the delay, with the last
+	// event. Events while the command is running are collapsed into a single
+	// run afterwards.
+	var (
+		trigger = make(chan fsnotify.Event, 1)
+		mu      sync.Mutex
+		last    fsnotify.Event
+		timer   = time.AfterFunc(time.Hour, func() {
+			mu.Lock()
+			e := last
+			mu.Unlock()
+			select {
+			case trigger <- e:
+			default:
+			}
+		})
+	)
+	timer.Stop()
+	r := &runner{command: command, restart: *restart}
+	if len(command) > 0 {
+		go r.loop(trigger)
+	}
+
+	// Stop the command on ^C, rather than leaving it running.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	if !*quiet && !*jsonOut {
+		printTime("ready; press ^C to exit")
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		select {
+		case sig := <-sigs:
+			r.stop(sig)
+			return
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			if *jsonOut {
+				enc.Encode(struct {
+					Time  time.Time `json:"time"`
+					Error string    `json:"error"`
+				}{time.Now(), err.Error()})
+			} else {
+				printTime("ERROR: %s", err)
+			}
+		case e, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if *recurse && e.Has(fsnotify.Create) {
+				if st, err := os.Lstat(e.Name); err == nil && st.IsDir() {
+					if err := add(e.Name); err != nil {
+						printTime("ERROR: %q: %s", e.Name, err)
+					}
+				}
+			}
+			if !filter.match(e) {
+				continue
+			}
+
+			switch {
+			case *quiet:
+			case *jsonOut:
+				enc.Encode(struct {
+					Time time.Time `json:"time"`
+					Name string    `json:"name"`
+					Op   string    `json:"op"`
+				}{time.Now(), e.Name, e.Op.String()})
+			default:
+				printTime("%s", e)
+			}
+
+			if len(command) > 0 {
+				mu.Lock()
+				last = e
+				mu.Unlock()
+				timer.Reset(*delay)
+			}
+		}
+	}
+}
+
+// runner runs the command for every event sent on trigger. The path and
+// operation are set in the FSNOTIFY_PATH and FSNOTIFY_OP environment variables.
+type runner struct {
+	command []string
+	restart bool
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	done    chan struct{} // Closed when cmd exits; nil if it was never started.
+	stopped bool
+}
+
+func (r *runner) loop(trigger <-chan fsnotify.Event) {
+	for e := range trigger {
+		r.mu.Lock()
+		cmd, done := r.cmd, r.done
+		r.mu.Unlock()
+
+		// Wait for the previous run to finish, or kill it with -restart.
+		if done != nil {
+			if r.restart {
+				select {
+				case <-done:
+				default:
+					cmd.Process.Kill()
+				}
+			}
+			<-done
+		}
+
+		r.mu.Lock()
+		if r.stopped {
+			r.mu.Unlock()
+			return
+		}
+		cmd = exec.Command(r.command[0], r.command[1:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		cmd.Env = append(os.Environ(), "FSNOTIFY_PATH="+e.Name, "FSNOTIFY_OP="+e.Op.String())
+		if err := cmd.Start(); err != nil {
+			r.cmd, r.done = nil, nil
+			r.mu.Unlock()
+			printTime("ERROR: %s", err)
+			continue
+		}
+		done = make(chan struct{})
+		r.cmd, r.done = cmd, done
+		r.mu.Unlock()
+		go func(cmd *exec.Cmd, done chan struct{}) {
+			if err := cmd.Wait(); err != nil {
+				printTime("%s: %s", r.command[0], err)
+			}
+			close(done)
+		}(cmd, done)
+	}
+}
+
+// stop forwards sig to the command if it's running, and kills it if it didn't
+// exit after a few seconds. No new commands are started after this.
+func (r *runner) stop(sig os.Signal) {
+	r.mu.Lock()
+	r.stopped = true
+	cmd, done := r.cmd, r.done
+	r.mu.Unlock()
+	if done == nil {
+		return
+	}
+
+	// Signal() doesn't work for os.Interrupt on Windows; just kill it.
+	if err := cmd.Process.Signal(sig); err != nil {
+		cmd.Process.Kill()
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		<-done
+	}
+}
+
+type runFilter struct {
+	op      fsnotify.Op
+	include []string
+	exclude []string
+}
+
+func newRunFilter(ops, match, exclude string) (runFilter, error) {
+	f := runFilter{op: fsnotify.Create | fsnotify.Write | fsnotify.Remove | fsnotify.Rename | fsnotify.Chmod}
+	if ops != "" {
+		f.op = 0
+		for _, name := range strings.Split(ops, ",") {
+			op, err := fsnotify.ParseOp(strings.TrimSpace(name))
+			if err != nil {
+				return f, err
+			}
+			f.op |= op
+		}
+	}
+	for _, m := range []struct {
+		s    string
+		list *[]string
+	}{{match, &f.include}, {exclude, &f.exclude}} {
+		if m.s == "" {
+			continue
+		}
+		for _, pat := range strings.Split(m.s, ",") {
+			if _, err := filepath.Match(pat, ""); err != nil {
+				return f, fmt.Errorf("invalid pattern %q: %w", pat, err)
+			}
+			*m.list = append(*m.list, pat)
+		}
+	}
+	return f, nil
+}
+
+func (f runFilter) match(e fsnotify.Event) bool {
+	if e.Op&f.op == 0 {
+		return false
+	}
+	base := filepath.Base(e.Name)
+	for _, pat := range f.exclude {
+		if ok, _ := filepath.Match(pat, base); ok {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, pat := range f.include {
+		if ok, _ := filepath.Match(pat, base); ok {
+			return true
+		}
+	}
+	return false
+}
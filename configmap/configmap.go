@@ -0,0 +1,274 @@
+// Package configmap watches Kubernetes ConfigMap and Secret volumes.
+//
+// The kubelet doesn't update the files in these volumes in place; the layout
+// looks like:
+//
+//	/etc/config/key               → ..data/key
+//	/etc/config/..data            → ..2024_01_02_15_04_05.123456789
+//	/etc/config/..2024_01_02_[..] (directory with the actual files)
+//
+// On update it writes a new timestamped directory, creates a "..data_tmp"
+// symlink to it, renames that over "..data", and removes the old directory.
+// Watching the key files directly doesn't work, as the file the symlink points
+// to is never written to, and watching the directory gives a lot of events
+// that don't mean much on their own.
+//
+// This sends a single event for every key that changed on every update;
+// updates in quick succession may be merged. The same layout is used for
+// projected volumes and downward API volumes.
+package configmap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/esvos/fsnotify"
+)
+
+// Name of the symlink that's swapped on updates.
+const dataLink = "..data"
+
+// Watcher watches a ConfigMap or Secret volume.
+type Watcher struct {
+	// Events sends an event for every key that changed: Write if the contents
+	// changed, Create for new keys, and Remove for keys that were removed. The
+	// Name is the path of the key in the volume (e.g. "/etc/config/key").
+	Events chan fsnotify.Event
+
+	// Errors sends any errors from the watcher, and errors reading the keys;
+	// this must be read, like fsnotify.Watcher.Errors.
+	Errors chan error
+
+	dir    string
+	keys   map[string]struct{} // nil for all keys.
+	w      *fsnotify.Watcher
+	target string            // Current ..data target.
+	sums   map[string][]byte // Checksum of every key.
+
+	done     chan struct{}
+	doneMu   sync.Mutex
+	doneResp chan struct{}
+}
+
+// New starts watching the volume mounted at dir. Only the keys given are
+// watched, or all keys if there are none.
+func New(dir string, keys ...string) (*Watcher, error) {
+	dir = filepath.Clean(dir)
+	if _, err := os.Readlink(filepath.Join(dir, dataLink)); err != nil {
+		return nil, fmt.Errorf("configmap: %q doesn't look like a ConfigMap or Secret volume: %w", dir, err)
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	c := &Watcher{
+		Events:   make(chan fsnotify.Event),
+		Errors:   make(chan error),
+		dir:      dir,
+		w:        w,
+		done:     make(chan struct{}),
+		doneResp: make(chan struct{}),
+	}
+	if len(keys) > 0 {
+		c.keys = make(map[string]struct{}, len(keys))
+		for _, k := range keys {
+			c.keys[k] = struct{}{}
+		}
+	}
+
+	// Watch before reading the current state, so that nothing gets lost.
+	if err := w.Add(dir); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if _, err := c.update(); err != nil {
+		w.Close()
+		return nil, err
+	}
+	go c.run()
+	return c, nil
+}
+
+// Returns true if the event was sent, or false if watcher is closed.
+func (c *Watcher) sendEvent(e fsnotify.Event) bool {
+	select {
+	case <-c.done:
+		return false
+	case c.Events <- e:
+		return true
+	}
+}
+
+// Returns true if the error was sent, or false if watcher is closed.
+func (c *Watcher) sendError(err error) bool {
+	if err == nil {
+		return true
+	}
+	select {
+	case <-c.done:
+		return false
+	case c.Errors <- err:
+		return true
+	}
+}
+
+func (c *Watcher) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops watching and closes the Events and Errors channels.
+func (c *Watcher) Close() error {
+	c.doneMu.Lock()
+	if c.isClosed() {
+		c.doneMu.Unlock()
+		return nil
+	}
+	close(c.done)
+	c.doneMu.Unlock()
+
+	err := c.w.Close()
+	<-c.doneResp
+	return err
+}
+
+func (c *Watcher) run() {
+	defer func() {
+		close(c.doneResp)
+		close(c.Errors)
+		close(c.Events)
+	}()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case err, ok := <-c.w.Errors:
+			if !ok {
+				return
+			}
+			if !c.sendError(err) {
+				return
+			}
+		case _, ok := <-c.w.Events:
+			if !ok {
+				return
+			}
+			// Every update creates and removes a bunch of files; just check if
+			// ..data points somewhere else on every event, rather than trying
+			// to make sense of them.
+			events, err := c.update()
+			for _, e := range events {
+				if !c.sendEvent(e) {
+					return
+				}
+			}
+			if !c.sendError(err) {
+				return
+			}
+		}
+	}
+}
+
+// update reads all keys if the ..data symlink changed, and returns the events
+// for the keys that changed.
+func (c *Watcher) update() ([]fsnotify.Event, error) {
+	target, err := os.Readlink(filepath.Join(c.dir, dataLink))
+	if err != nil {
+		if os.IsNotExist(err) { // In the middle of an update.
+			return nil, nil
+		}
+		return nil, fmt.Errorf("configmap: %w", err)
+	}
+	if target == c.target {
+		return nil, nil
+	}
+	first := c.sums == nil
+	c.target = target
+
+	// Keys can be in subdirectories if the items have a path with a "/".
+	var (
+		root = filepath.Join(c.dir, target)
+		sums = make(map[string][]byte, len(c.sums))
+	)
+	if filepath.IsAbs(target) {
+		root = target
+	}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		key, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		key = filepath.ToSlash(key)
+		if strings.HasPrefix(key, "..") || !c.watched(key) {
+			return nil
+		}
+		sums[key], err = checksum(path)
+		return err
+	})
+	if err != nil {
+		if os.IsNotExist(err) { // Updated again while reading; try again on the next event.
+			c.target = ""
+			return nil, nil
+		}
+		return nil, fmt.Errorf("configmap: %w", err)
+	}
+
+	var events []fsnotify.Event
+	if !first {
+		for key, sum := range sums {
+			old, ok := c.sums[key]
+			switch {
+			case !ok:
+				events = append(events, fsnotify.Event{Name: filepath.Join(c.dir, key), Op: fsnotify.Create})
+			case !bytes.Equal(old, sum):
+				events = append(events, fsnotify.Event{Name: filepath.Join(c.dir, key), Op: fsnotify.Write})
+			}
+		}
+		for key := range c.sums {
+			if _, ok := sums[key]; !ok {
+				events = append(events, fsnotify.Event{Name: filepath.Join(c.dir, key), Op: fsnotify.Remove})
+			}
+		}
+		sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+	}
+	c.sums = sums
+	return events, nil
+}
+
+func (c *Watcher) watched(key string) bool {
+	if c.keys == nil {
+		return true
+	}
+	_, ok := c.keys[key]
+	return ok
+}
+
+func checksum(path string) ([]byte, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fp); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
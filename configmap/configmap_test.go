@@ -0,0 +1,105 @@
+package configmap
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// update does what the kubelet does to update a volume.
+func update(t *testing.T, dir, version string, files map[string]string) {
+	t.Helper()
+	ts := "..2024_01_02_15_04_05." + version
+	for k, v := range files {
+		p := filepath.Join(dir, ts, k)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(v), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old, _ := os.Readlink(filepath.Join(dir, dataLink))
+	if err := os.Symlink(ts, filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, dataLink)); err != nil {
+		t.Fatal(err)
+	}
+	for k := range files {
+		k = strings.SplitN(k, "/", 2)[0]
+		os.Symlink(filepath.Join(dataLink, k), filepath.Join(dir, k))
+	}
+	if old != "" {
+		if err := os.RemoveAll(filepath.Join(dir, old)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	if _, err := New(t.TempDir()); err == nil {
+		t.Fatal("no error for directory without ..data")
+	}
+
+	for _, keys := range [][]string{nil, {"b", "sub/c"}} {
+		t.Run(fmt.Sprint(keys), func(t *testing.T) {
+			dir := t.TempDir()
+			update(t, dir, "1", map[string]string{"a": "1", "b": "1", "sub/c": "1"})
+			w, err := New(dir, keys...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+
+			var (
+				events = make(chan string)
+				have   []string
+			)
+			go func() {
+				defer close(events)
+				for {
+					select {
+					case err, ok := <-w.Errors:
+						if !ok {
+							return
+						}
+						t.Error(err)
+					case e, ok := <-w.Events:
+						if !ok {
+							return
+						}
+						rel, _ := filepath.Rel(dir, e.Name)
+						events <- e.Op.String() + " " + filepath.ToSlash(rel)
+					}
+				}
+			}()
+
+			// Updates in quick succession may be seen as one.
+			update(t, dir, "2", map[string]string{"a": "2", "b": "2", "sub/c": "1", "d": "1"})
+			time.Sleep(200 * time.Millisecond)
+			update(t, dir, "3", map[string]string{"a": "2", "sub/c": "2", "d": "1"})
+			timeout := time.After(time.Second)
+		loop:
+			for {
+				select {
+				case e := <-events:
+					have = append(have, e)
+				case <-timeout:
+					break loop
+				}
+			}
+
+			want := "WRITE a, WRITE b, CREATE d, REMOVE b, WRITE sub/c"
+			if keys != nil {
+				want = "WRITE b, REMOVE b, WRITE sub/c"
+			}
+			if h := strings.Join(have, ", "); h != want {
+				t.Errorf("\nhave: %s\nwant: %s", h, want)
+			}
+		})
+	}
+}
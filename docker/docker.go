@@ -0,0 +1,209 @@
+// Package docker watches files in containers from the host.
+//
+// Files in a container are also on the host filesystem: files in volumes and
+// bind mounts are in the mount source, and other files are in the overlayfs
+// directories of the container. This resolves a path in a container to the
+// path on the host, so that it can be watched without running anything in the
+// container.
+//
+// The Docker Engine API is used to look up containers; this also works with
+// Podman's Docker-compatible API. For other OCI runtimes use [ResolvePid] with
+// the PID of a process in the container.
+//
+// This needs to run as root (or a user that can read the Docker data
+// directory), and only works with a Docker daemon on the same machine.
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/esvos/fsnotify"
+)
+
+// DefaultSocket is the Docker API socket used if DOCKER_HOST isn't set.
+const DefaultSocket = "/var/run/docker.sock"
+
+// ErrNotFound is returned if the container doesn't exist.
+var ErrNotFound = errors.New("container not found")
+
+// Timeout for API requests.
+var timeout = 10 * time.Second
+
+// Mapping is a path in a container and its location on the host.
+type Mapping struct {
+	Container string // Path in the container.
+	Host      string // Path on the host.
+}
+
+// ContainerPath gets the path in the container for a path on the host, such as
+// the Name of an event. Returns the path unchanged if it's not in the mapping.
+func (m Mapping) ContainerPath(host string) string {
+	if host == m.Host {
+		return m.Container
+	}
+	rel := strings.TrimPrefix(host, m.Host+string(filepath.Separator))
+	if rel == host {
+		return host
+	}
+	return path.Join(m.Container, filepath.ToSlash(rel))
+}
+
+// Add resolves path in container and adds it to the watcher.
+//
+// The Name of events will be the path on the host; use
+// [Mapping.ContainerPath] to get the path in the container.
+func Add(w *fsnotify.Watcher, container, path string) (Mapping, error) {
+	m, err := Resolve(container, path)
+	if err != nil {
+		return m, err
+	}
+	return m, w.Add(m.Host)
+}
+
+// Resolve gets the location of path in container on the host. container is the
+// name or ID of a container.
+//
+// Paths in volumes and bind mounts resolve to the mount source. Other paths
+// resolve to the overlayfs merged directory while the container is running,
+// or the upper directory (which only has files changed in the container) if
+// it's not. Only the overlay2 and overlay storage drivers are supported.
+//
+// The socket is read from DOCKER_HOST if it's set to "unix://[path]", or
+// [DefaultSocket] otherwise.
+func Resolve(container, path string) (Mapping, error) {
+	m := Mapping{Container: path}
+	if !strings.HasPrefix(path, "/") {
+		return m, fmt.Errorf("docker: path must be absolute: %q", path)
+	}
+
+	c, err := inspect(container)
+	if err != nil {
+		return m, err
+	}
+
+	// Mounts, with the longest destination that matches.
+	var mount *apiMount
+	for i, mt := range c.Mounts {
+		d := strings.TrimSuffix(mt.Destination, "/")
+		if path != mt.Destination && path != d && !strings.HasPrefix(path, d+"/") {
+			continue
+		}
+		if mount == nil || len(mt.Destination) > len(mount.Destination) {
+			mount = &c.Mounts[i]
+		}
+	}
+	if mount != nil {
+		if mount.Source == "" {
+			return m, fmt.Errorf("docker: %q in container %q is a %s mount, which isn't on the host", path, container, mount.Type)
+		}
+		m.Host = join(mount.Source, strings.TrimPrefix(path, strings.TrimSuffix(mount.Destination, "/")))
+		return m, nil
+	}
+
+	switch c.GraphDriver.Name {
+	case "overlay2", "overlay":
+	default:
+		return m, fmt.Errorf("docker: storage driver %q for container %q not supported", c.GraphDriver.Name, container)
+	}
+	dir := c.GraphDriver.Data["UpperDir"]
+	if c.State.Running && c.GraphDriver.Data["MergedDir"] != "" {
+		dir = c.GraphDriver.Data["MergedDir"]
+	}
+	if dir == "" {
+		return m, fmt.Errorf("docker: no overlayfs directory for container %q", container)
+	}
+	m.Host = join(dir, path)
+	return m, nil
+}
+
+// ResolvePid gets the location of path in the container that process pid is
+// in, through /proc/[pid]/root. This works with any container runtime, but
+// only on Linux, and only while the process is running.
+func ResolvePid(pid int, path string) Mapping {
+	return Mapping{Container: path, Host: join("/proc/"+strconv.Itoa(pid)+"/root", path)}
+}
+
+func join(host, path string) string {
+	return filepath.Join(host, filepath.FromSlash(path))
+}
+
+type (
+	apiContainer struct {
+		State struct {
+			Running bool
+		}
+		GraphDriver struct {
+			Name string
+			Data map[string]string
+		}
+		Mounts []apiMount
+	}
+	apiMount struct {
+		Type        string
+		Source      string
+		Destination string
+	}
+	apiError struct {
+		Message string `json:"message"`
+	}
+)
+
+// inspect gets information about a container from the Docker API.
+func inspect(container string) (apiContainer, error) {
+	var c apiContainer
+	socket := DefaultSocket
+	if h := os.Getenv("DOCKER_HOST"); h != "" {
+		if !strings.HasPrefix(h, "unix://") {
+			return c, fmt.Errorf("docker: DOCKER_HOST must be a unix socket: %q", h)
+		}
+		socket = strings.TrimPrefix(h, "unix://")
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get("http://docker/containers/" + url.PathEscape(container) + "/json")
+	if err != nil {
+		return c, fmt.Errorf("docker: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return c, fmt.Errorf("docker: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e apiError
+		if json.Unmarshal(body, &e) != nil || e.Message == "" {
+			e.Message = resp.Status
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return c, fmt.Errorf("docker: %w: %s", ErrNotFound, e.Message)
+		}
+		return c, fmt.Errorf("docker: %s", e.Message)
+	}
+	if err := json.Unmarshal(body, &c); err != nil {
+		return c, fmt.Errorf("docker: %w", err)
+	}
+	return c, nil
+}
@@ -0,0 +1,88 @@
+package docker
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+const testContainer = `{
+	"State": {"Running": true},
+	"GraphDriver": {
+		"Name": "overlay2",
+		"Data": {"MergedDir": "/var/lib/docker/overlay2/x/merged", "UpperDir": "/var/lib/docker/overlay2/x/diff"}
+	},
+	"Mounts": [
+		{"Type": "volume", "Source": "/var/lib/docker/volumes/v/_data", "Destination": "/data"},
+		{"Type": "bind", "Source": "/home/user/cfg", "Destination": "/data/cfg"},
+		{"Type": "tmpfs", "Source": "", "Destination": "/tmp"}
+	]
+}`
+
+func TestResolve(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skip(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/containers/web/json" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "No such container"}`))
+			return
+		}
+		w.Write([]byte(testContainer))
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+	t.Setenv("DOCKER_HOST", "unix://"+socket)
+
+	tests := []struct {
+		path, want, wantErr string
+	}{
+		{"/etc/nginx", "/var/lib/docker/overlay2/x/merged/etc/nginx", ""},
+		{"/data", "/var/lib/docker/volumes/v/_data", ""},
+		{"/data/file", "/var/lib/docker/volumes/v/_data/file", ""},
+		{"/data/cfg/app.conf", "/home/user/cfg/app.conf", ""},
+		{"/database", "/var/lib/docker/overlay2/x/merged/database", ""},
+		{"/tmp/x", "", `docker: "/tmp/x" in container "web" is a tmpfs mount, which isn't on the host`},
+		{"etc", "", `docker: path must be absolute: "etc"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			m, err := Resolve("web", tt.path)
+			if err != nil {
+				if err.Error() != tt.wantErr {
+					t.Fatalf("wrong error:\nhave: %s\nwant: %s", err, tt.wantErr)
+				}
+				return
+			}
+			if tt.wantErr != "" {
+				t.Fatalf("no error; want %q", tt.wantErr)
+			}
+			if m.Host != filepath.FromSlash(tt.want) {
+				t.Errorf("\nhave: %s\nwant: %s", m.Host, tt.want)
+			}
+			if have := m.ContainerPath(filepath.Join(m.Host, "x")); have != tt.path+"/x" {
+				t.Errorf("ContainerPath: %s", have)
+			}
+		})
+	}
+
+	_, err = Resolve("nonexistent", "/")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestResolvePid(t *testing.T) {
+	m := ResolvePid(42, "/etc/hosts")
+	if want := filepath.FromSlash("/proc/42/root/etc/hosts"); m.Host != want {
+		t.Errorf("\nhave: %s\nwant: %s", m.Host, want)
+	}
+	if have := m.ContainerPath(m.Host); have != "/etc/hosts" {
+		t.Errorf("ContainerPath: %s", have)
+	}
+}
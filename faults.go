@@ -0,0 +1,136 @@
+package fsnotify
+
+import (
+	"sync"
+	"time"
+)
+
+// Faults simulates failures, for use with [WithFaults]. This is meant for
+// testing how an application recovers from problems that are hard to trigger
+// for real, such as a full kernel queue.
+//
+// All fields are optional. The functions are called from the goroutine that
+// reads events (except AddError), in the order events are read.
+type Faults struct {
+	// Overflow is called for every event; if it returns true the event is
+	// dropped and ErrEventOverflow is sent on the Errors channel instead, as
+	// if the kernel queue was full.
+	Overflow func(Event) bool
+
+	// Drop is called for every event; if it returns true the event is dropped
+	// without reporting anything.
+	Drop func(Event) bool
+
+	// Delay is called for every event, and the event is sent after waiting
+	// for the returned duration. Events after it wait too, so the order
+	// doesn't change.
+	Delay func(Event) time.Duration
+
+	// AddError is called before adding a watch for a new directory in a
+	// recursive watch; if it returns an error that's sent on the Errors
+	// channel instead of adding the watch. Only used on Linux, as it's the
+	// only backend that adds watches for recursive watches.
+	AddError func(path string) error
+}
+
+// faulter sits between the backend and the other layers for WithFaults(): it
+// applies the faults to the events from the backend.
+type faulter struct {
+	faults Faults
+	clock  Clock
+	b      backend // For wrapError().
+
+	inEv   chan Event // From the backend.
+	inErr  chan error
+	outEv  chan Event // To the other layers or the user.
+	outErr chan error
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newFaulter(with watcherOpts, ev chan Event, errs chan error) *faulter {
+	return &faulter{
+		faults:  *with.faults,
+		clock:   with.clock,
+		inEv:    make(chan Event),
+		inErr:   make(chan error),
+		outEv:   ev,
+		outErr:  errs,
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// close stops sending events.
+func (f *faulter) close() {
+	f.closeOnce.Do(func() { close(f.closing) })
+}
+
+func (f *faulter) run() {
+	defer func() {
+		close(f.done)
+		close(f.outErr)
+		close(f.outEv)
+	}()
+
+	inEv, inErr := f.inEv, f.inErr
+	for inEv != nil || inErr != nil {
+		select {
+		case <-f.closing:
+			return
+		case err, ok := <-inErr:
+			if !ok {
+				inErr = nil
+				continue
+			}
+			select {
+			case <-f.closing:
+				return
+			case f.outErr <- err:
+			}
+		case e, ok := <-inEv:
+			if !ok {
+				inEv = nil
+				continue
+			}
+			if !f.event(e) {
+				return
+			}
+		}
+	}
+}
+
+// event applies the faults to e and sends it (or the overflow error); returns
+// false if the watcher is closed.
+func (f *faulter) event(e Event) bool {
+	if f.faults.Drop != nil && f.faults.Drop(e) {
+		return true
+	}
+	if f.faults.Delay != nil {
+		if d := f.faults.Delay(e); d > 0 {
+			t := f.clock.NewTimer(d)
+			select {
+			case <-f.closing:
+				t.Stop()
+				return false
+			case <-t.C():
+			}
+		}
+	}
+	if f.faults.Overflow != nil && f.faults.Overflow(e) {
+		select {
+		case <-f.closing:
+			return false
+		case f.outErr <- wrapError(f.b, "watch", "", ErrEventOverflow):
+			return true
+		}
+	}
+	select {
+	case <-f.closing:
+		return false
+	case f.outEv <- e:
+		return true
+	}
+}
@@ -0,0 +1,94 @@
+package fsnotify
+
+import (
+	"errors"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWithFaults(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	errAdd := errors.New("add failed")
+	w, err := NewWatcherWith(WithFaults(&Faults{
+		Overflow: func(e Event) bool { return filepath.Base(e.Name) == "overflow" },
+		Drop:     func(e Event) bool { return filepath.Base(e.Name) == "dropped" },
+		Delay: func(e Event) time.Duration {
+			if filepath.Base(e.Name) == "slow" {
+				return 100 * time.Millisecond
+			}
+			return 0
+		},
+		AddError: func(path string) error { return errAdd },
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	var (
+		mu     sync.Mutex
+		events []string
+		errs   []error
+		done   = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				mu.Lock()
+				events = append(events, filepath.Base(e.Name))
+				mu.Unlock()
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}
+	}()
+
+	addWatch(t, w, tmp)
+	start := time.Now()
+	touch(t, tmp, "slow")
+	touch(t, tmp, "dropped")
+	touch(t, tmp, "overflow")
+	touch(t, tmp, "file")
+	waitForEvents()
+
+	if enableRecurse {
+		mkdir(t, tmp, "rec")
+		addWatch(t, w, tmp, "rec", "...")
+		mkdir(t, tmp, "rec", "sub")
+		waitForEvents()
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) < 2 || events[0] != "slow" || events[1] != "file" {
+		t.Errorf("wrong events: %q", events)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("not delayed")
+	}
+	if len(errs) == 0 || !errors.Is(errs[0], ErrEventOverflow) {
+		t.Fatalf("wrong errors: %v", errs)
+	}
+	if enableRecurse && runtime.GOOS == "linux" && (len(errs) != 2 || !errors.Is(errs[1], errAdd)) {
+		t.Errorf("wrong errors: %v", errs)
+	}
+}
@@ -0,0 +1,433 @@
+package fsnotify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// How long to wait for the file to be re-created after a Remove or Rename.
+var atomicSaveDelay = 100 * time.Millisecond
+
+// fileWatcher sits between the backend and the Events channel for
+// WithAtomicSave() and WithPersist(): files are watched through their parent
+// directory (always for WithAtomicSave(), and only while the file doesn't
+// exist for WithPersist()), and events for the file are translated so that
+// replacing or re-creating the file doesn't end the watch.
+type fileWatcher struct {
+	b      backend
+	atomic bool // WithAtomicSave(); otherwise WithPersist().
+	clock  Clock
+
+	inEv   chan Event // From the backend.
+	inErr  chan error
+	outEv  chan Event // To the user (or the settler).
+	outErr chan error
+
+	mu      sync.Mutex
+	files   map[string]*watchedFile // Watched files, by (clean) path.
+	dirs    map[string]int          // Number of files watched through directories.
+	direct  map[string]struct{}     // Directories added by the user.
+	pending []string                // Files with a held Remove or Rename, oldest first.
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+type watchedFile struct {
+	op     Op       // Operations the user asked for.
+	opts   []addOpt // For re-adding the file with WithPersist().
+	exists bool     // File exists, as far as we know.
+	held   *Event
+	heldAt time.Time
+}
+
+func newFileWatcher(with watcherOpts, ev chan Event, errs chan error) *fileWatcher {
+	return &fileWatcher{
+		atomic:  with.atomicSave,
+		clock:   with.clock,
+		inEv:    make(chan Event),
+		inErr:   make(chan error),
+		outEv:   ev,
+		outErr:  errs,
+		files:   make(map[string]*watchedFile),
+		dirs:    make(map[string]int),
+		direct:  make(map[string]struct{}),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// close stops sending events; held events are dropped.
+func (fw *fileWatcher) close() {
+	fw.closeOnce.Do(func() { close(fw.closing) })
+}
+
+// Returns true if the event was sent, or false if watcher is closed.
+func (fw *fileWatcher) sendEvent(e Event) bool {
+	select {
+	case <-fw.closing:
+		return false
+	case fw.outEv <- e:
+		return true
+	}
+}
+
+// watchDirect reports if files are watched directly while they exist, rather
+// than always through the parent directory.
+func (fw *fileWatcher) watchDirect() bool { return !fw.atomic }
+
+// add watches path. Files are watched through the parent directory with
+// WithAtomicSave().
+func (fw *fileWatcher) add(path string, opts ...addOpt) error {
+	st, err := os.Lstat(path)
+	if err != nil || st.IsDir() {
+		// Let the backend deal with errors.
+		if err := fw.b.AddWith(path, opts...); err != nil {
+			return err
+		}
+		fw.mu.Lock()
+		fw.direct[filepath.Clean(path)] = struct{}{}
+		fw.mu.Unlock()
+		return nil
+	}
+
+	var (
+		with = getOptions(opts...)
+		file = filepath.Clean(path)
+		dir  = filepath.Dir(file)
+	)
+	fw.mu.Lock()
+	f, ok := fw.files[file]
+	if ok {
+		f.op |= with.op
+		f.opts = append(f.opts, opts...)
+	} else {
+		fw.files[file] = &watchedFile{op: with.op, opts: opts, exists: true}
+		if !fw.watchDirect() {
+			fw.dirs[dir]++
+		}
+	}
+	fw.mu.Unlock()
+	if ok && !fw.watchDirect() {
+		return nil
+	}
+
+	if fw.watchDirect() {
+		err = fw.b.AddWith(file, opts...)
+	} else {
+		err = fw.b.AddWith(dir, append(opts, WithOps(with.op|Create|Remove|Rename))...)
+	}
+	if err != nil && !ok {
+		fw.mu.Lock()
+		fw.forget(file)
+		fw.mu.Unlock()
+	}
+	return err
+}
+
+// remove stops watching path. Directories stay watched by the backend as long
+// as there are files in it that are watched.
+func (fw *fileWatcher) remove(path string) error {
+	path = filepath.Clean(path)
+	fw.mu.Lock()
+	if f, ok := fw.files[path]; ok {
+		dir := filepath.Dir(path)
+		throughDir := !fw.watchDirect() || !f.exists
+		fw.forget(path)
+		_, direct := fw.direct[dir]
+		keep := direct || fw.dirs[dir] > 0
+		fw.mu.Unlock()
+		switch {
+		case !throughDir:
+			return fw.b.Remove(path)
+		case keep:
+			return nil
+		}
+		return fw.b.Remove(dir)
+	}
+
+	_, direct := fw.direct[path]
+	delete(fw.direct, path)
+	files := fw.dirs[path] > 0
+	fw.mu.Unlock()
+	switch {
+	case files && direct:
+		return nil
+	case files:
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, path)
+	}
+	return fw.b.Remove(path)
+}
+
+// removeOps removes op from a file, or passes it on to the backend for other
+// paths and files that are watched directly.
+func (fw *fileWatcher) removeOps(path string, op Op, b opRemover) error {
+	fw.mu.Lock()
+	f, ok := fw.files[filepath.Clean(path)]
+	if !ok {
+		fw.mu.Unlock()
+		return b.removeOps(path, op)
+	}
+	if f.op&^op == 0 {
+		fw.mu.Unlock()
+		return errAllOps(path)
+	}
+	direct := fw.watchDirect() && f.exists
+	f.op &^= op
+	f.opts = append(f.opts, WithOps(f.op))
+	fw.mu.Unlock()
+
+	if direct {
+		return b.removeOps(path, op)
+	}
+	return nil
+}
+
+// watchList replaces the directories that are only watched for files with the
+// files.
+func (fw *fileWatcher) watchList(list []string) []string {
+	if list == nil {
+		return nil
+	}
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	l := make([]string, 0, len(list)+len(fw.files))
+	for _, p := range list {
+		c := filepath.Clean(p)
+		_, direct := fw.direct[c]
+		_, file := fw.files[c]
+		if !file && (direct || fw.dirs[c] == 0) {
+			l = append(l, p)
+		}
+	}
+	for p := range fw.files {
+		l = append(l, p)
+	}
+	return l
+}
+
+// watches gets the list of watches, for Error.WatchPath().
+func (fw *fileWatcher) watches() []string { return fw.watchList(fw.b.WatchList()) }
+
+// watchInfo marks the directories that are only watched for files as internal,
+// and adds the files.
+func (fw *fileWatcher) watchInfo(l []WatchInfo) []WatchInfo {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	for i := range l {
+		c := filepath.Clean(l[i].Path)
+		if _, direct := fw.direct[c]; !direct && fw.dirs[c] > 0 {
+			l[i].Internal = true
+		}
+	}
+	for p, f := range fw.files {
+		if fw.watchDirect() && f.exists {
+			continue // Already in the list.
+		}
+		l = append(l, WatchInfo{Path: p, Op: f.op})
+	}
+	return l
+}
+
+// forget stops tracking file; must hold the lock.
+func (fw *fileWatcher) forget(file string) {
+	f := fw.files[file]
+	delete(fw.files, file)
+	if !fw.watchDirect() || !f.exists {
+		dir := filepath.Dir(file)
+		if fw.dirs[dir]--; fw.dirs[dir] <= 0 {
+			delete(fw.dirs, dir)
+		}
+	}
+	fw.unhold(file)
+}
+
+func (fw *fileWatcher) unhold(file string) {
+	for i, p := range fw.pending {
+		if p == file {
+			fw.pending = append(fw.pending[:i], fw.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func (fw *fileWatcher) run() {
+	defer func() {
+		close(fw.done)
+		close(fw.outErr)
+		close(fw.outEv)
+	}()
+
+	t := fw.clock.NewTimer(time.Hour)
+	stopTimer(t)
+	inEv, inErr := fw.inEv, fw.inErr
+	for inEv != nil || inErr != nil {
+		select {
+		case <-fw.closing:
+			return
+		case err, ok := <-inErr:
+			if !ok {
+				inErr = nil
+				continue
+			}
+			if e, ok := err.(*Error); ok {
+				e.watches = fw.watches
+			}
+			select {
+			case <-fw.closing:
+				return
+			case fw.outErr <- err:
+			}
+		case e, ok := <-inEv:
+			if !ok {
+				inEv = nil
+				continue
+			}
+			send, err := fw.event(e)
+			for _, e := range send {
+				if !fw.sendEvent(e) {
+					return
+				}
+			}
+			if err != nil {
+				select {
+				case <-fw.closing:
+					return
+				case fw.outErr <- err:
+				}
+			}
+		case <-t.C():
+			for _, e := range fw.expired(fw.clock.Now().Add(-atomicSaveDelay)) {
+				if !fw.sendEvent(e) {
+					return
+				}
+			}
+		}
+
+		stopTimer(t)
+		fw.mu.Lock()
+		if len(fw.pending) > 0 {
+			t.Reset(fw.files[fw.pending[0]].heldAt.Add(atomicSaveDelay).Sub(fw.clock.Now()))
+		}
+		fw.mu.Unlock()
+	}
+}
+
+// event translates an event from the backend into the events to send.
+func (fw *fileWatcher) event(e Event) ([]Event, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	name := filepath.Clean(e.Name)
+	f, ok := fw.files[name]
+	if !ok {
+		// Events for other files in the directory, or the directory itself.
+		for _, dir := range []string{filepath.Dir(name), name} {
+			if _, direct := fw.direct[dir]; !direct && fw.dirs[dir] > 0 {
+				return nil, nil
+			}
+		}
+		return []Event{e}, nil
+	}
+
+	if fw.watchDirect() {
+		return fw.persistEvent(name, f, e)
+	}
+
+	switch {
+	case e.Has(Create):
+		// Replaced by a rename, or re-created shortly after being removed
+		// or renamed (e.g. "mv file file~; write file; rm file~").
+		if f.held != nil || f.exists {
+			e = Event{Name: e.Name, Op: Write, Info: e.Info, Pid: e.Pid}
+			f.held = nil
+			fw.unhold(name)
+		}
+		f.exists = true
+	case e.Has(Remove) || e.Has(Rename):
+		f.exists = false
+		if f.held == nil {
+			fw.pending = append(fw.pending, name)
+			f.heldAt = fw.clock.Now()
+		}
+		f.held = &e
+		return nil, nil
+	}
+	if e.Op&f.op == 0 {
+		return nil, nil
+	}
+	return []Event{e}, nil
+}
+
+// persistEvent handles events for a file added with WithPersist(): the file is
+// watched through the parent directory after it's removed or renamed, and is
+// watched directly again once it's re-created.
+//
+// Must hold the lock.
+func (fw *fileWatcher) persistEvent(name string, f *watchedFile, e Event) ([]Event, error) {
+	var send []Event
+	if e.Op&f.op != 0 {
+		send = append(send, e)
+	}
+
+	switch {
+	case f.exists && (e.Has(Remove) || e.Has(Rename)):
+		f.exists = false
+		fw.b.Remove(name) // The backend may or may not have removed it already.
+		dir := filepath.Dir(name)
+		fw.dirs[dir]++
+		if _, direct := fw.direct[dir]; !direct && fw.dirs[dir] == 1 {
+			if err := fw.b.AddWith(dir, WithOps(Create)); err != nil {
+				return send, &Error{Path: name, Backend: fw.b.name(), Op: "watch",
+					Err: fmt.Errorf("fsnotify: watching %q for %q: %w", dir, name, err), watches: fw.watches}
+			}
+		}
+		// May have been re-created before the directory was watched.
+		if _, err := os.Lstat(name); err == nil && fw.reattach(name, f) && f.op.Has(Create) {
+			send = append(send, Event{Name: e.Name, Op: Create})
+		}
+	case !f.exists && e.Has(Create):
+		fw.reattach(name, f)
+	}
+	return send, nil
+}
+
+// reattach watches the file directly again, and stops watching the directory
+// if it's no longer needed. Returns false if the file can't be watched (e.g.
+// because it was removed again), in which case the directory stays watched.
+//
+// Must hold the lock.
+func (fw *fileWatcher) reattach(name string, f *watchedFile) bool {
+	if err := fw.b.AddWith(name, f.opts...); err != nil {
+		return false
+	}
+	f.exists = true
+	dir := filepath.Dir(name)
+	if fw.dirs[dir]--; fw.dirs[dir] <= 0 {
+		delete(fw.dirs, dir)
+		if _, direct := fw.direct[dir]; !direct {
+			fw.b.Remove(dir)
+		}
+	}
+	return true
+}
+
+// expired gets all held events from before t.
+func (fw *fileWatcher) expired(t time.Time) []Event {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	var send []Event
+	for len(fw.pending) > 0 && !fw.files[fw.pending[0]].heldAt.After(t) {
+		f := fw.files[fw.pending[0]]
+		fw.pending = fw.pending[1:]
+		if f.held.Op&f.op != 0 {
+			send = append(send, *f.held)
+		}
+		f.held = nil
+	}
+	return send
+}
@@ -0,0 +1,110 @@
+package fsnotify
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestWithAtomicSave(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file")
+	touch(t, tmp, "other")
+
+	w, err := NewWatcherWith(WithAtomicSave())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	addWatch(t, w, tmp, "file")
+
+	if have, want := fmt.Sprint(w.WatchList()), fmt.Sprint([]string{join(tmp, "file")}); have != want {
+		t.Errorf("WatchList:\nhave: %s\nwant: %s", have, want)
+	}
+	if err := w.Remove(tmp); !errors.Is(err, ErrNonExistentWatch) {
+		t.Errorf("removing directory: wrong error: %v", err)
+	}
+
+	echoAppend(t, "data", tmp, "file")
+	eventSeparator()
+	echoAppend(t, "data", tmp, "other")
+	eventSeparator()
+
+	// Write to temporary file and rename over the original.
+	echoTrunc(t, "new", tmp, "file.tmp")
+	mv(t, join(tmp, "file.tmp"), tmp, "file")
+	waitForEvents()
+
+	// Removed and created again later.
+	rm(t, tmp, "file")
+	waitForEvents()
+	touch(t, tmp, "file")
+	waitForEvents()
+
+	cmpEvents(t, tmp, c.stop(t), newEvents(t, `
+		write   /file
+		write   /file
+		remove  /file
+		create  /file
+	`))
+}
+
+func TestWithPersist(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file")
+
+	w, err := NewWatcherWith(WithPersist())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	addWatch(t, w, tmp, "file")
+
+	echoAppend(t, "data", tmp, "file")
+	eventSeparator()
+	rm(t, tmp, "file")
+	eventSeparator()
+	touch(t, tmp, "other")
+	eventSeparator()
+	if have, want := fmt.Sprint(w.WatchList()), fmt.Sprint([]string{join(tmp, "file")}); have != want {
+		t.Errorf("WatchList:\nhave: %s\nwant: %s", have, want)
+	}
+
+	// Watched again once it's re-created.
+	touch(t, tmp, "file")
+	eventSeparator()
+	echoAppend(t, "data", tmp, "file")
+	eventSeparator()
+	mv(t, join(tmp, "file"), tmp, "renamed")
+	eventSeparator()
+	echoAppend(t, "data", tmp, "renamed")
+	eventSeparator()
+	echoAppend(t, "data", tmp, "file")
+
+	cmpEvents(t, tmp, c.stop(t), newEvents(t, `
+		write   /file
+		remove  /file
+		create  /file
+		write   /file
+		rename  /file
+		create  /file
+		write   /file
+
+		# inotify sends IN_ATTRIB for the link count change.
+		linux:
+			write   /file
+			chmod   /file
+			remove  /file
+			create  /file
+			write   /file
+			rename  /file
+			create  /file
+			write   /file
+	`))
+}
@@ -7,6 +7,10 @@
 //   - BSD, macOS via kqueue
 //   - Windows    via ReadDirectoryChangesW
 //   - illumos    via FEN
+//   - AIX        via AHAFS (experimental)
+//   - WASM       via polling (js/wasm and wasip1; see the README for caveats)
+//   - Plan 9     via polling
+//   - z/OS       via polling
 //
 // # FSNOTIFY_DEBUG
 //
@@ -27,9 +31,14 @@ package fsnotify
 import (
 	"errors"
 	"fmt"
+	"hash"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Watcher watches a set of paths, delivering events on a channel.
@@ -74,10 +83,16 @@ import (
 //
 // # kqueue notes (macOS, BSD)
 //
-// kqueue requires opening a file descriptor for every file that's being watched;
-// so if you're watching a directory with five files then that's six file
-// descriptors. You will run in to your system's "max open files" limit faster on
-// these platforms.
+// kqueue requires opening a file descriptor for every file that's being
+// watched, and only reports changes to a directory's entries, not to the files
+// in it. By default only directories get a file descriptor and the events for
+// the files in them are found by comparing the directory listing, so Write and
+// Chmod events for those files are only sent if the directory changes too.
+//
+// With [WithFileWatches] every file in a watched directory gets a file
+// descriptor, so if you're watching a directory with five files then that's six
+// file descriptors. You will run in to your system's "max open files" limit
+// faster this way.
 //
 // The sysctl variables kern.maxfiles and kern.maxfilesperproc can be used to
 // control the maximum number of open files, as well as /etc/login.conf on BSD
@@ -88,17 +103,44 @@ import (
 // Paths can be added as "C:\\path\\to\\dir", but forward slashes
 // ("C:/path/to/dir") will also work.
 //
+// Paths longer than MAX_PATH (260 characters) are supported. They can be added
+// with or without the extended-length prefix ("\\\\?\\C:\\path"); events are
+// sent with the same style of path as was used in Add().
+//
 // When a watched directory is removed it will always send an event for the
 // directory itself, but may not send events for all files in that directory.
 // Sometimes it will send events for all files, sometimes it will send no
 // events, and often only for some files.
 //
+// If a network share (UNC path or mapped drive) disconnects a [*WatchLostError]
+// is sent on the Errors channel, and the path is checked periodically to see if
+// it's available again. Once it is, the watch is re-established and the
+// directory is rescanned: Create and Write events are sent for files that were
+// created or modified while the share was unavailable. Removes that happened
+// in the meantime can't be detected.
+//
+// Watches on removable drives don't prevent the drive from being ejected: when
+// the drive is ejected (or removed without ejecting) a [*WatchLostError] with
+// [ErrDeviceRemoved] is sent, and the watch is re-established if the drive is
+// inserted again.
+//
 // The default ReadDirectoryChangesW() buffer size is 64K, which is the largest
 // value that is guaranteed to work with SMB filesystems. If you have many
 // events in quick succession this may not be enough, and you will have to use
 // [WithBufferSize] to increase the value.
 type Watcher struct {
-	b backend
+	b      backend
+	settle *settler     // Only with WithChecksum() or WithSettled().
+	files  *fileWatcher // Only with WithAtomicSave() or WithPersist().
+	links  *linkWatcher // Only with WithSymlinks().
+	heal   *healer      // Only with WithHealing().
+	rel    *relPaths    // Only with WithRelativePaths() or WithSelfEvents(false).
+	budget *budget      // Only with WithWatchBudget().
+	prof   *profiler    // Only with WithProfiling() with hooks.
+	faults *faulter     // Only with WithFaults().
+	clone  *cloneState  // nil for Watchers from SharedWatcher.Scope().
+
+	canonical bool // WithCanonicalPaths()
 
 	// Events sends the filesystem change events.
 	//
@@ -166,7 +208,57 @@ type Event struct {
 	//
 	//   Event{Op: Rename, Name: "/tmp/file"}
 	//   Event{Op: Create, Name: "/tmp/rename", RenamedFrom: "/tmp/file"}
-	renamedFrom string
+	//
+	// This also works for moves between two directories that were added
+	// separately. On Windows the old name is matched by the file ID, which
+	// needs ReadDirectoryChangesExW (Windows 10 1709 or newer); without it
+	// the old name is sent as Remove rather than Rename.
+	RenamedFrom string
+
+	// Extended information about the file, if the backend delivers this as
+	// part of the event. This is nil if it's not available; currently only the
+	// Windows backend (with ReadDirectoryChangesExW, which is available on
+	// Windows 10 1709 and newer) and the fanotify backend on Linux set it.
+	Info *EventInfo
+
+	// PID of the process that triggered the event, or 0 if not known. This is
+	// only set on Linux by the fanotify backend (see [WithWholeVolume] and
+	// [Watcher.AddMount]), [WithAudit], and [WithEBPF].
+	Pid int
+
+	// Checksum of the file contents after a write, with [WithChecksum]. This
+	// is nil for other events, or if the file couldn't be read.
+	Checksum []byte
+
+	// Path added with [Watcher.Add] this event is for, with
+	// [WithRelativePaths]; Name is relative to this. Empty otherwise.
+	Root string
+}
+
+// EventInfo is extended information about the file an event was sent for.
+//
+// This is the state of the file at the time the event was generated, which may
+// be different from the current state.
+type EventInfo struct {
+	FileID     uint64    // Unique file ID on the volume.
+	Size       int64     // File size in bytes.
+	ModTime    time.Time // Last modification time.
+	ChangeTime time.Time // Last metadata change time.
+	AccessTime time.Time // Last access time.
+	BirthTime  time.Time // Creation time.
+
+	// Number of hard links to the file. This is only set for events with
+	// UnportableLink or UnportableUnlink.
+	Links uint64
+
+	// Opaque identifier for the file; this is the filesystem ID and file
+	// handle with fanotify on Linux, and empty for other backends.
+	//
+	// Unlike the path this stays the same when a file is renamed, and it's
+	// also set for events on files that were already deleted, so it can be
+	// used as a map key to track a file. Only the Handle field is set with
+	// fanotify.
+	Handle string
 }
 
 // Op describes a set of file operations.
@@ -200,17 +292,23 @@ const (
 
 	// File descriptor was opened.
 	//
-	// Only works on Linux and FreeBSD.
+	// Only works on Linux, FreeBSD, and NetBSD 10 or newer. On kqueue this is
+	// only sent for files that have their own watch; for files in a watched
+	// directory this needs WithFileWatches().
 	xUnportableOpen
 
 	// File was read from.
 	//
-	// Only works on Linux and FreeBSD.
+	// Only works on Linux, FreeBSD, NetBSD 10 or newer, and Windows.
+	//
+	// On Windows this is based on the last access time, which is updated lazily
+	// (up to an hour on NTFS) and is often disabled altogether; see "fsutil
+	// behavior query disablelastaccess".
 	xUnportableRead
 
 	// File opened for writing was closed.
 	//
-	// Only works on Linux and FreeBSD.
+	// Only works on Linux, FreeBSD, and NetBSD 10 or newer.
 	//
 	// The advantage of using this over Write is that it's more reliable than
 	// waiting for Write events to stop. It's also faster (if you're not
@@ -220,8 +318,135 @@ const (
 
 	// File opened for reading was closed.
 	//
-	// Only works on Linux and FreeBSD.
+	// Only works on Linux, FreeBSD, and NetBSD 10 or newer.
 	xUnportableCloseRead
+
+	// Security descriptor (owner, ACL) was changed.
+	//
+	// Only works on Windows.
+	//
+	// Windows reports both writes and security changes as "modified" with no
+	// way to tell them apart; if ReadDirectoryChangesExW is available the file
+	// timestamps are used to distinguish them, but on older versions of Windows
+	// an event will have both Write and UnportableSecurity set.
+	UnportableSecurity
+
+	// File size was increased, or reduced (truncated).
+	//
+	// Only works on Linux, macOS, and the BSDs.
+	//
+	// These are always sent together with Write. Neither inotify nor kqueue
+	// report the size, so this is based on comparing the size with the size at
+	// the previous event. Changes in quick succession may be missed: for
+	// example truncating a file and immediately writing more data to it (as
+	// with "echo >file") may be seen as an extend, or not at all.
+	UnportableExtend
+	UnportableTruncate
+
+	// A filesystem was mounted on the path, or the filesystem of the path was
+	// unmounted. This is sent for watched paths and for directories in a
+	// watched directory. Watches on an unmounted filesystem are removed.
+	//
+	// Only works on Linux, macOS, FreeBSD, and illumos; UnportableUnmount also
+	// works on the other BSDs (but only for forced unmounts, as the open file
+	// descriptors kqueue uses prevent unmounting otherwise).
+	UnportableMount
+	UnportableUnmount
+
+	// What changed for a Chmod event: the permission bits (UnportableMode),
+	// the owner or group (UnportableOwner), or the modification time
+	// (UnportableTimes; for example with touch). Changes to other attributes,
+	// such as extended attributes or the link count, are sent as a Chmod
+	// without any of these.
+	//
+	// Only works on Linux (but not with fanotify), macOS, and the BSDs.
+	//
+	// These are always sent together with Chmod. Neither inotify nor kqueue
+	// report what changed, so this is based on comparing the file's attributes
+	// with the attributes at the previous event, which means that changes in
+	// quick succession may be reported on the first event. On kqueue only
+	// UnportableMode is sent for files in a watched directory without
+	// WithFileWatches().
+	UnportableMode
+	UnportableOwner
+	UnportableTimes
+
+	// Extended attributes were added, changed, or removed; for example the
+	// com.apple.quarantine attribute on macOS, or SELinux labels on Linux.
+	//
+	// Only works on Linux (but not with fanotify) and macOS.
+	//
+	// This is always sent together with Chmod. Like [UnportableMode], this is
+	// based on comparing the extended attributes with the previous event;
+	// reading them for every Chmod event can be slow for files with many
+	// attributes.
+	UnportableXattr
+
+	// Access control list was changed.
+	//
+	// Only works on Linux (but not with fanotify) and Windows.
+	//
+	// On Linux this is sent together with Chmod when the POSIX ACL (the
+	// system.posix_acl_access and system.posix_acl_default extended
+	// attributes) changed since the previous event. Windows can't tell ACL
+	// changes apart from other security descriptor changes such as the owner,
+	// so it's sent for all of them, the same as UnportableSecurity.
+	UnportableACL
+
+	// A hard link to a file was added (UnportableLink) or removed
+	// (UnportableUnlink); [EventInfo].Links has the new link count.
+	//
+	// Only works on Linux (but not with fanotify), macOS, and the BSDs.
+	//
+	// UnportableLink is sent together with Create when the new file is a hard
+	// link to an existing file, and UnportableUnlink together with Remove when
+	// the removed file had other links. Both are sent together with Chmod when
+	// the link count of a file changed because a link was added or removed
+	// elsewhere; on Linux this is only sent for files that have their own watch,
+	// and on kqueue only for files that have their own watch or when the link is
+	// in the same directory.
+	//
+	// This isn't sent for directories.
+	UnportableLink
+	UnportableUnlink
+
+	// The file is a clone (reflink) of another file, made with cp --reflink or
+	// the FICLONE ioctl, and shares its data with it until either is written
+	// to. Consumers that hash file contents can use this to skip re-hashing.
+	//
+	// Only works on Linux (but not with fanotify), for filesystems that support
+	// clones such as Btrfs and XFS.
+	//
+	// This is sent together with the first Write after the file was created
+	// (the clone itself is a write to an empty file). The kernel doesn't
+	// report clones, so this is based on checking if the file's data is
+	// shared, which is also the case for files that were deduplicated or are
+	// part of a snapshot.
+	UnportableClone
+
+	// Events for the path may have been missed, and it should be rescanned
+	// (e.g. by reading the directory) if you need to be sure you have the
+	// current state.
+	//
+	// Only sent with WithHealing(), after a watch that stopped working was
+	// added again.
+	Rescan
+
+	// The watched symlink was changed to point somewhere else (or was
+	// re-created), and the watch was moved to the new target.
+	//
+	// Only sent with WithSymlinks().
+	Relink
+
+	// A directory in a recursive watch was moved to somewhere else in the
+	// watched tree, and the watches for everything in it were moved along
+	// with it. This is sent together with the Create for the new name, which
+	// has the old name in [Event.RenamedFrom], so the index for the
+	// entire subtree can be updated from this one event; there are no events
+	// for the files and directories inside it.
+	//
+	// Only sent for recursive watches on Linux and Windows.
+	Move
 )
 
 var (
@@ -242,19 +467,330 @@ var (
 	//  - kqueue, fen:  Not used.
 	ErrEventOverflow = errors.New("fsnotify: queue or buffer overflow")
 
+	// ErrDeviceRemoved is used as the Err in a [*WatchLostError] when a watch
+	// was removed because the device it's on was (or is about to be) removed.
+	//
+	// Currently only used on Windows.
+	ErrDeviceRemoved = errors.New("fsnotify: device removed")
+
+	// ErrWatchLimit is returned when the system limit on the number of watches
+	// is reached. The error will be a [*WatchLimitError] with more details.
+	//
+	// Currently only used on Linux, macOS, and the BSDs.
+	ErrWatchLimit = errors.New("fsnotify: watch limit reached")
+
+	// ErrAlreadyWatched is returned when adding a path that refers to a
+	// directory or file that's already watched under a different path, such
+	// as a symlink or bind mount of a watched directory.
+	//
+	// Currently only used on Linux.
+	ErrAlreadyWatched = errors.New("fsnotify: already watched under a different path")
+
+	// ErrWatchDead is used by [Watcher.Verify] for watches that no longer
+	// work: the path doesn't exist anymore, or the watch was removed by the
+	// kernel.
+	ErrWatchDead = errors.New("fsnotify: watch no longer works")
+
+	// ErrWatchDiverged is used by [Watcher.Verify] for watches where the path
+	// now refers to a different file or directory than the one being watched;
+	// for example because it was replaced with a rename.
+	ErrWatchDiverged = errors.New("fsnotify: watched path refers to a different file")
+
+	// ErrSymlinkLoop is sent on the Errors channel for symlinks that are
+	// skipped with [WithFollowSymlinks] because they point to a directory
+	// that's already part of the recursive watch (such as a parent directory).
+	ErrSymlinkLoop = errors.New("fsnotify: symlink loop")
+
+	// ErrSymlinkEscape is sent on the Errors channel for symlinks that are
+	// skipped with [WithFollowSymlinks] because they point outside the
+	// recursively watched directory.
+	ErrSymlinkEscape = errors.New("fsnotify: symlink points outside of the watched directory")
+
+	// ErrOutsideScope is returned when adding a path that's not in the prefix
+	// of a Watcher from [SharedWatcher.Scope].
+	ErrOutsideScope = errors.New("fsnotify: path is outside of the scope")
+
 	// ErrUnsupported is returned by AddWith() when WithOps() specified an
 	// Unportable event that's not supported on this platform.
 	xErrUnsupported = errors.New("fsnotify: not supported with this backend")
 )
 
+// WatchLostError is sent on the Errors channel when a watch stops working
+// without the watched path being removed; for example because the network
+// share it's on was disconnected.
+//
+// Currently only the Windows backend sends this. It will automatically
+// re-establish the watch once the path is available again; see the Windows
+// notes on [Watcher].
+type WatchLostError struct {
+	Path string // Watched path.
+	Err  error  // Underlying error.
+}
+
+func (e *WatchLostError) Error() string {
+	return fmt.Sprintf("fsnotify: watch for %q lost: %s", e.Path, e.Err)
+}
+
+func (e *WatchLostError) Unwrap() error { return e.Err }
+
+// PollingError is sent on the Errors channel when an added path is on a
+// filesystem that doesn't support change notifications, and is polled instead.
+// This is a warning: the path is still watched.
+//
+// On Android a path is also polled when fs.inotify.max_user_watches is
+// reached, and with [WithSandbox] when its file descriptor limit is reached,
+// rather than returning a [WatchLimitError]; Limit is set in that case.
+//
+// Polling only detects Create, Write, Remove, and Chmod (and the UnportableExtend
+// and UnportableTruncate operations): renames are sent as a Remove and Create.
+// Changes that are undone within the interval aren't seen.
+//
+// Currently only sent on Linux, macOS, and the BSDs; see [Watcher.Add] for the
+// filesystems. Use [WithNoPolling] to always use the kernel notifications.
+type PollingError struct {
+	Path     string        // Watched path.
+	FSType   string        // Filesystem type, e.g. "nfs" or "fuse".
+	Interval time.Duration // How often Path is polled.
+	Limit    string        // The limit that was reached, as in WatchLimitError.Sysctl; empty if polled because of FSType.
+}
+
+func (e *PollingError) Error() string {
+	if e.Limit != "" {
+		return fmt.Sprintf("fsnotify: %q can't be watched as the %s limit was reached; polling every %s",
+			e.Path, e.Limit, e.Interval)
+	}
+	return fmt.Sprintf("fsnotify: %q is on %s, which doesn't support change notifications; polling every %s",
+		e.Path, e.FSType, e.Interval)
+}
+
+// FileTypeError is returned when adding a FIFO (named pipe), socket, or device
+// node with a backend that can't watch it. See "Watching special files" on
+// [Watcher.Add] for the backends that can.
+type FileTypeError struct {
+	Path string      // Path that was being added.
+	Mode fs.FileMode // Type of the file.
+}
+
+func (e *FileTypeError) Error() string {
+	t := "special file"
+	switch {
+	case e.Mode&fs.ModeNamedPipe != 0:
+		t = "FIFO"
+	case e.Mode&fs.ModeSocket != 0:
+		t = "socket"
+	case e.Mode&fs.ModeCharDevice != 0:
+		t = "character device"
+	case e.Mode&fs.ModeDevice != 0:
+		t = "block device"
+	}
+	return fmt.Sprintf("fsnotify: can't watch %q: watching a %s is not supported with this backend", e.Path, t)
+}
+
+// isSpecial reports if mode is a FIFO, socket, or device node.
+func isSpecial(mode fs.FileMode) bool {
+	return mode&(fs.ModeNamedPipe|fs.ModeSocket|fs.ModeDevice) != 0
+}
+
+// WatchLimitError is returned when adding a watch or creating a Watcher fails
+// because a system limit was reached. It matches [ErrWatchLimit] with
+// errors.Is().
+//
+// On Linux the limits are the fs.inotify.max_user_watches sysctl for the
+// number of watches and fs.inotify.max_user_instances for the number of
+// Watchers. The limits are per user, not per process, so other programs may be
+// using watches too. Creating a Watcher also fails if the process reached
+// RLIMIT_NOFILE; Sysctl is "fs.inotify.max_user_instances or RLIMIT_NOFILE" if
+// it's not known which one was reached.
+//
+// On macOS and the BSDs every watch needs a file descriptor, and the limit is
+// the RLIMIT_NOFILE resource limit (see "ulimit -n"). The soft limit is raised
+// to the hard limit before this error is returned. Other open files count
+// towards the limit as well.
+type WatchLimitError struct {
+	Path    string // Path that was being added; empty when creating a Watcher.
+	Sysctl  string // Name of the limit, e.g. "fs.inotify.max_user_watches".
+	Limit   int    // Current value of the limit; -1 if unknown.
+	Watches int    // Number of watches this Watcher has.
+	Needed  int    // Number of additional watches needed for Path; 0 if unknown.
+	Err     error  // Underlying error.
+}
+
+func (e *WatchLimitError) Error() string {
+	var b strings.Builder
+	if e.Path == "" {
+		b.WriteString("fsnotify: creating watcher: ")
+	} else {
+		fmt.Fprintf(&b, "fsnotify: watching %q: ", e.Path)
+	}
+	fmt.Fprintf(&b, "%s (this watcher has %d watches", e.Err, e.Watches)
+	if e.Needed > 0 {
+		fmt.Fprintf(&b, " and needs %d more", e.Needed)
+	}
+	if e.Limit >= 0 {
+		fmt.Fprintf(&b, "; %s is %d", e.Sysctl, e.Limit)
+	}
+	switch e.Sysctl {
+	case "RLIMIT_NOFILE":
+		b.WriteString("); the limit can be increased with \"ulimit -n <n>\"")
+	case "fs.inotify.max_user_instances or RLIMIT_NOFILE":
+		b.WriteString("); the limits can be increased with " +
+			"\"sysctl fs.inotify.max_user_instances=<n>\" and \"ulimit -n <n>\"")
+	case "WithSandbox":
+		b.WriteString("); the limit can be increased with WithSandbox(<n>)")
+	default:
+		fmt.Fprintf(&b, "); the limit can be increased with \"sysctl %s=<n>\"", e.Sysctl)
+	}
+	return b.String()
+}
+
+func (e *WatchLimitError) Unwrap() error { return e.Err }
+
+func (e *WatchLimitError) Is(target error) bool { return target == ErrWatchLimit }
+
+// Error is the type of all errors returned by [Watcher] methods and sent on
+// [Watcher.Errors].
+//
+// The underlying error is in Err; use errors.Is() and errors.As() to check for
+// [ErrNonExistentWatch], [*WatchLimitError], and the like, as the error is
+// never one of those directly.
+type Error struct {
+	// Path the error is for, if any. Errors sent on Watcher.Errors that don't
+	// have a path are for the Watcher as a whole (for example
+	// [ErrEventOverflow]), rather than a single watch.
+	Path string
+
+	// Backend that returned the error: "inotify", "fanotify", "audit",
+	// "ebpf", "kqueue", "fen", "windows", "ahafs", "poll", "watchman",
+	// "ssh", "object", "synthetic", or "other" (unsupported platforms).
+	// Empty if creating the Watcher failed.
+	Backend string
+
+	// Operation: "new" (creating a Watcher), "add", "remove", "close", "read"
+	// and "sysfd" (for WithExternalLoop), or "watch" for errors sent on
+	// Watcher.Errors.
+	Op string
+
+	// The underlying error.
+	Err error
+
+	watches func() []string
+}
+
+// WatchError is implemented by errors for a watch, to find out which watch it's
+// for and if it needs to be re-added. All errors returned by [Watcher] methods
+// and sent on [Watcher.Errors] implement this.
+type WatchError interface {
+	error
+
+	// WatchPath gets the watched path the error is for. This may be different
+	// from the path in the error, for example for an error reading a file in a
+	// watched directory this is the directory. Returns the path in the error if
+	// it's no longer watched, or "" if the error isn't for a single watch.
+	WatchPath() string
+
+	// WatchActive reports if the watch is still active. If it's not, the path
+	// needs to be added again to keep watching it.
+	WatchActive() bool
+}
+
+func (e *Error) Error() string {
+	msg := strings.TrimPrefix(e.Err.Error(), "fsnotify: ")
+	if e.Path == "" || strings.Contains(msg, e.Path) {
+		return "fsnotify: " + msg
+	}
+	return fmt.Sprintf("fsnotify: %s %q: %s", e.Op, e.Path, msg)
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+func (e *Error) WatchPath() string {
+	if p, ok := e.watch(); ok {
+		return p
+	}
+	return e.Path
+}
+
+func (e *Error) WatchActive() bool {
+	_, ok := e.watch()
+	return ok
+}
+
+// watch finds the watch for Path: the path itself, or the closest watched
+// parent directory. This uses the current list of watches, rather than the
+// list when the error was sent.
+func (e *Error) watch() (string, bool) {
+	if e.Path == "" || e.watches == nil {
+		return "", false
+	}
+	var (
+		path  = filepath.Clean(e.Path)
+		found string
+		ok    bool
+	)
+	for _, p := range e.watches() {
+		p, _ = recursivePath(p)
+		p = filepath.Clean(p)
+		if path != p && !strings.HasPrefix(path, strings.TrimSuffix(p, string(filepath.Separator))+string(filepath.Separator)) {
+			continue
+		}
+		if !ok || len(p) > len(found) {
+			found, ok = p, true
+		}
+	}
+	return found, ok
+}
+
+// wrapError wraps err in an [*Error], unless it's nil or already an *Error.
+// The path is taken from err if it's empty and err has one. b may be nil if
+// there's no backend.
+func wrapError(b backend, op, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	if path == "" {
+		var (
+			lost  *WatchLostError
+			poll  *PollingError
+			limit *WatchLimitError
+			perr  *fs.PathError
+		)
+		switch {
+		case errors.As(err, &lost):
+			path = lost.Path
+		case errors.As(err, &poll):
+			path = poll.Path
+		case errors.As(err, &limit):
+			path = limit.Path
+		case errors.As(err, &perr):
+			path = perr.Path
+		}
+	}
+	e := &Error{Path: path, Op: op, Err: err}
+	if b != nil {
+		e.Backend, e.watches = b.name(), b.WatchList
+	}
+	return e
+}
+
+func (w *Watcher) wrap(op, path string, err error) error {
+	err = wrapError(w.b, op, path, err)
+	if e, ok := err.(*Error); ok {
+		e.watches = w.WatchList
+	}
+	return err
+}
+
 // NewWatcher creates a new Watcher.
 func NewWatcher() (*Watcher, error) {
 	ev, errs := make(chan Event), make(chan error)
 	b, err := newBackend(ev, errs)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(nil, "new", "", err)
 	}
-	return &Watcher{b: b, Events: ev, Errors: errs}, nil
+	return &Watcher{b: b, Events: ev, Errors: errs, clone: newCloneState(NewWatcher)}, nil
 }
 
 // NewBufferedWatcher creates a new Watcher with a buffered Watcher.Events
@@ -267,11 +803,202 @@ func NewWatcher() (*Watcher, error) {
 // buffers instead of adding a large userspace buffer.
 func NewBufferedWatcher(sz uint) (*Watcher, error) {
 	ev, errs := make(chan Event), make(chan error)
-	b, err := newBufferedBackend(sz, ev, errs)
+	b, err := newBufferedBackend(sz, ev, errs, defaultWatcherOpts)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(nil, "new", "", err)
 	}
-	return &Watcher{b: b, Events: ev, Errors: errs}, nil
+	return &Watcher{b: b, Events: ev, Errors: errs,
+		clone: newCloneState(func() (*Watcher, error) { return NewBufferedWatcher(sz) })}, nil
+}
+
+// NewWatcherWith creates a new Watcher with the given options.
+//
+// Options:
+//
+//   - [WithWorkers]: number of threads reading events (Windows only).
+//   - [WithWholeVolume]: watch entire volumes (Windows and Linux only).
+//   - [WithLongNames]: convert 8.3 short names in events (Windows only).
+//   - [WithQueueWarning]: get notified before the event queue overflows
+//     (Linux only).
+//   - [WithRenameWindow]: how long to wait for the second half of a rename.
+//   - [WithExternalLoop]: read events from your own event loop (Linux, macOS,
+//     and BSD only).
+//   - [WithAudit]: watch files by identity with the audit subsystem (Linux
+//     only).
+//   - [WithEBPF]: get events from eBPF programs on syscall tracepoints
+//     (experimental; Linux only).
+//   - [WithWatchman]: get events from a Watchman daemon.
+//   - [WithFileWatches]: watch every file in watched directories (macOS and
+//     BSD only).
+//   - [WithSandbox]: limit the file descriptors used, for sandboxed Apple
+//     platforms (macOS and BSD only; the default on iOS).
+//   - [WithNoPolling]: don't poll paths on network filesystems (Linux, macOS,
+//     and BSD only).
+//   - [WithSSH]: watch paths on a remote system over SSH.
+//   - [WithObjectStore]: watch object storage buckets.
+//   - [WithSyntheticLoad]: generate events to benchmark the code reading them.
+//   - [WithChecksum]: add a checksum of the file contents to Write events.
+//   - [WithSettled]: send a single Write event once a file is done being
+//     written.
+//   - [WithAtomicSave]: keep watching files that are replaced by a rename.
+//   - [WithPersist]: keep watching files that are removed and re-created.
+//   - [WithSymlinks]: move the watch when a watched symlink is changed.
+//   - [WithRelativePaths]: send paths relative to the added path.
+//   - [WithSelfEvents]: send events for added directories themselves.
+//   - [WithCanonicalPaths]: use absolute paths without symlinks.
+//   - [WithNFC]: normalize paths to NFC on macOS.
+//   - [WithRawEvents]: get the events as read from the system.
+//   - [WithHealing]: re-establish watches that stopped working.
+//   - [WithWatchBudget]: limit the number of watches, removing watches to
+//     stay within the limit.
+//   - [WithMemoryLimit]: limit the memory used for events that are held.
+//   - [WithProfiling]: add pprof labels to the goroutines, and time sending
+//     events.
+//   - [WithFaults]: simulate failures, for tests.
+//   - [WithClock]: use a fake clock for debouncing and polling, for tests.
+func NewWatcherWith(opts ...watcherOpt) (*Watcher, error) {
+	with := getWatcherOptions(opts...)
+	if !with.profiling {
+		return newWatcherWith(with, opts)
+	}
+	var (
+		w   *Watcher
+		err error
+	)
+	withLabels(with, func() { w, err = newWatcherWith(with, opts) })
+	return w, err
+}
+
+func newWatcherWith(with watcherOpts, opts []watcherOpt) (*Watcher, error) {
+	if with.checksum != nil && with.external {
+		return nil, wrapError(nil, "new", "", fmt.Errorf("%w: WithChecksum with WithExternalLoop", xErrUnsupported))
+	}
+	if with.settled && with.external {
+		return nil, wrapError(nil, "new", "", fmt.Errorf("%w: WithSettled with WithExternalLoop", xErrUnsupported))
+	}
+	if (with.atomicSave || with.persist) && (with.external || with.ssh != "" || with.objectStore != nil || with.synthetic != nil) {
+		return nil, wrapError(nil, "new", "", fmt.Errorf("%w: WithAtomicSave or WithPersist with WithExternalLoop, WithSSH, WithObjectStore, or WithSyntheticLoad", xErrUnsupported))
+	}
+	if with.symlinks && (with.external || with.ssh != "" || with.objectStore != nil || with.synthetic != nil) {
+		return nil, wrapError(nil, "new", "", fmt.Errorf("%w: WithSymlinks with WithExternalLoop, WithSSH, WithObjectStore, or WithSyntheticLoad", xErrUnsupported))
+	}
+	if with.heal > 0 && with.external {
+		return nil, wrapError(nil, "new", "", fmt.Errorf("%w: WithHealing with WithExternalLoop", xErrUnsupported))
+	}
+	if with.budget > 0 && with.external {
+		return nil, wrapError(nil, "new", "", fmt.Errorf("%w: WithWatchBudget with WithExternalLoop", xErrUnsupported))
+	}
+	if with.faults != nil && with.external {
+		return nil, wrapError(nil, "new", "", fmt.Errorf("%w: WithFaults with WithExternalLoop", xErrUnsupported))
+	}
+
+	outEv, outErr := make(chan Event), make(chan error)
+	ev, errs := outEv, outErr
+	var prof *profiler
+	if with.profileHooks != nil {
+		prof = newProfiler(with, ev, errs)
+		ev, errs = prof.inEv, prof.inErr
+	}
+	var rel *relPaths
+	if with.relative || with.noSelf {
+		rel = newRelPaths(with, ev, errs)
+		ev, errs = rel.inEv, rel.inErr
+	}
+	var bg *budget
+	if with.budget > 0 {
+		bg = newBudget(with, ev, errs)
+		ev, errs = bg.inEv, bg.inErr
+	}
+	var h *healer
+	if with.heal > 0 {
+		h = newHealer(with, ev, errs)
+		ev, errs = h.inEv, h.inErr
+	}
+	var s *settler
+	if with.checksum != nil || with.settled {
+		s = newSettler(with, ev, errs)
+		ev, errs = s.inEv, s.inErr
+	}
+	var lw *linkWatcher
+	if with.symlinks {
+		lw = newLinkWatcher(ev, errs)
+		ev, errs = lw.inEv, lw.inErr
+	}
+	var fw *fileWatcher
+	if with.atomicSave || with.persist {
+		fw = newFileWatcher(with, ev, errs)
+		ev, errs = fw.inEv, fw.inErr
+	}
+	var ft *faulter
+	if with.faults != nil {
+		ft = newFaulter(with, ev, errs)
+		ev, errs = ft.inEv, ft.inErr
+	}
+
+	var (
+		b   backend
+		err error
+	)
+	switch {
+	case with.watchman:
+		b, err = newWatchman(with.watchmanSock, ev, errs)
+	case with.ssh != "":
+		b, err = newSSH(with.ssh, ev, errs)
+	case with.objectStore != nil:
+		b, err = newObjectWatcher(with.objectStore, ev, errs)
+	case with.synthetic != nil:
+		b, err = newSynthetic(*with.synthetic, with.clock, ev, errs)
+	default:
+		b, err = newBufferedBackend(0, ev, errs, with)
+	}
+	if err != nil {
+		return nil, wrapError(nil, "new", "", err)
+	}
+	if h != nil {
+		v, ok := b.(verifier)
+		if !ok {
+			b.Close()
+			return nil, wrapError(nil, "new", "", fmt.Errorf("%w: WithHealing", xErrUnsupported))
+		}
+		h.b, h.v = b, v
+	}
+	if s != nil {
+		s.closeWrite, s.b = with.settled && b.xSupports(UnportableCloseWrite), b
+		go s.run()
+	}
+	if fw != nil {
+		fw.b = b
+		go fw.run()
+	}
+	w := &Watcher{b: b, settle: s, files: fw, links: lw, heal: h, rel: rel, budget: bg, prof: prof, faults: ft,
+		canonical: with.canonical, Events: outEv, Errors: outErr,
+		clone: newCloneState(func() (*Watcher, error) { return NewWatcherWith(opts...) })}
+	if rel != nil {
+		go rel.run()
+	}
+	if lw != nil {
+		lw.b, lw.add, lw.remove, lw.list = b, b.AddWith, b.Remove, w.WatchList
+		if fw != nil {
+			lw.add, lw.remove = fw.add, fw.remove
+		}
+		go lw.run()
+	}
+	if h != nil {
+		h.add, h.remove, h.list = w.add, w.remove, w.WatchList
+		go h.run()
+	}
+	if bg != nil {
+		bg.counts, bg.remove, bg.backend = w.WatchCounts, w.Remove, b
+		go bg.run()
+	}
+	if prof != nil {
+		go prof.run()
+	}
+	if ft != nil {
+		ft.b = b
+		go ft.run()
+	}
+	return w, nil
 }
 
 // Add starts monitoring the path for changes.
@@ -280,12 +1007,24 @@ func NewBufferedWatcher(sz uint) (*Watcher, error) {
 // not return an error. Paths that do not yet exist on the filesystem cannot be
 // watched.
 //
+// On Linux a directory or file can only be watched through one path: adding a
+// symlink or bind mount of a path that's already watched returns
+// [ErrAlreadyWatched].
+//
 // A watch will be automatically removed if the watched path is deleted or
 // renamed. The exception is the Windows backend, which doesn't remove the
 // watcher on renames.
 //
 // Notifications on network filesystems (NFS, SMB, FUSE, etc.) or special
-// filesystems (/proc, /sys, etc.) generally don't work.
+// filesystems (/proc, /sys, etc.) generally don't work. On Linux, macOS, and
+// the BSDs paths on NFS, SMB/CIFS, AFS, Ceph, 9p, and FUSE filesystems are
+// polled instead, and a [*PollingError] is sent on the Errors channel to warn
+// about this.
+//
+// On Linux, directories on SMB/CIFS mounts get change notifications from the
+// SMB server rather than being polled, if both the kernel (Linux 6.3 or newer)
+// and the server support it. Chmod events are not sent for these, just like
+// on Windows.
 //
 // Returns [ErrClosed] if [Watcher.Close] was called.
 //
@@ -309,8 +1048,57 @@ func NewBufferedWatcher(sz uint) (*Watcher, error) {
 // half-written file.
 //
 // Watch the parent directory and use Event.Name to filter out files you're not
-// interested in. There is an example of this in cmd/fsnotify/file.go.
-func (w *Watcher) Add(path string) error { return w.b.Add(path) }
+// interested in. There is an example of this in cmd/fsnotify/file.go, or use
+// [WithAtomicSave] to have fsnotify do this.
+//
+// # Watching special files
+//
+// FIFOs (named pipes), sockets, and device nodes can be watched on Linux, and
+// device nodes can be watched on macOS. Other backends return a
+// [*FileTypeError] for these. Creating and removing them in a watched
+// directory is sent as usual on all platforms.
+//
+// Writing to a FIFO or device is sent as Write (and UnportableCloseWrite if
+// requested) on Linux, but only when it's done through the watched path:
+// writes to a device by the kernel or a driver aren't sent.
+func (w *Watcher) Add(path string) error {
+	if w.files != nil || w.links != nil || w.heal != nil || w.rel != nil || w.budget != nil || w.canonical ||
+		(w.settle != nil && w.settle.closeWrite) {
+		return w.AddWith(path)
+	}
+	err := w.b.Add(w.watchedCase(path))
+	if err == nil {
+		w.clone.track(path)
+	}
+	return w.wrap("add", path, err)
+}
+
+// AddTx adds all paths with [Watcher.Add], or none of them: if adding a path
+// fails then the paths that were added by this call are removed again and the
+// error for the path that failed is returned.
+//
+// Paths that were already watched before the call are left alone.
+func (w *Watcher) AddTx(paths ...string) error {
+	watched := make(map[string]struct{})
+	for _, p := range w.WatchList() {
+		watched[filepath.Clean(p)] = struct{}{}
+	}
+
+	added := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if err := w.Add(p); err != nil {
+			for i := len(added) - 1; i >= 0; i-- {
+				_ = w.Remove(added[i])
+			}
+			return err
+		}
+		if _, ok := watched[filepath.Clean(p)]; !ok {
+			watched[filepath.Clean(p)] = struct{}{}
+			added = append(added, p)
+		}
+	}
+	return nil
+}
 
 // AddWith is like [Watcher.Add], but allows adding options. When using Add()
 // the defaults described below are used.
@@ -319,7 +1107,71 @@ func (w *Watcher) Add(path string) error { return w.b.Add(path) }
 //
 //   - [WithBufferSize] sets the buffer size for the Windows backend; no-op on
 //     other platforms. The default is 64K (65536 bytes).
-func (w *Watcher) AddWith(path string, opts ...addOpt) error { return w.b.AddWith(path, opts...) }
+//   - [WithOps] sets which operations to listen for.
+//   - [WithExcludeUnlinked] stops events for removed files that are still open;
+//     only has effect on Linux.
+//   - [WithRetry] retries adding the path if it fails with a transient error.
+//   - [WithPriority] sets the priority for [EvictPriority].
+//   - [WithPolling] polls the path, for files on /proc and /sys; only has
+//     effect on Linux, macOS, and the BSDs.
+//   - [WithSymlinkChain] watches every symlink followed to get to the target;
+//     needs [WithSymlinks].
+//
+// Adding a path that's already watched adds the operations to the existing
+// ones; operations are never removed this way. Use [Watcher.Remove] first to
+// watch fewer operations. [Watcher.WatchOps] gets the combined operations.
+//
+// On Linux, adding a path that refers to a file or directory that's already
+// watched under a different path (for example through a symlink or bind mount)
+// returns an error, as inotify uses a single watch for both.
+func (w *Watcher) AddWith(path string, opts ...addOpt) error {
+	path = w.canonicalPath(path)
+	var (
+		err  error
+		with = getOptions(opts...)
+	)
+	if with.linkChain && w.links == nil {
+		return w.wrap("add", path, fmt.Errorf("%w: WithSymlinkChain without WithSymlinks", xErrUnsupported))
+	}
+	if err := getPollConfig(with).checkAdaptive(); err != nil {
+		return w.wrap("add", path, err)
+	}
+	if with.retry > 0 {
+		err = retry(with.retry, path, func() error { return w.add(path, opts...) })
+	} else {
+		err = w.add(path, opts...)
+	}
+	if err == nil && w.budget != nil {
+		err = w.budget.add(path, with.priority)
+	}
+	if err == nil && w.heal != nil {
+		w.heal.track(path, opts...)
+	}
+	if err == nil && w.rel != nil {
+		w.rel.track(path)
+	}
+	if err == nil {
+		w.clone.track(path, opts...)
+	}
+	return w.wrap("add", path, err)
+}
+
+// add adds path to the backend, through the fileWatcher if needed.
+func (w *Watcher) add(path string, opts ...addOpt) error {
+	// WithSettled() needs UnportableCloseWrite to know when a write is done.
+	if w.settle != nil && w.settle.closeWrite {
+		if with := getOptions(opts...); with.op.Has(Write) {
+			opts = append(opts, WithOps(with.op|UnportableCloseWrite))
+		}
+	}
+	if w.links != nil {
+		return w.links.addLink(path, opts...)
+	}
+	if w.files != nil {
+		return w.files.add(path, opts...)
+	}
+	return w.b.AddWith(path, opts...)
+}
 
 // Remove stops monitoring the path for changes.
 //
@@ -327,70 +1179,744 @@ func (w *Watcher) AddWith(path string, opts ...addOpt) error { return w.b.AddWit
 // /tmp/dir and /tmp/dir/subdir then you will need to remove both.
 //
 // Removing a path that has not yet been added returns [ErrNonExistentWatch].
+// On case-insensitive filesystems (the default on Windows and macOS) the case
+// of path doesn't need to match the path that was added.
 //
 // Returns nil if [Watcher.Close] was called.
-func (w *Watcher) Remove(path string) error { return w.b.Remove(path) }
+func (w *Watcher) Remove(path string) error {
+	path = w.canonicalPath(path)
+	if w.heal != nil {
+		w.heal.forget(path)
+	}
+	if w.rel != nil {
+		w.rel.forget(path)
+	}
+	if w.budget != nil {
+		w.budget.forget(path)
+	}
+	w.clone.forget(path)
+	return w.wrap("remove", path, w.remove(path))
+}
 
-// Close removes all watches and closes the Events channel.
-func (w *Watcher) Close() error { return w.b.Close() }
+// remove removes path from the backend, through the fileWatcher if needed.
+func (w *Watcher) remove(path string) error {
+	if w.links != nil {
+		return w.links.removeLink(path)
+	}
+	if w.files != nil {
+		return w.files.remove(path)
+	}
+	return w.b.Remove(path)
+}
 
-// WatchList returns all paths explicitly added with [Watcher.Add] (and are not
-// yet removed).
+// RemoveOps stops watching path for the operations in op, without removing the
+// watch; removing and adding the path again would lose events between the
+// two. This has the same effect as adding path with [WithOps] without these
+// operations in the first place.
 //
-// Returns nil if [Watcher.Close] was called.
-func (w *Watcher) WatchList() []string { return w.b.WatchList() }
-
-// Supports reports if all the listed operations are supported by this platform.
+// Not every backend can filter all operations (see [WatchInfo].Op): kqueue
+// (macOS and the BSDs) and Windows always send Create, Write, Remove, Rename,
+// and Chmod, so only unportable operations can be removed there.
 //
-// Create, Write, Remove, Rename, and Chmod are always supported. It can only
-// return false for an Op starting with Unportable.
-func (w *Watcher) Supports(op Op) bool { return w.b.xSupports(op) }
+// Returns an error if path isn't watched, or if it would leave no operations;
+// use [Watcher.Remove] for that. Recursive watches aren't supported, and it's
+// not supported with WithAudit, WithEBPF, WithWatchman, WithWholeVolume, or
+// fanotify.
+func (w *Watcher) RemoveOps(path string, op Op) error {
+	path = w.canonicalPath(path)
+	b, ok := w.b.(opRemover)
+	if !ok {
+		return w.wrap("remove", path, fmt.Errorf("%w: RemoveOps", xErrUnsupported))
+	}
 
-func (o Op) String() string {
-	var b strings.Builder
-	if o.Has(Create) {
-		b.WriteString("|CREATE")
+	var err error
+	if w.files != nil {
+		err = w.files.removeOps(path, op, b)
+	} else {
+		err = b.removeOps(path, op)
 	}
-	if o.Has(Remove) {
-		b.WriteString("|REMOVE")
+	if err == nil && w.heal != nil {
+		w.heal.removeOps(path, op)
 	}
-	if o.Has(Write) {
-		b.WriteString("|WRITE")
+	if err == nil {
+		w.clone.removeOps(path, op)
 	}
-	if o.Has(xUnportableOpen) {
-		b.WriteString("|OPEN")
+	return w.wrap("remove", path, err)
+}
+
+// UpdateWith changes the options of a path that's already watched, without
+// removing the watch; removing and adding the path again would lose events
+// between the two.
+//
+// The watch is updated to what it would be if path had been added with opts in
+// the first place: operations not in [WithOps] are removed with
+// [Watcher.RemoveOps], and new ones are added. The buffer size set with
+// [WithBufferSize] (only used on Windows) is used from the next read; use
+// [Watcher.SetBufferSize] to change it right away. Other options, such as
+// [WithExcludeUnlinked], can't be changed and are ignored.
+//
+// New operations are added before the old ones are removed, so no events are
+// missed for operations in both the old and new set. Backends that can't
+// remove operations return an error if that's needed; see [Watcher.RemoveOps].
+//
+// Returns [ErrNonExistentWatch] if path isn't watched.
+func (w *Watcher) UpdateWith(path string, opts ...addOpt) error {
+	path = w.canonicalPath(path)
+	cur := w.WatchOps(path)
+	if cur == 0 {
+		return w.wrap("update", path, fmt.Errorf("%w: %s", ErrNonExistentWatch, path))
 	}
-	if o.Has(xUnportableRead) {
-		b.WriteString("|READ")
+
+	with := getOptions(opts...)
+	want := with.op
+	if w.settle != nil && w.settle.closeWrite && want.Has(Write) {
+		want |= UnportableCloseWrite
 	}
-	if o.Has(UnportableCloseWrite) {
-		b.WriteString("|CLOSE_WRITE")
+	rm, canRemove := w.b.(opRemover)
+	if cur&^want != 0 && !canRemove {
+		return w.wrap("update", path, fmt.Errorf("%w: removing operations with UpdateWith", xErrUnsupported))
 	}
-	if o.Has(xUnportableCloseRead) {
-		b.WriteString("|CLOSE_READ")
+
+	err := w.add(path, WithOps(cur|want), WithBufferSize(with.bufsize))
+	if err == nil {
+		if b, ok := w.b.(bufSizer); ok {
+			err = b.setBufferSize(path, with.bufsize)
+		}
 	}
-	if o.Has(Rename) {
-		b.WriteString("|RENAME")
+	if err == nil && cur&^want != 0 {
+		if w.files != nil {
+			err = w.files.removeOps(path, cur&^want, rm)
+		} else {
+			err = rm.removeOps(path, cur&^want)
+		}
 	}
-	if o.Has(Chmod) {
-		b.WriteString("|CHMOD")
+	if err == nil && w.heal != nil {
+		w.heal.forget(path)
+		w.heal.track(path, opts...)
 	}
-	if b.Len() == 0 {
-		return "[no events]"
+	if err == nil {
+		w.clone.forget(path)
+		w.clone.track(path, opts...)
 	}
-	return b.String()[1:]
+	return w.wrap("update", path, err)
 }
 
-// Has reports if this operation has the given operation.
-func (o Op) Has(h Op) bool { return o&h != 0 }
+// SetBufferSize changes the size of the ReadDirectoryChangesW buffer for path to
+// bytes, as if it had been added with [WithBufferSize]. Unlike [Watcher.UpdateWith]
+// this takes effect right away: the pending read is cancelled and issued again
+// with the new buffer, without removing the watch or losing events.
+//
+// This can be used to react to [ErrEventOverflow] errors at runtime. The
+// buffer still grows automatically after overflows, and doesn't shrink below
+// bytes; see [Stats.BufferSizes] for the current size.
+//
+// Only supported on Windows. Returns [ErrNonExistentWatch] if path isn't
+// watched.
+func (w *Watcher) SetBufferSize(path string, bytes int) error {
+	path = w.canonicalPath(path)
+	b, ok := w.b.(bufSizer)
+	if !ok {
+		return w.wrap("update", path, fmt.Errorf("%w: SetBufferSize", xErrUnsupported))
+	}
+	err := b.resizeBufferNow(path, bytes)
+	if err == nil && w.heal != nil {
+		w.heal.track(path, WithBufferSize(bytes))
+	}
+	if err == nil {
+		w.clone.setOpts(path, WithBufferSize(bytes))
+	}
+	return w.wrap("update", path, err)
+}
+
+func errAllOps(path string) error {
+	return fmt.Errorf("fsnotify: can't remove all operations for %q; use Remove()", path)
+}
+
+// Close removes all watches and closes the Events channel.
+func (w *Watcher) Close() error {
+	if w.prof != nil {
+		w.prof.close()
+	}
+	if w.rel != nil {
+		w.rel.close()
+	}
+	if w.heal != nil {
+		w.heal.close()
+	}
+	if w.budget != nil {
+		w.budget.close()
+	}
+	if w.settle != nil {
+		w.settle.close()
+	}
+	if w.links != nil {
+		w.links.close()
+	}
+	if w.files != nil {
+		w.files.close()
+	}
+	if w.faults != nil {
+		w.faults.close()
+	}
+	err := w.b.Close()
+	if w.settle != nil {
+		<-w.settle.done
+	}
+	if w.links != nil {
+		<-w.links.done
+	}
+	if w.files != nil {
+		<-w.files.done
+	}
+	if w.heal != nil {
+		<-w.heal.done
+	}
+	if w.budget != nil {
+		<-w.budget.done
+	}
+	if w.rel != nil {
+		<-w.rel.done
+	}
+	if w.prof != nil {
+		<-w.prof.done
+	}
+	if w.faults != nil {
+		<-w.faults.done
+	}
+	return w.wrap("close", "", err)
+}
+
+// WatchList returns all paths explicitly added with [Watcher.Add] (and are not
+// yet removed).
+//
+// Returns nil if [Watcher.Close] was called.
+func (w *Watcher) WatchList() []string {
+	l := w.b.WatchList()
+	if w.files != nil {
+		l = w.files.watchList(l)
+	}
+	if w.links != nil {
+		l = w.links.watchList(l)
+	}
+	return l
+}
+
+// WatchInfo is information about a watch, from [Watcher.WatchInfo].
+type WatchInfo struct {
+	// Watched path.
+	Path string
+
+	// Operations for which events are sent. This can include more than the
+	// operations added with [WithOps], as not every backend can filter all
+	// operations.
+	Op Op
+
+	// Part of a recursive watch.
+	Recursive bool
+
+	// Symlinks aren't followed; the symlink itself is watched.
+	NoFollow bool
+
+	// Path is polled, rather than getting change notifications from the
+	// system.
+	Polled bool
+
+	// Added by fsnotify rather than with [Watcher.Add]: for the directories in
+	// a recursive watch, files in a watched directory on kqueue, and
+	// directories that are watched for [WithAtomicSave] and [WithPersist].
+	Internal bool
+
+	// Path added with [Watcher.Add] this watch is for; the same as Path for
+	// watches that aren't internal, or internal watches that aren't for a
+	// single path.
+	Root string
+
+	// Identifier of the watch in the backend: the inotify watch descriptor,
+	// the file descriptor on kqueue, or the directory handle on Windows. 0 if
+	// there isn't one, such as for polled paths.
+	ID uint64
+}
+
+// WatchInfo returns information about all watches, sorted by path. Unlike
+// [Watcher.WatchList] this includes watches that were added internally.
+//
+// Only the Path is set for backends other than inotify (Linux), kqueue (macOS
+// and the BSDs), and Windows.
+//
+// Returns nil if [Watcher.Close] was called.
+func (w *Watcher) WatchInfo() []WatchInfo {
+	var l []WatchInfo
+	if b, ok := w.b.(watchInfoLister); ok {
+		l = b.watchInfo()
+	} else {
+		for _, p := range w.b.WatchList() {
+			l = append(l, WatchInfo{Path: p})
+		}
+	}
+	if w.files != nil {
+		l = w.files.watchInfo(l)
+	}
+	if w.links != nil {
+		l = w.links.watchInfo(l)
+	}
+	for i := range l {
+		if l[i].Root == "" {
+			l[i].Root = l[i].Path
+		}
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Path < l[j].Path })
+	return l
+}
+
+// WatchOps gets the operations that are watched for path: all the operations
+// it was added with (see [Watcher.AddWith]). This can include more
+// operations than were added, as not every backend can filter all operations;
+// see [WatchInfo].Op.
+//
+// Returns 0 if path isn't watched, or if it's not known (on backends where
+// [Watcher.WatchInfo] only has the path).
+func (w *Watcher) WatchOps(path string) Op {
+	path = filepath.Clean(w.canonicalPath(path))
+	for _, wi := range w.WatchInfo() {
+		if filepath.Clean(wi.Path) == path && !wi.Internal {
+			return wi.Op
+		}
+	}
+	return 0
+}
+
+// WatchCounts returns the number of watches for every path added with
+// [Watcher.Add], including the watches fsnotify added for it internally (such
+// as every directory in a recursive watch). This is the number of entries in
+// [Watcher.WatchInfo] for every Root.
+//
+// This can be used to find out which paths use the most watches when running
+// out of them (e.g. the fs.inotify.max_user_watches sysctl on Linux).
+func (w *Watcher) WatchCounts() map[string]int {
+	l := w.WatchInfo()
+	if l == nil {
+		return nil
+	}
+	counts := make(map[string]int)
+	for _, wi := range l {
+		counts[wi.Root]++
+	}
+	return counts
+}
+
+// AddMount starts monitoring everything on the mount that mountpoint is on,
+// with a single fanotify FAN_MARK_MOUNT mark. Events are filtered to the paths
+// under mountpoint, and have [Event.Pid] set to the process that triggered
+// them.
+//
+// The Watcher must be created with [WithWholeVolume], and this is only
+// supported on Linux. Use [Watcher.Remove] to stop monitoring it.
+//
+// The kernel doesn't support directory changes for mount marks, so only Write
+// and the unportable open, read, and close events are sent; other operations
+// set with [WithOps] are ignored. Use [Watcher.Add] for a FAN_MARK_FILESYSTEM
+// mark if you need those.
+func (w *Watcher) AddMount(mountpoint string, opts ...addOpt) error {
+	b, ok := w.b.(mountWatcher)
+	if !ok {
+		return w.wrap("add", mountpoint, fmt.Errorf("%w: AddMount", xErrUnsupported))
+	}
+	return w.added(mountpoint, b.addMount(mountpoint, opts...))
+}
+
+// AddInNamespace starts monitoring path in the mount namespace nsPath, for
+// example "/proc/1234/ns/mnt" to watch a path inside a container. The path is
+// resolved inside the namespace (including any symlinks), and events use the
+// path as it's seen in the namespace.
+//
+// A path can't be watched both inside and outside the namespace, or in two
+// namespaces, with the same Watcher; use a Watcher per namespace. The path must
+// be absolute, and can't be a recursive ("/...") path.
+//
+// This needs CAP_SYS_ADMIN, and is only supported on Linux with the default
+// inotify backend. Use [Watcher.Remove] with path to stop monitoring it.
+func (w *Watcher) AddInNamespace(nsPath, path string, opts ...addOpt) error {
+	b, ok := w.b.(nsWatcher)
+	if !ok {
+		return w.wrap("add", path, fmt.Errorf("%w: AddInNamespace", xErrUnsupported))
+	}
+	return w.added(path, b.addInNamespace(nsPath, path, opts...))
+}
+
+// AddFile starts monitoring the already opened file or directory f. This
+// watches what f refers to, rather than resolving the path again; the path may
+// have been replaced since it was opened, and this will still watch the
+// original file or directory. It keeps working if f is renamed, but events
+// will still use f.Name() as the path.
+//
+// f can be closed after AddFile returns. Use [Watcher.Remove] with f.Name() to
+// stop monitoring it.
+//
+// Supported on the same platforms as [Watcher.AddFd].
+func (w *Watcher) AddFile(f *os.File, opts ...addOpt) error {
+	b, ok := w.b.(fdAdder)
+	if !ok {
+		return w.wrap("add", f.Name(), fmt.Errorf("%w: AddFile", xErrUnsupported))
+	}
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return w.wrap("add", f.Name(), err)
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		err = b.addFd(int(fd), f.Name(), opts...)
+	})
+	if cerr != nil {
+		err = cerr
+	}
+	return w.added(f.Name(), err)
+}
+
+// AddFd starts monitoring the file or directory the file descriptor fd refers
+// to, such as a descriptor received over a Unix socket or opened with O_PATH.
+// Events use name as the path, and [Watcher.Remove] with name stops monitoring
+// it. Like [Watcher.AddFile], this doesn't resolve name.
+//
+// fd isn't used after AddFd returns, and can be closed.
+//
+// Only supported on Linux with the default inotify backend, and on macOS and
+// the BSDs. With kqueue the files in a directory are still opened by their
+// path, and O_PATH descriptors can't be used.
+func (w *Watcher) AddFd(fd int, name string, opts ...addOpt) error {
+	b, ok := w.b.(fdAdder)
+	if !ok {
+		return w.wrap("add", name, fmt.Errorf("%w: AddFd", xErrUnsupported))
+	}
+	return w.added(name, b.addFd(fd, name, opts...))
+}
+
+// AddAt starts monitoring relpath relative to the directory file descriptor
+// dirfd. The path is opened one component at a time with openat(), without
+// following symlinks, so a privileged process can't be tricked into watching
+// something outside dirfd by a symlink swapped in while resolving the path.
+// relpath can't be absolute or contain "..".
+//
+// Events use relpath as the path, and [Watcher.Remove] with relpath stops
+// monitoring it.
+//
+// Supported on the same platforms as [Watcher.AddFd].
+func (w *Watcher) AddAt(dirfd int, relpath string, opts ...addOpt) error {
+	b, ok := w.b.(fdAdder)
+	if !ok {
+		return w.wrap("add", relpath, fmt.Errorf("%w: AddAt", xErrUnsupported))
+	}
+	return w.added(relpath, addAt(b, dirfd, relpath, opts...))
+}
+
+// added records path as a root for WithRelativePaths() if err is nil, and
+// wraps err.
+func (w *Watcher) added(path string, err error) error {
+	if err == nil && w.rel != nil {
+		w.rel.track(path)
+	}
+	return w.wrap("add", path, err)
+}
+
+// SysFd returns the file descriptor the backend reads events from, so it can be
+// integrated in an existing event loop (e.g. with epoll or kqueue). When the
+// file descriptor is readable [Watcher.ReadEvents] should be called.
+//
+// The Watcher must be created with [WithExternalLoop].
+//
+// Only supported on Linux (the inotify file descriptor) and on macOS and the
+// BSDs (the kqueue file descriptor). The file descriptor is owned by the
+// Watcher and must not be read from or closed; it's closed on [Watcher.Close].
+func (w *Watcher) SysFd() (int, error) {
+	b, ok := w.b.(externalLoop)
+	if !ok {
+		return -1, w.wrap("sysfd", "", fmt.Errorf("%w: SysFd", xErrUnsupported))
+	}
+	fd, err := b.sysFd()
+	return fd, w.wrap("sysfd", "", err)
+}
+
+// ReadEvents reads all events and errors that are currently available, without
+// blocking. It's usually called when the file descriptor from [Watcher.SysFd]
+// becomes readable.
+//
+// The Watcher must be created with [WithExternalLoop]. Returns [ErrClosed] if
+// [Watcher.Close] was called.
+func (w *Watcher) ReadEvents() ([]Event, []error) {
+	b, ok := w.b.(externalLoop)
+	if !ok {
+		return nil, []error{w.wrap("read", "", fmt.Errorf("%w: ReadEvents", xErrUnsupported))}
+	}
+	events, errs := b.readAvailable()
+	for i := range errs {
+		errs[i] = w.wrap("read", "", errs[i])
+	}
+	return events, errs
+}
+
+// Verify checks if all watches still work, and returns an error for every watch
+// that doesn't. The errors are an [*Error] with Op "verify", and wrap
+// [ErrWatchDead] or [ErrWatchDiverged].
+//
+// Normally an event is sent when a watch stops working, but this isn't always
+// the case: for example kqueue watches on filesystems that don't send
+// NOTE_DELETE, or watches on network filesystems. Verify can be called
+// periodically to detect this, after which the watch can be removed and added
+// again.
+//
+// Watches that are being removed may be reported if the event for it wasn't
+// processed yet.
+//
+// Only supported on Linux (inotify), macOS and the BSDs (kqueue), and Windows.
+func (w *Watcher) Verify() []error {
+	b, ok := w.b.(verifier)
+	if !ok {
+		return []error{w.wrap("verify", "", fmt.Errorf("%w: Verify", xErrUnsupported))}
+	}
+	failed := b.verify()
+	paths := make([]string, 0, len(failed))
+	for p := range failed {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	errs := make([]error, 0, len(paths))
+	for _, p := range paths {
+		errs = append(errs, w.wrap("verify", p, failed[p]))
+	}
+	return errs
+}
+
+// Stats returns statistics about the watcher, which can be useful for
+// monitoring and debugging.
+//
+// Returns the zero value if [Watcher.Close] was called.
+func (w *Watcher) Stats() Stats { return w.b.Stats() }
+
+// Stats contains statistics about a [Watcher], as returned by [Watcher.Stats].
+type Stats struct {
+	// Number of watches registered with the kernel. This can be higher than
+	// the number of paths added with [Watcher.Add]: for example kqueue with
+	// [WithFileWatches] needs a watch for every file in a watched directory.
+	Watches int
+
+	// Current ReadDirectoryChangesW buffer size for every watched directory.
+	//
+	// The buffer starts at the size set with [WithBufferSize], grows
+	// automatically after an overflow, and shrinks back once there haven't been
+	// overflows for a while.
+	//
+	// Only set on Windows.
+	BufferSizes map[string]int
+
+	// Number of bytes in the kernel queue that haven't been read yet. Every
+	// event takes 16 bytes plus the length of the filename, and the queue can
+	// hold fs.inotify.max_queued_events events before overflowing.
+	//
+	// This will generally be 0 unless events are received faster than they're
+	// read from the Events channel. See [WithQueueWarning] to get notified
+	// when this gets too high.
+	//
+	// Only set on Linux.
+	QueuedBytes int
+
+	// Number of paths that are polled rather than watched with kernel
+	// notifications; see [PollingError].
+	Polled int
+}
+
+// Probe reports what a Watcher created with [NewWatcherWith] and opts can
+// deliver for path, based on the platform and the filesystem path is on. This
+// doesn't add a watch.
+//
+// This can be used to choose a different strategy up front (e.g. rescanning
+// the directory periodically) rather than discovering missing events later.
+// The filesystem type can't always be detected, in which case it assumes that
+// kernel notifications work.
+func Probe(path string, opts ...watcherOpt) (Capabilities, error) {
+	with := getWatcherOptions(opts...)
+	if with.ssh != "" { // Remote path, so don't check anything.
+		return Capabilities{Ops: pollOps &^ Rename, Network: true, Polled: true,
+			Latency: pollInterval, FileWrites: true}, nil
+	}
+	if with.objectStore != nil {
+		return Capabilities{Ops: Create | Write | Remove, Network: true, FileWrites: true}, nil
+	}
+	if with.synthetic != nil {
+		return Capabilities{Ops: Create | Write | Remove | Rename | Chmod, FileWrites: true}, nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return Capabilities{}, err
+	}
+	c := probe(path, with)
+	if with.watchman && !c.Polled {
+		c.Ops &= Create | Write | Remove
+	}
+	return c, nil
+}
+
+// Capabilities describes what a Watcher can deliver for a path, as returned by
+// [Probe].
+type Capabilities struct {
+	// Filesystem type, e.g. "ext4", "apfs", "NTFS", or "nfs"; empty if it's
+	// not known.
+	FSType string
+
+	// Operations that can be sent; see [Watcher.Supports]. This is 0 if
+	// notifications don't work on this filesystem at all, such as /proc and
+	// /sys on Linux.
+	Ops Op
+
+	// The path is on a network (or FUSE) filesystem. Without polling only
+	// changes made on the local system are sent, if any.
+	Network bool
+
+	// Changes are found by polling rather than from kernel notifications; see
+	// [PollingError]. Writes that don't change the size or modification time,
+	// and changes that are undone before the next poll, aren't seen.
+	Polled bool
+
+	// How long it can take before a change is sent. This is 0 for kernel
+	// notifications, which are sent (almost) immediately.
+	Latency time.Duration
+
+	// Write and Chmod events are sent for files in a watched directory. This is
+	// false with kqueue (macOS and the BSDs) without [WithFileWatches], where
+	// they're only sent if the directory changes at the same time.
+	FileWrites bool
+
+	// Maximum number of kernel watches for the user (fs.inotify.max_user_watches
+	// on Linux, or the limit for [WithSandbox] with kqueue); 0 if there is no
+	// such limit or it's not known. On Android and with WithSandbox paths are
+	// polled once this is reached.
+	WatchLimit int
+}
+
+// supportedOps gets all operations for which supports returns true.
+func supportedOps(supports func(Op) bool) Op {
+	var ops Op
+	for op := Create; op <= UnportableClone; op <<= 1 {
+		if supports(op) {
+			ops |= op
+		}
+	}
+	return ops
+}
+
+// Supports reports if all the listed operations are supported by this platform.
+//
+// Create, Write, Remove, Rename, and Chmod are always supported. It can only
+// return false for an Op starting with Unportable.
+func (w *Watcher) Supports(op Op) bool { return w.b.xSupports(op) }
+
+func (o Op) String() string {
+	var b strings.Builder
+	if o.Has(Create) {
+		b.WriteString("|CREATE")
+	}
+	if o.Has(Remove) {
+		b.WriteString("|REMOVE")
+	}
+	if o.Has(Write) {
+		b.WriteString("|WRITE")
+	}
+	if o.Has(xUnportableOpen) {
+		b.WriteString("|OPEN")
+	}
+	if o.Has(xUnportableRead) {
+		b.WriteString("|READ")
+	}
+	if o.Has(UnportableCloseWrite) {
+		b.WriteString("|CLOSE_WRITE")
+	}
+	if o.Has(xUnportableCloseRead) {
+		b.WriteString("|CLOSE_READ")
+	}
+	if o.Has(UnportableSecurity) {
+		b.WriteString("|SECURITY")
+	}
+	if o.Has(UnportableExtend) {
+		b.WriteString("|EXTEND")
+	}
+	if o.Has(UnportableTruncate) {
+		b.WriteString("|TRUNCATE")
+	}
+	if o.Has(UnportableMount) {
+		b.WriteString("|MOUNT")
+	}
+	if o.Has(UnportableUnmount) {
+		b.WriteString("|UNMOUNT")
+	}
+	if o.Has(UnportableMode) {
+		b.WriteString("|MODE")
+	}
+	if o.Has(UnportableOwner) {
+		b.WriteString("|OWNER")
+	}
+	if o.Has(UnportableTimes) {
+		b.WriteString("|TIMES")
+	}
+	if o.Has(UnportableXattr) {
+		b.WriteString("|XATTR")
+	}
+	if o.Has(UnportableACL) {
+		b.WriteString("|ACL")
+	}
+	if o.Has(UnportableLink) {
+		b.WriteString("|LINK")
+	}
+	if o.Has(UnportableUnlink) {
+		b.WriteString("|UNLINK")
+	}
+	if o.Has(UnportableClone) {
+		b.WriteString("|CLONE")
+	}
+	if o.Has(Rename) {
+		b.WriteString("|RENAME")
+	}
+	if o.Has(Chmod) {
+		b.WriteString("|CHMOD")
+	}
+	if o.Has(Rescan) {
+		b.WriteString("|RESCAN")
+	}
+	if o.Has(Relink) {
+		b.WriteString("|RELINK")
+	}
+	if o.Has(Move) {
+		b.WriteString("|MOVE")
+	}
+	if b.Len() == 0 {
+		return "[no events]"
+	}
+	return b.String()[1:]
+}
+
+// Has reports if this operation has the given operation.
+func (o Op) Has(h Op) bool { return o&h != 0 }
+
+// ParseOp parses an Op as returned by [Op.String], in any case; for example
+// "write" or "CREATE|WRITE".
+func ParseOp(s string) (Op, error) {
+	var op Op
+outer:
+	for _, name := range strings.Split(s, "|") {
+		for i := 0; i < 32; i++ {
+			o := Op(1 << i)
+			if n := o.String(); n != "[no events]" && strings.EqualFold(n, name) {
+				op |= o
+				continue outer
+			}
+		}
+		return 0, fmt.Errorf("fsnotify: unknown operation %q", name)
+	}
+	return op, nil
+}
 
 // Has reports if this event has the given operation.
 func (e Event) Has(op Op) bool { return e.Op.Has(op) }
 
 // String returns a string representation of the event with their path.
 func (e Event) String() string {
-	if e.renamedFrom != "" {
-		return fmt.Sprintf("%-13s %q ← %q", e.Op.String(), e.Name, e.renamedFrom)
+	if e.RenamedFrom != "" {
+		return fmt.Sprintf("%-13s %q ← %q", e.Op.String(), e.Name, e.RenamedFrom)
 	}
 	return fmt.Sprintf("%-13s %q", e.Op.String(), e.Name)
 }
@@ -401,15 +1927,128 @@ type (
 		AddWith(string, ...addOpt) error
 		Remove(string) error
 		WatchList() []string
+		Stats() Stats
 		Close() error
 		xSupports(Op) bool
+		name() string
 	}
 	addOpt   func(opt *withOpts)
 	withOpts struct {
-		bufsize    int
-		op         Op
-		noFollow   bool
-		sendCreate bool
+		bufsize         int
+		op              Op
+		noFollow        bool
+		sendCreate      bool
+		excludeUnlinked bool
+		retry           time.Duration
+		linkChain       bool
+		followLinks     bool
+		followOutside   bool
+		poll            bool
+		pollInterval    time.Duration
+		pollMin         time.Duration
+		pollMax         time.Duration
+		pollStrategy    PollStrategy
+		priority        int
+	}
+	watcherOpt  func(opt *watcherOpts)
+	watcherOpts struct {
+		workers      int
+		volume       bool
+		longNames    bool
+		queueWarn    int
+		queueWarnFn  func(queued int)
+		renameWindow time.Duration
+		external     bool
+		audit        bool
+		ebpf         bool
+		watchman     bool
+		watchmanSock string
+		fileWatches  bool
+		sandbox      bool
+		sandboxFDs   int
+		noPolling    bool
+		ssh          string
+		objectStore  ObjectStore
+		synthetic    *SyntheticLoad
+		checksum     func() hash.Hash
+		settled      bool
+		settleQuiet  time.Duration
+		atomicSave   bool
+		persist      bool
+		symlinks     bool
+		relative     bool
+		canonical    bool
+		noSelf       bool
+		nfc          bool
+		raw          func(RawEvent)
+		heal         time.Duration
+		budget       int
+		budgetEvict  EvictFunc
+		memLimit     int
+		memPolicy    MemoryPolicy
+		profiling    bool
+		profile      string
+		profileHooks *ProfileHooks
+		faults       *Faults
+		clock        Clock
+		pollWorkers  int
+	}
+
+	// Backends that support WithExternalLoop().
+	externalLoop interface {
+		sysFd() (int, error)
+		readAvailable() ([]Event, []error)
+	}
+
+	// Backends that support AddMount().
+	mountWatcher interface {
+		addMount(string, ...addOpt) error
+	}
+
+	// Backends that support AddInNamespace().
+	nsWatcher interface {
+		addInNamespace(string, string, ...addOpt) error
+	}
+
+	// Backends that support AddFd() and AddFile().
+	fdAdder interface {
+		addFd(int, string, ...addOpt) error
+	}
+
+	// Backends that support Verify(); returns the watches that don't work
+	// (path → reason).
+	verifier interface {
+		verify() map[string]error
+	}
+
+	// Backends that support RemoveOps().
+	opRemover interface {
+		removeOps(string, Op) error
+	}
+
+	// Backends that can change the buffer size of an existing watch.
+	bufSizer interface {
+		setBufferSize(string, int) error
+		resizeBufferNow(string, int) error
+	}
+
+	// Backends that have more than the path for WatchInfo().
+	watchInfoLister interface {
+		watchInfo() []WatchInfo
+	}
+
+	// Events and errors that are waiting to be returned from ReadEvents(),
+	// for WithExternalLoop().
+	pending struct {
+		mu     sync.Mutex
+		events []Event
+		errs   []error
+
+		limit   int // WithMemoryLimit()
+		policy  MemoryPolicy
+		size    int  // Approximate bytes used by events.
+		dropped int  // Events dropped with MemoryDrop.
+		full    bool // Limit was reached; reported on the next take().
 	}
 )
 
@@ -435,6 +2074,682 @@ func getOptions(opts ...addOpt) withOpts {
 	return with
 }
 
+var defaultWatcherOpts = watcherOpts{
+	workers:     1,
+	clock:       realClock{},
+	pollWorkers: pollWorkers,
+}
+
+func getWatcherOptions(opts ...watcherOpt) watcherOpts {
+	with := defaultWatcherOpts
+	for _, o := range opts {
+		if o != nil {
+			o(&with)
+		}
+	}
+	return with
+}
+
+// WithWorkers sets the number of threads that read events from the I/O
+// completion port, for use with [NewWatcherWith].
+//
+// This only has effect on Windows systems, and is a no-op for other backends.
+//
+// All watches share a single completion port, which is read by one thread by
+// default. When watching thousands of directories with a lot of activity it
+// can help to use a few more threads, so that one busy directory doesn't hold
+// up events from all the others. Events for a single directory are always
+// sent in order, but there is no ordering between events for different
+// directories if n is higher than 1.
+//
+// Values lower than 1 are treated as 1.
+func WithWorkers(n int) watcherOpt {
+	return func(opt *watcherOpts) {
+		if n < 1 {
+			n = 1
+		}
+		opt.workers = n
+	}
+}
+
+// WithWholeVolume sets up a single recursive watch on the root of the volume
+// (e.g. "C:\\"), rather than a watch for every added path, for use with
+// [NewWatcherWith]. Events are then filtered to the added paths.
+//
+// This only has effect on Windows and Linux systems, and is a no-op for other
+// backends.
+//
+// On Linux this uses fanotify with a FAN_MARK_FILESYSTEM mark for every
+// filesystem, rather than inotify. This requires Linux 5.9 and CAP_SYS_ADMIN;
+// NewWatcherWith() will return an error otherwise. Renames are only paired
+// ([Event.RenamedFrom]) with Linux 5.17 or newer. UnportableSecurity is not
+// supported.
+//
+// Every watched directory keeps an open handle and a ReadDirectoryChangesW
+// buffer, which adds up when watching thousands of directories, as e.g.
+// indexers or backup tools do. In whole-volume mode there's only one handle and
+// buffer per volume, at the cost of receiving (and discarding) the events for
+// the entire volume; you probably want to use a larger buffer with
+// [WithBufferSize].
+//
+// The semantics of Add() and Remove() are unchanged: adding a directory will
+// send events for that directory and the files in it.
+func WithWholeVolume() watcherOpt {
+	return func(opt *watcherOpts) { opt.volume = true }
+}
+
+// WithLongNames converts 8.3 short names (e.g. "PROGRA~1") in event paths to
+// the long name ("Program Files"), for use with [NewWatcherWith].
+//
+// This only has effect on Windows systems, and is a no-op for other backends.
+//
+// Windows reports the name that was used to access a file, so if a program
+// uses the short name the event will have the short name too, which won't
+// match the path you're expecting. With this option GetLongPathName() is used
+// to get the long name. Only the part of the path below the watched directory
+// is converted; the watched directory itself is always reported as it was
+// passed to Add().
+//
+// This doesn't work if the file no longer exists, such as for Remove events and
+// the old name of a Rename; in that case only the parent directories are
+// converted.
+func WithLongNames() watcherOpt {
+	return func(opt *watcherOpts) { opt.longNames = true }
+}
+
+// WithQueueWarning calls fn when the number of unread bytes in the kernel event
+// queue goes over the given number of bytes, for use with [NewWatcherWith]. See
+// [Stats].QueuedBytes for the details.
+//
+// This only has effect on Linux systems, and is a no-op for other backends.
+//
+// When the queue is full events are dropped and [ErrEventOverflow] is sent, so
+// this can be used to slow things down before that happens. The queue is
+// checked every 100ms, and fn is called once every time the queue goes over
+// the threshold; it won't be called again until the queue went below it first.
+//
+// fn is called from a separate goroutine, and must not block for long.
+func WithQueueWarning(bytes int, fn func(queued int)) watcherOpt {
+	return func(opt *watcherOpts) { opt.queueWarn, opt.queueWarnFn = bytes, fn }
+}
+
+// WithMemoryLimit limits the memory used for events that fsnotify holds on to
+// to approximately the given number of bytes, for use with [NewWatcherWith].
+//
+// Events are normally sent as they're read from the system, and aren't
+// buffered by fsnotify. They're only held in two cases, which is where this
+// applies:
+//
+//   - [WithExternalLoop]: events read by [Watcher.ReadEvents] are held until
+//     it returns. With [MemoryBlock] it stops reading once the limit is
+//     reached, and returns the rest on the next call.
+//   - [WithSettled] and [WithChecksum]: Write events are held until the file
+//     is done being written. With [MemoryBlock] the oldest held Write is sent
+//     right away when the limit is reached.
+//
+// With [MemoryDrop] new events are dropped instead (the oldest held Write for
+// WithSettled and WithChecksum). A [*MemoryLimitError] is sent on the Errors
+// channel (or returned from ReadEvents) when the limit is reached.
+//
+// Memory used for the watches themselves isn't limited; use [WithWatchBudget]
+// for that.
+func WithMemoryLimit(bytes int, policy MemoryPolicy) watcherOpt {
+	return func(opt *watcherOpts) { opt.memLimit, opt.memPolicy = bytes, policy }
+}
+
+// WithProfiling sets pprof labels on the goroutines of the Watcher, and calls
+// the hooks when sending events, for use with [NewWatcherWith]. This can be
+// used to find out which Watcher uses CPU time in applications that have many
+// of them.
+//
+// The goroutines that read and process events get the labels
+// "fsnotify.watcher" (set to name) and "fsnotify.backend" (e.g. "inotify"),
+// replacing any labels of the goroutine that calls NewWatcherWith. Goroutines
+// started when adding a path, such as for polled paths, don't get the labels.
+//
+// hooks may be nil.
+func WithProfiling(name string, hooks *ProfileHooks) watcherOpt {
+	return func(opt *watcherOpts) { opt.profiling, opt.profile, opt.profileHooks = true, name, hooks }
+}
+
+// WithFaults simulates failures as described in [Faults], for use with
+// [NewWatcherWith] in tests.
+//
+// This can't be used with [WithExternalLoop].
+func WithFaults(f *Faults) watcherOpt {
+	return func(opt *watcherOpts) { opt.faults = f }
+}
+
+// WithPollWorkers sets the number of goroutines that read polled paths, for use
+// with [NewWatcherWith]. The default is 4.
+//
+// Every poll reads all due paths at once; with large directories (or many of
+// them, or slow network filesystems) this can take a long time with a single
+// goroutine. Directories with many entries are also read by up to n goroutines,
+// as are the files with [PollContent]. Events are still sent in the same order.
+//
+// Values lower than 1 are treated as 1.
+func WithPollWorkers(n int) watcherOpt {
+	return func(opt *watcherOpts) { opt.pollWorkers = n }
+}
+
+// WithClock sets the clock used for [WithSettled], [WithChecksum],
+// [WithAtomicSave], [WithHealing], [WithRenameWindow], the Delay in
+// [WithFaults], and the interval of polled paths, for use with
+// [NewWatcherWith] in tests.
+//
+// With a fake clock these run when the test advances the clock, rather than
+// after sleeping. Timeouts in the system calls and in the other backends
+// still use the real time.
+func WithClock(c Clock) watcherOpt {
+	return func(opt *watcherOpts) {
+		if c != nil {
+			opt.clock = c
+		}
+	}
+}
+
+// WithRenameWindow sets how long the old name of a renamed file is remembered
+// to set the old name in the Create event for the new name, for use with
+// [NewWatcherWith].
+//
+// This only has effect on Linux systems, and is a no-op for other backends.
+//
+// inotify sends a rename as two events with a matching cookie: IN_MOVED_FROM
+// for the old name (sent as Rename) and IN_MOVED_TO for the new name (sent as
+// Create), but there can be other events between the two. By default the last
+// 10 IN_MOVED_FROM events are remembered, which isn't enough when many files
+// are renamed at once or moved out of the watched directories. With this the
+// old name is remembered for d instead, however many renames there are; a
+// Create for which the old name is no longer known is sent without it.
+func WithRenameWindow(d time.Duration) watcherOpt {
+	return func(opt *watcherOpts) { opt.renameWindow = d }
+}
+
+// WithExternalLoop doesn't start a goroutine to read events, for use with
+// [NewWatcherWith]. Instead, events are read with [Watcher.ReadEvents] when the
+// file descriptor from [Watcher.SysFd] is readable, and the Events and Errors
+// channels aren't used.
+//
+// This is useful for applications that already have an event loop, or create
+// a very large number of Watchers.
+//
+// Only supported on Linux, macOS, and the BSDs; [NewWatcherWith] returns an
+// error on other platforms.
+func WithExternalLoop() watcherOpt {
+	return func(opt *watcherOpts) { opt.external = true }
+}
+
+// WithAudit uses the Linux audit subsystem rather than inotify, for use with
+// [NewWatcherWith].
+//
+// Audit rules match the inode and device of the file rather than the path, so
+// changes are reported no matter through which hard link or bind mount a file
+// is accessed, and [Event.Pid] is set to the process that made the change.
+// Events are always sent with the path as passed to [Watcher.Add].
+//
+// This requires CAP_AUDIT_CONTROL and CAP_AUDIT_READ. Auditing is enabled if it
+// isn't already (and disabled again on [Watcher.Close]). Note that only
+// processes started after auditing was enabled are audited. The audit rules are
+// global and are not removed if the process exits without calling Close(), and
+// changes may be logged to the kernel log if auditd isn't running.
+//
+// Only files are supported: adding a directory only reports changes to the
+// directory entry itself, not the files in it, and recursive watches are not
+// supported. Only the Create, Write, Remove, Rename, and Chmod operations are
+// supported.
+//
+// Only supported on Linux; [NewWatcherWith] returns an error on other
+// platforms.
+func WithAudit() watcherOpt {
+	return func(opt *watcherOpts) { opt.audit = true }
+}
+
+// WithEBPF gets events from eBPF programs attached to the syscall tracepoints,
+// rather than from inotify, for use with [NewWatcherWith]. This is
+// experimental.
+//
+// Changes are seen as the syscalls that make them, so [Event.Pid] is set to
+// the process that made the change. Relative paths are resolved with the
+// process's working directory from /proc after the event is read, which fails
+// if the process has already exited; those events are dropped. This means that
+// changes by short-lived processes that use relative paths (such as shell
+// commands run in a watched directory) are often missed.
+//
+// This requires Linux 5.8 or newer, CAP_BPF and CAP_PERFMON (or
+// CAP_SYS_ADMIN), and tracefs mounted on /sys/kernel/tracing.
+//
+// Only the Create, Write, Remove, Rename, and Chmod operations are supported,
+// and recursive watches are not supported. Only changes made with the regular
+// syscalls are seen: not writes through memory maps or io_uring, or to file
+// descriptors that weren't opened with open() or openat() (e.g. inherited or
+// duplicated ones). Paths longer than 223 bytes are truncated and won't
+// match.
+//
+// Only supported on Linux; [NewWatcherWith] returns an error on other
+// platforms.
+func WithEBPF() watcherOpt {
+	return func(opt *watcherOpts) { opt.ebpf = true }
+}
+
+// WithWatchman gets events from an existing Watchman daemon rather than from
+// the kernel, for use with [NewWatcherWith]. sockname is the path to the
+// Watchman socket; if it's empty $WATCHMAN_SOCK is used, or else it's found
+// with "watchman get-sockname" (which also starts the daemon if it's not
+// running yet).
+//
+// This is useful for very large repositories which are already watched by
+// Watchman, as it doesn't need to set up watches for every directory, and
+// Watchman takes care of recrawling the tree after an overflow.
+//
+// Every added path is a Watchman subscription on the project root Watchman
+// picks for it (see "watch-project"), and the semantics of Add() and Remove()
+// are unchanged. Watchman only reports which files changed, so only the
+// Create, Write, and Remove operations are sent; renames are sent as a Remove
+// and Create, and Chmod is sent as a Write. ErrEventOverflow is sent if
+// Watchman recrawled the tree.
+//
+// This only works with Watchman's Unix socket; Windows named pipes are not
+// supported.
+func WithWatchman(sockname string) watcherOpt {
+	return func(opt *watcherOpts) { opt.watchman, opt.watchmanSock = true, sockname }
+}
+
+// WithFileWatches opens a file descriptor for every file in a watched
+// directory, for use with [NewWatcherWith].
+//
+// This only has effect on macOS and the BSDs, and is a no-op for other
+// backends.
+//
+// kqueue only reports changes to a directory's entries, not to the files in
+// it. By default only directories are watched, and events for the files in
+// them are found by comparing the directory listing when the directory
+// changes. This means that Write and Chmod events for files in a watched
+// directory are only sent if the directory itself changes at the same time
+// (e.g. because a file was created), and are based on the size, modification
+// time, and mode.
+//
+// With this option every file gets its own watch and reports all changes, as
+// is the case on other platforms. The downside is that this needs a file
+// descriptor for every file, which can run in to the open file limit
+// (RLIMIT_NOFILE) for large directories.
+func WithFileWatches() watcherOpt {
+	return func(opt *watcherOpts) { opt.fileWatches = true }
+}
+
+// WithSandbox uses at most maxFDs file descriptors for kqueue watches, for use
+// with [NewWatcherWith]. If maxFDs is 0 it's a quarter of the RLIMIT_NOFILE soft
+// limit, with a minimum of 16.
+//
+// This only has effect on macOS and the BSDs, and is a no-op for other
+// backends. It's the default on iOS.
+//
+// Sandboxed apps (iOS apps, and macOS apps in the App Sandbox) share the open
+// file limit with the rest of the app and can't always raise it, so with this
+// option:
+//
+//   - only directories are watched, and it's an error to use it with
+//     [WithFileWatches];
+//   - RLIMIT_NOFILE isn't raised when it's reached;
+//   - paths added after maxFDs is reached are polled, rather than returning a
+//     [WatchLimitError]. A [PollingError] with Limit set to "WithSandbox" is
+//     sent when this happens, unless [WithNoPolling] is used.
+//
+// FSEvents would avoid all of this, but isn't supported as it needs cgo.
+func WithSandbox(maxFDs int) watcherOpt {
+	return func(opt *watcherOpts) { opt.sandbox, opt.sandboxFDs = true, maxFDs }
+}
+
+// WithNoPolling always uses the kernel notifications, for use with
+// [NewWatcherWith].
+//
+// By default paths on network filesystems are polled (see [PollingError]), as
+// the kernel only reports changes made on the local system, if any. This option
+// disables that, which is useful if you only care about local changes.
+func WithNoPolling() watcherOpt {
+	return func(opt *watcherOpts) { opt.noPolling = true }
+}
+
+// WithSSH watches paths on the remote system dest over SSH rather than local
+// paths, for use with [NewWatcherWith]. dest is passed to the ssh command, and
+// can be anything it accepts such as "host", "user@host", or a Host from
+// ~/.ssh/config. Authentication must work without prompting (e.g. with keys and
+// ssh-agent).
+//
+// Changes are found by polling every two seconds (see [PollingError] for the
+// limitations), by running a small Perl script on the remote system; this
+// requires perl to be installed there, which it is on most Unix systems.
+// Windows hosts are not supported.
+//
+// Paths passed to [Watcher.Add] are remote paths, and events use the same
+// paths. Only the Create, Write, Remove, and Chmod operations (and
+// UnportableExtend and UnportableTruncate) are sent; renames are sent as a
+// Remove and Create. Recursive watches are not supported.
+//
+// [NewWatcherWith] returns an error if the connection can't be established. If
+// the connection is lost later on an error is sent for every watched path,
+// and the watches are removed.
+func WithSSH(dest string) watcherOpt {
+	return func(opt *watcherOpts) { opt.ssh = dest }
+}
+
+// WithObjectStore gets events from the object storage notifications of store
+// rather than from the local filesystem, for use with [NewWatcherWith].
+//
+// Paths passed to [Watcher.Add] are object key prefixes, for example "photos"
+// or "photos/2024"; leading and trailing slashes are ignored, and "" or "/" is
+// the root of the bucket. Just like directories, adding a prefix sends events
+// for the objects directly below it ("photos/a.jpg", but not
+// "photos/2024/a.jpg"), and for the object with exactly that key. Events have
+// the object key as the name.
+//
+// Only the Create, Write, and Remove operations are sent: notifications for
+// overwritten objects are sent as Write, and Create for new ones. To tell them
+// apart the keys of all objects below watched prefixes are kept in memory.
+//
+// The store is closed on [Watcher.Close].
+func WithObjectStore(store ObjectStore) watcherOpt {
+	return func(opt *watcherOpts) { opt.objectStore = store }
+}
+
+// WithSyntheticLoad generates events as described by load rather than reading
+// them from the filesystem, for use with [NewWatcherWith].
+//
+// This is meant for benchmarking and sizing the code that handles events,
+// without writing a load generator that thrashes the disk. Everything else
+// works as usual: paths are added with [Watcher.Add] (and don't need to
+// exist), events are only sent for added paths and operations, and the other
+// options such as [WithSettled] or [WithRelativePaths] apply to the generated
+// events. Use [WithClock] to generate events without waiting for the Rate.
+//
+// This can't be used with [WithAtomicSave], [WithPersist], or [WithSymlinks].
+func WithSyntheticLoad(load SyntheticLoad) watcherOpt {
+	return func(opt *watcherOpts) { opt.synthetic = &load }
+}
+
+// WithChecksum adds a checksum of the file contents to Write events, for use
+// with [NewWatcherWith]. newHash creates the hash to use, for example
+// sha256.New or crc32.NewIEEE.
+//
+// Write events are held back until there were no writes to the file for 100ms
+// (or until an [UnportableCloseWrite] event), and are then sent as a single
+// event with [Event.Checksum] set. Other events for the file are sent
+// immediately, after the pending Write event (if any).
+//
+// This makes it easy to ignore changes that didn't change the contents, such
+// as "touch" or an editor saving a file without changes, by comparing the
+// checksum with the previous one. Files are read in the goroutine that sends
+// events, so hashing large files will delay events.
+//
+// This can't be used with [WithExternalLoop].
+func WithChecksum(newHash func() hash.Hash) watcherOpt {
+	return func(opt *watcherOpts) { opt.checksum = newHash }
+}
+
+// WithSettled sends a single Write event once a file is done being written,
+// instead of a Write event for every write, for use with [NewWatcherWith].
+//
+// On backends that support [UnportableCloseWrite] the Write event is sent when
+// the file is closed. Elsewhere it's sent once there were no writes for quiet
+// and the file size didn't change in that time; if quiet is 0 it's 100ms.
+//
+// UnportableCloseWrite is never sent in this mode; it's added to the watched
+// operations automatically if Write is watched. Other events for the file are
+// sent immediately, after the pending Write event (if any). Files that are kept
+// open and written to (such as logs) won't get any Write events until they're
+// closed on backends that support UnportableCloseWrite.
+//
+// This can be combined with [WithChecksum], and can't be used with
+// [WithExternalLoop].
+func WithSettled(quiet time.Duration) watcherOpt {
+	return func(opt *watcherOpts) { opt.settled, opt.settleQuiet = true, quiet }
+}
+
+// WithAtomicSave keeps watching files that are replaced by writing to a
+// temporary file and renaming it over the original, as many editors do, for use
+// with [NewWatcherWith].
+//
+// Files added with [Watcher.Add] are watched through their parent directory,
+// and only events for the file itself are sent. Replacing the file with a
+// rename, or removing or renaming it and creating it again within 100ms, is sent
+// as a single Write event. The file stays watched after it's removed: if it's
+// created again later a Create event is sent.
+//
+// [Watcher.WatchList] returns the files, rather than the directories. Adding
+// directories works as before.
+//
+// This can't be used with [WithExternalLoop], [WithSSH], [WithObjectStore], or
+// [WithSyntheticLoad].
+func WithAtomicSave() watcherOpt {
+	return func(opt *watcherOpts) { opt.atomicSave = true }
+}
+
+// WithPersist keeps watching files after they're removed or renamed, for use
+// with [NewWatcherWith].
+//
+// Normally the watch is removed when a watched file is removed or renamed.
+// With this, files added with [Watcher.Add] are watched through the parent
+// directory while they don't exist, and are watched again once they're
+// re-created, which is sent as a Create event. Directories aren't affected.
+//
+// [Watcher.WatchList] keeps returning the file while it doesn't exist.
+//
+// [WithAtomicSave] already does this; this is for when you want to get all
+// events for the file (such as Remove followed by Create), rather than a
+// single Write.
+//
+// This can't be used with [WithExternalLoop], [WithSSH], [WithObjectStore], or
+// [WithSyntheticLoad].
+func WithPersist() watcherOpt {
+	return func(opt *watcherOpts) { opt.persist = true }
+}
+
+// RawEvent is an event as read from the backend, for [WithRawEvents].
+type RawEvent struct {
+	// Path of the event, like Event.Name.
+	Name string
+
+	// The event mask or flags as reported by the system:
+	//
+	//   inotify    inotify_event.mask (IN_*)
+	//   fanotify   fanotify_event_metadata.mask (FAN_*)
+	//   kqueue     kevent.fflags (NOTE_*)
+	//   FEN        port_event.portev_events (FILE_*)
+	//   Windows    FILE_NOTIFY_INFORMATION.Action (FILE_ACTION_*)
+	Mask uint64
+
+	// Cookie to connect IN_MOVED_FROM and IN_MOVED_TO events; inotify only.
+	Cookie uint32
+}
+
+// WithSymlinks keeps track of what symlinks added with [Watcher.Add] point to,
+// for use with [NewWatcherWith].
+//
+// Normally adding a symlink watches the target it points to at the time it's
+// added, and keeps watching that if the symlink is changed to point somewhere
+// else (e.g. with "ln -sfn"). With this, symlinks are also watched through
+// their parent directory, and when the symlink is replaced the watch is moved
+// to the new target and a [Relink] event is sent.
+//
+// Symlinks added with WithNoFollow and recursive watches aren't affected.
+//
+// This can't be used with [WithExternalLoop], [WithSSH], [WithObjectStore], or
+// [WithSyntheticLoad].
+func WithSymlinks() watcherOpt {
+	return func(opt *watcherOpts) { opt.symlinks = true }
+}
+
+// WithRelativePaths sends events with [Event.Name] relative to the path added
+// with [Watcher.Add], and [Event.Root] set to that path, for use with
+// [NewWatcherWith]. For example with Add("/tmp/dir") an event for
+// "/tmp/dir/sub/file" will have Root "/tmp/dir" and Name "sub/file"; events for
+// the added path itself have Name ".".
+//
+// If both a directory and a path inside it are added the closest one is used
+// as the Root.
+func WithRelativePaths() watcherOpt {
+	return func(opt *watcherOpts) { opt.relative = true }
+}
+
+// WithSelfEvents sets if events for directories added with [Watcher.Add]
+// themselves are sent, rather than only events for the files in them, for use
+// with [NewWatcherWith]. For example a chmod, rename, or removal of the
+// directory. This has no effect on files that are added directly.
+//
+// These are sent by default, but not all backends can detect them: Windows
+// only sends Remove for the directory itself, and backends that poll or use a
+// remote service (such as WithObjectStore) may send nothing at all. With send
+// set to false they are never sent on any backend; [Rescan] and [Relink]
+// events for the directory are still sent.
+func WithSelfEvents(send bool) watcherOpt {
+	return func(opt *watcherOpts) { opt.noSelf = !send }
+}
+
+// WithCanonicalPaths makes paths absolute and resolves symlinks in them when
+// they're added with [Watcher.Add], for use with [NewWatcherWith]. Events use
+// this canonical path, so that Add("./dir") and Add("/abs/dir") send the same
+// paths. On Windows the case of the path is set to what it is on disk.
+//
+// The last element of the path isn't resolved: adding a symlink still watches
+// the symlink. Paths are only made absolute if they don't exist (yet).
+//
+// [Watcher.Remove] and the other methods that take a path accept the path
+// as it was added, as well as the canonical path.
+func WithCanonicalPaths() watcherOpt {
+	return func(opt *watcherOpts) { opt.canonical = true }
+}
+
+// WithNFC normalizes the paths in events to Unicode NFC, for use with
+// [NewWatcherWith].
+//
+// HFS+ on macOS stores filenames in NFD, so a file created as "é" (U+00E9) is
+// read back as "é" (U+0065 U+0301) when the directory is read, and map lookups
+// with the path from [Watcher.Add] or the name the file was created with won't
+// match. APFS doesn't normalize names but older files may still be in NFD.
+//
+// This only has an effect on macOS, and is ignored on other platforms.
+func WithNFC() watcherOpt {
+	return func(opt *watcherOpts) { opt.nfc = true }
+}
+
+// canonicalPath gets the path to use for path: absolute and without symlinks
+// with WithCanonicalPaths(), and with the case it's watched as on
+// case-insensitive filesystems.
+func (w *Watcher) canonicalPath(path string) string {
+	if !w.canonical {
+		return w.watchedCase(path)
+	}
+	path, recurse := recursivePath(path)
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	if fi, err := os.Lstat(abs); err == nil && fi.Mode()&os.ModeSymlink == 0 {
+		if p, err := filepath.EvalSymlinks(abs); err == nil {
+			abs = p
+		}
+	} else if dir, err := filepath.EvalSymlinks(filepath.Dir(abs)); err == nil {
+		abs = filepath.Join(dir, filepath.Base(abs))
+	}
+	if vol := filepath.VolumeName(abs); len(vol) == 2 && vol[1] == ':' {
+		abs = strings.ToUpper(vol) + abs[2:] // Drive letter.
+	}
+	if recurse {
+		abs = filepath.Join(abs, "...")
+	}
+	return w.watchedCase(abs)
+}
+
+// WithRawEvents calls fn for every event read from the system, before it's
+// converted to an Event, for use with [NewWatcherWith].
+//
+// This is for cases where the portable Op loses too much detail. There is no
+// one-to-one mapping between raw events and Events: some raw events aren't
+// sent at all, and some are sent as more than one Event.
+//
+// fn is called from the goroutine that reads events, and must not block. This
+// isn't used for backends that don't get events from the system (WithSSH,
+// WithObjectStore, WithWatchman, WithAudit, WithEBPF, and polled paths).
+func WithRawEvents(fn func(RawEvent)) watcherOpt {
+	return func(opt *watcherOpts) { opt.raw = fn }
+}
+
+// WithHealing checks all watches every interval with [Watcher.Verify], and
+// adds watches that stopped working again once the path exists, for use with
+// [NewWatcherWith].
+//
+// This is for watches that died without an event being sent (e.g. on a network
+// filesystem), or paths that were removed or unmounted and are created or
+// mounted again: paths added with [Watcher.Add] stay watched until
+// [Watcher.Remove] is called. A [Rescan] event is sent after a watch is added
+// again, as events for it may have been missed.
+//
+// Only supported on Linux (inotify), macOS and the BSDs (kqueue), and Windows.
+// This can't be used with [WithExternalLoop].
+func WithHealing(interval time.Duration) watcherOpt {
+	return func(opt *watcherOpts) { opt.heal = interval }
+}
+
+// WithWatchBudget limits the number of watches to max, for use with
+// [NewWatcherWith]. This includes the watches fsnotify adds internally, as
+// counted by [Watcher.WatchCounts].
+//
+// When adding a path would exceed the budget, evict is called to pick one of
+// the other paths to remove, until the watches are within the budget again.
+// An [*EvictedError] is sent on the Errors channel for every path that's
+// removed. If the path being added needs more watches than max on its own
+// it's not added, and an error wrapping [ErrWatchLimit] is returned.
+//
+// evict can be [EvictLRU] (the default if it's nil), [EvictPriority], or a
+// custom function. The budget is checked when paths are added: watches added
+// for new directories in recursive watches are counted on the next add.
+//
+// This can't be used with [WithExternalLoop].
+func WithWatchBudget(max int, evict EvictFunc) watcherOpt {
+	return func(opt *watcherOpts) { opt.budget, opt.budgetEvict = max, evict }
+}
+
+func (p *pending) event(e Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := eventSize(e)
+	if p.limit > 0 && p.size+n > p.limit {
+		p.full = true
+		if p.policy == MemoryDrop {
+			p.dropped++
+			return
+		}
+	}
+	p.events = append(p.events, e)
+	p.size += n
+}
+
+// blocked reports if the limit set with WithMemoryLimit() was reached with
+// MemoryBlock, to stop reading events.
+func (p *pending) blocked() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.full && p.policy == MemoryBlock
+}
+
+func (p *pending) err(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.errs = append(p.errs, err)
+}
+
+func (p *pending) take() ([]Event, []error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ev, errs := p.events, p.errs
+	if p.full {
+		errs = append(errs, &MemoryLimitError{Limit: p.limit, Policy: p.policy, Dropped: p.dropped})
+	}
+	p.events, p.errs = nil, nil
+	p.size, p.dropped, p.full = 0, 0, false
+	return ev, errs
+}
+
 // WithBufferSize sets the [ReadDirectoryChangesW] buffer size.
 //
 // This only has effect on Windows systems, and is a no-op for other backends.
@@ -444,6 +2759,10 @@ func getOptions(opts ...addOpt) withOpts {
 // have a large burst of events it may not be enough. You can increase it if
 // you're hitting "queue or buffer overflow" errors ([ErrEventOverflow]).
 //
+// The buffer is automatically grown (up to 1M for local filesystems) after an
+// overflow, and shrunk back to this size when the number of events subsides.
+// The current size is in [Stats].BufferSizes.
+//
 // [ReadDirectoryChangesW]: https://learn.microsoft.com/en-gb/windows/win32/api/winbase/nf-winbase-readdirectorychangesw
 func WithBufferSize(bytes int) addOpt {
 	return func(opt *withOpts) { opt.bufsize = bytes }
@@ -458,8 +2777,12 @@ func WithBufferSize(bytes int) addOpt {
 //
 // This can also be used to add unportable operations not supported by all
 // platforms; unportable operations all start with "Unportable":
-// [UnportableOpen], [UnportableRead], [UnportableCloseWrite], and
-// [UnportableCloseRead].
+// [UnportableOpen], [UnportableRead], [UnportableCloseWrite],
+// [UnportableCloseRead], [UnportableSecurity], [UnportableExtend],
+// [UnportableTruncate], [UnportableMount], [UnportableUnmount],
+// [UnportableMode], [UnportableOwner], [UnportableTimes], [UnportableXattr],
+// [UnportableACL], [UnportableLink], [UnportableUnlink], and
+// [UnportableClone].
 //
 // AddWith returns an error when using an unportable operation that's not
 // supported. Use [Watcher.Support] to check for support.
@@ -467,6 +2790,123 @@ func WithOps(op Op) addOpt {
 	return func(opt *withOpts) { opt.op = op }
 }
 
+// WithExcludeUnlinked stops sending events for files after they've been
+// removed from a watched directory, even if they're still open.
+//
+// This only has effect on Linux systems (where it maps to IN_EXCL_UNLINK), and
+// is a no-op for other backends.
+//
+// By default inotify keeps sending events for files in a watched directory for
+// as long as something has them open, which can be a lot of noise when e.g. a
+// program keeps writing to a log file that was rotated away with "rm".
+func WithExcludeUnlinked() addOpt {
+	return func(opt *withOpts) { opt.excludeUnlinked = true }
+}
+
+// WithPolling polls the path for changes rather than using the kernel
+// notifications, for files that change without the kernel sending events. For
+// example files on /proc and /sys like /proc/net/dev or a sysfs attribute,
+// which are generated when they're read.
+//
+// Files on virtual filesystems such as proc and sysfs are compared by their
+// contents (only the first MB is read), as they don't have a meaningful size
+// or modification time; other files by their size and modification time, or
+// as set with [WithPollStrategy]. For directories this applies to the files in
+// it. Only the operations listed in
+// [PollingError] are sent, and the path is polled every 2 seconds (or as set
+// with [WithPollInterval]).
+//
+// This only has effect on Linux, macOS, the BSDs, and AIX, and is a no-op for
+// other backends. Recursive watches can't be polled.
+func WithPolling() addOpt {
+	return func(opt *withOpts) { opt.poll = true }
+}
+
+// WithPollInterval sets how often the path is polled, if it's polled: with
+// [WithPolling], with [WithSSH], or because it's on a filesystem that doesn't
+// support change notifications (see [PollingError]). The default is 2 seconds.
+//
+// This makes it possible to check a few busy paths often, and large trees
+// that rarely change less often. Adding a path that's already polled again
+// with a different interval changes the interval. It has no effect on paths
+// that aren't polled.
+func WithPollInterval(d time.Duration) addOpt {
+	return func(opt *withOpts) { opt.pollInterval = d }
+}
+
+// WithAdaptivePolling adjusts how often the path is polled to how often it
+// changes, if it's polled (see [WithPollInterval]).
+//
+// The interval is doubled after every poll that didn't find any changes, up to
+// max, and halved after a poll that did, down to min. This keeps the CPU and
+// I/O for large trees that rarely change low, while busy paths are still
+// checked often. Polling starts at the interval set with WithPollInterval (or
+// 2 seconds), limited to min and max.
+//
+// min must be above 0 and not above max; AddWith returns an error otherwise,
+// even if the path isn't polled.
+func WithAdaptivePolling(min, max time.Duration) addOpt {
+	return func(opt *withOpts) { opt.pollMin, opt.pollMax = min, max }
+}
+
+// WithPollStrategy sets how the path is compared to detect changes, if it's
+// polled (see [WithPollInterval]). The default is [PollDefault].
+//
+// [PollContent] is more reliable on filesystems with coarse timestamps such as
+// FAT and exFAT, where a write shortly after the previous one may not change
+// the modification time, but reads all files on every poll. It can't be used
+// with [WithSSH].
+func WithPollStrategy(s PollStrategy) addOpt {
+	return func(opt *withOpts) { opt.pollStrategy = s }
+}
+
+// WithRetry retries adding the path for up to the given duration if it fails
+// with a transient error: the path doesn't exist (for example while a log file
+// is being rotated), EINTR or EAGAIN, or ERROR_SHARING_VIOLATION on Windows.
+//
+// The first retry is after 10ms, and the wait is doubled after every retry, up
+// to a second. The error from the last attempt is returned if it still fails
+// after the duration. Retries are logged if FSNOTIFY_DEBUG is set.
+func WithRetry(d time.Duration) addOpt {
+	return func(opt *withOpts) { opt.retry = d }
+}
+
+// WithPriority sets the priority of the path for [EvictPriority] when using
+// [WithWatchBudget]: paths with a lower priority are removed first. The
+// default is 0.
+func WithPriority(p int) addOpt {
+	return func(opt *withOpts) { opt.priority = p }
+}
+
+// WithSymlinkChain watches every symlink that's followed to get to the target
+// of a symlink, rather than only the symlink that's added, for use with
+// [Watcher.AddWith] and a Watcher created with [WithSymlinks].
+//
+// For example /etc/localtime is a symlink to /usr/share/zoneinfo/Europe/Berlin,
+// where Europe/Berlin may be a symlink to another file, and the zoneinfo
+// directory itself may be a symlink. A [Relink] event is sent if any of these
+// symlinks change, and the watch is moved if that changes the target.
+func WithSymlinkChain() addOpt {
+	return func(opt *withOpts) { opt.linkChain = true }
+}
+
+// WithFollowSymlinks follows symlinks to directories in recursive watches
+// ("dir/..."), which are normally not watched. Files in the directory are sent
+// with the path through the symlink.
+//
+// Symlinks that point to a directory that's already watched (such as a parent
+// directory, which would otherwise loop forever) are skipped. If outside is
+// false, symlinks that point outside the recursively watched directory are
+// skipped as well. Skipped symlinks are sent on the Errors channel with
+// [ErrSymlinkLoop] or [ErrSymlinkEscape], and aren't a reason for the add to
+// fail.
+//
+// Only symlinks that exist when the path is added are followed. Only
+// supported on Linux.
+func WithFollowSymlinks(outside bool) addOpt {
+	return func(opt *withOpts) { opt.followLinks, opt.followOutside = true, outside }
+}
+
 // WithNoFollow disables following symlinks, so the symlinks themselves are
 // watched.
 func withNoFollow() addOpt {
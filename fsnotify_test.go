@@ -27,6 +27,11 @@ import (
 func init() {
 	internal.SetRlimit()
 	enableRecurse = true
+
+	// Most tests expect events for the files in a watched directory; the
+	// default directory-only mode for kqueue is tested with the scripts in
+	// TestScript and in backend_kqueue_test.
+	defaultWatcherOpts.fileWatches = true
 }
 
 func TestScript(t *testing.T) {
@@ -34,15 +39,23 @@ func TestScript(t *testing.T) {
 		if err != nil || info.IsDir() {
 			return err
 		}
+		d, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
 		n := strings.Split(filepath.ToSlash(path), "/")
 		t.Run(strings.Join(n[1:], "/"), func(t *testing.T) {
 			t.Parallel()
-			d, err := os.ReadFile(path)
-			if err != nil {
-				t.Fatal(err)
-			}
-			parseScript(t, string(d))
+			parseScript(t, string(d), false)
 		})
+		// Without WithFileWatches(), which is the default on kqueue; the
+		// expected output for this is in "dironly" if it's different.
+		if isKqueue() {
+			t.Run("dironly/"+strings.Join(n[1:], "/"), func(t *testing.T) {
+				t.Parallel()
+				parseScript(t, string(d), true)
+			})
+		}
 		return nil
 	})
 	if err != nil {
@@ -404,7 +417,19 @@ func TestAdd(t *testing.T) {
 			t.Fatal("err is nil")
 		}
 
+		werr, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("wrong error type: %[1]T: %#[1]v", err)
+		}
+		if werr.Op != "add" || werr.Path != join(tmp, "non-existent") || werr.Backend != w.b.name() {
+			t.Errorf("wrong error: %#v", werr)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("not ErrNotExist: %v", err)
+		}
+
 		// TODO(v2): errors for this are inconsistent; should be fixed in v2. See #144
+		err = werr.Err
 		switch runtime.GOOS {
 		case "linux":
 			if _, ok := err.(syscall.Errno); !ok {
@@ -660,6 +685,719 @@ func TestWatchList(t *testing.T) {
 	}
 }
 
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file")
+
+	w := newWatcher(t, tmp)
+	have := w.Stats()
+	if have.Watches < 1 {
+		t.Errorf("Watches is %d", have.Watches)
+	}
+	if runtime.GOOS == "windows" && have.BufferSizes[tmp] != 65536 {
+		t.Errorf("wrong BufferSizes: %v", have.BufferSizes)
+	}
+
+	w.Close()
+	if have := w.Stats(); !reflect.DeepEqual(have, Stats{}) {
+		t.Errorf("not zero after Close: %#v", have)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	if _, err := Probe(join(tmp, "nonexistent")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("wrong error: %v", err)
+	}
+
+	have, err := Probe(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Assumes the temporary directory is on a local filesystem.
+	if !have.Ops.Has(Create|Write|Remove|Rename|Chmod) || have.Polled || have.Network || have.Latency != 0 {
+		t.Errorf("%#v", have)
+	}
+
+	have, err = Probe(tmp, WithWatchman(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have.Ops.Has(Rename) || have.Ops.Has(Chmod) {
+		t.Errorf("%#v", have)
+	}
+
+	if runtime.GOOS == "linux" {
+		have, err := Probe("/proc/self")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have.FSType != "proc" || have.Ops != 0 {
+			t.Errorf("%#v", have)
+		}
+	}
+}
+
+func TestExternalLoop(t *testing.T) {
+	switch runtime.GOOS {
+	case "windows", "solaris", "illumos":
+		t.Skip("WithExternalLoop() not supported on " + runtime.GOOS)
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w, err := NewWatcherWith(WithExternalLoop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fd, err := w.SysFd(); err != nil || fd < 0 {
+		t.Fatalf("SysFd: %d, %v", fd, err)
+	}
+	addWatch(t, w, tmp)
+
+	touch(t, tmp, "file")
+	have, errs := w.ReadEvents()
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	cmpEvents(t, tmp, have, newEvents(t, `create /file`))
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, errs := w.ReadEvents(); len(errs) != 1 || !errors.Is(errs[0], ErrClosed) {
+		t.Errorf("wrong errors after Close: %v", errs)
+	}
+	if _, ok := <-w.Events; ok {
+		t.Error("Events not closed")
+	}
+}
+
+func TestExternalLoopMemoryLimit(t *testing.T) {
+	switch runtime.GOOS {
+	case "windows", "solaris", "illumos":
+		t.Skip("WithExternalLoop() not supported on " + runtime.GOOS)
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w, err := NewWatcherWith(WithExternalLoop(), WithMemoryLimit(1, MemoryDrop))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addWatch(t, w, tmp)
+
+	touch(t, tmp, "file1")
+	touch(t, tmp, "file2")
+	touch(t, tmp, "file3")
+	have, errs := w.ReadEvents()
+	if len(have) != 0 {
+		t.Errorf("events not dropped: %s", have)
+	}
+	var mErr *MemoryLimitError
+	if len(errs) != 1 || !errors.As(errs[0], &mErr) || !errors.Is(errs[0], ErrEventOverflow) {
+		t.Fatalf("wrong errors: %v", errs)
+	}
+	if mErr.Dropped < 3 {
+		t.Errorf("Dropped is %d", mErr.Dropped)
+	}
+
+	// Nothing is reported when the limit isn't reached.
+	if _, errs := w.ReadEvents(); len(errs) != 0 {
+		t.Errorf("wrong errors: %v", errs)
+	}
+}
+
+func TestRawEvents(t *testing.T) {
+	t.Parallel()
+
+	var (
+		tmp = t.TempDir()
+		mu  sync.Mutex
+		raw []RawEvent
+	)
+	w, err := NewWatcherWith(WithRawEvents(func(e RawEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		raw = append(raw, e)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	addWatch(t, w, tmp)
+
+	touch(t, tmp, "file")
+	cmpEvents(t, tmp, c.stop(t), newEvents(t, `create /file`))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(raw) == 0 {
+		t.Fatal("no raw events")
+	}
+	for _, e := range raw {
+		if e.Mask == 0 || !strings.HasPrefix(e.Name, tmp) {
+			t.Errorf("wrong raw event: %#v", e)
+		}
+	}
+}
+
+func TestError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&Error{Op: "watch", Backend: "inotify", Err: ErrEventOverflow}, "fsnotify: queue or buffer overflow"},
+		{&Error{Op: "add", Path: "/x", Backend: "inotify", Err: syscall.ENOENT}, `fsnotify: add "/x": no such file or directory`},
+		{&Error{Op: "watch", Path: "/x", Backend: "kqueue", Err: &WatchLostError{Path: "/x", Err: syscall.EIO}}, `fsnotify: watch for "/x" lost: input/output error`},
+		{wrapError(nil, "add", "", &fs.PathError{Op: "open", Path: "/x", Err: syscall.ENOENT}), "fsnotify: open /x: no such file or directory"},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			if have := tt.err.Error(); have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+		})
+	}
+
+	err := wrapError(nil, "add", "", &fs.PathError{Op: "open", Path: "/x", Err: syscall.ENOENT})
+	if e := err.(*Error); e.Path != "/x" {
+		t.Errorf("path not set: %#v", e)
+	}
+	if wrapError(nil, "watch", "", err) != err {
+		t.Error("wrapped twice")
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Error("not ErrNotExist")
+	}
+}
+
+func TestWatchError(t *testing.T) {
+	tmp := t.TempDir()
+	w := newWatcher(t, tmp)
+
+	err := w.Add(join(tmp, "non-existent"))
+	var werr WatchError
+	if !errors.As(err, &werr) {
+		t.Fatalf("not a WatchError: %[1]T: %[1]v", err)
+	}
+	if have := werr.WatchPath(); have != tmp {
+		t.Errorf("WatchPath: %q", have)
+	}
+	if !werr.WatchActive() {
+		t.Error("WatchActive is false")
+	}
+
+	rmWatch(t, w, tmp)
+	if have := werr.WatchPath(); have != join(tmp, "non-existent") {
+		t.Errorf("WatchPath after Remove: %q", have)
+	}
+	if werr.WatchActive() {
+		t.Error("WatchActive is true after Remove")
+	}
+}
+
+// Errors from the layers between the backend and the user should be an *Error,
+// just like the errors from the backends.
+func TestErrorLayers(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []watcherOpt
+		do   func(t *testing.T, w *Watcher, tmp string)
+		want interface{}
+	}{
+		{"budget", []watcherOpt{WithWatchBudget(1, EvictPriority)},
+			func(t *testing.T, w *Watcher, tmp string) { addWatch(t, w, tmp, "b") },
+			new(*EvictedError)},
+		{"settle", []watcherOpt{WithSettled(time.Hour), WithMemoryLimit(1, MemoryDrop)},
+			func(t *testing.T, w *Watcher, tmp string) {
+				echoAppend(t, "data", tmp, "a", "file1")
+				echoAppend(t, "data", tmp, "a", "file2")
+			},
+			new(*MemoryLimitError)},
+		{"faults", []watcherOpt{WithFaults(&Faults{Overflow: func(Event) bool { return true }})},
+			func(t *testing.T, w *Watcher, tmp string) { touch(t, tmp, "a", "file") },
+			&ErrEventOverflow},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.name == "budget" && isKqueue() {
+				t.Skip("kqueue adds a watch for every file in a watched directory")
+			}
+			t.Parallel()
+
+			tmp := t.TempDir()
+			mkdir(t, tmp, "a")
+			mkdir(t, tmp, "b")
+			w, err := NewWatcherWith(tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			addWatch(t, w, tmp, "a")
+
+			go func() {
+				for range w.Events {
+				}
+			}()
+			tt.do(t, w, tmp)
+
+			select {
+			case err := <-w.Errors:
+				if !errors.As(err, new(*Error)) {
+					t.Errorf("not an *Error: %[1]T: %[1]v", err)
+				}
+				switch want := tt.want.(type) {
+				case *error:
+					if !errors.Is(err, *want) {
+						t.Errorf("wrong error: %v", err)
+					}
+				default:
+					if !errors.As(err, want) {
+						t.Errorf("wrong error: %v", err)
+					}
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no error")
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	switch runtime.GOOS {
+	case "linux", "windows", "darwin", "freebsd", "openbsd", "netbsd", "dragonfly":
+	default:
+		t.Skip("Verify not supported on " + runtime.GOOS)
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	mkdir(t, tmp, "moved")
+	touch(t, tmp, "file")
+
+	w := newWatcher(t, tmp, join(tmp, "file"))
+	for _, p := range []string{"dir", "moved"} {
+		if err := w.AddWith(join(tmp, p), WithOps(Create)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if errs := w.Verify(); len(errs) > 0 {
+		t.Fatalf("errors for working watches: %v", errs)
+	}
+	if runtime.GOOS != "linux" {
+		return // Other backends remove the watch on renames.
+	}
+
+	// inotify keeps the watch on the old directory if Rename isn't watched.
+	mv(t, join(tmp, "dir"), tmp, "dir2")
+	mkdir(t, tmp, "dir")
+	mv(t, join(tmp, "moved"), tmp, "moved2")
+	waitForEvents()
+
+	errs := w.Verify()
+	if len(errs) != 2 {
+		t.Fatalf("wrong number of errors: %v", errs)
+	}
+	var e *Error
+	if !errors.As(errs[0], &e) || e.Op != "verify" || e.Path != join(tmp, "dir") || !errors.Is(e, ErrWatchDiverged) {
+		t.Errorf("wrong error: %v", errs[0])
+	}
+	if !errors.As(errs[1], &e) || e.Op != "verify" || e.Path != join(tmp, "moved") || !errors.Is(e, ErrWatchDead) {
+		t.Errorf("wrong error: %v", errs[1])
+	}
+}
+
+func TestWatchInfo(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file")
+	w := newWatcher(t, tmp)
+	if err := w.AddWith(join(tmp, "file"), WithOps(Write)); err != nil {
+		t.Fatal(err)
+	}
+
+	have := make(map[string]WatchInfo)
+	for _, wi := range w.WatchInfo() {
+		have[wi.Path] = wi
+	}
+	for _, p := range []string{tmp, join(tmp, "file")} {
+		wi, ok := have[p]
+		if !ok {
+			t.Fatalf("no info for %q: %v", p, have)
+		}
+		if wi.Internal || wi.Recursive || wi.Polled {
+			t.Errorf("wrong info for %q: %+v", p, wi)
+		}
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+	if wi := have[tmp]; wi.Op != Create|Write|Remove|Rename|Chmod || wi.ID == 0 {
+		t.Errorf("wrong info for directory: %+v", wi)
+	}
+	if wi := have[join(tmp, "file")]; wi.Op != Write || wi.ID == 0 {
+		t.Errorf("wrong info for file: %+v", wi)
+	}
+
+	w.Close()
+	if l := w.WatchInfo(); l != nil {
+		t.Errorf("not nil after Close(): %v", l)
+	}
+}
+
+func TestWatchCounts(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("recursive watches are only implemented for inotify")
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdirAll(t, tmp, "rec", "a", "b")
+	mkdir(t, tmp, "rec", "c")
+	mkdir(t, tmp, "dir")
+	w := newWatcher(t, join(tmp, "rec", "..."), join(tmp, "dir"))
+
+	have := w.WatchCounts()
+	want := map[string]int{join(tmp, "rec"): 4, join(tmp, "dir"): 1}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("\nhave: %v\nwant: %v", have, want)
+	}
+	for _, wi := range w.WatchInfo() {
+		if internal := wi.Path != wi.Root; wi.Internal != internal {
+			t.Errorf("wrong Internal: %+v", wi)
+		}
+	}
+}
+
+func TestWatchOps(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newCollector(t)
+	for _, op := range []Op{Create, Write} {
+		if err := w.w.AddWith(tmp, WithOps(op)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if op := w.w.WatchOps(tmp); !op.Has(Create) || !op.Has(Write) {
+		t.Errorf("ops not merged: %s", op)
+	}
+	if op := w.w.WatchOps(join(tmp, "other")); op != 0 {
+		t.Errorf("not 0 for path that's not watched: %s", op)
+	}
+
+	w.collect(t)
+	touch(t, tmp, "file")
+	eventSeparator()
+	echoAppend(t, "data", tmp, "file")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /file
+		write   /file
+	`))
+}
+
+func TestRemoveOps(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS != "linux" {
+		t.Skip("portable ops can only be removed on Linux")
+	}
+
+	tmp := t.TempDir()
+	w := newCollector(t)
+	addWatch(t, w.w, tmp)
+	if err := w.w.RemoveOps(tmp, Chmod); err != nil {
+		t.Fatal(err)
+	}
+	if op := w.w.WatchOps(tmp); op.Has(Chmod) || !op.Has(Create) {
+		t.Errorf("wrong ops after RemoveOps: %s", op)
+	}
+
+	err := w.w.RemoveOps(join(tmp, "other"), Chmod)
+	if !errors.Is(err, ErrNonExistentWatch) {
+		t.Errorf("wrong error for path that's not watched: %#v", err)
+	}
+	if err := w.w.RemoveOps(tmp, w.w.WatchOps(tmp)); err == nil {
+		t.Error("no error when removing all ops")
+	}
+
+	w.collect(t)
+	touch(t, tmp, "file")
+	eventSeparator()
+	chmod(t, 0o600, tmp, "file")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /file
+	`))
+}
+
+func TestUpdateWith(t *testing.T) {
+	t.Parallel()
+
+	if runtime.GOOS != "linux" {
+		t.Skip("portable ops can only be removed on Linux")
+	}
+
+	tmp := t.TempDir()
+	touch(t, tmp, "file")
+	w := newCollector(t)
+	if err := w.w.AddWith(tmp, WithOps(Create|Chmod)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.w.UpdateWith(tmp, WithOps(Write|Chmod)); err != nil {
+		t.Fatal(err)
+	}
+	if op := w.w.WatchOps(tmp); op != Write|Chmod {
+		t.Errorf("wrong ops after UpdateWith: %s", op)
+	}
+
+	err := w.w.UpdateWith(join(tmp, "other"), WithOps(Write))
+	if !errors.Is(err, ErrNonExistentWatch) {
+		t.Errorf("wrong error for path that's not watched: %#v", err)
+	}
+
+	w.collect(t)
+	touch(t, tmp, "new")
+	eventSeparator()
+	echoAppend(t, "data", tmp, "file")
+	eventSeparator()
+	chmod(t, 0o600, tmp, "file")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		write   /file
+		chmod   /file
+	`))
+}
+
+func TestAddFd(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	f, err := os.Open(join(tmp, "dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := newCollector(t)
+	err = w.w.AddFd(int(f.Fd()), join(tmp, "dir"))
+	f.Close()
+	if errors.Is(err, xErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.collect(t)
+	touch(t, tmp, "dir", "file")
+
+	cmpEvents(t, tmp, w.stop(t), newEvents(t, `
+		create  /dir/file
+	`))
+}
+
+func TestAddAt(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	mkdir(t, tmp, "other")
+	symlink(t, join(tmp, "other"), tmp, "dir", "link")
+	f, err := os.Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	dirfd := int(f.Fd())
+
+	w := newCollector(t)
+	err = w.w.AddAt(dirfd, "dir")
+	if errors.Is(err, xErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"dir/link/x", "dir/link", "../x", join(tmp, "dir")} {
+		if err := w.w.AddAt(dirfd, p); err == nil {
+			t.Errorf("no error for %q", p)
+		}
+	}
+
+	w.collect(t)
+	touch(t, tmp, "dir", "file")
+
+	have := w.stop(t)
+	if len(have) != 1 || have[0].Name != filepath.Join("dir", "file") || !have[0].Has(Create) {
+		t.Errorf("wrong events:\n%s", have)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	insensitive := caseInsensitive(join(tmp, "dir"))
+
+	w := newWatcher(t)
+	defer w.Close()
+	addWatch(t, w, tmp, "dir")
+	if insensitive {
+		addWatch(t, w, tmp, "DIR") // Merged with the existing watch.
+		if have := w.WatchList(); len(have) != 1 {
+			t.Errorf("wrong WatchList: %q", have)
+		}
+	}
+
+	err := w.Remove(join(tmp, "Dir"))
+	if insensitive && err != nil {
+		t.Errorf("Remove: %s", err)
+	}
+	if !insensitive && !errors.Is(err, ErrNonExistentWatch) {
+		t.Errorf("wrong error for Remove: %v", err)
+	}
+}
+
+func TestClone(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "a")
+	mkdir(t, tmp, "b")
+	mkdir(t, tmp, "c")
+
+	w, err := NewWatcherWith(WithRelativePaths())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addWatch(t, w, tmp, "a")
+	addWatch(t, w, tmp, "b")
+	if err := w.AddWith(join(tmp, "c"), WithOps(Create)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Remove(join(tmp, "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	nw, err := w.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nw.Close()
+
+	have := nw.WatchList()
+	sort.Strings(have)
+	if want := []string{join(tmp, "a"), join(tmp, "c")}; !reflect.DeepEqual(have, want) {
+		t.Errorf("wrong WatchList:\nhave: %q\nwant: %q", have, want)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	echoAppend(t, "data", tmp, "c", "file1") // Only the create is sent.
+	touch(t, tmp, "a", "file2")
+	var got []string
+	timeout := time.After(500 * time.Millisecond)
+loop:
+	for {
+		select {
+		case e := <-nw.Events:
+			got = append(got, e.Op.String()+" "+e.Name)
+		case err := <-nw.Errors:
+			t.Fatal(err)
+		case <-timeout:
+			break loop
+		}
+	}
+	want := []string{"CREATE file1", "CREATE file2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong events:\nhave: %q\nwant: %q", got, want)
+	}
+
+	// Paths that no longer exist make Clone fail.
+	addWatch(t, nw, tmp, "a", "file2")
+	rm(t, tmp, "a", "file2")
+	if _, err := nw.Clone(); err == nil {
+		t.Error("no error")
+	}
+}
+
+// Every AddWith() adds its operations to the watch; the clone should watch all
+// of them too, not just the ones from the last call.
+func TestCloneMergedOps(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w := newWatcher(t)
+	defer w.Close()
+	if err := w.AddWith(tmp, WithOps(Create)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AddWith(tmp, WithOps(Write)); err != nil {
+		t.Fatal(err)
+	}
+
+	nw, err := w.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nw.Close()
+
+	want := w.WatchOps(tmp)
+	if runtime.GOOS == "linux" && want != Create|Write {
+		t.Fatalf("wrong ops for the original: %s", want)
+	}
+	if have := nw.WatchOps(tmp); have != want {
+		t.Errorf("wrong ops for the clone:\nhave: %s\nwant: %s", have, want)
+	}
+}
+
+func TestAddTx(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "a")
+	mkdir(t, tmp, "b")
+	mkdir(t, tmp, "c")
+
+	w := newWatcher(t)
+	defer w.Close()
+	addWatch(t, w, tmp, "a")
+
+	err := w.AddTx(join(tmp, "a"), join(tmp, "b"), join(tmp, "nonexistent"), join(tmp, "c"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if have := w.WatchList(); len(have) != 1 || have[0] != join(tmp, "a") {
+		t.Errorf("wrong WatchList after failure: %q", have)
+	}
+
+	if err := w.AddTx(join(tmp, "b"), join(tmp, "c")); err != nil {
+		t.Fatal(err)
+	}
+	have := w.WatchList()
+	sort.Strings(have)
+	if want := []string{join(tmp, "a"), join(tmp, "b"), join(tmp, "c")}; !reflect.DeepEqual(have, want) {
+		t.Errorf("wrong WatchList:\nhave: %q\nwant: %q", have, want)
+	}
+}
+
 func TestOpHas(t *testing.T) {
 	tests := []struct {
 		name string
@@ -701,6 +1439,41 @@ func TestOpHas(t *testing.T) {
 	}
 }
 
+func TestParseOp(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Op
+		wantErr bool
+	}{
+		{"CREATE", Create, false},
+		{"write", Write, false},
+		{"CREATE|WRITE|CLOSE_WRITE", Create | Write | UnportableCloseWrite, false},
+		{"", 0, true},
+		{"nope", 0, true},
+		{"CREATE|", 0, true},
+		{"[no events]", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			have, err := ParseOp(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wrong error: %v", err)
+			}
+			if have != tt.want {
+				t.Errorf("\nhave: %s\nwant: %s", have, tt.want)
+			}
+		})
+	}
+	for i := 0; i < 32; i++ {
+		op := Op(1 << i)
+		if s := op.String(); s != "[no events]" {
+			if have, err := ParseOp(s); err != nil || have != op {
+				t.Errorf("ParseOp(%q) = %s, %v", s, have, err)
+			}
+		}
+	}
+}
+
 func BenchmarkWatch(b *testing.B) {
 	do := func(b *testing.B, w *Watcher) {
 		tmp := b.TempDir()
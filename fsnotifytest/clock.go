@@ -0,0 +1,126 @@
+package fsnotifytest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/esvos/fsnotify"
+)
+
+// Clock is a fake clock for fsnotify.WithClock. The time only changes when
+// [Clock.Advance] is called, which fires all timers that expire.
+//
+// The Watcher sets timers from its own goroutines, so a test should call
+// [Clock.BlockUntil] before Advance to make sure the timer it expects was set:
+//
+//	c := fsnotifytest.NewClock(time.Time{})
+//	w, _ := fsnotify.NewWatcherWith(fsnotify.WithChecksum(sha256.New), fsnotify.WithClock(c))
+//	// ... write to a watched file
+//	c.BlockUntil(1)
+//	c.Advance(100 * time.Millisecond) // Write event is sent now.
+type Clock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers map[*clockTimer]struct{} // Active timers.
+}
+
+var _ fsnotify.Clock = (*Clock)(nil)
+
+// NewClock creates a new fake clock, starting at start.
+func NewClock(start time.Time) *Clock {
+	c := &Clock{now: start, timers: make(map[*clockTimer]struct{})}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the current fake time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer creates a timer that fires once the clock is advanced by d.
+func (c *Clock) NewTimer(d time.Duration) fsnotify.Timer {
+	t := &clockTimer{c: c, ch: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d, and fires all timers that expire, in
+// the order they expire.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+
+	var fire []*clockTimer
+	for t := range c.timers {
+		if !t.at.After(c.now) {
+			fire = append(fire, t)
+		}
+	}
+	sort.Slice(fire, func(i, j int) bool { return fire[i].at.Before(fire[j].at) })
+	for _, t := range fire {
+		c.fire(t)
+	}
+	c.cond.Broadcast()
+}
+
+// Timers returns the number of active timers.
+func (c *Clock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil waits until there are at least n active timers.
+func (c *Clock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+// fire sends the time on the timer's channel; mu must be held.
+func (c *Clock) fire(t *clockTimer) {
+	delete(c.timers, t)
+	select {
+	case t.ch <- c.now:
+	default:
+	}
+}
+
+type clockTimer struct {
+	c  *Clock
+	ch chan time.Time
+	at time.Time
+}
+
+func (t *clockTimer) C() <-chan time.Time { return t.ch }
+
+func (t *clockTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	_, ok := t.c.timers[t]
+	delete(t.c.timers, t)
+	t.c.cond.Broadcast()
+	return ok
+}
+
+func (t *clockTimer) Reset(d time.Duration) bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	_, ok := t.c.timers[t]
+	t.at = t.c.now.Add(d)
+	if d <= 0 {
+		t.c.fire(t)
+	} else {
+		t.c.timers[t] = struct{}{}
+	}
+	t.c.cond.Broadcast()
+	return ok
+}
@@ -0,0 +1,138 @@
+// Package fsnotifytest has helpers for testing code that uses fsnotify.
+//
+// [Watcher] is a mock watcher: it has the same Events and Errors channels and
+// Add, Remove, WatchList, and Close methods as fsnotify.Watcher, but the
+// events are sent by the test with [Watcher.Send] rather than read from the
+// system. Code that takes the channels (or a small interface with the methods
+// it uses) can be tested with this instead of a real Watcher.
+package fsnotifytest
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/esvos/fsnotify"
+)
+
+// Watcher is a mock watcher.
+type Watcher struct {
+	// Events and Errors are closed by Close, like fsnotify.Watcher.
+	Events chan fsnotify.Event
+	Errors chan error
+
+	mu    sync.Mutex
+	paths map[string]struct{}
+
+	sendMu   sync.RWMutex // Held while sending, so Close doesn't close the channels.
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// NewWatcher creates a new mock watcher.
+func NewWatcher() *Watcher {
+	return &Watcher{
+		Events: make(chan fsnotify.Event),
+		Errors: make(chan error),
+		paths:  make(map[string]struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func (w *Watcher) isClosed() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Add records path as watched. The path doesn't need to exist.
+func (w *Watcher) Add(path string) error {
+	if w.isClosed() {
+		return fsnotify.ErrClosed
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.paths[filepath.Clean(path)] = struct{}{}
+	return nil
+}
+
+// Remove removes path, or returns fsnotify.ErrNonExistentWatch if it wasn't
+// added.
+func (w *Watcher) Remove(path string) error {
+	if w.isClosed() {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	path = filepath.Clean(path)
+	if _, ok := w.paths[path]; !ok {
+		return fsnotify.ErrNonExistentWatch
+	}
+	delete(w.paths, path)
+	return nil
+}
+
+// WatchList returns all added paths, sorted.
+func (w *Watcher) WatchList() []string {
+	if w.isClosed() {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	l := make([]string, 0, len(w.paths))
+	for p := range w.paths {
+		l = append(l, p)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// Close closes the Events and Errors channels. Send and SendError return false
+// after this, so Close can be called while they're blocked.
+func (w *Watcher) Close() error {
+	w.doneOnce.Do(func() {
+		close(w.done)
+		w.sendMu.Lock()
+		defer w.sendMu.Unlock()
+		close(w.Events)
+		close(w.Errors)
+	})
+	return nil
+}
+
+// Send sends e on the Events channel, and waits until it's read. It returns
+// false if the watcher was closed.
+//
+// Events are sent for any path, not just paths that were added.
+func (w *Watcher) Send(e fsnotify.Event) bool {
+	w.sendMu.RLock()
+	defer w.sendMu.RUnlock()
+	if w.isClosed() {
+		return false
+	}
+	select {
+	case <-w.done:
+		return false
+	case w.Events <- e:
+		return true
+	}
+}
+
+// SendError sends err on the Errors channel, and waits until it's read. It
+// returns false if the watcher was closed.
+func (w *Watcher) SendError(err error) bool {
+	w.sendMu.RLock()
+	defer w.sendMu.RUnlock()
+	if w.isClosed() {
+		return false
+	}
+	select {
+	case <-w.done:
+		return false
+	case w.Errors <- err:
+		return true
+	}
+}
@@ -0,0 +1,169 @@
+package fsnotifytest
+
+import (
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/esvos/fsnotify"
+)
+
+func TestWatcher(t *testing.T) {
+	w := NewWatcher()
+	if err := w.Add("/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add("/a/"); err != nil {
+		t.Fatal(err)
+	}
+	if have := w.WatchList(); !reflect.DeepEqual(have, []string{"/a", "/b"}) {
+		t.Errorf("wrong WatchList: %q", have)
+	}
+	if err := w.Remove("/c"); !errors.Is(err, fsnotify.ErrNonExistentWatch) {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	go w.Send(fsnotify.Event{Name: "/a/file", Op: fsnotify.Create})
+	if e := <-w.Events; e.Name != "/a/file" || e.Op != fsnotify.Create {
+		t.Errorf("wrong event: %s", e)
+	}
+
+	// Close while blocked in Send.
+	sent := make(chan bool)
+	go func() { sent <- w.Send(fsnotify.Event{Name: "/a/file", Op: fsnotify.Write}) }()
+	time.Sleep(10 * time.Millisecond)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if <-sent {
+		t.Error("Send returned true after Close")
+	}
+	if _, ok := <-w.Events; ok {
+		t.Error("Events not closed")
+	}
+	if err := w.Add("/x"); !errors.Is(err, fsnotify.ErrClosed) {
+		t.Errorf("wrong error for Add after Close: %v", err)
+	}
+}
+
+func TestSort(t *testing.T) {
+	w := NewWatcher()
+	s := Sort(w.Events, w.Errors, 20*time.Millisecond)
+
+	go func() {
+		w.Send(fsnotify.Event{Name: "/b", Op: fsnotify.Write})
+		w.Send(fsnotify.Event{Name: "/a", Op: fsnotify.Write})
+		w.Send(fsnotify.Event{Name: "/b", Op: fsnotify.Create})
+		w.SendError(errors.New("oops"))
+		w.Send(fsnotify.Event{Name: "/d", Op: fsnotify.Create})
+		w.Send(fsnotify.Event{Name: "/c", Op: fsnotify.Create})
+		time.Sleep(100 * time.Millisecond)
+		w.Send(fsnotify.Event{Name: "/a", Op: fsnotify.Remove})
+		w.Close()
+	}()
+
+	var have []string
+	for e := range s.Events {
+		have = append(have, e.String())
+		if len(have) == 3 {
+			if err := <-s.Errors; err == nil || err.Error() != "oops" {
+				t.Errorf("wrong error: %v", err)
+			}
+		}
+	}
+	want := []string{
+		fsnotify.Event{Name: "/a", Op: fsnotify.Write}.String(),
+		fsnotify.Event{Name: "/b", Op: fsnotify.Create}.String(),
+		fsnotify.Event{Name: "/b", Op: fsnotify.Write}.String(),
+		fsnotify.Event{Name: "/c", Op: fsnotify.Create}.String(),
+		fsnotify.Event{Name: "/d", Op: fsnotify.Create}.String(),
+		fsnotify.Event{Name: "/a", Op: fsnotify.Remove}.String(),
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("wrong order:\nhave: %q\nwant: %q", have, want)
+	}
+}
+
+func TestClock(t *testing.T) {
+	c := NewClock(time.Time{})
+	t1, t2 := c.NewTimer(2*time.Second), c.NewTimer(time.Second)
+	if n := c.Timers(); n != 2 {
+		t.Fatalf("%d timers", n)
+	}
+
+	c.Advance(time.Second)
+	select {
+	case <-t1.C():
+		t.Fatal("t1 fired early")
+	case have := <-t2.C():
+		if want := (time.Time{}).Add(time.Second); !have.Equal(want) {
+			t.Errorf("wrong time: %s", have)
+		}
+	}
+	if t2.Stop() {
+		t.Error("Stop returned true for expired timer")
+	}
+	if !t1.Stop() || c.Timers() != 0 {
+		t.Error("t1 not stopped")
+	}
+	c.Advance(time.Hour)
+	select {
+	case <-t1.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+
+	t1.Reset(time.Minute)
+	go c.Advance(time.Minute)
+	<-t1.C()
+}
+
+func TestClockWatcher(t *testing.T) {
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "file")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClock(time.Now())
+	w, err := fsnotify.NewWatcherWith(fsnotify.WithChecksum(sha256.New), fsnotify.WithClock(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+
+	// The write is held until the clock is advanced, however long it takes.
+	c.BlockUntil(1)
+	select {
+	case e := <-w.Events:
+		t.Fatalf("event before advancing clock: %s", e)
+	default:
+	}
+	c.Advance(time.Hour)
+	select {
+	case e := <-w.Events:
+		if e.Name != path || !e.Has(fsnotify.Write) || e.Checksum == nil {
+			t.Errorf("wrong event: %s", e)
+		}
+	case err := <-w.Errors:
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event after advancing clock")
+	}
+}
@@ -0,0 +1,290 @@
+// Package record records the events from a watcher to a file, and replays them
+// through a mock watcher.
+//
+// This can be used to capture what happens on a production system and write
+// reproducible tests for the code that handles the events:
+//
+//	// Record:
+//	fp, _ := os.Create("trace.jsonl")
+//	r := record.New(w, fp)
+//	for e := range r.Events { ... }  // Use r.Events and r.Errors instead of w.
+//
+//	// In the test:
+//	fp, _ := os.Open("testdata/trace.jsonl")
+//	m := fsnotifytest.NewWatcher()
+//	go record.Replay(fp, m, 0)
+//	handleEvents(m.Events, m.Errors)
+//
+// Recordings are JSON lines, with one event or error per line:
+//
+//	{"t":"1.5ms","op":"CREATE","name":"/tmp/file"}
+//	{"t":"3.2ms","err":"fsnotify: queue or buffer overflow","overflow":true}
+//
+// where "t" is the time since recording started. Errors are replayed as an
+// error with the same text; errors that wrap fsnotify.ErrEventOverflow also
+// wrap it when replayed.
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/esvos/fsnotify"
+	"github.com/esvos/fsnotify/fsnotifytest"
+)
+
+// Entry is a recorded event or error.
+type Entry struct {
+	Time     Duration `json:"t"`                  // Time since the recording started.
+	Op       string   `json:"op,omitempty"`       // Op.String() of the event.
+	Name     string   `json:"name,omitempty"`     // Event.Name.
+	Err      string   `json:"err,omitempty"`      // Error text; Op and Name are empty.
+	Overflow bool     `json:"overflow,omitempty"` // Error wraps ErrEventOverflow.
+}
+
+// Duration is a time.Duration that's written as a string like "1.5ms".
+type Duration time.Duration
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) { return []byte(time.Duration(d).String()), nil }
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(text []byte) error {
+	dd, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(dd)
+	return nil
+}
+
+// ToEvent gets the event for an entry, or an error if the Op isn't known.
+func (e Entry) ToEvent() (fsnotify.Event, error) {
+	op, err := parseOp(e.Op)
+	if err != nil {
+		return fsnotify.Event{}, fmt.Errorf("record: %w", err)
+	}
+	return fsnotify.Event{Name: e.Name, Op: op}, nil
+}
+
+// ToError gets the error for an entry, or nil if it's an event.
+func (e Entry) ToError() error {
+	switch {
+	case e.Err == "":
+		return nil
+	case e.Overflow:
+		return &replayedError{msg: e.Err}
+	default:
+		return errors.New(e.Err)
+	}
+}
+
+type replayedError struct{ msg string }
+
+func (e *replayedError) Error() string { return e.msg }
+func (e *replayedError) Unwrap() error { return fsnotify.ErrEventOverflow }
+
+var (
+	opsOnce sync.Once
+	ops     map[string]fsnotify.Op
+)
+
+// parseOp parses the output of Op.String().
+func parseOp(s string) (fsnotify.Op, error) {
+	opsOnce.Do(func() {
+		ops = make(map[string]fsnotify.Op)
+		for i := 0; i < 32; i++ {
+			op := fsnotify.Op(1 << i)
+			if n := strings.TrimPrefix(op.String(), "|"); n != "[no events]" {
+				ops[n] = op
+			}
+		}
+	})
+
+	var op fsnotify.Op
+	for _, n := range strings.Split(s, "|") {
+		o, ok := ops[n]
+		if !ok {
+			return 0, fmt.Errorf("unknown operation %q", n)
+		}
+		op |= o
+	}
+	return op, nil
+}
+
+// Recorder records the events and errors from a watcher.
+type Recorder struct {
+	// Events and Errors get everything from the watcher after it's recorded;
+	// these must be read, like fsnotify.Watcher.Events and Errors.
+	Events chan fsnotify.Event
+	Errors chan error
+
+	w     *fsnotify.Watcher
+	enc   *json.Encoder
+	start time.Time
+	err   error // First error writing the recording.
+
+	done     chan struct{}
+	doneMu   sync.Mutex
+	doneResp chan struct{}
+}
+
+// New starts recording the events and errors from w to out. Events and errors
+// should be read from the Recorder after this, rather than from w.
+func New(w *fsnotify.Watcher, out io.Writer) *Recorder {
+	r := &Recorder{
+		Events:   make(chan fsnotify.Event),
+		Errors:   make(chan error),
+		w:        w,
+		enc:      json.NewEncoder(out),
+		start:    time.Now(),
+		done:     make(chan struct{}),
+		doneResp: make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+func (r *Recorder) isClosed() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the watcher, and returns the first error writing the recording
+// (if any). out isn't closed.
+func (r *Recorder) Close() error {
+	r.doneMu.Lock()
+	if r.isClosed() {
+		r.doneMu.Unlock()
+		return nil
+	}
+	close(r.done)
+	r.doneMu.Unlock()
+
+	err := r.w.Close()
+	<-r.doneResp
+	if r.err != nil {
+		return fmt.Errorf("record: %w", r.err)
+	}
+	return err
+}
+
+func (r *Recorder) write(e Entry) {
+	e.Time = Duration(time.Since(r.start))
+	if err := r.enc.Encode(e); err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *Recorder) run() {
+	defer func() {
+		close(r.doneResp)
+		close(r.Errors)
+		close(r.Events)
+	}()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case err, ok := <-r.w.Errors:
+			if !ok {
+				return
+			}
+			r.write(Entry{Err: err.Error(), Overflow: errors.Is(err, fsnotify.ErrEventOverflow)})
+			select {
+			case <-r.done:
+				return
+			case r.Errors <- err:
+			}
+		case e, ok := <-r.w.Events:
+			if !ok {
+				return
+			}
+			r.write(Entry{Op: e.Op.String(), Name: e.Name})
+			select {
+			case <-r.done:
+				return
+			case r.Events <- e:
+			}
+		}
+	}
+}
+
+// Load reads all entries from a recording.
+func Load(in io.Reader) ([]Entry, error) {
+	var (
+		l    []Entry
+		scan = bufio.NewScanner(in)
+		line int
+	)
+	scan.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scan.Scan() {
+		line++
+		if len(strings.TrimSpace(scan.Text())) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(scan.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("record: line %d: %w", line, err)
+		}
+		if e.Err == "" {
+			if _, err := parseOp(e.Op); err != nil {
+				return nil, fmt.Errorf("record: line %d: %w", line, err)
+			}
+		}
+		l = append(l, e)
+	}
+	if err := scan.Err(); err != nil {
+		return nil, fmt.Errorf("record: %w", err)
+	}
+	return l, nil
+}
+
+// Replay sends the events and errors from a recording on the mock watcher w.
+//
+// The original timing is kept when speed is 1; higher values replay faster
+// (e.g. 2 for twice as fast) and lower values slower. If speed is 0 the
+// entries are sent without waiting between them. Sending always waits until
+// the previous event was read, so events are never sent earlier than in the
+// recording, but may be later.
+//
+// The entire recording is read before anything is sent. Replay returns after
+// everything was sent, or when w is closed. It doesn't close w.
+func Replay(in io.Reader, w *fsnotifytest.Watcher, speed float64) error {
+	l, err := Load(in)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	for _, e := range l {
+		if speed > 0 {
+			at := start.Add(time.Duration(float64(e.Time) / speed))
+			if d := time.Until(at); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		if err := e.ToError(); err != nil {
+			if !w.SendError(err) {
+				return nil
+			}
+			continue
+		}
+		ev, _ := e.ToEvent()
+		if !w.Send(ev) {
+			return nil
+		}
+	}
+	return nil
+}
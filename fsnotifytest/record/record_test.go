@@ -0,0 +1,92 @@
+package record
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esvos/fsnotify"
+	"github.com/esvos/fsnotify/fsnotifytest"
+)
+
+func TestRecord(t *testing.T) {
+	tmp := t.TempDir()
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	r := New(w, &buf)
+	if err := os.WriteFile(filepath.Join(tmp, "file"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-r.Events:
+		if e.Name != filepath.Join(tmp, "file") || !e.Has(fsnotify.Create) {
+			t.Errorf("wrong event: %s", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event")
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l) == 0 || l[0].Op != "CREATE" || l[0].Name != filepath.Join(tmp, "file") || l[0].Time <= 0 {
+		t.Errorf("wrong entries: %+v", l)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	rec := `{"t":"1ms","op":"CREATE","name":"/dir/file"}
+
+{"t":"20ms","op":"WRITE|CLOSE_WRITE","name":"/dir/file"}
+{"t":"30ms","err":"fsnotify: queue or buffer overflow","overflow":true}
+{"t":"40ms","err":"oops"}
+`
+	m := fsnotifytest.NewWatcher()
+	defer m.Close()
+	replayErr := make(chan error, 1)
+	start := time.Now()
+	go func() { replayErr <- Replay(strings.NewReader(rec), m, 1) }()
+
+	e := <-m.Events
+	if e.Name != "/dir/file" || e.Op != fsnotify.Create {
+		t.Errorf("wrong event: %s", e)
+	}
+	e = <-m.Events
+	if e.Name != "/dir/file" || e.Op != fsnotify.Write|fsnotify.UnportableCloseWrite {
+		t.Errorf("wrong event: %s", e)
+	}
+	if err := <-m.Errors; !errors.Is(err, fsnotify.ErrEventOverflow) {
+		t.Errorf("wrong error: %v", err)
+	}
+	if err := <-m.Errors; err.Error() != "oops" || errors.Is(err, fsnotify.ErrEventOverflow) {
+		t.Errorf("wrong error: %v", err)
+	}
+	if err := <-replayErr; err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("replayed too fast: %s", d)
+	}
+}
+
+func TestLoadError(t *testing.T) {
+	_, err := Load(strings.NewReader(`{"t":"1ms","op":"CREATE"}` + "\n" + `{"t":"1ms","op":"CREATE|NOPE"}`))
+	if err == nil || !strings.Contains(err.Error(), `line 2: unknown operation "NOPE"`) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
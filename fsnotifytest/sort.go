@@ -0,0 +1,91 @@
+package fsnotifytest
+
+import (
+	"sort"
+	"time"
+
+	"github.com/esvos/fsnotify"
+)
+
+// Sorter sends events in a deterministic order; see [Sort].
+type Sorter struct {
+	// Events and Errors are closed once the Events channel Sort reads from is
+	// closed, after sending everything.
+	Events chan fsnotify.Event
+	Errors chan error
+
+	inEv   <-chan fsnotify.Event
+	inErr  <-chan error
+	window time.Duration
+}
+
+// Sort reads events and errors (from a fsnotify.Watcher or [Watcher]) and
+// sends them on the Sorter's channels, with every burst of events sorted by
+// path and then by Op.
+//
+// Backends don't all send events in the same order when a lot of things
+// happen at once; this makes it possible to write the expected events for a
+// test once for all platforms. It's not useful outside of tests, as it delays
+// all events and loses the original order.
+//
+// A burst ends when there were no new events for window, or 50ms if window is
+// 0. Errors are sent right away, after the events received before the error.
+func Sort(events <-chan fsnotify.Event, errs <-chan error, window time.Duration) *Sorter {
+	if window <= 0 {
+		window = 50 * time.Millisecond
+	}
+	s := &Sorter{
+		Events: make(chan fsnotify.Event),
+		Errors: make(chan error),
+		inEv:   events,
+		inErr:  errs,
+		window: window,
+	}
+	go s.run()
+	return s
+}
+
+func (s *Sorter) run() {
+	defer func() {
+		close(s.Errors)
+		close(s.Events)
+	}()
+
+	var (
+		batch  []fsnotify.Event
+		inErr  = s.inErr
+		expire <-chan time.Time
+	)
+	flush := func() {
+		sort.SliceStable(batch, func(i, j int) bool {
+			if batch[i].Name != batch[j].Name {
+				return batch[i].Name < batch[j].Name
+			}
+			return batch[i].Op < batch[j].Op
+		})
+		for _, e := range batch {
+			s.Events <- e
+		}
+		batch, expire = batch[:0], nil
+	}
+	for {
+		select {
+		case e, ok := <-s.inEv:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, e)
+			expire = time.After(s.window)
+		case err, ok := <-inErr:
+			if !ok {
+				inErr = nil
+				continue
+			}
+			flush()
+			s.Errors <- err
+		case <-expire:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package fsnotify
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// healer sits between the backend (or the other layers) and the Events channel
+// for WithHealing(): it periodically checks the watches with verify(), and
+// adds any that died again once the path exists.
+type healer struct {
+	b        backend
+	v        verifier
+	interval time.Duration
+	clock    Clock
+	add      func(string, ...addOpt) error // Add and Remove without tracking the path.
+	remove   func(string) error
+	list     func() []string // Watcher.WatchList()
+
+	inEv   chan Event // From the backend.
+	inErr  chan error
+	outEv  chan Event // To the user.
+	outErr chan error
+
+	mu     sync.Mutex
+	paths  map[string][]addOpt // Paths added by the user, with the options.
+	healed chan healed         // From check() to run().
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	checkDone chan struct{}
+	done      chan struct{}
+}
+
+type healed struct {
+	events []Event
+	errs   []error
+}
+
+func newHealer(with watcherOpts, ev chan Event, errs chan error) *healer {
+	return &healer{
+		interval:  with.heal,
+		clock:     with.clock,
+		inEv:      make(chan Event),
+		inErr:     make(chan error),
+		outEv:     ev,
+		outErr:    errs,
+		paths:     make(map[string][]addOpt),
+		healed:    make(chan healed),
+		closing:   make(chan struct{}),
+		checkDone: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// close stops sending events and checking the watches.
+func (h *healer) close() {
+	h.closeOnce.Do(func() { close(h.closing) })
+}
+
+// track records that path was added by the user.
+func (h *healer) track(path string, opts ...addOpt) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.paths[path] = append(h.paths[path], opts...)
+}
+
+// forget stops healing path after the user removed it.
+func (h *healer) forget(path string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.paths, path)
+}
+
+// removeOps removes op from the options path is added again with.
+func (h *healer) removeOps(path string, op Op) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if opts, ok := h.paths[path]; ok {
+		h.paths[path] = append(opts, WithOps(getOptions(opts...).op&^op))
+	}
+}
+
+// check heals the watches every interval. This runs in a separate goroutine
+// from run(), as adding watches may send events.
+func (h *healer) check() {
+	defer close(h.checkDone)
+	t := h.clock.NewTimer(h.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closing:
+			return
+		case <-t.C():
+			t.Reset(h.interval)
+			events, errs := h.heal()
+			if len(events) == 0 && len(errs) == 0 {
+				continue
+			}
+			select {
+			case <-h.closing:
+				return
+			case h.healed <- healed{events: events, errs: errs}:
+			}
+		}
+	}
+}
+
+func (h *healer) run() {
+	defer func() {
+		h.close()
+		<-h.checkDone
+		close(h.done)
+		close(h.outErr)
+		close(h.outEv)
+	}()
+
+	go h.check()
+	inEv, inErr := h.inEv, h.inErr
+	for inEv != nil || inErr != nil {
+		select {
+		case <-h.closing:
+			return
+		case err, ok := <-inErr:
+			if !ok {
+				inErr = nil
+				continue
+			}
+			select {
+			case <-h.closing:
+				return
+			case h.outErr <- err:
+			}
+		case e, ok := <-inEv:
+			if !ok {
+				inEv = nil
+				continue
+			}
+			select {
+			case <-h.closing:
+				return
+			case h.outEv <- e:
+			}
+		case r := <-h.healed:
+			for _, e := range r.events {
+				select {
+				case <-h.closing:
+					return
+				case h.outEv <- e:
+				}
+			}
+			for _, err := range r.errs {
+				select {
+				case <-h.closing:
+					return
+				case h.outErr <- err:
+				}
+			}
+		}
+	}
+}
+
+// heal adds all paths that are no longer watched or for which the watch died
+// again, and returns a Rescan event for every path that was added.
+//
+// Paths that don't exist (yet) are skipped, and tried again on the next check.
+func (h *healer) heal() ([]Event, []error) {
+	failed := h.v.verify()
+	watched := make(map[string]struct{})
+	for _, p := range h.list() {
+		p, _ = recursivePath(p)
+		watched[p] = struct{}{}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	paths := make([]string, 0, len(h.paths))
+	for p := range h.paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var (
+		events []Event
+		errs   []error
+	)
+	for _, path := range paths {
+		p, _ := recursivePath(path)
+		_, dead := failed[p]
+		_, ok := watched[p]
+		if ok && !dead {
+			continue
+		}
+		if _, err := os.Stat(p); err != nil {
+			continue
+		}
+		if ok {
+			h.remove(path) // Add a new watch, rather than merging with the dead one.
+		}
+		if err := h.add(path, h.paths[path]...); err != nil {
+			errs = append(errs, wrapError(h.b, "heal", p, err))
+			continue
+		}
+		events = append(events, Event{Name: p, Op: Rescan})
+	}
+	return events, errs
+}
@@ -0,0 +1,60 @@
+package fsnotify
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestWithHealing(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("inotify keeps watches on renamed directories if Rename isn't watched")
+	}
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	mkdir(t, tmp, "removed")
+
+	w, err := NewWatcherWith(WithHealing(20 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	if err := w.AddWith(join(tmp, "dir"), WithOps(Create)); err != nil {
+		t.Fatal(err)
+	}
+	addWatch(t, w, tmp, "removed")
+
+	// Watch on dir2 now, without any events.
+	mv(t, join(tmp, "dir"), tmp, "dir2")
+	mkdir(t, tmp, "dir")
+	waitForEvents()
+	touch(t, tmp, "dir", "file")
+	eventSeparator()
+
+	// Watch is removed, and added again once it's re-created.
+	rmAll(t, tmp, "removed")
+	waitForEvents()
+	mkdir(t, tmp, "removed")
+	waitForEvents()
+	touch(t, tmp, "removed", "file")
+	eventSeparator()
+
+	// Removed by the user: not added again.
+	if err := w.Remove(join(tmp, "removed")); err != nil {
+		t.Fatal(err)
+	}
+	rmAll(t, tmp, "removed")
+	mkdir(t, tmp, "removed")
+	waitForEvents()
+
+	cmpEvents(t, tmp, c.stop(t), newEvents(t, `
+		rescan  /dir
+		create  /dir/file
+		remove  /removed
+		rescan  /removed
+		create  /removed/file
+	`))
+}
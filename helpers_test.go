@@ -348,6 +348,20 @@ func cat(t *testing.T, path ...string) {
 }
 
 // chmod
+func truncate(t *testing.T, size int64, path ...string) {
+	t.Helper()
+	if len(path) < 1 {
+		t.Fatalf("truncate: path must have at least one element: %s", path)
+	}
+	err := os.Truncate(join(path...), size)
+	if err != nil {
+		t.Fatalf("truncate(%q): %s", join(path...), err)
+	}
+	if shouldWait(path...) {
+		eventSeparator()
+	}
+}
+
 func chmod(t *testing.T, mode fs.FileMode, path ...string) {
 	t.Helper()
 	if len(path) < 1 {
@@ -456,8 +470,8 @@ func (e Events) String() string {
 		if i > 0 {
 			b.WriteString("\n")
 		}
-		if ee.renamedFrom != "" {
-			fmt.Fprintf(b, "%-8s %s ← %s", ee.Op.String(), filepath.ToSlash(ee.Name), filepath.ToSlash(ee.renamedFrom))
+		if ee.RenamedFrom != "" {
+			fmt.Fprintf(b, "%-8s %s ← %s", ee.Op.String(), filepath.ToSlash(ee.Name), filepath.ToSlash(ee.RenamedFrom))
 		} else {
 			fmt.Fprintf(b, "%-8s %s", ee.Op.String(), filepath.ToSlash(ee.Name))
 		}
@@ -472,10 +486,10 @@ func (e Events) TrimPrefix(prefix string) Events {
 		} else {
 			e[i].Name = strings.TrimPrefix(e[i].Name, prefix)
 		}
-		if e[i].renamedFrom == prefix {
-			e[i].renamedFrom = "/"
+		if e[i].RenamedFrom == prefix {
+			e[i].RenamedFrom = "/"
 		} else {
-			e[i].renamedFrom = strings.TrimPrefix(e[i].renamedFrom, prefix)
+			e[i].RenamedFrom = strings.TrimPrefix(e[i].RenamedFrom, prefix)
 		}
 	}
 	return e
@@ -509,6 +523,19 @@ func (e Events) copy() Events {
 // "kqueue" is a shortcut for all kqueue systems (BSD, macOS).
 func newEvents(t *testing.T, s string) Events {
 	t.Helper()
+	return parseEvents(t, s, false)
+}
+
+// newEventsDirOnly is like newEvents, but for kqueue without WithFileWatches().
+// This uses "dironly" if it exists, and keeps the old name for renames as
+// they're found by comparing the directory listing.
+func newEventsDirOnly(t *testing.T, s string) Events {
+	t.Helper()
+	return parseEvents(t, s, true)
+}
+
+func parseEvents(t *testing.T, s string, dirOnly bool) Events {
+	t.Helper()
 
 	var (
 		lines  = strings.Split(s, "\n")
@@ -563,6 +590,38 @@ func newEvents(t *testing.T, s string) Events {
 				op |= UnportableCloseWrite
 			case "CLOSE_READ":
 				op |= xUnportableCloseRead
+			case "SECURITY":
+				op |= UnportableSecurity
+			case "EXTEND":
+				op |= UnportableExtend
+			case "TRUNCATE":
+				op |= UnportableTruncate
+			case "MOUNT":
+				op |= UnportableMount
+			case "UNMOUNT":
+				op |= UnportableUnmount
+			case "MODE":
+				op |= UnportableMode
+			case "OWNER":
+				op |= UnportableOwner
+			case "TIMES":
+				op |= UnportableTimes
+			case "XATTR":
+				op |= UnportableXattr
+			case "ACL":
+				op |= UnportableACL
+			case "LINK":
+				op |= UnportableLink
+			case "UNLINK":
+				op |= UnportableUnlink
+			case "CLONE":
+				op |= UnportableClone
+			case "RESCAN":
+				op |= Rescan
+			case "RELINK":
+				op |= Relink
+			case "MOVE":
+				op |= Move
 			default:
 				t.Fatalf("newEvents: line %d has unknown event %q: %s", no+1, ee, line)
 			}
@@ -575,15 +634,18 @@ func newEvents(t *testing.T, s string) Events {
 			}
 			from = strings.Trim(fields[3], `"`)
 		}
-		if !supportsRename() {
+		if !supportsRename() && !dirOnly {
 			from = ""
 		}
 
 		for _, g := range groups {
-			events[g] = append(events[g], Event{Name: strings.Trim(fields[1], `"`), renamedFrom: from, Op: op})
+			events[g] = append(events[g], Event{Name: strings.Trim(fields[1], `"`), RenamedFrom: from, Op: op})
 		}
 	}
 
+	if e, ok := events["dironly"]; ok && dirOnly {
+		return e
+	}
 	if e, ok := events[runtime.GOOS]; ok {
 		return e
 	}
@@ -662,6 +724,18 @@ func supportsFilter(t *testing.T) {
 	}
 }
 
+func supportsOp(t *testing.T, op Op) {
+	t.Helper()
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if !w.Supports(op) {
+		t.Skipf("%s not supported on %s", op, runtime.GOOS)
+	}
+}
+
 func supportsRename() bool {
 	switch runtime.GOOS {
 	case "linux", "windows":
@@ -699,7 +773,9 @@ type command struct {
 	args []string
 }
 
-func parseScript(t *testing.T, in string) {
+// parseScript runs a script from testdata; dirOnly runs it without
+// WithFileWatches() on kqueue.
+func parseScript(t *testing.T, in string, dirOnly bool) {
 	var (
 		lines = strings.Split(in, "\n")
 		cmds  = make([]command, 0, 8)
@@ -760,7 +836,7 @@ func parseScript(t *testing.T, in string) {
 
 	var (
 		do      = make([]func(), 0, len(cmds))
-		w       = newCollector(t)
+		w       *eventCollector
 		mustArg = func(c command, n int) {
 			if len(c.args) != n {
 				t.Fatalf("line %d: %q requires exactly %d argument (have %d: %q)",
@@ -781,21 +857,18 @@ loop:
 					t.Skip("No op_all on this platform")
 				}
 			case "op_open":
-				if runtime.GOOS != "linux" {
-					t.Skip("No Open on this platform")
-				}
+				supportsOp(t, xUnportableOpen)
 			case "op_read":
-				if runtime.GOOS != "linux" {
-					t.Skip("No Read on this platform")
+				if runtime.GOOS == "windows" {
+					t.Skip("Read is based on the access time on Windows, which is updated lazily")
 				}
+				supportsOp(t, xUnportableRead)
 			case "op_close_write":
-				if runtime.GOOS != "linux" {
-					t.Skip("No CloseWrite on this platform")
-				}
+				supportsOp(t, UnportableCloseWrite)
 			case "op_close_read":
-				if runtime.GOOS != "linux" {
-					t.Skip("No CloseRead on this platform")
-				}
+				supportsOp(t, xUnportableCloseRead)
+			case "op_size":
+				supportsOp(t, UnportableExtend|UnportableTruncate)
 			case "always":
 				t.Skip()
 			case "symlink":
@@ -900,6 +973,32 @@ loop:
 					op |= UnportableCloseWrite
 				case "close_read":
 					op |= xUnportableCloseRead
+				case "security":
+					op |= UnportableSecurity
+				case "extend":
+					op |= UnportableExtend
+				case "truncate":
+					op |= UnportableTruncate
+				case "mount":
+					op |= UnportableMount
+				case "unmount":
+					op |= UnportableUnmount
+				case "mode":
+					op |= UnportableMode
+				case "owner":
+					op |= UnportableOwner
+				case "times":
+					op |= UnportableTimes
+				case "xattr":
+					op |= UnportableXattr
+				case "acl":
+					op |= UnportableACL
+				case "link":
+					op |= UnportableLink
+				case "unlink":
+					op |= UnportableUnlink
+				case "clone":
+					op |= UnportableClone
 				}
 			}
 			do = append(do, func() {
@@ -978,6 +1077,13 @@ loop:
 		case "cat":
 			mustArg(c, 1)
 			do = append(do, func() { cat(t, tmppath(tmp, c.args[0])) })
+		case "truncate":
+			mustArg(c, 2)
+			n, err := strconv.ParseInt(c.args[0], 10, 64)
+			if err != nil {
+				t.Fatalf("line %d: %s", c.line, err)
+			}
+			do = append(do, func() { truncate(t, n, tmppath(tmp, c.args[1])) })
 		case "echo":
 			if len(c.args) < 2 || len(c.args) > 3 {
 				t.Fatalf("line %d: %q requires 2 or 3 arguments (have %d: %q)",
@@ -1014,10 +1120,23 @@ loop:
 		}
 	}
 
+	if dirOnly {
+		ww, err := NewWatcherWith(func(o *watcherOpts) { o.fileWatches = false })
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = &eventCollector{w: ww, done: make(chan struct{}), e: make(Events, 0, 8)}
+	} else {
+		w = newCollector(t)
+	}
 	w.collect(t)
 	for _, d := range do {
 		d()
 	}
 	ev := w.stop(t)
-	cmpEvents(t, tmp, ev, newEvents(t, want))
+	if dirOnly {
+		cmpEvents(t, tmp, ev, newEventsDirOnly(t, want))
+	} else {
+		cmpEvents(t, tmp, ev, newEvents(t, want))
+	}
 }
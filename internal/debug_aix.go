@@ -0,0 +1,24 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// AHAFS event producers, and the names of their RC_FROM_EVPROD values (which
+// start at 1000).
+var ahafsNames = map[string][]string{
+	"modFile":     {"WRITE", "MAP", "REMOVE", "RENAME", "FCLEAR", "FTRUNC", "OVERWRITE", "UNMOUNT"},
+	"modDir":      {"CREATE", "REMOVE", "UNMOUNT", "REMOVE_SELF"},
+	"modFileAttr": {"SETMODE", "SETOWN", "SETACL", "SETTIMES"},
+}
+
+func Debug(name, evprod string, rc int) {
+	n := fmt.Sprintf("%d", rc)
+	if l := ahafsNames[evprod]; rc >= 1000 && rc-1000 < len(l) {
+		n = l[rc-1000]
+	}
+	fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  %11s:%-30s → %q\n",
+		time.Now().Format("15:04:05.000000000"), evprod, n, name)
+}
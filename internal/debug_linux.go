@@ -54,3 +54,42 @@ func Debug(name string, mask, cookie uint32) {
 	fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  %-30s → %s%q\n",
 		time.Now().Format("15:04:05.000000000"), strings.Join(l, "|"), c, name)
 }
+
+func DebugFanotify(name string, mask uint64) {
+	names := []struct {
+		n string
+		m uint64
+	}{
+		{"FAN_ACCESS", unix.FAN_ACCESS},
+		{"FAN_ATTRIB", unix.FAN_ATTRIB},
+		{"FAN_CLOSE_NOWRITE", unix.FAN_CLOSE_NOWRITE},
+		{"FAN_CLOSE_WRITE", unix.FAN_CLOSE_WRITE},
+		{"FAN_CREATE", unix.FAN_CREATE},
+		{"FAN_DELETE", unix.FAN_DELETE},
+		{"FAN_DELETE_SELF", unix.FAN_DELETE_SELF},
+		{"FAN_MODIFY", unix.FAN_MODIFY},
+		{"FAN_MOVED_FROM", unix.FAN_MOVED_FROM},
+		{"FAN_MOVED_TO", unix.FAN_MOVED_TO},
+		{"FAN_MOVE_SELF", unix.FAN_MOVE_SELF},
+		{"FAN_ONDIR", unix.FAN_ONDIR},
+		{"FAN_OPEN", unix.FAN_OPEN},
+		{"FAN_Q_OVERFLOW", unix.FAN_Q_OVERFLOW},
+		{"FAN_RENAME", unix.FAN_RENAME},
+	}
+
+	var (
+		l       []string
+		unknown = mask
+	)
+	for _, n := range names {
+		if mask&n.m == n.m {
+			l = append(l, n.n)
+			unknown ^= n.m
+		}
+	}
+	if unknown > 0 {
+		l = append(l, fmt.Sprintf("0x%x", unknown))
+	}
+	fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  %-30s → %q\n",
+		time.Now().Format("15:04:05.000000000"), strings.Join(l, "|"), name)
+}
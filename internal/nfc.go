@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"sort"
+	"unicode/utf8"
+)
+
+// Hangul syllables are composed algorithmically, rather than with a table.
+const (
+	hangulSBase  = 0xac00
+	hangulLBase  = 0x1100
+	hangulVBase  = 0x1161
+	hangulTBase  = 0x11a7
+	hangulLCount = 19
+	hangulVCount = 21
+	hangulTCount = 28
+	hangulSCount = hangulLCount * hangulVCount * hangulTCount
+)
+
+// NFC composes the decomposed characters in s, such as the NFD names HFS+ on
+// macOS returns: "é" becomes "é".
+//
+// Characters that are already composed aren't decomposed first, so this isn't
+// a complete NFC implementation, but it gives the same result for strings that
+// are either fully composed or fully decomposed.
+func NFC(s string) string {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return s
+	}
+
+	// Put combining characters in the canonical order.
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		if combiningClass(rs[i]) == 0 {
+			i++
+			continue
+		}
+		j := i
+		for j < len(rs) && combiningClass(rs[j]) != 0 {
+			j++
+		}
+		run := rs[i:j]
+		sort.SliceStable(run, func(a, b int) bool { return combiningClass(run[a]) < combiningClass(run[b]) })
+		i = j
+	}
+
+	// Compose every character with the last starter, unless there's a
+	// character in between that blocks it.
+	var (
+		out     = rs[:0]
+		starter = -1
+		last    uint8
+	)
+	for _, r := range rs {
+		ccc := combiningClass(r)
+		if starter >= 0 {
+			blocked := len(out)-1 > starter && (last == 0 || last >= ccc)
+			if c, ok := compose(out[starter], r); ok && !blocked {
+				out[starter] = c
+				continue
+			}
+		}
+		if ccc == 0 {
+			starter = len(out)
+		}
+		last = ccc
+		out = append(out, r)
+	}
+	return string(out)
+}
+
+func combiningClass(r rune) uint8 {
+	if r < 0x300 {
+		return 0
+	}
+	i := sort.Search(len(nfcCombining), func(i int) bool { return nfcCombining[i].hi >= r })
+	if i < len(nfcCombining) && nfcCombining[i].lo <= r {
+		return nfcCombining[i].ccc
+	}
+	return 0
+}
+
+func compose(a, b rune) (rune, bool) {
+	if a >= hangulLBase && a < hangulLBase+hangulLCount && b >= hangulVBase && b < hangulVBase+hangulVCount {
+		return hangulSBase + ((a-hangulLBase)*hangulVCount+(b-hangulVBase))*hangulTCount, true
+	}
+	if a >= hangulSBase && a < hangulSBase+hangulSCount && (a-hangulSBase)%hangulTCount == 0 &&
+		b > hangulTBase && b < hangulTBase+hangulTCount {
+		return a + b - hangulTBase, true
+	}
+	c, ok := nfcCompose[[2]rune{a, b}]
+	return c, ok
+}
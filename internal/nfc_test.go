@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"testing"
+)
+
+func TestNFC(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"/tmp/file", "/tmp/file"},
+		{"/tmp/été", "/tmp/été"},
+		{"été", "été"},    // Already composed.
+		{"ậ", "ậ"},      // Two marks.
+		{"ậ", "ậ"},      // Wrong order.
+		{"Ǻ", "Ǻ"},      // Composite + mark.
+		{"é́", "é́"},     // No composite for the second.
+		{"́abc", "́abc"},  // No starter.
+		{"क़", "क़"},      // Excluded composite.
+		{"각", "각"},      // Hangul LVT.
+		{"가", "가"},       // Hangul LV.
+		{"אַ", "אַ"},      // Excluded.
+		{"Ǟ/ö", "Ǟ/ö"}, // Path separator.
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			have := NFC(tt.in)
+			if have != tt.want {
+				t.Errorf("\nhave: %+q\nwant: %+q", have, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+//go:build plan9
+
+package internal
+
+import "errors"
+
+// Just a dummy.
+var (
+	SyscallEACCES       = errors.New("dummy")
+	UnixEACCES          = errors.New("dummy")
+	ErrSharingViolation = errors.New("dummy")
+	ErrAgain            = errors.New("dummy")
+)
+
+func HasPrivilegesForSymlink() bool { return true }
+
+func SetRlimit()                                    {}
+func Maxfiles() uint64                              { return 1<<64 - 1 }
+func Mkfifo(path string, mode uint32) error         { return errors.New("no FIFOs on Plan 9") }
+func Mknod(path string, mode uint32, dev int) error { return errors.New("no device nodes on Plan 9") }
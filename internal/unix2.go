@@ -1,7 +1,17 @@
-//go:build !windows
+//go:build !windows && !plan9
 
 package internal
 
+import (
+	"errors"
+	"syscall"
+)
+
 func HasPrivilegesForSymlink() bool {
 	return true
 }
+
+// Just a dummy.
+var ErrSharingViolation = errors.New("dummy")
+
+var ErrAgain = syscall.EAGAIN
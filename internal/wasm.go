@@ -0,0 +1,18 @@
+//go:build js || wasip1
+
+package internal
+
+import (
+	"errors"
+	"syscall"
+)
+
+var (
+	SyscallEACCES = syscall.EACCES
+	UnixEACCES    = syscall.EACCES
+)
+
+func SetRlimit()                                    {}
+func Maxfiles() uint64                              { return 1<<64 - 1 }
+func Mkfifo(path string, mode uint32) error         { return errors.New("no FIFOs on WASM") }
+func Mknod(path string, mode uint32, dev int) error { return errors.New("no device nodes on WASM") }
@@ -4,6 +4,7 @@ package internal
 
 import (
 	"errors"
+	"syscall"
 
 	"golang.org/x/sys/windows"
 )
@@ -14,6 +15,11 @@ var (
 	UnixEACCES    = errors.New("dummy")
 )
 
+var (
+	ErrSharingViolation = windows.ERROR_SHARING_VIOLATION
+	ErrAgain            = syscall.EAGAIN
+)
+
 func SetRlimit()                                    {}
 func Maxfiles() uint64                              { return 1<<64 - 1 }
 func Mkfifo(path string, mode uint32) error         { return errors.New("no FIFOs on Windows") }
@@ -0,0 +1,425 @@
+package fsnotify
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// linkWatcher sits between the backend (or the fileWatcher) and the Events
+// channel for WithSymlinks(): symlinks added with Add() are also watched
+// through their parent directory, and when the symlink is replaced or changed
+// to point somewhere else the watch is moved to the new target.
+type linkWatcher struct {
+	b      backend
+	add    func(string, ...addOpt) error // Add and Remove on the next layer.
+	remove func(string) error
+	list   func() []string // Watcher.WatchList()
+
+	inEv   chan Event // From the backend.
+	inErr  chan error
+	outEv  chan Event // To the user (or the settler).
+	outErr chan error
+
+	mu     sync.Mutex
+	links  map[string]*watchedLink // Watched symlinks, by (clean) path.
+	byHop  map[string][]string     // Symlinks in the chain → watched symlinks.
+	dirs   map[string]int          // Number of symlinks watched through directories.
+	direct map[string]struct{}     // Paths added by the user.
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+type watchedLink struct {
+	op       Op       // Operations the user asked for.
+	opts     []addOpt // For adding the target again.
+	target   string   // Resolved target the watch is on.
+	attached bool     // Target is watched; false after the symlink was removed.
+	chain    bool     // WithSymlinkChain()
+	hops     []string // Symlinks watched through their directory.
+}
+
+func newLinkWatcher(ev chan Event, errs chan error) *linkWatcher {
+	return &linkWatcher{
+		inEv:    make(chan Event),
+		inErr:   make(chan error),
+		outEv:   ev,
+		outErr:  errs,
+		links:   make(map[string]*watchedLink),
+		byHop:   make(map[string][]string),
+		dirs:    make(map[string]int),
+		direct:  make(map[string]struct{}),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// close stops sending events.
+func (lw *linkWatcher) close() {
+	lw.closeOnce.Do(func() { close(lw.closing) })
+}
+
+// addLink watches path. Symlinks are also watched through the parent directory,
+// other paths are passed on as-is.
+func (lw *linkWatcher) addLink(path string, opts ...addOpt) error {
+	var (
+		with       = getOptions(opts...)
+		clean      = filepath.Clean(path)
+		_, recurse = recursivePath(path)
+	)
+	st, err := os.Lstat(path)
+	if err != nil || recurse || with.noFollow || st.Mode()&os.ModeSymlink == 0 {
+		// Let the next layer deal with errors.
+		if err := lw.add(path, opts...); err != nil {
+			return err
+		}
+		lw.mu.Lock()
+		lw.direct[clean] = struct{}{}
+		lw.mu.Unlock()
+		return nil
+	}
+
+	target, hops, err := resolveLink(clean, with.linkChain)
+	if err != nil {
+		return err
+	}
+	if err := lw.add(path, opts...); err != nil {
+		return err
+	}
+
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	l, ok := lw.links[clean]
+	if ok {
+		l.op |= with.op
+		l.opts = append(l.opts, opts...)
+		if with.linkChain && !l.chain {
+			l.chain = true
+			_, err := lw.resolve(clean, l)
+			return err
+		}
+		return nil
+	}
+	l = &watchedLink{op: with.op, opts: opts, target: target, attached: true, chain: with.linkChain}
+	lw.links[clean] = l
+	if err := lw.setHops(clean, l, hops); err != nil {
+		delete(lw.links, clean)
+		lw.remove(path)
+		return err
+	}
+	return nil
+}
+
+// resolveLink gets the target of the symlink link, and the symlinks to watch
+// for it: only link itself, or every symlink that's followed to get to the
+// target if chain is set.
+func resolveLink(link string, chain bool) (string, []string, error) {
+	if !chain {
+		target, err := filepath.EvalSymlinks(link)
+		return target, []string{link}, err
+	}
+
+	var (
+		sep   = string(filepath.Separator)
+		hops  []string
+		done  string
+		todo  = strings.Split(link, sep)
+		links int
+	)
+	if filepath.IsAbs(link) {
+		vol := filepath.VolumeName(link)
+		done, todo = vol+sep, strings.Split(link[len(vol):], sep)
+	}
+	for len(todo) > 0 {
+		c := todo[0]
+		todo = todo[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			done = filepath.Join(done, "..")
+			continue
+		}
+
+		p := filepath.Join(done, c)
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return "", hops, err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			done = p
+			continue
+		}
+		if links++; links > 255 {
+			return "", hops, &os.PathError{Op: "resolve", Path: link, Err: errors.New("too many links")}
+		}
+		hops = append(hops, p)
+		dest, err := os.Readlink(p)
+		if err != nil {
+			return "", hops, err
+		}
+		if filepath.IsAbs(dest) {
+			vol := filepath.VolumeName(dest)
+			done, dest = vol+sep, dest[len(vol):]
+		}
+		todo = append(strings.Split(dest, sep), todo...)
+	}
+	return done, hops, nil
+}
+
+// setHops sets the symlinks that are watched through their directory for
+// link, adding and removing watches for the directories as needed. New
+// directories are watched before the old ones are removed, so directories in
+// both stay watched.
+//
+// Must hold the lock.
+func (lw *linkWatcher) setHops(link string, l *watchedLink, hops []string) error {
+	var added []string
+	for _, h := range hops {
+		dir := filepath.Dir(h)
+		_, direct := lw.direct[dir]
+		if lw.dirs[dir] == 0 && !direct {
+			if err := lw.add(dir, WithOps(Create|Remove|Rename)); err != nil {
+				lw.unhop(link, added)
+				return fmt.Errorf("fsnotify: watching %q for %q: %w", dir, link, err)
+			}
+		}
+		lw.dirs[dir]++
+		lw.byHop[h] = append(lw.byHop[h], link)
+		added = append(added, h)
+	}
+	lw.unhop(link, l.hops)
+	l.hops = added
+	return nil
+}
+
+// unhop stops watching the hops for link.
+//
+// Must hold the lock.
+func (lw *linkWatcher) unhop(link string, hops []string) {
+	for _, h := range hops {
+		if lw.byHop[h] = removeString(lw.byHop[h], link); len(lw.byHop[h]) == 0 {
+			delete(lw.byHop, h)
+		}
+		dir := filepath.Dir(h)
+		if lw.dirs[dir]--; lw.dirs[dir] <= 0 {
+			delete(lw.dirs, dir)
+			if _, direct := lw.direct[dir]; !direct {
+				lw.remove(dir)
+			}
+		}
+	}
+}
+
+func removeString(l []string, s string) []string {
+	for i := range l {
+		if l[i] == s {
+			return append(l[:i], l[i+1:]...)
+		}
+	}
+	return l
+}
+
+// removeLink stops watching path. Directories stay watched as long as there
+// are symlinks in it that are watched.
+func (lw *linkWatcher) removeLink(path string) error {
+	clean := filepath.Clean(path)
+	lw.mu.Lock()
+	if l, ok := lw.links[clean]; ok {
+		lw.setHops(clean, l, nil)
+		delete(lw.links, clean)
+		lw.mu.Unlock()
+		if l.attached {
+			return lw.remove(path)
+		}
+		return nil
+	}
+
+	delete(lw.direct, clean)
+	links := lw.dirs[clean] > 0
+	lw.mu.Unlock()
+	if links {
+		return nil
+	}
+	return lw.remove(path)
+}
+
+// internal reports if path is only watched for symlinks in it.
+func (lw *linkWatcher) internal(path string) bool {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	_, direct := lw.direct[path]
+	return !direct && lw.dirs[path] > 0
+}
+
+// watchList removes the directories that are only watched for symlinks.
+func (lw *linkWatcher) watchList(list []string) []string {
+	if list == nil {
+		return nil
+	}
+	l := make([]string, 0, len(list))
+	for _, p := range list {
+		if !lw.internal(filepath.Clean(p)) {
+			l = append(l, p)
+		}
+	}
+	return l
+}
+
+// watchInfo marks the directories that are only watched for symlinks as
+// internal.
+func (lw *linkWatcher) watchInfo(l []WatchInfo) []WatchInfo {
+	for i := range l {
+		if lw.internal(filepath.Clean(l[i].Path)) {
+			l[i].Internal = true
+		}
+	}
+	return l
+}
+
+func (lw *linkWatcher) run() {
+	defer func() {
+		close(lw.done)
+		close(lw.outErr)
+		close(lw.outEv)
+	}()
+
+	inEv, inErr := lw.inEv, lw.inErr
+	for inEv != nil || inErr != nil {
+		select {
+		case <-lw.closing:
+			return
+		case err, ok := <-inErr:
+			if !ok {
+				inErr = nil
+				continue
+			}
+			select {
+			case <-lw.closing:
+				return
+			case lw.outErr <- err:
+			}
+		case e, ok := <-inEv:
+			if !ok {
+				inEv = nil
+				continue
+			}
+			send, err := lw.event(e)
+			for _, e := range send {
+				select {
+				case <-lw.closing:
+					return
+				case lw.outEv <- e:
+				}
+			}
+			if err != nil {
+				select {
+				case <-lw.closing:
+					return
+				case lw.outErr <- err:
+				}
+			}
+		}
+	}
+}
+
+// event translates an event from the next layer into the events to send.
+func (lw *linkWatcher) event(e Event) ([]Event, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	name := filepath.Clean(e.Name)
+	links, ok := lw.byHop[name]
+	if !ok {
+		// Events for other files in the directory, or the directory itself.
+		for _, dir := range []string{filepath.Dir(name), name} {
+			if _, direct := lw.direct[dir]; !direct && lw.dirs[dir] > 0 {
+				return nil, nil
+			}
+		}
+		return []Event{e}, nil
+	}
+
+	// Create, Remove, and Rename may be for either the symlink (from the
+	// directory) or the target (from the watch on the symlink); check what
+	// it points to now.
+	l, isLink := lw.links[name]
+	if isLink && !e.Has(Create) && !e.Has(Remove) && !e.Has(Rename) {
+		return []Event{e}, nil
+	}
+	var send []Event
+	if _, direct := lw.direct[filepath.Dir(name)]; direct {
+		send = append(send, e)
+	} else if isLink && e.Op&^Create&l.op != 0 {
+		send = append(send, Event{Name: e.Name, Op: e.Op &^ Create & l.op, Info: e.Info, Pid: e.Pid})
+	}
+
+	var err error
+	for _, link := range append([]string(nil), links...) {
+		ev, rerr := lw.resolve(link, lw.links[link])
+		send = append(send, ev...)
+		if rerr != nil {
+			err = rerr
+		}
+	}
+	return send, err
+}
+
+// resolve checks what link points to, and moves the watch if it points
+// somewhere else now.
+//
+// Must hold the lock.
+func (lw *linkWatcher) resolve(link string, l *watchedLink) ([]Event, error) {
+	target, hops, err := resolveLink(link, l.chain)
+	if err != nil {
+		if _, err := os.Lstat(link); err != nil && l.attached {
+			// Symlink was removed; stop watching the old target.
+			l.attached = false
+			lw.remove(link)
+		}
+		if len(hops) > 0 && !equalStrings(hops, l.hops) {
+			lw.setHops(link, l, hops)
+		}
+		return nil, nil
+	}
+	changed := !equalStrings(hops, l.hops)
+	if changed {
+		if err := lw.setHops(link, l, hops); err != nil {
+			return nil, &Error{Path: link, Backend: lw.b.name(), Op: "watch", Err: err, watches: lw.list}
+		}
+	}
+	if l.attached && target == l.target {
+		if changed {
+			return []Event{{Name: link, Op: Relink}}, nil
+		}
+		return nil, nil
+	}
+
+	if l.attached {
+		lw.remove(link)
+	}
+	l.attached = false
+	if err := lw.add(link, l.opts...); err != nil {
+		return nil, &Error{Path: link, Backend: lw.b.name(), Op: "watch",
+			Err: fmt.Errorf("fsnotify: watching new target %q: %w", target, err), watches: lw.list}
+	}
+	l.target, l.attached = target, true
+	return []Event{{Name: link, Op: Relink}}, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+package fsnotify
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestWithSymlinks(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	touch(t, tmp, "a")
+	touch(t, tmp, "b")
+	symlink(t, join(tmp, "a"), tmp, "link")
+
+	w, err := NewWatcherWith(WithSymlinks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	addWatch(t, w, tmp, "link")
+
+	if have, want := fmt.Sprint(w.WatchList()), fmt.Sprint([]string{join(tmp, "link")}); have != want {
+		t.Errorf("WatchList:\nhave: %s\nwant: %s", have, want)
+	}
+
+	echoAppend(t, "data", tmp, "a")
+	eventSeparator()
+
+	// Point to b by renaming a new symlink over it, like "ln -sfn".
+	symlink(t, join(tmp, "b"), tmp, "link.tmp")
+	mv(t, join(tmp, "link.tmp"), tmp, "link")
+	waitForEvents()
+
+	echoAppend(t, "data", tmp, "a") // Not watched any more.
+	eventSeparator()
+	echoAppend(t, "data", tmp, "b")
+
+	cmpEvents(t, tmp, c.stop(t), newEvents(t, `
+		write   /link
+		relink  /link
+		write   /link
+	`))
+}
+
+func TestWithSymlinkChain(t *testing.T) {
+	t.Parallel()
+
+	// localtime → zoneinfo/Local, zoneinfo → zoneinfo-a, zoneinfo-a/Local → file
+	tmp := t.TempDir()
+	mkdir(t, tmp, "zoneinfo-a")
+	mkdir(t, tmp, "zoneinfo-b")
+	touch(t, tmp, "zoneinfo-a", "file")
+	touch(t, tmp, "zoneinfo-b", "file")
+	symlink(t, "file", tmp, "zoneinfo-a", "Local")
+	symlink(t, "file", tmp, "zoneinfo-b", "Local")
+	symlink(t, "zoneinfo-a", tmp, "zoneinfo")
+	symlink(t, join(tmp, "zoneinfo", "Local"), tmp, "localtime")
+
+	w, err := NewWatcherWith(WithSymlinks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	if err := w.AddWith(join(tmp, "localtime"), WithSymlinkChain()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the intermediate symlink.
+	symlink(t, "zoneinfo-b", tmp, "zoneinfo.tmp")
+	mv(t, join(tmp, "zoneinfo.tmp"), tmp, "zoneinfo")
+	waitForEvents()
+
+	echoAppend(t, "data", tmp, "zoneinfo-a", "file") // Not watched any more.
+	eventSeparator()
+	echoAppend(t, "data", tmp, "zoneinfo-b", "file")
+
+	cmpEvents(t, tmp, c.stop(t), newEvents(t, `
+		relink  /localtime
+		write   /localtime
+	`))
+
+	w2, err := NewWatcherWith()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Close()
+	if err := w2.AddWith(join(tmp, "localtime"), WithSymlinkChain()); !errors.Is(err, xErrUnsupported) {
+		t.Errorf("wrong error without WithSymlinks: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package fsnotify
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// MemoryPolicy is what to do when the limit set with [WithMemoryLimit] is
+// reached.
+type MemoryPolicy int
+
+const (
+	// MemoryBlock stops reading new events until the events that are held
+	// were sent. Events wait in the kernel queue in the meanwhile, which may
+	// overflow if they're not read fast enough.
+	MemoryBlock MemoryPolicy = iota
+
+	// MemoryDrop drops events once the limit is reached.
+	MemoryDrop
+)
+
+func (p MemoryPolicy) String() string {
+	switch p {
+	case MemoryBlock:
+		return "MemoryBlock"
+	case MemoryDrop:
+		return "MemoryDrop"
+	}
+	return fmt.Sprintf("MemoryPolicy(%d)", int(p))
+}
+
+// MemoryLimitError is sent on the Errors channel when the limit set with
+// [WithMemoryLimit] was reached. It's not sent again until all held events
+// were sent (or returned from ReadEvents), so Dropped may be lower than the
+// number of events that were dropped in total.
+type MemoryLimitError struct {
+	Limit   int          // Limit from WithMemoryLimit, in bytes.
+	Policy  MemoryPolicy // Policy from WithMemoryLimit.
+	Dropped int          // Number of events that were dropped; always 0 for MemoryBlock.
+}
+
+func (e *MemoryLimitError) Error() string {
+	if e.Policy == MemoryDrop {
+		return fmt.Sprintf("fsnotify: memory limit of %d bytes for pending events reached: dropped %d events",
+			e.Limit, e.Dropped)
+	}
+	return fmt.Sprintf("fsnotify: memory limit of %d bytes for pending events reached: waiting for events to be read",
+		e.Limit)
+}
+
+// Unwrap returns ErrEventOverflow if events were dropped.
+func (e *MemoryLimitError) Unwrap() error {
+	if e.Dropped > 0 {
+		return ErrEventOverflow
+	}
+	return nil
+}
+
+// eventSize is the approximate number of bytes used to hold e.
+func eventSize(e Event) int {
+	n := int(unsafe.Sizeof(e)) + len(e.Name) + len(e.RenamedFrom) + len(e.Checksum) + len(e.Root)
+	if e.Info != nil {
+		n += int(unsafe.Sizeof(*e.Info))
+	}
+	return n
+}
@@ -0,0 +1,506 @@
+// Package mirror keeps a directory in sync with another directory.
+//
+// The source directory is copied to the destination, and changes in the source
+// are copied as they happen. Regular files, directories, and symlinks are
+// copied; other files (devices, sockets, FIFOs) are skipped. Files are written
+// to a temporary file first and then renamed, so the destination never has
+// partially written files.
+//
+// This is a fairly simple one-way sync, meant for things like copying build
+// output or keeping a backup of a config directory: it's not a replacement for
+// rsync or Syncthing.
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/esvos/fsnotify"
+)
+
+// Conflict is what to do if a file in the destination was changed: it's newer
+// than the file in the source, or it was changed after it was copied.
+type Conflict int
+
+const (
+	// Overwrite the destination with the source; on startup, files that only
+	// exist in the destination are removed. This makes the destination an
+	// exact copy of the source.
+	Overwrite Conflict = iota
+
+	// Keep changed files in the destination, and don't remove files that only
+	// exist in the destination.
+	KeepNewer
+
+	// Rename changed files in the destination to "name.conflict-[time]"
+	// before overwriting or removing them, and don't remove files that only
+	// exist in the destination.
+	Backup
+)
+
+func (c Conflict) String() string {
+	switch c {
+	case Overwrite:
+		return "Overwrite"
+	case KeepNewer:
+		return "KeepNewer"
+	case Backup:
+		return "Backup"
+	}
+	return fmt.Sprintf("Conflict(%d)", int(c))
+}
+
+// How long to wait for the Create after a Rename; if there's nothing it was
+// moved out of the source directory.
+var renameWait = 100 * time.Millisecond
+
+// Mirror keeps a destination directory in sync with a source directory.
+type Mirror struct {
+	// Errors sends any errors from the watcher, and errors copying or
+	// removing files; this must be read, like fsnotify.Watcher.Errors.
+	Errors chan error
+
+	src, dst string
+	conflict Conflict
+	w        *fsnotify.Watcher
+
+	mu     sync.Mutex
+	synced map[string]time.Time // Destination path → mtime when it was copied.
+
+	done     chan struct{}
+	doneMu   sync.Mutex
+	doneResp chan struct{}
+}
+
+// New copies src to dst and starts watching src for changes. dst is created if
+// it doesn't exist.
+func New(src, dst string, conflict Conflict) (*Mirror, error) {
+	src, dst = filepath.Clean(src), filepath.Clean(dst)
+	st, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() {
+		return nil, fmt.Errorf("mirror: not a directory: %q", src)
+	}
+	if dst == src || strings.HasPrefix(dst, src+string(filepath.Separator)) {
+		return nil, fmt.Errorf("mirror: destination %q is inside source %q", dst, src)
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	m := &Mirror{
+		Errors:   make(chan error),
+		src:      src,
+		dst:      dst,
+		conflict: conflict,
+		w:        w,
+		synced:   make(map[string]time.Time),
+		done:     make(chan struct{}),
+		doneResp: make(chan struct{}),
+	}
+
+	// Watch directories before copying them, so that nothing gets lost.
+	if err := m.sync(src, true); err != nil {
+		w.Close()
+		return nil, err
+	}
+	go m.run()
+	return m, nil
+}
+
+// Returns true if the error was sent, or false if the mirror is closed.
+func (m *Mirror) sendError(err error) bool {
+	if err == nil {
+		return true
+	}
+	select {
+	case <-m.done:
+		return false
+	case m.Errors <- err:
+		return true
+	}
+}
+
+func (m *Mirror) isClosed() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops watching the source; the destination is left as-is.
+func (m *Mirror) Close() error {
+	m.doneMu.Lock()
+	if m.isClosed() {
+		m.doneMu.Unlock()
+		return nil
+	}
+	close(m.done)
+	m.doneMu.Unlock()
+
+	err := m.w.Close()
+	<-m.doneResp
+	return err
+}
+
+func (m *Mirror) run() {
+	defer func() {
+		close(m.doneResp)
+		close(m.Errors)
+	}()
+
+	// Path that was renamed; this is either followed by a Create for the new
+	// name, or it was moved out of src.
+	var renamed string
+	for {
+		var timeout <-chan time.Time
+		if renamed != "" {
+			timeout = time.After(renameWait)
+		}
+
+		select {
+		case <-m.done:
+			return
+		case <-timeout:
+			if !m.sendError(m.remove(renamed)) {
+				return
+			}
+			renamed = ""
+		case err, ok := <-m.w.Errors:
+			if !ok {
+				return
+			}
+			if !m.sendError(err) {
+				return
+			}
+		case e, ok := <-m.w.Events:
+			if !ok {
+				return
+			}
+
+			var err error
+			switch {
+			case renamed != "" && e.Has(fsnotify.Rename) && e.Name == renamed:
+				// Directories send Rename for both the parent and the directory
+				// itself.
+				continue
+			case renamed != "" && e.Has(fsnotify.Create):
+				var ok bool
+				ok, err = m.rename(renamed, e.Name)
+				if !ok && err == nil {
+					err = firstErr(m.remove(renamed), m.sync(e.Name, false))
+				}
+				renamed = ""
+			default:
+				if renamed != "" {
+					err = m.remove(renamed)
+					renamed = ""
+				}
+				switch {
+				case e.Has(fsnotify.Rename):
+					renamed = e.Name
+				case e.Has(fsnotify.Remove):
+					err = firstErr(err, m.remove(e.Name))
+				default: // Create, Write, Chmod.
+					err = firstErr(err, m.sync(e.Name, false))
+				}
+			}
+			if !m.sendError(err) {
+				return
+			}
+		}
+	}
+}
+
+func firstErr(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dstPath gets the path in the destination for a path in the source.
+func (m *Mirror) dstPath(src string) (string, error) {
+	rel, err := filepath.Rel(m.src, src)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("mirror: path %q is not in %q", src, m.src)
+	}
+	return filepath.Join(m.dst, rel), nil
+}
+
+// sync copies src to the destination; directories are copied recursively, and
+// watched. If initial is true entries that only exist in the destination are
+// removed with Overwrite.
+func (m *Mirror) sync(src string, initial bool) error {
+	dst, err := m.dstPath(src)
+	if err != nil {
+		return err
+	}
+	st, err := os.Lstat(src)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) { // Removed in the meantime.
+			return nil
+		}
+		return err
+	}
+
+	switch {
+	case st.IsDir():
+		return m.syncDir(src, dst, st, initial)
+	case st.Mode()&fs.ModeSymlink != 0:
+		return m.syncLink(src, dst)
+	case st.Mode().IsRegular():
+		return m.syncFile(src, dst, st)
+	}
+	return nil
+}
+
+func (m *Mirror) syncDir(src, dst string, st fs.FileInfo, initial bool) error {
+	if err := m.w.Add(src); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if err := m.mkdir(dst, st.Mode().Perm()); err != nil {
+		return err
+	}
+
+	ls, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	have := make(map[string]struct{}, len(ls))
+	for _, f := range ls {
+		have[f.Name()] = struct{}{}
+		if err := m.sync(filepath.Join(src, f.Name()), initial); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if initial && m.conflict == Overwrite {
+		dls, err := os.ReadDir(dst)
+		if err != nil {
+			return err
+		}
+		for _, f := range dls {
+			if _, ok := have[f.Name()]; !ok {
+				if err := os.RemoveAll(filepath.Join(dst, f.Name())); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return firstErr(errs...)
+}
+
+// mkdir makes sure dst is a directory.
+func (m *Mirror) mkdir(dst string, perm fs.FileMode) error {
+	st, err := os.Lstat(dst)
+	if err == nil && st.IsDir() {
+		return nil
+	}
+	if err == nil {
+		if err := os.Remove(dst); err != nil {
+			return err
+		}
+	}
+	return os.MkdirAll(dst, perm|0o700)
+}
+
+func (m *Mirror) syncLink(src, dst string) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	if have, err := os.Readlink(dst); err == nil && have == target {
+		return nil
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	return os.Symlink(target, dst)
+}
+
+func (m *Mirror) syncFile(src, dst string, st fs.FileInfo) error {
+	dstSt, err := os.Lstat(dst)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if dstSt.Mode().IsRegular() && dstSt.Size() == st.Size() && dstSt.ModTime().Equal(st.ModTime()) {
+			if dstSt.Mode().Perm() != st.Mode().Perm() {
+				return os.Chmod(dst, st.Mode().Perm())
+			}
+			return nil
+		}
+		if dstSt.Mode().IsRegular() && (dstSt.ModTime().After(st.ModTime()) || m.changed(dst, dstSt)) {
+			if ok, err := m.resolve(dst); !ok || err != nil {
+				return err
+			}
+		}
+	}
+	return m.copyFile(src, dst, st)
+}
+
+func (m *Mirror) copyFile(src, dst string, st fs.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, in)
+	if err == nil {
+		err = tmp.Chmod(st.Mode().Perm())
+	}
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), st.ModTime(), st.ModTime())
+	}
+	if err == nil {
+		if dstSt, err2 := os.Lstat(dst); err2 == nil && dstSt.IsDir() {
+			err = os.RemoveAll(dst)
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	m.mu.Lock()
+	m.synced[dst] = st.ModTime()
+	m.mu.Unlock()
+	return nil
+}
+
+// changed reports if dst was changed after it was copied.
+func (m *Mirror) changed(dst string, st fs.FileInfo) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.synced[dst]
+	return ok && !t.Equal(st.ModTime())
+}
+
+// resolve a conflict for dst; returns false if dst should be left as-is.
+func (m *Mirror) resolve(dst string) (bool, error) {
+	switch m.conflict {
+	case KeepNewer:
+		return false, nil
+	case Backup:
+		err := os.Rename(dst, dst+".conflict-"+time.Now().Format("20060102T150405"))
+		return err == nil, err
+	}
+	return true, nil
+}
+
+// remove the destination for src.
+func (m *Mirror) remove(src string) error {
+	dst, err := m.dstPath(src)
+	if err != nil {
+		return err
+	}
+	m.unwatch(src)
+
+	st, err := os.Lstat(dst)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if st.Mode().IsRegular() && m.changed(dst, st) {
+		if ok, err := m.resolve(dst); !ok || err != nil {
+			return err
+		}
+	}
+	m.forget(dst)
+	return os.RemoveAll(dst)
+}
+
+// rename the destination for oldSrc to newSrc, if newSrc is the same file.
+// Returns false if it's not.
+func (m *Mirror) rename(oldSrc, newSrc string) (bool, error) {
+	oldDst, err := m.dstPath(oldSrc)
+	if err != nil {
+		return false, err
+	}
+	newDst, err := m.dstPath(newSrc)
+	if err != nil {
+		return false, err
+	}
+
+	st, err := os.Lstat(newSrc)
+	if err != nil {
+		return false, nil
+	}
+	dstSt, err := os.Lstat(oldDst)
+	if err != nil {
+		return false, nil
+	}
+	same := (st.IsDir() && dstSt.IsDir()) ||
+		(st.Mode().IsRegular() && dstSt.Mode().IsRegular() &&
+			st.Size() == dstSt.Size() && st.ModTime().Equal(dstSt.ModTime()))
+	if !same {
+		return false, nil
+	}
+
+	m.unwatch(oldSrc)
+	m.forget(oldDst)
+	if err := os.RemoveAll(newDst); err != nil {
+		return true, err
+	}
+	if err := os.Rename(oldDst, newDst); err != nil {
+		return true, err
+	}
+	// Watch the new directory paths and sync anything that changed.
+	return true, m.sync(newSrc, false)
+}
+
+// unwatch removes the watches for src and everything below it; the watches
+// for a moved directory still have the old paths.
+func (m *Mirror) unwatch(src string) {
+	for _, p := range m.w.WatchList() {
+		if p == src || strings.HasPrefix(p, src+string(filepath.Separator)) {
+			m.w.Remove(p)
+		}
+	}
+}
+
+// forget the copy times for dst and everything below it.
+func (m *Mirror) forget(dst string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for p := range m.synced {
+		if p == dst || strings.HasPrefix(p, dst+string(filepath.Separator)) {
+			delete(m.synced, p)
+		}
+	}
+}
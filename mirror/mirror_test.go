@@ -0,0 +1,175 @@
+package mirror
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func write(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tree lists all files in dir, as "path=contents" or "path/" for directories.
+func tree(dir string) string {
+	var l []string
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		rel = filepath.ToSlash(rel)
+		switch {
+		case d.IsDir():
+			l = append(l, rel+"/")
+		case d.Type()&os.ModeSymlink != 0:
+			target, _ := os.Readlink(path)
+			l = append(l, rel+"->"+target)
+		default:
+			data, _ := os.ReadFile(path)
+			l = append(l, rel+"="+string(data))
+		}
+		return nil
+	})
+	sort.Strings(l)
+	return strings.Join(l, " ")
+}
+
+// waitFor waits until the destination has the wanted tree.
+func waitFor(t *testing.T, dst, want string) {
+	t.Helper()
+	var have string
+	for i := 0; i < 200; i++ {
+		if have = tree(dst); have == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("\nhave: %s\nwant: %s", have, want)
+}
+
+func start(t *testing.T, src, dst string, c Conflict) *Mirror {
+	t.Helper()
+	m, err := New(src, dst, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for err := range m.Errors {
+			t.Error(err)
+		}
+	}()
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestMirror(t *testing.T) {
+	var (
+		tmp = t.TempDir()
+		src = filepath.Join(tmp, "src")
+		dst = filepath.Join(tmp, "dst")
+	)
+	write(t, filepath.Join(src, "a"), "a")
+	write(t, filepath.Join(src, "sub", "b"), "b")
+	write(t, filepath.Join(dst, "stale"), "x")
+	if err := os.Symlink("a", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	start(t, src, dst, Overwrite)
+	waitFor(t, dst, "a=a link->a sub/ sub/b=b")
+
+	write(t, filepath.Join(src, "a"), "aa")
+	waitFor(t, dst, "a=aa link->a sub/ sub/b=b")
+
+	write(t, filepath.Join(src, "new", "c"), "c")
+	waitFor(t, dst, "a=aa link->a new/ new/c=c sub/ sub/b=b")
+
+	if err := os.Rename(filepath.Join(src, "a"), filepath.Join(src, "renamed")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, dst, "link->a new/ new/c=c renamed=aa sub/ sub/b=b")
+
+	// Files in a renamed directory should still be synced.
+	if err := os.Rename(filepath.Join(src, "new"), filepath.Join(src, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, dst, "dir/ dir/c=c link->a renamed=aa sub/ sub/b=b")
+	write(t, filepath.Join(src, "dir", "c"), "cc")
+	waitFor(t, dst, "dir/ dir/c=cc link->a renamed=aa sub/ sub/b=b")
+
+	// Moved out of the source.
+	if err := os.Rename(filepath.Join(src, "sub"), filepath.Join(tmp, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, dst, "dir/ dir/c=cc link->a renamed=aa")
+
+	if err := os.RemoveAll(filepath.Join(src, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, dst, "link->a renamed=aa")
+}
+
+func TestMirrorConflict(t *testing.T) {
+	for _, c := range []Conflict{Overwrite, KeepNewer, Backup} {
+		t.Run(c.String(), func(t *testing.T) {
+			var (
+				tmp = t.TempDir()
+				src = filepath.Join(tmp, "src")
+				dst = filepath.Join(tmp, "dst")
+			)
+			write(t, filepath.Join(src, "a"), "src")
+			write(t, filepath.Join(dst, "a"), "dst")
+			write(t, filepath.Join(dst, "only-dst"), "dst")
+			future := time.Now().Add(time.Hour)
+			if err := os.Chtimes(filepath.Join(dst, "a"), future, future); err != nil {
+				t.Fatal(err)
+			}
+
+			start(t, src, dst, c)
+			have := tree(dst)
+			want := map[Conflict]string{
+				Overwrite: "a=src",
+				KeepNewer: "a=dst only-dst=dst",
+				Backup:    "a.conflict-*=dst a=src only-dst=dst",
+			}[c]
+			if c == Backup {
+				have = strings.Join(strings.Fields(strings.Map(func(r rune) rune {
+					if r >= '0' && r <= '9' || r == 'T' {
+						return -1
+					}
+					return r
+				}, have)), " ")
+				want = strings.Replace(want, "*", "", 1)
+			}
+			if have != want {
+				t.Errorf("\nhave: %s\nwant: %s", have, want)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	tmp := t.TempDir()
+	_, err := New(tmp, filepath.Join(tmp, "dst"), Overwrite)
+	if err == nil || !strings.Contains(err.Error(), "inside source") {
+		t.Errorf("wrong error: %v", err)
+	}
+	_, err = New(filepath.Join(tmp, "nonexistent"), filepath.Join(tmp, "dst"), Overwrite)
+	if !os.IsNotExist(err) {
+		t.Errorf("wrong error: %v", err)
+	}
+	if have := fmt.Sprint(Conflict(5)); have != "Conflict(5)" {
+		t.Error(have)
+	}
+}
@@ -0,0 +1,129 @@
+package fsnotify
+
+import (
+	"context"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// ProfileHooks are called on the event path, for use with [WithProfiling].
+//
+// The hooks are called from the goroutine that sends the events, and must not
+// block.
+type ProfileHooks struct {
+	// Event is called after an event was sent on the Events channel, with how
+	// long it took until it was received. This is mostly the time the
+	// application spends handling the previous event.
+	Event func(e Event, wait time.Duration)
+
+	// Error is called after an error was sent on the Errors channel, with how
+	// long it took until it was received.
+	Error func(err error, wait time.Duration)
+}
+
+// profileLabels gets the pprof labels for the goroutines of a Watcher with
+// WithProfiling().
+func profileLabels(with watcherOpts) pprof.LabelSet {
+	b := backendName(with)
+	switch {
+	case with.watchman:
+		b = "watchman"
+	case with.ssh != "":
+		b = "ssh"
+	case with.objectStore != nil:
+		b = "object"
+	case with.synthetic != nil:
+		b = "synthetic"
+	}
+	return pprof.Labels("fsnotify.watcher", with.profile, "fsnotify.backend", b)
+}
+
+// withLabels runs f in a new goroutine with the pprof labels for with, so
+// that all goroutines f starts get the labels too.
+func withLabels(with watcherOpts, f func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), profileLabels(with)))
+		f()
+	}()
+	<-done
+}
+
+// profiler sits between the backend (or the other layers) and the Events
+// channel for WithProfiling() with hooks: it times how long sending every
+// event and error takes.
+type profiler struct {
+	hooks ProfileHooks
+
+	inEv   chan Event // From the backend.
+	inErr  chan error
+	outEv  chan Event // To the user.
+	outErr chan error
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newProfiler(with watcherOpts, ev chan Event, errs chan error) *profiler {
+	return &profiler{
+		hooks:   *with.profileHooks,
+		inEv:    make(chan Event),
+		inErr:   make(chan error),
+		outEv:   ev,
+		outErr:  errs,
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// close stops sending events.
+func (p *profiler) close() {
+	p.closeOnce.Do(func() { close(p.closing) })
+}
+
+func (p *profiler) run() {
+	defer func() {
+		close(p.done)
+		close(p.outErr)
+		close(p.outEv)
+	}()
+
+	inEv, inErr := p.inEv, p.inErr
+	for inEv != nil || inErr != nil {
+		select {
+		case <-p.closing:
+			return
+		case err, ok := <-inErr:
+			if !ok {
+				inErr = nil
+				continue
+			}
+			start := time.Now()
+			select {
+			case <-p.closing:
+				return
+			case p.outErr <- err:
+			}
+			if p.hooks.Error != nil {
+				p.hooks.Error(err, time.Since(start))
+			}
+		case e, ok := <-inEv:
+			if !ok {
+				inEv = nil
+				continue
+			}
+			start := time.Now()
+			select {
+			case <-p.closing:
+				return
+			case p.outEv <- e:
+			}
+			if p.hooks.Event != nil {
+				p.hooks.Event(e, time.Since(start))
+			}
+		}
+	}
+}
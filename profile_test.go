@@ -0,0 +1,48 @@
+package fsnotify
+
+import (
+	"bytes"
+	"runtime/pprof"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWithProfiling(t *testing.T) {
+	t.Parallel()
+
+	var (
+		tmp    = t.TempDir()
+		mu     sync.Mutex
+		timed  []string
+		hooked = &ProfileHooks{Event: func(e Event, wait time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			timed = append(timed, e.Name)
+		}}
+	)
+	w, err := NewWatcherWith(WithProfiling("test-profiling", hooked))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	addWatch(t, w, tmp)
+
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(`"fsnotify.watcher":"test-profiling"`)) {
+		t.Errorf("no goroutines with the label:\n%s", buf.String())
+	}
+
+	touch(t, tmp, "file")
+	cmpEvents(t, tmp, c.stop(t), newEvents(t, `create /file`))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(timed) != 1 || timed[0] != join(tmp, "file") {
+		t.Errorf("wrong events timed: %q", timed)
+	}
+}
@@ -0,0 +1,158 @@
+package fsnotify
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// relPaths sits between the other layers and the Events channel for
+// WithRelativePaths(): it sets Event.Root to the path added with Add() the
+// event is for, and makes Event.Name relative to that.
+//
+// It's also used for WithSelfEvents(false), to drop events for the added
+// directories themselves.
+type relPaths struct {
+	rel    bool // WithRelativePaths()
+	noSelf bool // WithSelfEvents(false)
+
+	inEv   chan Event // From the backend (or the other layers).
+	inErr  chan error
+	outEv  chan Event // To the user.
+	outErr chan error
+
+	mu    sync.Mutex
+	roots map[string]bool // Added paths, without "/...", and if it's a directory.
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newRelPaths(with watcherOpts, ev chan Event, errs chan error) *relPaths {
+	return &relPaths{
+		rel:     with.relative,
+		noSelf:  with.noSelf,
+		inEv:    make(chan Event),
+		inErr:   make(chan error),
+		outEv:   ev,
+		outErr:  errs,
+		roots:   make(map[string]bool),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// close stops sending events.
+func (r *relPaths) close() {
+	r.closeOnce.Do(func() { close(r.closing) })
+}
+
+// track records that path was added by the user.
+func (r *relPaths) track(path string) {
+	clean, _ := recursivePath(path)
+	fi, err := os.Stat(clean)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.roots[clean] = err == nil && fi.IsDir()
+}
+
+// forget stops using path as a root after the user removed it.
+func (r *relPaths) forget(path string) {
+	clean, _ := recursivePath(path)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.roots, clean)
+}
+
+// root finds the closest root for path: path itself, or the closest parent
+// directory that was added.
+func (r *relPaths) root(path string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for p := filepath.Clean(path); ; {
+		if _, ok := r.roots[p]; ok {
+			return p, true
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", false
+		}
+		p = parent
+	}
+}
+
+// self reports if e is for an added directory itself, rather than a file in
+// it. Events for a directory that's also in another added directory, and
+// Rescan and Relink, are always sent.
+func (r *relPaths) self(e Event) bool {
+	if e.Has(Rescan) || e.Has(Relink) {
+		return false
+	}
+	name := filepath.Clean(e.Name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, inRoot := r.roots[filepath.Dir(name)]
+	return r.roots[name] && !inRoot
+}
+
+// relative sets Root and makes the paths in e relative to it. Events that
+// aren't under any root (e.g. for a root that was just removed) are returned
+// as-is.
+func (r *relPaths) relative(e Event) Event {
+	root, ok := r.root(e.Name)
+	if !ok {
+		return e
+	}
+	if rel, err := filepath.Rel(root, e.Name); err == nil {
+		e.Root, e.Name = root, rel
+	}
+	if from, ok := r.root(e.RenamedFrom); e.RenamedFrom != "" && ok && from == root {
+		if rel, err := filepath.Rel(root, e.RenamedFrom); err == nil {
+			e.RenamedFrom = rel
+		}
+	}
+	return e
+}
+
+func (r *relPaths) run() {
+	defer func() {
+		close(r.done)
+		close(r.outErr)
+		close(r.outEv)
+	}()
+
+	inEv, inErr := r.inEv, r.inErr
+	for inEv != nil || inErr != nil {
+		select {
+		case <-r.closing:
+			return
+		case err, ok := <-inErr:
+			if !ok {
+				inErr = nil
+				continue
+			}
+			select {
+			case <-r.closing:
+				return
+			case r.outErr <- err:
+			}
+		case e, ok := <-inEv:
+			if !ok {
+				inEv = nil
+				continue
+			}
+			if r.noSelf && r.self(e) {
+				continue
+			}
+			if r.rel {
+				e = r.relative(e)
+			}
+			select {
+			case <-r.closing:
+				return
+			case r.outEv <- e:
+			}
+		}
+	}
+}
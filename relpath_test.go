@@ -0,0 +1,101 @@
+package fsnotify
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestWithRelativePaths(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "sub")
+
+	w, err := NewWatcherWith(WithRelativePaths())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	addWatch(t, w, tmp)
+	addWatch(t, w, tmp, "sub")
+
+	touch(t, tmp, "file")
+	eventSeparator()
+	touch(t, tmp, "sub", "file")
+
+	have := c.stop(t)
+	want := []Event{
+		{Name: "file", Op: Create, Root: tmp},
+		{Name: "file", Op: Create, Root: join(tmp, "sub")},
+	}
+	if len(have) != len(want) {
+		t.Fatalf("wrong events:\n%s", have)
+	}
+	for i := range want {
+		if have[i].Name != want[i].Name || have[i].Root != want[i].Root || !have[i].Has(want[i].Op) {
+			t.Errorf("event %d: have %s (root %q), want %s (root %q)",
+				i, have[i], have[i].Root, want[i], want[i].Root)
+		}
+	}
+}
+
+func TestWithCanonicalPaths(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdirAll(t, tmp, "dir", "sub")
+	symlink(t, join(tmp, "dir"), tmp, "link")
+	real, err := filepath.EvalSymlinks(join(tmp, "dir", "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewWatcherWith(WithCanonicalPaths())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	addWatch(t, w, tmp, "link", "sub")
+	if have := w.WatchList(); len(have) != 1 || have[0] != real {
+		t.Errorf("wrong WatchList: %q", have)
+	}
+
+	touch(t, tmp, "dir", "sub", "file")
+	eventSeparator()
+	if err := w.Remove(join(tmp, "link", "sub")); err != nil {
+		t.Error(err)
+	}
+
+	have := c.stop(t)
+	if len(have) != 1 || have[0].Name != filepath.Join(real, "file") {
+		t.Errorf("wrong events:\n%s", have)
+	}
+}
+
+func TestWithSelfEvents(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+
+	w, err := NewWatcherWith(WithSelfEvents(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	addWatch(t, w, tmp, "dir")
+
+	chmod(t, 0o700, tmp, "dir")
+	touch(t, tmp, "dir", "file")
+	eventSeparator()
+	rm(t, tmp, "dir", "file")
+	rm(t, tmp, "dir")
+
+	cmpEvents(t, tmp, c.stop(t), newEvents(t, `
+		create  /dir/file
+		remove  /dir/file
+	`))
+}
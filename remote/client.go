@@ -0,0 +1,338 @@
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/esvos/fsnotify"
+)
+
+// Time to wait between reconnect attempts; this doubles on every failed
+// attempt, up to maxBackoff.
+var (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 10 * time.Second
+)
+
+// Timeout for connecting and the hello request.
+const connectTimeout = 10 * time.Second
+
+// Client watches paths on a remote [Server].
+//
+// This has the same API as fsnotify.Watcher. If the connection is lost, an
+// error is sent on Errors and the client keeps reconnecting until Close() is
+// called. Add(), Remove(), and WatchList() fail with [ErrDisconnected] while
+// it's reconnecting.
+type Client struct {
+	// Events sends the filesystem change events; see fsnotify.Watcher.
+	Events chan fsnotify.Event
+
+	// Errors sends any errors from the server, and connection errors.
+	Errors chan error
+
+	dial func() (net.Conn, error)
+
+	mu       sync.Mutex
+	conn     net.Conn // nil while reconnecting.
+	enc      *json.Encoder
+	id       int
+	pending  map[int]chan message
+	paths    map[string]struct{} // Added paths, for the hello request.
+	instance string
+	client   string // Random ID for this client, so it can only remove its own paths.
+	seq      uint64 // Last event received.
+
+	done     chan struct{}
+	doneMu   sync.Mutex
+	doneResp chan struct{}
+}
+
+// Dial connects to the server at address; see net.Dial for the network and
+// address.
+func Dial(network, address string) (*Client, error) {
+	d := net.Dialer{Timeout: connectTimeout}
+	return NewClient(func() (net.Conn, error) { return d.Dial(network, address) })
+}
+
+// NewClient creates a new client, which uses dial to connect to the server.
+// This fails if the first connection fails.
+func NewClient(dial func() (net.Conn, error)) (*Client, error) {
+	c := &Client{
+		Events:   make(chan fsnotify.Event),
+		Errors:   make(chan error),
+		dial:     dial,
+		pending:  make(map[int]chan message),
+		paths:    make(map[string]struct{}),
+		client:   randomID(),
+		done:     make(chan struct{}),
+		doneResp: make(chan struct{}),
+	}
+	dec, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	go c.run(dec)
+	return c, nil
+}
+
+// Returns true if the event was sent, or false if client is closed.
+func (c *Client) sendEvent(e fsnotify.Event) bool {
+	select {
+	case <-c.done:
+		return false
+	case c.Events <- e:
+		return true
+	}
+}
+
+// Returns true if the error was sent, or false if client is closed.
+func (c *Client) sendError(err error) bool {
+	if err == nil {
+		return true
+	}
+	select {
+	case <-c.done:
+		return false
+	case c.Errors <- err:
+		return true
+	}
+}
+
+func (c *Client) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close disconnects from the server and closes the Events and Errors channels.
+// The paths stay watched on the server.
+func (c *Client) Close() error {
+	c.doneMu.Lock()
+	if c.isClosed() {
+		c.doneMu.Unlock()
+		return nil
+	}
+	close(c.done)
+	c.doneMu.Unlock()
+
+	c.mu.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.mu.Unlock()
+	<-c.doneResp
+	return nil
+}
+
+// Add starts watching path on the server.
+func (c *Client) Add(path string) error {
+	if c.isClosed() {
+		return fsnotify.ErrClosed
+	}
+	if _, err := c.request(message{Cmd: "add", Path: path}); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.paths[path] = struct{}{}
+	c.mu.Unlock()
+	return nil
+}
+
+// Remove stops watching path on the server. It stays watched if other clients
+// added it too.
+func (c *Client) Remove(path string) error {
+	if c.isClosed() {
+		return nil
+	}
+	if _, err := c.request(message{Cmd: "remove", Path: path}); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	delete(c.paths, path)
+	c.mu.Unlock()
+	return nil
+}
+
+// WatchList returns all paths watched on the server, or nil if the client is
+// closed or disconnected. This includes paths added by other clients.
+func (c *Client) WatchList() []string {
+	if c.isClosed() {
+		return nil
+	}
+	r, err := c.request(message{Cmd: "list"})
+	if err != nil {
+		return nil
+	}
+	if r.Paths == nil {
+		return []string{}
+	}
+	return r.Paths
+}
+
+// request sends m and waits for the reply.
+func (c *Client) request(m message) (message, error) {
+	c.mu.Lock()
+	if c.conn == nil {
+		c.mu.Unlock()
+		return message{}, ErrDisconnected
+	}
+	c.id++
+	m.ID = c.id
+	ch := make(chan message, 1)
+	c.pending[m.ID] = ch
+	err := c.enc.Encode(m)
+	if err != nil {
+		delete(c.pending, m.ID)
+		c.conn.Close() // The read in run() will fail and reconnect.
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return message{}, fmt.Errorf("%w: %s", ErrDisconnected, err)
+	}
+
+	select {
+	case <-c.done:
+		return message{}, fsnotify.ErrClosed
+	case r, ok := <-ch:
+		if !ok {
+			return message{}, ErrDisconnected
+		}
+		if r.Error != "" {
+			return message{}, newRemoteError(r.Error, r.Kind)
+		}
+		return r, nil
+	}
+}
+
+// connect connects to the server and sends the hello request.
+func (c *Client) connect() (*json.Decoder, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, fmt.Errorf("fsnotify/remote: %w", err)
+	}
+
+	c.mu.Lock()
+	hello := message{ID: 1, Cmd: "hello", Since: c.seq, Instance: c.instance, Client: c.client}
+	for p := range c.paths {
+		hello.Paths = append(hello.Paths, p)
+	}
+	c.mu.Unlock()
+	sort.Strings(hello.Paths)
+
+	var (
+		enc   = json.NewEncoder(conn)
+		dec   = json.NewDecoder(conn)
+		reply message
+	)
+	conn.SetDeadline(time.Now().Add(connectTimeout))
+	err = enc.Encode(hello)
+	if err == nil {
+		err = dec.Decode(&reply)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("fsnotify/remote: hello: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isClosed() {
+		conn.Close()
+		return nil, fsnotify.ErrClosed
+	}
+	c.conn, c.enc, c.instance, c.seq = conn, enc, reply.Instance, reply.Seq
+	return dec, nil
+}
+
+// disconnect closes the connection and fails all pending requests.
+func (c *Client) disconnect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.conn, c.enc = nil, nil
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+func (c *Client) run(dec *json.Decoder) {
+	defer func() {
+		close(c.doneResp)
+		close(c.Errors)
+		close(c.Events)
+	}()
+
+	for {
+		err := c.read(dec)
+		c.disconnect()
+		if c.isClosed() {
+			return
+		}
+		if !c.sendError(fmt.Errorf("fsnotify/remote: connection lost: %w", err)) {
+			return
+		}
+
+		for wait := minBackoff; ; {
+			select {
+			case <-c.done:
+				return
+			case <-time.After(wait):
+			}
+			dec, err = c.connect()
+			if err == nil {
+				break
+			}
+			if wait *= 2; wait > maxBackoff {
+				wait = maxBackoff
+			}
+		}
+	}
+}
+
+// read reads messages until the connection fails or the client is closed.
+func (c *Client) read(dec *json.Decoder) error {
+	for {
+		var m message
+		if err := dec.Decode(&m); err != nil {
+			return err
+		}
+
+		if m.ID != 0 {
+			c.mu.Lock()
+			ch, ok := c.pending[m.ID]
+			delete(c.pending, m.ID)
+			c.mu.Unlock()
+			if ok {
+				ch <- m
+			}
+			continue
+		}
+
+		if m.Seq != 0 {
+			c.mu.Lock()
+			c.seq = m.Seq
+			c.mu.Unlock()
+		}
+		var ok bool
+		if m.Err != "" {
+			ok = c.sendError(newRemoteError(m.Err, m.Kind))
+		} else {
+			ok = c.sendEvent(fsnotify.Event{Name: m.Name, Op: m.Op, RenamedFrom: m.RenamedFrom,
+				Info: m.Info, Pid: m.Pid, Checksum: m.Checksum})
+		}
+		if !ok {
+			return fsnotify.ErrClosed
+		}
+	}
+}
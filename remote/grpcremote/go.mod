@@ -0,0 +1,19 @@
+module github.com/esvos/fsnotify/remote/grpcremote
+
+go 1.19
+
+require (
+	github.com/esvos/fsnotify v0.0.0-00010101000000-000000000000
+	google.golang.org/grpc v1.59.0
+	google.golang.org/protobuf v1.31.0
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	golang.org/x/net v0.14.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.12.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230822172742-b8732ec3820d // indirect
+)
+
+replace github.com/esvos/fsnotify => ../..
@@ -0,0 +1,328 @@
+// Package grpcremote serves the fsnotify/remote protocol over gRPC.
+//
+// This is the same protocol as the remote package, with every message sent as
+// a remotepb.Message on a bidirectional Connect stream (see
+// remotepb/remote.proto), so that clients in other languages can use the code
+// generated from the .proto file. The server and client are the ones from the
+// remote package, with the same behaviour: reconnecting, resending missed
+// events, [remote.WithRoots], and so forth.
+//
+// This is a separate module so that fsnotify and the remote package don't
+// depend on gRPC and protobuf.
+//
+// To serve a Watcher:
+//
+//	s := remote.NewServer(w, 0)
+//	g := grpc.NewServer()
+//	grpcremote.Register(g, s)
+//	err := g.Serve(l)
+//
+// And to connect to it:
+//
+//	cc, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+//	c, err := grpcremote.NewClient(cc)
+//	err = c.Add("/etc")
+package grpcremote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/esvos/fsnotify"
+	"github.com/esvos/fsnotify/remote"
+	"github.com/esvos/fsnotify/remote/grpcremote/remotepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Register registers s as the Remote service on g, which is usually a
+// *grpc.Server.
+func Register(g grpc.ServiceRegistrar, s *remote.Server) {
+	remotepb.RegisterRemoteServer(g, &service{s: s})
+}
+
+type service struct {
+	remotepb.UnimplementedRemoteServer
+	s *remote.Server
+}
+
+func (svc *service) Connect(stream remotepb.Remote_ConnectServer) error {
+	var from net.Addr = addr("grpc")
+	if p, ok := peer.FromContext(stream.Context()); ok && p.Addr != nil {
+		from = p.Addr
+	}
+	err := svc.s.ServeConn(newConn(stream.Recv, stream.Send, func() {}, addr("grpc"), from))
+	if errors.Is(err, remote.ErrServerClosed) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return err
+}
+
+// NewClient creates a new client, which connects to the server over cc; this
+// is usually a *grpc.ClientConn. Every connection to the server is a new
+// Connect stream. This fails if the first connection fails.
+func NewClient(cc grpc.ClientConnInterface) (*remote.Client, error) {
+	rc := remotepb.NewRemoteClient(cc)
+	return remote.NewClient(func() (net.Conn, error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream, err := rc.Connect(ctx)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		return newConn(stream.Recv, stream.Send, cancel, addr("grpc"), addr("grpc")), nil
+	})
+}
+
+// conn is a net.Conn for a Connect stream, so that it can be used with
+// remote.Server.ServeConn() and remote.NewClient(), which read and write the
+// JSON protocol. Every line that's written is sent as a remotepb.Message, and
+// every received remotepb.Message is read as a line of JSON.
+type conn struct {
+	send          func(*remotepb.Message) error
+	cancel        func() // Stops the stream.
+	local, remote net.Addr
+
+	recv    chan []byte // Received messages, as JSON.
+	recvErr error       // Set before recv is closed.
+	rbuf    []byte      // Rest of the message for Read().
+
+	wmu  sync.Mutex
+	wbuf []byte // Incomplete line from Write().
+
+	closeOnce sync.Once
+	done      chan struct{}
+
+	timerMu sync.Mutex
+	timer   *time.Timer // For SetDeadline().
+}
+
+func newConn(recv func() (*remotepb.Message, error), send func(*remotepb.Message) error,
+	cancel func(), local, remote net.Addr) *conn {
+	c := &conn{
+		send:   send,
+		cancel: cancel,
+		local:  local,
+		remote: remote,
+		recv:   make(chan []byte),
+		done:   make(chan struct{}),
+	}
+	go c.readStream(recv)
+	return c
+}
+
+func (c *conn) readStream(recv func() (*remotepb.Message, error)) {
+	defer close(c.recv)
+	for {
+		m, err := recv()
+		if err != nil {
+			c.recvErr = err
+			return
+		}
+		b, err := json.Marshal(fromProto(m))
+		if err != nil {
+			c.recvErr = err
+			return
+		}
+		select {
+		case c.recv <- append(b, '\n'):
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	if len(c.rbuf) == 0 {
+		select {
+		case <-c.done:
+			return 0, net.ErrClosed
+		case b, ok := <-c.recv:
+			if !ok {
+				if c.recvErr == nil {
+					return 0, io.EOF
+				}
+				return 0, c.recvErr
+			}
+			c.rbuf = b
+		}
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	c.wbuf = append(c.wbuf, p...)
+	for {
+		i := bytes.IndexByte(c.wbuf, '\n')
+		if i == -1 {
+			return len(p), nil
+		}
+		var m message
+		if err := json.Unmarshal(c.wbuf[:i], &m); err != nil {
+			return 0, err
+		}
+		c.wbuf = c.wbuf[i+1:]
+		if err := c.send(toProto(m)); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.cancel()
+	})
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+// SetDeadline closes the stream at t; a zero t clears it. There are no
+// separate read and write deadlines.
+func (c *conn) SetDeadline(t time.Time) error {
+	c.timerMu.Lock()
+	defer c.timerMu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if !t.IsZero() {
+		c.timer = time.AfterFunc(time.Until(t), func() { c.Close() })
+	}
+	return nil
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error  { return c.SetDeadline(t) }
+func (c *conn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
+
+type addr string
+
+func (a addr) Network() string { return string(a) }
+func (a addr) String() string  { return string(a) }
+
+// message is a message of the JSON protocol, as documented in the remote
+// package.
+type message struct {
+	ID       int64    `json:"id,omitempty"`
+	Cmd      string   `json:"cmd,omitempty"`
+	Path     string   `json:"path,omitempty"`
+	Since    uint64   `json:"since,omitempty"`
+	Instance string   `json:"instance,omitempty"`
+	Client   string   `json:"client,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Paths    []string `json:"paths,omitempty"`
+
+	Seq         uint64              `json:"seq,omitempty"`
+	Name        string              `json:"name,omitempty"`
+	Op          fsnotify.Op         `json:"op,omitempty"`
+	RenamedFrom string              `json:"renamedFrom,omitempty"`
+	Info        *fsnotify.EventInfo `json:"info,omitempty"`
+	Pid         int                 `json:"pid,omitempty"`
+	Checksum    []byte              `json:"checksum,omitempty"`
+	Err         string              `json:"err,omitempty"`
+
+	Kind string `json:"kind,omitempty"`
+}
+
+func toProto(m message) *remotepb.Message {
+	pm := &remotepb.Message{
+		Id:          m.ID,
+		Cmd:         m.Cmd,
+		Path:        m.Path,
+		Since:       m.Since,
+		Instance:    m.Instance,
+		Client:      m.Client,
+		Error:       m.Error,
+		Paths:       m.Paths,
+		Seq:         m.Seq,
+		Name:        m.Name,
+		Op:          uint32(m.Op),
+		RenamedFrom: m.RenamedFrom,
+		Pid:         int64(m.Pid),
+		Checksum:    m.Checksum,
+		Err:         m.Err,
+		Kind:        m.Kind,
+	}
+	if i := m.Info; i != nil {
+		pm.Info = &remotepb.EventInfo{
+			FileId:     i.FileID,
+			Size:       i.Size,
+			ModTime:    toTimestamp(i.ModTime),
+			ChangeTime: toTimestamp(i.ChangeTime),
+			AccessTime: toTimestamp(i.AccessTime),
+			BirthTime:  toTimestamp(i.BirthTime),
+			Links:      i.Links,
+			Handle:     i.Handle,
+		}
+	}
+	return pm
+}
+
+func fromProto(pm *remotepb.Message) message {
+	m := message{
+		ID:          pm.Id,
+		Cmd:         pm.Cmd,
+		Path:        pm.Path,
+		Since:       pm.Since,
+		Instance:    pm.Instance,
+		Client:      pm.Client,
+		Error:       pm.Error,
+		Paths:       pm.Paths,
+		Seq:         pm.Seq,
+		Name:        pm.Name,
+		Op:          fsnotify.Op(pm.Op),
+		RenamedFrom: pm.RenamedFrom,
+		Pid:         int(pm.Pid),
+		Checksum:    pm.Checksum,
+		Err:         pm.Err,
+		Kind:        pm.Kind,
+	}
+	if i := pm.Info; i != nil {
+		m.Info = &fsnotify.EventInfo{
+			FileID:     i.FileId,
+			Size:       i.Size,
+			ModTime:    fromTimestamp(i.ModTime),
+			ChangeTime: fromTimestamp(i.ChangeTime),
+			AccessTime: fromTimestamp(i.AccessTime),
+			BirthTime:  fromTimestamp(i.BirthTime),
+			Links:      i.Links,
+			Handle:     i.Handle,
+		}
+	}
+	return m
+}
+
+func toTimestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func fromTimestamp(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return ts.AsTime()
+}
@@ -0,0 +1,183 @@
+package grpcremote
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/esvos/fsnotify"
+	"github.com/esvos/fsnotify/remote"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newServer starts a gRPC server for a new Watcher; the returned function
+// restarts the gRPC server (but not the remote.Server).
+func newServer(t *testing.T, opts ...remote.ServerOpt) (*grpc.ClientConn, func()) {
+	t.Helper()
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := remote.NewServer(w, 0, opts...)
+
+	var (
+		mu sync.Mutex
+		l  *bufconn.Listener
+		g  *grpc.Server
+	)
+	start := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if g != nil {
+			g.Stop()
+		}
+		l, g = bufconn.Listen(1<<20), grpc.NewServer()
+		Register(g, s)
+		go g.Serve(l)
+	}
+	start()
+
+	cc, err := grpc.Dial("bufnet",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return l.DialContext(ctx)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cc.Close()
+		mu.Lock()
+		g.Stop()
+		mu.Unlock()
+		s.Close()
+		w.Close()
+	})
+	return cc, start
+}
+
+func touch(t *testing.T, path string) {
+	t.Helper()
+	fp, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func wantEvent(t *testing.T, c *remote.Client, want fsnotify.Event) {
+	t.Helper()
+	select {
+	case e := <-c.Events:
+		if e.Name != want.Name || e.Op != want.Op || e.RenamedFrom != want.RenamedFrom {
+			t.Fatalf("\nhave: %s\nwant: %s", e, want)
+		}
+	case err := <-c.Errors:
+		t.Fatalf("unexpected error: %s", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for %s", want)
+	}
+}
+
+func wantError(t *testing.T, c *remote.Client, want string) {
+	t.Helper()
+	select {
+	case e := <-c.Events:
+		t.Fatalf("unexpected event: %s", e)
+	case err := <-c.Errors:
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("wrong error\nhave: %s\nwant: %s", err, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for error %q", want)
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	tmp := t.TempDir()
+	cc, restart := newServer(t)
+
+	c, err := NewClient(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if have := c.WatchList(); len(have) != 1 || have[0] != tmp {
+		t.Errorf("WatchList: %q", have)
+	}
+	err = c.Remove(filepath.Join(tmp, "nonexistent"))
+	if !errors.Is(err, fsnotify.ErrNonExistentWatch) {
+		t.Errorf("wrong error for Remove: %#v", err)
+	}
+
+	touch(t, filepath.Join(tmp, "file"))
+	wantEvent(t, c, fsnotify.Event{Name: filepath.Join(tmp, "file"), Op: fsnotify.Create})
+
+	// Stop the gRPC server; events while it's reconnecting shouldn't get lost.
+	restart()
+	wantError(t, c, "connection lost")
+	touch(t, filepath.Join(tmp, "file2"))
+	wantEvent(t, c, fsnotify.Event{Name: filepath.Join(tmp, "file2"), Op: fsnotify.Create})
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add(tmp); !errors.Is(err, fsnotify.ErrClosed) {
+		t.Errorf("wrong error for Add after Close: %v", err)
+	}
+}
+
+func TestGRPCRoots(t *testing.T) {
+	tmp := t.TempDir()
+	cc, _ := newServer(t, remote.WithRoots(filepath.Join(tmp, "root")))
+	if err := os.Mkdir(filepath.Join(tmp, "root"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewClient(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Add(tmp); !errors.Is(err, remote.ErrNotAllowed) {
+		t.Errorf("wrong error: %v", err)
+	}
+	if err := c.Add(filepath.Join(tmp, "root")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMessage(t *testing.T) {
+	now := time.Now()
+	m := message{ID: 1, Cmd: "hello", Paths: []string{"/a"}, Seq: 2, Name: "/b", Op: fsnotify.Create,
+		RenamedFrom: "/c", Pid: 3, Checksum: []byte{1}, Kind: "overflow",
+		Info: &fsnotify.EventInfo{FileID: 4, Size: 5, ModTime: now, Links: 6, Handle: "h"}}
+
+	have := fromProto(toProto(m))
+	if have.ID != m.ID || have.Cmd != m.Cmd || have.Paths[0] != m.Paths[0] || have.Seq != m.Seq ||
+		have.Name != m.Name || have.Op != m.Op || have.RenamedFrom != m.RenamedFrom || have.Pid != m.Pid ||
+		string(have.Checksum) != string(m.Checksum) || have.Kind != m.Kind {
+		t.Errorf("\nhave: %+v\nwant: %+v", have, m)
+	}
+	if i := have.Info; i == nil || i.FileID != 4 || i.Size != 5 || !i.ModTime.Equal(now) ||
+		!i.ChangeTime.IsZero() || i.Links != 6 || i.Handle != "h" {
+		t.Errorf("wrong Info: %+v", have.Info)
+	}
+}
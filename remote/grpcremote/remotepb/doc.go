@@ -0,0 +1,4 @@
+// Package remotepb has the generated code for remote.proto.
+package remotepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative remote.proto
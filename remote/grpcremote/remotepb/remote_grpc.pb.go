@@ -0,0 +1,141 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: remote.proto
+
+package remotepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Remote_Connect_FullMethodName = "/fsnotify.remote.v1.Remote/Connect"
+)
+
+// RemoteClient is the client API for Remote service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RemoteClient interface {
+	Connect(ctx context.Context, opts ...grpc.CallOption) (Remote_ConnectClient, error)
+}
+
+type remoteClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRemoteClient(cc grpc.ClientConnInterface) RemoteClient {
+	return &remoteClient{cc}
+}
+
+func (c *remoteClient) Connect(ctx context.Context, opts ...grpc.CallOption) (Remote_ConnectClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Remote_ServiceDesc.Streams[0], Remote_Connect_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &remoteConnectClient{stream}
+	return x, nil
+}
+
+type Remote_ConnectClient interface {
+	Send(*Message) error
+	Recv() (*Message, error)
+	grpc.ClientStream
+}
+
+type remoteConnectClient struct {
+	grpc.ClientStream
+}
+
+func (x *remoteConnectClient) Send(m *Message) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *remoteConnectClient) Recv() (*Message, error) {
+	m := new(Message)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// RemoteServer is the server API for Remote service.
+// All implementations must embed UnimplementedRemoteServer
+// for forward compatibility
+type RemoteServer interface {
+	Connect(Remote_ConnectServer) error
+	mustEmbedUnimplementedRemoteServer()
+}
+
+// UnimplementedRemoteServer must be embedded to have forward compatible implementations.
+type UnimplementedRemoteServer struct {
+}
+
+func (UnimplementedRemoteServer) Connect(Remote_ConnectServer) error {
+	return status.Errorf(codes.Unimplemented, "method Connect not implemented")
+}
+func (UnimplementedRemoteServer) mustEmbedUnimplementedRemoteServer() {}
+
+// UnsafeRemoteServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RemoteServer will
+// result in compilation errors.
+type UnsafeRemoteServer interface {
+	mustEmbedUnimplementedRemoteServer()
+}
+
+func RegisterRemoteServer(s grpc.ServiceRegistrar, srv RemoteServer) {
+	s.RegisterService(&Remote_ServiceDesc, srv)
+}
+
+func _Remote_Connect_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(RemoteServer).Connect(&remoteConnectServer{stream})
+}
+
+type Remote_ConnectServer interface {
+	Send(*Message) error
+	Recv() (*Message, error)
+	grpc.ServerStream
+}
+
+type remoteConnectServer struct {
+	grpc.ServerStream
+}
+
+func (x *remoteConnectServer) Send(m *Message) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *remoteConnectServer) Recv() (*Message, error) {
+	m := new(Message)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Remote_ServiceDesc is the grpc.ServiceDesc for Remote service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Remote_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "fsnotify.remote.v1.Remote",
+	HandlerType: (*RemoteServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Connect",
+			Handler:       _Remote_Connect_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "remote.proto",
+}
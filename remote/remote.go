@@ -0,0 +1,110 @@
+// Package remote exposes a Watcher over the network, so that files on one
+// machine can be watched from another (e.g. from a sidecar or agent).
+//
+// A [Server] sends the events from a Watcher to all connected clients, and
+// clients can add and remove paths. A [Client] has the same API as
+// fsnotify.Watcher, and reconnects automatically if the connection is lost.
+//
+// Every event has a sequence number, and the server keeps the most recent
+// events in memory. A client that reconnects gets the events it missed, or an
+// fsnotify.ErrEventOverflow error if they're no longer available (or if the
+// server was restarted, in which case the client also adds its paths again).
+//
+// The connection can be anything that's a net.Conn: TCP, a Unix socket, or a
+// tls.Conn. The wire protocol is JSON, one message per line:
+//
+//	→ {"id":1,"cmd":"hello","since":41,"instance":"…","client":"…","paths":["/etc"]}
+//	← {"id":1,"instance":"…","seq":41}
+//	→ {"id":2,"cmd":"add","path":"/etc"}
+//	← {"id":2}
+//	← {"seq":42,"name":"/etc/passwd","op":2}
+//	← {"seq":43,"err":"…","kind":"overflow"}
+//
+// Messages with an "id" are replies to the request with the same id; the
+// others are events and errors. The "kind" is set for errors that can be
+// checked with errors.Is(): "overflow", "nonexistent", "closed", or
+// "notallowed".
+//
+// The hello request includes the paths the client added; these are added again
+// if the instance doesn't match (i.e. the server was restarted). The client is
+// a random ID that stays the same when reconnecting, so that a client can only
+// remove the paths it added.
+//
+// The Server is also an http.Handler, which streams the events as Server-Sent
+// Events, or serves the same protocol over a WebSocket; see [Server.ServeHTTP].
+//
+// The same protocol is served over gRPC by the
+// github.com/esvos/fsnotify/remote/grpcremote module, which is a separate module
+// so that using fsnotify doesn't pull in gRPC and protobuf.
+package remote
+
+import (
+	"errors"
+
+	"github.com/esvos/fsnotify"
+)
+
+// ErrDisconnected is returned by the Client if there is no connection to the
+// server (i.e. it's reconnecting).
+var ErrDisconnected = errors.New("fsnotify/remote: not connected")
+
+// message is a request, reply, event, or error.
+type message struct {
+	// Requests and replies.
+	ID       int      `json:"id,omitempty"`
+	Cmd      string   `json:"cmd,omitempty"` // hello, add, remove, list
+	Path     string   `json:"path,omitempty"`
+	Since    uint64   `json:"since,omitempty"`
+	Instance string   `json:"instance,omitempty"`
+	Client   string   `json:"client,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Paths    []string `json:"paths,omitempty"`
+
+	// Events and errors.
+	Seq         uint64              `json:"seq,omitempty"`
+	Name        string              `json:"name,omitempty"`
+	Op          fsnotify.Op         `json:"op,omitempty"`
+	RenamedFrom string              `json:"renamedFrom,omitempty"`
+	Info        *fsnotify.EventInfo `json:"info,omitempty"`
+	Pid         int                 `json:"pid,omitempty"`
+	Checksum    []byte              `json:"checksum,omitempty"`
+	Err         string              `json:"err,omitempty"`
+
+	Kind string `json:"kind,omitempty"` // For Error and Err.
+}
+
+func eventMessage(e fsnotify.Event) message {
+	return message{Name: e.Name, Op: e.Op, RenamedFrom: e.RenamedFrom, Info: e.Info, Pid: e.Pid, Checksum: e.Checksum}
+}
+
+func errorMessage(err error) message {
+	return message{Err: err.Error(), Kind: errorKind(err)}
+}
+
+// Errors that are sent as a "kind", so that errors.Is() works on the client.
+var kinds = map[string]error{
+	"overflow":    fsnotify.ErrEventOverflow,
+	"nonexistent": fsnotify.ErrNonExistentWatch,
+	"closed":      fsnotify.ErrClosed,
+	"notallowed":  ErrNotAllowed,
+}
+
+func errorKind(err error) string {
+	for k, e := range kinds {
+		if errors.Is(err, e) {
+			return k
+		}
+	}
+	return ""
+}
+
+// remoteError is an error received from the server.
+type remoteError struct {
+	msg  string
+	kind error
+}
+
+func newRemoteError(msg, kind string) error { return &remoteError{msg: msg, kind: kinds[kind]} }
+
+func (e *remoteError) Error() string { return e.msg }
+func (e *remoteError) Unwrap() error { return e.kind }
@@ -0,0 +1,470 @@
+package remote
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/esvos/fsnotify"
+)
+
+func newServer(t *testing.T, opts ...ServerOpt) (*Server, net.Listener) {
+	t.Helper()
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(w, 0, opts...)
+	go s.Serve(l)
+	t.Cleanup(func() {
+		s.Close()
+		w.Close()
+	})
+	return s, l
+}
+
+func touch(t *testing.T, path string) {
+	t.Helper()
+	fp, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func wantEvent(t *testing.T, c *Client, want fsnotify.Event) {
+	t.Helper()
+	select {
+	case e := <-c.Events:
+		if e.Name != want.Name || e.Op != want.Op {
+			t.Fatalf("\nhave: %s\nwant: %s", e, want)
+		}
+	case err := <-c.Errors:
+		t.Fatalf("unexpected error: %s", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for %s", want)
+	}
+}
+
+func wantError(t *testing.T, c *Client, want string) error {
+	t.Helper()
+	select {
+	case e := <-c.Events:
+		t.Fatalf("unexpected event: %s", e)
+	case err := <-c.Errors:
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("wrong error\nhave: %s\nwant: %s", err, want)
+		}
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for error %q", want)
+	}
+	return nil
+}
+
+func TestRemote(t *testing.T) {
+	tmp := t.TempDir()
+	_, l := newServer(t)
+
+	c, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if have := c.WatchList(); len(have) != 1 || have[0] != tmp {
+		t.Errorf("WatchList: %q", have)
+	}
+	err = c.Remove(filepath.Join(tmp, "nonexistent"))
+	if !errors.Is(err, fsnotify.ErrNonExistentWatch) {
+		t.Errorf("wrong error for Remove: %#v", err)
+	}
+
+	touch(t, filepath.Join(tmp, "file"))
+	wantEvent(t, c, fsnotify.Event{Name: filepath.Join(tmp, "file"), Op: fsnotify.Create})
+
+	// Drop the connection; events while it's reconnecting shouldn't get lost.
+	c.mu.Lock()
+	c.conn.Close()
+	c.mu.Unlock()
+	wantError(t, c, "connection lost")
+	if err := c.Add(tmp); !errors.Is(err, ErrDisconnected) {
+		t.Errorf("wrong error for Add: %v", err)
+	}
+	touch(t, filepath.Join(tmp, "file2"))
+	wantEvent(t, c, fsnotify.Event{Name: filepath.Join(tmp, "file2"), Op: fsnotify.Create})
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add(tmp); !errors.Is(err, fsnotify.ErrClosed) {
+		t.Errorf("wrong error for Add after Close: %v", err)
+	}
+	if _, ok := <-c.Events; ok {
+		t.Error("Events not closed")
+	}
+}
+
+func TestRemoteRestart(t *testing.T) {
+	tmp := t.TempDir()
+	s, l := newServer(t)
+
+	var (
+		mu   sync.Mutex
+		addr = l.Addr().String()
+	)
+	c, err := NewClient(func() (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return net.Dial("tcp", addr)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	// New server with a new watcher: the client should add the path again.
+	s.Close()
+	_, l2 := newServer(t)
+	mu.Lock()
+	addr = l2.Addr().String()
+	mu.Unlock()
+
+	wantError(t, c, "connection lost")
+	err = wantError(t, c, "overflow")
+	if !errors.Is(err, fsnotify.ErrEventOverflow) {
+		t.Errorf("not ErrEventOverflow: %#v", err)
+	}
+	touch(t, filepath.Join(tmp, "file"))
+	wantEvent(t, c, fsnotify.Event{Name: filepath.Join(tmp, "file"), Op: fsnotify.Create})
+}
+
+func TestServerBacklog(t *testing.T) {
+	tmp := t.TempDir()
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	s := NewServer(w, 1)
+	defer s.Close()
+	if err := w.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []string{"a", "b", "c"} {
+		touch(t, filepath.Join(tmp, f))
+	}
+	for i := 0; ; i++ {
+		s.mu.Lock()
+		seq := s.seq
+		s.mu.Unlock()
+		if seq == 3 {
+			break
+		}
+		if i > 500 {
+			t.Fatalf("seq is %d", seq)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Reconnect after the first event; the second is no longer available.
+	client, server := net.Pipe()
+	go s.ServeConn(server)
+	c := &Client{
+		Events:   make(chan fsnotify.Event),
+		Errors:   make(chan error),
+		dial:     func() (net.Conn, error) { return client, nil },
+		pending:  make(map[int]chan message),
+		paths:    make(map[string]struct{}),
+		done:     make(chan struct{}),
+		doneResp: make(chan struct{}),
+		instance: s.instance,
+		seq:      1,
+	}
+	dec, err := c.connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go c.run(dec)
+	defer c.Close()
+
+	wantError(t, c, "overflow")
+	wantEvent(t, c, fsnotify.Event{Name: filepath.Join(tmp, "c"), Op: fsnotify.Create})
+}
+
+func TestServeHTTP(t *testing.T) {
+	tmp := t.TempDir()
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	s := NewServer(w, 0)
+	if err := w.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	defer s.Close() // Stop the streams before srv.Close() waits for them.
+
+	get := func(query, lastID string) *bufio.Reader {
+		t.Helper()
+		req, err := http.NewRequest("GET", srv.URL+"?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if resp.StatusCode != 200 {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+		return bufio.NewReader(resp.Body)
+	}
+	next := func(r *bufio.Reader) string {
+		t.Helper()
+		var b strings.Builder
+		for {
+			l, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l == "\n" {
+				return b.String()
+			}
+			b.WriteString(l)
+		}
+	}
+
+	r := get("op=create&match=*.css&path="+url.QueryEscape(tmp), "")
+	touch(t, filepath.Join(tmp, "a.txt"))
+	touch(t, filepath.Join(tmp, "b.css"))
+	have := next(r)
+	want := fmt.Sprintf("id: %s:2\ndata: {\"name\":%q,\"op\":\"CREATE\"}\n", s.instance, filepath.Join(tmp, "b.css"))
+	if have != want {
+		t.Errorf("\nhave: %q\nwant: %q", have, want)
+	}
+
+	// Reconnect.
+	r = get("", s.instance+":1")
+	if have := next(r); !strings.Contains(have, "b.css") {
+		t.Errorf("wrong event after reconnect: %q", have)
+	}
+	r = get("", "restarted:1")
+	if have := next(r); !strings.Contains(have, "event: fsnotify-error\n") || !strings.Contains(have, `"kind":"overflow"`) {
+		t.Errorf("wrong event after restart: %q", have)
+	}
+
+	resp, err := http.Get(srv.URL + "?op=nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status %d for invalid op", resp.StatusCode)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	tmp := t.TempDir()
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	s := NewServer(w, 0)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	defer s.Close()
+
+	dial := func(origin string) (net.Conn, *bufio.Reader, string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nOrigin: %s\r\nConnection: keep-alive, Upgrade\r\n"+
+			"Upgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n",
+			srv.Listener.Addr(), origin)
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, r, resp.Status + " " + resp.Header.Get("Sec-WebSocket-Accept")
+	}
+	send := func(conn net.Conn, opcode byte, data string) {
+		t.Helper()
+		mask := []byte{1, 2, 3, 4}
+		frame := append([]byte{0x80 | opcode, 0x80 | byte(len(data))}, mask...)
+		for i := range data {
+			frame = append(frame, data[i]^mask[i%4])
+		}
+		if _, err := conn.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recv := func(r *bufio.Reader) (byte, string) {
+		t.Helper()
+		var hdr [2]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			t.Fatal(err)
+		}
+		size := int(hdr[1])
+		if size == 126 {
+			var b [2]byte
+			io.ReadFull(r, b[:])
+			size = int(b[0])<<8 | int(b[1])
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Fatal(err)
+		}
+		return hdr[0] & 0x0f, strings.TrimSpace(string(data))
+	}
+
+	if _, _, status := dial("http://example.com"); !strings.HasPrefix(status, "403") {
+		t.Errorf("cross-origin request not rejected: %s", status)
+	}
+
+	conn, r, status := dial("http://" + srv.Listener.Addr().String())
+	if status != "101 Switching Protocols s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("wrong status: %s", status)
+	}
+	send(conn, wsText, `{"id":1,"cmd":"hello"}`)
+	if _, have := recv(r); !strings.HasPrefix(have, `{"id":1,"instance":`) {
+		t.Fatalf("wrong hello reply: %s", have)
+	}
+	send(conn, wsText, fmt.Sprintf(`{"id":2,"cmd":"add","path":%q}`, tmp))
+	if _, have := recv(r); have != `{"id":2}` {
+		t.Fatalf("wrong add reply: %s", have)
+	}
+
+	send(conn, wsPing, "hi")
+	if op, have := recv(r); op != wsPong || have != "hi" {
+		t.Errorf("wrong pong: %x %q", op, have)
+	}
+
+	touch(t, filepath.Join(tmp, "file"))
+	want := fmt.Sprintf(`{"seq":1,"name":%q,"op":1}`, filepath.Join(tmp, "file"))
+	if _, have := recv(r); have != want {
+		t.Errorf("\nhave: %s\nwant: %s", have, want)
+	}
+
+	send(conn, wsClose, "")
+	if op, _ := recv(r); op != wsClose {
+		t.Errorf("wrong opcode after close: %x", op)
+	}
+}
+
+func TestServerRoots(t *testing.T) {
+	tmp := t.TempDir()
+	for _, d := range []string{"allowed", "other"} {
+		if err := os.Mkdir(filepath.Join(tmp, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(tmp, "other"), filepath.Join(tmp, "allowed", "link")); err != nil {
+		t.Fatal(err)
+	}
+	_, l := newServer(t, WithRoots(filepath.Join(tmp, "allowed")))
+
+	c, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Add(filepath.Join(tmp, "allowed")); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{
+		tmp,
+		filepath.Join(tmp, "other"),
+		filepath.Join(tmp, "allowed", "..", "other"),
+		filepath.Join(tmp, "allowed", "link"),
+		filepath.Join(tmp, "allowed") + "2",
+	} {
+		if err := c.Add(p); !errors.Is(err, ErrNotAllowed) {
+			t.Errorf("wrong error for Add(%q): %v", p, err)
+		}
+	}
+	if have := c.WatchList(); len(have) != 1 {
+		t.Errorf("WatchList: %q", have)
+	}
+}
+
+func TestServerRefs(t *testing.T) {
+	tmp := t.TempDir()
+	_, l := newServer(t)
+
+	dial := func() *Client {
+		t.Helper()
+		c, err := Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	c1, c2 := dial(), dial()
+	if err := c1.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := c2.Add(tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Still used by c2.
+	if err := c1.Remove(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := c1.Remove(tmp); !errors.Is(err, fsnotify.ErrNonExistentWatch) {
+		t.Errorf("wrong error for second Remove: %v", err)
+	}
+	touch(t, filepath.Join(tmp, "file"))
+	wantEvent(t, c2, fsnotify.Event{Name: filepath.Join(tmp, "file"), Op: fsnotify.Create})
+
+	// A client that didn't add it can't remove it.
+	c3 := dial()
+	if err := c3.Remove(tmp); !errors.Is(err, fsnotify.ErrNonExistentWatch) {
+		t.Errorf("wrong error for Remove from other client: %v", err)
+	}
+
+	if err := c2.Remove(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if have := c2.WatchList(); len(have) != 0 {
+		t.Errorf("WatchList: %q", have)
+	}
+}
@@ -0,0 +1,413 @@
+package remote
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/esvos/fsnotify"
+)
+
+// ErrServerClosed is returned by Serve() and ServeConn() after Close().
+var ErrServerClosed = errors.New("fsnotify/remote: server closed")
+
+// ErrNotAllowed is returned to clients that add a path outside the roots set
+// with [WithRoots].
+var ErrNotAllowed = errors.New("fsnotify/remote: path not allowed")
+
+// Number of events to keep for clients that reconnect, if NewServer() is called
+// with a backlog of 0.
+const defaultBacklog = 10000
+
+// Server exposes a Watcher to remote clients.
+type Server struct {
+	w        *fsnotify.Watcher
+	backlog  int
+	instance string   // Random ID for this server, to detect restarts.
+	roots    []string // Only allow adding paths in these; all paths if empty.
+
+	// Clients that added a path, so it's only removed from the Watcher once
+	// the last of them removes it.
+	refMu sync.Mutex
+	refs  map[string]map[string]struct{}
+
+	mu     sync.Mutex
+	seq    uint64        // Sequence number of the last event.
+	events []message     // Recent events, ending with seq.
+	notify chan struct{} // Closed (and replaced) on new events.
+	lns    map[net.Listener]struct{}
+	conns  map[net.Conn]struct{}
+	done   chan struct{}
+}
+
+// ServerOpt is an option for [NewServer].
+type ServerOpt func(*Server)
+
+// WithRoots only lets clients add paths inside one of the roots, or the roots
+// themselves. Symlinks are resolved before checking, and adding other paths
+// fails with [ErrNotAllowed].
+//
+// The default is to let clients add any path the server can read.
+func WithRoots(roots ...string) ServerOpt {
+	return func(s *Server) {
+		for _, r := range roots {
+			s.roots = append(s.roots, resolve(r))
+		}
+	}
+}
+
+// NewServer creates a new server for w.
+//
+// The server reads from w.Events and w.Errors, so nothing else should. At least
+// the last backlog events are kept for clients that reconnect; the default is
+// 10,000 if it's 0.
+//
+// Paths are only removed from w once every client that added them removed them
+// again. Paths added to w directly aren't tracked: a client that adds and
+// removes such a path also removes it from w.
+//
+// Close() doesn't close w, so that it can be used with a new server; close the
+// server first.
+func NewServer(w *fsnotify.Watcher, backlog int, opts ...ServerOpt) *Server {
+	if backlog <= 0 {
+		backlog = defaultBacklog
+	}
+	s := &Server{
+		w:        w,
+		backlog:  backlog,
+		instance: randomID(),
+		refs:     make(map[string]map[string]struct{}),
+		notify:   make(chan struct{}),
+		lns:      make(map[net.Listener]struct{}),
+		conns:    make(map[net.Conn]struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	go s.readEvents()
+	return s
+}
+
+func randomID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// resolve makes path absolute and resolves symlinks, if it exists.
+func resolve(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	return filepath.Clean(path)
+}
+
+// allowed checks if path is inside one of the roots.
+func (s *Server) allowed(path string) error {
+	if len(s.roots) == 0 {
+		return nil
+	}
+	real := resolve(path)
+	for _, r := range s.roots {
+		// Clean() only leaves a trailing separator for the filesystem root.
+		if real == r || strings.HasPrefix(real, strings.TrimSuffix(r, string(filepath.Separator))+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrNotAllowed, path)
+}
+
+// add path to the watcher for client.
+func (s *Server) add(client, path string) error {
+	if err := s.allowed(path); err != nil {
+		return err
+	}
+	s.refMu.Lock()
+	defer s.refMu.Unlock()
+	if err := s.w.Add(path); err != nil {
+		return err
+	}
+	key := filepath.Clean(path)
+	if s.refs[key] == nil {
+		s.refs[key] = make(map[string]struct{})
+	}
+	s.refs[key][client] = struct{}{}
+	return nil
+}
+
+// remove path for client, and from the watcher if no other client uses it.
+func (s *Server) remove(client, path string) error {
+	s.refMu.Lock()
+	defer s.refMu.Unlock()
+	key := filepath.Clean(path)
+	if _, ok := s.refs[key][client]; !ok {
+		return fmt.Errorf("%w: %s", fsnotify.ErrNonExistentWatch, path)
+	}
+	delete(s.refs[key], client)
+	if len(s.refs[key]) > 0 {
+		return nil
+	}
+	delete(s.refs, key)
+	return s.w.Remove(path)
+}
+
+func (s *Server) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes all listeners and connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed() {
+		return nil
+	}
+	close(s.done)
+	for l := range s.lns {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+// Serve accepts connections on l, and serves them. This blocks until l is
+// closed or Close() is called.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.isClosed() {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.lns[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.lns, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single connection. This blocks until the client
+// disconnects or Close() is called, and always closes conn.
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+
+	s.mu.Lock()
+	if s.isClosed() {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	var (
+		dec   = json.NewDecoder(conn)
+		c     = &serverConn{enc: json.NewEncoder(conn)}
+		hello message
+	)
+	if err := dec.Decode(&hello); err != nil {
+		return err
+	}
+	if hello.Cmd != "hello" {
+		return fmt.Errorf("fsnotify/remote: expected hello, got %q", hello.Cmd)
+	}
+
+	// Clients that don't send an ID can only remove the paths they added
+	// over this connection.
+	client := hello.Client
+	if client == "" {
+		client = randomID()
+	}
+
+	// Server was restarted: add the client's paths again, and tell the client
+	// it may have missed events.
+	var errs []message
+	if hello.Instance != "" && hello.Instance != s.instance {
+		errs = append(errs, errorMessage(fsnotify.ErrEventOverflow))
+		for _, p := range hello.Paths {
+			if err := s.add(client, p); err != nil {
+				errs = append(errs, errorMessage(err))
+			}
+		}
+	}
+
+	s.mu.Lock()
+	last := s.seq
+	if hello.Instance == s.instance && hello.Since < s.seq {
+		last = hello.Since
+	}
+	s.mu.Unlock()
+
+	if err := c.send(message{ID: hello.ID, Instance: s.instance, Seq: last}); err != nil {
+		return err
+	}
+	for _, m := range errs {
+		if err := c.send(m); err != nil {
+			return err
+		}
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		if err := s.stream(c.send, last, stop); err != nil {
+			conn.Close() // Make sure ServeConn() stops.
+		}
+	}()
+
+	for {
+		var req message
+		if err := dec.Decode(&req); err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		reply := s.handle(client, req)
+		if req.ID == 0 {
+			continue
+		}
+		reply.ID = req.ID
+		if err := c.send(reply); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) handle(client string, req message) message {
+	var err error
+	switch req.Cmd {
+	case "add":
+		err = s.add(client, req.Path)
+	case "remove":
+		err = s.remove(client, req.Path)
+	case "list":
+		return message{Paths: s.w.WatchList()}
+	default:
+		err = fmt.Errorf("fsnotify/remote: unknown command %q", req.Cmd)
+	}
+	if err != nil {
+		return message{Error: err.Error(), Kind: errorKind(err)}
+	}
+	return message{}
+}
+
+// stream sends all events after last, until stop is closed, the server is
+// closed, or send fails.
+func (s *Server) stream(send func(message) error, last uint64, stop <-chan struct{}) error {
+	for {
+		s.mu.Lock()
+		var (
+			oldest   = s.seq - uint64(len(s.events)) // Last event that's gone.
+			notify   = s.notify
+			overflow = last < oldest
+		)
+		if overflow {
+			last = oldest
+		}
+		msgs := make([]message, s.seq-last)
+		copy(msgs, s.events[last-oldest:])
+		last = s.seq
+		s.mu.Unlock()
+
+		if overflow {
+			msgs = append([]message{errorMessage(fsnotify.ErrEventOverflow)}, msgs...)
+		}
+		for _, m := range msgs {
+			if err := send(m); err != nil {
+				return err
+			}
+		}
+		if len(msgs) == 0 {
+			select {
+			case <-stop:
+				return nil
+			case <-s.done:
+				return nil
+			case <-notify:
+			}
+		}
+	}
+}
+
+// readEvents reads all events and errors from the watcher.
+func (s *Server) readEvents() {
+	for {
+		var m message
+		select {
+		case <-s.done:
+			return
+		case e, ok := <-s.w.Events:
+			if !ok {
+				return
+			}
+			m = eventMessage(e)
+		case err, ok := <-s.w.Errors:
+			if !ok {
+				return
+			}
+			m = errorMessage(err)
+		}
+
+		s.mu.Lock()
+		s.seq++
+		m.Seq = s.seq
+		s.events = append(s.events, m)
+		if len(s.events) >= s.backlog*2 { // Don't copy on every event.
+			s.events = append([]message(nil), s.events[len(s.events)-s.backlog:]...)
+		}
+		close(s.notify)
+		s.notify = make(chan struct{})
+		s.mu.Unlock()
+	}
+}
+
+// serverConn is a connection to a client; messages are sent from both
+// ServeConn() and stream().
+type serverConn struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (c *serverConn) send(m message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.enc.Encode(m)
+}
@@ -0,0 +1,186 @@
+package remote
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/esvos/fsnotify"
+)
+
+// ServeHTTP streams the events as Server-Sent Events, so that they can be used
+// from a browser with EventSource (e.g. for live reloading):
+//
+//	id: 5f3a…:42
+//	data: {"name":"/srv/www/style.css","op":"WRITE"}
+//
+//	event: fsnotify-error
+//	data: {"error":"fsnotify: queue or buffer overflow"}
+//
+// Errors use the "fsnotify-error" event type, as "error" is used by
+// EventSource for connection errors. The Last-Event-ID header is used to send
+// the events that were missed when EventSource reconnects.
+//
+// The events can be filtered with query parameters:
+//
+//	path   Only events for this path, or paths below it; can be given more
+//	       than once.
+//	op     Only these operations, as a comma-separated list: "create,write".
+//	match  Only events where the filename matches this filepath.Match()
+//	       pattern: "*.css".
+//
+// Paths can't be added or removed with Server-Sent Events; use a WebSocket for
+// that. WebSocket requests are served with the same protocol as ServeConn(),
+// with one JSON message per text frame:
+//
+//	let ws = new WebSocket('ws://localhost:8080/fsnotify')
+//	ws.onopen = () => {
+//		ws.send(JSON.stringify({id: 1, cmd: 'hello'}))
+//		ws.send(JSON.stringify({id: 2, cmd: 'add', path: '/srv/www'}))
+//	}
+//	ws.onmessage = (m) => console.log(JSON.parse(m.data))
+//
+// The Origin of WebSocket requests must match the Host, to prevent other
+// websites from adding watches.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isWebSocket(r) {
+		s.serveWebSocket(w, r)
+		return
+	}
+
+	flush, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	f, err := parseSSEFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	last, overflow := s.seq, false
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		instance, seq := sseID(id)
+		if instance == s.instance && seq < last {
+			last = seq
+		} else if instance != s.instance {
+			overflow = true
+		}
+	}
+	s.mu.Unlock()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flush.Flush()
+
+	send := func(m message) error {
+		if !f.match(m) {
+			return nil
+		}
+		if m.Seq != 0 {
+			if _, err := fmt.Fprintf(w, "id: %s:%d\n", s.instance, m.Seq); err != nil {
+				return err
+			}
+		}
+		var (
+			data []byte
+			err  error
+		)
+		if m.Err != "" {
+			data, _ = json.Marshal(sseError{Error: m.Err, Kind: m.Kind})
+			_, err = fmt.Fprintf(w, "event: fsnotify-error\ndata: %s\n\n", data)
+		} else {
+			data, _ = json.Marshal(sseEvent{Name: m.Name, Op: m.Op.String(), Pid: m.Pid})
+			_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		flush.Flush()
+		return err
+	}
+	if overflow {
+		if send(errorMessage(fsnotify.ErrEventOverflow)) != nil {
+			return
+		}
+	}
+	s.stream(send, last, r.Context().Done())
+}
+
+type sseEvent struct {
+	Name string `json:"name"`
+	Op   string `json:"op"`
+	Pid  int    `json:"pid,omitempty"`
+}
+
+type sseError struct {
+	Error string `json:"error"`
+	Kind  string `json:"kind,omitempty"`
+}
+
+// sseID parses an event ID ("instance:seq").
+func sseID(id string) (string, uint64) {
+	i := strings.LastIndexByte(id, ':')
+	if i == -1 {
+		return "", 0
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	if err != nil {
+		return "", 0
+	}
+	return id[:i], seq
+}
+
+type sseFilter struct {
+	paths []string
+	op    fsnotify.Op
+	glob  string
+}
+
+func parseSSEFilter(q url.Values) (sseFilter, error) {
+	f := sseFilter{glob: q.Get("match")}
+	for _, p := range q["path"] {
+		f.paths = append(f.paths, filepath.Clean(p))
+	}
+	if _, err := filepath.Match(f.glob, ""); err != nil {
+		return f, fmt.Errorf("invalid match %q: %w", f.glob, err)
+	}
+	for _, o := range q["op"] {
+		for _, name := range strings.Split(o, ",") {
+			op, err := fsnotify.ParseOp(strings.TrimSpace(name))
+			if err != nil {
+				return f, err
+			}
+			f.op |= op
+		}
+	}
+	return f, nil
+}
+
+func (f sseFilter) match(m message) bool {
+	if m.Err != "" {
+		return true
+	}
+	if f.op != 0 && m.Op&f.op == 0 {
+		return false
+	}
+	if f.glob != "" {
+		if ok, _ := filepath.Match(f.glob, filepath.Base(m.Name)); !ok {
+			return false
+		}
+	}
+	if len(f.paths) == 0 {
+		return true
+	}
+	for _, p := range f.paths {
+		if m.Name == p || strings.HasPrefix(m.Name, strings.TrimSuffix(p, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,238 @@
+package remote
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket support (RFC 6455), for ServeHTTP(). Every message is a text frame
+// with one JSON message, using the same protocol as ServeConn().
+//
+// This only implements what's needed for the server side: the handshake, and
+// reading masked frames from the client. Extensions and subprotocols aren't
+// supported.
+
+// Opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// Maximum size of a message from the client; requests are small.
+const wsMaxMessage = 1 << 20
+
+func isWebSocket(r *http.Request) bool {
+	return headerHas(r.Header, "Connection", "upgrade") && headerHas(r.Header, "Upgrade", "websocket")
+}
+
+// headerHas reports if the comma-separated header contains token.
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h[name] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveWebSocket does the WebSocket handshake, and serves the connection with
+// ServeConn().
+//
+// The Origin must match the Host, as browsers allow WebSocket connections to
+// any site; otherwise any website could add watches.
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "invalid WebSocket handshake", http.StatusBadRequest)
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Host, r.Host) {
+			http.Error(w, "cross-origin WebSocket not allowed", http.StatusForbidden)
+			return
+		}
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(h[:]))
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	s.ServeConn(&wsConn{Conn: conn, r: brw.Reader})
+}
+
+// wsConn reads and writes WebSocket messages. Read() returns the payload of
+// the data frames, and every Write() is sent as a single text frame.
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	remain int64 // Bytes left in the current frame.
+	mask   [4]byte
+	maskAt int
+	msgLen int64 // Size of the current message.
+
+	wmu    sync.Mutex
+	closed bool
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remain == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remain {
+		p = p[:c.remain]
+	}
+	n, err := c.r.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= c.mask[c.maskAt%4]
+		c.maskAt++
+	}
+	c.remain -= int64(n)
+	return n, err
+}
+
+// nextFrame reads the next frame header, and handles control frames.
+func (c *wsConn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return err
+	}
+	var (
+		fin    = hdr[0]&0x80 != 0
+		opcode = hdr[0] & 0x0f
+		masked = hdr[1]&0x80 != 0
+		size   = int64(hdr[1] & 0x7f)
+	)
+	if !masked {
+		return errors.New("fsnotify/remote: unmasked WebSocket frame from client")
+	}
+	switch size {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return err
+		}
+		size = int64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return err
+		}
+		size = int64(binary.BigEndian.Uint64(b[:]) & (1<<63 - 1))
+	}
+	if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+		return err
+	}
+	c.maskAt = 0
+
+	switch opcode {
+	case wsText, wsBinary, wsContinuation:
+		if opcode != wsContinuation {
+			c.msgLen = 0
+		}
+		if c.msgLen += size; c.msgLen > wsMaxMessage {
+			return errors.New("fsnotify/remote: WebSocket message too large")
+		}
+		c.remain = size
+		return nil
+	case wsClose, wsPing, wsPong:
+		if !fin || size > 125 {
+			return errors.New("fsnotify/remote: invalid WebSocket control frame")
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= c.mask[i%4]
+		}
+		switch opcode {
+		case wsClose:
+			c.writeFrame(wsClose, payload)
+			return io.EOF
+		case wsPing:
+			return c.writeFrame(wsPong, payload)
+		}
+		return nil
+	default:
+		return fmt.Errorf("fsnotify/remote: unknown WebSocket opcode 0x%x", opcode)
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsText, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, p []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	hdr := make([]byte, 2, 10+len(p))
+	hdr[0] = 0x80 | opcode
+	switch {
+	case len(p) < 126:
+		hdr[1] = byte(len(p))
+	case len(p) <= 0xffff:
+		hdr[1] = 126
+		hdr = append(hdr, byte(len(p)>>8), byte(len(p)))
+	default:
+		hdr[1] = 127
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(len(p)))
+		hdr = append(hdr, b[:]...)
+	}
+	_, err := c.Conn.Write(append(hdr, p...))
+	if opcode == wsClose {
+		c.closed = true
+	}
+	return err
+}
+
+func (c *wsConn) Close() error {
+	// Don't wait forever if a write is blocked on a client that's not reading.
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrame(wsClose, nil)
+	return c.Conn.Close()
+}
@@ -0,0 +1,58 @@
+package fsnotify
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/esvos/fsnotify/internal"
+)
+
+// Time to wait before the first retry with WithRetry(); this is doubled after
+// every retry, up to retryMax.
+var (
+	retryMin = 10 * time.Millisecond
+	retryMax = time.Second
+)
+
+// transient reports if adding a watch may succeed when tried again after
+// failing with err.
+func transient(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, internal.ErrAgain) ||
+		errors.Is(err, internal.ErrSharingViolation)
+}
+
+// retry calls add until it succeeds, fails with an error that's not transient,
+// or window has passed.
+func retry(window time.Duration, path string, add func() error) error {
+	var (
+		deadline = time.Now().Add(window)
+		wait     = retryMin
+	)
+	for {
+		err := add()
+		if err == nil || !transient(err) {
+			return err
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return err
+		}
+		if wait > left {
+			wait = left
+		}
+		if debug {
+			fmt.Fprintf(os.Stderr, "FSNOTIFY_DEBUG: %s  retrying Add(%q) in %s: %s\n",
+				time.Now().Format("15:04:05.000000000"), path, wait, err)
+		}
+		time.Sleep(wait)
+		if wait *= 2; wait > retryMax {
+			wait = retryMax
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package fsnotify
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+)
+
+func TestWithRetry(t *testing.T) {
+	t.Parallel()
+
+	t.Run("created later", func(t *testing.T) {
+		t.Parallel()
+		tmp := t.TempDir()
+		w := newWatcher(t)
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			touch(t, tmp, "file")
+		}()
+		if err := w.AddWith(join(tmp, "file"), WithRetry(5*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		t.Parallel()
+		tmp := t.TempDir()
+		w := newWatcher(t)
+
+		start := time.Now()
+		err := w.AddWith(join(tmp, "file"), WithRetry(100*time.Millisecond))
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("wrong error: %v", err)
+		}
+		if took := time.Since(start); took < 100*time.Millisecond || took > time.Second {
+			t.Errorf("took %s", took)
+		}
+	})
+
+	t.Run("not transient", func(t *testing.T) {
+		t.Parallel()
+		tmp := t.TempDir()
+		w := newWatcher(t)
+		w.Close()
+
+		start := time.Now()
+		err := w.AddWith(tmp, WithRetry(time.Second))
+		if !errors.Is(err, ErrClosed) {
+			t.Fatalf("wrong error: %v", err)
+		}
+		if took := time.Since(start); took > 100*time.Millisecond {
+			t.Errorf("took %s", took)
+		}
+	})
+}
@@ -0,0 +1,293 @@
+package fsnotify
+
+import (
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// How long to wait for more writes before computing the checksum.
+var checksumDelay = 100 * time.Millisecond
+
+// settler sits between the backend and the Events channel for WithChecksum()
+// and WithSettled(): Write events are held until there are no more writes to
+// the file for a while (or until UnportableCloseWrite), and are then sent as a
+// single event.
+type settler struct {
+	newHash    func() hash.Hash // Only with WithChecksum().
+	quiet      time.Duration
+	settled    bool // WithSettled(): don't send UnportableCloseWrite events.
+	closeWrite bool // Wait for UnportableCloseWrite instead of quiet.
+	clock      Clock
+	b          backend // For wrapError().
+
+	inEv   chan Event // From the backend.
+	inErr  chan error
+	outEv  chan Event // To the user.
+	outErr chan error
+
+	pending map[string]*settlePending
+	order   []string // Pending paths, oldest first.
+
+	memLimit  int // WithMemoryLimit()
+	memPolicy MemoryPolicy
+	memUsed   int  // Approximate bytes used by pending.
+	memFull   bool // MemoryLimitError was sent; reset once nothing is pending.
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+type settlePending struct {
+	e    Event
+	at   time.Time // Time of the last write.
+	size int64     // Size at the last write or check, or -1.
+	mem  int       // Approximate bytes used.
+}
+
+func newSettler(with watcherOpts, ev chan Event, errs chan error) *settler {
+	s := &settler{
+		newHash: with.checksum,
+		quiet:   checksumDelay,
+		settled: with.settled,
+		clock:   with.clock,
+		inEv:    make(chan Event),
+		inErr:   make(chan error),
+		outEv:   ev,
+		outErr:  errs,
+		pending: make(map[string]*settlePending),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+
+		memLimit:  with.memLimit,
+		memPolicy: with.memPolicy,
+	}
+	if with.settled && with.settleQuiet > 0 {
+		s.quiet = with.settleQuiet
+	}
+	return s
+}
+
+// close stops sending events; the pending writes are dropped.
+func (s *settler) close() {
+	s.closeOnce.Do(func() { close(s.closing) })
+}
+
+// Returns true if the event was sent, or false if watcher is closed.
+func (s *settler) sendEvent(e Event) bool {
+	select {
+	case <-s.closing:
+		return false
+	case s.outEv <- e:
+		return true
+	}
+}
+
+func (s *settler) run() {
+	defer func() {
+		close(s.done)
+		close(s.outErr)
+		close(s.outEv)
+	}()
+
+	t := s.clock.NewTimer(time.Hour)
+	stopTimer(t)
+	inEv, inErr := s.inEv, s.inErr
+	for inEv != nil || inErr != nil {
+		select {
+		case <-s.closing:
+			return
+		case err, ok := <-inErr:
+			if !ok {
+				inErr = nil
+				continue
+			}
+			select {
+			case <-s.closing:
+				return
+			case s.outErr <- err:
+			}
+		case e, ok := <-inEv:
+			if !ok {
+				inEv = nil
+				continue
+			}
+			if !s.event(e) {
+				return
+			}
+		case <-t.C():
+			if !s.flush(s.clock.Now().Add(-s.quiet)) {
+				return
+			}
+		}
+
+		stopTimer(t)
+		if !s.closeWrite && len(s.order) > 0 {
+			t.Reset(s.pending[s.order[0]].at.Add(s.quiet).Sub(s.clock.Now()))
+		}
+	}
+}
+
+func (s *settler) event(e Event) bool {
+	p, ok := s.pending[e.Name]
+
+	switch {
+	case e.Has(Write) && e.Op&^(Write|UnportableExtend|UnportableTruncate) == 0:
+		if ok {
+			p.e.Op |= e.Op
+			p.e.Info, p.e.Pid = e.Info, e.Pid
+			s.remove(e.Name)
+		} else {
+			p = &settlePending{e: e, mem: eventSize(e) + int(unsafe.Sizeof(settlePending{}))}
+			s.pending[e.Name] = p
+			s.memUsed += p.mem
+		}
+		p.at, p.size = s.clock.Now(), s.size(e.Name)
+		s.order = append(s.order, e.Name)
+		return s.limit()
+	case e.Has(UnportableCloseWrite):
+		if s.settled {
+			// Closed without writing, or the Write was already sent.
+			if !ok {
+				return true
+			}
+			return s.send(e.Name)
+		}
+		if ok {
+			e.Op |= p.e.Op
+			s.take(e.Name)
+		}
+		e.Checksum = s.checksum(e.Name)
+		return s.sendEvent(e)
+	default:
+		// Send the pending write first, to keep the order.
+		if ok && !s.send(e.Name) {
+			return false
+		}
+		return s.sendEvent(e)
+	}
+}
+
+// flush sends all pending writes from before t.
+//
+// Writes to files that changed size since the last write are delayed again, as
+// the file is probably still being written (e.g. a slow copy that doesn't
+// trigger events for every write).
+func (s *settler) flush(t time.Time) bool {
+	for len(s.order) > 0 && !s.pending[s.order[0]].at.After(t) {
+		path := s.order[0]
+		if p := s.pending[path]; s.settled {
+			if size := s.size(path); size != p.size {
+				p.at, p.size = s.clock.Now(), size
+				s.order = append(s.order[1:], path)
+				continue
+			}
+		}
+		if !s.send(path) {
+			return false
+		}
+	}
+	return true
+}
+
+// send the pending write for path.
+func (s *settler) send(path string) bool {
+	p := s.take(path)
+	if s.newHash != nil {
+		p.e.Checksum = s.checksum(path)
+	}
+	return s.sendEvent(p.e)
+}
+
+func (s *settler) remove(path string) {
+	for i, p := range s.order {
+		if p == path {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// take removes the pending write for path.
+func (s *settler) take(path string) *settlePending {
+	p := s.pending[path]
+	delete(s.pending, path)
+	s.remove(path)
+	s.memUsed -= p.mem
+	if len(s.pending) == 0 {
+		s.memFull = false
+	}
+	return p
+}
+
+// limit sends (with MemoryBlock) or drops (with MemoryDrop) the oldest pending
+// writes until the memory used is within the limit set with WithMemoryLimit().
+func (s *settler) limit() bool {
+	if s.memLimit <= 0 || s.memUsed <= s.memLimit {
+		return true
+	}
+	var (
+		report  = !s.memFull
+		dropped int
+	)
+	s.memFull = true
+	for s.memUsed > s.memLimit && len(s.order) > 0 {
+		if s.memPolicy == MemoryDrop {
+			s.take(s.order[0])
+			dropped++
+			continue
+		}
+		if !s.send(s.order[0]) {
+			return false
+		}
+	}
+	if !report {
+		return true
+	}
+	if len(s.pending) > 0 {
+		s.memFull = true
+	}
+	select {
+	case <-s.closing:
+		return false
+	case s.outErr <- wrapError(s.b, "watch", "", &MemoryLimitError{Limit: s.memLimit, Policy: s.memPolicy, Dropped: dropped}):
+		return true
+	}
+}
+
+// size gets the size of path, or -1 if it can't be read.
+func (s *settler) size(path string) int64 {
+	if !s.settled {
+		return -1
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return -1
+	}
+	return st.Size()
+}
+
+// checksum gets the checksum of the file at path, or nil if it's not a regular
+// file or can't be read.
+func (s *settler) checksum(path string) []byte {
+	if s.newHash == nil {
+		return nil
+	}
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer fp.Close()
+	if st, err := fp.Stat(); err != nil || !st.Mode().IsRegular() {
+		return nil
+	}
+	h := s.newHash()
+	if _, err := io.Copy(h, fp); err != nil {
+		return nil
+	}
+	return h.Sum(nil)
+}
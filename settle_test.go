@@ -0,0 +1,187 @@
+package fsnotify
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestWithChecksum(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w, err := NewWatcherWith(WithChecksum(sha256.New))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	addWatch(t, w, tmp)
+
+	// Writes in quick succession are merged.
+	fp, err := os.Create(join(tmp, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"hello", " ", "world"} {
+		if _, err := fp.WriteString(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvents()
+
+	// Same content.
+	if err := os.WriteFile(join(tmp, "file"), []byte("hello world"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvents()
+	rm(t, tmp, "file")
+
+	have := c.stop(t)
+	cmpEvents(t, tmp, have, newEvents(t, `
+		create  /file
+		write   /file
+		write   /file
+		remove  /file
+	`))
+	if len(have) != 4 {
+		return
+	}
+
+	want := sha256.Sum256([]byte("hello world"))
+	for i, e := range have {
+		switch e.Op {
+		case Write:
+			if !bytes.Equal(e.Checksum, want[:]) {
+				t.Errorf("event %d: wrong checksum\nhave: %x\nwant: %x", i, e.Checksum, want)
+			}
+		default:
+			if e.Checksum != nil {
+				t.Errorf("event %d: checksum set for %s", i, e)
+			}
+		}
+	}
+}
+
+func TestWithSettled(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	w, err := NewWatcherWith(WithSettled(200 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &eventCollector{w: w, done: make(chan struct{}), e: make(Events, 0, 8)}
+	c.collect(t)
+	addWatch(t, w, tmp)
+
+	fp, err := os.Create(join(tmp, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"hello", " ", "world"} {
+		if _, err := fp.WriteString(s); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvents()
+
+	// Opening and closing without writing doesn't send anything.
+	fp, err = os.OpenFile(join(tmp, "file"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitForEvents()
+
+	// Pending write is sent before the remove.
+	echoAppend(t, "data", tmp, "file")
+	rm(t, tmp, "file")
+
+	cmpEvents(t, tmp, c.stop(t), newEvents(t, `
+		create  /file
+		write   /file
+		write   /file
+		remove  /file
+	`))
+}
+
+// The file size is checked if there's no UnportableCloseWrite.
+func TestSettlerSize(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	path := join(tmp, "file")
+	touch(t, path)
+
+	ev := make(chan Event, 8)
+	s := newSettler(watcherOpts{settled: true, clock: realClock{}}, ev, make(chan error))
+	defer s.close()
+
+	s.event(Event{Name: path, Op: Write})
+	echoAppend(t, "data", path)
+	if !s.flush(time.Now()) || len(ev) != 0 {
+		t.Fatalf("sent event while size changed")
+	}
+	if !s.flush(time.Now()) || len(ev) != 1 {
+		t.Fatalf("didn't send event after size was stable")
+	}
+	if e := <-ev; e.Name != path || e.Op != Write {
+		t.Errorf("wrong event: %s", e)
+	}
+}
+
+func TestSettlerMemoryLimit(t *testing.T) {
+	t.Parallel()
+
+	one := eventSize(Event{Name: "a"}) + int(unsafe.Sizeof(settlePending{}))
+	for _, policy := range []MemoryPolicy{MemoryBlock, MemoryDrop} {
+		t.Run(policy.String(), func(t *testing.T) {
+			ev, errs := make(chan Event, 8), make(chan error, 8)
+			s := newSettler(watcherOpts{memLimit: one*2 + 1, memPolicy: policy, clock: realClock{}}, ev, errs)
+			defer s.close()
+
+			for _, name := range []string{"a", "b", "c", "d"} {
+				if !s.event(Event{Name: name, Op: Write}) {
+					t.Fatal("event returned false")
+				}
+			}
+			if len(s.pending) != 2 {
+				t.Errorf("%d pending", len(s.pending))
+			}
+			if len(errs) != 1 {
+				t.Fatalf("%d errors", len(errs))
+			}
+			var mErr *MemoryLimitError
+			if err := <-errs; !errors.As(err, &mErr) {
+				t.Fatalf("wrong error: %v", err)
+			}
+
+			var have []string
+			for len(ev) > 0 {
+				have = append(have, (<-ev).Name)
+			}
+			if policy == MemoryDrop {
+				if mErr.Dropped != 1 || len(have) != 0 {
+					t.Errorf("dropped %d; sent %q", mErr.Dropped, have)
+				}
+			} else if !reflect.DeepEqual(have, []string{"a", "b"}) {
+				t.Errorf("wrong events sent: %q", have)
+			}
+		})
+	}
+}
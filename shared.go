@@ -0,0 +1,503 @@
+package fsnotify
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Shared returns a reference to a Watcher that's shared by everything in the
+// process that uses Shared(), so that libraries that all want to watch
+// something don't each need their own inotify instance (or other kernel
+// object) and file descriptors.
+//
+// Paths are watched with [SharedWatcher.Subscribe], and every subscription
+// gets its own Events and Errors channel with only the events for that path.
+//
+// The Watcher is created on the first call, and closed when every reference
+// was closed with [SharedWatcher.Close]; the next call to Shared() creates a
+// new one. It's always created with [NewWatcher]; use [NewWatcherWith] if you
+// need options.
+func Shared() (*SharedWatcher, error) {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	if sharedHub == nil {
+		w, err := NewWatcher()
+		if err != nil {
+			return nil, err
+		}
+		sharedHub = &hub{
+			w:     w,
+			paths: make(map[string]int),
+			subs:  make(map[*Subscription]struct{}),
+			done:  make(chan struct{}),
+		}
+		go sharedHub.run()
+	}
+	sharedHub.refs++
+	return &SharedWatcher{h: sharedHub, subs: make(map[*Subscription]struct{})}, nil
+}
+
+// SharedWatcher is a reference to the shared Watcher from [Shared].
+type SharedWatcher struct {
+	h      *hub
+	subs   map[*Subscription]struct{} // Protected by sharedMu.
+	closed bool
+}
+
+// Subscription is a path watched with [SharedWatcher.Subscribe].
+type Subscription struct {
+	h       *hub
+	sw      *SharedWatcher
+	path    string // Without "/...".
+	recurse bool
+	op      Op
+
+	inEv      chan Event // From the hub.
+	inErr     chan error
+	events    chan Event // To the user.
+	errors    chan error
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// hub sends the events from the shared Watcher to the subscriptions.
+type hub struct {
+	w     *Watcher
+	addMu sync.Mutex // Held while adding or removing paths.
+	done  chan struct{}
+
+	// Protected by sharedMu.
+	refs  int
+	paths map[string]int // Number of subscriptions for every path.
+	subs  map[*Subscription]struct{}
+}
+
+var (
+	sharedMu  sync.Mutex
+	sharedHub *hub
+)
+
+// Subscribe starts watching path, which works like [Watcher.AddWith]. The
+// returned Subscription only gets the events for path (or the files in it, if
+// it's a directory).
+//
+// The same path can be subscribed to more than once, by any user of the shared
+// Watcher. The operations from [WithOps] are combined for the watch, but every
+// subscription only gets the operations it asked for. The path is removed from
+// the Watcher once the last subscription for it is closed.
+//
+// Both the Events and Errors channel must be read, as the events for all
+// subscriptions are sent from one goroutine: a subscription that doesn't read
+// its channels delays the events for all others.
+func (sw *SharedWatcher) Subscribe(path string, opts ...addOpt) (*Subscription, error) {
+	h := sw.h
+	h.addMu.Lock()
+	defer h.addMu.Unlock()
+
+	sharedMu.Lock()
+	closed := sw.closed
+	sharedMu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+
+	if err := h.w.AddWith(path, opts...); err != nil {
+		return nil, err
+	}
+	clean, recurse := recursivePath(path)
+	s := &Subscription{
+		h:       h,
+		sw:      sw,
+		path:    clean,
+		recurse: recurse,
+		op:      getOptions(opts...).op,
+		inEv:    make(chan Event),
+		inErr:   make(chan error),
+		events:  make(chan Event),
+		errors:  make(chan error),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+
+	key := clean
+	if recurse {
+		key = filepath.Join(clean, "...")
+	}
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	h.paths[key]++
+	h.subs[s] = struct{}{}
+	sw.subs[s] = struct{}{}
+	return s, nil
+}
+
+// Close closes all subscriptions made with this reference, and releases the
+// reference. The shared Watcher is closed when all references are closed.
+//
+// It's safe to call Close more than once; only the first call has an effect.
+func (sw *SharedWatcher) Close() error {
+	sw.h.addMu.Lock()
+	sharedMu.Lock()
+	if sw.closed {
+		sharedMu.Unlock()
+		sw.h.addMu.Unlock()
+		return nil
+	}
+	sw.closed = true
+	subs := make([]*Subscription, 0, len(sw.subs))
+	for s := range sw.subs {
+		subs = append(subs, s)
+	}
+	sharedMu.Unlock()
+	sw.h.addMu.Unlock()
+
+	var err error
+	for _, s := range subs {
+		if cErr := s.Close(); cErr != nil {
+			err = cErr
+		}
+	}
+
+	sharedMu.Lock()
+	sw.h.refs--
+	last := sw.h.refs == 0
+	if last && sharedHub == sw.h {
+		sharedHub = nil
+	}
+	sharedMu.Unlock()
+	if last {
+		if cErr := sw.h.w.Close(); cErr != nil {
+			err = cErr
+		}
+		<-sw.h.done
+	}
+	return err
+}
+
+// Events sends the events for the path; see [Watcher.Events].
+func (s *Subscription) Events() <-chan Event { return s.events }
+
+// Errors sends the errors for the path, and errors that aren't for any path;
+// see [Watcher.Errors].
+func (s *Subscription) Errors() <-chan error { return s.errors }
+
+// Close stops the subscription, and closes the Events and Errors channels. The
+// path is removed from the shared Watcher if there are no other subscriptions
+// for it, and otherwise the operations that only this subscription asked for
+// are removed with [Watcher.RemoveOps] (which not every backend can do).
+//
+// It's safe to call Close more than once; only the first call has an effect.
+func (s *Subscription) Close() error {
+	closed := false
+	s.closeOnce.Do(func() { close(s.closing); closed = true })
+	<-s.done
+	if !closed {
+		return nil
+	}
+
+	h := s.h
+	h.addMu.Lock()
+	defer h.addMu.Unlock()
+	sharedMu.Lock()
+	delete(h.subs, s)
+	delete(s.sw.subs, s)
+	path := s.path
+	if s.recurse {
+		path = filepath.Join(path, "...")
+	}
+	h.paths[path]--
+	last := h.paths[path] <= 0
+	if last {
+		delete(h.paths, path)
+	}
+	var rest Op // Operations of the other subscriptions for the path.
+	for o := range h.subs {
+		if o.path == s.path && o.recurse == s.recurse {
+			rest |= o.op
+		}
+	}
+	sharedMu.Unlock()
+
+	var err error
+	switch {
+	case last:
+		err = h.w.Remove(path)
+	case s.op&^rest != 0 && rest != 0 && !s.recurse:
+		err = h.w.RemoveOps(s.path, s.op&^rest)
+	}
+	if err != nil && !errors.Is(err, ErrNonExistentWatch) && !errors.Is(err, ErrClosed) && !errors.Is(err, xErrUnsupported) {
+		return err
+	}
+	return nil
+}
+
+// match reports if name is the path or in it.
+func (s *Subscription) match(name string) bool {
+	name = filepath.Clean(name)
+	if name == s.path || filepath.Dir(name) == s.path {
+		return true
+	}
+	return s.recurse && strings.HasPrefix(name, s.path+string(filepath.Separator))
+}
+
+func (s *Subscription) run() {
+	defer func() {
+		close(s.done)
+		close(s.errors)
+		close(s.events)
+	}()
+	for {
+		select {
+		case <-s.closing:
+			return
+		case err := <-s.inErr:
+			select {
+			case <-s.closing:
+				return
+			case s.errors <- err:
+			}
+		case e := <-s.inEv:
+			select {
+			case <-s.closing:
+				return
+			case s.events <- e:
+			}
+		}
+	}
+}
+
+// subscribers gets the subscriptions that match name, or all of them if name
+// is empty.
+func (h *hub) subscribers(name string) []*Subscription {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	subs := make([]*Subscription, 0, 1)
+	for s := range h.subs {
+		if name == "" || s.match(name) {
+			subs = append(subs, s)
+		}
+	}
+	return subs
+}
+
+func (h *hub) run() {
+	defer close(h.done)
+	ev, errs := h.w.Events, h.w.Errors
+	for ev != nil || errs != nil {
+		select {
+		case e, ok := <-ev:
+			if !ok {
+				ev = nil
+				continue
+			}
+			for _, s := range h.subscribers(e.Name) {
+				se := e
+				if se.Op &= s.op | Rescan | Relink | Move; se.Op == 0 {
+					continue
+				}
+				select {
+				case <-s.closing:
+				case s.inEv <- se:
+				}
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			var path string
+			if fErr := (*Error)(nil); errors.As(err, &fErr) {
+				path = fErr.Path
+			}
+			for _, s := range h.subscribers(path) {
+				select {
+				case <-s.closing:
+				case s.inErr <- err:
+				}
+			}
+		}
+	}
+}
+
+// Scope returns a Watcher that uses the shared Watcher, but can only add paths
+// in prefix (or prefix itself). Adding other paths returns [ErrOutsideScope].
+//
+// The Watcher works like any other Watcher: it has its own Events and Errors
+// channels with the events for the paths added to it, and closing it removes
+// its paths without affecting the shared Watcher or other scopes. It holds its
+// own reference to the shared Watcher, so it keeps working after sw is closed.
+//
+// Only Add, AddWith, Remove, WatchList, and Close are supported; other methods
+// return an error or the zero value, as if the backend doesn't support them.
+func (sw *SharedWatcher) Scope(prefix string) (*Watcher, error) {
+	abs, err := filepath.Abs(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	sharedMu.Lock()
+	if sw.closed {
+		sharedMu.Unlock()
+		return nil, ErrClosed
+	}
+	sw.h.refs++
+	sharedMu.Unlock()
+
+	ev, errs := make(chan Event), make(chan error)
+	s := &scope{
+		sw:     &SharedWatcher{h: sw.h, subs: make(map[*Subscription]struct{})},
+		prefix: abs,
+		ev:     ev,
+		errs:   errs,
+		subs:   make(map[string]*Subscription),
+		done:   make(chan struct{}),
+	}
+	return &Watcher{b: s, Events: ev, Errors: errs}, nil
+}
+
+// scope is the backend for the Watcher from SharedWatcher.Scope(): every path
+// is a subscription, and the events from all of them are sent to one channel.
+type scope struct {
+	sw     *SharedWatcher // Own reference, released on Close().
+	prefix string
+	ev     chan Event
+	errs   chan error
+
+	mu     sync.Mutex
+	subs   map[string]*Subscription // By path as added.
+	closed bool
+	wg     sync.WaitGroup // Running forward() goroutines.
+	done   chan struct{}  // Closed on Close().
+}
+
+func (s *scope) name() string          { return s.sw.h.w.b.name() }
+func (s *scope) xSupports(op Op) bool  { return s.sw.h.w.b.xSupports(op) }
+func (s *scope) Add(path string) error { return s.AddWith(path) }
+
+// inside reports if path is in the prefix; both are made absolute first, so
+// that "." or "" isn't mistaken for the root directory.
+func (s *scope) inside(path string) bool {
+	path, _ = recursivePath(path)
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	if filepath.Dir(s.prefix) == s.prefix { // Root directory.
+		return filepath.VolumeName(path) == filepath.VolumeName(s.prefix)
+	}
+	return path == s.prefix || strings.HasPrefix(path, s.prefix+string(filepath.Separator))
+}
+
+func (s *scope) AddWith(path string, opts ...addOpt) error {
+	if !s.inside(path) {
+		return fmt.Errorf("%w: %q isn't in %q", ErrOutsideScope, path, s.prefix)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	old := s.subs[path]
+	if old != nil { // Add the operations to the existing ones.
+		opts = append(opts, WithOps(old.op|getOptions(opts...).op))
+	}
+	sub, err := s.sw.Subscribe(path, opts...)
+	if err != nil {
+		return err
+	}
+	s.subs[path] = sub
+	s.wg.Add(1)
+	go s.forward(sub)
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+func (s *scope) Remove(path string) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	sub, ok := s.subs[path]
+	delete(s.subs, path)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, path)
+	}
+	return sub.Close()
+}
+
+func (s *scope) WatchList() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	l := make([]string, 0, len(s.subs))
+	for path := range s.subs {
+		l = append(l, path)
+	}
+	return l
+}
+
+func (s *scope) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Stats{Watches: len(s.subs)}
+}
+
+func (s *scope) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.subs = make(map[string]*Subscription)
+	close(s.done)
+	s.mu.Unlock()
+
+	err := s.sw.Close()
+	s.wg.Wait()
+	close(s.errs)
+	close(s.ev)
+	return err
+}
+
+// forward sends the events and errors from sub until it's closed.
+func (s *scope) forward(sub *Subscription) {
+	defer s.wg.Done()
+	ev, errs := sub.Events(), sub.Errors()
+	for ev != nil || errs != nil {
+		select {
+		case e, ok := <-ev:
+			if !ok {
+				ev = nil
+				continue
+			}
+			select {
+			case <-s.done:
+				return
+			case s.ev <- e:
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			select {
+			case <-s.done:
+				return
+			case s.errs <- err:
+			}
+		}
+	}
+}
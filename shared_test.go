@@ -0,0 +1,236 @@
+package fsnotify
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestShared(t *testing.T) {
+	tmp := t.TempDir()
+	mkdir(t, tmp, "a")
+	mkdir(t, tmp, "b")
+
+	sw1, err := Shared()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw2, err := Shared()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sw1.h != sw2.h {
+		t.Fatal("not the same Watcher")
+	}
+
+	subA, err := sw1.Subscribe(join(tmp, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subB, err := sw2.Subscribe(join(tmp, "b"), WithOps(Create))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subB2, err := sw2.Subscribe(join(tmp, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(s *Subscription) Event {
+		t.Helper()
+		select {
+		case e := <-s.Events():
+			return e
+		case err := <-s.Errors():
+			t.Fatal(err)
+		case <-time.After(2 * time.Second):
+			t.Fatal("no event")
+		}
+		return Event{}
+	}
+
+	touch(t, tmp, "a", "file")
+	if e := read(subA); e.Name != join(tmp, "a", "file") || e.Op != Create {
+		t.Errorf("wrong event for a: %s", e)
+	}
+
+	echoAppend(t, "data", tmp, "b", "file")
+	if e := read(subB); e.Name != join(tmp, "b", "file") || e.Op != Create {
+		t.Errorf("wrong event for b: %s", e)
+	}
+	if e := read(subB2); e.Name != join(tmp, "b", "file") || e.Op != Create {
+		t.Errorf("wrong event for b: %s", e)
+	}
+	if e := read(subB2); e.Name != join(tmp, "b", "file") || e.Op != Write {
+		t.Errorf("wrong event for b: %s", e)
+	}
+
+	// Still watched for subB2.
+	if err := subB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-subB.Events(); ok {
+		t.Error("Events not closed")
+	}
+	if have := sw1.h.w.WatchList(); len(have) != 2 {
+		t.Errorf("wrong WatchList: %q", have)
+	}
+
+	if err := sw1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if have := sw2.h.w.WatchList(); len(have) != 1 || have[0] != join(tmp, "b") {
+		t.Errorf("wrong WatchList: %q", have)
+	}
+	if _, err := sw1.Subscribe(join(tmp, "a")); err != ErrClosed {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	h := sw2.h
+	if err := sw2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if have := h.w.WatchList(); have != nil {
+		t.Errorf("Watcher not closed: %q", have)
+	}
+
+	sw3, err := Shared()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sw3.Close()
+	if sw3.h == h {
+		t.Error("closed Watcher was re-used")
+	}
+}
+
+func TestSharedScope(t *testing.T) {
+	tmp := t.TempDir()
+	mkdir(t, tmp, "a")
+	mkdir(t, tmp, "b")
+
+	sw, err := Shared()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sw.Close()
+
+	scopeA, err := sw.Scope(join(tmp, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scopeB, err := sw.Scope(join(tmp, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer scopeB.Close()
+
+	if err := scopeA.Add(join(tmp, "b")); !errors.Is(err, ErrOutsideScope) {
+		t.Errorf("wrong error: %v", err)
+	}
+	if err := scopeA.Add(join(tmp, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := scopeB.Add(join(tmp, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if have := scopeA.WatchList(); len(have) != 1 || have[0] != join(tmp, "a") {
+		t.Errorf("wrong WatchList: %q", have)
+	}
+
+	touch(t, tmp, "b", "file")
+	touch(t, tmp, "a", "file")
+	select {
+	case e := <-scopeA.Events:
+		if e.Name != join(tmp, "a", "file") {
+			t.Errorf("wrong event: %s", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event")
+	}
+	select {
+	case e := <-scopeB.Events:
+		if e.Name != join(tmp, "b", "file") {
+			t.Errorf("wrong event: %s", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event")
+	}
+
+	if _, err := scopeA.Clone(); !errors.Is(err, xErrUnsupported) {
+		t.Errorf("wrong error for Clone: %v", err)
+	}
+
+	if err := scopeA.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-scopeA.Events; ok {
+		t.Error("Events not closed")
+	}
+	if have := sw.h.w.WatchList(); len(have) != 1 || have[0] != join(tmp, "b") {
+		t.Errorf("wrong WatchList for the shared Watcher: %q", have)
+	}
+}
+
+func TestSharedScopeRelative(t *testing.T) {
+	tmp := t.TempDir()
+
+	sw, err := Shared()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sw.Close()
+
+	for _, prefix := range []string{".", ""} {
+		t.Run(prefix, func(t *testing.T) {
+			s, err := sw.Scope(prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			if err := s.Add(tmp); !errors.Is(err, ErrOutsideScope) {
+				t.Errorf("wrong error for Add(%q): %v", tmp, err)
+			}
+			if err := s.Add(".."); !errors.Is(err, ErrOutsideScope) {
+				t.Errorf("wrong error for Add(\"..\"): %v", err)
+			}
+			if err := s.Add("testdata"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSharedCloseOps(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only inotify can remove Create or Write")
+	}
+	tmp := t.TempDir()
+
+	sw, err := Shared()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sw.Close()
+
+	subC, err := sw.Subscribe(tmp, WithOps(Create))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subC.Close()
+	subW, err := sw.Subscribe(tmp, WithOps(Write))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := sw.h.w.WatchOps(tmp); have != Create|Write {
+		t.Errorf("wrong ops: %s", have)
+	}
+	if err := subW.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if have := sw.h.w.WatchOps(tmp); have != Create {
+		t.Errorf("wrong ops after Close: %s", have)
+	}
+}
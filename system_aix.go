@@ -0,0 +1,22 @@
+//go:build aix
+
+package fsnotify
+
+import "golang.org/x/sys/unix"
+
+// Names for the gfs types in f_vfstype, from <sys/vmount.h>.
+var vfsTypes = map[int32]string{
+	0: "jfs2", 1: "namefs", 2: "nfs", 3: "jfs", 5: "cdrfs", 6: "procfs",
+	16: "sfs", 17: "cachefs", 18: "nfs3", 19: "autofs", 20: "poolfs",
+	32: "vxfs", 33: "vxodm", 34: "udfs", 35: "nfs4", 36: "rfs4", 37: "cifs",
+	38: "pmemfs", 39: "ahafs", 41: "stnfs", 42: "asmfs",
+}
+
+// fsTypeName gets the filesystem type name for path.
+func fsTypeName(path string) string {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return ""
+	}
+	return vfsTypes[st.Vfstype]
+}
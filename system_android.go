@@ -0,0 +1,11 @@
+//go:build android
+
+package fsnotify
+
+func init() {
+	// sdcardfs is used for /sdcard (and /storage/emulated) on Android 8 to 10;
+	// newer versions use FUSE. Both only send events for changes made through
+	// the same view of the storage, so changes by other apps aren't seen.
+	filesystems[0x5dca2df5] = "sdcardfs"
+	pollFilesystems["sdcardfs"] = true
+}
@@ -5,3 +5,14 @@ package fsnotify
 import "golang.org/x/sys/unix"
 
 const openMode = unix.O_NONBLOCK | unix.O_RDONLY | unix.O_CLOEXEC
+
+// raiseNofile raises the soft RLIMIT_NOFILE to the hard limit. Returns true if
+// the limit was raised.
+func raiseNofile() bool {
+	var l unix.Rlimit
+	if unix.Getrlimit(unix.RLIMIT_NOFILE, &l) != nil || l.Cur >= l.Max {
+		return false
+	}
+	l.Cur = l.Max
+	return unix.Setrlimit(unix.RLIMIT_NOFILE, &l) == nil
+}
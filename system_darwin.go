@@ -6,3 +6,35 @@ import "golang.org/x/sys/unix"
 
 // note: this constant is not defined on BSD
 const openMode = unix.O_EVTONLY | unix.O_CLOEXEC
+
+// ACLs aren't stored as extended attributes that can be read, so UnportableACL
+// isn't supported.
+var aclXattrs []string
+
+// raiseNofile raises the soft RLIMIT_NOFILE to the hard limit, but no more than
+// kern.maxfilesperproc as setrlimit() fails otherwise. Returns true if the
+// limit was raised.
+func raiseNofile() bool {
+	var l unix.Rlimit
+	if unix.Getrlimit(unix.RLIMIT_NOFILE, &l) != nil {
+		return false
+	}
+	max := l.Max
+	if n, err := unix.SysctlUint32("kern.maxfilesperproc"); err == nil && uint64(n) < max {
+		max = uint64(n)
+	}
+	if l.Cur >= max {
+		return false
+	}
+	l.Cur = max
+	return unix.Setrlimit(unix.RLIMIT_NOFILE, &l) == nil
+}
+
+// fsTypeName gets the filesystem type name (f_fstypename) for path.
+func fsTypeName(path string) string {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return ""
+	}
+	return unix.ByteSliceToString(st.Fstypename[:])
+}
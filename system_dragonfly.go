@@ -0,0 +1,14 @@
+//go:build dragonfly
+
+package fsnotify
+
+import "golang.org/x/sys/unix"
+
+// fsTypeName gets the filesystem type name (f_fstypename) for path.
+func fsTypeName(path string) string {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return ""
+	}
+	return unix.ByteSliceToString(st.Fstypename[:])
+}
@@ -0,0 +1,19 @@
+//go:build freebsd
+
+package fsnotify
+
+import "golang.org/x/sys/unix"
+
+func init() {
+	noteOpen, noteRead = unix.NOTE_OPEN, unix.NOTE_READ
+	noteCloseWrite, noteCloseRead = unix.NOTE_CLOSE_WRITE, unix.NOTE_CLOSE
+}
+
+// fsTypeName gets the filesystem type name (f_fstypename) for path.
+func fsTypeName(path string) string {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return ""
+	}
+	return unix.ByteSliceToString(st.Fstypename[:])
+}
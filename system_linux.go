@@ -0,0 +1,92 @@
+//go:build linux
+
+package fsnotify
+
+import "golang.org/x/sys/unix"
+
+// Mode to open files with for AddAt(); inotify only needs the file descriptor
+// to refer to the file.
+const openMode = unix.O_PATH | unix.O_CLOEXEC
+
+// Extended attributes the POSIX ACL is stored in, for UnportableACL.
+var aclXattrs = []string{"system.posix_acl_access", "system.posix_acl_default"}
+
+// Names for the statfs(2) magic numbers.
+var filesystems = map[uint32]string{
+	unix.EXT4_SUPER_MAGIC:      "ext4", // Also ext2 and ext3.
+	unix.XFS_SUPER_MAGIC:       "xfs",
+	unix.BTRFS_SUPER_MAGIC:     "btrfs",
+	unix.F2FS_SUPER_MAGIC:      "f2fs",
+	0x2fc12fc1:                 "zfs",
+	unix.MSDOS_SUPER_MAGIC:     "vfat",
+	unix.EXFAT_SUPER_MAGIC:     "exfat",
+	0x5346544e:                 "ntfs",
+	unix.ISOFS_SUPER_MAGIC:     "iso9660",
+	unix.UDF_SUPER_MAGIC:       "udf",
+	unix.SQUASHFS_MAGIC:        "squashfs",
+	unix.TMPFS_MAGIC:           "tmpfs",
+	unix.RAMFS_MAGIC:           "ramfs",
+	unix.OVERLAYFS_SUPER_MAGIC: "overlay",
+	unix.ECRYPTFS_SUPER_MAGIC:  "ecryptfs",
+
+	unix.NFS_SUPER_MAGIC:  "nfs",
+	unix.SMB_SUPER_MAGIC:  "smb",
+	0xff534d42:            "cifs",
+	0xfe534d42:            "smb2",
+	unix.AFS_FS_MAGIC:     "afs",
+	unix.AFS_SUPER_MAGIC:  "afs",
+	unix.CEPH_SUPER_MAGIC: "ceph",
+	unix.CODA_SUPER_MAGIC: "coda",
+	unix.V9FS_MAGIC:       "9p",
+	unix.FUSE_SUPER_MAGIC: "fuse",
+
+	unix.PROC_SUPER_MAGIC:    "proc",
+	unix.SYSFS_MAGIC:         "sysfs",
+	unix.DEBUGFS_MAGIC:       "debugfs",
+	unix.TRACEFS_MAGIC:       "tracefs",
+	unix.SECURITYFS_MAGIC:    "securityfs",
+	unix.CGROUP_SUPER_MAGIC:  "cgroup",
+	unix.CGROUP2_SUPER_MAGIC: "cgroup2",
+	unix.BPF_FS_MAGIC:        "bpf",
+	unix.EFIVARFS_MAGIC:      "efivarfs",
+	unix.PSTOREFS_MAGIC:      "pstore",
+}
+
+// Filesystems that need to be polled; inotify only sees changes made on the
+// local system for these.
+var pollFilesystems = map[string]bool{
+	"nfs": true, "smb": true, "cifs": true, "smb2": true, "afs": true,
+	"ceph": true, "coda": true, "9p": true, "fuse": true,
+}
+
+// Virtual filesystems where the kernel changes files without sending any
+// events.
+var virtualFilesystems = map[string]bool{
+	"proc": true, "sysfs": true, "debugfs": true, "tracefs": true,
+	"securityfs": true, "cgroup": true, "cgroup2": true, "bpf": true,
+	"efivarfs": true, "pstore": true,
+}
+
+// fsTypeName gets the filesystem type name for path, or "" if it's not known.
+func fsTypeName(path string) string {
+	var st unix.Statfs_t
+	for {
+		err := unix.Statfs(path, &st)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return ""
+		}
+		return filesystems[uint32(st.Type)]
+	}
+}
+
+// pollFSType gets the filesystem type of path if it needs to be polled, or ""
+// if it doesn't.
+func pollFSType(path string) string {
+	if t := fsTypeName(path); pollFilesystems[t] {
+		return t
+	}
+	return ""
+}
@@ -0,0 +1,31 @@
+//go:build netbsd
+
+package fsnotify
+
+import "golang.org/x/sys/unix"
+
+// NetBSD 10 added the same notes as FreeBSD, with the same values; these are
+// not in x/sys/unix yet.
+const (
+	netbsdNoteOpen       = 0x0080
+	netbsdNoteClose      = 0x0100
+	netbsdNoteCloseWrite = 0x0200
+	netbsdNoteRead       = 0x0400
+)
+
+func init() {
+	// kern.osrevision is __NetBSD_Version__; 1000000000 is 10.0.
+	if v, err := unix.SysctlUint32("kern.osrevision"); err == nil && v >= 1000000000 {
+		noteOpen, noteRead = netbsdNoteOpen, netbsdNoteRead
+		noteCloseWrite, noteCloseRead = netbsdNoteCloseWrite, netbsdNoteClose
+	}
+}
+
+// fsTypeName gets the filesystem type name (f_fstypename) for path.
+func fsTypeName(path string) string {
+	var st unix.Statvfs_t
+	if err := unix.Statvfs(path, &st); err != nil {
+		return ""
+	}
+	return unix.ByteSliceToString(st.Fstypename[:])
+}
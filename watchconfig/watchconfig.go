@@ -0,0 +1,407 @@
+// Package watchconfig creates a watcher from a declarative configuration, so
+// that programs can put what to watch in their config files.
+//
+// A configuration looks like this in JSON:
+//
+//	{
+//	    "debounce": "200ms",
+//	    "watches": [
+//	        {"path": "/etc/myapp", "include": ["*.conf"]},
+//	        {"path": "/srv/www", "recursive": true, "exclude": [".git", "*.tmp"],
+//	         "ops": ["create", "write", "remove", "rename"]}
+//	    ]
+//	}
+//
+// [Parse] and [Load] read JSON. The struct fields also have yaml tags and
+// [Duration] implements encoding.TextUnmarshaler, so YAML (or anything else)
+// can be decoded in to a [Config] with the decoder of your choice and then
+// passed to [New].
+package watchconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/esvos/fsnotify"
+)
+
+// Config is the configuration for a watcher.
+type Config struct {
+	// Paths to watch.
+	Watches []Watch `json:"watches" yaml:"watches"`
+
+	// Send Write events only once a file hasn't been written to for this long;
+	// see fsnotify.WithSettled. Zero (the default) sends every Write.
+	Debounce Duration `json:"debounce,omitempty" yaml:"debounce,omitempty"`
+}
+
+// Watch is a single path to watch.
+type Watch struct {
+	// Path to watch; a file or directory.
+	Path string `json:"path" yaml:"path"`
+
+	// Also watch all subdirectories of Path. Every directory is watched
+	// separately, and new directories are added when they're created; events
+	// for files created in a new directory before it's watched are missed.
+	// Directories matching Exclude aren't watched.
+	Recursive bool `json:"recursive,omitempty" yaml:"recursive,omitempty"`
+
+	// Only send events for files matching one of these patterns, or all files
+	// if there are none. Patterns use the filepath.Match syntax and are matched
+	// against the filename, or the path relative to Path if the pattern has a
+	// "/" in it.
+	Include []string `json:"include,omitempty" yaml:"include,omitempty"`
+
+	// Don't send events for files matching one of these patterns, using the
+	// same syntax as Include. A pattern matching a directory also excludes
+	// everything in it.
+	Exclude []string `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+
+	// Operations to watch: any of "create", "write", "remove", "rename",
+	// "chmod", or the name of an unportable operation without the Unportable
+	// prefix ("close_write", "mount", etc.). The default is to watch create,
+	// write, remove, rename, and chmod.
+	Ops []string `json:"ops,omitempty" yaml:"ops,omitempty"`
+}
+
+// Duration is a time.Duration that's written as a string like "1.5s" or
+// "200ms", as accepted by time.ParseDuration.
+type Duration time.Duration
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) { return []byte(time.Duration(d).String()), nil }
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(text []byte) error {
+	dd, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(dd)
+	return nil
+}
+
+var ops = map[string]fsnotify.Op{
+	"create":      fsnotify.Create,
+	"write":       fsnotify.Write,
+	"remove":      fsnotify.Remove,
+	"rename":      fsnotify.Rename,
+	"chmod":       fsnotify.Chmod,
+	"close_write": fsnotify.UnportableCloseWrite,
+	"security":    fsnotify.UnportableSecurity,
+	"extend":      fsnotify.UnportableExtend,
+	"truncate":    fsnotify.UnportableTruncate,
+	"mount":       fsnotify.UnportableMount,
+	"unmount":     fsnotify.UnportableUnmount,
+	"mode":        fsnotify.UnportableMode,
+	"owner":       fsnotify.UnportableOwner,
+	"times":       fsnotify.UnportableTimes,
+	"xattr":       fsnotify.UnportableXattr,
+	"acl":         fsnotify.UnportableACL,
+	"link":        fsnotify.UnportableLink,
+	"unlink":      fsnotify.UnportableUnlink,
+	"clone":       fsnotify.UnportableClone,
+}
+
+// Parse parses a JSON configuration, and checks it with [Config.Validate].
+// Unknown fields are an error.
+func Parse(data []byte) (Config, error) {
+	var c Config
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&c); err != nil {
+		return Config{}, fmt.Errorf("watchconfig: %w", err)
+	}
+	return c, c.Validate()
+}
+
+// Load reads and parses a JSON configuration file.
+func Load(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("watchconfig: %w", err)
+	}
+	return Parse(data)
+}
+
+// Validate checks if the configuration is valid. It doesn't check if the paths
+// exist.
+func (c Config) Validate() error {
+	if len(c.Watches) == 0 {
+		return errors.New("watchconfig: no watches")
+	}
+	if c.Debounce < 0 {
+		return fmt.Errorf("watchconfig: negative debounce: %s", time.Duration(c.Debounce))
+	}
+	for i, w := range c.Watches {
+		if w.Path == "" {
+			return fmt.Errorf("watchconfig: watch %d: no path", i)
+		}
+		if _, err := w.op(); err != nil {
+			return fmt.Errorf("watchconfig: watch %q: %w", w.Path, err)
+		}
+		for _, pats := range [][]string{w.Include, w.Exclude} {
+			for _, p := range pats {
+				if _, err := filepath.Match(p, ""); err != nil {
+					return fmt.Errorf("watchconfig: watch %q: pattern %q: %w", w.Path, p, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (w Watch) op() (fsnotify.Op, error) {
+	if len(w.Ops) == 0 {
+		return fsnotify.Create | fsnotify.Write | fsnotify.Remove | fsnotify.Rename | fsnotify.Chmod, nil
+	}
+	var op fsnotify.Op
+	for _, o := range w.Ops {
+		oo, ok := ops[strings.ToLower(o)]
+		if !ok {
+			return 0, fmt.Errorf("unknown operation %q", o)
+		}
+		op |= oo
+	}
+	return op, nil
+}
+
+// matches reports if the event path is included by the watch; rel is the path
+// relative to the watched path.
+func (w Watch) matches(rel string) bool {
+	if w.excluded(rel) {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	elems := strings.Split(rel, "/")
+	if len(w.Include) == 0 {
+		return true
+	}
+	for _, p := range w.Include {
+		name := elems[len(elems)-1]
+		if strings.Contains(p, "/") {
+			name = rel
+		}
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded reports if rel, or one of the directories it's in, matches Exclude.
+func (w Watch) excluded(rel string) bool {
+	elems := strings.Split(filepath.ToSlash(rel), "/")
+	for _, p := range w.Exclude {
+		if strings.Contains(p, "/") {
+			for i := range elems {
+				if ok, _ := filepath.Match(p, strings.Join(elems[:i+1], "/")); ok {
+					return true
+				}
+			}
+			continue
+		}
+		for _, e := range elems {
+			if ok, _ := filepath.Match(p, e); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Watcher watches the paths from a [Config].
+type Watcher struct {
+	// Events sends the events for the watched paths that aren't filtered by
+	// Include and Exclude.
+	Events chan fsnotify.Event
+
+	// Errors sends any errors from the watcher; this must be read, like
+	// fsnotify.Watcher.Errors.
+	Errors chan error
+
+	w       *fsnotify.Watcher
+	watches []Watch // Sorted longest path first.
+
+	done     chan struct{}
+	doneMu   sync.Mutex
+	doneResp chan struct{}
+}
+
+// New creates a watcher for the configuration, after checking it with
+// [Config.Validate]. No watcher is created if adding any of the paths fails.
+func New(c Config) (*Watcher, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	var (
+		w   *fsnotify.Watcher
+		err error
+	)
+	if c.Debounce > 0 {
+		w, err = fsnotify.NewWatcherWith(fsnotify.WithSettled(time.Duration(c.Debounce)))
+	} else {
+		w, err = fsnotify.NewWatcher()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cw := &Watcher{
+		Events:   make(chan fsnotify.Event),
+		Errors:   make(chan error),
+		w:        w,
+		watches:  make([]Watch, 0, len(c.Watches)),
+		done:     make(chan struct{}),
+		doneResp: make(chan struct{}),
+	}
+	for _, ww := range c.Watches {
+		ww.Path = filepath.Clean(ww.Path)
+		if err := cw.add(ww.Path, ww); err != nil {
+			w.Close()
+			return nil, err
+		}
+		cw.watches = append(cw.watches, ww)
+	}
+	sort.SliceStable(cw.watches, func(i, j int) bool { return len(cw.watches[i].Path) > len(cw.watches[j].Path) })
+
+	go cw.run()
+	return cw, nil
+}
+
+// add path for the watch ww, and all directories in it if it's recursive.
+func (c *Watcher) add(path string, ww Watch) error {
+	op, _ := ww.op()
+	if !ww.Recursive {
+		return c.w.AddWith(path, fsnotify.WithOps(op))
+	}
+	// Create is needed to add new directories; it's filtered in run().
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != path {
+			if !d.IsDir() {
+				return nil
+			}
+			if rel, _ := filepath.Rel(ww.Path, p); ww.excluded(rel) {
+				return filepath.SkipDir
+			}
+		}
+		return c.w.AddWith(p, fsnotify.WithOps(op|fsnotify.Create))
+	})
+}
+
+// watch gets the watch with the longest path that contains path.
+func (c *Watcher) watch(path string) (Watch, string, bool) {
+	for _, w := range c.watches {
+		if path == w.Path {
+			return w, ".", true
+		}
+		rel, err := filepath.Rel(w.Path, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return w, rel, true
+	}
+	return Watch{}, "", false
+}
+
+// Returns true if the event was sent, or false if watcher is closed.
+func (c *Watcher) sendEvent(e fsnotify.Event) bool {
+	select {
+	case <-c.done:
+		return false
+	case c.Events <- e:
+		return true
+	}
+}
+
+// Returns true if the error was sent, or false if watcher is closed.
+func (c *Watcher) sendError(err error) bool {
+	select {
+	case <-c.done:
+		return false
+	case c.Errors <- err:
+		return true
+	}
+}
+
+func (c *Watcher) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops watching and closes the Events and Errors channels.
+func (c *Watcher) Close() error {
+	c.doneMu.Lock()
+	if c.isClosed() {
+		c.doneMu.Unlock()
+		return nil
+	}
+	close(c.done)
+	c.doneMu.Unlock()
+
+	err := c.w.Close()
+	<-c.doneResp
+	return err
+}
+
+func (c *Watcher) run() {
+	defer func() {
+		close(c.doneResp)
+		close(c.Errors)
+		close(c.Events)
+	}()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case err, ok := <-c.w.Errors:
+			if !ok {
+				return
+			}
+			if !c.sendError(err) {
+				return
+			}
+		case e, ok := <-c.w.Events:
+			if !ok {
+				return
+			}
+			ww, rel, ok := c.watch(e.Name)
+			if ok && ww.Recursive && e.Has(fsnotify.Create) {
+				if st, err := os.Lstat(e.Name); err == nil && st.IsDir() && !ww.excluded(rel) {
+					err := c.add(e.Name, ww)
+					if err != nil && !errors.Is(err, fs.ErrNotExist) && !c.sendError(err) {
+						return
+					}
+				}
+				if op, _ := ww.op(); !op.Has(fsnotify.Create) {
+					if e.Op &^= fsnotify.Create; e.Op == 0 {
+						continue
+					}
+				}
+			}
+			// Use the Include and Exclude of the watch with the longest path
+			// that contains it.
+			if (!ok || rel == "." || ww.matches(rel)) && !c.sendEvent(e) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package watchconfig
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esvos/fsnotify"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr string
+	}{
+		{`{"watches": [{"path": "/tmp"}]}`, ""},
+		{`{"watches": [{"path": "/tmp", "ops": ["create", "WRITE", "close_write"]}], "debounce": "1s"}`, ""},
+		{`{}`, "no watches"},
+		{`{"watches": [{}]}`, "no path"},
+		{`{"watches": [{"path": "/tmp", "ops": ["create", "nope"]}]}`, `unknown operation "nope"`},
+		{`{"watches": [{"path": "/tmp", "include": ["[x"]}]}`, "syntax error in pattern"},
+		{`{"watches": [{"path": "/tmp"}], "debounce": "1x"}`, "unknown unit"},
+		{`{"watches": [{"path": "/tmp"}], "debounce": "-1s"}`, "negative debounce"},
+		{`{"watches": [{"path": "/tmp", "recursve": true}]}`, "unknown field"},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			_, err := Parse([]byte(tt.in))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("wrong error\nhave: %v\nwant: %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		include, exclude []string
+		path             string
+		want             bool
+	}{
+		{nil, nil, "file", true},
+		{[]string{"*.conf"}, nil, "app.conf", true},
+		{[]string{"*.conf"}, nil, "dir/app.conf", true},
+		{[]string{"*.conf"}, nil, "app.json", false},
+		{[]string{"dir/*.conf"}, nil, "dir/app.conf", true},
+		{[]string{"dir/*.conf"}, nil, "app.conf", false},
+		{nil, []string{".git"}, ".git", false},
+		{nil, []string{".git"}, ".git/index", false},
+		{nil, []string{"*.tmp"}, "dir/x.tmp", false},
+		{nil, []string{"dir/sub"}, "dir/sub/file", false},
+		{nil, []string{"dir/sub"}, "other/sub/file", true},
+		{[]string{"*.conf"}, []string{"old"}, "old/app.conf", false},
+	}
+
+	for _, tt := range tests {
+		t.Run("", func(t *testing.T) {
+			w := Watch{Include: tt.include, Exclude: tt.exclude}
+			if have := w.matches(filepath.FromSlash(tt.path)); have != tt.want {
+				t.Errorf("%q (include %q, exclude %q): have %t; want %t", tt.path, tt.include, tt.exclude, have, tt.want)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.Mkdir(filepath.Join(tmp, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Parse([]byte(`{"watches": [
+		{"path": "` + filepath.ToSlash(tmp) + `", "exclude": ["*.tmp"], "ops": ["create"]},
+		{"path": "` + filepath.ToSlash(filepath.Join(tmp, "dir")) + `", "include": ["*.conf"]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for _, f := range []string{"x.tmp", "file", "dir/x.json", "dir/app.conf"} {
+		if err := os.WriteFile(filepath.Join(tmp, f), []byte("data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		have    []string
+		timeout = time.After(500 * time.Millisecond)
+	)
+loop:
+	for {
+		select {
+		case e := <-w.Events:
+			rel, _ := filepath.Rel(tmp, e.Name)
+			have = append(have, rel)
+		case err := <-w.Errors:
+			t.Fatal(err)
+		case <-timeout:
+			break loop
+		}
+	}
+	for _, h := range have {
+		switch filepath.ToSlash(h) {
+		case "file", "dir/app.conf":
+		default:
+			t.Errorf("unexpected event for %q", h)
+		}
+	}
+	if len(have) == 0 || filepath.ToSlash(have[len(have)-1]) != "dir/app.conf" {
+		t.Errorf("no event for dir/app.conf: %q", have)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-w.Events; ok {
+		t.Error("Events not closed")
+	}
+}
+
+func TestNewError(t *testing.T) {
+	tmp := t.TempDir()
+	_, err := New(Config{Watches: []Watch{{Path: tmp}, {Path: filepath.Join(tmp, "nonexistent")}}})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("wrong error: %v", err)
+	}
+}
+
+// Recursive watches shouldn't depend on recursion support in fsnotify.
+func TestNewRecursive(t *testing.T) {
+	tmp := t.TempDir()
+	for _, d := range []string{"a/b", ".git"} {
+		if err := os.MkdirAll(filepath.Join(tmp, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w, err := New(Config{Watches: []Watch{{Path: tmp, Recursive: true, Exclude: []string{".git"}, Ops: []string{"write"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for _, p := range w.w.WatchList() {
+		if filepath.Base(p) == ".git" {
+			t.Errorf("excluded directory is watched: %q", p)
+		}
+	}
+
+	// New directories are watched once the Create is read.
+	if err := os.Mkdir(filepath.Join(tmp, "new"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if len(w.w.WatchList()) == 4 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("new directory not watched: %q", w.w.WatchList())
+		}
+	}
+
+	for _, f := range []string{"a/b/file", ".git/index", "new/file"} {
+		if err := os.WriteFile(filepath.Join(tmp, f), []byte("data"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		have    = make(map[string]bool)
+		timeout = time.After(500 * time.Millisecond)
+	)
+loop:
+	for {
+		select {
+		case e := <-w.Events:
+			if e.Op != fsnotify.Write {
+				t.Errorf("unexpected event: %s", e)
+			}
+			rel, _ := filepath.Rel(tmp, e.Name)
+			have[filepath.ToSlash(rel)] = true
+		case err := <-w.Errors:
+			t.Fatal(err)
+		case <-timeout:
+			break loop
+		}
+	}
+	if !have["a/b/file"] || !have["new/file"] || len(have) != 2 {
+		t.Errorf("wrong events: %v", have)
+	}
+}
@@ -0,0 +1,134 @@
+package fsnotify
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// WatchFS is a file system that can be watched for changes.
+//
+// Libraries that use an fs.FS can check if it implements this to get change
+// notifications, for example to reload templates. [DirFS] returns a WatchFS for
+// a directory on the OS filesystem.
+type WatchFS interface {
+	fs.FS
+
+	// Watch starts watching name for changes, which is a path as accepted by
+	// fs.ValidPath: slash-separated and unrooted, with "." for the root.
+	//
+	// Watching a directory watches the files in it, non-recursively, just
+	// like [Watcher.Add].
+	Watch(name string) (FSWatch, error)
+}
+
+// FSWatch is a watch from [WatchFS.Watch].
+type FSWatch interface {
+	// Events sends the changes. The Name is a path in the FS (like
+	// "dir/file"), not an OS path.
+	Events() <-chan Event
+
+	// Errors sends any errors; this must be read, like Watcher.Errors.
+	Errors() <-chan error
+
+	// Close stops watching and closes the Events and Errors channels.
+	Close() error
+}
+
+// Watch starts watching name in fsys, if fsys implements [WatchFS].
+func Watch(fsys fs.FS, name string) (FSWatch, error) {
+	w, ok := fsys.(WatchFS)
+	if !ok {
+		return nil, &fs.PathError{Op: "watch", Path: name, Err: fmt.Errorf("%w: %T doesn't implement WatchFS", xErrUnsupported, fsys)}
+	}
+	return w.Watch(name)
+}
+
+// DirFS returns a [WatchFS] for the directory dir; this is os.DirFS(dir) with
+// a Watch method, which uses a new [Watcher] for every watch.
+func DirFS(dir string) WatchFS {
+	return dirFS{FS: os.DirFS(dir), dir: dir}
+}
+
+type dirFS struct {
+	fs.FS
+	dir string
+}
+
+func (d dirFS) Watch(name string) (FSWatch, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "watch", Path: name, Err: fs.ErrInvalid}
+	}
+
+	w, err := NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	root := filepath.Clean(d.dir)
+	if err := w.Add(filepath.Join(root, filepath.FromSlash(name))); err != nil {
+		w.Close()
+		return nil, &fs.PathError{Op: "watch", Path: name, Err: err}
+	}
+
+	dw := &dirWatch{
+		w:       w,
+		root:    root,
+		events:  make(chan Event),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go dw.run()
+	return dw, nil
+}
+
+type dirWatch struct {
+	w         *Watcher
+	root      string
+	events    chan Event
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (dw *dirWatch) Events() <-chan Event { return dw.events }
+func (dw *dirWatch) Errors() <-chan error { return dw.w.Errors }
+
+func (dw *dirWatch) Close() error {
+	dw.closeOnce.Do(func() { close(dw.closing) })
+	err := dw.w.Close()
+	<-dw.done
+	return err
+}
+
+// run converts the names to paths in the FS.
+func (dw *dirWatch) run() {
+	defer func() {
+		close(dw.events)
+		close(dw.done)
+	}()
+	for e := range dw.w.Events {
+		e.Name = dw.rel(e.Name)
+		if e.RenamedFrom != "" {
+			e.RenamedFrom = dw.rel(e.RenamedFrom)
+		}
+		select {
+		case <-dw.closing:
+			return
+		case dw.events <- e:
+		}
+	}
+}
+
+func (dw *dirWatch) rel(path string) string {
+	if path == dw.root {
+		return "."
+	}
+	prefix := dw.root
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+	return filepath.ToSlash(strings.TrimPrefix(path, prefix))
+}
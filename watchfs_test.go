@@ -0,0 +1,69 @@
+package fsnotify
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestDirFS(t *testing.T) {
+	t.Parallel()
+
+	tmp := t.TempDir()
+	mkdir(t, tmp, "dir")
+	fsys := DirFS(tmp)
+
+	if _, err := fsys.Watch("/dir"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("wrong error for invalid path: %v", err)
+	}
+	if _, err := fsys.Watch("nonexistent"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("wrong error for nonexistent path: %v", err)
+	}
+	if _, err := Watch(fstest.MapFS{}, "."); !errors.Is(err, xErrUnsupported) {
+		t.Errorf("wrong error for MapFS: %v", err)
+	}
+
+	w, err := Watch(fsys, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	touch(t, tmp, "dir", "file")
+	eventSeparator()
+	mv(t, join(tmp, "dir", "file"), tmp, "dir", "renamed")
+
+	var have []Event
+	timeout := time.After(time.Second)
+loop:
+	for {
+		select {
+		case err := <-w.Errors():
+			t.Fatal(err)
+		case e := <-w.Events():
+			have = append(have, e)
+		case <-timeout:
+			break loop
+		}
+	}
+	for i := range have {
+		if f := have[i].RenamedFrom; f != "" && f != "dir/file" {
+			t.Errorf("wrong RenamedFrom for %s: %q", have[i], f)
+		}
+		have[i].RenamedFrom = ""
+	}
+	cmpEvents(t, "dir", have, newEvents(t, `
+		create  /file
+		rename  /file
+		create  /renamed
+	`))
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-w.Events(); ok {
+		t.Error("Events not closed")
+	}
+}
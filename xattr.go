@@ -0,0 +1,71 @@
+//go:build !appengine && (linux || darwin)
+
+package fsnotify
+
+import (
+	"bytes"
+	"hash/fnv"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// Extended attributes can be read for UnportableXattr.
+const hasXattr = true
+
+// xattrSum gets a checksum of the names and values of the extended attributes
+// of path (without following symlinks), or 0 if they can't be read.
+//
+// Only the attributes in only are read if it's not empty.
+func xattrSum(path string, only ...string) uint64 {
+	names := only
+	if len(names) == 0 {
+		list, err := readXattr(func(b []byte) (int, error) { return unix.Llistxattr(path, b) })
+		if err != nil || len(list) == 0 {
+			return 0
+		}
+		for _, n := range bytes.Split(bytes.TrimRight(list, "\x00"), []byte{0}) {
+			names = append(names, string(n))
+		}
+		sort.Strings(names)
+	}
+
+	var (
+		h   = fnv.New64a()
+		any bool
+	)
+	for _, n := range names {
+		v, err := readXattr(func(b []byte) (int, error) { return unix.Lgetxattr(path, n, b) })
+		if err != nil {
+			continue
+		}
+		any = true
+		h.Write([]byte(n))
+		h.Write([]byte{0})
+		h.Write(v)
+		h.Write([]byte{0})
+	}
+	if !any {
+		return 0
+	}
+	return h.Sum64()
+}
+
+// readXattr calls get with a buffer large enough for the result.
+func readXattr(get func([]byte) (int, error)) ([]byte, error) {
+	for {
+		sz, err := get(nil)
+		if err != nil || sz == 0 {
+			return nil, err
+		}
+		buf := make([]byte, sz)
+		n, err := get(buf)
+		if err == unix.ERANGE { // Changed between the two calls.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
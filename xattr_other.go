@@ -0,0 +1,10 @@
+//go:build !appengine && (freebsd || openbsd || netbsd || dragonfly)
+
+package fsnotify
+
+const hasXattr = false
+
+// No ACLs as extended attributes.
+var aclXattrs []string
+
+func xattrSum(path string, only ...string) uint64 { return 0 }